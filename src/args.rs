@@ -15,6 +15,9 @@ pub enum Commands {
     AddServer(AddServerArgs),
     /// Run a command jailed through a named WireCage server
     Run(RunArgs),
+    /// Measure throughput to a server's speed test service, from inside a
+    /// cage
+    Speedtest(SpeedtestArgs),
 }
 
 #[derive(ClapArgs, Debug, Clone)]
@@ -30,10 +33,58 @@ pub struct AddServerArgs {
     pub token: Option<String>,
 }
 
+#[derive(ClapArgs, Debug, Clone)]
+pub struct SpeedtestArgs {
+    /// The service's HOST:PORT, for example 10.200.100.1:8080
+    pub address: String,
+
+    /// How long to run each test for
+    #[arg(long, default_value_t = 10)]
+    pub seconds: u64,
+
+    /// Also send UDP at this many Mbit/s and count the echoes for loss
+    #[arg(long, value_name = "MBPS")]
+    pub udp_mbps: Option<f64>,
+}
+
+/// When the tunnel goes through the server's relay
+#[derive(Debug, Clone, Copy, PartialEq, Eq, clap::ValueEnum)]
+pub enum RelayMode {
+    /// Once handshakes over UDP go unanswered
+    Auto,
+    /// From the start
+    Always,
+    /// Never; UDP only
+    Never,
+}
+
 #[derive(ClapArgs, Debug, Clone)]
 pub struct RunArgs {
-    /// Name of the configured server to use
-    pub server: String,
+    /// Name of the configured server to use (omit with --enroll-url)
+    #[arg(required_unless_present = "enroll_url")]
+    pub server: Option<String>,
+
+    /// Register directly against this server API instead of a configured
+    /// server, generating a key on first use (needs --enroll-token or --ssh-key)
+    #[arg(long, env = "WIRECAGE_ENROLL_URL")]
+    pub enroll_url: Option<String>,
+
+    /// Enrollment (or auth) token to present with --enroll-url
+    #[arg(long, env = "WIRECAGE_ENROLL_TOKEN", hide_env_values = true)]
+    pub enroll_token: Option<String>,
+
+    /// One-time code for enrollment tokens that require TOTP
+    #[arg(long, env = "WIRECAGE_TOTP_CODE")]
+    pub totp_code: Option<String>,
+
+    /// Sign the registration with this SSH key, for servers that authorize
+    /// enrollment by SSH key
+    #[arg(long, env = "WIRECAGE_SSH_KEY")]
+    pub ssh_key: Option<std::path::PathBuf>,
+
+    /// Ask the server for a preshared key to harden the handshake
+    #[arg(long, env = "WIRECAGE_PRESHARED_KEY")]
+    pub preshared_key: bool,
 
     #[arg(long, default_value = "wirecage", help = "name of the TUN device")]
     pub tun: String,
@@ -68,18 +119,47 @@ pub struct RunArgs {
     )]
     pub log_level: String,
 
+    #[arg(
+        long,
+        value_enum,
+        default_value = "auto",
+        env = "WIRECAGE_RELAY",
+        help = "when to tunnel over the server's WebSocket relay instead of UDP"
+    )]
+    pub relay: RelayMode,
+
     #[arg(long = "wg-public-key", hide = true, env = "WIRECAGE_WG_PUBLIC_KEY")]
     pub wg_public_key: Option<String>,
 
     #[arg(long = "wg-private-key-file", hide = true, env = "WIRECAGE_WG_PRIVATE_KEY_FILE")]
     pub wg_private_key_file: Option<String>,
 
+    #[arg(
+        long = "wg-preshared-key",
+        hide = true,
+        env = "WIRECAGE_WG_PRESHARED_KEY",
+        hide_env_values = true
+    )]
+    pub wg_preshared_key: Option<String>,
+
     #[arg(long = "wg-endpoint", hide = true, env = "WIRECAGE_WG_ENDPOINT")]
     pub wg_endpoint: Option<String>,
 
+    #[arg(long = "wg-relay-url", hide = true, env = "WIRECAGE_WG_RELAY_URL")]
+    pub wg_relay_url: Option<String>,
+
     #[arg(long = "wg-address", hide = true, env = "WIRECAGE_WG_ADDRESS")]
     pub wg_address: Option<String>,
 
+    #[arg(long = "wg-address6", hide = true, env = "WIRECAGE_WG_ADDRESS6")]
+    pub wg_address6: Option<String>,
+
+    #[arg(long = "wg-dns", hide = true, env = "WIRECAGE_WG_DNS")]
+    pub wg_dns: Option<String>,
+
+    #[arg(long = "wg-obfuscation", hide = true, env = "WIRECAGE_WG_OBFUSCATION")]
+    pub wg_obfuscation: Option<String>,
+
     #[arg(trailing_var_arg = true, help = "command to run")]
     pub command: Vec<String>,
 }
@@ -139,10 +219,18 @@ impl RunArgs {
     }
 
     pub fn get_command(&self) -> Vec<String> {
-        if self.command.is_empty() {
+        // Without a server name, clap hands the first word of the command
+        // to the `server` positional
+        let command: Vec<String> = match (&self.enroll_url, &self.server) {
+            (Some(_), Some(first)) => std::iter::once(first.clone())
+                .chain(self.command.iter().cloned())
+                .collect(),
+            _ => self.command.clone(),
+        };
+        if command.is_empty() {
             vec!["/bin/sh".to_string()]
         } else {
-            self.command.clone()
+            command
         }
     }
 
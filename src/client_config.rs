@@ -33,16 +33,56 @@ pub struct KeyMaterial {
 #[derive(Debug, Clone, Deserialize)]
 pub struct RegisterResponse {
     pub client_address: String,
+    /// IPv6 address in the server's prefix, if it gives peers one
+    #[serde(default)]
+    pub client_address_v6: Option<String>,
     pub server_public_key: String,
     pub server_endpoint: String,
+    /// WebSocket relay to tunnel through where UDP is blocked, if the server
+    /// runs one
+    #[serde(default)]
+    pub relay_url: Option<String>,
+    #[serde(default)]
+    pub preshared_key: Option<String>,
+    /// Resolver to use inside the tunnel, if the server names one, such as
+    /// its DNS64 one for IPv6-only peers
+    #[serde(default)]
+    pub dns_server: Option<String>,
+    /// AmneziaWG parameters to obfuscate the tunnel with, if the server
+    /// obfuscates this peer
+    #[serde(default)]
+    pub obfuscation: Option<String>,
 }
 
 #[derive(Debug, Serialize)]
 struct RegisterRequest<'a> {
     token: &'a str,
     client_public_key: &'a str,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    totp_code: Option<&'a str>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    ssh_signature: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    ssh_timestamp: Option<u64>,
+    #[serde(skip_serializing_if = "std::ops::Not::not")]
+    preshared_key: bool,
+}
+
+/// Extra proof of identity sent when registering
+#[derive(Debug, Clone, Default)]
+pub struct RegisterCredentials {
+    /// Code for enrollment tokens that require TOTP
+    pub totp_code: Option<String>,
+    /// SSH key (or its public half, with the private key in the agent) to
+    /// sign the registration with
+    pub ssh_key: Option<PathBuf>,
+    /// Ask the server for a preshared key
+    pub preshared_key: bool,
 }
 
+/// Namespace and message format the server expects SSH signatures in
+const SSH_NAMESPACE: &str = "wirecage-enroll";
+
 fn default_version() -> u32 {
     1
 }
@@ -109,6 +149,14 @@ pub fn get_server(name: &str) -> Result<ServerConfig> {
         .with_context(|| format!("server `{}` not found in {}", name, path.display()))
 }
 
+/// Server settings for `--enroll-url` mode, which bypasses the config file
+pub fn enrollment_server(api_url: &str, token: Option<String>) -> ServerConfig {
+    ServerConfig {
+        api_url: normalize_api_url(api_url),
+        token,
+    }
+}
+
 pub fn ensure_client_key(server_name: &str) -> Result<KeyMaterial> {
     let root = config_root()?;
     let key_dir = root.join("keys");
@@ -147,9 +195,23 @@ pub fn ensure_client_key(server_name: &str) -> Result<KeyMaterial> {
     })
 }
 
-pub fn register_with_server(server: &ServerConfig, client_public_key: &str) -> Result<RegisterResponse> {
+pub fn register_with_server(
+    server: &ServerConfig,
+    client_public_key: &str,
+    credentials: &RegisterCredentials,
+) -> Result<RegisterResponse> {
     let url = format!("{}/v1/register", normalize_api_url(&server.api_url));
     let token = server.token.clone().unwrap_or_default();
+    let (ssh_signature, ssh_timestamp) = match &credentials.ssh_key {
+        Some(ssh_key) => {
+            let timestamp = std::time::SystemTime::now()
+                .duration_since(std::time::UNIX_EPOCH)?
+                .as_secs();
+            let message = format!("{} {} {}", SSH_NAMESPACE, client_public_key, timestamp);
+            (Some(ssh_sign(ssh_key, &message)?), Some(timestamp))
+        }
+        None => (None, None),
+    };
     let http = Client::builder()
         .timeout(Duration::from_secs(10))
         .build()
@@ -160,6 +222,10 @@ pub fn register_with_server(server: &ServerConfig, client_public_key: &str) -> R
         .json(&RegisterRequest {
             token: &token,
             client_public_key,
+            totp_code: credentials.totp_code.as_deref(),
+            ssh_signature,
+            ssh_timestamp,
+            preshared_key: credentials.preshared_key,
         })
         .send()
         .context("registration request failed")?;
@@ -173,6 +239,30 @@ pub fn register_with_server(server: &ServerConfig, client_public_key: &str) -> R
     response.json().context("failed to decode registration response")
 }
 
+/// Sign `message` with `ssh-keygen -Y sign`, which also uses the SSH agent
+fn ssh_sign(key: &Path, message: &str) -> Result<String> {
+    use std::io::Write;
+    use std::process::{Command, Stdio};
+
+    let mut child = Command::new("ssh-keygen")
+        .args(["-Y", "sign", "-n", SSH_NAMESPACE, "-f"])
+        .arg(key)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .spawn()
+        .context("failed to run ssh-keygen")?;
+    child
+        .stdin
+        .take()
+        .context("ssh-keygen stdin unavailable")?
+        .write_all(message.as_bytes())?;
+    let output = child.wait_with_output().context("ssh-keygen failed")?;
+    if !output.status.success() {
+        anyhow::bail!("ssh-keygen could not sign with {}", key.display());
+    }
+    String::from_utf8(output.stdout).context("ssh-keygen printed an invalid signature")
+}
+
 pub fn strip_mask(client_address: &str) -> &str {
     client_address.split('/').next().unwrap_or(client_address)
 }
@@ -2,7 +2,11 @@ mod args;
 mod client_config;
 mod namespace;
 mod network_new;
+mod obfuscation;
 mod overlay;
+mod relay;
+mod speedtest;
+mod wg_mac;
 mod wireguard;
 
 use anyhow::{Context, Result};
@@ -11,7 +15,7 @@ use std::os::unix::process::CommandExt;
 use std::process::Command;
 use tracing::{debug, info};
 
-use args::{Cli, Commands, RunArgs};
+use args::{Cli, Commands, RelayMode, RunArgs};
 use namespace::Stage;
 
 fn main() -> Result<()> {
@@ -31,6 +35,7 @@ fn main() -> Result<()> {
             info!("Saved server `{}` to {}", args.name, path.display());
             Ok(())
         }
+        Commands::Speedtest(args) => speedtest::run(&args),
         Commands::Run(args) => {
             let stage = Stage::from_argv0()?;
             match stage {
@@ -43,7 +48,7 @@ fn main() -> Result<()> {
 
 fn log_level_for(cli: &Cli) -> &str {
     match &cli.command {
-        Commands::AddServer(_) => "info",
+        Commands::AddServer(_) | Commands::Speedtest(_) => "info",
         Commands::Run(args) => &args.log_level,
     }
 }
@@ -51,10 +56,31 @@ fn log_level_for(cli: &Cli) -> &str {
 fn stage_one(args: RunArgs) -> Result<()> {
     debug!("at first stage, resolving server configuration and preparing new user namespace...");
 
-    let server = client_config::get_server(&args.server)?;
-    let key = client_config::ensure_client_key(&args.server)?;
-    let registration = client_config::register_with_server(&server, &key.public_key_b64)?;
+    let (server, key_name) = match &args.enroll_url {
+        Some(_) if args.enroll_token.is_none() && args.ssh_key.is_none() => {
+            anyhow::bail!("--enroll-url needs --enroll-token or --ssh-key");
+        }
+        Some(url) => (
+            client_config::enrollment_server(url, args.enroll_token.clone()),
+            format!("enroll-{}", url),
+        ),
+        None => {
+            let name = args.server.as_deref().context("server name is required")?;
+            (client_config::get_server(name)?, name.to_string())
+        }
+    };
+    let key = client_config::ensure_client_key(&key_name)?;
+    let credentials = client_config::RegisterCredentials {
+        totp_code: args.totp_code.clone(),
+        ssh_key: args.ssh_key.clone(),
+        preshared_key: args.preshared_key,
+    };
+    let registration =
+        client_config::register_with_server(&server, &key.public_key_b64, &credentials)?;
     let wg_address = client_config::strip_mask(&registration.client_address).to_string();
+    if args.relay == RelayMode::Always && registration.relay_url.is_none() {
+        anyhow::bail!("--relay always, but the server offers no relay");
+    }
 
     let (uid, gid) = args.resolve_target_user()?;
     let current_uid = nix::unistd::getuid();
@@ -71,7 +97,8 @@ fn stage_one(args: RunArgs) -> Result<()> {
             Box::new(|| {
                 std::thread::sleep(std::time::Duration::from_millis(50));
 
-                let err = Command::new("/proc/self/exe")
+                let mut command = Command::new("/proc/self/exe");
+                command
                     .args(std::env::args().skip(1))
                     .env("WIRECAGE_STAGE", "2")
                     .env("WIRECAGE_UID", uid.to_string())
@@ -79,8 +106,23 @@ fn stage_one(args: RunArgs) -> Result<()> {
                     .env("WIRECAGE_WG_PUBLIC_KEY", registration.server_public_key.clone())
                     .env("WIRECAGE_WG_PRIVATE_KEY_FILE", key.private_key_path.display().to_string())
                     .env("WIRECAGE_WG_ENDPOINT", registration.server_endpoint.clone())
-                    .env("WIRECAGE_WG_ADDRESS", wg_address.clone())
-                    .exec();
+                    .env("WIRECAGE_WG_ADDRESS", wg_address.clone());
+                if let Some(preshared_key) = &registration.preshared_key {
+                    command.env("WIRECAGE_WG_PRESHARED_KEY", preshared_key);
+                }
+                if let Some(relay_url) = &registration.relay_url {
+                    command.env("WIRECAGE_WG_RELAY_URL", relay_url);
+                }
+                if let Some(address) = &registration.client_address_v6 {
+                    command.env("WIRECAGE_WG_ADDRESS6", client_config::strip_mask(address));
+                }
+                if let Some(dns_server) = &registration.dns_server {
+                    command.env("WIRECAGE_WG_DNS", dns_server);
+                }
+                if let Some(obfuscation) = &registration.obfuscation {
+                    command.env("WIRECAGE_WG_OBFUSCATION", obfuscation);
+                }
+                let err = command.exec();
 
                 eprintln!("exec failed: {}", err);
                 1
@@ -157,7 +199,10 @@ fn stage_two(args: RunArgs) -> Result<()> {
 
     let _overlay_guard = if !args.no_overlay {
         debug!("overlaying /etc...");
-        Some(overlay::setup_etc_overlay(&args.gateway)?)
+        Some(overlay::setup_etc_overlay(
+            &args.gateway,
+            args.wg_dns.as_deref(),
+        )?)
     } else {
         None
     };
@@ -105,25 +105,41 @@ fn setup_network_config(args: &RunArgs) -> Result<()> {
             .await
             .context("failed to add address to TUN device")?;
 
-        // Also add a link-local IPv6 address for IPv6 connectivity
-        let ipv6_addr = std::net::Ipv6Addr::new(0xfd42, 0x42, 0x42, 0, 0, 0, 0, 2);
-        debug!("Adding IPv6 address: {}/64", ipv6_addr);
-        let _ = handle
-            .address()
-            .add(link_index, std::net::IpAddr::V6(ipv6_addr), 64)
-            .execute()
-            .await;
-
-        // Add default IPv4 route
-        handle
-            .route()
-            .add()
-            .v4()
-            .destination_prefix(std::net::Ipv4Addr::new(0, 0, 0, 0), 0)
-            .output_interface(link_index)
-            .execute()
-            .await
-            .context("failed to add default IPv4 route")?;
+        // An IPv6-only server gives just an IPv6 address, and there is no
+        // IPv4 to route
+        let ipv6_only = addr.is_ipv6();
+
+        // Use the IPv6 address the server assigned, if any; otherwise add a
+        // placeholder so IPv6 sockets still have a source address
+        let (ipv6_addr, ipv6_prefix_len) = match args.wg_address6.as_deref() {
+            Some(address) => (address.parse().context("invalid wg-address6")?, 128),
+            None => (
+                std::net::Ipv6Addr::new(0xfd42, 0x42, 0x42, 0, 0, 0, 0, 2),
+                64,
+            ),
+        };
+        if !ipv6_only {
+            debug!("Adding IPv6 address: {}/{}", ipv6_addr, ipv6_prefix_len);
+            let added = handle
+                .address()
+                .add(link_index, std::net::IpAddr::V6(ipv6_addr), ipv6_prefix_len)
+                .execute()
+                .await;
+            if args.wg_address6.is_some() {
+                added.context("failed to add IPv6 address to TUN device")?;
+            }
+
+            // Add default IPv4 route
+            handle
+                .route()
+                .add()
+                .v4()
+                .destination_prefix(std::net::Ipv4Addr::new(0, 0, 0, 0), 0)
+                .output_interface(link_index)
+                .execute()
+                .await
+                .context("failed to add default IPv4 route")?;
+        }
 
         // Try to add default IPv6 route (ignore errors)
         let _ = handle
@@ -30,16 +30,19 @@ pub async fn run_wireguard_host(
     let wg_tunnel = WireGuardTunnel::new_simple(
         private_key,
         args.wg_public_key(),
+        args.wg_preshared_key.as_deref(),
         args.wg_endpoint(),
+        args.wg_relay_url.as_deref(),
+        args.relay,
+        args.wg_obfuscation.as_deref(),
     )
     .await?;
 
     let wg_tunnel_tx = wg_tunnel.clone_tunnel();
-    let wg_socket_tx = wg_tunnel.clone_socket();
-    let wg_endpoint = wg_tunnel.endpoint();
+    let wg_transport_tx = wg_tunnel.clone_transport();
 
     let wg_tunnel_rx = wg_tunnel.clone_tunnel();
-    let wg_socket_rx = wg_tunnel.clone_socket();
+    let wg_transport_rx = wg_tunnel.clone_transport();
 
     // Task: Forward packets from TUN (via channel) to WireGuard socket
     let mut tun_to_wg_rx = tun_to_wg_rx;
@@ -58,7 +61,7 @@ pub async fn run_wireguard_host(
                         let wg_packet: Packet = wg_kind.into();
                         let data = wg_packet.as_bytes();
                         debug!("TUN->WG: sending {} bytes to WireGuard", data.len());
-                        if let Err(e) = wg_socket_tx.send_to(data, wg_endpoint).await {
+                        if let Err(e) = wg_transport_tx.send(data).await {
                             error!("TUN->WG: send error: {}", e);
                         }
                         break; // Success, move to next packet
@@ -82,7 +85,7 @@ pub async fn run_wireguard_host(
 
     // Task: Forward packets from WireGuard socket to TUN (via channel)
     let recv_handle = tokio::spawn(async move {
-        let local_addr = wg_socket_rx.local_addr().unwrap();
+        let local_addr = wg_transport_rx.local_addr().unwrap();
         debug!(
             "WG->TUN forwarder started (host namespace), listening on {}",
             local_addr
@@ -92,15 +95,15 @@ pub async fn run_wireguard_host(
 
         loop {
             counter += 1;
-            debug!("WG->TUN: calling recv_from (attempt {})...", counter);
+            debug!("WG->TUN: calling recv (attempt {})...", counter);
             match tokio::time::timeout(
                 std::time::Duration::from_secs(2),
-                wg_socket_rx.recv_from(&mut recv_buf),
+                wg_transport_rx.recv(&mut recv_buf),
             )
             .await
             {
-                Ok(Ok((n, addr))) => {
-                    debug!("WG->TUN: received {} bytes from {}", n, addr);
+                Ok(Ok(n)) => {
+                    debug!("WG->TUN: received {} bytes", n);
                     if n == recv_buf.len() {
                         error!(
                             "WG->TUN: received packet filled the {} byte buffer; packet may be truncated",
@@ -138,7 +141,7 @@ pub async fn run_wireguard_host(
                                 "WG->TUN: got WireGuard protocol message, sending back {} bytes",
                                 data.len()
                             );
-                            if let Err(e) = wg_socket_rx.send_to(data, addr).await {
+                            if let Err(e) = wg_transport_rx.send(data).await {
                                 error!("WG->TUN: failed to send protocol message: {}", e);
                             }
                         }
@@ -164,8 +167,7 @@ pub async fn run_wireguard_host(
 
     // Timer task for WireGuard keepalives
     let wg_tunnel_timer = wg_tunnel.clone_tunnel();
-    let wg_socket_timer = wg_tunnel.clone_socket();
-    let wg_endpoint_timer = wg_tunnel.endpoint();
+    let wg_transport_timer = wg_tunnel.clone_transport();
 
     let timer_handle = tokio::spawn(async move {
         debug!("WireGuard timer started");
@@ -173,6 +175,7 @@ pub async fn run_wireguard_host(
         loop {
             interval.tick().await;
             debug!("Timer: tick");
+            wg_transport_timer.check_fallback();
 
             let mut tunnel = wg_tunnel_timer.lock().await;
 
@@ -181,7 +184,7 @@ pub async fn run_wireguard_host(
                     let wg_packet: Packet = wg_kind.into();
                     let data = wg_packet.as_bytes();
                     debug!("Timer: sending {} bytes", data.len());
-                    let _ = wg_socket_timer.send_to(data, wg_endpoint_timer).await;
+                    let _ = wg_transport_timer.send(data).await;
                 }
                 Ok(None) => {}
                 Err(e) => {
@@ -0,0 +1,175 @@
+//! Client side of the server's AmneziaWG-style obfuscation
+//!
+//! A server that obfuscates a peer's traffic hands it the parameters when
+//! it registers, as `jc=4,jmin=40,jmax=70,s1=15,s2=45,h1=..,h2=..,h3=..,h4=..`.
+//! Messages going out have their type replaced by the `h` value for it and,
+//! for initiations and responses, `s1` or `s2` random bytes put in front;
+//! each initiation sent over UDP follows `jc` junk datagrams. Messages
+//! coming in are turned back into WireGuard's own before the tunnel sees
+//! them.
+//!
+//! mac1 covers the message type, so AmneziaWG makes it over its own
+//! header; it is made again for each rewritten handshake, the same way the
+//! server does.
+
+use std::str::FromStr;
+
+use anyhow::{Context, Result};
+use rand::{Rng, RngCore};
+
+use crate::wg_mac::{mac1_matches, seal_mac1};
+
+const HANDSHAKE_INITIATION: u8 = 1;
+const HANDSHAKE_RESPONSE: u8 = 2;
+const COOKIE_REPLY: u8 = 3;
+const TRANSPORT_DATA: u8 = 4;
+
+const INITIATION_LEN: usize = 148;
+const RESPONSE_LEN: usize = 92;
+const COOKIE_REPLY_LEN: usize = 64;
+/// Header and authentication tag of a transport message with no payload
+const MIN_TRANSPORT_LEN: usize = 32;
+
+/// The parameters the server handed out
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Params {
+    junk_count: u8,
+    junk_min: u16,
+    junk_max: u16,
+    initiation_padding: u16,
+    response_padding: u16,
+    /// Message types of initiations, responses, cookie replies and
+    /// transport data
+    headers: [u32; 4],
+}
+
+impl FromStr for Params {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        let mut params = Params {
+            junk_count: 0,
+            junk_min: 0,
+            junk_max: 0,
+            initiation_padding: 0,
+            response_padding: 0,
+            headers: [1, 2, 3, 4],
+        };
+        for field in s.split(',') {
+            let (name, value) = field
+                .split_once('=')
+                .with_context(|| format!("expected name=value, got `{}`", field))?;
+            let value = value.trim();
+            let invalid = || format!("invalid {}", name);
+            match name.trim() {
+                "jc" => params.junk_count = value.parse().with_context(invalid)?,
+                "jmin" => params.junk_min = value.parse().with_context(invalid)?,
+                "jmax" => params.junk_max = value.parse().with_context(invalid)?,
+                "s1" => params.initiation_padding = value.parse().with_context(invalid)?,
+                "s2" => params.response_padding = value.parse().with_context(invalid)?,
+                "h1" => params.headers[0] = value.parse().with_context(invalid)?,
+                "h2" => params.headers[1] = value.parse().with_context(invalid)?,
+                "h3" => params.headers[2] = value.parse().with_context(invalid)?,
+                "h4" => params.headers[3] = value.parse().with_context(invalid)?,
+                other => anyhow::bail!("unknown obfuscation parameter `{}`", other),
+            }
+        }
+        if params.junk_min > params.junk_max {
+            anyhow::bail!("jmin must be at most jmax");
+        }
+        Ok(params)
+    }
+}
+
+/// Obfuscation of one tunnel's messages
+pub struct Obfuscation {
+    params: Params,
+    /// Receiver of the messages sent, whose key their mac1 is made with
+    server_public_key: [u8; 32],
+    /// Receiver of the messages coming in
+    public_key: [u8; 32],
+}
+
+impl Obfuscation {
+    pub fn new(params: Params, server_public_key: [u8; 32], public_key: [u8; 32]) -> Self {
+        Self {
+            params,
+            server_public_key,
+            public_key,
+        }
+    }
+
+    /// Junk datagrams to send ahead of a handshake initiation
+    pub fn junk(&self) -> Vec<Vec<u8>> {
+        let mut rng = rand::thread_rng();
+        (0..self.params.junk_count)
+            .map(|_| {
+                let len = rng.gen_range(self.params.junk_min..=self.params.junk_max);
+                let mut junk = vec![0u8; usize::from(len)];
+                rng.fill_bytes(&mut junk);
+                junk
+            })
+            .collect()
+    }
+
+    /// A WireGuard message as it goes out
+    pub fn encode(&self, message: &[u8]) -> Vec<u8> {
+        let framing = message.first().and_then(|&kind| self.framing(kind));
+        let Some((header, padding)) = framing.filter(|_| message.len() >= 4) else {
+            return message.to_vec();
+        };
+        let mut packet = vec![0u8; padding];
+        rand::thread_rng().fill_bytes(&mut packet);
+        packet.extend_from_slice(message);
+        packet[padding..padding + 4].copy_from_slice(&header.to_le_bytes());
+        if is_handshake(message[0]) {
+            seal_mac1(&mut packet[padding..], &self.server_public_key);
+        }
+        packet
+    }
+
+    /// Turn the `len` bytes received at the start of `buf` back into a
+    /// WireGuard message in place, returning its length; `None` for
+    /// packets that aren't one, or a handshake whose mac1 isn't ours
+    pub fn decode(&self, buf: &mut [u8], len: usize) -> Option<usize> {
+        let packet = buf.get(..len)?;
+        let (kind, padding) = (1..=4u8).find_map(|kind| {
+            let (header, padding) = self.framing(kind)?;
+            let message = packet.get(padding..)?;
+            let fits = match kind {
+                HANDSHAKE_INITIATION => message.len() == INITIATION_LEN,
+                HANDSHAKE_RESPONSE => message.len() == RESPONSE_LEN,
+                COOKIE_REPLY => message.len() == COOKIE_REPLY_LEN,
+                _ => message.len() >= MIN_TRANSPORT_LEN,
+            };
+            (fits && message[..4] == header.to_le_bytes()).then_some((kind, padding))
+        })?;
+        if is_handshake(kind) && !mac1_matches(&packet[padding..], &self.public_key) {
+            return None;
+        }
+        buf.copy_within(padding..len, 0);
+        let len = len - padding;
+        buf[..4].copy_from_slice(&u32::from(kind).to_le_bytes());
+        if is_handshake(kind) {
+            seal_mac1(&mut buf[..len], &self.public_key);
+        }
+        Some(len)
+    }
+
+    /// The header value of `kind`'s messages and the padding in front of
+    /// them
+    fn framing(&self, kind: u8) -> Option<(u32, usize)> {
+        let header = *self.params.headers.get(usize::from(kind).checked_sub(1)?)?;
+        let padding = match kind {
+            HANDSHAKE_INITIATION => self.params.initiation_padding,
+            HANDSHAKE_RESPONSE => self.params.response_padding,
+            COOKIE_REPLY | TRANSPORT_DATA => 0,
+            _ => return None,
+        };
+        Some((header, usize::from(padding)))
+    }
+}
+
+fn is_handshake(kind: u8) -> bool {
+    kind == HANDSHAKE_INITIATION || kind == HANDSHAKE_RESPONSE
+}
@@ -8,7 +8,7 @@ pub struct OverlayGuard {
     _tmpdir: tempfile::TempDir,
 }
 
-pub fn setup_etc_overlay(_gateway: &str) -> Result<OverlayGuard> {
+pub fn setup_etc_overlay(_gateway: &str, nameserver: Option<&str>) -> Result<OverlayGuard> {
     // Check if /etc exists and is a directory
     if !Path::new("/etc").is_dir() {
         anyhow::bail!("/etc is not a directory");
@@ -26,12 +26,14 @@ pub fn setup_etc_overlay(_gateway: &str) -> Result<OverlayGuard> {
     std::fs::create_dir_all(&workdir).context("failed to create work directory")?;
     std::fs::create_dir_all(&layerdir).context("failed to create layer directory")?;
 
-    // Create resolv.conf in layer pointing to public DNS (will route via WireGuard)
-    std::fs::write(
-        layerdir.join("resolv.conf"),
-        "nameserver 1.1.1.1\nnameserver 8.8.8.8\n",
-    )
-    .context("failed to write resolv.conf")?;
+    // Create resolv.conf in layer pointing to the server's resolver if it
+    // named one, else public DNS (will route via WireGuard)
+    let resolv_conf = match nameserver {
+        Some(nameserver) => format!("nameserver {}\n", nameserver),
+        None => "nameserver 1.1.1.1\nnameserver 8.8.8.8\n".to_string(),
+    };
+    std::fs::write(layerdir.join("resolv.conf"), resolv_conf)
+        .context("failed to write resolv.conf")?;
 
     // Switch to a new mount namespace
     unshare(CloneFlags::CLONE_NEWNS | CloneFlags::CLONE_FS)
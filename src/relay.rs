@@ -0,0 +1,276 @@
+//! Client side of the server's WebSocket relay
+//!
+//! The relay carries the same WireGuard messages as UDP, one per binary
+//! WebSocket message, over a TLS connection to (usually) port 443 that
+//! networks blocking UDP still let through.
+
+use std::sync::Arc;
+use std::time::Duration;
+
+use anyhow::{Context, Result};
+use aws_lc_rs::digest;
+use base64::Engine;
+use bytes::{Buf, BytesMut};
+use rustls::pki_types::ServerName;
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt};
+use tokio::net::TcpStream;
+use tokio::sync::mpsc;
+use tokio_rustls::TlsConnector;
+
+/// Appended to our key to make the accept value the server must answer with
+const ACCEPT_GUID: &str = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11";
+const CONNECT_TIMEOUT: Duration = Duration::from_secs(10);
+const MAX_RESPONSE_LEN: usize = 8192;
+const MAX_MESSAGE_LEN: usize = 65536;
+
+const OP_BINARY: u8 = 0x2;
+const OP_CLOSE: u8 = 0x8;
+const OP_PING: u8 = 0x9;
+const OP_PONG: u8 = 0xa;
+
+trait Stream: AsyncRead + AsyncWrite + Unpin + Send {}
+impl<T: AsyncRead + AsyncWrite + Unpin + Send> Stream for T {}
+
+/// An open relay connection
+pub struct RelayConnection {
+    stream: Box<dyn Stream>,
+    /// Bytes read past the end of the handshake
+    buf: BytesMut,
+}
+
+impl RelayConnection {
+    /// Connect to a `wss://` (or, behind a TLS-terminating proxy on the
+    /// same host, `ws://`) relay URL and open the WebSocket
+    pub async fn connect(url: &str) -> Result<Self> {
+        tokio::time::timeout(CONNECT_TIMEOUT, Self::open(url))
+            .await
+            .with_context(|| format!("timed out connecting to relay {}", url))?
+    }
+
+    async fn open(url: &str) -> Result<Self> {
+        let url =
+            reqwest::Url::parse(url).with_context(|| format!("invalid relay URL `{}`", url))?;
+        let tls = match url.scheme() {
+            "wss" => true,
+            "ws" => false,
+            scheme => anyhow::bail!("unsupported relay URL scheme `{}`", scheme),
+        };
+        let host = url
+            .host_str()
+            .context("relay URL has no host")?
+            .trim_start_matches('[')
+            .trim_end_matches(']')
+            .to_string();
+        let port = url
+            .port_or_known_default()
+            .context("relay URL has no port")?;
+
+        let tcp = TcpStream::connect((host.as_str(), port))
+            .await
+            .with_context(|| format!("failed to connect to relay {}:{}", host, port))?;
+        tcp.set_nodelay(true)?;
+        let mut stream: Box<dyn Stream> = if tls {
+            let name = ServerName::try_from(host.clone())
+                .with_context(|| format!("invalid relay host `{}`", host))?;
+            let stream = tls_connector()?
+                .connect(name, tcp)
+                .await
+                .context("TLS handshake with relay failed")?;
+            Box::new(stream)
+        } else {
+            Box::new(tcp)
+        };
+
+        let key = base64::engine::general_purpose::STANDARD.encode(rand::random::<[u8; 16]>());
+        let path = match url.query() {
+            Some(query) => format!("{}?{}", url.path(), query),
+            None => url.path().to_string(),
+        };
+        let host_header = match url.port() {
+            Some(port) => format!("{}:{}", url.host_str().unwrap_or_default(), port),
+            None => url.host_str().unwrap_or_default().to_string(),
+        };
+        let request = format!(
+            "GET {} HTTP/1.1\r\n\
+             Host: {}\r\n\
+             Upgrade: websocket\r\n\
+             Connection: Upgrade\r\n\
+             Sec-WebSocket-Key: {}\r\n\
+             Sec-WebSocket-Version: 13\r\n\r\n",
+            path, host_header, key
+        );
+        stream.write_all(request.as_bytes()).await?;
+        stream.flush().await?;
+
+        let mut buf = BytesMut::new();
+        let (status, accept, len) = loop {
+            if stream.read_buf(&mut buf).await? == 0 {
+                anyhow::bail!("relay closed the connection during the handshake");
+            }
+            let mut headers = [httparse::EMPTY_HEADER; 32];
+            let mut response = httparse::Response::new(&mut headers);
+            match response
+                .parse(&buf)
+                .context("malformed relay handshake response")?
+            {
+                httparse::Status::Complete(len) => {
+                    let accept = response
+                        .headers
+                        .iter()
+                        .find(|header| header.name.eq_ignore_ascii_case("sec-websocket-accept"))
+                        .map(|header| String::from_utf8_lossy(header.value).trim().to_string());
+                    break (response.code, accept, len);
+                }
+                httparse::Status::Partial if buf.len() >= MAX_RESPONSE_LEN => {
+                    anyhow::bail!("relay handshake response too long");
+                }
+                httparse::Status::Partial => {}
+            }
+        };
+        if status != Some(101) {
+            anyhow::bail!("relay refused the WebSocket: HTTP {}", status.unwrap_or(0));
+        }
+        let hash = digest::digest(
+            &digest::SHA1_FOR_LEGACY_USE_ONLY,
+            format!("{}{}", key, ACCEPT_GUID).as_bytes(),
+        );
+        let expected = base64::engine::general_purpose::STANDARD.encode(hash.as_ref());
+        if accept.as_deref() != Some(expected.as_str()) {
+            anyhow::bail!("relay answered the WebSocket handshake wrongly");
+        }
+        buf.advance(len);
+        Ok(Self { stream, buf })
+    }
+
+    /// Send the messages queued on `outgoing` and pass those received on to
+    /// `incoming`, until the connection closes or `outgoing` does
+    pub async fn run(
+        self,
+        mut outgoing: mpsc::Receiver<Vec<u8>>,
+        incoming: mpsc::Sender<Vec<u8>>,
+    ) -> Result<()> {
+        let (reader, mut writer) = tokio::io::split(self.stream);
+        let mut reader = FrameReader {
+            inner: reader,
+            buf: self.buf,
+        };
+        loop {
+            tokio::select! {
+                message = outgoing.recv() => {
+                    let Some(message) = message else {
+                        return Ok(());
+                    };
+                    write_frame(&mut writer, OP_BINARY, &message).await?;
+                }
+                frame = reader.next() => {
+                    let Some((opcode, payload)) = frame? else {
+                        anyhow::bail!("relay closed the connection");
+                    };
+                    match opcode {
+                        OP_BINARY => {
+                            if incoming.send(payload).await.is_err() {
+                                return Ok(());
+                            }
+                        }
+                        OP_PING => write_frame(&mut writer, OP_PONG, &payload).await?,
+                        OP_CLOSE => anyhow::bail!("relay closed the connection"),
+                        _ => {}
+                    }
+                }
+            }
+        }
+    }
+}
+
+/// Frames read from the relay
+struct FrameReader<R> {
+    inner: R,
+    buf: BytesMut,
+}
+
+impl<R: AsyncRead + Unpin> FrameReader<R> {
+    /// The next frame's opcode and payload, or `None` at the end of the
+    /// connection. Cancel-safe: a frame read in part is kept for the next
+    /// call.
+    async fn next(&mut self) -> Result<Option<(u8, Vec<u8>)>> {
+        loop {
+            if let Some(frame) = self.parse()? {
+                return Ok(Some(frame));
+            }
+            if self.inner.read_buf(&mut self.buf).await? == 0 {
+                return Ok(None);
+            }
+        }
+    }
+
+    fn parse(&mut self) -> Result<Option<(u8, Vec<u8>)>> {
+        let Some(&[first, second]) = self.buf.get(..2) else {
+            return Ok(None);
+        };
+        // Frames from the server are never masked
+        let (len, offset) = match second & 0x7f {
+            126 => match self.buf.get(2..4) {
+                Some(len) => (u64::from(u16::from_be_bytes([len[0], len[1]])), 4),
+                None => return Ok(None),
+            },
+            127 => match self.buf.get(2..10) {
+                Some(len) => (u64::from_be_bytes(len.try_into().expect("8 bytes")), 10),
+                None => return Ok(None),
+            },
+            len => (u64::from(len), 2),
+        };
+        if len > MAX_MESSAGE_LEN as u64 {
+            anyhow::bail!("relay sent a {} byte frame", len);
+        }
+        let len = len as usize;
+        if self.buf.len() < offset + len {
+            return Ok(None);
+        }
+        self.buf.advance(offset);
+        Ok(Some((first & 0x0f, self.buf.split_to(len).to_vec())))
+    }
+}
+
+/// Write a whole message as one frame, masked as frames from clients must be
+async fn write_frame<W: AsyncWrite + Unpin>(
+    writer: &mut W,
+    opcode: u8,
+    payload: &[u8],
+) -> Result<()> {
+    let mut frame = Vec::with_capacity(payload.len() + 14);
+    frame.push(0x80 | opcode);
+    match payload.len() {
+        len @ 0..=125 => frame.push(0x80 | len as u8),
+        len @ 126..=0xffff => {
+            frame.push(0x80 | 126);
+            frame.extend_from_slice(&(len as u16).to_be_bytes());
+        }
+        len => {
+            frame.push(0x80 | 127);
+            frame.extend_from_slice(&(len as u64).to_be_bytes());
+        }
+    }
+    let mask: [u8; 4] = rand::random();
+    frame.extend_from_slice(&mask);
+    frame.extend(
+        payload
+            .iter()
+            .enumerate()
+            .map(|(i, byte)| byte ^ mask[i % 4]),
+    );
+    writer.write_all(&frame).await?;
+    writer.flush().await?;
+    Ok(())
+}
+
+fn tls_connector() -> Result<TlsConnector> {
+    let roots = rustls::RootCertStore::from_iter(webpki_roots::TLS_SERVER_ROOTS.iter().cloned());
+    let config = rustls::ClientConfig::builder_with_provider(Arc::new(
+        rustls::crypto::aws_lc_rs::default_provider(),
+    ))
+    .with_safe_default_protocol_versions()
+    .context("failed to configure TLS for the relay")?
+    .with_root_certificates(roots)
+    .with_no_client_auth();
+    Ok(TlsConnector::from(Arc::new(config)))
+}
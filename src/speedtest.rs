@@ -0,0 +1,212 @@
+//! Bandwidth test client
+//!
+//! `wirecage speedtest ADDRESS` measures throughput against a server's
+//! `--speedtest-port`. Run inside a cage, it measures the tunnel itself:
+//! `wirecage run myserver -- wirecage speedtest 10.200.100.1:8080`. The
+//! download and the upload each run for `--seconds` over HTTP, and the
+//! upload's rate is the one the server measured. With `--udp-mbps`,
+//! datagrams are also sent at that rate and the echoes counted, so the
+//! loss shown is for the round trip.
+
+use std::io::{BufRead, BufReader, Read, Write};
+use std::net::{SocketAddr, TcpStream, ToSocketAddrs, UdpSocket};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use anyhow::{Context, Result};
+use serde::Deserialize;
+
+use crate::args::SpeedtestArgs;
+
+const CHUNK: usize = 64 * 1024;
+/// Bytes a download asks for, more than a test moves; it stops at its
+/// deadline instead
+const DOWNLOAD_BYTES: u64 = 1 << 40;
+const IO_TIMEOUT: Duration = Duration::from_secs(10);
+const DATAGRAM_LEN: usize = 1200;
+/// How long to wait for the last echoes once sending stops
+const ECHO_GRACE: Duration = Duration::from_secs(1);
+
+/// What the server reports of an upload
+#[derive(Deserialize)]
+struct UploadResult {
+    bytes: u64,
+    seconds: f64,
+}
+
+pub fn run(args: &SpeedtestArgs) -> Result<()> {
+    if args.seconds == 0 {
+        anyhow::bail!("--seconds must be at least 1");
+    }
+    if args
+        .udp_mbps
+        .is_some_and(|mbps| !mbps.is_finite() || mbps <= 0.0)
+    {
+        anyhow::bail!("--udp-mbps must be above 0");
+    }
+    let addr = args
+        .address
+        .to_socket_addrs()
+        .with_context(|| format!("invalid address {}", args.address))?
+        .next()
+        .with_context(|| format!("{} has no address", args.address))?;
+    let duration = Duration::from_secs(args.seconds);
+
+    let (bytes, elapsed) = download(addr, duration).context("download test failed")?;
+    report("download", bytes, elapsed);
+    let (bytes, elapsed) = upload(addr, duration).context("upload test failed")?;
+    report("upload", bytes, elapsed);
+    if let Some(mbps) = args.udp_mbps {
+        udp(addr, duration, mbps).context("UDP test failed")?;
+    }
+    Ok(())
+}
+
+fn report(test: &str, bytes: u64, elapsed: Duration) {
+    println!(
+        "{:<8} {:>9.1} Mbit/s  ({} bytes in {:.1}s)",
+        test,
+        mbit_per_second(bytes, elapsed),
+        bytes,
+        elapsed.as_secs_f64()
+    );
+}
+
+fn mbit_per_second(bytes: u64, elapsed: Duration) -> f64 {
+    bytes as f64 * 8.0 / elapsed.as_secs_f64().max(f64::EPSILON) / 1e6
+}
+
+fn connect(addr: SocketAddr) -> Result<TcpStream> {
+    let stream = TcpStream::connect_timeout(&addr, IO_TIMEOUT)
+        .with_context(|| format!("failed to connect to {}", addr))?;
+    stream.set_read_timeout(Some(IO_TIMEOUT))?;
+    stream.set_write_timeout(Some(IO_TIMEOUT))?;
+    stream.set_nodelay(true)?;
+    Ok(stream)
+}
+
+/// Read a response head, failing unless its status is 200
+fn read_head(reader: &mut impl BufRead) -> Result<()> {
+    let mut line = String::new();
+    reader.read_line(&mut line)?;
+    if line.split_whitespace().nth(1) != Some("200") {
+        anyhow::bail!("server answered {:?}", line.trim());
+    }
+    loop {
+        line.clear();
+        if reader.read_line(&mut line)? == 0 {
+            anyhow::bail!("connection closed mid-response");
+        }
+        if line.trim().is_empty() {
+            return Ok(());
+        }
+    }
+}
+
+fn download(addr: SocketAddr, duration: Duration) -> Result<(u64, Duration)> {
+    let mut stream = connect(addr)?;
+    write!(
+        stream,
+        "GET /download?bytes={} HTTP/1.1\r\nHost: {}\r\nConnection: close\r\n\r\n",
+        DOWNLOAD_BYTES, addr
+    )?;
+    let mut reader = BufReader::new(stream);
+    read_head(&mut reader)?;
+    let start = Instant::now();
+    let mut buf = vec![0u8; CHUNK];
+    let mut total = 0;
+    while start.elapsed() < duration {
+        let n = reader.read(&mut buf)?;
+        if n == 0 {
+            break;
+        }
+        total += n as u64;
+    }
+    Ok((total, start.elapsed()))
+}
+
+fn upload(addr: SocketAddr, duration: Duration) -> Result<(u64, Duration)> {
+    let mut stream = connect(addr)?;
+    write!(
+        stream,
+        "POST /upload HTTP/1.1\r\nHost: {}\r\nTransfer-Encoding: chunked\r\n\
+         Connection: close\r\n\r\n",
+        addr
+    )?;
+    let mut chunk = format!("{:x}\r\n", CHUNK).into_bytes();
+    chunk.resize(chunk.len() + CHUNK, 0);
+    chunk.extend_from_slice(b"\r\n");
+    let start = Instant::now();
+    while start.elapsed() < duration {
+        stream.write_all(&chunk)?;
+    }
+    stream.write_all(b"0\r\n\r\n")?;
+
+    let mut reader = BufReader::new(stream);
+    read_head(&mut reader)?;
+    let mut body = String::new();
+    reader.read_to_string(&mut body)?;
+    let result: UploadResult =
+        serde_json::from_str(&body).context("invalid upload result from server")?;
+    Ok((result.bytes, Duration::from_secs_f64(result.seconds)))
+}
+
+/// Send datagrams at `mbps` for `duration`, counting the echoes
+fn udp(addr: SocketAddr, duration: Duration, mbps: f64) -> Result<()> {
+    let bind: SocketAddr = if addr.is_ipv4() {
+        "0.0.0.0:0".parse()?
+    } else {
+        "[::]:0".parse()?
+    };
+    let socket = UdpSocket::bind(bind).context("failed to bind UDP socket")?;
+    socket.connect(addr)?;
+    let receiver = socket.try_clone()?;
+    receiver.set_read_timeout(Some(ECHO_GRACE))?;
+    let sending = Arc::new(AtomicBool::new(true));
+    let counting = {
+        let sending = Arc::clone(&sending);
+        std::thread::spawn(move || {
+            let mut buf = [0u8; DATAGRAM_LEN];
+            let mut received = 0u64;
+            loop {
+                match receiver.recv(&mut buf) {
+                    Ok(_) => received += 1,
+                    // Errors are timeouts, or ICMP errors from sends
+                    Err(_) if sending.load(Ordering::Relaxed) => {}
+                    Err(_) => return received,
+                }
+            }
+        })
+    };
+
+    let interval = Duration::from_secs_f64(DATAGRAM_LEN as f64 * 8.0 / (mbps * 1e6));
+    let mut datagram = [0u8; DATAGRAM_LEN];
+    let start = Instant::now();
+    let mut sent = 0u64;
+    while start.elapsed() < duration {
+        let due = start + interval.mul_f64(sent as f64);
+        let now = Instant::now();
+        if due > now {
+            std::thread::sleep(due - now);
+        }
+        datagram[..8].copy_from_slice(&sent.to_be_bytes());
+        // Drops when the socket buffer is full count as loss
+        let _ = socket.send(&datagram);
+        sent += 1;
+    }
+    let elapsed = start.elapsed();
+    sending.store(false, Ordering::Relaxed);
+    let received = counting.join().expect("echo counting thread panicked");
+
+    let lost = sent.saturating_sub(received) as f64 * 100.0 / sent.max(1) as f64;
+    println!(
+        "{:<8} {:>9.1} Mbit/s  ({} of {} datagrams back, {:.1}% lost)",
+        "udp",
+        mbit_per_second(received * DATAGRAM_LEN as u64, elapsed),
+        received,
+        sent,
+        lost
+    );
+    Ok(())
+}
@@ -0,0 +1,159 @@
+//! Access log of the HTTP proxy
+//!
+//! With `--http-proxy-access-log`, every request to the
+//! [HTTP proxy](super::http_proxy) is recorded as a JSON line with the peer
+//! and its address, the method and destination host, the status, the bytes
+//! sent to and received from the destination and how long it took, so
+//! proxy use can be audited like the NATed flows in the flow log. The log
+//! goes to a file, or to stdout given `-`. As with the flow log, records are
+//! written by a background task and dropped if it falls behind.
+
+use std::io::Write;
+use std::net::SocketAddrV4;
+use std::os::unix::fs::OpenOptionsExt;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::{Context, Result};
+use serde::Serialize;
+use tokio::sync::mpsc;
+use tracing::{error, warn};
+
+use super::events::encode_key;
+
+/// Records queued before new ones are dropped
+const QUEUE_LEN: usize = 4096;
+
+/// How often buffered records are written out
+const FLUSH_INTERVAL: Duration = Duration::from_secs(1);
+
+/// One proxy request, recorded when it ends or is refused
+#[derive(Debug, Clone)]
+pub struct AccessRecord {
+    pub peer: [u8; 32],
+    pub client: SocketAddrV4,
+    /// Unset if the request could not be parsed
+    pub method: Option<String>,
+    /// `host:port` the request was for
+    pub host: Option<String>,
+    /// Sent by the proxy, or by the origin for forwarded requests; unset if
+    /// the origin sent no response
+    pub status: Option<u16>,
+    /// Bytes sent to the destination, and received from it
+    pub up_bytes: u64,
+    pub down_bytes: u64,
+    pub start: SystemTime,
+    pub end: SystemTime,
+}
+
+#[derive(Serialize)]
+struct JsonRecord<'a> {
+    /// Unix time in milliseconds the request started
+    start_ms: u64,
+    duration_ms: u64,
+    peer: String,
+    client: SocketAddrV4,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    method: Option<&'a str>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    host: Option<&'a str>,
+    status: Option<u16>,
+    up_bytes: u64,
+    down_bytes: u64,
+}
+
+enum Output {
+    Stdout,
+    File(std::fs::File),
+}
+
+/// Hands access records to the writer task
+pub struct AccessLog {
+    tx: mpsc::Sender<AccessRecord>,
+    dropped: AtomicU64,
+}
+
+impl AccessLog {
+    /// Open `path`, or stdout for `-`, and start writing records to it
+    pub fn start(path: &str) -> Result<Self> {
+        let output = if path == "-" {
+            Output::Stdout
+        } else {
+            let file = std::fs::OpenOptions::new()
+                .append(true)
+                .create(true)
+                .mode(0o600)
+                .open(path)
+                .with_context(|| format!("failed to open HTTP proxy access log {}", path))?;
+            Output::File(file)
+        };
+        let (tx, rx) = mpsc::channel(QUEUE_LEN);
+        tokio::spawn(write_records(rx, path.to_string(), output));
+        Ok(Self {
+            tx,
+            dropped: AtomicU64::new(0),
+        })
+    }
+
+    pub fn record(&self, record: AccessRecord) {
+        if self.tx.try_send(record).is_err() {
+            // Only every thousandth drop is logged, as drops come in floods
+            if self.dropped.fetch_add(1, Ordering::Relaxed) % 1000 == 0 {
+                warn!("HTTP proxy access log is falling behind; dropping records");
+            }
+        }
+    }
+}
+
+async fn write_records(mut rx: mpsc::Receiver<AccessRecord>, path: String, mut output: Output) {
+    let mut batch = Vec::new();
+    let mut flush = tokio::time::interval(FLUSH_INTERVAL);
+    loop {
+        tokio::select! {
+            record = rx.recv() => match record {
+                Some(record) => batch.push(record),
+                None => break,
+            },
+            _ = flush.tick() => {
+                if batch.is_empty() {
+                    continue;
+                }
+                let lines = json_lines(&batch);
+                let written = match &mut output {
+                    Output::Stdout => std::io::stdout().lock().write_all(lines.as_bytes()),
+                    Output::File(file) => file.write_all(lines.as_bytes()),
+                };
+                if let Err(e) = written {
+                    error!("Failed to write HTTP proxy access log {}: {}", path, e);
+                }
+                batch.clear();
+            }
+        }
+    }
+}
+
+fn json_lines(records: &[AccessRecord]) -> String {
+    let mut out = String::new();
+    for record in records {
+        let json = JsonRecord {
+            start_ms: record
+                .start
+                .duration_since(UNIX_EPOCH)
+                .map_or(0, |d| d.as_millis() as u64),
+            duration_ms: record
+                .end
+                .duration_since(record.start)
+                .map_or(0, |d| d.as_millis() as u64),
+            peer: encode_key(&record.peer),
+            client: record.client,
+            method: record.method.as_deref(),
+            host: record.host.as_deref(),
+            status: record.status,
+            up_bytes: record.up_bytes,
+            down_bytes: record.down_bytes,
+        };
+        out.push_str(&serde_json::to_string(&json).expect("access records serialize"));
+        out.push('\n');
+    }
+    out
+}
@@ -0,0 +1,411 @@
+//! Per-peer egress ACLs for wirecagesrv
+//!
+//! A TOML file restricts where groups of peers (by public key or tag) may
+//! connect through the NAT:
+//!
+//! ```toml
+//! [[acl]]
+//! name = "ci"
+//! peers = ["<base64 public key>"]
+//! rules = [
+//!   { action = "allow", protocol = "tcp", ports = [443], sni = ["registry.npmjs.org", "pypi.org"] },
+//!   { action = "allow", cidrs = ["10.20.0.0/16"], ports = ["8000-8999"] },
+//! ]
+//!
+//! [[acl]]
+//! name = "contractors"
+//! tags = ["contractors"]
+//! rules = [{ action = "allow", protocol = "tcp", ports = [443] }]
+//! ```
+//!
+//! A peer listed by key gets that ACL; otherwise it gets the first ACL in
+//! the file naming one of its tags. Rules are checked in order and the first match decides; flows no rule
+//! matches get the ACL's `default`, which is `deny` unless set. Omitted
+//! fields in a rule match anything. A rule with `sni` only matches TLS
+//! connections whose ClientHello names one of the listed domains or a
+//! subdomain of one, or plain HTTP requests whose Host header does, so
+//! those flows are decided once the client's first bytes arrive. Pings
+//! through the NAT only match rules without a protocol, ports or `sni`.
+//! Peers not listed in any ACL are unrestricted, and DNS
+//! queries to the server itself are always allowed. The file is re-read on
+//! SIGHUP or `POST /v1/reload`; flows already open are not re-checked.
+
+use std::collections::HashMap;
+use std::net::IpAddr;
+use std::ops::RangeInclusive;
+use std::sync::Arc;
+
+use anyhow::{Context, Result};
+use base64::Engine;
+use ipnet::IpNet;
+use parking_lot::RwLock;
+use serde::Deserialize;
+use tracing::info;
+
+use super::flow::Protocol;
+use super::state::SharedState;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Action {
+    Allow,
+    Deny,
+}
+
+/// What an ACL says about a new flow
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Decision {
+    Allow,
+    Deny,
+    /// Depends on the server name in the TLS ClientHello
+    NeedsSni,
+}
+
+impl From<Action> for Decision {
+    fn from(action: Action) -> Self {
+        match action {
+            Action::Allow => Decision::Allow,
+            Action::Deny => Decision::Deny,
+        }
+    }
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct AclFile {
+    #[serde(default)]
+    acl: Vec<AclEntry>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct AclEntry {
+    name: String,
+    #[serde(default)]
+    peers: Vec<String>,
+    #[serde(default)]
+    tags: Vec<String>,
+    #[serde(default)]
+    rules: Vec<RuleEntry>,
+    #[serde(default = "default_action")]
+    default: Action,
+}
+
+fn default_action() -> Action {
+    Action::Deny
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct RuleEntry {
+    action: Action,
+    protocol: Option<RuleProtocol>,
+    #[serde(default)]
+    cidrs: Vec<String>,
+    #[serde(default)]
+    ports: Vec<PortSpec>,
+    #[serde(default)]
+    sni: Vec<String>,
+}
+
+#[derive(Debug, Clone, Copy, Deserialize)]
+#[serde(rename_all = "lowercase")]
+enum RuleProtocol {
+    Tcp,
+    Udp,
+}
+
+/// A port, or a range written `"low-high"`
+#[derive(Debug, Deserialize)]
+#[serde(untagged)]
+enum PortSpec {
+    Port(u16),
+    Range(String),
+}
+
+struct Rule {
+    action: Action,
+    protocol: Option<Protocol>,
+    cidrs: Vec<IpNet>,
+    ports: Vec<RangeInclusive<u16>>,
+    sni: Vec<String>,
+}
+
+impl Rule {
+    /// Whether the rule covers the flow, ignoring its server names
+    fn matches(&self, protocol: Protocol, ip: IpAddr, port: u16) -> bool {
+        self.protocol.is_none_or(|p| p == protocol)
+            && (self.cidrs.is_empty() || self.cidrs.iter().any(|net| net.contains(&ip)))
+            && (self.ports.is_empty() || self.ports.iter().any(|range| range.contains(&port)))
+    }
+
+    /// Whether the rule covers an ICMP echo session to `ip`, which only
+    /// rules naming no protocol, port or server name do
+    fn matches_echo(&self, ip: IpAddr) -> bool {
+        self.protocol.is_none()
+            && self.ports.is_empty()
+            && self.sni.is_empty()
+            && (self.cidrs.is_empty() || self.cidrs.iter().any(|net| net.contains(&ip)))
+    }
+
+    fn matches_sni(&self, name: &str) -> bool {
+        self.sni.iter().any(|domain| {
+            name == domain
+                || name
+                    .strip_suffix(domain.as_str())
+                    .is_some_and(|prefix| prefix.ends_with('.'))
+        })
+    }
+}
+
+struct Acl {
+    name: String,
+    rules: Vec<Rule>,
+    default: Action,
+}
+
+impl Acl {
+    /// `sni` is `None` while the ClientHello hasn't been seen, and
+    /// `Some(None)` for connections that turned out not to send one
+    fn evaluate(
+        &self,
+        protocol: Protocol,
+        ip: IpAddr,
+        port: u16,
+        sni: Option<Option<&str>>,
+    ) -> Decision {
+        for rule in &self.rules {
+            if !rule.matches(protocol, ip, port) {
+                continue;
+            }
+            if !rule.sni.is_empty() {
+                match sni {
+                    None => return Decision::NeedsSni,
+                    Some(Some(name)) if rule.matches_sni(name) => {}
+                    Some(_) => continue,
+                }
+            }
+            return rule.action.into();
+        }
+        self.default.into()
+    }
+}
+
+/// Egress ACLs by peer public key and tag, as read from the file
+#[derive(Default)]
+struct AclSet {
+    by_peer: HashMap<[u8; 32], Arc<Acl>>,
+    /// In file order, so the first ACL naming one of a peer's tags wins
+    by_tag: Vec<(String, Arc<Acl>)>,
+    /// For looking up peers' tags; only set when some ACL uses tags
+    shared: Option<Arc<SharedState>>,
+    count: usize,
+}
+
+impl AclSet {
+    fn read(path: &str, shared: &Arc<SharedState>) -> Result<Self> {
+        let contents = std::fs::read_to_string(path)
+            .with_context(|| format!("failed to read egress ACL file {}", path))?;
+        let file: AclFile = toml::from_str(&contents)
+            .with_context(|| format!("failed to parse egress ACL file {}", path))?;
+
+        let count = file.acl.len();
+        let mut by_peer = HashMap::new();
+        let mut by_tag = Vec::new();
+        for entry in file.acl {
+            if entry.peers.is_empty() && entry.tags.is_empty() {
+                anyhow::bail!("egress ACL `{}` lists no peers or tags", entry.name);
+            }
+            let acl = Arc::new(
+                parse_acl(&entry).with_context(|| format!("invalid egress ACL `{}`", entry.name))?,
+            );
+            for peer in &entry.peers {
+                let pubkey = decode_public_key(peer)
+                    .with_context(|| format!("invalid peer key in egress ACL `{}`", entry.name))?;
+                if by_peer.insert(pubkey, Arc::clone(&acl)).is_some() {
+                    anyhow::bail!("peer {} appears in more than one egress ACL", peer);
+                }
+            }
+            for tag in &entry.tags {
+                by_tag.push((tag.clone(), Arc::clone(&acl)));
+            }
+            info!(
+                "Loaded egress ACL `{}` with {} rules for {} peers and {} tags",
+                acl.name,
+                acl.rules.len(),
+                entry.peers.len(),
+                entry.tags.len()
+            );
+        }
+        let shared = (!by_tag.is_empty()).then(|| Arc::clone(shared));
+        Ok(Self {
+            by_peer,
+            by_tag,
+            shared,
+            count,
+        })
+    }
+
+    /// The ACL for a peer: its own listing, else the first matching tag
+    fn acl_for(&self, peer: &[u8; 32]) -> Option<&Acl> {
+        if let Some(acl) = self.by_peer.get(peer) {
+            return Some(acl);
+        }
+        let shared = self.shared.as_ref()?;
+        let tags = shared.peer_tags(peer);
+        self.by_tag
+            .iter()
+            .find(|(tag, _)| tags.contains(tag))
+            .map(|(_, acl)| acl.as_ref())
+    }
+}
+
+/// The egress ACLs in force, replaced as a whole on reload
+#[derive(Default)]
+pub struct EgressAcls {
+    path: Option<String>,
+    shared: Option<Arc<SharedState>>,
+    set: RwLock<Arc<AclSet>>,
+}
+
+impl EgressAcls {
+    /// Load ACLs from a TOML file
+    pub fn load(path: &str, shared: Arc<SharedState>) -> Result<Self> {
+        let set = AclSet::read(path, &shared)?;
+        Ok(Self {
+            path: Some(path.to_string()),
+            shared: Some(shared),
+            set: RwLock::new(Arc::new(set)),
+        })
+    }
+
+    pub fn is_configured(&self) -> bool {
+        self.path.is_some()
+    }
+
+    /// Re-read the ACL file, keeping the current ACLs if it is invalid.
+    /// Flows already open are not re-checked. Returns the number of ACLs.
+    pub fn reload(&self) -> Result<usize> {
+        let (Some(path), Some(shared)) = (&self.path, &self.shared) else {
+            anyhow::bail!("no --egress-acl-file configured");
+        };
+        let set = AclSet::read(path, shared)?;
+        let count = set.count;
+        *self.set.write() = Arc::new(set);
+        info!("Reloaded {} egress ACLs from {}", count, path);
+        Ok(count)
+    }
+
+    /// Decide a new flow before any of its data has been seen. UDP flows
+    /// never need a server name; rules with `sni` don't match them.
+    pub fn check(&self, peer: &[u8; 32], protocol: Protocol, ip: IpAddr, port: u16) -> Decision {
+        let set = Arc::clone(&self.set.read());
+        let Some(acl) = set.acl_for(peer) else {
+            return Decision::Allow;
+        };
+        let sni = match protocol {
+            Protocol::Tcp => None,
+            Protocol::Udp => Some(None),
+        };
+        acl.evaluate(protocol, ip, port, sni)
+    }
+
+    /// Whether the peer may ping `ip` through the NAT
+    pub fn check_echo(&self, peer: &[u8; 32], ip: IpAddr) -> bool {
+        let set = Arc::clone(&self.set.read());
+        set.acl_for(peer).is_none_or(|acl| {
+            let action = acl
+                .rules
+                .iter()
+                .find(|rule| rule.matches_echo(ip))
+                .map_or(acl.default, |rule| rule.action);
+            action == Action::Allow
+        })
+    }
+
+    /// Decide a TCP flow that needed its server name
+    pub fn check_sni(&self, peer: &[u8; 32], ip: IpAddr, port: u16, sni: Option<&str>) -> bool {
+        let set = Arc::clone(&self.set.read());
+        set.acl_for(peer)
+            .is_none_or(|acl| acl.evaluate(Protocol::Tcp, ip, port, Some(sni)) == Decision::Allow)
+    }
+
+    /// Name of the ACL applied to a peer, for logging
+    pub fn name_for(&self, peer: &[u8; 32]) -> Option<String> {
+        let set = Arc::clone(&self.set.read());
+        set.acl_for(peer).map(|acl| acl.name.clone())
+    }
+}
+
+fn parse_acl(entry: &AclEntry) -> Result<Acl> {
+    let rules = entry
+        .rules
+        .iter()
+        .enumerate()
+        .map(|(i, rule)| parse_rule(rule).with_context(|| format!("rule {}", i + 1)))
+        .collect::<Result<_>>()?;
+    Ok(Acl {
+        name: entry.name.clone(),
+        rules,
+        default: entry.default,
+    })
+}
+
+fn parse_rule(entry: &RuleEntry) -> Result<Rule> {
+    let cidrs = entry
+        .cidrs
+        .iter()
+        .map(|cidr| {
+            cidr.parse::<IpNet>()
+                .or_else(|_| cidr.parse::<IpAddr>().map(IpNet::from))
+                .with_context(|| format!("invalid CIDR {}", cidr))
+        })
+        .collect::<Result<_>>()?;
+    let ports = entry
+        .ports
+        .iter()
+        .map(|spec| match spec {
+            PortSpec::Port(port) => Ok(*port..=*port),
+            PortSpec::Range(range) => {
+                let (low, high) = range.split_once('-').unwrap_or((range, range));
+                let parse = |port: &str| {
+                    port.trim()
+                        .parse::<u16>()
+                        .with_context(|| format!("invalid port range {}", range))
+                };
+                let (low, high) = (parse(low)?, parse(high)?);
+                if low > high {
+                    anyhow::bail!("invalid port range {}", range);
+                }
+                Ok(low..=high)
+            }
+        })
+        .collect::<Result<_>>()?;
+    let protocol = entry.protocol.map(|protocol| match protocol {
+        RuleProtocol::Tcp => Protocol::Tcp,
+        RuleProtocol::Udp => Protocol::Udp,
+    });
+    if !entry.sni.is_empty() && matches!(protocol, Some(Protocol::Udp)) {
+        anyhow::bail!("sni only applies to TCP");
+    }
+    Ok(Rule {
+        action: entry.action,
+        protocol,
+        cidrs,
+        ports,
+        sni: entry
+            .sni
+            .iter()
+            .map(|name| name.trim_end_matches('.').to_ascii_lowercase())
+            .collect(),
+    })
+}
+
+fn decode_public_key(key: &str) -> Result<[u8; 32]> {
+    let bytes = base64::engine::general_purpose::STANDARD
+        .decode(key.trim())
+        .context("not valid base64")?;
+    bytes
+        .try_into()
+        .map_err(|_| anyhow::anyhow!("public key must be 32 bytes"))
+}
@@ -0,0 +1,1853 @@
+//! Peer management API for wirecagesrv
+//!
+//! Served on its own listener (disabled unless `--admin-listen` is set) so
+//! it can be bound to loopback or a management network, or protected with
+//! tokens and TLS (see `admin_auth`):
+//! - `GET /v1/peers` lists peers
+//! - `POST /v1/peers` adds a peer; without a `public_key` the server
+//!   generates a keypair and returns a wg-quick config for it. A
+//!   `preshared_key` may be given, or generated with `"generate"`
+//! - `PUT /v1/peers` replaces the whole peer set with the given list, for
+//!   configuration management tools that reconcile declaratively
+//! - `GET /v1/peers/{public_key}` inspects a peer
+//! - `DELETE /v1/peers/{public_key}` removes a peer and its port forwards
+//! - `PUT /v1/peers/{public_key}/tags` replaces a peer's tags, which
+//!   firewall rules and per-peer policies can refer to
+//! - `GET /v1/peers/{public_key}/endpoints` lists the endpoints the peer has
+//!   roamed through, with the time it moved to each
+//! - `GET /v1/peers/{public_key}/usage` reports a peer's traffic between
+//!   `since` and `until` (Unix times) in `hour` or `day` buckets, and
+//!   `GET /v1/usage` every peer's totals over the same kind of window
+//! - `GET /v1/peers/{public_key}/destinations` lists the destinations a
+//!   peer exchanged the most traffic with since startup, and
+//!   `GET /v1/destinations` the busiest across all peers
+//! - `GET /v1/flows` lists the dataplane's open flows with their peer,
+//!   addresses, state, idle time and bytes exchanged, filtered by `peer`,
+//!   `host`, `port` and `protocol`, most recently active first
+//! - `GET /v1/peers/{public_key}/sessions` lists a peer's sessions, from
+//!   handshake to going idle, with endpoint and bytes exchanged, and
+//!   `GET /v1/sessions` every peer's; both take `since`, `until` and `limit`
+//! - `POST /v1/enrollment-tokens` mints a token clients can register with;
+//!   `GET` lists tokens and `DELETE /v1/enrollment-tokens/{id}` revokes one
+//! - `GET /v1/showconf` returns the interface and peers in `wg showconf`
+//!   format; the private key is only included with `?private_key=true`
+//! - `POST /v1/wg-config/reload` re-reads the `--wg-config` file and applies
+//!   its peer list
+//! - `GET /v1/firewall` lists the firewall rules with how many flows each
+//!   matched; `POST /v1/firewall/reload` re-reads `--firewall-rules`
+//! - `POST /v1/reload` re-reads every configuration file, as SIGHUP does,
+//!   and reports how each went
+//! - `GET /v1/status` reports the interface and per-peer handshake,
+//!   liveness and transfer counters
+//! - `POST /v1/server-key` switches the server to a new private key, given
+//!   or generated, while handshakes with the old one are still answered for
+//!   `grace_secs` (a week by default) so clients can move to the new public
+//!   key; the key is saved to `--private-key-file` if the server has one
+//! - `GET /v1/port-forwards` lists port forwards, `POST /v1/port-forwards`
+//!   forwards a public port to a peer given by name or public key, on any
+//!   port, and `DELETE /v1/port-forwards/{protocol}/{port}` removes one
+//! - `GET /v1/bans` lists banned public keys; `POST /v1/bans` bans one,
+//!   removing its peer immediately, and `DELETE /v1/bans/{public_key}`
+//!   lifts a ban
+//! - `GET /v1/audit` returns audit log entries, filtered by `action`,
+//!   `target` (a public key) and `since` (Unix time), newest `limit` last
+//! - `GET /v1/events` streams server events (peer added/removed/expired,
+//!   handshake completed, endpoint changed) as server-sent events
+//! - `GET /v1/capture` streams the decrypted tunnel traffic as pcap for
+//!   `seconds` (default 60), filtered by `peer`, `host`, `port` and
+//!   `protocol`; it needs the admin scope
+//!
+//! Public keys in paths may use URL-safe base64 (`-` and `_`) or be
+//! percent-encoded.
+
+use std::net::{IpAddr, Ipv4Addr, SocketAddr};
+use std::sync::Arc;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::Context;
+use axum::{
+    body::Body,
+    extract::{ConnectInfo, FromRequestParts, Path, Query, State},
+    http::{header, request::Parts, StatusCode},
+    response::sse::{self, KeepAlive, Sse},
+    response::{IntoResponse, Response},
+    routing::{delete, get, post, put},
+    Extension, Json, Router,
+};
+use base64::Engine;
+use futures::{Stream, StreamExt};
+use serde::Deserialize;
+use tokio::sync::broadcast::error::RecvError;
+use tokio::sync::{mpsc, oneshot};
+use tracing::{error, info, warn};
+
+use super::admin_auth::{AdminIdentity, Scope};
+use super::api::{add_peer_status, is_valid_peer_name, is_valid_tag, PortForwardEvent};
+use super::audit::{Actor, AuditAction, AuditEntry, AuditFilter};
+use super::dataplane::{FlowEntry, FlowTableRequest, TrafficStats};
+use super::destinations::DestinationSummary;
+use super::enroll::TokenOptions;
+use super::events::encode_key;
+use super::firewall::Firewall;
+use super::flow::{PortForwardRule, Protocol};
+use super::pcap::{self, CaptureFilter};
+use super::port_forwards;
+use super::reload::Reloader;
+use super::sessions::SessionFilter;
+use super::state::{PeerInfo, PeerOptions, SharedState};
+use super::usage::{unix_now, HOUR_SECS};
+use super::wg::WgIo;
+use super::wgconf;
+use super::wgimport::WgConfigImport;
+
+/// Request to add a peer
+#[derive(Debug, Deserialize)]
+pub struct AddPeerRequest {
+    /// Peer public key; generated along with a client config if omitted
+    #[serde(default)]
+    pub public_key: Option<String>,
+    #[serde(default)]
+    pub name: Option<String>,
+    /// Fixed address for the peer; allocated from the network if omitted
+    #[serde(default)]
+    pub address: Option<Ipv4Addr>,
+    /// Base64 preshared key, or "generate" to have the server pick one
+    #[serde(default)]
+    pub preshared_key: Option<String>,
+    /// Remove the peer this many seconds from now
+    #[serde(default)]
+    pub ttl_secs: Option<u64>,
+    /// Remove the peer at this Unix time
+    #[serde(default)]
+    pub expires_at: Option<u64>,
+    #[serde(default)]
+    pub tags: Option<Vec<String>>,
+}
+
+/// Desired state of one peer in a `PUT /v1/peers`
+#[derive(Debug, Deserialize)]
+pub struct DesiredPeer {
+    pub public_key: String,
+    #[serde(default)]
+    pub name: Option<String>,
+    #[serde(default)]
+    pub address: Option<Ipv4Addr>,
+    #[serde(default)]
+    pub preshared_key: Option<String>,
+    /// Tags for the peer; an existing peer keeps its tags if omitted
+    #[serde(default)]
+    pub tags: Option<Vec<String>>,
+}
+
+/// Request to replace the peer set
+#[derive(Debug, Deserialize)]
+pub struct ReplacePeersRequest {
+    pub peers: Vec<DesiredPeer>,
+}
+
+/// Request to replace a peer's tags
+#[derive(Debug, Deserialize)]
+pub struct SetTagsRequest {
+    pub tags: Vec<String>,
+}
+
+/// Query for GET /v1/showconf
+#[derive(Debug, Deserialize)]
+pub struct ShowconfQuery {
+    #[serde(default)]
+    pub private_key: bool,
+}
+
+/// Query for the usage endpoints
+#[derive(Debug, Deserialize)]
+pub struct UsageQuery {
+    /// Unix time; defaults to the start of retained usage
+    #[serde(default)]
+    pub since: u64,
+    /// Unix time; defaults to now
+    pub until: Option<u64>,
+    /// `hour` (default) or `day`
+    pub bucket: Option<String>,
+}
+
+/// Query for the destination endpoints
+#[derive(Debug, Deserialize)]
+pub struct DestinationsQuery {
+    #[serde(default = "default_destinations_limit")]
+    pub limit: usize,
+}
+
+fn default_destinations_limit() -> usize {
+    20
+}
+
+/// Query for GET /v1/flows
+#[derive(Debug, Deserialize)]
+pub struct FlowsQuery {
+    pub peer: Option<String>,
+    pub host: Option<IpAddr>,
+    pub port: Option<u16>,
+    /// `tcp` or `udp`
+    pub protocol: Option<String>,
+    #[serde(default = "default_flows_limit")]
+    pub limit: usize,
+}
+
+fn default_flows_limit() -> usize {
+    1000
+}
+
+/// Query for GET /v1/capture
+#[derive(Debug, Deserialize)]
+pub struct CaptureQuery {
+    pub peer: Option<String>,
+    pub host: Option<IpAddr>,
+    pub port: Option<u16>,
+    /// `tcp` or `udp`
+    pub protocol: Option<String>,
+    #[serde(default = "default_capture_secs")]
+    pub seconds: u64,
+}
+
+fn default_capture_secs() -> u64 {
+    60
+}
+
+/// Longest capture one request may stream
+const MAX_CAPTURE_SECS: u64 = 3600;
+
+/// Request to ban a public key
+#[derive(Debug, Deserialize)]
+pub struct BanKeyRequest {
+    pub public_key: String,
+    #[serde(default)]
+    pub reason: Option<String>,
+}
+
+/// Request to forward a public port to a peer
+#[derive(Debug, Deserialize)]
+pub struct AddPortForwardRequest {
+    /// Name or public key
+    pub peer: String,
+    #[serde(default = "default_forward_protocol")]
+    pub protocol: String,
+    pub public_port: u16,
+    /// Defaults to `public_port`
+    #[serde(default)]
+    pub target_port: Option<u16>,
+}
+
+fn default_forward_protocol() -> String {
+    "tcp".to_string()
+}
+
+/// Request to mint an enrollment token
+#[derive(Debug, Deserialize)]
+pub struct CreateTokenRequest {
+    /// Number of peers the token may register
+    #[serde(default = "default_token_uses")]
+    pub uses: u32,
+    /// Lifetime of the token in seconds; never expires if omitted
+    #[serde(default)]
+    pub ttl_secs: Option<u64>,
+    /// Require a TOTP code alongside the token to enroll new peers
+    #[serde(default)]
+    pub totp: bool,
+    /// Remove peers enrolled with the token this many seconds after they
+    /// last registered
+    #[serde(default)]
+    pub peer_ttl_secs: Option<u64>,
+    /// Tags given to peers enrolled with the token
+    #[serde(default)]
+    pub peer_tags: Vec<String>,
+}
+
+fn default_token_uses() -> u32 {
+    1
+}
+
+/// Request to rotate the server's private key
+#[derive(Debug, Deserialize)]
+pub struct RotateKeyRequest {
+    /// Base64 private key to switch to; generated if omitted
+    #[serde(default)]
+    pub private_key: Option<String>,
+    /// How long handshakes with the old key are still answered, in seconds
+    #[serde(default = "default_key_grace_secs")]
+    pub grace_secs: u64,
+}
+
+fn default_key_grace_secs() -> u64 {
+    7 * 86400
+}
+
+/// Longest lifetime a token may give the peers it enrolls, a century
+const MAX_PEER_TTL_SECS: u64 = 100 * 365 * 86400;
+
+/// Longest the old key may still be answered after a rotation
+const MAX_KEY_GRACE_SECS: u64 = 90 * 86400;
+
+pub struct AdminContext {
+    pub shared: Arc<SharedState>,
+    pub wg_io: Arc<WgIo>,
+    pub wg_endpoint: String,
+    pub port_forward_tx: mpsc::Sender<PortForwardEvent>,
+    pub flow_table_tx: mpsc::Sender<FlowTableRequest>,
+    pub wg_config: Option<Arc<WgConfigImport>>,
+    pub firewall: Arc<Firewall>,
+    pub stats: TrafficStats,
+    pub reloader: Arc<Reloader>,
+    /// File the server's private key was read from, updated on rotation
+    pub key_file: Option<String>,
+}
+
+type AdminState = Arc<AdminContext>;
+
+/// Create the admin API router
+pub fn create_router(
+    shared: Arc<SharedState>,
+    wg_io: Arc<WgIo>,
+    wg_endpoint: String,
+    port_forward_tx: mpsc::Sender<PortForwardEvent>,
+    flow_table_tx: mpsc::Sender<FlowTableRequest>,
+    wg_config: Option<Arc<WgConfigImport>>,
+    firewall: Arc<Firewall>,
+    stats: TrafficStats,
+    reloader: Arc<Reloader>,
+    key_file: Option<String>,
+) -> Router {
+    let ctx = Arc::new(AdminContext {
+        shared,
+        wg_io,
+        wg_endpoint,
+        port_forward_tx,
+        flow_table_tx,
+        wg_config,
+        firewall,
+        stats,
+        reloader,
+        key_file,
+    });
+
+    Router::new()
+        .route(
+            "/v1/peers",
+            get(list_peers_handler)
+                .post(add_peer_handler)
+                .put(replace_peers_handler),
+        )
+        .route(
+            "/v1/peers/{public_key}",
+            get(get_peer_handler).delete(remove_peer_handler),
+        )
+        .route("/v1/peers/{public_key}/tags", put(set_tags_handler))
+        .route("/v1/peers/{public_key}/endpoints", get(endpoints_handler))
+        .route("/v1/peers/{public_key}/usage", get(peer_usage_handler))
+        .route("/v1/usage", get(usage_handler))
+        .route(
+            "/v1/peers/{public_key}/destinations",
+            get(peer_destinations_handler),
+        )
+        .route("/v1/destinations", get(destinations_handler))
+        .route("/v1/flows", get(flows_handler))
+        .route("/v1/peers/{public_key}/sessions", get(peer_sessions_handler))
+        .route("/v1/sessions", get(sessions_handler))
+        .route(
+            "/v1/enrollment-tokens",
+            get(list_tokens_handler).post(create_token_handler),
+        )
+        .route("/v1/enrollment-tokens/{id}", delete(revoke_token_handler))
+        .route("/v1/showconf", get(showconf_handler))
+        .route("/v1/wg-config/reload", post(reload_wg_config_handler))
+        .route("/v1/firewall", get(firewall_handler))
+        .route("/v1/firewall/reload", post(reload_firewall_handler))
+        .route("/v1/reload", post(reload_handler))
+        .route("/v1/status", get(status_handler))
+        .route("/v1/server-key", post(rotate_key_handler))
+        .route(
+            "/v1/port-forwards",
+            get(list_port_forwards_handler).post(add_port_forward_handler),
+        )
+        .route(
+            "/v1/port-forwards/{protocol}/{port}",
+            delete(remove_port_forward_handler),
+        )
+        .route("/v1/bans", get(list_bans_handler).post(ban_key_handler))
+        .route("/v1/bans/{public_key}", delete(unban_key_handler))
+        .route("/v1/audit", get(audit_handler))
+        .route("/v1/events", get(events_handler))
+        .route("/v1/capture", get(capture_handler))
+        .with_state(ctx)
+}
+
+/// Handler for GET /v1/peers
+async fn list_peers_handler(State(ctx): State<AdminState>) -> impl IntoResponse {
+    let peers: Vec<PeerInfo> = ctx.shared.peers.read().iter().cloned().collect();
+    let peers: Vec<_> = peers.iter().map(|peer| peer_json(&ctx, peer)).collect();
+    (StatusCode::OK, Json(serde_json::json!({ "peers": peers })))
+}
+
+/// Handler for POST /v1/peers
+async fn add_peer_handler(
+    State(ctx): State<AdminState>,
+    actor: Actor,
+    Json(req): Json<AddPeerRequest>,
+) -> impl IntoResponse {
+    let (public_key, generated) = match req.public_key.as_deref() {
+        Some(key) => match decode_public_key(key) {
+            Some(public_key) => (public_key, None),
+            None => {
+                return (
+                    StatusCode::BAD_REQUEST,
+                    Json(serde_json::json!({"error": "invalid public key"})),
+                );
+            }
+        },
+        None => {
+            let key = wgconf::generate_key();
+            (key.public_key, Some(key))
+        }
+    };
+
+    let name = req.name.as_deref().map(str::to_ascii_lowercase);
+    if name.as_deref().is_some_and(|name| !is_valid_peer_name(name)) {
+        return (
+            StatusCode::BAD_REQUEST,
+            Json(serde_json::json!({"error": "invalid peer name"})),
+        );
+    }
+    if req.tags.as_deref().is_some_and(|tags| !tags.iter().all(|t| is_valid_tag(t))) {
+        return (
+            StatusCode::BAD_REQUEST,
+            Json(serde_json::json!({"error": "invalid tag"})),
+        );
+    }
+
+    let preshared_key = match req.preshared_key.as_deref() {
+        None => None,
+        Some("generate") => Some(wgconf::generate_preshared_key()),
+        Some(key) => match decode_public_key(key) {
+            Some(key) => Some(key),
+            None => {
+                return (
+                    StatusCode::BAD_REQUEST,
+                    Json(serde_json::json!({"error": "invalid preshared key"})),
+                );
+            }
+        },
+    };
+
+    let expires_at = match (req.ttl_secs, req.expires_at) {
+        (Some(_), Some(_)) => {
+            return (
+                StatusCode::BAD_REQUEST,
+                Json(serde_json::json!({"error": "give ttl_secs or expires_at, not both"})),
+            );
+        }
+        (Some(ttl), None) => match SystemTime::now().checked_add(Duration::from_secs(ttl)) {
+            Some(expires_at) => Some(expires_at),
+            None => {
+                return (
+                    StatusCode::BAD_REQUEST,
+                    Json(serde_json::json!({"error": "ttl_secs is too large"})),
+                );
+            }
+        },
+        (None, Some(at)) => match UNIX_EPOCH.checked_add(Duration::from_secs(at)) {
+            Some(expires_at) => Some(expires_at),
+            None => {
+                return (
+                    StatusCode::BAD_REQUEST,
+                    Json(serde_json::json!({"error": "expires_at is too large"})),
+                );
+            }
+        },
+        (None, None) => None,
+    };
+
+    let options = PeerOptions {
+        name,
+        address: req.address,
+        preshared_key,
+        tags: req.tags.clone(),
+    };
+    let mut added = ctx.shared.add_peer(public_key, options);
+    if let (Ok(peer), Some(expires_at)) = (&mut added, expires_at) {
+        ctx.shared.set_peer_expiry(&peer.public_key, Some(expires_at));
+        peer.expires_at = Some(expires_at);
+    }
+    let entry = AuditEntry::new(AuditAction::PeerAdd, &actor).target(encode_key(&public_key));
+    ctx.shared.audit.record(match &added {
+        Ok(peer) => entry.detail(peer.assigned_ip.to_string()),
+        Err(e) => entry.failed(e.message()),
+    });
+    match added {
+        Ok(peer) => {
+            info!(
+                "Admin API added peer {} with IP {}",
+                encode_key(&peer.public_key),
+                peer.assigned_ip
+            );
+            let mut body = peer_json(&ctx, &peer);
+            if req.preshared_key.as_deref() == Some("generate") {
+                body["preshared_key"] = peer
+                    .preshared_key
+                    .map(|key| base64::engine::general_purpose::STANDARD.encode(key))
+                    .into();
+            }
+            if let Some(key) = generated {
+                let config = &ctx.shared.config;
+                let address6 = config
+                    .ipv6_prefix
+                    .map(|prefix| (prefix.address_for(peer.assigned_ip), prefix.prefix_len()));
+                // IPv6-only peers use the server's IPv6 address for DNS64,
+                // others its address in their network
+                let dns = match config.ipv6_prefix {
+                    Some(prefix) if config.ipv6_only => {
+                        IpAddr::V6(prefix.address_for(config.subnet))
+                    }
+                    _ => IpAddr::V4(config.networks.gateway_for(peer.assigned_ip)),
+                };
+                let prefix_len = config
+                    .networks
+                    .containing(peer.assigned_ip)
+                    .map_or(config.subnet_mask, |network| network.prefix_len);
+                let obfuscation = ctx.wg_io.obfuscation().for_client(&peer.public_key);
+                let conf = wgconf::ClientConf {
+                    private_key: &key.private_key,
+                    address: peer.assigned_ip,
+                    prefix_len,
+                    address6,
+                    ipv6_only: config.ipv6_only,
+                    dns,
+                    server_public_key: &ctx.shared.server_public_key(),
+                    server_endpoint: &ctx.wg_endpoint,
+                    preshared_key: peer.preshared_key.as_ref(),
+                    obfuscation: obfuscation.as_deref(),
+                };
+                body["client_config"] = conf.render().into();
+            }
+            (StatusCode::CREATED, Json(body))
+        }
+        Err(e) => (add_peer_status(e), Json(serde_json::json!({"error": e.message()}))),
+    }
+}
+
+/// Handler for PUT /v1/peers
+async fn replace_peers_handler(
+    State(ctx): State<AdminState>,
+    actor: Actor,
+    Json(req): Json<ReplacePeersRequest>,
+) -> impl IntoResponse {
+    let mut desired = Vec::with_capacity(req.peers.len());
+    let mut seen = std::collections::HashSet::new();
+    for peer in req.peers {
+        let bad_request = |error: String| {
+            (
+                StatusCode::BAD_REQUEST,
+                Json(serde_json::json!({"error": error, "public_key": peer.public_key})),
+            )
+        };
+        let Some(public_key) = decode_public_key(&peer.public_key) else {
+            return bad_request("invalid public key".to_string());
+        };
+        if !seen.insert(public_key) {
+            return bad_request("peer listed more than once".to_string());
+        }
+        let name = peer.name.as_deref().map(str::to_ascii_lowercase);
+        if name.as_deref().is_some_and(|name| !is_valid_peer_name(name)) {
+            return bad_request("invalid peer name".to_string());
+        }
+        if peer.tags.as_deref().is_some_and(|tags| !tags.iter().all(|t| is_valid_tag(t))) {
+            return bad_request("invalid tag".to_string());
+        }
+        let preshared_key = match peer.preshared_key.as_deref().map(decode_public_key) {
+            Some(None) => return bad_request("invalid preshared key".to_string()),
+            Some(key) => key,
+            None => None,
+        };
+        desired.push((
+            public_key,
+            PeerOptions {
+                name,
+                address: peer.address,
+                preshared_key,
+                tags: peer.tags,
+            },
+        ));
+    }
+
+    let result = match ctx.shared.replace_peers(desired) {
+        Ok(result) => result,
+        Err((public_key, e)) => {
+            ctx.shared.audit.record(
+                AuditEntry::new(AuditAction::PeersReplace, &actor)
+                    .target(encode_key(&public_key))
+                    .failed(e.message()),
+            );
+            return (
+                add_peer_status(e),
+                Json(serde_json::json!({
+                    "error": e.message(),
+                    "public_key": encode_key(&public_key),
+                })),
+            );
+        }
+    };
+
+    for rule in &result.removed_rules {
+        if let Err(e) = ctx
+            .port_forward_tx
+            .send(PortForwardEvent::Removed {
+                protocol: rule.protocol,
+                port: rule.public_port,
+            })
+            .await
+        {
+            error!("Failed to notify dataplane of port forward removal: {}", e);
+        }
+    }
+
+    let summary = format!(
+        "{} added, {} updated, {} removed, {} unchanged",
+        result.added.len(),
+        result.updated.len(),
+        result.removed.len(),
+        result.unchanged
+    );
+    info!("Admin API replaced peers: {}", summary);
+    ctx.shared
+        .audit
+        .record(AuditEntry::new(AuditAction::PeersReplace, &actor).detail(summary));
+
+    let keys = |peers: &[PeerInfo]| -> Vec<String> {
+        peers.iter().map(|peer| encode_key(&peer.public_key)).collect()
+    };
+    (
+        StatusCode::OK,
+        Json(serde_json::json!({
+            "added": keys(&result.added),
+            "updated": keys(&result.updated),
+            "removed": keys(&result.removed),
+            "unchanged": result.unchanged,
+        })),
+    )
+}
+
+/// Handler for GET /v1/peers/{public_key}
+async fn get_peer_handler(
+    State(ctx): State<AdminState>,
+    Path(public_key): Path<String>,
+) -> impl IntoResponse {
+    let Some(public_key) = decode_public_key(&public_key) else {
+        return (
+            StatusCode::BAD_REQUEST,
+            Json(serde_json::json!({"error": "invalid public key"})),
+        );
+    };
+
+    let peer = ctx.shared.peers.read().get_by_pubkey(&public_key).cloned();
+    match peer {
+        Some(peer) => (StatusCode::OK, Json(peer_json(&ctx, &peer))),
+        None => (
+            StatusCode::NOT_FOUND,
+            Json(serde_json::json!({"error": "peer not found"})),
+        ),
+    }
+}
+
+/// Handler for PUT /v1/peers/{public_key}/tags
+async fn set_tags_handler(
+    State(ctx): State<AdminState>,
+    actor: Actor,
+    Path(public_key): Path<String>,
+    Json(req): Json<SetTagsRequest>,
+) -> impl IntoResponse {
+    let Some(public_key) = decode_public_key(&public_key) else {
+        return (
+            StatusCode::BAD_REQUEST,
+            Json(serde_json::json!({"error": "invalid public key"})),
+        );
+    };
+    if !req.tags.iter().all(|tag| is_valid_tag(tag)) {
+        return (
+            StatusCode::BAD_REQUEST,
+            Json(serde_json::json!({"error": "invalid tag"})),
+        );
+    }
+
+    let updated = ctx.shared.set_peer_tags(&public_key, req.tags.clone());
+    let entry = AuditEntry::new(AuditAction::PeerTag, &actor)
+        .target(encode_key(&public_key))
+        .detail(req.tags.join(","));
+    ctx.shared.audit.record(if updated {
+        entry
+    } else {
+        entry.failed("peer not found")
+    });
+    if !updated {
+        return (
+            StatusCode::NOT_FOUND,
+            Json(serde_json::json!({"error": "peer not found"})),
+        );
+    }
+    info!(
+        "Admin API set tags of {} to [{}]",
+        encode_key(&public_key),
+        req.tags.join(", ")
+    );
+    (StatusCode::OK, Json(serde_json::json!({ "tags": req.tags })))
+}
+
+/// Handler for GET /v1/peers/{public_key}/endpoints
+async fn endpoints_handler(
+    State(ctx): State<AdminState>,
+    Path(public_key): Path<String>,
+) -> impl IntoResponse {
+    let Some(public_key) = decode_public_key(&public_key) else {
+        return (
+            StatusCode::BAD_REQUEST,
+            Json(serde_json::json!({"error": "invalid public key"})),
+        );
+    };
+    if ctx.shared.peers.read().get_by_pubkey(&public_key).is_none() {
+        return (
+            StatusCode::NOT_FOUND,
+            Json(serde_json::json!({"error": "peer not found"})),
+        );
+    }
+
+    // Peers that have not sent a packet yet have no tunnel state
+    let history = ctx.wg_io.endpoint_history(&public_key).unwrap_or_default();
+    let endpoints: Vec<_> = history
+        .iter()
+        .map(|(endpoint, since)| {
+            serde_json::json!({
+                "endpoint": endpoint.to_string(),
+                "since": since.duration_since(UNIX_EPOCH).map_or(0, |d| d.as_secs()),
+            })
+        })
+        .collect();
+    let roams = ctx.wg_io.peer_stats(&public_key).map_or(0, |s| s.roams);
+    (
+        StatusCode::OK,
+        Json(serde_json::json!({
+            "public_key": encode_key(&public_key),
+            "roams": roams,
+            "endpoints": endpoints,
+        })),
+    )
+}
+
+/// Handler for GET /v1/peers/{public_key}/usage
+async fn peer_usage_handler(
+    State(ctx): State<AdminState>,
+    Path(public_key): Path<String>,
+    Query(query): Query<UsageQuery>,
+) -> impl IntoResponse {
+    let Some(public_key) = decode_public_key(&public_key) else {
+        return (
+            StatusCode::BAD_REQUEST,
+            Json(serde_json::json!({"error": "invalid public key"})),
+        );
+    };
+    let bucket_secs = match query.bucket.as_deref() {
+        None | Some("hour") => HOUR_SECS,
+        Some("day") => 24 * HOUR_SECS,
+        Some(_) => {
+            return (
+                StatusCode::BAD_REQUEST,
+                Json(serde_json::json!({"error": "bucket must be hour or day"})),
+            )
+        }
+    };
+
+    // Removed peers keep their usage until it ages out
+    let until = query.until.unwrap_or_else(unix_now);
+    let (total, buckets) = ctx
+        .stats
+        .usage
+        .peer_usage(&public_key, query.since, until, bucket_secs);
+    let buckets: Vec<_> = buckets
+        .iter()
+        .map(|(start, counters)| {
+            let mut bucket = serde_json::to_value(counters).expect("counters serialize");
+            bucket["start"] = (*start).into();
+            bucket
+        })
+        .collect();
+    (
+        StatusCode::OK,
+        Json(serde_json::json!({
+            "public_key": encode_key(&public_key),
+            "since": query.since,
+            "until": until,
+            "total": total,
+            "buckets": buckets,
+        })),
+    )
+}
+
+/// Handler for GET /v1/usage
+async fn usage_handler(
+    State(ctx): State<AdminState>,
+    Query(query): Query<UsageQuery>,
+) -> impl IntoResponse {
+    let until = query.until.unwrap_or_else(unix_now);
+    let mut totals = ctx.stats.usage.totals(query.since, until);
+    totals.sort_by_key(|(_, counters)| std::cmp::Reverse(counters.total_bytes()));
+    let peers = ctx.shared.peers.read();
+    let totals: Vec<_> = totals
+        .iter()
+        .map(|(public_key, counters)| {
+            let mut entry = serde_json::to_value(counters).expect("counters serialize");
+            entry["public_key"] = encode_key(public_key).into();
+            entry["name"] = peers
+                .get_by_pubkey(public_key)
+                .and_then(|peer| peer.name.clone())
+                .into();
+            entry
+        })
+        .collect();
+    drop(peers);
+    (
+        StatusCode::OK,
+        Json(serde_json::json!({
+            "since": query.since,
+            "until": until,
+            "peers": totals,
+        })),
+    )
+}
+
+/// Handler for GET /v1/peers/{public_key}/destinations
+async fn peer_destinations_handler(
+    State(ctx): State<AdminState>,
+    Path(public_key): Path<String>,
+    Query(query): Query<DestinationsQuery>,
+) -> impl IntoResponse {
+    let Some(public_key) = decode_public_key(&public_key) else {
+        return (
+            StatusCode::BAD_REQUEST,
+            Json(serde_json::json!({"error": "invalid public key"})),
+        );
+    };
+    let top = ctx.stats.destinations.top(Some(&public_key), query.limit);
+    (
+        StatusCode::OK,
+        Json(serde_json::json!({
+            "public_key": encode_key(&public_key),
+            "destinations": destinations_json(&top),
+        })),
+    )
+}
+
+/// Handler for GET /v1/destinations
+async fn destinations_handler(
+    State(ctx): State<AdminState>,
+    Query(query): Query<DestinationsQuery>,
+) -> impl IntoResponse {
+    let top = ctx.stats.destinations.top(None, query.limit);
+    Json(serde_json::json!({
+        "destinations": destinations_json(&top),
+    }))
+}
+
+fn destinations_json(top: &[DestinationSummary]) -> Vec<serde_json::Value> {
+    top.iter()
+        .map(|summary| {
+            let mut entry = serde_json::to_value(summary.counters).expect("counters serialize");
+            entry["protocol"] = match summary.destination.protocol {
+                Protocol::Tcp => "tcp",
+                Protocol::Udp => "udp",
+            }
+            .into();
+            entry["ip"] = summary.destination.ip.to_string().into();
+            entry["port"] = summary.destination.port.into();
+            entry["name"] = summary.name.clone().into();
+            entry
+        })
+        .collect()
+}
+
+/// Handler for GET /v1/flows
+async fn flows_handler(
+    State(ctx): State<AdminState>,
+    Query(query): Query<FlowsQuery>,
+) -> impl IntoResponse {
+    let bad_request = |error: &str| {
+        (
+            StatusCode::BAD_REQUEST,
+            Json(serde_json::json!({ "error": error })),
+        )
+    };
+    let peer = match query.peer.as_deref().map(decode_public_key) {
+        Some(None) => return bad_request("invalid public key"),
+        Some(Some(peer)) => Some(peer),
+        None => None,
+    };
+    let protocol = match query.protocol.as_deref().map(str::to_ascii_lowercase) {
+        Some(protocol) if protocol == "tcp" => Some(Protocol::Tcp),
+        Some(protocol) if protocol == "udp" => Some(Protocol::Udp),
+        Some(_) => return bad_request("protocol must be 'tcp' or 'udp'"),
+        None => None,
+    };
+
+    let (reply_tx, reply_rx) = oneshot::channel();
+    let flows = match ctx.flow_table_tx.send(reply_tx).await {
+        Ok(()) => reply_rx.await.ok(),
+        Err(_) => None,
+    };
+    let Some(mut flows) = flows else {
+        return (
+            StatusCode::SERVICE_UNAVAILABLE,
+            Json(serde_json::json!({"error": "dataplane is not running"})),
+        );
+    };
+    flows.retain(|flow| {
+        peer.is_none_or(|peer| flow.peer == Some(peer))
+            && protocol.is_none_or(|protocol| flow.protocol == protocol)
+            && query
+                .host
+                .is_none_or(|host| flow.client.ip() == host || flow.remote.ip() == host)
+            && query
+                .port
+                .is_none_or(|port| flow.client.port() == port || flow.remote.port() == port)
+    });
+    flows.sort_by_key(|flow| flow.idle);
+    let total = flows.len();
+    flows.truncate(query.limit);
+
+    let names: std::collections::HashMap<[u8; 32], String> = ctx
+        .shared
+        .peers
+        .read()
+        .iter()
+        .filter_map(|peer| Some((peer.public_key, peer.name.clone()?)))
+        .collect();
+    let flows: Vec<_> = flows
+        .iter()
+        .map(|flow| flow_json(flow, flow.peer.and_then(|peer| names.get(&peer))))
+        .collect();
+    (
+        StatusCode::OK,
+        Json(serde_json::json!({ "flows": flows, "total": total })),
+    )
+}
+
+fn flow_json(flow: &FlowEntry, name: Option<&String>) -> serde_json::Value {
+    serde_json::json!({
+        "peer": flow.peer.as_ref().map(encode_key),
+        "name": name,
+        "protocol": match flow.protocol {
+            Protocol::Tcp => "tcp",
+            Protocol::Udp => "udp",
+        },
+        "direction": if flow.inbound { "inbound" } else { "outbound" },
+        "client": flow.client.to_string(),
+        "remote": flow.remote.to_string(),
+        "public_port": flow.public_port,
+        "state": flow.state,
+        "remote_closed": flow.remote_closed,
+        "idle_secs": flow.idle.as_secs(),
+        "opened_at": flow
+            .totals
+            .opened
+            .duration_since(UNIX_EPOCH)
+            .map_or(0, |d| d.as_secs()),
+        "up_bytes": flow.totals.up_bytes,
+        "down_bytes": flow.totals.down_bytes,
+        "queued_packets": flow.queued,
+    })
+}
+
+/// Handler for GET /v1/peers/{public_key}/sessions
+async fn peer_sessions_handler(
+    State(ctx): State<AdminState>,
+    Path(public_key): Path<String>,
+    Query(filter): Query<SessionFilter>,
+) -> impl IntoResponse {
+    let Some(public_key) = decode_public_key(&public_key) else {
+        return (
+            StatusCode::BAD_REQUEST,
+            Json(serde_json::json!({"error": "invalid public key"})),
+        );
+    };
+    // Removed peers keep their sessions until they age out
+    let sessions = ctx.shared.sessions.query(Some(&public_key), &filter);
+    (
+        StatusCode::OK,
+        Json(serde_json::json!({ "sessions": sessions })),
+    )
+}
+
+/// Handler for GET /v1/sessions
+async fn sessions_handler(
+    State(ctx): State<AdminState>,
+    Query(filter): Query<SessionFilter>,
+) -> impl IntoResponse {
+    let sessions = ctx.shared.sessions.query(None, &filter);
+    Json(serde_json::json!({ "sessions": sessions }))
+}
+
+/// Handler for DELETE /v1/peers/{public_key}
+async fn remove_peer_handler(
+    State(ctx): State<AdminState>,
+    actor: Actor,
+    Path(public_key): Path<String>,
+) -> impl IntoResponse {
+    let Some(public_key) = decode_public_key(&public_key) else {
+        return (
+            StatusCode::BAD_REQUEST,
+            Json(serde_json::json!({"error": "invalid public key"})),
+        );
+    };
+
+    let removed = ctx.shared.remove_peer(&public_key);
+    let entry = AuditEntry::new(AuditAction::PeerRemove, &actor).target(encode_key(&public_key));
+    ctx.shared.audit.record(match &removed {
+        Some(_) => entry,
+        None => entry.failed("peer not found"),
+    });
+    let Some((peer, rules)) = removed else {
+        return (
+            StatusCode::NOT_FOUND,
+            Json(serde_json::json!({"error": "peer not found"})),
+        );
+    };
+
+    for rule in rules {
+        if let Err(e) = ctx
+            .port_forward_tx
+            .send(PortForwardEvent::Removed {
+                protocol: rule.protocol,
+                port: rule.public_port,
+            })
+            .await
+        {
+            error!("Failed to notify dataplane of port forward removal: {}", e);
+        }
+    }
+
+    info!(
+        "Admin API removed peer {} with IP {}",
+        encode_key(&peer.public_key),
+        peer.assigned_ip
+    );
+
+    (
+        StatusCode::OK,
+        Json(serde_json::json!({"status": "removed"})),
+    )
+}
+
+/// Handler for GET /v1/enrollment-tokens
+async fn list_tokens_handler(State(ctx): State<AdminState>) -> impl IntoResponse {
+    let tokens = ctx.shared.enrollment.read().list();
+    (StatusCode::OK, Json(serde_json::json!({ "tokens": tokens })))
+}
+
+/// Handler for POST /v1/enrollment-tokens
+async fn create_token_handler(
+    State(ctx): State<AdminState>,
+    actor: Actor,
+    Json(req): Json<CreateTokenRequest>,
+) -> impl IntoResponse {
+    if req.uses == 0 {
+        return (
+            StatusCode::BAD_REQUEST,
+            Json(serde_json::json!({"error": "uses must be at least 1"})),
+        );
+    }
+    if !req.peer_tags.iter().all(|tag| is_valid_tag(tag)) {
+        return (
+            StatusCode::BAD_REQUEST,
+            Json(serde_json::json!({"error": "invalid tag"})),
+        );
+    }
+
+    let ttl = req.ttl_secs.map(Duration::from_secs);
+    let expires_at = match ttl.map(|ttl| SystemTime::now().checked_add(ttl)) {
+        Some(None) => {
+            return (
+                StatusCode::BAD_REQUEST,
+                Json(serde_json::json!({"error": "ttl_secs is too large"})),
+            );
+        }
+        expires_at => expires_at.flatten(),
+    };
+    // Peers' lifetimes are added to the time they register, so leave room
+    // for the token to be used for as long as a peer could live
+    if let Some(peer_ttl) = req.peer_ttl_secs {
+        if peer_ttl > MAX_PEER_TTL_SECS {
+            return (
+                StatusCode::BAD_REQUEST,
+                Json(serde_json::json!({
+                    "error": format!("peer_ttl_secs must be at most {}", MAX_PEER_TTL_SECS)
+                })),
+            );
+        }
+    }
+    let created = ctx.shared.enrollment.write().create(TokenOptions {
+        uses: req.uses,
+        expires_at,
+        require_totp: req.totp,
+        peer_ttl: req.peer_ttl_secs.map(Duration::from_secs),
+        peer_tags: req.peer_tags,
+    });
+    let summary = &created.summary;
+    info!(
+        "Admin API created enrollment token {} for {} registrations",
+        summary.id, summary.uses_left
+    );
+    ctx.shared.audit.record(
+        AuditEntry::new(AuditAction::TokenCreate, &actor)
+            .target(summary.id.clone())
+            .detail(format!("{} registrations", summary.uses_left)),
+    );
+
+    (
+        StatusCode::CREATED,
+        Json(serde_json::json!({
+            "token": created.secret,
+            "id": summary.id,
+            "uses_left": summary.uses_left,
+            "expires_at": summary.expires_at,
+            "peer_ttl_secs": summary.peer_ttl_secs,
+            "peer_tags": summary.peer_tags,
+            "totp_uri": created.totp_uri,
+        })),
+    )
+}
+
+/// Handler for DELETE /v1/enrollment-tokens/{id}
+async fn revoke_token_handler(
+    State(ctx): State<AdminState>,
+    actor: Actor,
+    Path(id): Path<String>,
+) -> impl IntoResponse {
+    let revoked = ctx.shared.enrollment.write().revoke(&id);
+    let entry = AuditEntry::new(AuditAction::TokenRevoke, &actor).target(id.clone());
+    ctx.shared.audit.record(if revoked {
+        entry
+    } else {
+        entry.failed("enrollment token not found")
+    });
+    if !revoked {
+        return (
+            StatusCode::NOT_FOUND,
+            Json(serde_json::json!({"error": "enrollment token not found"})),
+        );
+    }
+    info!("Admin API revoked enrollment token {}", id);
+    (
+        StatusCode::OK,
+        Json(serde_json::json!({"status": "revoked"})),
+    )
+}
+
+/// Handler for GET /v1/port-forwards
+async fn list_port_forwards_handler(State(ctx): State<AdminState>) -> impl IntoResponse {
+    let rules = ctx.shared.port_forwards.read().rules();
+    let peers = ctx.shared.peers.read();
+    let forwards: Vec<_> = rules
+        .iter()
+        .map(|rule| {
+            serde_json::json!({
+                "protocol": match rule.protocol {
+                    Protocol::Tcp => "tcp",
+                    Protocol::Udp => "udp",
+                },
+                "public_port": rule.public_port,
+                "peer": encode_key(&rule.peer_pubkey),
+                "name": peers.get_by_pubkey(&rule.peer_pubkey).and_then(|peer| peer.name.clone()),
+                "peer_ip": rule.peer_ip.to_string(),
+                "target_port": rule.target_port,
+            })
+        })
+        .collect();
+    (
+        StatusCode::OK,
+        Json(serde_json::json!({ "port_forwards": forwards })),
+    )
+}
+
+/// Handler for POST /v1/port-forwards
+async fn add_port_forward_handler(
+    State(ctx): State<AdminState>,
+    actor: Actor,
+    Json(req): Json<AddPortForwardRequest>,
+) -> impl IntoResponse {
+    let Some(protocol) = parse_protocol(&req.protocol) else {
+        return (
+            StatusCode::BAD_REQUEST,
+            Json(serde_json::json!({"error": "protocol must be 'tcp' or 'udp'"})),
+        );
+    };
+    let peer = {
+        let peers = ctx.shared.peers.read();
+        peers
+            .get_by_name(&req.peer)
+            .or_else(|| peers.get_by_pubkey(&decode_public_key(&req.peer)?))
+            .map(|peer| (peer.public_key, peer.assigned_ip))
+    };
+    let Some((peer_pubkey, peer_ip)) = peer else {
+        return (
+            StatusCode::NOT_FOUND,
+            Json(serde_json::json!({"error": "peer not found"})),
+        );
+    };
+    let rule = PortForwardRule {
+        protocol,
+        public_port: req.public_port,
+        peer_pubkey,
+        peer_ip,
+        target_port: req.target_port.unwrap_or(req.public_port),
+    };
+    let target_port = rule.target_port;
+
+    let added = port_forwards::add(&ctx.shared, &ctx.port_forward_tx, rule).await;
+    let entry = AuditEntry::new(AuditAction::PortForwardAdd, &actor)
+        .target(encode_key(&peer_pubkey))
+        .detail(format!(
+            "{} port {} -> {}",
+            req.protocol, req.public_port, target_port
+        ));
+    ctx.shared.audit.record(match added {
+        Ok(()) => entry,
+        Err(e) => entry.failed(e),
+    });
+    if let Err(e) = added {
+        return (StatusCode::CONFLICT, Json(serde_json::json!({"error": e})));
+    }
+    (
+        StatusCode::CREATED,
+        Json(serde_json::json!({
+            "protocol": req.protocol,
+            "public_port": req.public_port,
+            "peer": encode_key(&peer_pubkey),
+            "peer_ip": peer_ip.to_string(),
+            "target_port": target_port,
+        })),
+    )
+}
+
+/// Handler for DELETE /v1/port-forwards/{protocol}/{port}
+async fn remove_port_forward_handler(
+    State(ctx): State<AdminState>,
+    actor: Actor,
+    Path((protocol, port)): Path<(String, u16)>,
+) -> impl IntoResponse {
+    let Some(protocol) = parse_protocol(&protocol) else {
+        return (
+            StatusCode::BAD_REQUEST,
+            Json(serde_json::json!({"error": "protocol must be 'tcp' or 'udp'"})),
+        );
+    };
+    let removed = port_forwards::remove(&ctx.shared, &ctx.port_forward_tx, protocol, port).await;
+    let Some(rule) = removed else {
+        return (
+            StatusCode::NOT_FOUND,
+            Json(serde_json::json!({"error": "port forward not found"})),
+        );
+    };
+    ctx.shared.audit.record(
+        AuditEntry::new(AuditAction::PortForwardRemove, &actor)
+            .target(encode_key(&rule.peer_pubkey))
+            .detail(format!("port {}", port)),
+    );
+    (
+        StatusCode::OK,
+        Json(serde_json::json!({"status": "removed"})),
+    )
+}
+
+fn parse_protocol(protocol: &str) -> Option<Protocol> {
+    match protocol.to_ascii_lowercase().as_str() {
+        "tcp" => Some(Protocol::Tcp),
+        "udp" => Some(Protocol::Udp),
+        _ => None,
+    }
+}
+
+/// Handler for GET /v1/bans
+async fn list_bans_handler(State(ctx): State<AdminState>) -> impl IntoResponse {
+    let mut bans: Vec<serde_json::Value> = ctx
+        .shared
+        .bans
+        .read()
+        .values()
+        .map(|ban| {
+            serde_json::json!({
+                "public_key": encode_key(&ban.public_key),
+                "reason": ban.reason,
+                "banned_at": ban
+                    .banned_at
+                    .duration_since(UNIX_EPOCH)
+                    .map_or(0, |d| d.as_secs()),
+            })
+        })
+        .collect();
+    bans.sort_by_key(|ban| ban["banned_at"].as_u64());
+    (StatusCode::OK, Json(serde_json::json!({ "bans": bans })))
+}
+
+/// Handler for POST /v1/bans
+async fn ban_key_handler(
+    State(ctx): State<AdminState>,
+    actor: Actor,
+    Json(req): Json<BanKeyRequest>,
+) -> impl IntoResponse {
+    let Some(public_key) = decode_public_key(&req.public_key) else {
+        return (
+            StatusCode::BAD_REQUEST,
+            Json(serde_json::json!({"error": "invalid public key"})),
+        );
+    };
+
+    let removed = ctx.shared.ban_key(public_key, req.reason.clone());
+    let mut entry = AuditEntry::new(AuditAction::KeyBan, &actor).target(encode_key(&public_key));
+    if let Some(reason) = &req.reason {
+        entry = entry.detail(reason.clone());
+    }
+    ctx.shared.audit.record(entry);
+    info!("Admin API banned public key {}", encode_key(&public_key));
+
+    let removed_peer = removed.is_some();
+    if let Some((peer, rules)) = removed {
+        for rule in rules {
+            if let Err(e) = ctx
+                .port_forward_tx
+                .send(PortForwardEvent::Removed {
+                    protocol: rule.protocol,
+                    port: rule.public_port,
+                })
+                .await
+            {
+                error!("Failed to notify dataplane of port forward removal: {}", e);
+            }
+        }
+        info!(
+            "Removed banned peer {} with IP {}",
+            encode_key(&peer.public_key),
+            peer.assigned_ip
+        );
+    }
+
+    (
+        StatusCode::OK,
+        Json(serde_json::json!({
+            "status": "banned",
+            "removed_peer": removed_peer,
+        })),
+    )
+}
+
+/// Handler for DELETE /v1/bans/{public_key}
+async fn unban_key_handler(
+    State(ctx): State<AdminState>,
+    actor: Actor,
+    Path(public_key): Path<String>,
+) -> impl IntoResponse {
+    let Some(public_key) = decode_public_key(&public_key) else {
+        return (
+            StatusCode::BAD_REQUEST,
+            Json(serde_json::json!({"error": "invalid public key"})),
+        );
+    };
+
+    let unbanned = ctx.shared.unban_key(&public_key);
+    let entry = AuditEntry::new(AuditAction::KeyUnban, &actor).target(encode_key(&public_key));
+    ctx.shared.audit.record(if unbanned {
+        entry
+    } else {
+        entry.failed("public key is not banned")
+    });
+    if !unbanned {
+        return (
+            StatusCode::NOT_FOUND,
+            Json(serde_json::json!({"error": "public key is not banned"})),
+        );
+    }
+    info!("Admin API lifted ban on {}", encode_key(&public_key));
+    (
+        StatusCode::OK,
+        Json(serde_json::json!({"status": "unbanned"})),
+    )
+}
+
+/// Handler for GET /v1/status
+async fn status_handler(State(ctx): State<AdminState>) -> impl IntoResponse {
+    let peers: Vec<PeerInfo> = ctx.shared.peers.read().iter().cloned().collect();
+    let peers: Vec<_> = peers.iter().map(|peer| peer_json(&ctx, peer)).collect();
+    let mut body = serde_json::json!({
+        "public_key": encode_key(&ctx.shared.server_public_key()),
+        "listen_addr": ctx.wg_io.local_addr().map(|addr| addr.to_string()),
+        "listen_addrs": ctx
+            .wg_io
+            .local_addrs()
+            .iter()
+            .map(|addr| addr.to_string())
+            .collect::<Vec<_>>(),
+        "address": format!("{}/{}", ctx.shared.config.subnet, ctx.shared.config.subnet_mask),
+        "networks": ctx
+            .shared
+            .config
+            .networks
+            .iter()
+            .map(|network| {
+                serde_json::json!({
+                    "address": format!("{}/{}", network.server_ip, network.prefix_len),
+                    "tag": network.tag,
+                })
+            })
+            .collect::<Vec<_>>(),
+        "peers": peers,
+    });
+    if let Some((public_key, until)) = ctx.wg_io.retiring_key() {
+        body["previous_public_key"] = encode_key(&public_key).into();
+        body["previous_key_retires_at"] = until
+            .duration_since(UNIX_EPOCH)
+            .map_or(0, |d| d.as_secs())
+            .into();
+    }
+    (StatusCode::OK, Json(body))
+}
+
+/// Handler for POST /v1/server-key
+async fn rotate_key_handler(
+    State(ctx): State<AdminState>,
+    actor: Actor,
+    Json(req): Json<RotateKeyRequest>,
+) -> impl IntoResponse {
+    let private_key = match req.private_key.as_deref() {
+        Some(key) => match base64::engine::general_purpose::STANDARD
+            .decode(key.trim())
+            .ok()
+            .and_then(|bytes| <[u8; 32]>::try_from(bytes).ok())
+        {
+            Some(key) => key,
+            None => {
+                return (
+                    StatusCode::BAD_REQUEST,
+                    Json(serde_json::json!({"error": "invalid private key"})),
+                );
+            }
+        },
+        None => wgconf::generate_key().private_key,
+    };
+    // Checked before the key is saved, so a bad request changes nothing
+    let retire_at = match SystemTime::now().checked_add(Duration::from_secs(req.grace_secs)) {
+        Some(retire_at) if req.grace_secs <= MAX_KEY_GRACE_SECS => retire_at,
+        _ => {
+            return (
+                StatusCode::BAD_REQUEST,
+                Json(serde_json::json!({
+                    "error": format!("grace_secs must be at most {}", MAX_KEY_GRACE_SECS)
+                })),
+            );
+        }
+    };
+    let public_key = wgconf::public_key(&private_key);
+    let entry =
+        AuditEntry::new(AuditAction::ServerKeyRotate, &actor).target(encode_key(&public_key));
+
+    // Save first, so a restart never comes back with a key clients were
+    // told to stop using
+    if let Some(path) = &ctx.key_file {
+        if let Err(e) = save_private_key(path, &private_key) {
+            let error = format!("{:#}", e);
+            error!("Failed to save rotated server key: {}", error);
+            ctx.shared.audit.record(entry.failed(error.clone()));
+            return (
+                StatusCode::INTERNAL_SERVER_ERROR,
+                Json(serde_json::json!({ "error": error })),
+            );
+        }
+    }
+    let previous_public_key = ctx.shared.server_public_key();
+    let retire_at = ctx
+        .wg_io
+        .rotate_key(private_key, retire_at)
+        .duration_since(UNIX_EPOCH)
+        .map_or(0, |d| d.as_secs());
+    ctx.shared
+        .audit
+        .record(entry.detail(format!("grace {}s", req.grace_secs)));
+    info!(
+        "Rotated server key to {}; {} is answered until {}",
+        encode_key(&public_key),
+        encode_key(&previous_public_key),
+        retire_at
+    );
+    if ctx.key_file.is_none() {
+        warn!("Rotated server key is not saved; the server will use its old key after a restart");
+    }
+
+    (
+        StatusCode::OK,
+        Json(serde_json::json!({
+            "public_key": encode_key(&public_key),
+            "previous_public_key": encode_key(&previous_public_key),
+            "previous_key_retires_at": retire_at,
+            "saved": ctx.key_file.is_some(),
+        })),
+    )
+}
+
+/// Atomically replace the server's key file, readable only by its owner
+fn save_private_key(path: &str, private_key: &[u8; 32]) -> anyhow::Result<()> {
+    use std::io::Write;
+    use std::os::unix::fs::OpenOptionsExt;
+
+    let path = std::path::Path::new(path);
+    let tmp_path = path.with_extension("tmp");
+    let mut tmp = std::fs::OpenOptions::new()
+        .write(true)
+        .create(true)
+        .truncate(true)
+        .mode(0o600)
+        .open(&tmp_path)
+        .with_context(|| format!("failed to create {}", tmp_path.display()))?;
+    writeln!(
+        tmp,
+        "{}",
+        base64::engine::general_purpose::STANDARD.encode(private_key)
+    )?;
+    tmp.sync_all()?;
+    std::fs::rename(&tmp_path, path)
+        .with_context(|| format!("failed to replace {}", path.display()))?;
+    Ok(())
+}
+
+/// Handler for GET /v1/events
+async fn events_handler(
+    State(ctx): State<AdminState>,
+) -> Sse<impl Stream<Item = Result<sse::Event, axum::Error>>> {
+    let rx = ctx.shared.events.subscribe();
+    let stream = futures::stream::unfold(rx, |mut rx| async move {
+        let event = match rx.recv().await {
+            Ok(event) => sse::Event::default().event(event.kind()).json_data(&event),
+            // Tell slow subscribers how much they missed so they can resync
+            Err(RecvError::Lagged(missed)) => {
+                Ok(sse::Event::default().event("lagged").data(missed.to_string()))
+            }
+            Err(RecvError::Closed) => return None,
+        };
+        Some((event, rx))
+    });
+    Sse::new(stream).keep_alive(KeepAlive::default())
+}
+
+/// Handler for GET /v1/capture
+async fn capture_handler(
+    State(ctx): State<AdminState>,
+    actor: Actor,
+    Query(query): Query<CaptureQuery>,
+) -> Response {
+    let bad_request = |error: &str| {
+        (
+            StatusCode::BAD_REQUEST,
+            Json(serde_json::json!({ "error": error })),
+        )
+            .into_response()
+    };
+    let peer = match query.peer.as_deref().map(decode_public_key) {
+        Some(None) => return bad_request("invalid public key"),
+        Some(Some(peer)) => Some(peer),
+        None => None,
+    };
+    let protocol = match query.protocol.as_deref().map(str::to_ascii_lowercase) {
+        Some(protocol) if protocol == "tcp" => Some(Protocol::Tcp),
+        Some(protocol) if protocol == "udp" => Some(Protocol::Udp),
+        Some(_) => return bad_request("protocol must be 'tcp' or 'udp'"),
+        None => None,
+    };
+    if query.seconds == 0 || query.seconds > MAX_CAPTURE_SECS {
+        return bad_request("seconds must be between 1 and 3600");
+    }
+
+    let mut entry =
+        AuditEntry::new(AuditAction::Capture, &actor).detail(format!("{} seconds", query.seconds));
+    if let Some(peer) = &peer {
+        entry = entry.target(encode_key(peer));
+    }
+    ctx.shared.audit.record(entry);
+
+    let packets = ctx.stats.capture.subscribe(CaptureFilter {
+        peer,
+        host: query.host,
+        port: query.port,
+        protocol,
+    });
+    let deadline = tokio::time::Instant::now() + Duration::from_secs(query.seconds);
+    let header =
+        futures::stream::once(async { Ok::<_, std::convert::Infallible>(pcap::file_header()) });
+    let records = futures::stream::unfold(packets, move |mut packets| async move {
+        let packet = tokio::time::timeout_at(deadline, packets.recv())
+            .await
+            .ok()??;
+        Some((Ok(pcap::record(&packet)), packets))
+    });
+    (
+        [
+            (header::CONTENT_TYPE, "application/vnd.tcpdump.pcap"),
+            (
+                header::CONTENT_DISPOSITION,
+                "attachment; filename=\"wirecage.pcap\"",
+            ),
+        ],
+        Body::from_stream(header.chain(records)),
+    )
+        .into_response()
+}
+
+fn peer_json(ctx: &AdminContext, peer: &PeerInfo) -> serde_json::Value {
+    let port_forwards: Vec<_> = ctx
+        .shared
+        .port_forwards
+        .read()
+        .rules_for_peer(&peer.public_key)
+        .into_iter()
+        .map(|rule| {
+            serde_json::json!({
+                "protocol": match rule.protocol {
+                    Protocol::Tcp => "tcp",
+                    Protocol::Udp => "udp",
+                },
+                "public_port": rule.public_port,
+                "target_port": rule.target_port,
+            })
+        })
+        .collect();
+
+    let stats = ctx.wg_io.peer_stats(&peer.public_key);
+    let stats = stats.as_ref();
+    let unix_secs = |time: Option<SystemTime>| {
+        time.and_then(|t| t.duration_since(UNIX_EPOCH).ok())
+            .map(|d| d.as_secs())
+    };
+    serde_json::json!({
+        "public_key": encode_key(&peer.public_key),
+        "assigned_ip": peer.assigned_ip.to_string(),
+        "assigned_ip6": ctx
+            .shared
+            .config
+            .ipv6_prefix
+            .map(|prefix| prefix.address_for(peer.assigned_ip).to_string()),
+        "name": peer.name,
+        "has_preshared_key": peer.preshared_key.is_some(),
+        "tags": peer.tags,
+        "expires_at": peer
+            .expires_at
+            .and_then(|t| t.duration_since(UNIX_EPOCH).ok())
+            .map(|d| d.as_secs()),
+        "endpoint": stats.and_then(|s| s.endpoint).map(|addr| addr.to_string()),
+        "latest_handshake": unix_secs(stats.and_then(|s| s.last_handshake)),
+        "last_receive": unix_secs(stats.and_then(|s| s.last_receive)),
+        "last_keepalive": unix_secs(stats.and_then(|s| s.last_keepalive)),
+        "connected": stats.is_some_and(|s| s.is_connected()),
+        "keepalive": stats.is_some_and(|s| s.sends_keepalives()),
+        "roams": stats.map_or(0, |s| s.roams),
+        "rx_bytes": stats.map_or(0, |s| s.rx_bytes),
+        "tx_bytes": stats.map_or(0, |s| s.tx_bytes),
+        "port_forwards": port_forwards,
+    })
+}
+
+/// Handler for GET /v1/showconf. Read tokens get the peers without their
+/// preshared keys; the admin socket and admin tokens get everything.
+async fn showconf_handler(
+    State(ctx): State<AdminState>,
+    scope: Option<Extension<Scope>>,
+    Query(query): Query<ShowconfQuery>,
+) -> impl IntoResponse {
+    let reveals_preshared_keys = scope.map_or(true, |Extension(scope)| scope == Scope::Admin);
+    let mut peers: Vec<PeerInfo> = ctx.shared.peers.read().iter().cloned().collect();
+    peers.sort_by_key(|peer| peer.assigned_ip);
+    let endpoints: Vec<_> = peers
+        .iter()
+        .map(|peer| ctx.wg_io.peer_stats(&peer.public_key).and_then(|s| s.endpoint))
+        .collect();
+    let conf_peers: Vec<_> = peers
+        .iter()
+        .zip(endpoints)
+        .map(|(peer, endpoint)| wgconf::ServerConfPeer {
+            public_key: &peer.public_key,
+            preshared_key: peer
+                .preshared_key
+                .as_ref()
+                .filter(|_| reveals_preshared_keys),
+            address: peer.assigned_ip,
+            address6: ctx
+                .shared
+                .config
+                .ipv6_prefix
+                .map(|prefix| prefix.address_for(peer.assigned_ip)),
+            endpoint,
+        })
+        .collect();
+
+    let listen_port = ctx.wg_io.local_addr().map_or(0, |addr| addr.port());
+    let private_key = query
+        .private_key
+        .then(|| ctx.wg_io.server_private_key());
+    (
+        [(header::CONTENT_TYPE, "text/plain; charset=utf-8")],
+        wgconf::render_showconf(listen_port, private_key.as_ref(), &conf_peers),
+    )
+}
+
+/// Handler for POST /v1/wg-config/reload
+async fn reload_wg_config_handler(
+    State(ctx): State<AdminState>,
+    actor: Actor,
+) -> impl IntoResponse {
+    let Some(wg_config) = &ctx.wg_config else {
+        return (
+            StatusCode::NOT_FOUND,
+            Json(serde_json::json!({"error": "no --wg-config file configured"})),
+        );
+    };
+    let reloaded = wg_config.reload(&ctx.shared);
+    let entry = AuditEntry::new(AuditAction::ConfigReload, &actor).target("wg-config");
+    ctx.shared.audit.record(match &reloaded {
+        Ok(result) => entry.detail(format!(
+            "{} applied, {} skipped, {} removed",
+            result.applied, result.skipped, result.removed
+        )),
+        Err(e) => entry.failed(format!("{:#}", e)),
+    });
+    let result = match reloaded {
+        Ok(result) => result,
+        Err(e) => {
+            return (
+                StatusCode::UNPROCESSABLE_ENTITY,
+                Json(serde_json::json!({"error": format!("{:#}", e)})),
+            );
+        }
+    };
+
+    for rule in &result.removed_rules {
+        if let Err(e) = ctx
+            .port_forward_tx
+            .send(PortForwardEvent::Removed {
+                protocol: rule.protocol,
+                port: rule.public_port,
+            })
+            .await
+        {
+            error!("Failed to notify dataplane of port forward removal: {}", e);
+        }
+    }
+
+    (
+        StatusCode::OK,
+        Json(serde_json::json!({
+            "applied": result.applied,
+            "skipped": result.skipped,
+            "removed": result.removed,
+        })),
+    )
+}
+
+/// Handler for GET /v1/firewall
+async fn firewall_handler(State(ctx): State<AdminState>) -> impl IntoResponse {
+    (
+        StatusCode::OK,
+        Json(serde_json::json!({
+            "policy": ctx.firewall.policy(),
+            "rules": ctx.firewall.rules(),
+        })),
+    )
+}
+
+/// Handler for POST /v1/firewall/reload
+async fn reload_firewall_handler(
+    State(ctx): State<AdminState>,
+    actor: Actor,
+) -> impl IntoResponse {
+    if !ctx.firewall.is_configured() {
+        return (
+            StatusCode::NOT_FOUND,
+            Json(serde_json::json!({"error": "no --firewall-rules file configured"})),
+        );
+    }
+    let reloaded = ctx.firewall.reload().await;
+    let entry = AuditEntry::new(AuditAction::ConfigReload, &actor).target("firewall");
+    ctx.shared.audit.record(match &reloaded {
+        Ok(count) => entry.detail(format!("{} rules", count)),
+        Err(e) => entry.failed(format!("{:#}", e)),
+    });
+    match reloaded {
+        Ok(count) => (StatusCode::OK, Json(serde_json::json!({ "rules": count }))),
+        Err(e) => (
+            StatusCode::UNPROCESSABLE_ENTITY,
+            Json(serde_json::json!({"error": format!("{:#}", e)})),
+        ),
+    }
+}
+
+/// Handler for POST /v1/reload
+async fn reload_handler(State(ctx): State<AdminState>, actor: Actor) -> impl IntoResponse {
+    let outcomes = ctx.reloader.reload(&actor).await;
+    let status = if outcomes.iter().all(|outcome| outcome.ok) {
+        StatusCode::OK
+    } else {
+        StatusCode::UNPROCESSABLE_ENTITY
+    };
+    (status, Json(serde_json::json!({ "reloaded": outcomes })))
+}
+
+/// Handler for GET /v1/audit
+async fn audit_handler(
+    State(ctx): State<AdminState>,
+    Query(filter): Query<AuditFilter>,
+) -> impl IntoResponse {
+    match ctx.shared.audit.query(&filter) {
+        Ok(entries) => (
+            StatusCode::OK,
+            Json(serde_json::json!({ "entries": entries })),
+        ),
+        Err(e) => (
+            StatusCode::INTERNAL_SERVER_ERROR,
+            Json(serde_json::json!({"error": format!("{:#}", e)})),
+        ),
+    }
+}
+
+/// Admin callers are identified by their token, or by the socket they used
+impl<S: Send + Sync> FromRequestParts<S> for Actor {
+    type Rejection = std::convert::Infallible;
+
+    async fn from_request_parts(parts: &mut Parts, _state: &S) -> Result<Self, Self::Rejection> {
+        let source = parts
+            .extensions
+            .get::<ConnectInfo<SocketAddr>>()
+            .map(|ConnectInfo(addr)| addr.to_string());
+        let who = match (parts.extensions.get::<AdminIdentity>(), &source) {
+            (Some(AdminIdentity(who)), _) => who.clone(),
+            (None, Some(_)) => "anonymous".to_string(),
+            (None, None) => "admin-socket".to_string(),
+        };
+        Ok(Actor { who, source })
+    }
+}
+
+/// Decode a standard or URL-safe base64 public key
+fn decode_public_key(key: &str) -> Option<[u8; 32]> {
+    let standard: String = key
+        .trim()
+        .chars()
+        .map(|c| match c {
+            '-' => '+',
+            '_' => '/',
+            c => c,
+        })
+        .collect();
+    base64::engine::general_purpose::STANDARD
+        .decode(standard)
+        .ok()?
+        .try_into()
+        .ok()
+}
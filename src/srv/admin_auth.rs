@@ -0,0 +1,225 @@
+//! Authentication and TLS for the TCP admin API
+//!
+//! The admin unix socket is protected by its file permissions. The TCP
+//! listener can additionally require bearer tokens, be served over TLS, and
+//! demand client certificates signed by a given CA, so it can be exposed
+//! beyond loopback.
+//!
+//! Tokens have one of two scopes: read tokens may inspect the server
+//! (`GET` requests), admin tokens may also change it. Reading the server's
+//! private key through `/v1/showconf`, tunnel traffic through
+//! `/v1/capture`, or the cluster's peers with their preshared keys through
+//! `/v1/cluster/state`, needs the admin scope; `/v1/showconf` leaves
+//! preshared keys out for read tokens.
+//!
+//! The `/dashboard` page loads without a token, and asks for one to use the
+//! API with.
+
+use std::io::BufReader;
+use std::sync::Arc;
+
+use anyhow::{Context, Result};
+use axum::{
+    extract::{Query, Request, State},
+    http::{header, Method, StatusCode},
+    middleware::Next,
+    response::{IntoResponse, Response},
+    Json,
+};
+use aws_lc_rs::digest;
+use axum_server::tls_rustls::RustlsConfig;
+use rustls::server::WebPkiClientVerifier;
+
+use super::admin::ShowconfQuery;
+use super::api::constant_time_eq;
+use super::cluster;
+use super::dashboard;
+use super::tenant;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum Scope {
+    Read,
+    Admin,
+}
+
+/// Who an authenticated admin request came from, as recorded in the audit log
+#[derive(Debug, Clone)]
+pub struct AdminIdentity(pub String);
+
+/// Bearer tokens accepted on the TCP admin listener
+pub struct AdminTokens {
+    admin: Vec<String>,
+    read: Vec<String>,
+}
+
+impl AdminTokens {
+    pub fn new(admin: Vec<String>, read: Vec<String>) -> Self {
+        let non_empty = |tokens: Vec<String>| tokens.into_iter().filter(|t| !t.is_empty()).collect();
+        Self {
+            admin: non_empty(admin),
+            read: non_empty(read),
+        }
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.admin.is_empty() && self.read.is_empty()
+    }
+
+    fn scope(&self, token: &str) -> Option<Scope> {
+        let matches = |tokens: &[String]| {
+            tokens
+                .iter()
+                .any(|candidate| constant_time_eq(token.as_bytes(), candidate.as_bytes()))
+        };
+        if matches(&self.admin) {
+            Some(Scope::Admin)
+        } else if matches(&self.read) {
+            Some(Scope::Read)
+        } else {
+            None
+        }
+    }
+}
+
+/// Scope needed to make a request
+fn required_scope(request: &Request) -> Scope {
+    // Tenants' APIs are checked as their own
+    let path = tenant::route_path(request.uri().path());
+    // Parsed as the handler parses it, so an encoded query can't slip past;
+    // one it can't parse is refused either way
+    let reveals_private_key = path == "/v1/showconf"
+        && Query::<ShowconfQuery>::try_from_uri(request.uri())
+            .map_or(true, |Query(query)| query.private_key);
+    let reveals_traffic = path == "/v1/capture";
+    // Cluster nodes exchange peers with their preshared keys
+    let reveals_preshared_keys = path == cluster::STATE_PATH;
+    match *request.method() {
+        Method::GET | Method::HEAD
+            if !reveals_private_key && !reveals_traffic && !reveals_preshared_keys =>
+        {
+            Scope::Read
+        }
+        _ => Scope::Admin,
+    }
+}
+
+/// Names a token by a short hash, so logs can tell tokens apart without
+/// revealing them
+fn token_id(token: &str) -> String {
+    let hash = digest::digest(&digest::SHA256, token.as_bytes());
+    hash.as_ref()[..4].iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+/// Middleware rejecting requests without a token of sufficient scope
+pub async fn require_token(
+    State(tokens): State<Arc<AdminTokens>>,
+    mut request: Request,
+    next: Next,
+) -> Response {
+    // The dashboard page holds nothing secret; it asks for a token itself
+    let path = tenant::route_path(request.uri().path());
+    if path == dashboard::PATH && request.method() == Method::GET {
+        return next.run(request).await;
+    }
+    let token = request
+        .headers()
+        .get(header::AUTHORIZATION)
+        .and_then(|value| value.to_str().ok())
+        .and_then(|value| value.strip_prefix("Bearer "))
+        .map(str::trim)
+        .unwrap_or_default();
+    let Some(scope) = tokens.scope(token) else {
+        return (
+            StatusCode::UNAUTHORIZED,
+            [(header::WWW_AUTHENTICATE, "Bearer")],
+            Json(serde_json::json!({"error": "missing or invalid admin token"})),
+        )
+            .into_response();
+    };
+    if scope < required_scope(&request) {
+        return (
+            StatusCode::FORBIDDEN,
+            Json(serde_json::json!({"error": "token is read-only"})),
+        )
+            .into_response();
+    }
+    let kind = match scope {
+        Scope::Read => "read-token",
+        Scope::Admin => "admin-token",
+    };
+    let identity = AdminIdentity(format!("{}:{}", kind, token_id(token)));
+    request.extensions_mut().insert(identity);
+    request.extensions_mut().insert(scope);
+    next.run(request).await
+}
+
+/// TLS settings for the admin listener, requiring client certificates
+/// signed by `client_ca` when it is given
+pub async fn tls_config(cert: &str, key: &str, client_ca: Option<&str>) -> Result<RustlsConfig> {
+    let Some(client_ca) = client_ca else {
+        return RustlsConfig::from_pem_file(cert, key)
+            .await
+            .context("failed to load admin TLS config");
+    };
+
+    let mut roots = rustls::RootCertStore::empty();
+    for ca in read_certs(client_ca)? {
+        roots.add(ca).context("invalid admin client CA certificate")?;
+    }
+    let provider = Arc::new(rustls::crypto::aws_lc_rs::default_provider());
+    let verifier = WebPkiClientVerifier::builder_with_provider(Arc::new(roots), Arc::clone(&provider))
+        .build()
+        .context("failed to configure admin client verification")?;
+
+    let key = rustls_pemfile::private_key(&mut BufReader::new(
+        std::fs::File::open(key).with_context(|| format!("failed to open {}", key))?,
+    ))
+    .with_context(|| format!("failed to read {}", key))?
+    .with_context(|| format!("no private key in {}", key))?;
+    let mut config = rustls::ServerConfig::builder_with_provider(provider)
+        .with_safe_default_protocol_versions()
+        .context("failed to configure admin TLS")?
+        .with_client_cert_verifier(verifier)
+        .with_single_cert(read_certs(cert)?, key)
+        .context("invalid admin TLS certificate or key")?;
+    config.alpn_protocols = vec![b"h2".to_vec(), b"http/1.1".to_vec()];
+    Ok(RustlsConfig::from_config(Arc::new(config)))
+}
+
+fn read_certs(path: &str) -> Result<Vec<rustls::pki_types::CertificateDer<'static>>> {
+    let file = std::fs::File::open(path).with_context(|| format!("failed to open {}", path))?;
+    let certs = rustls_pemfile::certs(&mut BufReader::new(file))
+        .collect::<Result<Vec<_>, _>>()
+        .with_context(|| format!("failed to read {}", path))?;
+    if certs.is_empty() {
+        anyhow::bail!("no certificates in {}", path);
+    }
+    Ok(certs)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use axum::body::Body;
+
+    fn scope_of(uri: &str) -> Scope {
+        required_scope(&Request::get(uri).body(Body::empty()).unwrap())
+    }
+
+    #[test]
+    fn showconf_private_key_needs_admin() {
+        let tokens = AdminTokens::new(vec!["admin".into()], vec!["read".into()]);
+        let read = tokens.scope("read").unwrap();
+        assert!(read >= scope_of("/v1/showconf"));
+        assert!(read >= scope_of("/v1/showconf?private_key=false"));
+        for uri in [
+            "/v1/showconf?private_key=true",
+            "/v1/showconf?private%5Fkey=true",
+            "/v1/showconf?private_key=tru%65",
+            "/v1/showconf?private_key=1",
+        ] {
+            assert!(read < scope_of(uri), "{}", uri);
+            assert!(tokens.scope("admin").unwrap() >= scope_of(uri), "{}", uri);
+        }
+    }
+}
@@ -0,0 +1,226 @@
+//! Detection of unusual egress behavior per peer
+//!
+//! Since every packet a peer sends leaves through the server, it is the
+//! natural place to notice a compromised client. With
+//! `--anomaly-detection`, each peer's new flows and DNS queries are tallied
+//! per minute and three things are flagged:
+//! - a spike in distinct destination addresses well above the peer's own
+//!   moving average (`destination_spike`)
+//! - DNS queries above a rate for several minutes in a row (`dns_rate`)
+//! - a flow to a protocol and port the peer has not used before, once the
+//!   peer has been watched for the learning period (`new_port`)
+//!
+//! Each anomaly is published as an `anomaly` event, which reaches
+//! `/v1/events` subscribers and webhooks, and counted in
+//! `wirecage_anomalies_total`. Only counts and small sets are kept, so the
+//! cost per flow is a hash lookup.
+
+use std::collections::{HashMap, HashSet};
+use std::net::IpAddr;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use parking_lot::Mutex;
+use serde::Serialize;
+use tracing::warn;
+
+use super::events::{encode_key, Event};
+use super::flow::Protocol;
+use super::state::SharedState;
+
+/// Length of the windows activity is tallied over
+const WINDOW: Duration = Duration::from_secs(60);
+
+/// Windows of history a peer needs before destination spikes are flagged
+const BASELINE_WINDOWS: u32 = 10;
+
+/// How many times its average a peer's destinations must be to spike
+const SPIKE_FACTOR: f64 = 5.0;
+
+/// Weight of the latest window in the moving average of destinations
+const BASELINE_WEIGHT: f64 = 0.2;
+
+/// Consecutive windows over the DNS rate before it is flagged
+const DNS_SUSTAINED_WINDOWS: u32 = 3;
+
+/// Distinct destinations and ports remembered per peer
+const MAX_TRACKED: usize = 4096;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum AnomalyKind {
+    DestinationSpike,
+    DnsRate,
+    NewPort,
+}
+
+impl AnomalyKind {
+    pub const ALL: [AnomalyKind; 3] = [
+        AnomalyKind::DestinationSpike,
+        AnomalyKind::DnsRate,
+        AnomalyKind::NewPort,
+    ];
+
+    pub fn label(self) -> &'static str {
+        match self {
+            AnomalyKind::DestinationSpike => "destination_spike",
+            AnomalyKind::DnsRate => "dns_rate",
+            AnomalyKind::NewPort => "new_port",
+        }
+    }
+}
+
+pub struct AnomalySettings {
+    /// Fewest distinct destinations in a minute that can count as a spike
+    pub min_destinations: usize,
+    /// DNS queries per minute that count as a high rate
+    pub dns_per_minute: u64,
+    /// How long a peer is watched before new ports are flagged
+    pub learning_period: Duration,
+}
+
+#[derive(Default)]
+struct PeerActivity {
+    first_seen: Option<Instant>,
+    /// Distinct destinations in the current window
+    destinations: HashSet<IpAddr>,
+    /// Moving average of distinct destinations per window
+    baseline: f64,
+    windows: u32,
+    dns_queries: u64,
+    /// Consecutive windows over the DNS rate
+    dns_high_windows: u32,
+    ports: HashSet<(Protocol, u16)>,
+}
+
+/// Watches each peer's flows and DNS queries for anomalies
+pub struct AnomalyDetector {
+    settings: AnomalySettings,
+    shared: Arc<SharedState>,
+    peers: Mutex<HashMap<[u8; 32], PeerActivity>>,
+}
+
+impl AnomalyDetector {
+    /// Start a detector that closes a window every minute
+    pub fn spawn(settings: AnomalySettings, shared: Arc<SharedState>) -> Arc<Self> {
+        let detector = Arc::new(Self {
+            settings,
+            shared,
+            peers: Mutex::new(HashMap::new()),
+        });
+        let ticker = Arc::clone(&detector);
+        tokio::spawn(async move {
+            let mut interval = tokio::time::interval(WINDOW);
+            interval.tick().await;
+            loop {
+                interval.tick().await;
+                ticker.close_window();
+            }
+        });
+        detector
+    }
+
+    /// Note a new outbound flow from a peer
+    pub fn flow(&self, peer_pubkey: &[u8; 32], protocol: Protocol, ip: IpAddr, port: u16) {
+        let mut peers = self.peers.lock();
+        let activity = peers.entry(*peer_pubkey).or_default();
+        let first_seen = *activity.first_seen.get_or_insert_with(Instant::now);
+        if activity.destinations.len() < MAX_TRACKED {
+            activity.destinations.insert(ip);
+        }
+        if activity.ports.len() >= MAX_TRACKED || !activity.ports.insert((protocol, port)) {
+            return;
+        }
+        drop(peers);
+        if first_seen.elapsed() >= self.settings.learning_period {
+            let protocol = match protocol {
+                Protocol::Tcp => "tcp",
+                Protocol::Udp => "udp",
+            };
+            self.raise(
+                peer_pubkey,
+                AnomalyKind::NewPort,
+                format!("first {} flow to port {} ({}:{})", protocol, port, ip, port),
+            );
+        }
+    }
+
+    /// Note a DNS query from a peer
+    pub fn dns_query(&self, peer_pubkey: &[u8; 32]) {
+        let mut peers = self.peers.lock();
+        let activity = peers.entry(*peer_pubkey).or_default();
+        activity.first_seen.get_or_insert_with(Instant::now);
+        activity.dns_queries += 1;
+    }
+
+    fn close_window(&self) {
+        let mut raised = Vec::new();
+        {
+            let registered = self.shared.peers.read();
+            let mut peers = self.peers.lock();
+            peers.retain(|public_key, _| registered.get_by_pubkey(public_key).is_some());
+            for (public_key, activity) in peers.iter_mut() {
+                let destinations = activity.destinations.len();
+                if activity.windows >= BASELINE_WINDOWS
+                    && destinations >= self.settings.min_destinations
+                    && destinations as f64 > activity.baseline * SPIKE_FACTOR
+                {
+                    raised.push((
+                        *public_key,
+                        AnomalyKind::DestinationSpike,
+                        format!(
+                            "{} destinations in a minute against an average of {:.1}",
+                            destinations, activity.baseline
+                        ),
+                    ));
+                }
+                activity.baseline = if activity.windows == 0 {
+                    destinations as f64
+                } else {
+                    activity.baseline * (1.0 - BASELINE_WEIGHT)
+                        + destinations as f64 * BASELINE_WEIGHT
+                };
+                activity.windows = activity.windows.saturating_add(1);
+                activity.destinations.clear();
+
+                if activity.dns_queries >= self.settings.dns_per_minute {
+                    activity.dns_high_windows += 1;
+                    // Raised once per stretch of high-rate windows
+                    if activity.dns_high_windows == DNS_SUSTAINED_WINDOWS {
+                        raised.push((
+                            *public_key,
+                            AnomalyKind::DnsRate,
+                            format!(
+                                "{} DNS queries in the last minute, over {}/min for {} minutes",
+                                activity.dns_queries,
+                                self.settings.dns_per_minute,
+                                DNS_SUSTAINED_WINDOWS
+                            ),
+                        ));
+                    }
+                } else {
+                    activity.dns_high_windows = 0;
+                }
+                activity.dns_queries = 0;
+            }
+        }
+        for (public_key, kind, detail) in raised {
+            self.raise(&public_key, kind, detail);
+        }
+    }
+
+    fn raise(&self, peer_pubkey: &[u8; 32], kind: AnomalyKind, detail: String) {
+        warn!(
+            "Anomaly from peer {}: {}: {}",
+            encode_key(peer_pubkey),
+            kind.label(),
+            detail
+        );
+        self.shared.metrics.record_anomaly(kind);
+        self.shared.events.publish(Event::Anomaly {
+            public_key: encode_key(peer_pubkey),
+            anomaly: kind,
+            detail,
+        });
+    }
+}
@@ -1,13 +1,17 @@
 //! HTTPS API for wirecagesrv
 //!
 //! Provides endpoints for:
-//! - Token-based authentication and WireGuard config provisioning
+//! - Token-based authentication and WireGuard config provisioning, using
+//!   the server auth token, an enrollment token, an OIDC ID token, or a
+//!   signature from an authorized SSH key
 //! - Port forwarding rule management
+//! - `/healthz` and `/readyz` for load balancers (see `health`)
 
+use std::net::SocketAddr;
 use std::sync::Arc;
 
 use axum::{
-    extract::State,
+    extract::{ConnectInfo, State},
     http::StatusCode,
     response::IntoResponse,
     routing::{delete, post},
@@ -18,14 +22,34 @@ use serde::Deserialize;
 use tokio::sync::mpsc;
 use tracing::{error, info, warn};
 
+use super::audit::{Actor, AuditAction, AuditEntry};
 use super::flow::{PortForwardRule, Protocol};
-use super::state::{PeerInfo, SharedState};
+use super::obfuscation::Obfuscation;
+use super::oidc::{self, OidcVerifier};
+use super::ssh_auth::SshAuthorizer;
+use super::state::{AddPeerError, PeerOptions, SharedState};
+use super::wgconf;
 
 /// Request to register a new peer
 #[derive(Debug, Deserialize)]
 pub struct RegisterRequest {
     pub token: String,
     pub client_public_key: String,
+    /// Optional DNS label for the peer inside the VPN
+    #[serde(default)]
+    pub name: Option<String>,
+    /// Code from an authenticator app, for enrollment tokens that require one
+    #[serde(default)]
+    pub totp_code: Option<String>,
+    /// Armored `ssh-keygen -Y sign` signature of the enrollment message
+    #[serde(default)]
+    pub ssh_signature: Option<String>,
+    /// Unix time included in the signed enrollment message
+    #[serde(default)]
+    pub ssh_timestamp: u64,
+    /// Ask for a preshared key, generated on first registration
+    #[serde(default)]
+    pub preshared_key: bool,
 }
 
 /// Request to create a port forward
@@ -59,19 +83,33 @@ pub type ApiState = Arc<ApiContext>;
 pub struct ApiContext {
     pub shared: Arc<SharedState>,
     pub wg_endpoint: String,
+    /// URL of the WebSocket relay clients fall back to, if the server runs
+    /// one
+    pub relay_url: Option<String>,
     pub port_forward_tx: mpsc::Sender<PortForwardEvent>,
+    pub oidc: Option<Arc<OidcVerifier>>,
+    pub ssh: Option<SshAuthorizer>,
+    pub obfuscation: Arc<Obfuscation>,
 }
 
 /// Create the API router
 pub fn create_router(
     shared: Arc<SharedState>,
     wg_endpoint: String,
+    relay_url: Option<String>,
     port_forward_tx: mpsc::Sender<PortForwardEvent>,
+    oidc: Option<Arc<OidcVerifier>>,
+    ssh: Option<SshAuthorizer>,
+    obfuscation: Arc<Obfuscation>,
 ) -> Router {
     let ctx = Arc::new(ApiContext {
         shared,
         wg_endpoint,
+        relay_url,
         port_forward_tx,
+        oidc,
+        ssh,
+        obfuscation,
     });
 
     Router::new()
@@ -84,16 +122,37 @@ pub fn create_router(
 /// Handler for POST /v1/register
 async fn register_handler(
     State(ctx): State<ApiState>,
+    ConnectInfo(remote): ConnectInfo<SocketAddr>,
     Json(req): Json<RegisterRequest>,
 ) -> impl IntoResponse {
-    // Constant-time token comparison to prevent timing attacks
-    if !constant_time_eq(req.token.as_bytes(), ctx.shared.config.auth_token.as_bytes()) {
-        warn!("Invalid token attempt");
-        return (
-            StatusCode::UNAUTHORIZED,
-            Json(serde_json::json!({"error": "invalid token"})),
-        );
-    }
+    let mut actor = Actor {
+        who: "unauthenticated".to_string(),
+        source: Some(remote.to_string()),
+    };
+    let (status, body) = register(&ctx, &req, &mut actor).await;
+
+    let entry = AuditEntry::new(AuditAction::Enroll, &actor).target(req.client_public_key.clone());
+    ctx.shared.audit.record(if status.is_success() {
+        entry
+    } else {
+        entry.failed(body["error"].as_str().unwrap_or("registration failed"))
+    });
+    (status, body)
+}
+
+/// Authenticate and add a registering peer, noting in `actor` who it
+/// authenticated as
+async fn register(
+    ctx: &ApiContext,
+    req: &RegisterRequest,
+    actor: &mut Actor,
+) -> (StatusCode, Json<serde_json::Value>) {
+    // Constant-time token comparison to prevent timing attacks; anything
+    // else must be an enrollment token
+    let enrollment_token = !constant_time_eq(
+        req.token.as_bytes(),
+        ctx.shared.config.auth_token.as_bytes(),
+    );
 
     let client_public_key = match base64::engine::general_purpose::STANDARD.decode(&req.client_public_key)
     {
@@ -109,41 +168,186 @@ async fn register_handler(
             );
         }
     };
+    // Checked before any token is spent so a banned key can't use one up
+    if ctx.shared.is_banned(&client_public_key) {
+        return (
+            StatusCode::FORBIDDEN,
+            Json(serde_json::json!({"error": AddPeerError::Banned.message()})),
+        );
+    }
 
-    let server_public_key_b64 = base64::engine::general_purpose::STANDARD.encode(&ctx.shared.config.server_public_key);
-
-    let existing_ip = {
-        let peers = ctx.shared.peers.read();
-        peers.get_by_pubkey(&client_public_key).map(|peer| peer.assigned_ip)
+    // ID tokens are told apart from enrollment tokens by their JWT shape
+    let identity = match &ctx.oidc {
+        Some(verifier) if enrollment_token && oidc::is_jwt(&req.token) => {
+            match verifier.verify(&req.token).await {
+                Ok(identity) => {
+                    actor.who = format!("oidc:{}", identity.subject);
+                    Some(identity)
+                }
+                Err(e) => {
+                    warn!("Rejected OIDC ID token: {:#}", e);
+                    return (
+                        StatusCode::UNAUTHORIZED,
+                        Json(serde_json::json!({"error": "invalid ID token"})),
+                    );
+                }
+            }
+        }
+        _ => None,
     };
 
-    let assigned_ip = if let Some(ip) = existing_ip {
-        ip
-    } else {
-        let allocated_ip = {
-            let mut pool = ctx.shared.ip_pool.write();
-            match pool.allocate() {
-                Some(ip) => ip,
-                None => {
+    let ssh_identity = match (&ctx.ssh, &req.ssh_signature) {
+        (Some(ssh), Some(signature)) if enrollment_token && identity.is_none() => {
+            match ssh.authorize(&req.client_public_key, req.ssh_timestamp, signature) {
+                Ok(ssh_identity) => {
+                    actor.who = format!("ssh:{}", ssh_identity.fingerprint);
+                    Some(ssh_identity)
+                }
+                Err(e) => {
+                    warn!("Rejected SSH-signed registration: {:#}", e);
                     return (
-                        StatusCode::SERVICE_UNAVAILABLE,
-                        Json(serde_json::json!({"error": "no IPs available"})),
+                        StatusCode::UNAUTHORIZED,
+                        Json(serde_json::json!({"error": "SSH signature not accepted"})),
                     );
                 }
             }
-        };
+        }
+        _ => None,
+    };
 
-        let peer_info = PeerInfo {
-            public_key: client_public_key,
-            assigned_ip: allocated_ip,
-        };
+    // Peers enrolled through OIDC or SSH are named after the identity, not
+    // the request
+    let requested_name = match (&identity, &ssh_identity) {
+        (Some(identity), _) => identity.name.as_deref().and_then(peer_name_from),
+        (None, Some(ssh_identity)) => ssh_identity.comment.as_deref().and_then(peer_name_from),
+        (None, None) => req.name.as_deref().map(str::to_ascii_lowercase),
+    };
+    let name = match requested_name {
+        Some(name) if !is_valid_peer_name(&name) => {
+            return (
+                StatusCode::BAD_REQUEST,
+                Json(serde_json::json!({"error": "invalid peer name"})),
+            );
+        }
+        name => name,
+    };
+
+    let server_public_key_b64 = base64::engine::general_purpose::STANDARD.encode(ctx.shared.server_public_key());
+
+    let (consumed, peer_ttl, tags) = if enrollment_token && identity.is_none() && ssh_identity.is_none() {
+        let mut enrollment = ctx.shared.enrollment.write();
+        if let Some(id) = enrollment.id_of(&req.token) {
+            actor.who = format!("enrollment-token:{}", id);
+        }
+        let peer_ttl = enrollment.peer_ttl(&req.token);
+        let tags = enrollment.peer_tags(&req.token);
+        let redeemed = enrollment.redeem(&req.token, &client_public_key, req.totp_code.as_deref());
+        drop(enrollment);
+        match redeemed {
+            Ok(consumed) => (consumed, peer_ttl, (!tags.is_empty()).then_some(tags)),
+            Err(e) => {
+                warn!("Rejected registration token: {}", e.message());
+                return (
+                    StatusCode::UNAUTHORIZED,
+                    Json(serde_json::json!({"error": e.message()})),
+                );
+            }
+        }
+    } else {
+        if !enrollment_token {
+            actor.who = "auth-token".to_string();
+        }
+        (false, None, None)
+    };
 
-        let mut peers = ctx.shared.peers.write();
-        peers.add(peer_info);
-        allocated_ip
+    // Keep an existing preshared key so concurrent sessions of the same
+    // client are not cut off by a new one
+    let preshared_key = req.preshared_key.then(|| {
+        ctx.shared
+            .peers
+            .read()
+            .get_by_pubkey(&client_public_key)
+            .and_then(|peer| peer.preshared_key)
+            .unwrap_or_else(wgconf::generate_preshared_key)
+    });
+    // Tokens' peer lifetimes are bounded when they are created
+    let peer_expiry = match peer_ttl.map(|ttl| std::time::SystemTime::now().checked_add(ttl)) {
+        Some(None) => {
+            if consumed {
+                ctx.shared.enrollment.write().refund(&req.token, &client_public_key);
+            }
+            return (
+                StatusCode::BAD_REQUEST,
+                Json(serde_json::json!({"error": "token's peer lifetime is too long"})),
+            );
+        }
+        expiry => expiry.flatten(),
+    };
+    let options = PeerOptions {
+        name,
+        address: None,
+        preshared_key,
+        tags,
     };
+    let peer = match ctx.shared.add_peer(client_public_key, options) {
+        Ok(peer) => peer,
+        Err(e) => {
+            if consumed {
+                ctx.shared.enrollment.write().refund(&req.token, &client_public_key);
+            }
+            return (add_peer_status(e), Json(serde_json::json!({"error": e.message()})));
+        }
+    };
+
+    // Each registration renews the lifetime the token gives its peers
+    if let Some(expires_at) = peer_expiry {
+        ctx.shared.set_peer_expiry(&client_public_key, Some(expires_at));
+    }
+
+    if let Some(identity) = &identity {
+        let expires_at = ctx
+            .oidc
+            .as_ref()
+            .is_some_and(|verifier| verifier.settings().expire_peers)
+            .then_some(identity.expires_at);
+        ctx.shared
+            .set_peer_attributes(&client_public_key, identity.groups.clone(), expires_at);
+        info!(
+            "Peer {} enrolled as OIDC subject {}",
+            req.client_public_key, identity.subject
+        );
+    }
+    if let Some(ssh_identity) = &ssh_identity {
+        info!(
+            "Peer {} enrolled with SSH key {}",
+            req.client_public_key, ssh_identity.fingerprint
+        );
+    }
 
-    let client_address = format!("{}/24", assigned_ip);
+    let assigned_ip = peer.assigned_ip;
+    let client_address_v6 = ctx.shared.config.ipv6_prefix.map(|prefix| {
+        format!(
+            "{}/{}",
+            prefix.address_for(assigned_ip),
+            prefix.prefix_len()
+        )
+    });
+    // IPv6-only peers are given their IPv6 address alone
+    let client_address = match &client_address_v6 {
+        Some(address) if ctx.shared.config.ipv6_only => address.clone(),
+        _ => {
+            let network = ctx.shared.config.networks.containing(assigned_ip);
+            let prefix_len = network.map_or(24, |network| network.prefix_len);
+            format!("{}/{}", assigned_ip, prefix_len)
+        }
+    };
+    // and need the server's resolver for DNS64
+    let dns_server = ctx
+        .shared
+        .config
+        .ipv6_prefix
+        .filter(|_| ctx.shared.config.ipv6_only)
+        .map(|prefix| prefix.address_for(ctx.shared.config.subnet).to_string());
     info!(
         "Registered peer {} with IP {}",
         req.client_public_key,
@@ -154,8 +358,18 @@ async fn register_handler(
         StatusCode::OK,
         Json(serde_json::json!({
             "client_address": client_address,
+            "client_address_v6": client_address_v6,
             "server_public_key": server_public_key_b64,
             "server_endpoint": ctx.wg_endpoint,
+            "relay_url": ctx.relay_url,
+            "preshared_key": peer
+                .preshared_key
+                .map(|key| base64::engine::general_purpose::STANDARD.encode(key)),
+            "dns_server": dns_server,
+            "obfuscation": ctx
+                .obfuscation
+                .for_client(&client_public_key)
+                .map(|params| params.to_string()),
         })),
     )
 }
@@ -327,8 +541,51 @@ async fn portforward_delete_handler(
     )
 }
 
+/// HTTP status for a failed peer registration
+pub fn add_peer_status(e: AddPeerError) -> StatusCode {
+    match e {
+        AddPeerError::NoAddressAvailable => StatusCode::SERVICE_UNAVAILABLE,
+        AddPeerError::Banned => StatusCode::FORBIDDEN,
+        AddPeerError::NameInUse
+        | AddPeerError::AddressUnavailable
+        | AddPeerError::AddressMismatch => StatusCode::CONFLICT,
+    }
+}
+
+/// Peer names must be a single lowercase DNS label
+pub fn is_valid_peer_name(name: &str) -> bool {
+    !name.is_empty()
+        && name.len() <= 63
+        && !name.starts_with('-')
+        && !name.ends_with('-')
+        && name
+            .bytes()
+            .all(|b| b.is_ascii_lowercase() || b.is_ascii_digit() || b == b'-')
+}
+
+/// Tags are referenced by name from policy files, so they can't contain
+/// whitespace
+pub fn is_valid_tag(tag: &str) -> bool {
+    !tag.is_empty() && tag.len() <= 64 && tag.bytes().all(|b| b.is_ascii_graphic() && b != b',')
+}
+
+/// Turn an identity such as a username or SSH key comment into a peer name
+pub fn peer_name_from(identity: &str) -> Option<String> {
+    let mut label = String::new();
+    for c in identity.chars() {
+        if c.is_ascii_alphanumeric() {
+            label.push(c.to_ascii_lowercase());
+        } else if !label.is_empty() && !label.ends_with('-') {
+            label.push('-');
+        }
+    }
+    label.truncate(63);
+    let label = label.trim_end_matches('-');
+    (!label.is_empty()).then(|| label.to_string())
+}
+
 /// Constant-time byte comparison
-fn constant_time_eq(a: &[u8], b: &[u8]) -> bool {
+pub fn constant_time_eq(a: &[u8], b: &[u8]) -> bool {
     if a.len() != b.len() {
         return false;
     }
@@ -0,0 +1,222 @@
+//! Audit log of administrative actions
+//!
+//! Peer changes, enrollments, token management, key bans, server key
+//! rotations and config reloads are recorded with who made them, from where, and whether they
+//! succeeded. With `--audit-log` every entry is appended to a JSON-lines
+//! file that is never rewritten; the most recent entries are also kept in memory so the
+//! log can be queried without one.
+
+use std::collections::VecDeque;
+use std::fs::File;
+use std::io::Write;
+use std::os::unix::fs::OpenOptionsExt;
+use std::path::{Path, PathBuf};
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use anyhow::{Context, Result};
+use parking_lot::Mutex;
+use serde::{Deserialize, Serialize};
+use tracing::{error, info};
+
+/// Entries kept in memory
+const RECENT_ENTRIES: usize = 1000;
+
+/// Entries returned by a query unless it asks for fewer
+const DEFAULT_QUERY_LIMIT: usize = 100;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum AuditAction {
+    PeerAdd,
+    PeerRemove,
+    PeerExpire,
+    PeerTag,
+    PeersReplace,
+    Enroll,
+    TokenCreate,
+    TokenRevoke,
+    ConfigReload,
+    KeyBan,
+    KeyUnban,
+    PortForwardAdd,
+    PortForwardRemove,
+    Capture,
+    ServerKeyRotate,
+}
+
+/// Who performed an action
+#[derive(Debug, Clone)]
+pub struct Actor {
+    /// The credential or identity used, e.g. `oidc:alice` or `admin-socket`
+    pub who: String,
+    /// Remote address of the request, if it came over the network
+    pub source: Option<String>,
+}
+
+impl Actor {
+    /// The server itself, for actions it takes on its own
+    pub fn system() -> Self {
+        Self {
+            who: "system".to_string(),
+            source: None,
+        }
+    }
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct AuditEntry {
+    /// Unix time in seconds
+    pub time: u64,
+    pub action: AuditAction,
+    pub actor: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub source: Option<String>,
+    /// What was acted on, usually a peer's public key
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub target: Option<String>,
+    pub ok: bool,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub detail: Option<String>,
+}
+
+impl AuditEntry {
+    pub fn new(action: AuditAction, actor: &Actor) -> Self {
+        Self {
+            time: SystemTime::now()
+                .duration_since(UNIX_EPOCH)
+                .map_or(0, |d| d.as_secs()),
+            action,
+            actor: actor.who.clone(),
+            source: actor.source.clone(),
+            target: None,
+            ok: true,
+            error: None,
+            detail: None,
+        }
+    }
+
+    pub fn target(mut self, target: impl Into<String>) -> Self {
+        self.target = Some(target.into());
+        self
+    }
+
+    pub fn detail(mut self, detail: impl Into<String>) -> Self {
+        self.detail = Some(detail.into());
+        self
+    }
+
+    /// Mark the action as having failed with `error`
+    pub fn failed(mut self, error: impl Into<String>) -> Self {
+        self.ok = false;
+        self.error = Some(error.into());
+        self
+    }
+}
+
+/// Which entries a query returns
+#[derive(Debug, Default, Deserialize)]
+pub struct AuditFilter {
+    pub action: Option<AuditAction>,
+    pub target: Option<String>,
+    /// Only entries at or after this Unix time
+    pub since: Option<u64>,
+    /// Return at most this many of the newest matching entries
+    pub limit: Option<usize>,
+}
+
+impl AuditFilter {
+    fn matches(&self, entry: &AuditEntry) -> bool {
+        self.action.is_none_or(|action| action == entry.action)
+            && self
+                .target
+                .as_ref()
+                .is_none_or(|target| entry.target.as_ref() == Some(target))
+            && self.since.is_none_or(|since| entry.time >= since)
+    }
+}
+
+pub struct AuditLog {
+    file: Option<(PathBuf, Mutex<File>)>,
+    recent: Mutex<VecDeque<AuditEntry>>,
+}
+
+impl AuditLog {
+    /// Keep entries in memory only
+    pub fn in_memory() -> Self {
+        Self {
+            file: None,
+            recent: Mutex::new(VecDeque::new()),
+        }
+    }
+
+    /// Also append entries to `path`, creating it owner-readable if needed
+    pub fn open(path: impl Into<PathBuf>) -> Result<Self> {
+        let path = path.into();
+        let file = std::fs::OpenOptions::new()
+            .append(true)
+            .create(true)
+            .mode(0o600)
+            .open(&path)
+            .with_context(|| format!("failed to open audit log {}", path.display()))?;
+        Ok(Self {
+            file: Some((path, Mutex::new(file))),
+            recent: Mutex::new(VecDeque::new()),
+        })
+    }
+
+    pub fn record(&self, entry: AuditEntry) {
+        info!(
+            "Audit: {:?} by {} on {} {}",
+            entry.action,
+            entry.actor,
+            entry.target.as_deref().unwrap_or("-"),
+            if entry.ok { "succeeded" } else { "failed" }
+        );
+        if let Some((path, file)) = &self.file {
+            let mut line = serde_json::to_string(&entry).expect("audit entries serialize");
+            line.push('\n');
+            if let Err(e) = file.lock().write_all(line.as_bytes()) {
+                error!("Failed to write audit log {}: {}", path.display(), e);
+            }
+        }
+        let mut recent = self.recent.lock();
+        if recent.len() == RECENT_ENTRIES {
+            recent.pop_front();
+        }
+        recent.push_back(entry);
+    }
+
+    /// Matching entries, oldest first; the whole file is searched when
+    /// there is one
+    pub fn query(&self, filter: &AuditFilter) -> Result<Vec<AuditEntry>> {
+        let mut entries: Vec<AuditEntry> = match &self.file {
+            Some((path, _)) => read_entries(path)?
+                .into_iter()
+                .filter(|entry| filter.matches(entry))
+                .collect(),
+            None => self
+                .recent
+                .lock()
+                .iter()
+                .filter(|entry| filter.matches(entry))
+                .cloned()
+                .collect(),
+        };
+        let limit = filter.limit.unwrap_or(DEFAULT_QUERY_LIMIT);
+        let excess = entries.len().saturating_sub(limit);
+        entries.drain(..excess);
+        Ok(entries)
+    }
+}
+
+fn read_entries(path: &Path) -> Result<Vec<AuditEntry>> {
+    let contents = std::fs::read_to_string(path)
+        .with_context(|| format!("failed to read audit log {}", path.display()))?;
+    // A torn final line from a crash is skipped rather than failing the query
+    Ok(contents
+        .lines()
+        .filter_map(|line| serde_json::from_str(line).ok())
+        .collect())
+}
@@ -0,0 +1,342 @@
+//! Per-peer bandwidth limits for wirecagesrv
+//!
+//! Each peer's traffic through the server is policed with a token bucket in
+//! each direction: `up` is what the peer sends and `down` what it receives.
+//! Packets over the limit are dropped, which TCP senders answer by slowing
+//! down. `--peer-upload-limit` and `--peer-download-limit` set the limit for
+//! every peer, and a TOML file can set others for peers by public key or
+//! tag:
+//!
+//! ```toml
+//! [[limit]]
+//! name = "guests"
+//! tags = ["guest"]
+//! up = "2mbit"
+//! down = "10mbit"
+//!
+//! [[limit]]
+//! name = "backup-server"
+//! peers = ["<base64 public key>"]
+//! down = "0"
+//! ```
+//!
+//! Rates are bits per second with an optional `kbit`, `mbit` or `gbit`
+//! suffix, and `0` lifts the limit. A peer listed by key gets that entry;
+//! otherwise it gets the first entry in the file naming one of its tags.
+//! Directions an entry leaves out keep the server-wide limit. Buckets hold
+//! a tenth of a second of traffic, and at least 64 KiB. The file is re-read
+//! on SIGHUP or `POST /v1/reload`.
+
+use std::collections::HashMap;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use anyhow::{Context, Result};
+use base64::Engine;
+use parking_lot::{Mutex, RwLock};
+use serde::Deserialize;
+use tracing::{info, warn};
+
+use super::events::encode_key;
+use super::state::SharedState;
+
+const MIN_BURST_BYTES: f64 = 64.0 * 1024.0;
+/// How long a peer's resolved limits are used before its tags are checked
+/// again
+const RESOLVE_INTERVAL: Duration = Duration::from_secs(10);
+/// How long an idle peer's buckets are kept
+const IDLE_TIMEOUT: Duration = Duration::from_secs(300);
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Direction {
+    /// From the peer
+    Up,
+    /// To the peer
+    Down,
+}
+
+/// Bytes per second in each direction; `None` is unlimited
+#[derive(Debug, Clone, Copy, Default, PartialEq)]
+pub struct Rates {
+    pub up: Option<f64>,
+    pub down: Option<f64>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct LimitFile {
+    #[serde(default)]
+    limit: Vec<LimitEntry>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct LimitEntry {
+    name: String,
+    #[serde(default)]
+    peers: Vec<String>,
+    #[serde(default)]
+    tags: Vec<String>,
+    up: Option<String>,
+    down: Option<String>,
+}
+
+/// A limit for one direction: unset, inheriting the server-wide value, or
+/// set, with `None` meaning unlimited
+#[derive(Debug, Clone, Copy, Default)]
+struct Override {
+    up: Option<Option<f64>>,
+    down: Option<Option<f64>>,
+}
+
+struct Bucket {
+    tokens: f64,
+    updated: Instant,
+}
+
+impl Bucket {
+    fn take(&mut self, rate: f64, bytes: usize, now: Instant) -> bool {
+        let burst = (rate / 10.0).max(MIN_BURST_BYTES);
+        let elapsed = now.duration_since(self.updated).as_secs_f64();
+        self.tokens = (self.tokens + elapsed * rate).min(burst);
+        self.updated = now;
+        if self.tokens < bytes as f64 {
+            return false;
+        }
+        self.tokens -= bytes as f64;
+        true
+    }
+}
+
+struct PeerBuckets {
+    rates: Rates,
+    resolved_at: Instant,
+    up: Bucket,
+    down: Bucket,
+    /// Packets dropped since the peer last went over a limit
+    dropped: u64,
+}
+
+/// The limits read from `--bandwidth-limit-file`
+#[derive(Default)]
+struct LimitSet {
+    by_peer: HashMap<[u8; 32], Override>,
+    /// In file order, so the first entry naming one of a peer's tags wins
+    by_tag: Vec<(String, Override)>,
+    entries: usize,
+}
+
+impl LimitSet {
+    fn read(path: &str) -> Result<Self> {
+        let contents = std::fs::read_to_string(path)
+            .with_context(|| format!("failed to read bandwidth limit file {}", path))?;
+        let file: LimitFile = toml::from_str(&contents)
+            .with_context(|| format!("failed to parse bandwidth limit file {}", path))?;
+        let mut set = LimitSet {
+            entries: file.limit.len(),
+            ..Default::default()
+        };
+        for entry in file.limit {
+            if entry.peers.is_empty() && entry.tags.is_empty() {
+                anyhow::bail!("bandwidth limit `{}` lists no peers or tags", entry.name);
+            }
+            let parse = |rate: &Option<String>| {
+                rate.as_deref()
+                    .map(parse_rate)
+                    .transpose()
+                    .with_context(|| format!("invalid bandwidth limit `{}`", entry.name))
+            };
+            let limit = Override {
+                up: parse(&entry.up)?,
+                down: parse(&entry.down)?,
+            };
+            for peer in &entry.peers {
+                let pubkey = decode_public_key(peer).with_context(|| {
+                    format!("invalid peer key in bandwidth limit `{}`", entry.name)
+                })?;
+                if set.by_peer.insert(pubkey, limit).is_some() {
+                    anyhow::bail!("peer {} appears in more than one bandwidth limit", peer);
+                }
+            }
+            for tag in &entry.tags {
+                set.by_tag.push((tag.clone(), limit));
+            }
+            info!(
+                "Loaded bandwidth limit `{}` for {} peers and {} tags",
+                entry.name,
+                entry.peers.len(),
+                entry.tags.len()
+            );
+        }
+        Ok(set)
+    }
+}
+
+pub struct BandwidthLimits {
+    default: Rates,
+    path: Option<String>,
+    set: RwLock<Arc<LimitSet>>,
+    shared: Arc<SharedState>,
+    buckets: Mutex<HashMap<[u8; 32], PeerBuckets>>,
+}
+
+impl BandwidthLimits {
+    /// Limits from the server-wide rates and an optional TOML file
+    pub fn load(default: Rates, path: Option<&str>, shared: Arc<SharedState>) -> Result<Self> {
+        let set = match path {
+            Some(path) => LimitSet::read(path)?,
+            None => LimitSet::default(),
+        };
+        Ok(Self {
+            default,
+            path: path.map(str::to_string),
+            set: RwLock::new(Arc::new(set)),
+            shared,
+            buckets: Mutex::new(HashMap::new()),
+        })
+    }
+
+    pub fn is_configured(&self) -> bool {
+        self.path.is_some()
+    }
+
+    /// Re-read the limit file, keeping the current limits if it is
+    /// invalid. Peers' buckets keep their tokens but take the new limits
+    /// at once. Returns the number of entries.
+    pub fn reload(&self) -> Result<usize> {
+        let Some(path) = &self.path else {
+            anyhow::bail!("no --bandwidth-limit-file configured");
+        };
+        let set = LimitSet::read(path)?;
+        let count = set.entries;
+        *self.set.write() = Arc::new(set);
+        for (peer, buckets) in self.buckets.lock().iter_mut() {
+            buckets.rates = self.resolve(peer);
+        }
+        info!("Reloaded {} bandwidth limits from {}", count, path);
+        Ok(count)
+    }
+
+    fn is_unlimited(&self) -> bool {
+        let set = self.set.read();
+        self.default == Rates::default() && set.by_peer.is_empty() && set.by_tag.is_empty()
+    }
+
+    /// The limits a peer is under
+    pub fn resolve(&self, peer: &[u8; 32]) -> Rates {
+        let set = Arc::clone(&self.set.read());
+        let limit = set.by_peer.get(peer).copied().or_else(|| {
+            if set.by_tag.is_empty() {
+                return None;
+            }
+            let tags = self.shared.peer_tags(peer);
+            set.by_tag
+                .iter()
+                .find(|(tag, _)| tags.contains(tag))
+                .map(|(_, limit)| *limit)
+        });
+        let limit = limit.unwrap_or_default();
+        Rates {
+            up: limit.up.unwrap_or(self.default.up),
+            down: limit.down.unwrap_or(self.default.down),
+        }
+    }
+
+    /// Account a packet of `bytes` in `direction`, returning false if it is
+    /// over the peer's limit and should be dropped
+    pub fn allow(&self, peer: &[u8; 32], direction: Direction, bytes: usize) -> bool {
+        if self.is_unlimited() {
+            return true;
+        }
+        let now = Instant::now();
+        let mut buckets = self.buckets.lock();
+        let buckets = buckets.entry(*peer).or_insert_with(|| PeerBuckets {
+            rates: self.resolve(peer),
+            resolved_at: now,
+            up: Bucket {
+                tokens: MIN_BURST_BYTES,
+                updated: now,
+            },
+            down: Bucket {
+                tokens: MIN_BURST_BYTES,
+                updated: now,
+            },
+            dropped: 0,
+        });
+        if now.duration_since(buckets.resolved_at) >= RESOLVE_INTERVAL {
+            buckets.rates = self.resolve(peer);
+            buckets.resolved_at = now;
+        }
+
+        let (rate, bucket) = match direction {
+            Direction::Up => (buckets.rates.up, &mut buckets.up),
+            Direction::Down => (buckets.rates.down, &mut buckets.down),
+        };
+        let Some(rate) = rate else {
+            return true;
+        };
+        if bucket.take(rate, bytes, now) {
+            if buckets.dropped > 0 {
+                info!(
+                    "Peer {} is back under its bandwidth limit after {} dropped packets",
+                    encode_key(peer),
+                    buckets.dropped
+                );
+                buckets.dropped = 0;
+            }
+            return true;
+        }
+        if buckets.dropped == 0 {
+            warn!(
+                "Peer {} exceeded its {} bandwidth limit",
+                encode_key(peer),
+                match direction {
+                    Direction::Up => "upload",
+                    Direction::Down => "download",
+                }
+            );
+        }
+        buckets.dropped += 1;
+        false
+    }
+
+    /// Drop the buckets of peers that have been idle for a while
+    pub fn forget_idle(&self) {
+        let now = Instant::now();
+        self.buckets.lock().retain(|_, buckets| {
+            let updated = buckets.up.updated.max(buckets.down.updated);
+            now.duration_since(updated) < IDLE_TIMEOUT
+        });
+    }
+}
+
+/// Parse a rate in bits per second into bytes per second; zero is unlimited
+pub fn parse_rate(rate: &str) -> Result<Option<f64>> {
+    let rate = rate.trim().to_ascii_lowercase();
+    let (number, multiplier) = if let Some(number) = rate.strip_suffix("gbit") {
+        (number, 1e9)
+    } else if let Some(number) = rate.strip_suffix("mbit") {
+        (number, 1e6)
+    } else if let Some(number) = rate.strip_suffix("kbit") {
+        (number, 1e3)
+    } else {
+        (rate.strip_suffix("bit").unwrap_or(&rate), 1.0)
+    };
+    let bits: f64 = number
+        .trim()
+        .parse()
+        .ok()
+        .filter(|bits: &f64| bits.is_finite() && *bits >= 0.0)
+        .with_context(|| format!("invalid rate `{}` (expected e.g. 10mbit)", rate))?;
+    let bytes = bits * multiplier / 8.0;
+    Ok((bytes > 0.0).then_some(bytes))
+}
+
+fn decode_public_key(key: &str) -> Result<[u8; 32]> {
+    let bytes = base64::engine::general_purpose::STANDARD
+        .decode(key.trim())
+        .context("not valid base64")?;
+    bytes
+        .try_into()
+        .map_err(|_| anyhow::anyhow!("public key must be 32 bytes"))
+}
@@ -0,0 +1,201 @@
+//! Pooled buffers for the relay path
+//!
+//! NAT relays read from one end of a flow and hand what they read to the
+//! other. Rather than allocating a buffer per flow and a fresh `Vec` per
+//! read, they take buffers from a shared pool and pass them along the flow's
+//! queues; a buffer goes back to its pool when its last holder drops it.
+//! Chunks that pile up in a queue are written out with one vectored write.
+
+use std::fmt;
+use std::io::{self, IoSlice};
+use std::ops::Deref;
+use std::sync::Arc;
+
+use parking_lot::Mutex;
+use tokio::io::{AsyncWrite, AsyncWriteExt};
+use tokio::sync::mpsc;
+
+/// Size of the buffers stream reads go into
+pub const STREAM_BUFFER: usize = 16 * 1024;
+
+/// Size of the buffers whole datagrams are received into
+pub const DATAGRAM_BUFFER: usize = 65535;
+
+/// Most queued chunks gathered into one vectored write
+const MAX_GATHER: usize = 64;
+
+/// Buffers of one size, reused once dropped
+pub struct BufferPool {
+    size: usize,
+    /// Most free buffers kept; beyond that, dropped buffers are freed
+    max_free: usize,
+    free: Mutex<Vec<Vec<u8>>>,
+}
+
+impl BufferPool {
+    pub fn new(size: usize, max_free: usize) -> Arc<Self> {
+        Arc::new(Self {
+            size,
+            max_free,
+            free: Mutex::new(Vec::new()),
+        })
+    }
+
+    /// Take an empty buffer with room for the pool's size
+    pub fn get(self: &Arc<Self>) -> Buffer {
+        let data = self
+            .free
+            .lock()
+            .pop()
+            .unwrap_or_else(|| vec![0u8; self.size]);
+        Buffer {
+            data,
+            start: 0,
+            end: 0,
+            pool: Some(Arc::clone(self)),
+        }
+    }
+
+    /// Copy `bytes` into a buffer from the pool, or into one of their own if
+    /// they do not fit
+    pub fn copy_from(self: &Arc<Self>, bytes: &[u8]) -> Buffer {
+        if bytes.len() > self.size {
+            return Buffer::from(bytes.to_vec());
+        }
+        let mut buf = self.get();
+        buf.space()[..bytes.len()].copy_from_slice(bytes);
+        buf.filled(bytes.len());
+        buf
+    }
+
+    fn put(&self, data: Vec<u8>) {
+        let mut free = self.free.lock();
+        if free.len() < self.max_free {
+            free.push(data);
+        }
+    }
+}
+
+/// The pools shared by the dataplane's relays
+#[derive(Clone)]
+pub struct RelayBuffers {
+    /// For stream reads and the chunks passed between a flow's two ends
+    pub stream: Arc<BufferPool>,
+    /// For receiving datagrams, which are copied out before being passed on
+    pub datagram: Arc<BufferPool>,
+}
+
+impl Default for RelayBuffers {
+    fn default() -> Self {
+        Self {
+            stream: BufferPool::new(STREAM_BUFFER, 4096),
+            datagram: BufferPool::new(DATAGRAM_BUFFER, 256),
+        }
+    }
+}
+
+/// Bytes read into a buffer, which goes back to its pool once dropped
+pub struct Buffer {
+    data: Vec<u8>,
+    start: usize,
+    end: usize,
+    pool: Option<Arc<BufferPool>>,
+}
+
+impl Buffer {
+    /// The whole buffer, to read into; follow with `filled`
+    pub fn space(&mut self) -> &mut [u8] {
+        &mut self.data
+    }
+
+    /// Mark the first `len` bytes of the buffer as holding data
+    pub fn filled(&mut self, len: usize) {
+        self.start = 0;
+        self.end = len;
+    }
+
+    /// Drop the first `n` bytes, once they have been passed on
+    pub fn advance(&mut self, n: usize) {
+        self.start = (self.start + n).min(self.end);
+    }
+}
+
+impl Deref for Buffer {
+    type Target = [u8];
+
+    fn deref(&self) -> &[u8] {
+        &self.data[self.start..self.end]
+    }
+}
+
+/// A buffer of its own, not returned to any pool
+impl From<Vec<u8>> for Buffer {
+    fn from(data: Vec<u8>) -> Self {
+        let end = data.len();
+        Self {
+            data,
+            start: 0,
+            end,
+            pool: None,
+        }
+    }
+}
+
+impl Drop for Buffer {
+    fn drop(&mut self) {
+        if let Some(pool) = self.pool.take() {
+            pool.put(std::mem::take(&mut self.data));
+        }
+    }
+}
+
+impl fmt::Debug for Buffer {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("Buffer").field("len", &self.len()).finish()
+    }
+}
+
+/// Write the next chunk from `queue`, together with any already queued
+/// behind it, in one vectored write. `batch` is scratch space kept between
+/// calls. Returns the bytes written, or None once the queue is closed.
+pub async fn write_queued<W: AsyncWrite + Unpin>(
+    queue: &mut mpsc::Receiver<Buffer>,
+    writer: &mut W,
+    batch: &mut Vec<Buffer>,
+) -> io::Result<Option<usize>> {
+    let Some(first) = queue.recv().await else {
+        return Ok(None);
+    };
+    batch.push(first);
+    while batch.len() < MAX_GATHER {
+        match queue.try_recv() {
+            Ok(chunk) => batch.push(chunk),
+            Err(_) => break,
+        }
+    }
+
+    let mut slices = [IoSlice::new(&[]); MAX_GATHER];
+    for (slice, chunk) in slices.iter_mut().zip(batch.iter()) {
+        *slice = IoSlice::new(chunk);
+    }
+    let len = batch.iter().map(|chunk| chunk.len()).sum();
+    let result = write_all_vectored(writer, &mut slices[..batch.len()]).await;
+    batch.clear();
+    result.map(|()| Some(len))
+}
+
+/// Write all of `slices`, as few writes as the writer allows
+pub async fn write_all_vectored<W: AsyncWrite + Unpin>(
+    writer: &mut W,
+    mut slices: &mut [IoSlice<'_>],
+) -> io::Result<()> {
+    IoSlice::advance_slices(&mut slices, 0);
+    while !slices.is_empty() {
+        let n = writer.write_vectored(slices).await?;
+        if n == 0 {
+            return Err(io::ErrorKind::WriteZero.into());
+        }
+        IoSlice::advance_slices(&mut slices, n);
+    }
+    Ok(())
+}
@@ -0,0 +1,659 @@
+//! Cascaded WireGuard egress
+//!
+//! With `--egress-wg-config`, the server joins an upstream WireGuard server
+//! as a client, such as a commercial VPN exit, and dials peers' flows
+//! through that tunnel instead of from its own address. The config is the
+//! wg-quick file the provider hands out: the client's `PrivateKey` and
+//! `Address`, and one `[Peer]` with the provider's `PublicKey`, `Endpoint`
+//! and optionally `PresharedKey` and `PersistentKeepalive`. `AllowedIPs` is
+//! not used; egress routes decide what goes through the tunnel.
+//!
+//! The tunnel is a second userspace device: a gotatun session with the
+//! upstream endpoint, under a smoltcp interface holding the client address,
+//! on which each flow gets a TCP or UDP socket of its own. TCP connections
+//! are handed to the dataplane's relay tasks as in-memory streams, so they
+//! are relayed just like connections dialed directly.
+
+use std::collections::{HashMap, HashSet};
+use std::io;
+use std::net::{Ipv4Addr, SocketAddr, SocketAddrV4};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use anyhow::{Context, Result};
+use gotatun::noise::{Tunn, TunnResult};
+use gotatun::packet::Packet;
+use smoltcp::iface::{Config as SmolConfig, Interface, SocketHandle, SocketSet};
+use smoltcp::socket::{tcp, udp};
+use smoltcp::time::Instant as SmolInstant;
+use smoltcp::wire::{HardwareAddress, IpCidr, IpEndpoint, Ipv4Address, Ipv4Cidr};
+use tokio::io::{AsyncReadExt, AsyncWriteExt, DuplexStream};
+use tokio::net::UdpSocket;
+use tokio::sync::{mpsc, oneshot, Notify};
+use tracing::{debug, info, warn};
+use zerocopy::IntoBytes;
+
+use super::dataplane::SmolDevice;
+use super::wgconf;
+
+/// MTU inside the tunnel, as wg-quick picks for IPv4 endpoints
+const TUNNEL_MTU: usize = 1420;
+
+const MAX_PACKET: usize = 65536;
+
+/// Send and receive buffers of each TCP socket in the tunnel
+const TCP_SOCKET_BUFFER: usize = 256 * 1024;
+
+/// Buffer between a TCP socket and the relay task using it
+const STREAM_BUFFER: usize = 64 * 1024;
+
+/// Datagrams queued in each direction of a UDP flow
+const UDP_QUEUE: usize = 64;
+
+/// How often WireGuard timers run, for handshakes and keepalives
+const TIMER_INTERVAL: Duration = Duration::from_millis(250);
+
+/// Longest the device sleeps when smoltcp has nothing scheduled
+const MAX_POLL_DELAY: Duration = Duration::from_millis(250);
+
+/// Local ports flows in the tunnel are opened from
+const EPHEMERAL_PORTS: std::ops::RangeInclusive<u16> = 49152..=65535;
+
+/// What the upstream server's config says
+struct Settings {
+    private_key: [u8; 32],
+    address: Ipv4Addr,
+    public_key: [u8; 32],
+    preshared_key: Option<[u8; 32]>,
+    endpoint: String,
+    persistent_keepalive: Option<u16>,
+}
+
+impl Settings {
+    fn read(path: &str) -> Result<Self> {
+        let text = std::fs::read_to_string(path)
+            .with_context(|| format!("failed to read WireGuard egress config {}", path))?;
+        let conf = wgconf::parse_conf(&text)
+            .with_context(|| format!("failed to parse WireGuard egress config {}", path))?;
+        let private_key = conf.private_key.context("config has no PrivateKey")?;
+        let (address, _) = conf.address.context("config has no IPv4 Address")?;
+        let [peer] = <[wgconf::ParsedPeer; 1]>::try_from(conf.peers)
+            .map_err(|_| anyhow::anyhow!("config must have exactly one [Peer]"))?;
+        let endpoint = peer.endpoint.context("the [Peer] has no Endpoint")?;
+        Ok(Self {
+            private_key,
+            address,
+            public_key: peer.public_key,
+            preshared_key: peer.preshared_key,
+            endpoint,
+            persistent_keepalive: peer.persistent_keepalive,
+        })
+    }
+}
+
+enum Command {
+    Tcp {
+        remote: SocketAddrV4,
+        reply: oneshot::Sender<io::Result<DuplexStream>>,
+    },
+    Udp {
+        remote: SocketAddrV4,
+        to_remote: mpsc::Receiver<Vec<u8>>,
+        from_remote: mpsc::Sender<Vec<u8>>,
+    },
+}
+
+/// A WireGuard tunnel to an upstream server that flows can be dialed
+/// through
+pub struct Cascade {
+    commands: mpsc::Sender<Command>,
+    /// Woken when a flow has data for the device
+    wake: Arc<Notify>,
+    endpoint: SocketAddr,
+}
+
+impl std::fmt::Debug for Cascade {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "WireGuard via {}", self.endpoint)
+    }
+}
+
+impl Cascade {
+    /// Read the client config and start the tunnel device. The handshake
+    /// happens when the first flow is dialed.
+    pub async fn start(config_path: &str) -> Result<Arc<Self>> {
+        let settings = Settings::read(config_path)?;
+        let endpoint = tokio::net::lookup_host(&settings.endpoint)
+            .await
+            .with_context(|| format!("failed to resolve {}", settings.endpoint))?
+            .find(SocketAddr::is_ipv4)
+            .with_context(|| format!("{} has no IPv4 address", settings.endpoint))?;
+        let socket = UdpSocket::bind("0.0.0.0:0")
+            .await
+            .context("failed to bind WireGuard egress socket")?;
+        socket
+            .connect(endpoint)
+            .await
+            .with_context(|| format!("failed to connect to {}", endpoint))?;
+
+        let (commands, command_rx) = mpsc::channel(256);
+        let wake = Arc::new(Notify::new());
+        let device = Device::new(&settings, socket, Arc::clone(&wake));
+        tokio::spawn(device.run(command_rx));
+        info!(
+            "Cascading WireGuard egress through {} as {}",
+            endpoint, settings.address
+        );
+        Ok(Arc::new(Self {
+            commands,
+            wake,
+            endpoint,
+        }))
+    }
+
+    /// Open a TCP connection to `remote` through the tunnel
+    pub async fn connect_tcp(&self, remote: SocketAddrV4) -> io::Result<DuplexStream> {
+        let (reply, response) = oneshot::channel();
+        self.commands
+            .send(Command::Tcp { remote, reply })
+            .await
+            .map_err(|_| device_gone())?;
+        response.await.map_err(|_| device_gone())?
+    }
+
+    /// Open a UDP flow to `remote` through the tunnel
+    pub fn open_udp(&self, remote: SocketAddrV4) -> io::Result<TunnelUdp> {
+        let (to_remote, to_remote_rx) = mpsc::channel(UDP_QUEUE);
+        let (from_remote_tx, from_remote) = mpsc::channel(UDP_QUEUE);
+        self.commands
+            .try_send(Command::Udp {
+                remote,
+                to_remote: to_remote_rx,
+                from_remote: from_remote_tx,
+            })
+            .map_err(|_| device_gone())?;
+        Ok(TunnelUdp {
+            to_remote,
+            from_remote: tokio::sync::Mutex::new(from_remote),
+            wake: Arc::clone(&self.wake),
+        })
+    }
+}
+
+fn device_gone() -> io::Error {
+    io::Error::new(
+        io::ErrorKind::NotConnected,
+        "WireGuard egress device stopped",
+    )
+}
+
+/// A UDP flow through the tunnel, used like a connected UDP socket
+pub struct TunnelUdp {
+    to_remote: mpsc::Sender<Vec<u8>>,
+    from_remote: tokio::sync::Mutex<mpsc::Receiver<Vec<u8>>>,
+    wake: Arc<Notify>,
+}
+
+impl TunnelUdp {
+    pub async fn send(&self, data: &[u8]) -> io::Result<usize> {
+        self.to_remote
+            .send(data.to_vec())
+            .await
+            .map_err(|_| device_gone())?;
+        self.wake.notify_one();
+        Ok(data.len())
+    }
+
+    pub async fn recv(&self, buf: &mut [u8]) -> io::Result<usize> {
+        let data = self
+            .from_remote
+            .lock()
+            .await
+            .recv()
+            .await
+            .ok_or_else(device_gone)?;
+        let n = data.len().min(buf.len());
+        buf[..n].copy_from_slice(&data[..n]);
+        Ok(n)
+    }
+}
+
+/// A TCP socket waiting for its handshake to finish
+struct Connecting {
+    port: u16,
+    reply: oneshot::Sender<io::Result<DuplexStream>>,
+}
+
+/// An established TCP socket and the channels to its stream's pump
+struct TcpConn {
+    port: u16,
+    /// Dropped once the remote has closed and everything is passed on
+    to_stream: Option<mpsc::Sender<Vec<u8>>>,
+    from_stream: mpsc::Receiver<Vec<u8>>,
+    /// Data from the stream not yet taken by the socket
+    pending: Vec<u8>,
+    closing: bool,
+}
+
+struct UdpConn {
+    port: u16,
+    remote: SocketAddrV4,
+    to_remote: mpsc::Receiver<Vec<u8>>,
+    from_remote: mpsc::Sender<Vec<u8>>,
+}
+
+/// The userspace device behind a `Cascade`
+struct Device {
+    tunnel: Tunn,
+    socket: Arc<UdpSocket>,
+    wake: Arc<Notify>,
+    iface: Interface,
+    sockets: SocketSet<'static>,
+    smol: SmolDevice,
+    start: Instant,
+    connecting: HashMap<SocketHandle, Connecting>,
+    tcp: HashMap<SocketHandle, TcpConn>,
+    udp: HashMap<SocketHandle, UdpConn>,
+    ports: HashSet<u16>,
+    next_port: u16,
+}
+
+enum Event {
+    Command(Option<Command>),
+    Received(io::Result<usize>),
+    Timers,
+    Poll,
+}
+
+impl Device {
+    fn new(settings: &Settings, socket: UdpSocket, wake: Arc<Notify>) -> Self {
+        let tunnel = Tunn::new(
+            settings.private_key.into(),
+            settings.public_key.into(),
+            settings.preshared_key,
+            settings.persistent_keepalive,
+            0,
+            None,
+        );
+        let mut smol = SmolDevice::new(TUNNEL_MTU);
+        let mut config = SmolConfig::new(HardwareAddress::Ip);
+        config.random_seed = rand::random();
+        let mut iface = Interface::new(config, &mut smol, SmolInstant::from_millis(0));
+        let address = Ipv4Address::from_bytes(&settings.address.octets());
+        iface.update_ip_addrs(|addrs| {
+            addrs
+                .push(IpCidr::Ipv4(Ipv4Cidr::new(address, 32)))
+                .expect("smoltcp interface address table full");
+        });
+        iface
+            .routes_mut()
+            .add_default_ipv4_route(address)
+            .expect("smoltcp route table full");
+        Self {
+            tunnel,
+            socket: Arc::new(socket),
+            wake,
+            iface,
+            sockets: SocketSet::new(Vec::new()),
+            smol,
+            start: Instant::now(),
+            connecting: HashMap::new(),
+            tcp: HashMap::new(),
+            udp: HashMap::new(),
+            ports: HashSet::new(),
+            next_port: *EPHEMERAL_PORTS.start(),
+        }
+    }
+
+    async fn run(mut self, mut commands: mpsc::Receiver<Command>) {
+        let socket = Arc::clone(&self.socket);
+        let wake = Arc::clone(&self.wake);
+        let mut timers = tokio::time::interval(TIMER_INTERVAL);
+        let mut buf = vec![0u8; MAX_PACKET];
+        loop {
+            let delay = self
+                .iface
+                .poll_delay(self.now(), &self.sockets)
+                .map_or(MAX_POLL_DELAY, |delay| {
+                    Duration::from_micros(delay.total_micros()).min(MAX_POLL_DELAY)
+                });
+            let event = tokio::select! {
+                command = commands.recv() => Event::Command(command),
+                received = socket.recv(&mut buf) => Event::Received(received),
+                _ = timers.tick() => Event::Timers,
+                _ = wake.notified() => Event::Poll,
+                _ = tokio::time::sleep(delay) => Event::Poll,
+            };
+            match event {
+                Event::Command(None) => return,
+                Event::Command(Some(command)) => self.open(command),
+                Event::Received(Ok(n)) => self.receive(&buf[..n]).await,
+                Event::Received(Err(e)) => debug!("WireGuard egress receive failed: {}", e),
+                Event::Timers => self.update_timers().await,
+                Event::Poll => {}
+            }
+            self.service();
+            self.transmit().await;
+        }
+    }
+
+    fn now(&self) -> SmolInstant {
+        SmolInstant::from_millis(self.start.elapsed().as_millis() as i64)
+    }
+
+    /// A free local port, or `None` if every ephemeral port is in use
+    fn allocate_port(&mut self) -> Option<u16> {
+        for _ in EPHEMERAL_PORTS {
+            let port = self.next_port;
+            self.next_port = if port == *EPHEMERAL_PORTS.end() {
+                *EPHEMERAL_PORTS.start()
+            } else {
+                port + 1
+            };
+            if self.ports.insert(port) {
+                return Some(port);
+            }
+        }
+        None
+    }
+
+    fn open(&mut self, command: Command) {
+        let Some(port) = self.allocate_port() else {
+            warn!("WireGuard egress is out of local ports");
+            if let Command::Tcp { reply, .. } = command {
+                let _ = reply.send(Err(io::Error::new(
+                    io::ErrorKind::AddrNotAvailable,
+                    "WireGuard egress is out of local ports",
+                )));
+            }
+            return;
+        };
+        match command {
+            Command::Tcp { remote, reply } => {
+                let mut socket = tcp::Socket::new(
+                    tcp::SocketBuffer::new(vec![0; TCP_SOCKET_BUFFER]),
+                    tcp::SocketBuffer::new(vec![0; TCP_SOCKET_BUFFER]),
+                );
+                if let Err(e) = socket.connect(self.iface.context(), remote, port) {
+                    self.ports.remove(&port);
+                    let _ = reply.send(Err(io::Error::other(format!("{:?}", e))));
+                    return;
+                }
+                let handle = self.sockets.add(socket);
+                self.connecting.insert(handle, Connecting { port, reply });
+            }
+            Command::Udp {
+                remote,
+                to_remote,
+                from_remote,
+            } => {
+                let mut socket = udp::Socket::new(
+                    udp::PacketBuffer::new(
+                        vec![udp::PacketMetadata::EMPTY; UDP_QUEUE],
+                        vec![0; UDP_QUEUE * TUNNEL_MTU],
+                    ),
+                    udp::PacketBuffer::new(
+                        vec![udp::PacketMetadata::EMPTY; UDP_QUEUE],
+                        vec![0; UDP_QUEUE * TUNNEL_MTU],
+                    ),
+                );
+                if let Err(e) = socket.bind(port) {
+                    self.ports.remove(&port);
+                    debug!("Failed to bind WireGuard egress UDP socket: {:?}", e);
+                    return;
+                }
+                let handle = self.sockets.add(socket);
+                self.udp.insert(
+                    handle,
+                    UdpConn {
+                        port,
+                        remote,
+                        to_remote,
+                        from_remote,
+                    },
+                );
+            }
+        }
+    }
+
+    /// Decrypt a packet from the upstream server
+    async fn receive(&mut self, data: &[u8]) {
+        let packet = Packet::from_bytes(bytes::BytesMut::from(data));
+        let Ok(wg_packet) = packet.try_into_wg() else {
+            return;
+        };
+        match self.tunnel.handle_incoming_packet(wg_packet) {
+            TunnResult::Done => {}
+            TunnResult::WriteToNetwork(response) => {
+                let response: Packet = response.into();
+                self.send(response.as_bytes()).await;
+            }
+            TunnResult::WriteToTunnel(decrypted) => {
+                self.smol.push_rx(decrypted.as_bytes().to_vec());
+            }
+            TunnResult::Err(e) => debug!("WireGuard egress packet rejected: {:?}", e),
+        }
+    }
+
+    async fn update_timers(&mut self) {
+        match self.tunnel.update_timers() {
+            Ok(Some(packet)) => {
+                let packet: Packet = packet.into();
+                self.send(packet.as_bytes()).await;
+            }
+            Ok(None) => {}
+            Err(e) => debug!("WireGuard egress timers: {:?}", e),
+        }
+    }
+
+    /// Encrypt and send what smoltcp has queued
+    async fn transmit(&mut self) {
+        for packet in self.smol.drain_tx() {
+            let packet = Packet::from_bytes(bytes::BytesMut::from(&packet[..]));
+            if let Some(wg_packet) = self.tunnel.handle_outgoing_packet(packet) {
+                let out: Packet = wg_packet.into();
+                self.send(out.as_bytes()).await;
+            }
+        }
+    }
+
+    async fn send(&self, data: &[u8]) {
+        if let Err(e) = self.socket.send(data).await {
+            debug!("WireGuard egress send failed: {}", e);
+        }
+    }
+
+    /// Run smoltcp and move data between its sockets and the flows
+    fn service(&mut self) {
+        let now = self.now();
+        self.iface.poll(now, &mut self.smol, &mut self.sockets);
+        self.service_connecting();
+        self.service_tcp();
+        self.service_udp();
+        self.iface.poll(now, &mut self.smol, &mut self.sockets);
+    }
+
+    fn service_connecting(&mut self) {
+        let handles: Vec<SocketHandle> = self.connecting.keys().copied().collect();
+        for handle in handles {
+            let socket = self.sockets.get_mut::<tcp::Socket>(handle);
+            let state = socket.state();
+            let gave_up = self.connecting[&handle].reply.is_closed();
+            if state == tcp::State::SynSent && !gave_up {
+                continue;
+            }
+            let connecting = self
+                .connecting
+                .remove(&handle)
+                .expect("socket is connecting");
+            if state != tcp::State::Established || gave_up {
+                socket.abort();
+                self.sockets.remove(handle);
+                self.ports.remove(&connecting.port);
+                let _ = connecting
+                    .reply
+                    .send(Err(io::ErrorKind::ConnectionRefused.into()));
+                continue;
+            }
+
+            let (stream, device_end) = tokio::io::duplex(STREAM_BUFFER);
+            let (to_stream, to_stream_rx) = mpsc::channel(16);
+            let (from_stream_tx, from_stream) = mpsc::channel(16);
+            tokio::spawn(pump(
+                device_end,
+                to_stream_rx,
+                from_stream_tx,
+                Arc::clone(&self.wake),
+            ));
+            self.tcp.insert(
+                handle,
+                TcpConn {
+                    port: connecting.port,
+                    to_stream: Some(to_stream),
+                    from_stream,
+                    pending: Vec::new(),
+                    closing: false,
+                },
+            );
+            if connecting.reply.send(Ok(stream)).is_err() {
+                socket.abort();
+            }
+        }
+    }
+
+    fn service_tcp(&mut self) {
+        let mut finished = Vec::new();
+        for (&handle, conn) in self.tcp.iter_mut() {
+            let socket = self.sockets.get_mut::<tcp::Socket>(handle);
+
+            // Remote to stream, only as fast as the stream takes it
+            if let Some(to_stream) = &conn.to_stream {
+                while socket.can_recv() && to_stream.capacity() > 0 {
+                    let Ok(data) = socket.recv(|data| (data.len(), data.to_vec())) else {
+                        break;
+                    };
+                    let _ = to_stream.try_send(data);
+                }
+                if to_stream.is_closed() {
+                    // The relay task went away
+                    socket.abort();
+                } else if !socket.may_recv() && !socket.can_recv() {
+                    conn.to_stream = None;
+                }
+            }
+
+            // Stream to remote
+            loop {
+                if conn.pending.is_empty() {
+                    match conn.from_stream.try_recv() {
+                        Ok(data) => conn.pending = data,
+                        Err(mpsc::error::TryRecvError::Empty) => break,
+                        Err(mpsc::error::TryRecvError::Disconnected) => {
+                            if !conn.closing {
+                                socket.close();
+                                conn.closing = true;
+                            }
+                            break;
+                        }
+                    }
+                }
+                if !socket.can_send() {
+                    break;
+                }
+                let sent = socket.send_slice(&conn.pending).unwrap_or(0);
+                conn.pending.drain(..sent);
+                if !conn.pending.is_empty() {
+                    break;
+                }
+            }
+
+            if socket.state() == tcp::State::Closed {
+                finished.push(handle);
+            }
+        }
+        for handle in finished {
+            if let Some(conn) = self.tcp.remove(&handle) {
+                self.sockets.remove(handle);
+                self.ports.remove(&conn.port);
+            }
+        }
+    }
+
+    fn service_udp(&mut self) {
+        let mut finished = Vec::new();
+        let mut buf = vec![0u8; TUNNEL_MTU];
+        for (&handle, conn) in self.udp.iter_mut() {
+            let socket = self.sockets.get_mut::<udp::Socket>(handle);
+            while socket.can_recv() {
+                let Ok((n, _)) = socket.recv_slice(&mut buf) else {
+                    break;
+                };
+                // Dropped if the relay is behind, as a congested link would
+                let _ = conn.from_remote.try_send(buf[..n].to_vec());
+            }
+            while socket.can_send() {
+                match conn.to_remote.try_recv() {
+                    Ok(data) => {
+                        let remote = IpEndpoint::from(conn.remote);
+                        if let Err(e) = socket.send_slice(&data, remote) {
+                            debug!("WireGuard egress UDP send failed: {:?}", e);
+                        }
+                    }
+                    Err(mpsc::error::TryRecvError::Empty) => break,
+                    Err(mpsc::error::TryRecvError::Disconnected) => {
+                        finished.push(handle);
+                        break;
+                    }
+                }
+            }
+            if conn.from_remote.is_closed() {
+                finished.push(handle);
+            }
+        }
+        for handle in finished {
+            if let Some(conn) = self.udp.remove(&handle) {
+                self.sockets.remove(handle);
+                self.ports.remove(&conn.port);
+            }
+        }
+    }
+}
+
+/// Copy between the device's end of a TCP stream and its socket's channels
+async fn pump(
+    stream: DuplexStream,
+    mut to_stream: mpsc::Receiver<Vec<u8>>,
+    from_stream: mpsc::Sender<Vec<u8>>,
+    wake: Arc<Notify>,
+) {
+    let (mut reader, mut writer) = tokio::io::split(stream);
+    let upload_wake = Arc::clone(&wake);
+    let upload = async move {
+        let mut buf = vec![0u8; STREAM_BUFFER];
+        loop {
+            match reader.read(&mut buf).await {
+                Ok(0) | Err(_) => break,
+                Ok(n) => {
+                    if from_stream.send(buf[..n].to_vec()).await.is_err() {
+                        break;
+                    }
+                    upload_wake.notify_one();
+                }
+            }
+        }
+        // Closing the channel tells the device to close the socket
+        drop(from_stream);
+        upload_wake.notify_one();
+    };
+    let download = async move {
+        while let Some(data) = to_stream.recv().await {
+            // Room freed in the channel lets the device read on
+            wake.notify_one();
+            if writer.write_all(&data).await.is_err() {
+                return;
+            }
+        }
+        let _ = writer.shutdown().await;
+    };
+    tokio::join!(upload, download);
+}
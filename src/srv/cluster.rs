@@ -0,0 +1,504 @@
+//! Clustered servers
+//!
+//! With `--cluster-node`, several servers share one peer database, so
+//! clients can be pointed at any of them through round-robin DNS or an
+//! anycast address. Each node pulls the others' peers and bans from their
+//! admin APIs every `--cluster-interval-secs`, authenticating with
+//! `--cluster-token`, an admin token on the other nodes: enrollments,
+//! removals, tag and expiry changes, bans and enrollment tokens made on one
+//! reach the rest within an interval or two. Nodes must share the server key and client
+//! networks, and their clocks should be in sync.
+//!
+//! Every public key has one record in a ledger, holding its peer, its ban
+//! or its removal, versioned by when and where the change was made; the
+//! newest version wins everywhere. Whatever a node holds when it starts,
+//! from its state file or the server it took over from, is versioned
+//! oldest, so a node that was down catches up rather than bringing back
+//! peers removed meanwhile. Removals are remembered for a week. Should two
+//! nodes hand one address or name to different peers at once, the peer
+//! changed first keeps it and the node that registered the other gives
+//! that one a new address, or drops its name.
+//!
+//! `GET /v1/cluster` reports each node's reachability and where each peer
+//! last completed a handshake. A node's peers follow it out of service on
+//! their own: clients given several addresses for the server move to the
+//! next one once handshakes go unanswered.
+
+use std::collections::{HashMap, HashSet};
+use std::sync::Arc;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::{Context, Result};
+use axum::extract::State;
+use axum::http::StatusCode;
+use axum::response::IntoResponse;
+use axum::routing::get;
+use axum::{Json, Router};
+use parking_lot::{Mutex, RwLock};
+use serde::{Deserialize, Serialize};
+use tokio::sync::mpsc;
+use tracing::{error, info, warn};
+
+use super::api::PortForwardEvent;
+use super::enroll::SharedToken;
+use super::events::encode_key;
+use super::state::{BannedKey, PeerInfo, SharedState};
+use super::store::{self, StoredBan, StoredPeer};
+use super::usage::unix_now;
+use super::wg::WgIo;
+
+/// Path a node serves its ledger on, to the others
+pub const STATE_PATH: &str = "/v1/cluster/state";
+
+/// How long removals are remembered, and so how long a node can be down
+/// and still learn of them
+const TOMBSTONE_TTL: Duration = Duration::from_secs(7 * 86400);
+
+const HTTP_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Which change to a key is newest: the time it was made, then the node
+/// that made it to break ties
+#[derive(Debug, Clone, PartialEq, Eq, PartialOrd, Ord, Serialize, Deserialize)]
+struct Version {
+    /// Unix time in milliseconds; zero for what a node held when it started
+    at: u64,
+    node: String,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(tag = "state", rename_all = "snake_case")]
+enum Entry {
+    Peer { peer: StoredPeer },
+    Banned { ban: StoredBan },
+    Removed,
+}
+
+/// The latest change to a public key
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Record {
+    public_key: String,
+    version: Version,
+    entry: Entry,
+}
+
+#[derive(Default)]
+struct LedgerState {
+    records: HashMap<String, Record>,
+    /// Peers the registry leaves out for clashing with another, which must
+    /// not be taken for removed
+    excluded: HashSet<String>,
+    observed: bool,
+}
+
+/// This node's view of every peer and ban in the cluster
+pub struct Ledger {
+    node: String,
+    state: Mutex<LedgerState>,
+}
+
+impl Ledger {
+    pub fn new(node: String) -> Self {
+        Self {
+            node,
+            state: Mutex::new(LedgerState::default()),
+        }
+    }
+
+    pub fn node(&self) -> &str {
+        &self.node
+    }
+
+    /// Record where the registry and bans differ from the ledger as changes
+    /// made on this node
+    pub fn observe<'a>(
+        &self,
+        peers: impl Iterator<Item = &'a PeerInfo>,
+        bans: impl Iterator<Item = &'a BannedKey>,
+    ) {
+        let mut current: HashMap<String, Entry> = bans
+            .map(|ban| {
+                let entry = Entry::Banned {
+                    ban: store::stored_ban(ban),
+                };
+                (encode_key(&ban.public_key), entry)
+            })
+            .collect();
+        for peer in peers {
+            current
+                .entry(encode_key(&peer.public_key))
+                .or_insert_with(|| Entry::Peer {
+                    peer: store::stored_peer(peer),
+                });
+        }
+
+        let mut state = self.state.lock();
+        let at = if state.observed { unix_millis() } else { 0 };
+        state.observed = true;
+        let removed: Vec<String> = state
+            .records
+            .iter()
+            .filter(|(key, record)| {
+                record.entry != Entry::Removed
+                    && !current.contains_key(*key)
+                    && !state.excluded.contains(*key)
+            })
+            .map(|(key, _)| key.clone())
+            .collect();
+        let changes = removed
+            .into_iter()
+            .map(|key| (key, Entry::Removed))
+            .chain(current)
+            .collect::<Vec<_>>();
+        for (public_key, entry) in changes {
+            let previous = state.records.get(&public_key);
+            if previous.is_some_and(|record| record.entry == entry) {
+                continue;
+            }
+            // A change here always supersedes what it changed, even if
+            // another node's clock is ahead
+            let at = previous.map_or(at, |record| at.max(record.version.at + 1));
+            let version = Version {
+                at,
+                node: self.node.clone(),
+            };
+            state.records.insert(
+                public_key.clone(),
+                Record {
+                    public_key,
+                    version,
+                    entry,
+                },
+            );
+        }
+
+        let forget_before = unix_millis().saturating_sub(TOMBSTONE_TTL.as_millis() as u64);
+        state.records.retain(|_, record| {
+            record.entry != Entry::Removed || record.version.at >= forget_before
+        });
+    }
+
+    /// Take each of another node's records newer than ours, returning
+    /// whether there were any
+    pub fn merge(&self, records: Vec<Record>) -> bool {
+        let mut state = self.state.lock();
+        let mut changed = false;
+        for record in records {
+            // A record's key must be the one its peer or ban holds
+            let valid = match &record.entry {
+                Entry::Peer { peer } => store::peer_info(peer.clone())
+                    .is_ok_and(|peer| encode_key(&peer.public_key) == record.public_key),
+                Entry::Banned { ban } => store::banned_key(ban.clone())
+                    .is_ok_and(|ban| encode_key(&ban.public_key) == record.public_key),
+                Entry::Removed => true,
+            };
+            if !valid {
+                warn!("Ignoring invalid cluster record for {}", record.public_key);
+                continue;
+            }
+            let newer = state
+                .records
+                .get(&record.public_key)
+                .is_none_or(|ours| record.version > ours.version);
+            if newer {
+                state.records.insert(record.public_key.clone(), record);
+                changed = true;
+            }
+        }
+        changed
+    }
+
+    /// The peers the ledger holds, least recently changed first and each
+    /// with whether this node changed it last, and the bans
+    pub fn live(&self) -> (Vec<(PeerInfo, bool)>, Vec<BannedKey>) {
+        let state = self.state.lock();
+        let mut records: Vec<&Record> = state.records.values().collect();
+        records.sort_by(|a, b| a.version.cmp(&b.version));
+        let mut peers = Vec::new();
+        let mut bans = Vec::new();
+        for record in records {
+            match &record.entry {
+                Entry::Peer { peer } => {
+                    if let Ok(info) = store::peer_info(peer.clone()) {
+                        peers.push((info, record.version.node == self.node));
+                    }
+                }
+                Entry::Banned { ban } => bans.extend(store::banned_key(ban.clone()).ok()),
+                Entry::Removed => {}
+            }
+        }
+        (peers, bans)
+    }
+
+    /// Set which peers the registry leaves out for clashing with another
+    pub fn set_excluded(&self, excluded: impl Iterator<Item = [u8; 32]>) {
+        self.state.lock().excluded = excluded.map(|key| encode_key(&key)).collect();
+    }
+
+    fn records(&self) -> Vec<Record> {
+        self.state.lock().records.values().cloned().collect()
+    }
+}
+
+fn unix_millis() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map_or(0, |d| d.as_millis() as u64)
+}
+
+/// What a node serves the others
+#[derive(Serialize, Deserialize)]
+struct NodeState {
+    node: String,
+    records: Vec<Record>,
+    /// Unix time of the latest handshake of each peer connected to the node
+    #[serde(default)]
+    handshakes: HashMap<String, u64>,
+    #[serde(default)]
+    enrollment_tokens: Vec<SharedToken>,
+}
+
+/// How the last pull from another node went
+#[derive(Default)]
+struct NodeStatus {
+    /// The name the node gives itself
+    name: Option<String>,
+    last_contact: Option<u64>,
+    error: Option<String>,
+    handshakes: HashMap<String, u64>,
+}
+
+pub struct ClusterSettings {
+    /// Admin API URLs of the other nodes
+    pub nodes: Vec<String>,
+    /// Bearer token the other nodes accept
+    pub token: Option<String>,
+    pub interval: Duration,
+}
+
+/// The other nodes and how reaching them has gone
+pub struct Cluster {
+    urls: Vec<String>,
+    status: RwLock<Vec<NodeStatus>>,
+}
+
+impl Cluster {
+    /// Pull from the other nodes every interval, bringing `shared` in step
+    /// with what they hold
+    pub fn spawn(
+        shared: Arc<SharedState>,
+        port_forward_tx: mpsc::Sender<PortForwardEvent>,
+        settings: ClusterSettings,
+    ) -> Result<Arc<Self>> {
+        if settings.interval.is_zero() {
+            anyhow::bail!("--cluster-interval-secs must be at least 1");
+        }
+        if let Some(url) = settings
+            .nodes
+            .iter()
+            .find(|url| !url.starts_with("http://") && !url.starts_with("https://"))
+        {
+            anyhow::bail!("cluster node {} is not an http:// or https:// URL", url);
+        }
+        let client = reqwest::Client::builder()
+            .timeout(HTTP_TIMEOUT)
+            .build()
+            .context("failed to create cluster HTTP client")?;
+        let cluster = Arc::new(Self {
+            status: RwLock::new(
+                settings
+                    .nodes
+                    .iter()
+                    .map(|_| NodeStatus::default())
+                    .collect(),
+            ),
+            urls: settings
+                .nodes
+                .iter()
+                .map(|url| url.trim_end_matches('/').to_string())
+                .collect(),
+        });
+
+        let puller = Arc::clone(&cluster);
+        tokio::spawn(async move {
+            // The first look records what this node starts with, before
+            // anything is taken from the others
+            shared.sync_cluster();
+            let mut interval = tokio::time::interval(settings.interval);
+            loop {
+                interval.tick().await;
+                let pulls = puller
+                    .urls
+                    .iter()
+                    .map(|url| pull(&client, url, settings.token.as_deref()));
+                let results = futures::future::join_all(pulls).await;
+                let mut changed = false;
+                for (i, result) in results.into_iter().enumerate() {
+                    match result {
+                        Ok(state) => {
+                            if let Some(ledger) = &shared.cluster {
+                                changed |= ledger.merge(state.records);
+                            }
+                            shared.enrollment.write().merge(state.enrollment_tokens);
+                            puller.record_contact(i, state.node, state.handshakes);
+                        }
+                        Err(e) => puller.record_error(i, format!("{:#}", e)),
+                    }
+                }
+                if !changed {
+                    continue;
+                }
+                for rule in shared.sync_cluster() {
+                    let event = PortForwardEvent::Removed {
+                        protocol: rule.protocol,
+                        port: rule.public_port,
+                    };
+                    if let Err(e) = port_forward_tx.send(event).await {
+                        error!("Failed to notify dataplane of port forward removal: {}", e);
+                    }
+                }
+            }
+        });
+        Ok(cluster)
+    }
+
+    fn record_contact(&self, i: usize, name: String, handshakes: HashMap<String, u64>) {
+        let mut status = self.status.write();
+        let node = &mut status[i];
+        if node.error.is_some() || node.last_contact.is_none() {
+            info!("Cluster node {} ({}) reachable", name, self.urls[i]);
+        }
+        *node = NodeStatus {
+            name: Some(name),
+            last_contact: Some(unix_now()),
+            error: None,
+            handshakes,
+        };
+    }
+
+    fn record_error(&self, i: usize, error: String) {
+        let mut status = self.status.write();
+        let node = &mut status[i];
+        if node.error.is_none() {
+            warn!("Cluster node {} unreachable: {}", self.urls[i], error);
+        }
+        node.error = Some(error);
+        // A node that can't be reached has no peers connected to it, as
+        // far as anyone can tell
+        node.handshakes.clear();
+    }
+}
+
+async fn pull(client: &reqwest::Client, url: &str, token: Option<&str>) -> Result<NodeState> {
+    let mut request = client.get(format!("{}{}", url, STATE_PATH));
+    if let Some(token) = token {
+        request = request.bearer_auth(token);
+    }
+    let response = request.send().await?.error_for_status()?;
+    Ok(response.json().await?)
+}
+
+/// Peers connected to this node, with the Unix time of their latest
+/// handshake
+fn local_handshakes(shared: &SharedState, wg_io: &WgIo) -> HashMap<String, u64> {
+    let keys: Vec<[u8; 32]> = shared
+        .peers
+        .read()
+        .iter()
+        .map(|peer| peer.public_key)
+        .collect();
+    keys.iter()
+        .filter_map(|key| {
+            let stats = wg_io.peer_stats(key)?;
+            let handshake = stats.last_handshake.filter(|_| stats.is_connected())?;
+            let at = handshake.duration_since(UNIX_EPOCH).ok()?.as_secs();
+            Some((encode_key(key), at))
+        })
+        .collect()
+}
+
+type RouterState = (Arc<SharedState>, Arc<WgIo>, Arc<Cluster>);
+
+/// Create the router serving `/v1/cluster` and the ledger for other nodes
+pub fn create_router(shared: Arc<SharedState>, wg_io: Arc<WgIo>, cluster: Arc<Cluster>) -> Router {
+    Router::new()
+        .route("/v1/cluster", get(cluster_handler))
+        .route(STATE_PATH, get(state_handler))
+        .with_state((shared, wg_io, cluster))
+}
+
+/// Handler for GET /v1/cluster/state
+async fn state_handler(State((shared, wg_io, _)): State<RouterState>) -> impl IntoResponse {
+    let Some(ledger) = &shared.cluster else {
+        return (StatusCode::NOT_FOUND, "not clustered").into_response();
+    };
+    Json(NodeState {
+        node: ledger.node().to_string(),
+        records: ledger.records(),
+        handshakes: local_handshakes(&shared, &wg_io),
+        enrollment_tokens: shared.enrollment.read().export(),
+    })
+    .into_response()
+}
+
+/// Handler for GET /v1/cluster
+async fn cluster_handler(State((shared, wg_io, cluster)): State<RouterState>) -> impl IntoResponse {
+    let node = shared
+        .cluster
+        .as_ref()
+        .map(|ledger| ledger.node().to_string())
+        .unwrap_or_default();
+    let local = local_handshakes(&shared, &wg_io);
+
+    // Where each peer's latest handshake was, across the cluster
+    let mut latest: HashMap<String, (u64, String)> = local
+        .iter()
+        .map(|(key, at)| (key.clone(), (*at, node.clone())))
+        .collect();
+    let status = cluster.status.read();
+    let nodes: Vec<_> = cluster
+        .urls
+        .iter()
+        .zip(status.iter())
+        .map(|(url, status)| {
+            let name = status.name.clone().unwrap_or_else(|| url.clone());
+            for (key, at) in &status.handshakes {
+                if latest.get(key).is_none_or(|(latest, _)| at > latest) {
+                    latest.insert(key.clone(), (*at, name.clone()));
+                }
+            }
+            serde_json::json!({
+                "url": url,
+                "node": status.name,
+                "reachable": status.error.is_none() && status.last_contact.is_some(),
+                "last_contact": status.last_contact,
+                "error": status.error,
+                "connected_peers": status.handshakes.len(),
+            })
+        })
+        .collect();
+    let mut peers: Vec<_> = latest
+        .into_iter()
+        .map(|(key, (at, node))| {
+            serde_json::json!({ "public_key": key, "node": node, "latest_handshake": at })
+        })
+        .collect();
+    peers.sort_by_key(|peer| peer["public_key"].as_str().unwrap_or_default().to_string());
+
+    Json(serde_json::json!({
+        "node": node,
+        "connected_peers": local.len(),
+        "nodes": nodes,
+        "peers": peers,
+    }))
+}
+
+/// This host's name, the default name of its node
+pub fn hostname() -> Result<String> {
+    let mut buf = [0u8; 256];
+    // SAFETY: the buffer is valid for its length, which is passed along
+    if unsafe { libc::gethostname(buf.as_mut_ptr().cast(), buf.len()) } != 0 {
+        return Err(std::io::Error::last_os_error()).context("failed to read the hostname");
+    }
+    let len = buf.iter().position(|&b| b == 0).unwrap_or(buf.len());
+    Ok(String::from_utf8_lossy(&buf[..len]).into_owned())
+}
@@ -0,0 +1,227 @@
+//! WireGuard's mac1, mac2 and cookie reply messages
+//!
+//! Every handshake initiation carries a mac1 keyed with the server's public
+//! key, which is checked before any expensive work so random junk is
+//! dropped cheaply. Under load, the server answers an initiation without a
+//! valid mac2 with a cookie reply instead of a handshake response: the
+//! cookie is a MAC of the sender's address under a secret that changes
+//! every two minutes, so only a sender that can receive packets at that
+//! address can come back with a matching mac2.
+//!
+//! BLAKE2s and XChaCha20-Poly1305 come from the same crates gotatun makes
+//! and checks these messages with.
+
+use std::net::SocketAddr;
+use std::time::{Duration, Instant};
+
+use chacha20poly1305::aead::{AeadInPlace, KeyInit};
+use chacha20poly1305::{Key, XChaCha20Poly1305, XNonce};
+use parking_lot::Mutex;
+use rand::RngCore;
+
+use super::api::constant_time_eq;
+use super::wg_mac::{hash, mac, mac1_matches};
+
+/// Size of a handshake initiation, ending in mac1 and mac2
+pub const INITIATION_LEN: usize = 148;
+const MAC1_OFFSET: usize = 116;
+const MAC2_OFFSET: usize = 132;
+
+/// WireGuard message type of a cookie reply
+const COOKIE_REPLY: u8 = 3;
+const COOKIE_REPLY_LEN: usize = 64;
+
+const LABEL_COOKIE: &[u8] = b"cookie--";
+
+/// How long a cookie secret is used before it is replaced, as in the
+/// WireGuard paper
+const SECRET_LIFETIME: Duration = Duration::from_secs(120);
+
+/// Whether the initiation's mac1 was made for `server_public_key`
+pub fn mac1_valid(msg: &[u8], server_public_key: &[u8; 32]) -> bool {
+    msg.len() == INITIATION_LEN && mac1_matches(msg, server_public_key)
+}
+
+/// Issues cookies and checks the mac2 of initiations made with them
+pub struct CookieJar {
+    secrets: Mutex<Secrets>,
+}
+
+struct Secrets {
+    current: [u8; 32],
+    /// The secret before the current one, so cookies handed out just
+    /// before a change still count
+    previous: Option<[u8; 32]>,
+    changed: Instant,
+}
+
+impl Default for CookieJar {
+    fn default() -> Self {
+        Self {
+            secrets: Mutex::new(Secrets {
+                current: random_bytes(),
+                previous: None,
+                changed: Instant::now(),
+            }),
+        }
+    }
+}
+
+impl CookieJar {
+    /// Whether the initiation carries a mac2 made with a cookie recently
+    /// handed to `src`
+    pub fn mac2_valid(&self, msg: &[u8], src: SocketAddr) -> bool {
+        if msg.len() != INITIATION_LEN {
+            return false;
+        }
+        let secrets = self.secrets();
+        [Some(secrets.0), secrets.1]
+            .into_iter()
+            .flatten()
+            .any(|secret| {
+                let mac2 = mac(&make_cookie(&secret, src), &[&msg[..MAC2_OFFSET]]);
+                constant_time_eq(&mac2, &msg[MAC2_OFFSET..])
+            })
+    }
+
+    /// A cookie reply to the initiation from `src`, which must have a valid
+    /// mac1 for `server_public_key`
+    pub fn reply(&self, msg: &[u8], src: SocketAddr, server_public_key: &[u8; 32]) -> Vec<u8> {
+        let (secret, _) = self.secrets();
+        let mut cookie = make_cookie(&secret, src);
+        let key = hash(LABEL_COOKIE, server_public_key);
+        let mut nonce = [0u8; 24];
+        rand::thread_rng().fill_bytes(&mut nonce);
+        // Bound to the initiation by its mac1
+        let tag = XChaCha20Poly1305::new(Key::from_slice(&key))
+            .encrypt_in_place_detached(
+                XNonce::from_slice(&nonce),
+                &msg[MAC1_OFFSET..MAC2_OFFSET],
+                &mut cookie,
+            )
+            .expect("sealing a 16-byte cookie cannot fail");
+
+        let mut reply = Vec::with_capacity(COOKIE_REPLY_LEN);
+        reply.extend_from_slice(&[COOKIE_REPLY, 0, 0, 0]);
+        // Addressed to the initiator by the sender index it chose
+        reply.extend_from_slice(&msg[4..8]);
+        reply.extend_from_slice(&nonce);
+        reply.extend_from_slice(&cookie);
+        reply.extend_from_slice(&tag);
+        reply
+    }
+
+    /// The current and previous secrets, replacing them when due
+    fn secrets(&self) -> ([u8; 32], Option<[u8; 32]>) {
+        let mut secrets = self.secrets.lock();
+        if secrets.changed.elapsed() >= SECRET_LIFETIME {
+            secrets.previous = Some(secrets.current);
+            secrets.current = random_bytes();
+            secrets.changed = Instant::now();
+        }
+        (secrets.current, secrets.previous)
+    }
+}
+
+fn make_cookie(secret: &[u8; 32], src: SocketAddr) -> [u8; 16] {
+    let ip = match src.ip() {
+        std::net::IpAddr::V4(ip) => ip.octets().to_vec(),
+        std::net::IpAddr::V6(ip) => ip.octets().to_vec(),
+    };
+    mac(secret, &[&ip, &src.port().to_be_bytes()])
+}
+
+fn random_bytes() -> [u8; 32] {
+    let mut bytes = [0u8; 32];
+    rand::thread_rng().fill_bytes(&mut bytes);
+    bytes
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    use chacha20poly1305::Tag;
+    use gotatun::noise::{Tunn, TunnResult};
+    use gotatun::packet::Packet;
+    use zerocopy::IntoBytes;
+
+    use crate::wg_mac::seal_mac1;
+    use crate::wgconf;
+
+    /// An IPv4 header, enough for a tunnel without a session to start a
+    /// handshake
+    const IPV4_PACKET: [u8; 20] = [
+        0x45, 0, 0, 20, 0, 0, 0x40, 0, 64, 17, 0, 0, 10, 0, 0, 2, 1, 1, 1, 1,
+    ];
+
+    /// A handshake initiation to `server_public_key` as gotatun makes it,
+    /// and the tunnel that made it
+    fn initiation(server_public_key: &[u8; 32]) -> (Tunn, Vec<u8>) {
+        let client = wgconf::generate_key();
+        let mut tunnel = Tunn::new(
+            client.private_key.into(),
+            (*server_public_key).into(),
+            None,
+            None,
+            0,
+            None,
+        );
+        let packet = Packet::from_bytes(bytes::BytesMut::from(&IPV4_PACKET[..]));
+        let sent: Packet = tunnel
+            .handle_outgoing_packet(packet)
+            .expect("a tunnel without a session starts a handshake")
+            .into();
+        (tunnel, sent.as_bytes().to_vec())
+    }
+
+    #[test]
+    fn mac1_of_a_real_initiation() {
+        let server = wgconf::generate_key();
+        let (_, mut msg) = initiation(&server.public_key);
+        assert_eq!(msg.len(), INITIATION_LEN);
+        assert!(mac1_valid(&msg, &server.public_key));
+        assert!(!mac1_valid(&msg, &wgconf::generate_key().public_key));
+
+        // A rewritten header fails until mac1 is made again
+        msg[..4].copy_from_slice(&0x5a5a5a5au32.to_le_bytes());
+        assert!(!mac1_matches(&msg, &server.public_key));
+        seal_mac1(&mut msg, &server.public_key);
+        assert!(mac1_matches(&msg, &server.public_key));
+    }
+
+    #[test]
+    fn cookie_reply_round_trip() {
+        let server = wgconf::generate_key();
+        let (mut tunnel, mut msg) = initiation(&server.public_key);
+        let src: SocketAddr = "192.0.2.7:40000".parse().unwrap();
+        let jar = CookieJar::default();
+        let reply = jar.reply(&msg, src, &server.public_key);
+        assert_eq!(reply.len(), COOKIE_REPLY_LEN);
+
+        // gotatun takes the cookie, so the reply decrypts with its keys
+        let wg = Packet::from_bytes(bytes::BytesMut::from(&reply[..]))
+            .try_into_wg()
+            .expect("a WireGuard message");
+        if let TunnResult::Err(e) = tunnel.handle_incoming_packet(wg) {
+            panic!("gotatun rejected the cookie reply: {:?}", e);
+        }
+
+        // and an initiation with a mac2 made from the cookie is let through,
+        // from that address only
+        let mut cookie: [u8; 16] = reply[32..48].try_into().unwrap();
+        XChaCha20Poly1305::new(Key::from_slice(&hash(LABEL_COOKIE, &server.public_key)))
+            .decrypt_in_place_detached(
+                XNonce::from_slice(&reply[8..32]),
+                &msg[MAC1_OFFSET..MAC2_OFFSET],
+                &mut cookie,
+                Tag::from_slice(&reply[48..]),
+            )
+            .expect("the cookie decrypts");
+        assert!(!jar.mac2_valid(&msg, src));
+        let mac2 = mac(&cookie, &[&msg[..MAC2_OFFSET]]);
+        msg[MAC2_OFFSET..].copy_from_slice(&mac2);
+        assert!(jar.mac2_valid(&msg, src));
+        assert!(!jar.mac2_valid(&msg, "192.0.2.8:40000".parse().unwrap()));
+    }
+}
@@ -0,0 +1,771 @@
+//! `wirecagesrv peer`, `status`, `dumpconf` and `rotate-key` subcommands
+//!
+//! Manage and inspect a running server through the admin API served on its
+//! `--admin-socket` unix socket, or with `--tenant` one of the tenants it
+//! runs.
+
+use std::path::{Path, PathBuf};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::{Context, Result};
+use clap::{Parser, Subcommand};
+use serde_json::Value;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::UnixStream;
+
+use super::tenant;
+
+/// Default path of the admin unix socket
+pub const DEFAULT_SOCKET: &str = "/run/wirecagesrv/admin.sock";
+
+#[derive(Parser, Debug)]
+#[command(name = "wirecagesrv peer")]
+#[command(about = "Manage peers on a running wirecagesrv")]
+pub struct PeerCli {
+    /// Admin socket of the running server
+    #[arg(long, global = true, default_value = DEFAULT_SOCKET)]
+    socket: String,
+
+    /// Manage this tenant's peers rather than the server's own
+    #[arg(long, global = true)]
+    tenant: Option<String>,
+
+    #[command(subcommand)]
+    command: PeerCommand,
+}
+
+#[derive(Subcommand, Debug)]
+enum PeerCommand {
+    /// List registered peers
+    List,
+    /// Register a peer and assign it an address
+    Add {
+        /// Peer public key (base64); if omitted the server generates a
+        /// keypair and returns a wg-quick config
+        public_key: Option<String>,
+        /// DNS name for the peer
+        #[arg(long)]
+        name: Option<String>,
+        /// Fixed address for the peer (default: next free address)
+        #[arg(long)]
+        address: Option<std::net::Ipv4Addr>,
+        /// Base64 preshared key for the peer, or `generate` for a random one
+        #[arg(long, value_name = "KEY|generate")]
+        preshared_key: Option<String>,
+        /// Remove the peer automatically after this many seconds
+        #[arg(long, value_name = "SECS")]
+        ttl: Option<u64>,
+        /// Tag the peer for policy (repeatable)
+        #[arg(long = "tag", value_name = "TAG")]
+        tags: Vec<String>,
+        /// Write the generated wg-quick config here instead of stdout
+        #[arg(long, value_name = "PATH")]
+        conf: Option<PathBuf>,
+        /// Also print the generated config as a terminal QR code (needs `qrencode`)
+        #[arg(long)]
+        qr: bool,
+    },
+    /// Replace a peer's tags; with none given, clear them
+    Tag {
+        /// Peer public key (base64)
+        public_key: String,
+        tags: Vec<String>,
+    },
+    /// Show the endpoints a peer has roamed through
+    Endpoints {
+        /// Peer public key (base64)
+        public_key: String,
+    },
+    /// Show a peer's traffic per day
+    Usage {
+        /// Peer public key (base64)
+        public_key: String,
+        /// How many days back to report
+        #[arg(long, default_value = "7")]
+        days: u64,
+    },
+    /// Show a peer's recent sessions
+    Sessions {
+        /// Peer public key (base64)
+        public_key: String,
+        /// How many sessions to list
+        #[arg(long, default_value = "20")]
+        limit: usize,
+    },
+    /// Show the destinations a peer exchanged the most traffic with
+    Destinations {
+        /// Peer public key (base64)
+        public_key: String,
+        /// How many destinations to list
+        #[arg(long, default_value = "20")]
+        limit: usize,
+    },
+    /// Remove a peer and its port forwards
+    Remove {
+        /// Peer public key (base64)
+        public_key: String,
+    },
+    /// Ban a public key, removing its peer if registered
+    Ban {
+        /// Peer public key (base64)
+        public_key: String,
+        /// Why the key is banned, kept with the ban
+        #[arg(long)]
+        reason: Option<String>,
+    },
+    /// Lift a ban on a public key
+    Unban {
+        /// Peer public key (base64)
+        public_key: String,
+    },
+    /// List banned public keys
+    Bans,
+    /// Make the server's peers exactly those in a JSON file, removing any
+    /// others
+    Sync {
+        /// File with `{"peers": [{"public_key": ..., "name": ..., "address": ...}]}`
+        /// (`-` for stdin)
+        file: PathBuf,
+    },
+}
+
+#[derive(Parser, Debug)]
+#[command(name = "wirecagesrv status")]
+#[command(about = "Show interface and peer state of a running wirecagesrv")]
+pub struct StatusCli {
+    /// Admin socket of the running server
+    #[arg(long, default_value = DEFAULT_SOCKET)]
+    socket: String,
+
+    /// Act on this tenant rather than the server itself
+    #[arg(long)]
+    tenant: Option<String>,
+
+    /// Print the raw JSON status
+    #[arg(long)]
+    json: bool,
+
+    /// List the open NAT flows instead, most recently active first
+    #[arg(long)]
+    flows: bool,
+
+    /// With `--flows`, only list this peer's flows
+    #[arg(long, value_name = "PUBLIC_KEY", requires = "flows")]
+    peer: Option<String>,
+
+    /// Show the other cluster nodes instead, and how many peers each has
+    #[arg(long, conflicts_with = "flows")]
+    cluster: bool,
+}
+
+#[derive(Parser, Debug)]
+#[command(name = "wirecagesrv dumpconf")]
+#[command(about = "Print a running wirecagesrv's configuration in `wg showconf` format")]
+pub struct DumpconfCli {
+    /// Admin socket of the running server
+    #[arg(long, default_value = DEFAULT_SOCKET)]
+    socket: String,
+
+    /// Act on this tenant rather than the server itself
+    #[arg(long)]
+    tenant: Option<String>,
+
+    /// Leave the interface private key out of the output
+    #[arg(long)]
+    no_private_key: bool,
+}
+
+#[derive(Parser, Debug)]
+#[command(name = "wirecagesrv rotate-key")]
+#[command(about = "Switch a running wirecagesrv to a new private key")]
+pub struct RotateKeyCli {
+    /// Admin socket of the running server
+    #[arg(long, default_value = DEFAULT_SOCKET)]
+    socket: String,
+
+    /// Act on this tenant rather than the server itself
+    #[arg(long)]
+    tenant: Option<String>,
+
+    /// File holding the new private key (base64); one is generated if not
+    /// given
+    #[arg(long)]
+    private_key_file: Option<PathBuf>,
+
+    /// Seconds the old key keeps answering handshakes, for clients still
+    /// configured with it
+    #[arg(long, default_value = "604800")]
+    grace_secs: u64,
+}
+
+pub async fn run_rotate_key(cli: RotateKeyCli) -> Result<()> {
+    let private_key = cli
+        .private_key_file
+        .as_ref()
+        .map(|path| {
+            std::fs::read_to_string(path)
+                .map(|key| key.trim().to_string())
+                .with_context(|| format!("failed to read {}", path.display()))
+        })
+        .transpose()?;
+    let payload = serde_json::json!({
+        "private_key": private_key,
+        "grace_secs": cli.grace_secs,
+    });
+    let body = request(
+        &Admin::new(&cli.socket, cli.tenant.as_deref()),
+        "POST",
+        "/v1/server-key",
+        Some(&payload),
+    )
+    .await?;
+    println!(
+        "New public key: {}",
+        body["public_key"].as_str().unwrap_or("-")
+    );
+    println!(
+        "Old public key {} retires {}",
+        body["previous_public_key"].as_str().unwrap_or("-"),
+        format_in(body["previous_key_retires_at"].as_u64().unwrap_or(0))
+    );
+    if !body["saved"].as_bool().unwrap_or(false) {
+        println!("The server has no --private-key-file; update its configuration with the new key");
+    }
+    Ok(())
+}
+
+pub async fn run_dumpconf(cli: DumpconfCli) -> Result<()> {
+    let path = format!("/v1/showconf?private_key={}", !cli.no_private_key);
+    let admin = Admin::new(&cli.socket, cli.tenant.as_deref());
+    let (status, body) = send(&admin, "GET", &path, None).await?;
+    if !(200..300).contains(&status) {
+        anyhow::bail!("server returned {}: {}", status, body.trim());
+    }
+    print!("{}", body);
+    Ok(())
+}
+
+pub async fn run_status(cli: StatusCli) -> Result<()> {
+    if cli.flows {
+        return print_flows(&cli).await;
+    }
+    if cli.cluster {
+        return print_cluster(&cli).await;
+    }
+    let admin = Admin::new(&cli.socket, cli.tenant.as_deref());
+    let status = request(&admin, "GET", "/v1/status", None).await?;
+    if cli.json {
+        println!("{}", serde_json::to_string_pretty(&status)?);
+        return Ok(());
+    }
+
+    println!("interface: wirecagesrv");
+    println!("  public key: {}", status["public_key"].as_str().unwrap_or("-"));
+    if let Some(previous) = status["previous_public_key"].as_str() {
+        println!(
+            "  previous public key: {} (retires {})",
+            previous,
+            format_in(status["previous_key_retires_at"].as_u64().unwrap_or(0))
+        );
+    }
+    println!("  listening on: {}", status["listen_addr"].as_str().unwrap_or("-"));
+    println!("  address: {}", status["address"].as_str().unwrap_or("-"));
+
+    for peer in status["peers"].as_array().into_iter().flatten() {
+        println!();
+        println!("peer: {}", peer["public_key"].as_str().unwrap_or("-"));
+        if let Some(name) = peer["name"].as_str() {
+            println!("  name: {}", name);
+        }
+        if let Some(endpoint) = peer["endpoint"].as_str() {
+            println!("  endpoint: {}", endpoint);
+        }
+        println!("  allowed ips: {}/32", peer["assigned_ip"].as_str().unwrap_or("-"));
+        let liveness = match (peer["connected"].as_bool(), peer["keepalive"].as_bool()) {
+            (Some(true), Some(true)) => "connected, sending keepalives",
+            (Some(true), _) => "connected",
+            _ if peer["last_receive"].is_u64() => "idle",
+            _ => "never connected",
+        };
+        println!("  liveness: {}", liveness);
+        if let Some(handshake) = peer["latest_handshake"].as_u64() {
+            println!("  latest handshake: {}", format_ago(handshake));
+        }
+        println!(
+            "  transfer: {} received, {} sent",
+            format_bytes(peer["rx_bytes"].as_u64().unwrap_or(0)),
+            format_bytes(peer["tx_bytes"].as_u64().unwrap_or(0)),
+        );
+    }
+    Ok(())
+}
+
+async fn print_flows(cli: &StatusCli) -> Result<()> {
+    let path = match &cli.peer {
+        Some(peer) => format!("/v1/flows?peer={}", url_safe_key(peer)),
+        None => "/v1/flows".to_string(),
+    };
+    let admin = Admin::new(&cli.socket, cli.tenant.as_deref());
+    let body = request(&admin, "GET", &path, None).await?;
+    if cli.json {
+        println!("{}", serde_json::to_string_pretty(&body)?);
+        return Ok(());
+    }
+
+    println!(
+        "{:<5} {:<21} {:<21} {:<13} {:>6} {:>12} {:>12} PEER",
+        "PROTO", "CLIENT", "REMOTE", "STATE", "IDLE", "UP", "DOWN"
+    );
+    let mut remote_closed = false;
+    for flow in body["flows"].as_array().into_iter().flatten() {
+        let mut state = flow["state"].as_str().unwrap_or("-").to_string();
+        if flow["remote_closed"].as_bool().unwrap_or(false) {
+            state.push('*');
+            remote_closed = true;
+        }
+        let mut remote = flow["remote"].as_str().unwrap_or("-").to_string();
+        if let Some(port) = flow["public_port"].as_u64() {
+            remote = format!("{} (:{})", remote, port);
+        }
+        println!(
+            "{:<5} {:<21} {:<21} {:<13} {:>5}s {:>12} {:>12} {}",
+            flow["protocol"].as_str().unwrap_or("-"),
+            flow["client"].as_str().unwrap_or("-"),
+            remote,
+            state,
+            flow["idle_secs"].as_u64().unwrap_or(0),
+            format_bytes(flow["up_bytes"].as_u64().unwrap_or(0)),
+            format_bytes(flow["down_bytes"].as_u64().unwrap_or(0)),
+            flow["name"]
+                .as_str()
+                .or(flow["peer"].as_str())
+                .unwrap_or("-"),
+        );
+    }
+    let shown = body["flows"].as_array().map_or(0, Vec::len);
+    let total = body["total"].as_u64().unwrap_or(0);
+    if total > shown as u64 {
+        println!("({} of {} flows shown)", shown, total);
+    }
+    if remote_closed {
+        println!("* the remote end has closed");
+    }
+    Ok(())
+}
+
+async fn print_cluster(cli: &StatusCli) -> Result<()> {
+    let admin = Admin::new(&cli.socket, cli.tenant.as_deref());
+    let body = request(&admin, "GET", "/v1/cluster", None).await?;
+    if cli.json {
+        println!("{}", serde_json::to_string_pretty(&body)?);
+        return Ok(());
+    }
+
+    println!(
+        "node: {} ({} peers connected)",
+        body["node"].as_str().unwrap_or("-"),
+        body["connected_peers"].as_u64().unwrap_or(0)
+    );
+    for node in body["nodes"].as_array().into_iter().flatten() {
+        println!();
+        println!("node: {}", node["node"].as_str().unwrap_or("-"));
+        println!("  url: {}", node["url"].as_str().unwrap_or("-"));
+        match node["error"].as_str() {
+            Some(error) => println!("  unreachable: {}", error),
+            None if node["reachable"].as_bool().unwrap_or(false) => {
+                println!(
+                    "  peers connected: {}",
+                    node["connected_peers"].as_u64().unwrap_or(0)
+                )
+            }
+            None => println!("  not yet reached"),
+        }
+        if let Some(contact) = node["last_contact"].as_u64() {
+            println!("  last contact: {}", format_ago(contact));
+        }
+    }
+    Ok(())
+}
+
+pub fn format_ago(unix_secs: u64) -> String {
+    let then = UNIX_EPOCH + Duration::from_secs(unix_secs);
+    let secs = SystemTime::now()
+        .duration_since(then)
+        .unwrap_or_default()
+        .as_secs();
+    match secs {
+        0..=59 => format!("{} seconds ago", secs),
+        60..=3599 => format!("{} minutes, {} seconds ago", secs / 60, secs % 60),
+        _ => format!("{} hours, {} minutes ago", secs / 3600, secs % 3600 / 60),
+    }
+}
+
+pub fn format_in(unix_secs: u64) -> String {
+    let then = UNIX_EPOCH + Duration::from_secs(unix_secs);
+    let secs = then
+        .duration_since(SystemTime::now())
+        .unwrap_or_default()
+        .as_secs();
+    match secs {
+        0..=3599 => format!("in {} minutes", secs / 60),
+        3600..=86399 => format!("in {} hours, {} minutes", secs / 3600, secs % 3600 / 60),
+        _ => format!("in {} days, {} hours", secs / 86400, secs % 86400 / 3600),
+    }
+}
+
+pub fn format_bytes(bytes: u64) -> String {
+    const UNITS: [&str; 4] = ["KiB", "MiB", "GiB", "TiB"];
+    if bytes < 1024 {
+        return format!("{} B", bytes);
+    }
+    let mut value = bytes as f64;
+    let mut unit = "B";
+    for next in UNITS {
+        if value < 1024.0 {
+            break;
+        }
+        value /= 1024.0;
+        unit = next;
+    }
+    format!("{:.2} {}", value, unit)
+}
+
+pub async fn run(cli: PeerCli) -> Result<()> {
+    let admin = &Admin::new(&cli.socket, cli.tenant.as_deref());
+    match cli.command {
+        PeerCommand::List => {
+            let body = request(admin, "GET", "/v1/peers", None).await?;
+            let peers = body["peers"].as_array().cloned().unwrap_or_default();
+            println!("{:<46} {:<16} {:<20} ENDPOINT", "PUBLIC KEY", "ADDRESS", "NAME");
+            for peer in peers {
+                println!(
+                    "{:<46} {:<16} {:<20} {}",
+                    peer["public_key"].as_str().unwrap_or("-"),
+                    peer["assigned_ip"].as_str().unwrap_or("-"),
+                    peer["name"].as_str().unwrap_or("-"),
+                    peer["endpoint"].as_str().unwrap_or("-"),
+                );
+            }
+        }
+        PeerCommand::Add {
+            public_key,
+            name,
+            address,
+            preshared_key,
+            ttl,
+            tags,
+            conf,
+            qr,
+        } => {
+            let payload = serde_json::json!({
+                "public_key": public_key,
+                "name": name,
+                "address": address,
+                "preshared_key": preshared_key,
+                "ttl_secs": ttl,
+                "tags": (!tags.is_empty()).then_some(tags),
+            });
+            let body = request(admin, "POST", "/v1/peers", Some(&payload)).await?;
+            eprintln!(
+                "Added peer {} with IP {}",
+                body["public_key"].as_str().unwrap_or("?"),
+                body["assigned_ip"].as_str().unwrap_or("?")
+            );
+
+            // The generated key is only shown here, or inside the client config
+            if let (Some(preshared_key), None) =
+                (body["preshared_key"].as_str(), body["client_config"].as_str())
+            {
+                println!("PresharedKey = {}", preshared_key);
+            }
+
+            if let Some(client_config) = body["client_config"].as_str() {
+                match &conf {
+                    Some(path) => {
+                        write_private_file(path, client_config)?;
+                        eprintln!("Wrote client config to {}", path.display());
+                    }
+                    None => print!("{}", client_config),
+                }
+                if qr {
+                    print_qr(client_config)?;
+                }
+            } else if conf.is_some() || qr {
+                eprintln!("No client config: the server only generates one for keys it creates");
+            }
+        }
+        PeerCommand::Tag { public_key, tags } => {
+            let path = format!("/v1/peers/{}/tags", url_safe_key(&public_key));
+            let payload = serde_json::json!({ "tags": tags });
+            request(admin, "PUT", &path, Some(&payload)).await?;
+            if tags.is_empty() {
+                println!("Cleared tags of {}", public_key);
+            } else {
+                println!("Tagged {} with {}", public_key, tags.join(", "));
+            }
+        }
+        PeerCommand::Endpoints { public_key } => {
+            let path = format!("/v1/peers/{}/endpoints", url_safe_key(&public_key));
+            let body = request(admin, "GET", &path, None).await?;
+            println!("{:<26} {}", "SINCE", "ENDPOINT");
+            for entry in body["endpoints"].as_array().into_iter().flatten() {
+                println!(
+                    "{:<26} {}",
+                    entry["since"].as_u64().map_or("-".to_string(), format_ago),
+                    entry["endpoint"].as_str().unwrap_or("-"),
+                );
+            }
+            println!("{} roams in total", body["roams"].as_u64().unwrap_or(0));
+        }
+        PeerCommand::Usage { public_key, days } => {
+            let now = SystemTime::now()
+                .duration_since(UNIX_EPOCH)
+                .map_or(0, |d| d.as_secs());
+            let today = now - now % 86400;
+            let since = today.saturating_sub(days.saturating_sub(1) * 86400);
+            let path = format!(
+                "/v1/peers/{}/usage?since={}&bucket=day",
+                url_safe_key(&public_key),
+                since
+            );
+            let body = request(admin, "GET", &path, None).await?;
+            println!("{:<12} {:>12} {:>12} {:>8}", "DAY (UTC)", "UP", "DOWN", "FLOWS");
+            let row = |label: String, counters: &Value| {
+                println!(
+                    "{:<12} {:>12} {:>12} {:>8}",
+                    label,
+                    format_bytes(counters["up_bytes"].as_u64().unwrap_or(0)),
+                    format_bytes(counters["down_bytes"].as_u64().unwrap_or(0)),
+                    counters["flows"].as_u64().unwrap_or(0),
+                )
+            };
+            for bucket in body["buckets"].as_array().into_iter().flatten() {
+                let start = bucket["start"].as_u64().unwrap_or(today);
+                let label = match (today - start.min(today)) / 86400 {
+                    0 => "today".to_string(),
+                    1 => "yesterday".to_string(),
+                    n => format!("{} days ago", n),
+                };
+                row(label, bucket);
+            }
+            row("total".to_string(), &body["total"]);
+        }
+        PeerCommand::Sessions { public_key, limit } => {
+            let path = format!(
+                "/v1/peers/{}/sessions?limit={}",
+                url_safe_key(&public_key),
+                limit
+            );
+            let body = request(admin, "GET", &path, None).await?;
+            println!(
+                "{:<24} {:<24} {:<22} {:>12} {:>12}",
+                "STARTED", "ENDED", "ENDPOINT", "RECEIVED", "SENT"
+            );
+            for session in body["sessions"].as_array().into_iter().flatten() {
+                println!(
+                    "{:<24} {:<24} {:<22} {:>12} {:>12}",
+                    format_ago(session["started_at"].as_u64().unwrap_or(0)),
+                    session["ended_at"]
+                        .as_u64()
+                        .map_or_else(|| "connected".to_string(), format_ago),
+                    session["endpoint"].as_str().unwrap_or("-"),
+                    format_bytes(session["rx_bytes"].as_u64().unwrap_or(0)),
+                    format_bytes(session["tx_bytes"].as_u64().unwrap_or(0)),
+                );
+            }
+        }
+        PeerCommand::Destinations { public_key, limit } => {
+            let path = format!(
+                "/v1/peers/{}/destinations?limit={}",
+                url_safe_key(&public_key),
+                limit
+            );
+            let body = request(admin, "GET", &path, None).await?;
+            println!(
+                "{:<5} {:<21} {:<32} {:>12} {:>12} {:>8}",
+                "PROTO", "DESTINATION", "NAME", "UP", "DOWN", "FLOWS"
+            );
+            for destination in body["destinations"].as_array().into_iter().flatten() {
+                println!(
+                    "{:<5} {:<21} {:<32} {:>12} {:>12} {:>8}",
+                    destination["protocol"].as_str().unwrap_or("-"),
+                    format!(
+                        "{}:{}",
+                        destination["ip"].as_str().unwrap_or("-"),
+                        destination["port"].as_u64().unwrap_or(0)
+                    ),
+                    destination["name"].as_str().unwrap_or("-"),
+                    format_bytes(destination["up_bytes"].as_u64().unwrap_or(0)),
+                    format_bytes(destination["down_bytes"].as_u64().unwrap_or(0)),
+                    destination["flows"].as_u64().unwrap_or(0),
+                );
+            }
+        }
+        PeerCommand::Remove { public_key } => {
+            let path = format!("/v1/peers/{}", url_safe_key(&public_key));
+            request(admin, "DELETE", &path, None).await?;
+            println!("Removed peer {}", public_key);
+        }
+        PeerCommand::Ban { public_key, reason } => {
+            let payload = serde_json::json!({
+                "public_key": public_key,
+                "reason": reason,
+            });
+            let body = request(admin, "POST", "/v1/bans", Some(&payload)).await?;
+            if body["removed_peer"].as_bool().unwrap_or(false) {
+                println!("Banned {} and removed its peer", public_key);
+            } else {
+                println!("Banned {}", public_key);
+            }
+        }
+        PeerCommand::Unban { public_key } => {
+            let path = format!("/v1/bans/{}", url_safe_key(&public_key));
+            request(admin, "DELETE", &path, None).await?;
+            println!("Lifted ban on {}", public_key);
+        }
+        PeerCommand::Bans => {
+            let body = request(admin, "GET", "/v1/bans", None).await?;
+            println!("{:<46} {:<26} REASON", "PUBLIC KEY", "BANNED");
+            for ban in body["bans"].as_array().into_iter().flatten() {
+                println!(
+                    "{:<46} {:<26} {}",
+                    ban["public_key"].as_str().unwrap_or("-"),
+                    ban["banned_at"].as_u64().map_or("-".to_string(), format_ago),
+                    ban["reason"].as_str().unwrap_or("-"),
+                );
+            }
+        }
+        PeerCommand::Sync { file } => {
+            let contents = if file.as_os_str() == "-" {
+                std::io::read_to_string(std::io::stdin())?
+            } else {
+                std::fs::read_to_string(&file)
+                    .with_context(|| format!("failed to read {}", file.display()))?
+            };
+            let desired: serde_json::Value = serde_json::from_str(&contents)
+                .with_context(|| format!("{} is not valid JSON", file.display()))?;
+            let body = request(admin, "PUT", "/v1/peers", Some(&desired)).await?;
+            let count = |field: &str| body[field].as_array().map_or(0, Vec::len);
+            println!(
+                "{} added, {} updated, {} removed, {} unchanged",
+                count("added"),
+                count("updated"),
+                count("removed"),
+                body["unchanged"].as_u64().unwrap_or(0)
+            );
+        }
+    }
+    Ok(())
+}
+
+/// Write a file only the current user can read, as it holds a private key
+fn write_private_file(path: &Path, contents: &str) -> Result<()> {
+    use std::io::Write;
+    use std::os::unix::fs::OpenOptionsExt;
+
+    let mut file = std::fs::OpenOptions::new()
+        .write(true)
+        .create(true)
+        .truncate(true)
+        .mode(0o600)
+        .open(path)
+        .with_context(|| format!("failed to create {}", path.display()))?;
+    file.write_all(contents.as_bytes())
+        .with_context(|| format!("failed to write {}", path.display()))
+}
+
+/// Render text as a QR code on the terminal via `qrencode`
+fn print_qr(text: &str) -> Result<()> {
+    use std::io::Write;
+    use std::process::{Command, Stdio};
+
+    let mut child = Command::new("qrencode")
+        .args(["-t", "ansiutf8"])
+        .stdin(Stdio::piped())
+        .spawn()
+        .context("failed to run qrencode; install it to print QR codes")?;
+    child
+        .stdin
+        .take()
+        .context("qrencode stdin unavailable")?
+        .write_all(text.as_bytes())?;
+    let status = child.wait()?;
+    if !status.success() {
+        anyhow::bail!("qrencode exited with {}", status);
+    }
+    Ok(())
+}
+
+/// Where admin API requests go: the socket, and the path a tenant's API is
+/// served under
+struct Admin {
+    socket: PathBuf,
+    prefix: String,
+}
+
+impl Admin {
+    fn new(socket: &str, tenant: Option<&str>) -> Self {
+        Self {
+            socket: PathBuf::from(socket),
+            prefix: tenant.map_or(String::new(), |tenant| {
+                format!("{}/{}", tenant::PATH_PREFIX, tenant)
+            }),
+        }
+    }
+}
+
+/// Send one admin API request and decode the JSON reply
+async fn request(admin: &Admin, method: &str, path: &str, body: Option<&Value>) -> Result<Value> {
+    let (status, body) = send(admin, method, path, body).await?;
+    let body: Value = serde_json::from_str(&body).unwrap_or(Value::Null);
+    if !(200..300).contains(&status) {
+        let message = body["error"].as_str().unwrap_or("request failed");
+        anyhow::bail!("server returned {}: {}", status, message);
+    }
+    Ok(body)
+}
+
+/// Send one HTTP/1.1 request over the unix socket, returning the status and body
+async fn send(
+    admin: &Admin,
+    method: &str,
+    path: &str,
+    body: Option<&Value>,
+) -> Result<(u16, String)> {
+    let mut stream = UnixStream::connect(&admin.socket)
+        .await
+        .with_context(|| format!("failed to connect to {}", admin.socket.display()))?;
+
+    let body = body.map(|b| b.to_string()).unwrap_or_default();
+    let request = format!(
+        "{} {} HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\
+         Content-Type: application/json\r\nContent-Length: {}\r\n\r\n{}",
+        method,
+        format!("{}{}", admin.prefix, path),
+        body.len(),
+        body
+    );
+    stream.write_all(request.as_bytes()).await?;
+
+    let mut response = Vec::new();
+    stream
+        .read_to_end(&mut response)
+        .await
+        .context("failed to read admin API response")?;
+    let response = String::from_utf8_lossy(&response);
+
+    let (head, body) = response
+        .split_once("\r\n\r\n")
+        .context("malformed admin API response")?;
+    let status: u16 = head
+        .split_whitespace()
+        .nth(1)
+        .and_then(|code| code.parse().ok())
+        .context("malformed admin API status line")?;
+    Ok((status, body.to_string()))
+}
+
+/// Admin API paths take URL-safe base64 keys
+fn url_safe_key(key: &str) -> String {
+    key.trim().replace('+', "-").replace('/', "_")
+}
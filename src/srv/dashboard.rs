@@ -0,0 +1,46 @@
+//! Admin web dashboard
+//!
+//! `GET /dashboard` on the admin listeners serves a single page for
+//! day-to-day work without scripting: the peers with their handshake state
+//! and live throughput, each peer's traffic over the last day, the flow
+//! table, and adding peers (with a client config to download), removing
+//! them and rotating the server key. The page is embedded in the binary
+//! and does everything through the admin API, so it needs nothing the API
+//! doesn't; with admin tokens configured it asks for one and keeps it for
+//! the browser tab only, and a read token shows everything but can't act.
+//! Under `/tenants/NAME/dashboard` it manages that tenant.
+
+use axum::http::header;
+use axum::response::IntoResponse;
+use axum::routing::get;
+use axum::Router;
+
+/// Path of the page, which needs no token to load
+pub const PATH: &str = "/dashboard";
+
+const PAGE: &str = include_str!("dashboard.html");
+
+/// Create the router serving the dashboard page
+pub fn create_router() -> Router {
+    Router::new().route(PATH, get(page_handler))
+}
+
+/// Handler for GET /dashboard
+async fn page_handler() -> impl IntoResponse {
+    (
+        [
+            (header::CONTENT_TYPE, "text/html; charset=utf-8"),
+            (header::CACHE_CONTROL, "no-store"),
+            // The page only talks to the API it came from, and can't be
+            // framed into clicking its buttons
+            (
+                header::CONTENT_SECURITY_POLICY,
+                "default-src 'none'; script-src 'unsafe-inline'; \
+                 style-src 'unsafe-inline'; img-src data:; connect-src 'self'; \
+                 frame-ancestors 'none'",
+            ),
+            (header::X_FRAME_OPTIONS, "DENY"),
+        ],
+        PAGE,
+    )
+}
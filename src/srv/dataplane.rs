@@ -4,57 +4,141 @@
 //! - Parses TCP/UDP from decrypted WireGuard packets
 //! - Creates real outbound tokio sockets to destinations
 //! - Tracks connection state and relays data back
+//! - Applies firewall rules, per-peer egress ACLs and access schedules to
+//!   new flows
+//! - Drops packets between peers, or routes them back out through the
+//!   WireGuard device when client isolation is off
+//!
+//! The dataplane runs as one or more workers, each owning its own flow
+//! tables and smoltcp interface. Every peer is handled by one worker, picked
+//! from its public key, so the WireGuard receive loops hand decrypted
+//! packets straight to that worker's queue and workers share no flow state.
 
 use std::collections::{HashMap, VecDeque};
-use std::net::{Ipv4Addr, SocketAddr, SocketAddrV4};
-use std::sync::Arc;
-use std::time::{Duration, Instant};
-
-use anyhow::Result;
+use std::future::Future;
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr, SocketAddr, SocketAddrV4};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Weak};
+use std::time::{Duration, Instant, SystemTime};
+
+use anyhow::{Context, Result};
+use parking_lot::Mutex;
 use smoltcp::iface::{Config as SmolConfig, Interface, SocketHandle, SocketSet};
 use smoltcp::phy::{Device, DeviceCapabilities, Medium, RxToken, TxToken};
 use smoltcp::socket::tcp;
 use smoltcp::time::Instant as SmolInstant;
 use smoltcp::wire::{
-    HardwareAddress, IpAddress, IpCidr, IpProtocol, Ipv4Address, Ipv4Cidr, Ipv4Packet, TcpPacket,
-    UdpPacket,
+    HardwareAddress, IpCidr, IpProtocol, Ipv4Address, Ipv4Cidr, Ipv4Packet, Ipv6Address, Ipv6Cidr,
+    Ipv6Packet, TcpPacket, UdpPacket,
 };
-use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::io::{AsyncReadExt, AsyncWriteExt, DuplexStream};
 use tokio::net::{TcpListener, TcpStream, UdpSocket as TokioUdpSocket};
-use tokio::sync::mpsc;
+use tokio::sync::{mpsc, oneshot};
 use tracing::{debug, error, info, trace, warn};
 
+use super::acl::{Decision, EgressAcls};
+use super::anomaly::AnomalyDetector;
 use super::api::PortForwardEvent;
-use super::flow::{FlowConfig, FlowKey, PortForwardRule, Protocol};
+use super::bandwidth::{BandwidthLimits, Direction};
+use super::bufpool::{self, Buffer, RelayBuffers};
+use super::destinations::{Destination, DestinationStats};
+use super::dns::{self, DnsService, TcpFramer, Transport, DNS_PORT};
+use super::domain_filter::DomainFilter;
+use super::egress::{Datagrams, Egress};
+use super::events::encode_key;
+use super::firewall::{Firewall, Verdict};
+use super::flow::{Eviction, FlowConfig, FlowKey, PortForwardRule, Protocol};
+use super::flow_limit::{FlowLimiter, FlowLimits, ProxyFlows};
+use super::flowlog::{FlowLog, FlowRecord, FlowTotals, FlowVerdict};
+use super::hairpin::{HairpinFlows, HairpinKey};
+use super::http_proxy::{self, HttpProxy};
+use super::icmp::{self, Echo, EchoSocket};
+use super::ipv6::Ipv6Prefix;
+use super::metrics::{Metrics, Task};
+use super::mss;
+use super::nat64;
+use super::nat_ports::PortMapping;
+use super::network::{Network, Networks};
+use super::ntp::{self, NTP_PORT};
+use super::otel::{FlowTrace, Tracer};
+use super::pcap::PacketCapture;
+use super::port_mapping::{PortMapper, NAT_PMP_PORT};
+use super::qos::{self, FlowClass, Qos};
+use super::schedule::AccessSchedules;
+use super::sni::{self, ClientHello};
+use super::socks::{SendToClient, SocksServer};
+use super::speedtest;
+use super::status_page::{StatusPage, STATUS_PORT};
+use super::usage::{unix_now, Counters, PendingUsage, UsageTracker};
 use super::wg::{WgIo, WgToDataplane};
 
 const DEFAULT_SMOLTCP_MTU: usize = 1420;
 const MIN_SMOLTCP_MTU: usize = 576;
 const SMOLTCP_SOCKET_BUFFER: usize = 256 * 1024;
-const WAN_READ_BUFFER: usize = 16 * 1024;
+const DNS_TCP_IDLE_TIMEOUT: Duration = Duration::from_secs(10);
+/// How long to wait for a ClientHello or HTTP request head when an egress
+/// ACL or the domain filter needs its server name
+const SNI_TIMEOUT: Duration = Duration::from_secs(5);
+/// Most bytes buffered while waiting for a server name
+const MAX_CLIENT_HELLO: usize = 16 * 1024;
+/// Most ICMP echo sessions a worker keeps open
+const MAX_ECHO_SESSIONS: usize = 1024;
+/// Smallest MTU an IPv6 link may have, which ICMPv6 errors must fit in
+const IPV6_MIN_MTU: usize = 1280;
 /// Message from WAN socket back to dataplane
 #[derive(Debug)]
 enum WanToDataplane {
     // Outbound NAT: data from internet to send to client
     TcpData {
         flow_key: FlowKey,
-        data: Vec<u8>,
+        data: Buffer,
     },
     TcpClosed {
         flow_key: FlowKey,
     },
+    // The outbound dial failed, so the client should see a reset
+    TcpReset {
+        flow_key: FlowKey,
+    },
     UdpData {
         flow_key: FlowKey,
-        data: Vec<u8>,
+        data: Buffer,
     },
     // Inbound port forward: data from internet client to send to VPN client
     InboundTcpData {
         flow_key: InboundFlowKey,
-        data: Vec<u8>,
+        data: Buffer,
     },
     InboundTcpClosed {
         flow_key: InboundFlowKey,
     },
+    // DNS service: answer from the upstream resolver for a VPN client
+    DnsResponse {
+        peer_pubkey: [u8; 32],
+        client_ip: IpAddr,
+        client_port: u16,
+        /// The server address the query was sent to
+        server_ip: IpAddr,
+        data: Vec<u8>,
+    },
+    // SOCKS5 service: datagram of a UDP association for a VPN client
+    SocksDatagram {
+        peer_pubkey: [u8; 32],
+        client: SocketAddrV4,
+        data: Vec<u8>,
+    },
+    // ICMP echo: reply from the internet to a VPN client's ping
+    EchoReply {
+        key: EchoKey,
+        seq: u16,
+        data: Vec<u8>,
+    },
+    // Port mapping: NAT-PMP response for a VPN client
+    PortMappingResponse {
+        peer_pubkey: [u8; 32],
+        client: SocketAddrV4,
+        data: Vec<u8>,
+    },
 }
 
 /// Message for inbound connections (port forwarding)
@@ -67,7 +151,7 @@ enum InboundEvent {
     },
     UdpPacket {
         rule: PortForwardRule,
-        data: Vec<u8>,
+        data: Buffer,
         remote_addr: SocketAddr,
     },
 }
@@ -84,33 +168,145 @@ struct InboundFlowKey {
 /// Inbound TCP flow (internet -> client)
 struct InboundTcpFlow {
     socket: SocketHandle,
-    wan_tx: mpsc::Sender<Vec<u8>>,
-    pending_to_client: VecDeque<Vec<u8>>,
+    wan_tx: mpsc::Sender<Buffer>,
+    pending_to_client: VecDeque<Buffer>,
     last_activity: Instant,
     wan_closed: bool,
+    totals: FlowTotals,
 }
 
 type SmolTcpFlow = InboundTcpFlow;
 
+/// An open flow, as listed by `GET /v1/flows`
+pub struct FlowEntry {
+    pub peer: Option<[u8; 32]>,
+    pub protocol: Protocol,
+    /// Opened from the internet through a port forward rather than by the
+    /// peer
+    pub inbound: bool,
+    /// Address on the peer's side
+    pub client: SocketAddr,
+    /// Address on the internet side
+    pub remote: SocketAddr,
+    /// Server port an inbound flow arrived on
+    pub public_port: Option<u16>,
+    /// TCP state of the tunnel side, or `open` for UDP
+    pub state: String,
+    /// Whether the internet side of a TCP flow has closed
+    pub remote_closed: bool,
+    pub idle: Duration,
+    /// Packets from the internet waiting to go to the peer
+    pub queued: usize,
+    pub totals: FlowTotals,
+}
+
+/// Asks the dataplane for a snapshot of its flow table
+pub type FlowTableRequest = oneshot::Sender<Vec<FlowEntry>>;
+
+/// A peer's pings with one identifier to one destination
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+struct EchoKey {
+    client_ip: IpAddr,
+    ident: u16,
+    remote_ip: IpAddr,
+}
+
+/// An ICMP echo session sent on from the host
+struct EchoSession {
+    peer_pubkey: [u8; 32],
+    /// Sequence numbers and data of requests to send
+    wan_tx: mpsc::Sender<(u16, Vec<u8>)>,
+    last_activity: Instant,
+}
+
 /// Active UDP flow state
 struct UdpFlow {
     peer_pubkey: [u8; 32],
-    client_ip: Ipv4Addr,
+    client_ip: IpAddr,
     client_port: u16,
-    remote_ip: Ipv4Addr,
+    remote_ip: IpAddr,
     remote_port: u16,
-    wan_tx: mpsc::Sender<Vec<u8>>,
+    wan_tx: mpsc::Sender<Buffer>,
     last_activity: Instant,
+    totals: FlowTotals,
+}
+
+/// What an outbound TCP flow's server name must pass, once its first bytes
+/// show it
+struct NameCheck {
+    peer: [u8; 32],
+    /// Set if the peer's egress ACL depends on the name
+    acls: Option<Arc<EgressAcls>>,
+    /// Set if the domain filter covers the flow's port
+    domains: Option<Arc<DomainFilter>>,
 }
 
-struct SmolDevice {
+impl NameCheck {
+    /// What refuses the flow, if anything does
+    fn denier(&self, remote: SocketAddr, server_name: Option<&str>) -> Option<&'static str> {
+        if let Some(acls) = &self.acls {
+            if !acls.check_sni(&self.peer, remote.ip(), remote.port(), server_name) {
+                return Some("egress ACL");
+            }
+        }
+        if let Some(domains) = &self.domains {
+            if !domains.allows(server_name) {
+                return Some("domain filter");
+            }
+        }
+        None
+    }
+}
+
+/// What the dataplane needs of a peer's IPv4 or IPv6 packet
+struct IpHeader<'a> {
+    src: IpAddr,
+    dst: IpAddr,
+    protocol: IpProtocol,
+    hop_limit: u8,
+    payload: &'a [u8],
+}
+
+impl<'a> IpHeader<'a> {
+    /// Parse a packet's IP header. IPv6 extension headers aren't followed,
+    /// so packets carrying them are ignored as unknown protocols.
+    fn parse(packet: &'a [u8]) -> Option<Self> {
+        match packet.first()? >> 4 {
+            4 => {
+                let ip = Ipv4Packet::new_checked(packet).ok()?;
+                Some(Self {
+                    src: IpAddr::V4(ip.src_addr().into()),
+                    dst: IpAddr::V4(ip.dst_addr().into()),
+                    protocol: ip.next_header(),
+                    hop_limit: ip.hop_limit(),
+                    payload: ip.payload(),
+                })
+            }
+            6 => {
+                let ip = Ipv6Packet::new_checked(packet).ok()?;
+                Some(Self {
+                    src: IpAddr::V6(ip.src_addr().into()),
+                    dst: IpAddr::V6(ip.dst_addr().into()),
+                    protocol: ip.next_header(),
+                    hop_limit: ip.hop_limit(),
+                    payload: ip.payload(),
+                })
+            }
+            _ => None,
+        }
+    }
+}
+
+/// A smoltcp device whose packets are fed in and collected by hand, for
+/// interfaces on the far side of a WireGuard tunnel
+pub struct SmolDevice {
     rx: VecDeque<Vec<u8>>,
     tx: VecDeque<Vec<u8>>,
     mtu: usize,
 }
 
 impl SmolDevice {
-    fn new(mtu: usize) -> Self {
+    pub fn new(mtu: usize) -> Self {
         Self {
             rx: VecDeque::new(),
             tx: VecDeque::new(),
@@ -118,16 +314,16 @@ impl SmolDevice {
         }
     }
 
-    fn push_rx(&mut self, packet: Vec<u8>) {
+    pub fn push_rx(&mut self, packet: Vec<u8>) {
         self.rx.push_back(packet);
     }
 
-    fn drain_tx(&mut self) -> Vec<Vec<u8>> {
+    pub fn drain_tx(&mut self) -> Vec<Vec<u8>> {
         self.tx.drain(..).collect()
     }
 }
 
-struct SmolRxToken {
+pub struct SmolRxToken {
     buffer: Vec<u8>,
 }
 
@@ -140,7 +336,7 @@ impl RxToken for SmolRxToken {
     }
 }
 
-struct SmolTxToken<'a> {
+pub struct SmolTxToken<'a> {
     tx: &'a mut VecDeque<Vec<u8>>,
 }
 
@@ -210,19 +406,97 @@ fn smoltcp_mtu_from_env() -> usize {
     }
 }
 
+/// Policy deciding which flows peers may open and keep, and where they
+/// leave the server from
+#[derive(Clone)]
+pub struct FlowPolicy {
+    pub firewall: Arc<Firewall>,
+    pub acls: Arc<EgressAcls>,
+    pub schedules: Arc<AccessSchedules>,
+    pub bandwidth: Arc<BandwidthLimits>,
+    pub qos: Arc<Qos>,
+    /// Drop packets addressed to other peers instead of relaying them
+    pub client_isolation: bool,
+    /// Copy peers' multicast and broadcast packets to the other peers in
+    /// their network
+    pub peer_multicast: bool,
+    pub flow_limits: FlowLimits,
+    pub egress: Arc<Egress>,
+    /// Explicit HTTP proxy served on the server IP, if enabled
+    pub http_proxy: Option<Arc<HttpProxy>>,
+    /// SOCKS5 service on the server IP, if enabled
+    pub socks: Option<Arc<SocksServer>>,
+    /// Server-wide domain blocklist or allowlist, if configured
+    pub domains: Option<Arc<DomainFilter>>,
+    /// NAT-PMP responder on the server IP, if peers may map ports
+    pub port_mapping: Option<Arc<PortMapper>>,
+    /// Send peers' pings to hosts other than the server on from the host
+    pub icmp_echo_forwarding: bool,
+    /// Prefix peers' IPv6 addresses are made in, if they have them
+    pub ipv6_prefix: Option<Ipv6Prefix>,
+    /// Drop peers' IPv4 packets and translate their flows to
+    /// `64:ff9b::/96` to IPv4
+    pub ipv6_only: bool,
+    /// Answer NTP requests on the server's addresses from the host clock
+    pub ntp: bool,
+    /// Port bandwidth tests are answered on at the server's addresses, if
+    /// enabled
+    pub speedtest_port: Option<u16>,
+    /// Page describing each peer to itself on the server's addresses, if
+    /// enabled
+    pub status_page: Option<Arc<StatusPage>>,
+}
+
+/// Where the dataplane reports the traffic it forwards
+#[derive(Clone)]
+pub struct TrafficStats {
+    pub usage: Arc<UsageTracker>,
+    pub destinations: Arc<DestinationStats>,
+    pub metrics: Arc<Metrics>,
+    /// Traces forwarded flows when OTLP export is on
+    pub tracer: Option<Arc<Tracer>>,
+    /// Records finished and refused flows when flow logging is on
+    pub flow_log: Option<Arc<FlowLog>>,
+    /// Copies decrypted packets to running captures
+    pub capture: Arc<PacketCapture>,
+    /// Watches peers' flows and DNS queries when anomaly detection is on
+    pub anomalies: Option<Arc<AnomalyDetector>>,
+}
+
 /// The NAT dataplane
 pub struct Dataplane {
     wg_io: Arc<WgIo>,
+    /// The server's address in the main network, where its services are
+    server_ip: Ipv4Addr,
+    networks: Networks,
+    /// The server's address in the IPv6 prefix, if peers have IPv6
+    server_ip6: Option<Ipv6Addr>,
+    dns: Arc<DnsService>,
+    policy: FlowPolicy,
+    stats: TrafficStats,
+    /// Traffic counted since the last cleanup tick
+    pending_usage: PendingUsage,
+    pending_destinations: HashMap<([u8; 32], Destination), Counters>,
     tcp_flows: HashMap<FlowKey, SmolTcpFlow>,
     tcp_listen_sockets: HashMap<u16, Vec<SocketHandle>>,
     smol_iface: Interface,
     smol_sockets: SocketSet<'static>,
     smol_device: SmolDevice,
     smol_start: Instant,
-    peer_by_ip: HashMap<Ipv4Addr, [u8; 32]>,
+    peer_by_ip: HashMap<IpAddr, [u8; 32]>,
     udp_flows: HashMap<FlowKey, UdpFlow>,
+    /// Source ports shared by each client endpoint's UDP flows under
+    /// endpoint-independent mapping, held by the flows' sockets
+    udp_mappings: HashMap<(IpAddr, u16), Weak<PortMapping>>,
+    echo_sessions: HashMap<EchoKey, EchoSession>,
     inbound_tcp_flows: HashMap<InboundFlowKey, InboundTcpFlow>,
     config: FlowConfig,
+    /// MSS that SYNs to and from peers are lowered to
+    mss_clamp: Option<u16>,
+    /// Shared with the proxies, which count the connections they open
+    flow_limiter: Arc<Mutex<FlowLimiter>>,
+    /// Flows between peers the policy let through
+    hairpin_flows: HairpinFlows,
     wan_rx: mpsc::Receiver<WanToDataplane>,
     wan_tx_template: mpsc::Sender<WanToDataplane>,
     inbound_rx: mpsc::Receiver<InboundEvent>,
@@ -230,34 +504,97 @@ pub struct Dataplane {
     // Track active listeners so we can stop them
     tcp_listeners: HashMap<u16, tokio::task::JoinHandle<()>>,
     udp_listeners: HashMap<u16, tokio::task::JoinHandle<()>>,
+    /// Table sizes this worker last added to the flow gauges, which sum
+    /// over workers
+    reported: TableSizes,
+    /// Unix time this worker last ran its housekeeping
+    heartbeat: Arc<AtomicU64>,
+    buffers: RelayBuffers,
+}
+
+/// Sizes of a worker's flow tables
+#[derive(Default)]
+struct TableSizes {
+    tcp: u64,
+    udp: u64,
+    inbound_tcp: u64,
+    smoltcp_sockets: u64,
 }
 
 impl Dataplane {
-    pub fn new(wg_io: Arc<WgIo>, server_ip: Ipv4Addr) -> Self {
+    pub fn new(
+        wg_io: Arc<WgIo>,
+        networks: Networks,
+        dns: Arc<DnsService>,
+        policy: FlowPolicy,
+        config: FlowConfig,
+        stats: TrafficStats,
+        buffers: RelayBuffers,
+    ) -> Self {
         let (wan_tx, wan_rx) = mpsc::channel(10000);
         let (inbound_tx, inbound_rx) = mpsc::channel(1000);
+        stats.metrics.watch_queue("wan_to_dataplane", &wan_tx);
+        stats.metrics.watch_queue("inbound_connections", &inbound_tx);
         let smoltcp_mtu = smoltcp_mtu_from_env();
         info!(mtu = smoltcp_mtu, "Configuring smoltcp interface MTU");
+        let mss_clamp = match config.tcp_mss_clamp {
+            Some(0) => None,
+            Some(mss) => Some(mss),
+            None => Some((smoltcp_mtu - mss::HEADERS) as u16),
+        };
         let mut smol_device = SmolDevice::new(smoltcp_mtu);
         let mut smol_config = SmolConfig::new(HardwareAddress::Ip);
         smol_config.random_seed = rand::random();
         let smol_start = Instant::now();
         let mut smol_iface =
             Interface::new(smol_config, &mut smol_device, SmolInstant::from_millis(0));
+        let server_ip = networks.main().server_ip;
         let smol_server_ip = Ipv4Address::from_bytes(&server_ip.octets());
+        let server_ip6 = policy
+            .ipv6_prefix
+            .map(|prefix| prefix.address_for(server_ip));
         smol_iface.update_ip_addrs(|addrs| {
-            addrs
-                .push(IpCidr::Ipv4(Ipv4Cidr::new(smol_server_ip, 32)))
-                .expect("smoltcp interface address table full");
+            for network in networks.iter() {
+                let ip = Ipv4Address::from_bytes(&network.server_ip.octets());
+                addrs
+                    .push(IpCidr::Ipv4(Ipv4Cidr::new(ip, 32)))
+                    .expect("smoltcp interface address table full");
+            }
+            if let Some(ip) = server_ip6 {
+                addrs
+                    .push(IpCidr::Ipv6(Ipv6Cidr::new(Ipv6Address::from(ip), 128)))
+                    .expect("smoltcp interface address table full");
+            }
         });
         smol_iface
             .routes_mut()
             .add_default_ipv4_route(smol_server_ip)
             .expect("smoltcp route table full");
+        if let Some(ip) = server_ip6 {
+            smol_iface
+                .routes_mut()
+                .add_default_ipv6_route(Ipv6Address::from(ip))
+                .expect("smoltcp route table full");
+        }
         smol_iface.set_any_ip(true);
+        let flow_limiter = Arc::new(Mutex::new(FlowLimiter::new(policy.flow_limits)));
+        let hairpin_flows = HairpinFlows::new(
+            Arc::clone(&policy.firewall),
+            Arc::clone(&policy.acls),
+            Arc::clone(&policy.schedules),
+            ProxyFlows::new(Arc::clone(&flow_limiter), Arc::clone(&stats.metrics)),
+        );
 
         Self {
             wg_io,
+            server_ip,
+            networks,
+            server_ip6,
+            dns,
+            policy,
+            stats,
+            pending_usage: PendingUsage::default(),
+            pending_destinations: HashMap::new(),
             tcp_flows: HashMap::new(),
             tcp_listen_sockets: HashMap::new(),
             smol_iface,
@@ -266,14 +603,22 @@ impl Dataplane {
             smol_start,
             peer_by_ip: HashMap::new(),
             udp_flows: HashMap::new(),
+            udp_mappings: HashMap::new(),
+            echo_sessions: HashMap::new(),
             inbound_tcp_flows: HashMap::new(),
-            config: FlowConfig::default(),
+            config,
+            mss_clamp,
+            flow_limiter,
+            hairpin_flows,
             wan_rx,
             wan_tx_template: wan_tx,
             inbound_rx,
             inbound_tx,
             tcp_listeners: HashMap::new(),
             udp_listeners: HashMap::new(),
+            reported: TableSizes::default(),
+            heartbeat: Arc::new(AtomicU64::new(0)),
+            buffers,
         }
     }
 
@@ -282,10 +627,11 @@ impl Dataplane {
         mut self,
         mut from_wg: mpsc::Receiver<WgToDataplane>,
         mut port_forward_rx: mpsc::Receiver<PortForwardEvent>,
+        mut flow_table_rx: mpsc::Receiver<FlowTableRequest>,
     ) -> Result<()> {
         info!("Dataplane starting");
 
-        let mut cleanup_interval = tokio::time::interval(Duration::from_secs(10));
+        let mut cleanup_interval = tokio::time::interval(self.config.reap_interval());
         let mut tcp_timer = tokio::time::interval(Duration::from_millis(50));
 
         loop {
@@ -310,6 +656,11 @@ impl Dataplane {
                     self.handle_port_forward_event(event).await;
                 }
 
+                // Flow table snapshots for the admin API
+                Some(reply) = flow_table_rx.recv() => {
+                    let _ = reply.send(self.flow_table());
+                }
+
                 // Periodic cleanup
                 _ = cleanup_interval.tick() => {
                     self.cleanup_expired_flows();
@@ -339,18 +690,22 @@ impl Dataplane {
         let port = rule.public_port;
         let protocol = rule.protocol;
         let inbound_tx = self.inbound_tx.clone();
+        let running = self.stats.metrics.running(Task::PortForwardListener);
 
         match protocol {
             Protocol::Tcp => {
                 let handle = tokio::spawn(async move {
+                    let _running = running;
                     Self::run_tcp_listener(port, rule, inbound_tx).await;
                 });
                 self.tcp_listeners.insert(port, handle);
                 info!("Started TCP listener on port {}", port);
             }
             Protocol::Udp => {
+                let buffers = self.buffers.clone();
                 let handle = tokio::spawn(async move {
-                    Self::run_udp_listener(port, rule, inbound_tx).await;
+                    let _running = running;
+                    Self::run_udp_listener(port, rule, inbound_tx, buffers).await;
                 });
                 self.udp_listeners.insert(port, handle);
                 info!("Started UDP listener on port {}", port);
@@ -424,6 +779,7 @@ impl Dataplane {
         port: u16,
         rule: PortForwardRule,
         inbound_tx: mpsc::Sender<InboundEvent>,
+        buffers: RelayBuffers,
     ) {
         let addr = format!("0.0.0.0:{}", port);
         let socket = match TokioUdpSocket::bind(&addr).await {
@@ -436,9 +792,9 @@ impl Dataplane {
 
         info!("UDP port forward listening on {}", addr);
 
-        let mut buf = vec![0u8; 65535];
+        let mut buf = buffers.datagram.get();
         loop {
-            match socket.recv_from(&mut buf).await {
+            match socket.recv_from(buf.space()).await {
                 Ok((n, remote_addr)) => {
                     trace!(
                         "Inbound UDP packet from {} on port {} ({} bytes)",
@@ -449,7 +805,7 @@ impl Dataplane {
                     if inbound_tx
                         .send(InboundEvent::UdpPacket {
                             rule: rule.clone(),
-                            data: buf[..n].to_vec(),
+                            data: buffers.stream.copy_from(&buf.space()[..n]),
                             remote_addr,
                         })
                         .await
@@ -507,9 +863,10 @@ impl Dataplane {
             remote_port,
             public_port: rule.public_port,
         };
-        self.peer_by_ip.insert(rule.peer_ip, rule.peer_pubkey);
+        self.peer_by_ip
+            .insert(IpAddr::V4(rule.peer_ip), rule.peer_pubkey);
 
-        let (wan_tx, mut wan_rx) = mpsc::channel::<Vec<u8>>(100);
+        let (wan_tx, mut wan_rx) = mpsc::channel::<Buffer>(100);
 
         let rx_buffer = tcp::SocketBuffer::new(vec![0; SMOLTCP_SOCKET_BUFFER]);
         let tx_buffer = tcp::SocketBuffer::new(vec![0; SMOLTCP_SOCKET_BUFFER]);
@@ -532,8 +889,10 @@ impl Dataplane {
             pending_to_client: VecDeque::new(),
             last_activity: Instant::now(),
             wan_closed: false,
+            totals: FlowTotals::new(),
         };
 
+        self.pending_usage.add_flow(&rule.peer_pubkey);
         self.inbound_tcp_flows.insert(flow_key, flow);
         self.poll_smol_tcp().await;
 
@@ -543,13 +902,14 @@ impl Dataplane {
         // Channel for VPN client -> internet client data
         let wan_tx_back = self.wan_tx_template.clone();
         let flow_key_for_reader = flow_key;
+        let buffers = self.buffers.clone();
 
         // Reader task: forward data from internet client to dataplane
         // (dataplane will then send to VPN client as TCP packets)
         tokio::spawn(async move {
-            let mut buf = vec![0u8; WAN_READ_BUFFER];
             loop {
-                match read_half.read(&mut buf).await {
+                let mut buf = buffers.stream.get();
+                match read_half.read(buf.space()).await {
                     Ok(0) => {
                         // Connection closed
                         let _ = wan_tx_back
@@ -561,10 +921,11 @@ impl Dataplane {
                     }
                     Ok(n) => {
                         // Forward data to dataplane
+                        buf.filled(n);
                         if wan_tx_back
                             .send(WanToDataplane::InboundTcpData {
                                 flow_key: flow_key_for_reader,
-                                data: buf[..n].to_vec(),
+                                data: buf,
                             })
                             .await
                             .is_err()
@@ -586,11 +947,18 @@ impl Dataplane {
         });
 
         // Writer task: forward data from VPN client to internet client
+        let running = self.stats.metrics.running(Task::InboundRelay);
         tokio::spawn(async move {
-            while let Some(data) = wan_rx.recv().await {
-                if let Err(e) = write_half.write_all(&data).await {
-                    debug!("Inbound TCP write error: {}", e);
-                    break;
+            let _running = running;
+            let mut batch = Vec::new();
+            loop {
+                match bufpool::write_queued(&mut wan_rx, &mut write_half, &mut batch).await {
+                    Ok(Some(_)) => {}
+                    Ok(None) => break,
+                    Err(e) => {
+                        debug!("Inbound TCP write error: {}", e);
+                        break;
+                    }
                 }
             }
         });
@@ -605,7 +973,7 @@ impl Dataplane {
     async fn handle_inbound_udp(
         &mut self,
         rule: PortForwardRule,
-        data: Vec<u8>,
+        data: Buffer,
         remote_addr: SocketAddr,
     ) {
         let remote_ip = match remote_addr {
@@ -615,8 +983,8 @@ impl Dataplane {
 
         // Forward UDP packet to VPN client
         let packet = build_udp_packet(
-            remote_ip,
-            rule.peer_ip,
+            IpAddr::V4(remote_ip),
+            IpAddr::V4(rule.peer_ip),
             remote_addr.port(),
             rule.target_port,
             &data,
@@ -641,34 +1009,250 @@ impl Dataplane {
             return;
         }
 
-        let Ok(ipv4) = Ipv4Packet::new_checked(packet) else {
+        let Some(ip) = IpHeader::parse(packet) else {
             return;
         };
-
-        let src_ip = Ipv4Addr::from(ipv4.src_addr());
-        let dst_ip = Ipv4Addr::from(ipv4.dst_addr());
+        if !self
+            .policy
+            .bandwidth
+            .allow(&msg.peer_pubkey, Direction::Up, packet.len())
+        {
+            return;
+        }
+        self.pending_usage
+            .add_bytes(&msg.peer_pubkey, Direction::Up, packet.len());
+        self.stats.capture.packet(&msg.peer_pubkey, packet);
+
+        let src_ip = ip.src;
+        let dst_ip = ip.dst;
+        // Peers' allowed IPs take in all of IPv6, so only their assigned
+        // address is let through
+        if src_ip.is_ipv6() && self.assigned_peer(src_ip) != Some(msg.peer_pubkey) {
+            trace!("Dropping IPv6 packet from unassigned source {}", src_ip);
+            return;
+        }
+        // IPv6-only peers reach IPv4 through NAT64 alone
+        if src_ip.is_ipv4() && self.policy.ipv6_only {
+            trace!("Dropping IPv4 packet from IPv6-only peer {}", src_ip);
+            return;
+        }
         self.peer_by_ip.insert(src_ip, msg.peer_pubkey);
 
-        match ipv4.next_header() {
-            IpProtocol::Tcp => {
-                self.handle_tcp_packet(&msg.peer_pubkey, src_ip, dst_ip, packet, ipv4.payload())
+        // Peers on a network share it like a link, so group packets are
+        // copied to them before any TTL check
+        if self.policy.peer_multicast && self.is_group_address(src_ip, dst_ip) {
+            self.replicate(&msg.peer_pubkey, src_ip, dst_ip, packet)
+                .await;
+            return;
+        }
+
+        // The server is the hop where a TTL of 1 runs out, which traceroute
+        // relies on to list it. ICMP errors and multicast are not answered
+        // with more.
+        if !self.is_server(dst_ip) && ip.hop_limit <= 1 {
+            trace!("TTL expired routing {} -> {}", src_ip, dst_ip);
+            let is_error = match ip.protocol {
+                IpProtocol::Icmp => Echo::parse(ip.payload, icmp::ECHO_REQUEST).is_none(),
+                IpProtocol::Icmpv6 => Echo::parse(ip.payload, icmp::ECHO_REQUEST_V6).is_none(),
+                _ => false,
+            };
+            if !is_error && !dst_ip.is_multicast() {
+                if let Some(server_ip) = self.server_address(src_ip) {
+                    let exceeded = build_time_exceeded(server_ip, src_ip, packet);
+                    self.send_to_client(&msg.peer_pubkey, &exceeded).await;
+                }
+            }
+            return;
+        }
+
+        if !self.is_server(dst_ip) {
+            if let Some(dst_peer) = self.assigned_peer(dst_ip) {
+                if self.policy.client_isolation {
+                    trace!("Client isolation drops {} -> {}", src_ip, dst_ip);
+                } else {
+                    self.hairpin(&msg.peer_pubkey, &dst_peer, &ip, packet).await;
+                }
+                return;
+            }
+        }
+
+        match (ip.protocol, src_ip) {
+            (IpProtocol::Tcp, _) => {
+                self.handle_tcp_packet(&msg.peer_pubkey, src_ip, dst_ip, packet, ip.payload)
                     .await;
             }
-            IpProtocol::Udp => {
-                self.handle_udp_packet(&msg.peer_pubkey, src_ip, dst_ip, ipv4.payload())
+            (IpProtocol::Udp, _) => {
+                self.handle_udp_packet(&msg.peer_pubkey, src_ip, dst_ip, packet, ip.payload)
                     .await;
             }
-            proto => {
+            (IpProtocol::Icmp, IpAddr::V4(_)) | (IpProtocol::Icmpv6, IpAddr::V6(_)) => {
+                self.handle_icmp_packet(&msg.peer_pubkey, src_ip, dst_ip, ip.payload)
+                    .await;
+            }
+            (proto, _) => {
                 trace!("Ignoring protocol {:?}", proto);
             }
         }
     }
 
+    /// The peer assigned `ip`: its IPv4 address, or the address made from
+    /// that in the IPv6 prefix
+    fn assigned_peer(&self, ip: IpAddr) -> Option<[u8; 32]> {
+        let ip = match ip {
+            IpAddr::V4(ip) => ip,
+            IpAddr::V6(ip) => self.policy.ipv6_prefix?.ipv4_for(ip)?,
+        };
+        self.wg_io.peer_for_ip(&ip)
+    }
+
+    /// The server's own address for peer address `ip`: the one in its
+    /// network, or in `ip`'s family for IPv6, if it has one
+    fn server_address(&self, ip: IpAddr) -> Option<IpAddr> {
+        match ip {
+            IpAddr::V4(ip) => Some(IpAddr::V4(self.networks.gateway_for(ip))),
+            IpAddr::V6(_) => self.server_ip6.map(IpAddr::V6),
+        }
+    }
+
+    fn is_server(&self, ip: IpAddr) -> bool {
+        match ip {
+            IpAddr::V4(ip) => self.networks.is_server(ip),
+            IpAddr::V6(ip) => self.server_ip6 == Some(ip),
+        }
+    }
+
+    /// Where a flow to `ip` goes on the internet: with NAT64, the IPv4
+    /// address in `64:ff9b::/96` addresses, and otherwise `ip`
+    fn egress_ip(&self, ip: IpAddr) -> IpAddr {
+        if self.policy.ipv6_only {
+            nat64::translate(ip)
+        } else {
+            ip
+        }
+    }
+
+    /// The client network peer address `ip` is in
+    fn network_of(&self, ip: IpAddr) -> Option<&Network> {
+        let ip = match ip {
+            IpAddr::V4(ip) => ip,
+            IpAddr::V6(ip) => self.policy.ipv6_prefix?.ipv4_for(ip)?,
+        };
+        self.networks.containing(ip)
+    }
+
+    /// Whether `dst_ip` is for a group of hosts rather than one: multicast,
+    /// the limited broadcast, or the broadcast address of the sender's
+    /// network unless a peer was given it
+    fn is_group_address(&self, src_ip: IpAddr, dst_ip: IpAddr) -> bool {
+        match dst_ip {
+            IpAddr::V4(ip) => {
+                ip.is_multicast()
+                    || ip.is_broadcast()
+                    || (self
+                        .network_of(src_ip)
+                        .is_some_and(|network| network.broadcast() == ip)
+                        && self.wg_io.peer_for_ip(&ip).is_none())
+            }
+            IpAddr::V6(ip) => ip.is_multicast(),
+        }
+    }
+
+    /// Copy a multicast or broadcast packet to every other peer in the
+    /// sender's network, as a switch floods a segment. As with routed
+    /// packets the source must be the sender's own address; the TTL is
+    /// left alone, since the peers share the network.
+    async fn replicate(&self, src_peer: &[u8; 32], src_ip: IpAddr, dst_ip: IpAddr, packet: &[u8]) {
+        if self.policy.client_isolation {
+            trace!("Client isolation drops {} -> {}", src_ip, dst_ip);
+            return;
+        }
+        if self.assigned_peer(src_ip).as_ref() != Some(src_peer) {
+            debug!("Dropping group packet from unassigned source {}", src_ip);
+            return;
+        }
+        let Some(network) = self.network_of(src_ip) else {
+            return;
+        };
+        let members = self.wg_io.peers_in(network);
+        trace!(
+            "Copying {} -> {} ({} bytes) to {} peers",
+            src_ip,
+            dst_ip,
+            packet.len(),
+            members.len().saturating_sub(1)
+        );
+        for peer in members.iter().filter(|peer| *peer != src_peer) {
+            self.send_to_client(peer, packet).await;
+        }
+    }
+
+    /// Route a packet from one peer to another. As with WireGuard's
+    /// allowed IPs, the source must be the sender's own address, and as a
+    /// router the server decrements the TTL, which the caller has checked
+    /// is above 1. New flows between peers get the policy flows through
+    /// the NAT do.
+    async fn hairpin(
+        &mut self,
+        src_peer: &[u8; 32],
+        dst_peer: &[u8; 32],
+        ip: &IpHeader<'_>,
+        packet: &[u8],
+    ) {
+        let (src_ip, dst_ip) = (ip.src, ip.dst);
+        if self.assigned_peer(src_ip).as_ref() != Some(src_peer) {
+            debug!("Dropping peer-to-peer packet from unassigned source {}", src_ip);
+            return;
+        }
+        let Some(key) = HairpinKey::of(ip.protocol, src_ip, dst_ip, ip.payload) else {
+            return;
+        };
+        let verdict = self.hairpin_flows.admit(src_peer, key);
+        if verdict != Verdict::Accept {
+            if let Some(flow_key) = key.flow_key() {
+                let logged = match verdict {
+                    Verdict::Reject => FlowVerdict::Reject,
+                    _ => FlowVerdict::Drop,
+                };
+                self.log_refused_flow(src_peer, &flow_key, logged);
+            }
+            if verdict == Verdict::Reject {
+                let refusal = match ip.protocol {
+                    IpProtocol::Tcp => TcpPacket::new_checked(ip.payload).ok().map(|tcp| {
+                        let ack = (tcp.seq_number().0 as u32).wrapping_add(1);
+                        build_tcp_reset(dst_ip, src_ip, tcp.dst_port(), tcp.src_port(), ack)
+                    }),
+                    IpProtocol::Udp => Some(build_port_unreachable(dst_ip, src_ip, packet)),
+                    _ => None,
+                };
+                if let Some(refusal) = refusal {
+                    self.send_to_client(src_peer, &refusal).await;
+                }
+            }
+            return;
+        }
+        let mut routed = packet.to_vec();
+        match src_ip {
+            IpAddr::V4(_) => {
+                routed[8] -= 1;
+                let header_len = usize::from(routed[0] & 0x0f) * 4;
+                let checksum = ip_checksum(&routed[..header_len]);
+                routed[10..12].copy_from_slice(&checksum.to_be_bytes());
+            }
+            // The IPv6 header has no checksum
+            IpAddr::V6(_) => routed[7] -= 1,
+        }
+        if let Some(mss) = self.mss_clamp {
+            mss::clamp(&mut routed, mss);
+        }
+        trace!("Routing {} -> {} ({} bytes)", src_ip, dst_ip, routed.len());
+        self.send_to_client(dst_peer, &routed).await;
+    }
+
     async fn handle_tcp_packet(
         &mut self,
         peer_pubkey: &[u8; 32],
-        src_ip: Ipv4Addr,
-        dst_ip: Ipv4Addr,
+        src_ip: IpAddr,
+        dst_ip: IpAddr,
         ip_packet: &[u8],
         tcp_data: &[u8],
     ) {
@@ -690,6 +1274,35 @@ impl Dataplane {
             tcp.rst()
         );
 
+        // Firewall rules are applied to the SYN opening a flow
+        let flow_key = FlowKey {
+            protocol: Protocol::Tcp,
+            client_ip: src_ip,
+            client_port: src_port,
+            remote_ip: dst_ip,
+            remote_port: dst_port,
+        };
+        let opens_flow = tcp.syn()
+            && !tcp.ack()
+            && !self.is_local_service(dst_ip, dst_port)
+            && !self.tcp_flows.contains_key(&flow_key);
+        if opens_flow {
+            match self.check_new_flow(peer_pubkey, Protocol::Tcp, dst_ip, dst_port) {
+                Verdict::Accept => {}
+                Verdict::Drop => {
+                    self.log_refused_flow(peer_pubkey, &flow_key, FlowVerdict::Drop);
+                    return;
+                }
+                Verdict::Reject => {
+                    self.log_refused_flow(peer_pubkey, &flow_key, FlowVerdict::Reject);
+                    let ack = (tcp.seq_number().0 as u32).wrapping_add(1);
+                    let reset = build_tcp_reset(dst_ip, src_ip, dst_port, src_port, ack);
+                    self.send_to_client(peer_pubkey, &reset).await;
+                    return;
+                }
+            }
+        }
+
         self.handle_outbound_tcp_packet(
             *peer_pubkey,
             src_ip,
@@ -702,18 +1315,108 @@ impl Dataplane {
         .await;
     }
 
-    fn is_inbound_smol_packet(&self, dst_ip: Ipv4Addr, dst_port: u16) -> bool {
+    /// Apply the peer's access schedule, the firewall, egress routes and the
+    /// peer's flow limits to a new flow; flows outside the schedule or over
+    /// the limits, or opened while the server is draining, are rejected, and
+    /// flows with no way out, such as to destinations routed to `drop`, are
+    /// dropped
+    fn check_new_flow(
+        &mut self,
+        peer_pubkey: &[u8; 32],
+        protocol: Protocol,
+        dst_ip: IpAddr,
+        dst_port: u16,
+    ) -> Verdict {
+        let dst_ip = self.egress_ip(dst_ip);
+        if self.wg_io.is_draining() {
+            debug!(
+                "Refusing {:?} flow to {}:{} while draining",
+                protocol, dst_ip, dst_port
+            );
+            return Verdict::Reject;
+        }
+        if !self.policy.schedules.allows(peer_pubkey) {
+            debug!(
+                "Access schedule `{}` refuses {:?} flow to {}:{}",
+                self.policy
+                    .schedules
+                    .name_for(peer_pubkey)
+                    .as_deref()
+                    .unwrap_or("?"),
+                protocol,
+                dst_ip,
+                dst_port
+            );
+            return Verdict::Reject;
+        }
+        let verdict = self
+            .policy
+            .firewall
+            .check(peer_pubkey, protocol, dst_ip, dst_port);
+        if verdict != Verdict::Accept {
+            return verdict;
+        }
+        if !self.policy.egress.admits(protocol, dst_ip) {
+            debug!(
+                "Egress route drops {:?} flow to {}:{}",
+                protocol, dst_ip, dst_port
+            );
+            return Verdict::Drop;
+        }
+        if let Err(reason) = self.flow_limiter.lock().admit(peer_pubkey) {
+            debug!(
+                "Peer {} is over its flow limit ({}), refusing {:?} flow to {}:{}",
+                encode_key(peer_pubkey),
+                reason.label(),
+                protocol,
+                dst_ip,
+                dst_port
+            );
+            self.stats.metrics.record_flow_limit(reason);
+            return Verdict::Reject;
+        }
+        Verdict::Accept
+    }
+
+    /// Whether TCP to `dst_ip:dst_port` is for a service the server answers
+    /// itself on its tunnel IP, which checks its own requests, rather than
+    /// a flow to NAT. DNS, speed tests and the status page are served on
+    /// every server address, the proxies only on the main network's.
+    fn is_local_service(&self, dst_ip: IpAddr, dst_port: u16) -> bool {
+        let everywhere = dst_port == DNS_PORT
+            || self.policy.speedtest_port == Some(dst_port)
+            || (self.policy.status_page.is_some() && dst_port == STATUS_PORT);
+        match dst_ip {
+            IpAddr::V4(ip) => {
+                (self.networks.is_server(ip) && everywhere)
+                    || (ip == self.server_ip
+                        && (self.http_proxy_port() == Some(dst_port)
+                            || self.socks_port() == Some(dst_port)))
+            }
+            IpAddr::V6(ip) => Some(ip) == self.server_ip6 && everywhere,
+        }
+    }
+
+    fn http_proxy_port(&self) -> Option<u16> {
+        self.policy.http_proxy.as_ref().map(|proxy| proxy.port())
+    }
+
+    fn socks_port(&self) -> Option<u16> {
+        self.policy.socks.as_ref().map(|socks| socks.port())
+    }
+
+    fn is_inbound_smol_packet(&self, dst_ip: IpAddr, dst_port: u16) -> bool {
         self.inbound_tcp_flows
             .keys()
-            .any(|key| key.remote_ip == dst_ip && key.remote_port == dst_port)
+            .any(|key| IpAddr::V4(key.remote_ip) == dst_ip && key.remote_port == dst_port)
     }
 
     async fn handle_outbound_tcp_packet(
         &mut self,
         peer_pubkey: [u8; 32],
-        src_ip: Ipv4Addr,
+        src_ip: IpAddr,
         src_port: u16,
-        dst_ip: Ipv4Addr,
+        dst_ip: IpAddr,
         dst_port: u16,
         ensure_listener: bool,
         ip_packet: &[u8],
@@ -736,7 +1439,11 @@ impl Dataplane {
         if ensure_listener {
             self.ensure_smol_listener(dst_port);
         }
-        self.smol_device.push_rx(ip_packet.to_vec());
+        let mut packet = ip_packet.to_vec();
+        if let Some(mss) = self.mss_clamp {
+            mss::clamp(&mut packet, mss);
+        }
+        self.smol_device.push_rx(packet);
         self.poll_smol_tcp().await;
     }
 
@@ -813,23 +1520,12 @@ impl Dataplane {
                         continue;
                     };
 
-                    let IpAddress::Ipv4(client_addr) = remote.addr else {
-                        socket.abort();
-                        remaining.push(handle);
-                        continue;
-                    };
-                    let IpAddress::Ipv4(dest_addr) = local.addr else {
-                        socket.abort();
-                        remaining.push(handle);
-                        continue;
-                    };
-
                     accepted.push((
                         port,
                         handle,
-                        Ipv4Addr::from(client_addr),
+                        IpAddr::from(remote.addr),
                         remote.port,
-                        Ipv4Addr::from(dest_addr),
+                        IpAddr::from(local.addr),
                         local.port,
                     ));
                 } else {
@@ -854,13 +1550,49 @@ impl Dataplane {
                 continue;
             }
 
-            if !self.peer_by_ip.contains_key(&client_ip) {
+            let Some(&peer_pubkey) = self.peer_by_ip.get(&client_ip) else {
                 warn!("Accepted TCP flow from unknown peer IP {}", client_ip);
                 self.smol_sockets.get_mut::<tcp::Socket>(handle).abort();
                 continue;
+            };
+
+            let is_dns = self.is_server(remote_ip) && remote_port == DNS_PORT;
+            let is_local = self.is_local_service(remote_ip, remote_port);
+            let egress_ip = self.egress_ip(remote_ip);
+            let decision = if is_local {
+                Decision::Allow
+            } else {
+                self.policy
+                    .acls
+                    .check(&peer_pubkey, Protocol::Tcp, egress_ip, remote_port)
+            };
+            if decision == Decision::Deny {
+                debug!(
+                    "Egress ACL denies TCP {}:{} -> {}:{}",
+                    client_ip, client_port, remote_ip, remote_port
+                );
+                self.smol_sockets.get_mut::<tcp::Socket>(handle).abort();
+                self.log_refused_flow(&peer_pubkey, &flow_key, FlowVerdict::Deny);
+                continue;
             }
 
-            let (wan_tx, wan_rx) = mpsc::channel::<Vec<u8>>(100);
+            let (wan_tx, wan_rx) = mpsc::channel::<Buffer>(100);
+            self.pending_usage.add_flow(&peer_pubkey);
+            if !is_local {
+                if let Some(anomalies) = &self.stats.anomalies {
+                    anomalies.flow(&peer_pubkey, Protocol::Tcp, egress_ip, remote_port);
+                }
+            }
+            self.count_destination(
+                &flow_key,
+                Counters {
+                    flows: 1,
+                    ..Counters::default()
+                },
+            );
+            if !is_local {
+                self.flow_limiter.lock().opened(&peer_pubkey, flow_key);
+            }
             self.tcp_flows.insert(
                 flow_key,
                 SmolTcpFlow {
@@ -869,6 +1601,7 @@ impl Dataplane {
                     pending_to_client: VecDeque::new(),
                     last_activity: Instant::now(),
                     wan_closed: false,
+                    totals: FlowTotals::new(),
                 },
             );
 
@@ -877,18 +1610,134 @@ impl Dataplane {
                 client_ip, client_port, remote_ip, remote_port
             );
 
-            let remote_addr = SocketAddrV4::new(remote_ip, remote_port);
             let wan_tx_back = self.wan_tx_template.clone();
-            tokio::spawn(async move {
-                Self::run_tcp_wan_task(flow_key, remote_addr, wan_rx, wan_tx_back).await;
-            });
+            if is_dns {
+                let dns = Arc::clone(&self.dns);
+                let anomalies = self.stats.anomalies.clone();
+                let running = self.stats.metrics.running(Task::Dns);
+                tokio::spawn(async move {
+                    let _running = running;
+                    Self::run_dns_tcp_task(
+                        flow_key,
+                        peer_pubkey,
+                        dns,
+                        anomalies,
+                        wan_rx,
+                        wan_tx_back,
+                    )
+                    .await;
+                });
+            } else if is_local && self.policy.speedtest_port == Some(remote_port) {
+                let running = self.stats.metrics.running(Task::SpeedTest);
+                let buffers = self.buffers.clone();
+                tokio::spawn(async move {
+                    let _running = running;
+                    Self::run_service_task(
+                        flow_key,
+                        speedtest::serve,
+                        buffers,
+                        wan_rx,
+                        wan_tx_back,
+                    )
+                    .await;
+                });
+            } else if let Some(page) = self
+                .policy
+                .status_page
+                .clone()
+                .filter(|_| is_local && remote_port == STATUS_PORT)
+            {
+                let running = self.stats.metrics.running(Task::StatusPage);
+                let buffers = self.buffers.clone();
+                let policy = self.policy.clone();
+                let serve = move |pipe: DuplexStream| async move {
+                    page.serve(pipe, peer_pubkey, &policy).await
+                };
+                tokio::spawn(async move {
+                    let _running = running;
+                    Self::run_service_task(flow_key, serve, buffers, wan_rx, wan_tx_back).await;
+                });
+            } else if is_local {
+                // The proxies are only served over IPv4
+                let IpAddr::V4(client_ip) = client_ip else {
+                    continue;
+                };
+                let peer = http_proxy::Peer {
+                    pubkey: peer_pubkey,
+                    client: SocketAddrV4::new(client_ip, client_port),
+                    policy: self.policy.clone(),
+                    dns: Arc::clone(&self.dns),
+                    flows: ProxyFlows::new(
+                        Arc::clone(&self.flow_limiter),
+                        Arc::clone(&self.stats.metrics),
+                    ),
+                };
+                let buffers = self.buffers.clone();
+                let socks = self.policy.socks.clone();
+                if let Some(socks) = socks.filter(|socks| socks.port() == remote_port) {
+                    let running = self.stats.metrics.running(Task::Socks);
+                    let to_dataplane = wan_tx_back.clone();
+                    let send_to_client: SendToClient = Arc::new(move |client, data| {
+                        let _ = to_dataplane.try_send(WanToDataplane::SocksDatagram {
+                            peer_pubkey,
+                            client,
+                            data,
+                        });
+                    });
+                    let serve = move |pipe: DuplexStream| async move {
+                        socks.serve(pipe, peer, send_to_client).await
+                    };
+                    tokio::spawn(async move {
+                        let _running = running;
+                        Self::run_service_task(flow_key, serve, buffers, wan_rx, wan_tx_back).await;
+                    });
+                } else if let Some(proxy) = self.policy.http_proxy.clone() {
+                    let running = self.stats.metrics.running(Task::HttpProxy);
+                    let serve =
+                        move |pipe: DuplexStream| async move { proxy.serve(pipe, peer).await };
+                    tokio::spawn(async move {
+                        let _running = running;
+                        Self::run_service_task(flow_key, serve, buffers, wan_rx, wan_tx_back).await;
+                    });
+                }
+            } else {
+                let remote_addr = SocketAddr::new(egress_ip, remote_port);
+                let acls = (decision == Decision::NeedsSni).then(|| Arc::clone(&self.policy.acls));
+                let domains = self.policy.domains.clone();
+                let domains = domains.filter(|domains| domains.covers(remote_port));
+                let name_check = (acls.is_some() || domains.is_some()).then_some(NameCheck {
+                    peer: peer_pubkey,
+                    acls,
+                    domains,
+                });
+                let egress = Arc::clone(&self.policy.egress);
+                let qos = Arc::clone(&self.policy.qos);
+                let metrics = Arc::clone(&self.stats.metrics);
+                let trace = self.trace_flow(&peer_pubkey, &flow_key);
+                let buffers = self.buffers.clone();
+                tokio::spawn(async move {
+                    Self::run_tcp_wan_task(
+                        flow_key,
+                        peer_pubkey,
+                        remote_addr,
+                        name_check,
+                        egress,
+                        qos,
+                        metrics,
+                        trace,
+                        buffers,
+                        wan_rx,
+                        wan_tx_back,
+                    )
+                    .await;
+                });
+            }
 
             self.ensure_smol_listener(port);
         }
     }
 
     fn drain_smol_tcp_to_wan(&mut self) {
-        let mut buf = vec![0u8; WAN_READ_BUFFER];
         let flow_keys: Vec<FlowKey> = self.tcp_flows.keys().copied().collect();
 
         for flow_key in flow_keys {
@@ -897,17 +1746,21 @@ impl Dataplane {
             };
             let socket = self.smol_sockets.get_mut::<tcp::Socket>(flow.socket);
 
+            let mut sent = 0;
             while socket.can_recv() {
                 let Ok(permit) = flow.wan_tx.try_reserve() else {
                     trace!("WAN TCP channel full for {:?}", flow_key);
                     break;
                 };
 
-                match socket.recv_slice(&mut buf) {
+                let mut buf = self.buffers.stream.get();
+                match socket.recv_slice(buf.space()) {
                     Ok(0) => break,
                     Ok(n) => {
                         flow.last_activity = Instant::now();
-                        permit.send(buf[..n].to_vec());
+                        buf.filled(n);
+                        permit.send(buf);
+                        sent += n;
                     }
                     Err(e) => {
                         debug!("smoltcp TCP recv error for {:?}: {:?}", flow_key, e);
@@ -915,11 +1768,19 @@ impl Dataplane {
                     }
                 }
             }
+            if sent > 0 {
+                self.count_destination(
+                    &flow_key,
+                    Counters {
+                        up_bytes: sent as u64,
+                        ..Counters::default()
+                    },
+                );
+            }
         }
     }
 
     fn drain_inbound_smol_tcp_to_wan(&mut self) {
-        let mut buf = vec![0u8; WAN_READ_BUFFER];
         let flow_keys: Vec<InboundFlowKey> = self.inbound_tcp_flows.keys().copied().collect();
 
         for flow_key in flow_keys {
@@ -934,11 +1795,13 @@ impl Dataplane {
                     break;
                 };
 
-                match socket.recv_slice(&mut buf) {
+                let mut buf = self.buffers.stream.get();
+                match socket.recv_slice(buf.space()) {
                     Ok(0) => break,
                     Ok(n) => {
                         flow.last_activity = Instant::now();
-                        permit.send(buf[..n].to_vec());
+                        buf.filled(n);
+                        permit.send(buf);
                     }
                     Err(e) => {
                         debug!("inbound smoltcp TCP recv error for {:?}: {:?}", flow_key, e);
@@ -971,7 +1834,7 @@ impl Dataplane {
                         flow.last_activity = Instant::now();
                     }
                     Ok(n) => {
-                        data.drain(..n);
+                        data.advance(n);
                         flow.pending_to_client.push_front(data);
                         flow.last_activity = Instant::now();
                         break;
@@ -1012,7 +1875,7 @@ impl Dataplane {
                         flow.last_activity = Instant::now();
                     }
                     Ok(n) => {
-                        data.drain(..n);
+                        data.advance(n);
                         flow.pending_to_client.push_front(data);
                         flow.last_activity = Instant::now();
                         break;
@@ -1033,19 +1896,37 @@ impl Dataplane {
 
     async fn drain_smol_tx(&mut self) {
         let packets = self.smol_device.drain_tx();
-        for packet in packets {
+        // Runs of packets to the same peer are sent together, so they can
+        // go out in one GSO send
+        let mut batch: Vec<Vec<u8>> = Vec::new();
+        let mut batch_peer = None;
+        for mut packet in packets {
+            if let Some(mss) = self.mss_clamp {
+                mss::clamp(&mut packet, mss);
+            }
             let Some(peer_pubkey) = self.peer_for_packet(&packet) else {
                 debug!("Dropping smoltcp packet without known peer");
                 continue;
             };
-            self.send_to_client(&peer_pubkey, &packet).await;
+            if batch_peer != Some(peer_pubkey) {
+                if let Some(peer) = batch_peer {
+                    self.send_batch_to_client(&peer, &batch).await;
+                }
+                batch.clear();
+                batch_peer = Some(peer_pubkey);
+            }
+            if self.admit_to_client(&peer_pubkey, &packet) {
+                batch.push(packet);
+            }
+        }
+        if let Some(peer) = batch_peer {
+            self.send_batch_to_client(&peer, &batch).await;
         }
     }
 
     fn peer_for_packet(&self, packet: &[u8]) -> Option<[u8; 32]> {
-        let ipv4 = Ipv4Packet::new_checked(packet).ok()?;
-        let dst_ip = Ipv4Addr::from(ipv4.dst_addr());
-        self.peer_by_ip.get(&dst_ip).copied()
+        let ip = IpHeader::parse(packet)?;
+        self.peer_by_ip.get(&ip.dst).copied()
     }
 
     fn cleanup_closed_smol_tcp(&mut self) {
@@ -1065,6 +1946,7 @@ impl Dataplane {
         for flow_key in closed {
             if let Some(flow) = self.tcp_flows.remove(&flow_key) {
                 self.smol_sockets.remove(flow.socket);
+                self.end_flow(&flow_key, flow.totals);
             }
         }
     }
@@ -1092,43 +1974,103 @@ impl Dataplane {
 
     async fn run_tcp_wan_task(
         flow_key: FlowKey,
-        remote_addr: SocketAddrV4,
-        mut from_client: mpsc::Receiver<Vec<u8>>,
+        peer_pubkey: [u8; 32],
+        remote_addr: SocketAddr,
+        name_check: Option<NameCheck>,
+        egress: Arc<Egress>,
+        qos: Arc<Qos>,
+        metrics: Arc<Metrics>,
+        trace: Option<FlowTrace>,
+        buffers: RelayBuffers,
+        mut from_client: mpsc::Receiver<Buffer>,
         to_dataplane: mpsc::Sender<WanToDataplane>,
     ) {
-        // Connect to remote
-        let stream =
-            match tokio::time::timeout(Duration::from_secs(10), TcpStream::connect(remote_addr))
-                .await
-            {
-                Ok(Ok(s)) => s,
-                Ok(Err(e)) => {
-                    debug!("TCP connect failed: {}", e);
-                    let _ = to_dataplane
-                        .send(WanToDataplane::TcpClosed { flow_key })
-                        .await;
-                    return;
+        let _running = metrics.running(Task::TcpRelay);
+        // Hold the flow until its first bytes show where it is going
+        let mut first_data = Vec::new();
+        let mut server_name = None;
+        if name_check.is_some() || qos.needs_name(Protocol::Tcp, remote_addr.port()) {
+            server_name = Self::read_client_hello(&mut from_client, &mut first_data).await;
+        }
+        if let Some(name_check) = name_check {
+            if let Some(denier) = name_check.denier(remote_addr, server_name.as_deref()) {
+                debug!(
+                    "TCP to {} denied by {} (server name {})",
+                    remote_addr,
+                    denier,
+                    server_name.as_deref().unwrap_or("-")
+                );
+                if let Some(trace) = trace {
+                    trace.finish(Some(format!("denied by {}", denier)));
                 }
-                Err(_) => {
-                    debug!("TCP connect timeout");
-                    let _ = to_dataplane
-                        .send(WanToDataplane::TcpClosed { flow_key })
-                        .await;
-                    return;
+                let _ = to_dataplane
+                    .send(WanToDataplane::TcpReset { flow_key })
+                    .await;
+                return;
+            }
+        }
+        let class = qos.classify(
+            &peer_pubkey,
+            Protocol::Tcp,
+            remote_addr.port(),
+            server_name.as_deref(),
+        );
+
+        // Connect to remote, under the egress dial timeout and retries
+        let dial_start = SystemTime::now();
+        let stream = match egress
+            .connect_flow_tcp(flow_key.client_ip, remote_addr)
+            .await
+        {
+            Ok(s) => s,
+            Err(e) => {
+                debug!("TCP connect to {} failed: {}", remote_addr, e);
+                metrics.tcp_forward_errors.fetch_add(1, Ordering::Relaxed);
+                if let Some(trace) = trace {
+                    trace.fail("dial", dial_start, e.to_string());
                 }
-            };
+                let _ = to_dataplane
+                    .send(WanToDataplane::TcpReset { flow_key })
+                    .await;
+                return;
+            }
+        };
 
         info!("TCP connected to {}", remote_addr);
+        if let Some(trace) = &trace {
+            trace.phase("dial", dial_start, None);
+        }
+        if let (Some(dscp), Some(socket)) = (class.dscp, stream.socket()) {
+            if let Err(e) = qos::mark(socket, dscp) {
+                debug!(
+                    "Failed to mark TCP to {} with DSCP {}: {}",
+                    remote_addr, dscp, e
+                );
+            }
+        }
+        let relay_start = SystemTime::now();
 
-        let (mut read_half, mut write_half) = stream.into_split();
+        let (mut read_half, mut write_half) = tokio::io::split(stream);
+        if !first_data.is_empty() {
+            if let Err(e) = write_half.write_all(&first_data).await {
+                debug!("TCP write error: {}", e);
+                if let Some(trace) = trace {
+                    trace.fail("relay", relay_start, e.to_string());
+                }
+                return;
+            }
+            qos.pace(&class, Direction::Up, first_data.len()).await;
+        }
 
         // Spawn reader task
         let to_dataplane_clone = to_dataplane.clone();
         let flow_key_clone = flow_key;
+        let qos_clone = Arc::clone(&qos);
+        let class_clone = Arc::clone(&class);
         tokio::spawn(async move {
-            let mut buf = vec![0u8; WAN_READ_BUFFER];
             loop {
-                match read_half.read(&mut buf).await {
+                let mut buf = buffers.stream.get();
+                match read_half.read(buf.space()).await {
                     Ok(0) => {
                         let _ = to_dataplane_clone
                             .send(WanToDataplane::TcpClosed {
@@ -1138,12 +2080,14 @@ impl Dataplane {
                         break;
                     }
                     Ok(n) => {
+                        buf.filled(n);
                         let _ = to_dataplane_clone
                             .send(WanToDataplane::TcpData {
                                 flow_key: flow_key_clone,
-                                data: buf[..n].to_vec(),
+                                data: buf,
                             })
                             .await;
+                        qos_clone.pace(&class_clone, Direction::Down, n).await;
                     }
                     Err(e) => {
                         debug!("TCP read error: {}", e);
@@ -1159,19 +2103,160 @@ impl Dataplane {
         });
 
         // Writer loop - forward data from client to WAN
-        while let Some(data) = from_client.recv().await {
-            if let Err(e) = write_half.write_all(&data).await {
-                debug!("TCP write error: {}", e);
-                break;
+        let mut relay_error = None;
+        let mut batch = Vec::new();
+        loop {
+            match bufpool::write_queued(&mut from_client, &mut write_half, &mut batch).await {
+                Ok(Some(n)) => qos.pace(&class, Direction::Up, n).await,
+                Ok(None) => break,
+                Err(e) => {
+                    debug!("TCP write error: {}", e);
+                    relay_error = Some(e.to_string());
+                    break;
+                }
+            }
+        }
+        // The read half keeps the connection open, so close our side here
+        let _ = write_half.shutdown().await;
+        if let Some(trace) = trace {
+            trace.phase("relay", relay_start, relay_error.clone());
+            trace.finish(relay_error);
+        }
+    }
+
+    /// Buffer a client's first bytes until they hold a ClientHello or HTTP
+    /// request head, returning its server name. Gives up with no name if the
+    /// client sends something else, or nothing before `SNI_TIMEOUT`.
+    async fn read_client_hello(
+        from_client: &mut mpsc::Receiver<Buffer>,
+        buffered: &mut Vec<u8>,
+    ) -> Option<String> {
+        let deadline = tokio::time::Instant::now() + SNI_TIMEOUT;
+        while buffered.len() < MAX_CLIENT_HELLO {
+            match sni::parse(buffered) {
+                ClientHello::Parsed(name) => return name,
+                ClientHello::Unrecognized => return None,
+                ClientHello::Incomplete => {}
+            }
+            match tokio::time::timeout_at(deadline, from_client.recv()).await {
+                Ok(Some(data)) => buffered.extend_from_slice(&data),
+                Ok(None) | Err(_) => return None,
+            }
+        }
+        None
+    }
+
+    /// Serve DNS over TCP for a client connected to the server IP.
+    ///
+    /// Handles any number of length-prefixed queries per connection and
+    /// closes the connection once the client goes idle.
+    async fn run_dns_tcp_task(
+        flow_key: FlowKey,
+        peer_pubkey: [u8; 32],
+        dns: Arc<DnsService>,
+        anomalies: Option<Arc<AnomalyDetector>>,
+        mut from_client: mpsc::Receiver<Buffer>,
+        to_dataplane: mpsc::Sender<WanToDataplane>,
+    ) {
+        let mut framer = TcpFramer::default();
+
+        loop {
+            while let Some(query) = framer.next_message() {
+                if let Some(anomalies) = &anomalies {
+                    anomalies.dns_query(&peer_pubkey);
+                }
+                let response = match dns.resolve(&peer_pubkey, &query, Transport::Tcp).await {
+                    Ok(response) => response,
+                    Err(e) => {
+                        debug!("TCP DNS query for {:?} failed: {:#}", flow_key, e);
+                        continue;
+                    }
+                };
+                let data = match dns::frame(&response) {
+                    Ok(data) => data,
+                    Err(e) => {
+                        debug!("Dropping TCP DNS response for {:?}: {:#}", flow_key, e);
+                        continue;
+                    }
+                };
+                if to_dataplane
+                    .send(WanToDataplane::TcpData {
+                        flow_key,
+                        data: Buffer::from(data),
+                    })
+                    .await
+                    .is_err()
+                {
+                    return;
+                }
+            }
+
+            match tokio::time::timeout(DNS_TCP_IDLE_TIMEOUT, from_client.recv()).await {
+                Ok(Some(data)) => framer.push(&data),
+                Ok(None) => return,
+                Err(_) => break,
+            }
+        }
+
+        let _ = to_dataplane
+            .send(WanToDataplane::TcpClosed { flow_key })
+            .await;
+    }
+
+    /// Serve a client connected to the HTTP or SOCKS5 proxy port, passing
+    /// its stream to `serve` through an in-memory pipe
+    async fn run_service_task<F, Fut>(
+        flow_key: FlowKey,
+        serve: F,
+        buffers: RelayBuffers,
+        mut from_client: mpsc::Receiver<Buffer>,
+        to_dataplane: mpsc::Sender<WanToDataplane>,
+    ) where
+        F: FnOnce(DuplexStream) -> Fut,
+        Fut: Future<Output = ()> + Send + 'static,
+    {
+        let (pipe, service_end) = tokio::io::duplex(SMOLTCP_SOCKET_BUFFER);
+        tokio::spawn(serve(service_end));
+
+        let (mut read_half, mut write_half) = tokio::io::split(pipe);
+        let mut client_open = true;
+        loop {
+            let mut buf = buffers.stream.get();
+            tokio::select! {
+                data = from_client.recv(), if client_open => match data {
+                    Some(data) => {
+                        if write_half.write_all(&data).await.is_err() {
+                            break;
+                        }
+                    }
+                    None => {
+                        client_open = false;
+                        let _ = write_half.shutdown().await;
+                    }
+                },
+                read = read_half.read(buf.space()) => match read {
+                    Ok(0) | Err(_) => break,
+                    Ok(n) => {
+                        buf.filled(n);
+                        let data = WanToDataplane::TcpData { flow_key, data: buf };
+                        if to_dataplane.send(data).await.is_err() {
+                            return;
+                        }
+                    }
+                },
             }
         }
+        let _ = to_dataplane
+            .send(WanToDataplane::TcpClosed { flow_key })
+            .await;
     }
 
     async fn handle_udp_packet(
         &mut self,
         peer_pubkey: &[u8; 32],
-        src_ip: Ipv4Addr,
-        dst_ip: Ipv4Addr,
+        src_ip: IpAddr,
+        dst_ip: IpAddr,
+        ip_packet: &[u8],
         udp_data: &[u8],
     ) {
         let Ok(udp) = UdpPacket::new_checked(udp_data) else {
@@ -1199,31 +2284,139 @@ impl Dataplane {
             payload.len()
         );
 
+        if self.is_server(dst_ip) && dst_port == DNS_PORT {
+            self.handle_dns_query(*peer_pubkey, src_ip, src_port, dst_ip, payload);
+            return;
+        }
+        if self.policy.ntp && self.is_server(dst_ip) && dst_port == NTP_PORT {
+            if let Some(response) = ntp::respond(payload, SystemTime::now(), dst_ip) {
+                let packet = build_udp_packet(dst_ip, src_ip, NTP_PORT, src_port, &response);
+                self.send_to_client(peer_pubkey, &packet).await;
+            }
+            return;
+        }
+        if self.is_server(dst_ip) && self.policy.speedtest_port == Some(dst_port) {
+            let packet = build_udp_packet(dst_ip, src_ip, dst_port, src_port, payload);
+            self.send_to_client(peer_pubkey, &packet).await;
+            return;
+        }
+        // SOCKS5 and NAT-PMP are only served over IPv4
+        if let (IpAddr::V4(src_ip), IpAddr::V4(dst_ip)) = (src_ip, dst_ip) {
+            if dst_ip == self.server_ip && self.socks_port() == Some(dst_port) {
+                if let Some(socks) = &self.policy.socks {
+                    socks.deliver(peer_pubkey, src_ip, src_port, payload);
+                }
+                return;
+            }
+            if dst_ip == self.server_ip && dst_port == NAT_PMP_PORT {
+                if let Some(mapper) = &self.policy.port_mapping {
+                    self.handle_port_mapping_request(
+                        mapper,
+                        *peer_pubkey,
+                        src_ip,
+                        src_port,
+                        payload,
+                    );
+                    return;
+                }
+            }
+        }
+
         // Get or create flow
         if !self.udp_flows.contains_key(&flow_key) {
+            match self.check_new_flow(peer_pubkey, Protocol::Udp, dst_ip, dst_port) {
+                Verdict::Accept => {}
+                Verdict::Drop => {
+                    self.log_refused_flow(peer_pubkey, &flow_key, FlowVerdict::Drop);
+                    return;
+                }
+                Verdict::Reject => {
+                    self.log_refused_flow(peer_pubkey, &flow_key, FlowVerdict::Reject);
+                    let unreachable = build_port_unreachable(dst_ip, src_ip, ip_packet);
+                    self.send_to_client(peer_pubkey, &unreachable).await;
+                    return;
+                }
+            }
+            let egress_ip = self.egress_ip(dst_ip);
+            if self
+                .policy
+                .acls
+                .check(peer_pubkey, Protocol::Udp, egress_ip, dst_port)
+                != Decision::Allow
+            {
+                debug!(
+                    "Egress ACL denies UDP {}:{} -> {}:{}",
+                    src_ip, src_port, dst_ip, dst_port
+                );
+                self.log_refused_flow(peer_pubkey, &flow_key, FlowVerdict::Deny);
+                return;
+            }
             if self.udp_flows.len() >= self.config.max_udp_flows {
                 warn!("Max UDP flows reached");
                 return;
             }
 
-            let remote_addr = SocketAddrV4::new(dst_ip, dst_port);
+            let remote_addr = SocketAddr::new(egress_ip, dst_port);
             info!("New UDP flow to {}", remote_addr);
+            self.pending_usage.add_flow(peer_pubkey);
+            if let Some(anomalies) = &self.stats.anomalies {
+                anomalies.flow(peer_pubkey, Protocol::Udp, egress_ip, dst_port);
+            }
+            self.count_destination(
+                &flow_key,
+                Counters {
+                    flows: 1,
+                    ..Counters::default()
+                },
+            );
 
             // Create WAN socket
-            let wan_socket = match TokioUdpSocket::bind("0.0.0.0:0").await {
+            let trace = self.trace_flow(peer_pubkey, &flow_key);
+            let dial_start = SystemTime::now();
+            let mapping = self
+                .udp_mappings
+                .get(&(src_ip, src_port))
+                .and_then(Weak::upgrade);
+            let wan_socket = match self
+                .policy
+                .egress
+                .open_flow_udp(src_ip, remote_addr, mapping.as_ref())
+                .await
+            {
                 Ok(s) => s,
                 Err(e) => {
-                    error!("Failed to bind UDP socket: {}", e);
+                    error!("Failed to open UDP flow to {}: {}", remote_addr, e);
+                    self.stats
+                        .metrics
+                        .udp_forward_errors
+                        .fetch_add(1, Ordering::Relaxed);
+                    if let Some(trace) = trace {
+                        trace.fail("dial", dial_start, e.to_string());
+                    }
                     return;
                 }
             };
-
-            if let Err(e) = wan_socket.connect(SocketAddr::V4(remote_addr)).await {
-                error!("Failed to connect UDP socket: {}", e);
-                return;
+            if let Some(trace) = &trace {
+                trace.phase("dial", dial_start, None);
+            }
+            if let Some(mapping) = wan_socket.mapping() {
+                self.udp_mappings
+                    .insert((src_ip, src_port), Arc::downgrade(mapping));
+            }
+            let class = self
+                .policy
+                .qos
+                .classify(peer_pubkey, Protocol::Udp, dst_port, None);
+            if let (Some(dscp), Some(socket)) = (class.dscp, wan_socket.socket()) {
+                if let Err(e) = qos::mark(socket, dscp) {
+                    debug!(
+                        "Failed to mark UDP to {} with DSCP {}: {}",
+                        remote_addr, dscp, e
+                    );
+                }
             }
 
-            let (wan_tx, wan_rx) = mpsc::channel::<Vec<u8>>(100);
+            let (wan_tx, wan_rx) = mpsc::channel::<Buffer>(100);
 
             let flow = UdpFlow {
                 peer_pubkey: *peer_pubkey,
@@ -1233,49 +2426,284 @@ impl Dataplane {
                 remote_port: dst_port,
                 wan_tx,
                 last_activity: Instant::now(),
+                totals: FlowTotals::new(),
             };
 
             self.udp_flows.insert(flow_key, flow);
+            self.flow_limiter.lock().opened(peer_pubkey, flow_key);
 
             // Spawn WAN task
             let wan_tx_back = self.wan_tx_template.clone();
+            let qos = Arc::clone(&self.policy.qos);
+            let metrics = Arc::clone(&self.stats.metrics);
+            let buffers = self.buffers.clone();
 
             tokio::spawn(async move {
-                Self::run_udp_wan_task(flow_key, wan_socket, wan_rx, wan_tx_back).await;
+                Self::run_udp_wan_task(
+                    flow_key,
+                    wan_socket,
+                    qos,
+                    class,
+                    metrics,
+                    trace,
+                    buffers,
+                    wan_rx,
+                    wan_tx_back,
+                )
+                .await;
             });
         }
 
         // Forward packet
         if let Some(flow) = self.udp_flows.get_mut(&flow_key) {
             flow.last_activity = Instant::now();
-            if flow.wan_tx.try_send(payload.to_vec()).is_err() {
+            if flow
+                .wan_tx
+                .try_send(self.buffers.stream.copy_from(payload))
+                .is_err()
+            {
                 warn!("UDP WAN channel full");
+                self.stats
+                    .metrics
+                    .udp_dropped
+                    .fetch_add(1, Ordering::Relaxed);
+                return;
+            }
+            self.count_destination(
+                &flow_key,
+                Counters {
+                    up_bytes: payload.len() as u64,
+                    ..Counters::default()
+                },
+            );
+        }
+    }
+
+    /// Answer a ping to the server IP, or send it on through an echo
+    /// session. Other ICMP messages from peers are dropped.
+    async fn handle_icmp_packet(
+        &mut self,
+        peer_pubkey: &[u8; 32],
+        src_ip: IpAddr,
+        dst_ip: IpAddr,
+        icmp_data: &[u8],
+    ) {
+        let request = match src_ip {
+            IpAddr::V4(_) => icmp::ECHO_REQUEST,
+            IpAddr::V6(_) => icmp::ECHO_REQUEST_V6,
+        };
+        let Some(echo) = Echo::parse(icmp_data, request) else {
+            trace!("Ignoring ICMP {} -> {}", src_ip, dst_ip);
+            return;
+        };
+        if self.is_server(dst_ip) {
+            let reply = build_echo_packet(dst_ip, src_ip, &echo);
+            self.send_to_client(peer_pubkey, &reply).await;
+            return;
+        }
+        if !self.policy.icmp_echo_forwarding {
+            return;
+        }
+
+        let key = EchoKey {
+            client_ip: src_ip,
+            ident: echo.ident,
+            remote_ip: dst_ip,
+        };
+        if !self.echo_sessions.contains_key(&key) {
+            let egress_ip = self.egress_ip(dst_ip);
+            if !self.check_new_echo(peer_pubkey, egress_ip) {
+                return;
+            }
+            if self.echo_sessions.len() >= MAX_ECHO_SESSIONS {
+                warn!("Max ICMP echo sessions reached");
+                return;
             }
+            let socket = match self.policy.egress.open_echo(src_ip, egress_ip) {
+                Ok(socket) => socket,
+                Err(e) => {
+                    debug!("Failed to open ICMP echo session to {}: {}", dst_ip, e);
+                    return;
+                }
+            };
+            debug!("New ICMP echo session {} -> {}", src_ip, dst_ip);
+            self.pending_usage.add_flow(peer_pubkey);
+            let (wan_tx, wan_rx) = mpsc::channel(16);
+            self.echo_sessions.insert(
+                key,
+                EchoSession {
+                    peer_pubkey: *peer_pubkey,
+                    wan_tx,
+                    last_activity: Instant::now(),
+                },
+            );
+            let running = self.stats.metrics.running(Task::EchoRelay);
+            let to_dataplane = self.wan_tx_template.clone();
+            tokio::spawn(async move {
+                let _running = running;
+                Self::run_echo_task(key, socket, wan_rx, to_dataplane).await;
+            });
+        }
+
+        if let Some(session) = self.echo_sessions.get_mut(&key) {
+            session.last_activity = Instant::now();
+            let _ = session.wan_tx.try_send((echo.seq, echo.data.to_vec()));
         }
     }
 
+    /// The checks a new flow gets that apply to pings, which have no
+    /// protocol or port for the rest to match on
+    fn check_new_echo(&mut self, peer_pubkey: &[u8; 32], dst_ip: IpAddr) -> bool {
+        if self.wg_io.is_draining() || !self.policy.schedules.allows(peer_pubkey) {
+            return false;
+        }
+        if self.policy.firewall.check_echo(peer_pubkey, dst_ip) != Verdict::Accept {
+            debug!("Firewall refuses ICMP echo to {}", dst_ip);
+            return false;
+        }
+        if !self.policy.acls.check_echo(peer_pubkey, dst_ip) {
+            debug!("Egress ACL denies ICMP echo to {}", dst_ip);
+            return false;
+        }
+        if let Err(reason) = self.flow_limiter.lock().admit(peer_pubkey) {
+            self.stats.metrics.record_flow_limit(reason);
+            return false;
+        }
+        true
+    }
+
+    /// Send a session's echo requests and hand its replies to the dataplane,
+    /// until the session is expired and its sender dropped
+    async fn run_echo_task(
+        key: EchoKey,
+        socket: EchoSocket,
+        mut from_client: mpsc::Receiver<(u16, Vec<u8>)>,
+        to_dataplane: mpsc::Sender<WanToDataplane>,
+    ) {
+        let mut buf = vec![0u8; 65536];
+        loop {
+            tokio::select! {
+                request = from_client.recv() => {
+                    let Some((seq, data)) = request else {
+                        return;
+                    };
+                    if let Err(e) = socket.send(seq, &data).await {
+                        debug!("ICMP echo send to {} failed: {}", key.remote_ip, e);
+                    }
+                }
+                reply = socket.recv(&mut buf) => {
+                    match reply {
+                        Ok((seq, data)) => {
+                            let _ = to_dataplane
+                                .send(WanToDataplane::EchoReply { key, seq, data })
+                                .await;
+                        }
+                        Err(e) => {
+                            debug!("ICMP echo recv from {} failed: {}", key.remote_ip, e);
+                            return;
+                        }
+                    }
+                }
+            }
+        }
+    }
+
+    /// Resolve a DNS query addressed to the server IP without blocking the dataplane
+    fn handle_dns_query(
+        &self,
+        peer_pubkey: [u8; 32],
+        client_ip: IpAddr,
+        client_port: u16,
+        server_ip: IpAddr,
+        query: &[u8],
+    ) {
+        let dns = Arc::clone(&self.dns);
+        let query = query.to_vec();
+        let to_dataplane = self.wan_tx_template.clone();
+        let running = self.stats.metrics.running(Task::Dns);
+        if let Some(anomalies) = &self.stats.anomalies {
+            anomalies.dns_query(&peer_pubkey);
+        }
+
+        tokio::spawn(async move {
+            let _running = running;
+            match dns.resolve(&peer_pubkey, &query, Transport::Udp).await {
+                Ok(data) => {
+                    let _ = to_dataplane
+                        .send(WanToDataplane::DnsResponse {
+                            peer_pubkey,
+                            client_ip,
+                            client_port,
+                            server_ip,
+                            data,
+                        })
+                        .await;
+                }
+                Err(e) => {
+                    debug!("DNS query from {}:{} failed: {:#}", client_ip, client_port, e);
+                }
+            }
+        });
+    }
+
+    /// Answer a NAT-PMP request in the background, since it may wait on
+    /// the port forward channel
+    fn handle_port_mapping_request(
+        &self,
+        mapper: &Arc<PortMapper>,
+        peer_pubkey: [u8; 32],
+        client_ip: Ipv4Addr,
+        client_port: u16,
+        request: &[u8],
+    ) {
+        let mapper = Arc::clone(mapper);
+        let request = request.to_vec();
+        let to_dataplane = self.wan_tx_template.clone();
+
+        tokio::spawn(async move {
+            if let Some(data) = mapper.handle(peer_pubkey, &request).await {
+                let _ = to_dataplane
+                    .send(WanToDataplane::PortMappingResponse {
+                        peer_pubkey,
+                        client: SocketAddrV4::new(client_ip, client_port),
+                        data,
+                    })
+                    .await;
+            }
+        });
+    }
+
     async fn run_udp_wan_task(
         flow_key: FlowKey,
-        socket: TokioUdpSocket,
-        mut from_client: mpsc::Receiver<Vec<u8>>,
+        socket: Datagrams,
+        qos: Arc<Qos>,
+        class: Arc<FlowClass>,
+        metrics: Arc<Metrics>,
+        trace: Option<FlowTrace>,
+        buffers: RelayBuffers,
+        mut from_client: mpsc::Receiver<Buffer>,
         to_dataplane: mpsc::Sender<WanToDataplane>,
     ) {
+        let _running = metrics.running(Task::UdpRelay);
         let socket = Arc::new(socket);
         let socket_recv = Arc::clone(&socket);
 
         // Spawn receiver
         let to_dataplane_clone = to_dataplane.clone();
-        tokio::spawn(async move {
-            let mut buf = vec![0u8; 65535];
+        let qos_clone = Arc::clone(&qos);
+        let class_clone = Arc::clone(&class);
+        let recv_task = tokio::spawn(async move {
+            let mut buf = buffers.datagram.get();
             loop {
-                match socket_recv.recv(&mut buf).await {
+                match socket_recv.recv(buf.space()).await {
                     Ok(n) => {
                         let _ = to_dataplane_clone
                             .send(WanToDataplane::UdpData {
                                 flow_key,
-                                data: buf[..n].to_vec(),
+                                data: buffers.stream.copy_from(&buf.space()[..n]),
                             })
                             .await;
+                        qos_clone.pace(&class_clone, Direction::Down, n).await;
                     }
                     Err(e) => {
                         debug!("UDP recv error: {}", e);
@@ -1285,12 +2713,24 @@ impl Dataplane {
             }
         });
 
-        // Send loop
+        // Send loop - ends once the flow is expired and its sender dropped
+        let relay_start = SystemTime::now();
+        let mut relay_error = None;
         while let Some(data) = from_client.recv().await {
             if let Err(e) = socket.send(&data).await {
                 debug!("UDP send error: {}", e);
+                metrics.udp_forward_errors.fetch_add(1, Ordering::Relaxed);
+                relay_error = Some(e.to_string());
                 break;
             }
+            qos.pace(&class, Direction::Up, data.len()).await;
+        }
+
+        // Release the WAN socket along with the flow
+        recv_task.abort();
+        if let Some(trace) = trace {
+            trace.phase("relay", relay_start, relay_error.clone());
+            trace.finish(relay_error);
         }
     }
 
@@ -1299,7 +2739,12 @@ impl Dataplane {
             WanToDataplane::TcpData { flow_key, data } => {
                 if let Some(flow) = self.tcp_flows.get_mut(&flow_key) {
                     flow.last_activity = Instant::now();
+                    let counters = Counters {
+                        down_bytes: data.len() as u64,
+                        ..Counters::default()
+                    };
                     flow.pending_to_client.push_back(data);
+                    self.count_destination(&flow_key, counters);
                     self.poll_smol_tcp().await;
                 }
             }
@@ -1309,9 +2754,22 @@ impl Dataplane {
                     self.poll_smol_tcp().await;
                 }
             }
+            WanToDataplane::TcpReset { flow_key } => {
+                if let Some(flow) = self.tcp_flows.get(&flow_key) {
+                    self.smol_sockets.get_mut::<tcp::Socket>(flow.socket).abort();
+                    self.poll_smol_tcp().await;
+                }
+            }
             WanToDataplane::UdpData { flow_key, data } => {
                 if let Some(flow) = self.udp_flows.get_mut(&flow_key) {
                     flow.last_activity = Instant::now();
+                    self.count_destination(
+                        &flow_key,
+                        Counters {
+                            down_bytes: data.len() as u64,
+                            ..Counters::default()
+                        },
+                    );
                     self.send_udp_response(&flow_key, &data).await;
                 }
             }
@@ -1328,6 +2786,60 @@ impl Dataplane {
                     self.poll_smol_tcp().await;
                 }
             }
+            WanToDataplane::DnsResponse {
+                peer_pubkey,
+                client_ip,
+                client_port,
+                server_ip,
+                data,
+            } => {
+                self.stats.destinations.learn_names(&data);
+                let packet = build_udp_packet(server_ip, client_ip, DNS_PORT, client_port, &data);
+                self.send_to_client(&peer_pubkey, &packet).await;
+            }
+            WanToDataplane::SocksDatagram {
+                peer_pubkey,
+                client,
+                data,
+            } => {
+                if let Some(port) = self.socks_port() {
+                    let packet = build_udp_packet(
+                        IpAddr::V4(self.server_ip),
+                        IpAddr::V4(*client.ip()),
+                        port,
+                        client.port(),
+                        &data,
+                    );
+                    self.send_to_client(&peer_pubkey, &packet).await;
+                }
+            }
+            WanToDataplane::EchoReply { key, seq, data } => {
+                if let Some(session) = self.echo_sessions.get_mut(&key) {
+                    session.last_activity = Instant::now();
+                    let echo = Echo {
+                        ident: key.ident,
+                        seq,
+                        data: &data,
+                    };
+                    let packet = build_echo_packet(key.remote_ip, key.client_ip, &echo);
+                    let peer_pubkey = session.peer_pubkey;
+                    self.send_to_client(&peer_pubkey, &packet).await;
+                }
+            }
+            WanToDataplane::PortMappingResponse {
+                peer_pubkey,
+                client,
+                data,
+            } => {
+                let packet = build_udp_packet(
+                    IpAddr::V4(self.server_ip),
+                    IpAddr::V4(*client.ip()),
+                    NAT_PMP_PORT,
+                    client.port(),
+                    &data,
+                );
+                self.send_to_client(&peer_pubkey, &packet).await;
+            }
         }
     }
 
@@ -1348,69 +2860,443 @@ impl Dataplane {
     }
 
     async fn send_to_client(&self, peer_pubkey: &[u8; 32], packet: &[u8]) {
+        if !self.admit_to_client(peer_pubkey, packet) {
+            return;
+        }
         if let Err(e) = self.wg_io.send_to_peer(peer_pubkey, packet).await {
             debug!("Failed to send to client: {}", e);
         }
     }
 
+    /// Send packets already admitted by `admit_to_client`
+    async fn send_batch_to_client(&self, peer_pubkey: &[u8; 32], packets: &[Vec<u8>]) {
+        if packets.is_empty() {
+            return;
+        }
+        let packets: Vec<&[u8]> = packets.iter().map(Vec::as_slice).collect();
+        if let Err(e) = self.wg_io.send_batch_to_peer(peer_pubkey, &packets).await {
+            debug!("Failed to send to client: {}", e);
+        }
+    }
+
+    /// Apply the peer's download limit to a packet and count it, returning
+    /// whether it may be sent
+    fn admit_to_client(&self, peer_pubkey: &[u8; 32], packet: &[u8]) -> bool {
+        if !self
+            .policy
+            .bandwidth
+            .allow(peer_pubkey, Direction::Down, packet.len())
+        {
+            return false;
+        }
+        self.pending_usage
+            .add_bytes(peer_pubkey, Direction::Down, packet.len());
+        self.stats.capture.packet(peer_pubkey, packet);
+        true
+    }
+
+    /// Close flows that have been idle past their timeout, and run the
+    /// rest of the dataplane's periodic housekeeping
     fn cleanup_expired_flows(&mut self) {
         let now = Instant::now();
-        let tcp_timeout = Duration::from_secs(self.config.tcp_idle_timeout_secs);
         let udp_timeout = Duration::from_secs(self.config.udp_idle_timeout_secs);
 
-        let expired_tcp: Vec<FlowKey> = self
+        let expired_tcp: Vec<(FlowKey, Eviction)> = self
             .tcp_flows
             .iter()
-            .filter_map(|(flow_key, flow)| {
-                (now.duration_since(flow.last_activity) >= tcp_timeout).then_some(*flow_key)
-            })
+            .filter_map(|(flow_key, flow)| Some((*flow_key, self.tcp_expiry(flow, now)?)))
             .collect();
 
-        for flow_key in expired_tcp {
+        for (flow_key, eviction) in expired_tcp {
             if let Some(flow) = self.tcp_flows.remove(&flow_key) {
                 self.smol_sockets
                     .get_mut::<tcp::Socket>(flow.socket)
                     .abort();
                 self.smol_sockets.remove(flow.socket);
+                self.end_flow(&flow_key, flow.totals);
+                self.stats.metrics.record_eviction(eviction);
             }
         }
 
-        let expired_inbound_tcp: Vec<InboundFlowKey> = self
+        let expired_inbound_tcp: Vec<(InboundFlowKey, Eviction)> = self
             .inbound_tcp_flows
             .iter()
+            .filter_map(|(flow_key, flow)| Some((*flow_key, self.tcp_expiry(flow, now)?)))
+            .collect();
+
+        for (flow_key, eviction) in expired_inbound_tcp {
+            if let Some(flow) = self.inbound_tcp_flows.remove(&flow_key) {
+                self.smol_sockets
+                    .get_mut::<tcp::Socket>(flow.socket)
+                    .abort();
+                self.smol_sockets.remove(flow.socket);
+                self.stats.metrics.record_eviction(eviction);
+            }
+        }
+
+        let expired_udp: Vec<FlowKey> = self
+            .udp_flows
+            .iter()
             .filter_map(|(flow_key, flow)| {
-                (now.duration_since(flow.last_activity) >= tcp_timeout).then_some(*flow_key)
+                (now.duration_since(flow.last_activity) >= udp_timeout).then_some(*flow_key)
             })
             .collect();
+        for flow_key in expired_udp {
+            if let Some(flow) = self.udp_flows.remove(&flow_key) {
+                self.end_flow(&flow_key, flow.totals);
+                self.stats.metrics.record_eviction(Eviction::UdpIdle);
+            }
+        }
 
-        for flow_key in expired_inbound_tcp {
-            if let Some(flow) = self.inbound_tcp_flows.remove(&flow_key) {
+        let tcp_timeout = Duration::from_secs(self.config.tcp_idle_timeout_secs);
+        self.hairpin_flows.expire(tcp_timeout, udp_timeout);
+        self.udp_mappings
+            .retain(|_, mapping| mapping.strong_count() > 0);
+        self.echo_sessions
+            .retain(|_, session| now.duration_since(session.last_activity) < udp_timeout);
+        self.terminate_unscheduled_flows();
+        let metrics = &self.stats.metrics;
+        let sizes = TableSizes {
+            tcp: (self.tcp_flows.len() + self.inbound_tcp_flows.len()) as u64,
+            udp: self.udp_flows.len() as u64,
+            inbound_tcp: self.inbound_tcp_flows.len() as u64,
+            smoltcp_sockets: self.smol_sockets.iter().count() as u64,
+        };
+        report_size(&metrics.tcp_flows, self.reported.tcp, sizes.tcp);
+        report_size(&metrics.udp_flows, self.reported.udp, sizes.udp);
+        report_size(
+            &metrics.inbound_tcp_flows,
+            self.reported.inbound_tcp,
+            sizes.inbound_tcp,
+        );
+        report_size(
+            &metrics.smoltcp_sockets,
+            self.reported.smoltcp_sockets,
+            sizes.smoltcp_sockets,
+        );
+        self.reported = sizes;
+        self.heartbeat.store(unix_now(), Ordering::Relaxed);
+        self.policy.bandwidth.forget_idle();
+        if let Some(http_proxy) = &self.policy.http_proxy {
+            http_proxy.forget_idle();
+        }
+        self.flow_limiter.lock().forget_idle();
+        self.stats.usage.record(self.pending_usage.take());
+        self.stats
+            .destinations
+            .record(std::mem::take(&mut self.pending_destinations));
+    }
+
+    /// Whether a TCP flow has been idle past its timeout, which is shorter
+    /// once either side has closed
+    fn tcp_expiry(&self, flow: &InboundTcpFlow, now: Instant) -> Option<Eviction> {
+        let state = self.smol_sockets.get::<tcp::Socket>(flow.socket).state();
+        let half_closed = flow.wan_closed
+            || matches!(
+                state,
+                tcp::State::FinWait1
+                    | tcp::State::FinWait2
+                    | tcp::State::CloseWait
+                    | tcp::State::Closing
+                    | tcp::State::LastAck
+                    | tcp::State::TimeWait
+            );
+        let (timeout_secs, eviction) = if half_closed {
+            (
+                self.config.tcp_half_closed_timeout_secs,
+                Eviction::TcpHalfClosed,
+            )
+        } else {
+            (self.config.tcp_idle_timeout_secs, Eviction::TcpIdle)
+        };
+        (now.duration_since(flow.last_activity) >= Duration::from_secs(timeout_secs))
+            .then_some(eviction)
+    }
+
+    /// Every open flow, outbound then inbound TCP and then UDP
+    fn flow_table(&self) -> Vec<FlowEntry> {
+        let now = Instant::now();
+        let mut entries = Vec::new();
+        for (flow_key, flow) in &self.tcp_flows {
+            let socket = self.smol_sockets.get::<tcp::Socket>(flow.socket);
+            entries.push(FlowEntry {
+                peer: self.peer_by_ip.get(&flow_key.client_ip).copied(),
+                protocol: Protocol::Tcp,
+                inbound: false,
+                client: SocketAddr::new(flow_key.client_ip, flow_key.client_port),
+                remote: SocketAddr::new(flow_key.remote_ip, flow_key.remote_port),
+                public_port: None,
+                state: socket.state().to_string(),
+                remote_closed: flow.wan_closed,
+                idle: now.duration_since(flow.last_activity),
+                queued: flow.pending_to_client.len(),
+                totals: flow.totals,
+            });
+        }
+        for (flow_key, flow) in &self.inbound_tcp_flows {
+            let socket = self.smol_sockets.get::<tcp::Socket>(flow.socket);
+            // The tunnel side connects out to the peer's forwarded port
+            let client = match socket.remote_endpoint() {
+                Some(endpoint) => SocketAddr::new(endpoint.addr.into(), endpoint.port),
+                None => SocketAddr::new(Ipv4Addr::UNSPECIFIED.into(), 0),
+            };
+            entries.push(FlowEntry {
+                peer: self.peer_by_ip.get(&client.ip()).copied(),
+                protocol: Protocol::Tcp,
+                inbound: true,
+                client,
+                remote: SocketAddr::new(flow_key.remote_ip.into(), flow_key.remote_port),
+                public_port: Some(flow_key.public_port),
+                state: socket.state().to_string(),
+                remote_closed: flow.wan_closed,
+                idle: now.duration_since(flow.last_activity),
+                queued: flow.pending_to_client.len(),
+                totals: flow.totals,
+            });
+        }
+        for flow in self.udp_flows.values() {
+            entries.push(FlowEntry {
+                peer: Some(flow.peer_pubkey),
+                protocol: Protocol::Udp,
+                inbound: false,
+                client: SocketAddr::new(flow.client_ip, flow.client_port),
+                remote: SocketAddr::new(flow.remote_ip, flow.remote_port),
+                public_port: None,
+                state: "open".to_string(),
+                remote_closed: false,
+                idle: now.duration_since(flow.last_activity),
+                queued: 0,
+                totals: flow.totals,
+            });
+        }
+        entries
+    }
+
+    /// Start tracing an outbound flow, if traces are exported
+    fn trace_flow(&self, peer_pubkey: &[u8; 32], flow_key: &FlowKey) -> Option<FlowTrace> {
+        let tracer = self.stats.tracer.as_ref()?;
+        let protocol = match flow_key.protocol {
+            Protocol::Tcp => "tcp",
+            Protocol::Udp => "udp",
+        };
+        Some(tracer.start_flow(vec![
+            ("wirecage.peer", encode_key(peer_pubkey)),
+            ("network.transport", protocol.to_string()),
+            ("client.address", flow_key.client_ip.to_string()),
+            ("client.port", flow_key.client_port.to_string()),
+            ("server.address", flow_key.remote_ip.to_string()),
+            ("server.port", flow_key.remote_port.to_string()),
+        ]))
+    }
+
+    /// Count traffic on an outbound flow for its flow record and the
+    /// destination statistics
+    fn count_destination(&mut self, flow_key: &FlowKey, counters: Counters) {
+        let totals = match flow_key.protocol {
+            Protocol::Tcp => self
+                .tcp_flows
+                .get_mut(flow_key)
+                .map(|flow| &mut flow.totals),
+            Protocol::Udp => self
+                .udp_flows
+                .get_mut(flow_key)
+                .map(|flow| &mut flow.totals),
+        };
+        if let Some(totals) = totals {
+            totals.up_bytes += counters.up_bytes;
+            totals.down_bytes += counters.down_bytes;
+        }
+
+        if self.is_server(flow_key.remote_ip) {
+            return;
+        }
+        let Some(&peer_pubkey) = self.peer_by_ip.get(&flow_key.client_ip) else {
+            return;
+        };
+        let destination = Destination {
+            protocol: flow_key.protocol,
+            ip: self.egress_ip(flow_key.remote_ip),
+            port: flow_key.remote_port,
+        };
+        self.pending_destinations
+            .entry((peer_pubkey, destination))
+            .or_default()
+            .add(&counters);
+    }
+
+    /// Release an outbound flow that has ended from its peer's flow limit
+    /// and record it, if flows are logged
+    fn end_flow(&mut self, flow_key: &FlowKey, totals: FlowTotals) {
+        self.flow_limiter.lock().closed(flow_key);
+        let peer_pubkey = self.peer_by_ip.get(&flow_key.client_ip).copied();
+        self.record_flow(peer_pubkey, flow_key, totals, FlowVerdict::Accept);
+    }
+
+    /// Record a new outbound flow that policy refused, if flows are logged
+    fn log_refused_flow(&self, peer_pubkey: &[u8; 32], flow_key: &FlowKey, verdict: FlowVerdict) {
+        self.record_flow(Some(*peer_pubkey), flow_key, FlowTotals::new(), verdict);
+    }
+
+    fn record_flow(
+        &self,
+        peer_pubkey: Option<[u8; 32]>,
+        flow_key: &FlowKey,
+        totals: FlowTotals,
+        verdict: FlowVerdict,
+    ) {
+        let Some(flow_log) = &self.stats.flow_log else {
+            return;
+        };
+        // DNS to the server itself is not egress
+        if self.is_server(flow_key.remote_ip) {
+            return;
+        }
+        flow_log.record(FlowRecord {
+            peer: peer_pubkey,
+            protocol: flow_key.protocol,
+            src: (flow_key.client_ip, flow_key.client_port),
+            dst: (flow_key.remote_ip, flow_key.remote_port),
+            up_bytes: totals.up_bytes,
+            down_bytes: totals.down_bytes,
+            start: totals.opened,
+            end: SystemTime::now(),
+            verdict,
+        });
+    }
+
+    /// Close the open flows of peers whose access schedule has ended and
+    /// says to terminate them
+    fn terminate_unscheduled_flows(&mut self) {
+        let mut terminates: HashMap<[u8; 32], bool> = HashMap::new();
+        let schedules = &self.policy.schedules;
+        let mut check = |peer_pubkey: &[u8; 32]| {
+            *terminates
+                .entry(*peer_pubkey)
+                .or_insert_with(|| schedules.terminates(peer_pubkey))
+        };
+
+        let closing_tcp: Vec<FlowKey> = self
+            .tcp_flows
+            .keys()
+            .filter(|flow_key| {
+                !self.is_server(flow_key.remote_ip)
+                    && self.peer_by_ip.get(&flow_key.client_ip).is_some_and(&mut check)
+            })
+            .copied()
+            .collect();
+        let closing_udp: Vec<FlowKey> = self
+            .udp_flows
+            .iter()
+            .filter(|(_, flow)| check(&flow.peer_pubkey))
+            .map(|(flow_key, _)| *flow_key)
+            .collect();
+
+        for flow_key in &closing_tcp {
+            if let Some(flow) = self.tcp_flows.remove(flow_key) {
                 self.smol_sockets
                     .get_mut::<tcp::Socket>(flow.socket)
                     .abort();
                 self.smol_sockets.remove(flow.socket);
+                self.end_flow(flow_key, flow.totals);
+            }
+        }
+        for flow_key in &closing_udp {
+            if let Some(flow) = self.udp_flows.remove(flow_key) {
+                self.end_flow(flow_key, flow.totals);
             }
         }
 
-        self.udp_flows
-            .retain(|_, flow| now.duration_since(flow.last_activity) < udp_timeout);
+        let closed = closing_tcp.len() + closing_udp.len();
+        if closed > 0 {
+            info!("Closed {} flows outside their peers' access schedules", closed);
+        }
     }
 }
 
 /// Build a UDP packet with IP header
 fn build_udp_packet(
-    src_ip: Ipv4Addr,
-    dst_ip: Ipv4Addr,
+    src_ip: IpAddr,
+    dst_ip: IpAddr,
     src_port: u16,
     dst_port: u16,
     payload: &[u8],
 ) -> Vec<u8> {
+    let header_len = ip_header_len(src_ip);
     let udp_len = 8 + payload.len();
-    let total_len = 20 + udp_len;
 
-    let mut packet = vec![0u8; total_len];
+    let mut packet = vec![0u8; header_len + udp_len];
+    write_ip_header(&mut packet, 17, src_ip, dst_ip); // Protocol: UDP
+
+    // UDP header
+    let udp = &mut packet[header_len..];
+    udp[0..2].copy_from_slice(&src_port.to_be_bytes());
+    udp[2..4].copy_from_slice(&dst_port.to_be_bytes());
+    udp[4..6].copy_from_slice(&(udp_len as u16).to_be_bytes());
+
+    // Payload
+    udp[8..8 + payload.len()].copy_from_slice(payload);
+
+    // Checksum at 6-7 is optional over IPv4 and left 0, but IPv6 needs it,
+    // with 0 sent as all ones
+    if src_ip.is_ipv6() {
+        let checksum = match transport_checksum(17, src_ip, dst_ip, udp) {
+            0 => 0xffff,
+            checksum => checksum,
+        };
+        udp[6..8].copy_from_slice(&checksum.to_be_bytes());
+    }
+
+    packet
+}
+
+/// Build an echo reply from `src_ip` to a peer
+fn build_echo_packet(src_ip: IpAddr, dst_ip: IpAddr, echo: &Echo) -> Vec<u8> {
+    let (protocol, reply) = match src_ip {
+        IpAddr::V4(_) => (1, icmp::ECHO_REPLY),
+        IpAddr::V6(_) => (58, icmp::ECHO_REPLY_V6),
+    };
+    let header_len = ip_header_len(src_ip);
+    let message = echo.encode(reply);
+    let mut packet = vec![0u8; header_len + message.len()];
+    write_ip_header(&mut packet, protocol, src_ip, dst_ip);
+    let icmp = &mut packet[header_len..];
+    icmp.copy_from_slice(&message);
+    if src_ip.is_ipv6() {
+        icmp[2..4].fill(0);
+        let checksum = transport_checksum(protocol, src_ip, dst_ip, icmp);
+        icmp[2..4].copy_from_slice(&checksum.to_be_bytes());
+    }
+    packet
+}
+
+/// Length of the header `write_ip_header` writes for `ip`'s family
+fn ip_header_len(ip: IpAddr) -> usize {
+    match ip {
+        IpAddr::V4(_) => 20,
+        IpAddr::V6(_) => 40,
+    }
+}
+
+/// Fill in the IPv4 or IPv6 header for a packet of `packet.len()` bytes
+/// between two addresses of one family
+fn write_ip_header(packet: &mut [u8], protocol: u8, src_ip: IpAddr, dst_ip: IpAddr) {
+    match (src_ip, dst_ip) {
+        (IpAddr::V4(src_ip), IpAddr::V4(dst_ip)) => {
+            write_ipv4_header(packet, protocol, src_ip, dst_ip)
+        }
+        (IpAddr::V6(src_ip), IpAddr::V6(dst_ip)) => {
+            write_ipv6_header(packet, protocol, src_ip, dst_ip)
+        }
+        _ => unreachable!(
+            "packet from {} to {} mixes address families",
+            src_ip, dst_ip
+        ),
+    }
+}
 
-    // IP header
+/// Fill in a 20-byte IPv4 header for a packet of `packet.len()` bytes
+fn write_ipv4_header(packet: &mut [u8], protocol: u8, src_ip: Ipv4Addr, dst_ip: Ipv4Addr) {
+    let total_len = packet.len();
     packet[0] = 0x45;
     packet[1] = 0;
     packet[2..4].copy_from_slice(&(total_len as u16).to_be_bytes());
@@ -1418,27 +3304,145 @@ fn build_udp_packet(
     packet[6] = 0x40;
     packet[7] = 0;
     packet[8] = 64;
-    packet[9] = 17; // Protocol: UDP
+    packet[9] = protocol;
     packet[12..16].copy_from_slice(&src_ip.octets());
     packet[16..20].copy_from_slice(&dst_ip.octets());
 
     let ip_checksum = ip_checksum(&packet[0..20]);
     packet[10..12].copy_from_slice(&ip_checksum.to_be_bytes());
+}
 
-    // UDP header
-    let udp = &mut packet[20..];
-    udp[0..2].copy_from_slice(&src_port.to_be_bytes());
-    udp[2..4].copy_from_slice(&dst_port.to_be_bytes());
-    udp[4..6].copy_from_slice(&(udp_len as u16).to_be_bytes());
-    // Checksum at 6-7 (optional for UDP over IPv4, set to 0)
-    udp[6..8].copy_from_slice(&0u16.to_be_bytes());
+/// Fill in a 40-byte IPv6 header for a packet of `packet.len()` bytes
+fn write_ipv6_header(packet: &mut [u8], next_header: u8, src_ip: Ipv6Addr, dst_ip: Ipv6Addr) {
+    let payload_len = packet.len() - 40;
+    packet[0..4].copy_from_slice(&[0x60, 0, 0, 0]);
+    packet[4..6].copy_from_slice(&(payload_len as u16).to_be_bytes());
+    packet[6] = next_header;
+    packet[7] = 64;
+    packet[8..24].copy_from_slice(&src_ip.octets());
+    packet[24..40].copy_from_slice(&dst_ip.octets());
+}
 
-    // Payload
-    udp[8..8 + payload.len()].copy_from_slice(payload);
+/// Checksum of a TCP, UDP or ICMP `segment`, over the pseudo-header of its
+/// IP family where it has one; ICMP over IPv4 has none
+fn transport_checksum(protocol: u8, src_ip: IpAddr, dst_ip: IpAddr, segment: &[u8]) -> u16 {
+    let mut pseudo_header = Vec::with_capacity(40);
+    match (src_ip, dst_ip) {
+        (IpAddr::V4(_), _) if protocol == 1 => {}
+        (IpAddr::V4(src_ip), IpAddr::V4(dst_ip)) => {
+            pseudo_header.extend_from_slice(&src_ip.octets());
+            pseudo_header.extend_from_slice(&dst_ip.octets());
+            pseudo_header.extend_from_slice(&[0, protocol]);
+            pseudo_header.extend_from_slice(&(segment.len() as u16).to_be_bytes());
+        }
+        (IpAddr::V6(src_ip), IpAddr::V6(dst_ip)) => {
+            pseudo_header.extend_from_slice(&src_ip.octets());
+            pseudo_header.extend_from_slice(&dst_ip.octets());
+            pseudo_header.extend_from_slice(&(segment.len() as u32).to_be_bytes());
+            pseudo_header.extend_from_slice(&[0, 0, 0, protocol]);
+        }
+        _ => unreachable!(
+            "packet from {} to {} mixes address families",
+            src_ip, dst_ip
+        ),
+    }
+    internet_checksum(&[&pseudo_header, segment])
+}
+
+/// Build a TCP RST+ACK refusing a connection
+fn build_tcp_reset(
+    src_ip: IpAddr,
+    dst_ip: IpAddr,
+    src_port: u16,
+    dst_port: u16,
+    ack_number: u32,
+) -> Vec<u8> {
+    let header_len = ip_header_len(src_ip);
+    let mut packet = vec![0u8; header_len + 20];
+    write_ip_header(&mut packet, 6, src_ip, dst_ip); // Protocol: TCP
+
+    let tcp = &mut packet[header_len..];
+    tcp[0..2].copy_from_slice(&src_port.to_be_bytes());
+    tcp[2..4].copy_from_slice(&dst_port.to_be_bytes());
+    tcp[8..12].copy_from_slice(&ack_number.to_be_bytes());
+    tcp[12] = 5 << 4; // Data offset: 20 bytes
+    tcp[13] = 0x14; // Flags: RST, ACK
+
+    let checksum = transport_checksum(6, src_ip, dst_ip, tcp);
+    tcp[16..18].copy_from_slice(&checksum.to_be_bytes());
 
     packet
 }
 
+/// Build an ICMP port unreachable for `original`, which `src_ip` refused
+fn build_port_unreachable(src_ip: IpAddr, dst_ip: IpAddr, original: &[u8]) -> Vec<u8> {
+    // Destination unreachable: port
+    let (kind, code) = match src_ip {
+        IpAddr::V4(_) => (3, 3),
+        IpAddr::V6(_) => (1, 4),
+    };
+    build_icmp_error(src_ip, dst_ip, kind, code, original)
+}
+
+/// Build an ICMP time exceeded for `original`, whose TTL ran out at `src_ip`
+fn build_time_exceeded(src_ip: IpAddr, dst_ip: IpAddr, original: &[u8]) -> Vec<u8> {
+    // Time exceeded: in transit
+    let kind = match src_ip {
+        IpAddr::V4(_) => 11,
+        IpAddr::V6(_) => 3,
+    };
+    build_icmp_error(src_ip, dst_ip, kind, 0, original)
+}
+
+fn build_icmp_error(
+    src_ip: IpAddr,
+    dst_ip: IpAddr,
+    kind: u8,
+    code: u8,
+    original: &[u8],
+) -> Vec<u8> {
+    let header_len = ip_header_len(src_ip);
+    let (protocol, quoted) = match src_ip {
+        // The original IP header and first 8 bytes of its payload are quoted
+        IpAddr::V4(_) => {
+            let original_header_len = ((original[0] & 0x0f) as usize) * 4;
+            (1, &original[..original.len().min(original_header_len + 8)])
+        }
+        // ICMPv6 quotes as much as fits in the minimum MTU
+        IpAddr::V6(_) => (
+            58,
+            &original[..original.len().min(IPV6_MIN_MTU - header_len - 8)],
+        ),
+    };
+
+    let mut packet = vec![0u8; header_len + 8 + quoted.len()];
+    write_ip_header(&mut packet, protocol, src_ip, dst_ip);
+
+    let icmp = &mut packet[header_len..];
+    icmp[0] = kind;
+    icmp[1] = code;
+    icmp[8..].copy_from_slice(quoted);
+    let checksum = transport_checksum(protocol, src_ip, dst_ip, icmp);
+    icmp[2..4].copy_from_slice(&checksum.to_be_bytes());
+
+    packet
+}
+
+/// One's complement checksum over `chunks`, each but the last of even length
+pub fn internet_checksum(chunks: &[&[u8]]) -> u16 {
+    let mut sum: u32 = 0;
+    for chunk in chunks {
+        for word in chunk.chunks(2) {
+            let high = (word[0] as u32) << 8;
+            sum = sum.wrapping_add(high | word.get(1).copied().unwrap_or(0) as u32);
+        }
+    }
+    while sum >> 16 != 0 {
+        sum = (sum & 0xFFFF) + (sum >> 16);
+    }
+    !(sum as u16)
+}
+
 fn ip_checksum(header: &[u8]) -> u16 {
     let mut sum: u32 = 0;
     for i in (0..header.len()).step_by(2) {
@@ -1458,13 +3462,130 @@ fn ip_checksum(header: &[u8]) -> u16 {
     !(sum as u16)
 }
 
-/// Start the dataplane with WireGuard IO
+/// Queues into the dataplane workers, each fed the packets of the peers it
+/// owns
+#[derive(Clone)]
+pub struct WorkerQueues {
+    senders: Vec<mpsc::Sender<WgToDataplane>>,
+}
+
+impl WorkerQueues {
+    /// Create queues for `workers` workers, returning the receiving ends to
+    /// pass to `run_dataplane`
+    pub fn new(workers: usize) -> (Self, Vec<mpsc::Receiver<WgToDataplane>>) {
+        let (senders, receivers) = (0..workers).map(|_| mpsc::channel(1000)).unzip();
+        (Self { senders }, receivers)
+    }
+
+    /// The queue of the worker owning `peer_pubkey`
+    pub fn for_peer(&self, peer_pubkey: &[u8; 32]) -> &mpsc::Sender<WgToDataplane> {
+        &self.senders[worker_for_peer(peer_pubkey, self.senders.len())]
+    }
+
+    pub fn senders(&self) -> &[mpsc::Sender<WgToDataplane>] {
+        &self.senders
+    }
+}
+
+/// Index of the worker owning a peer; public keys are uniformly random, so
+/// their leading bytes spread peers evenly
+fn worker_for_peer(peer_pubkey: &[u8; 32], workers: usize) -> usize {
+    let mut prefix = [0u8; 8];
+    prefix.copy_from_slice(&peer_pubkey[..8]);
+    (u64::from_le_bytes(prefix) % workers as u64) as usize
+}
+
+/// Move a gauge summed over workers from this worker's last reported size to
+/// its current one
+fn report_size(gauge: &AtomicU64, reported: u64, size: u64) {
+    gauge.fetch_add(size.wrapping_sub(reported), Ordering::Relaxed);
+}
+
+/// Start a dataplane worker for each queue in `from_wg`, returning when any
+/// of them stops. Port forward changes go to the worker owning the peer, and
+/// flow table requests are answered from all of them.
 pub async fn run_dataplane(
     wg_io: Arc<WgIo>,
-    from_wg: mpsc::Receiver<WgToDataplane>,
-    server_ip: Ipv4Addr,
-    port_forward_rx: mpsc::Receiver<PortForwardEvent>,
+    from_wg: Vec<mpsc::Receiver<WgToDataplane>>,
+    networks: Networks,
+    dns: Arc<DnsService>,
+    policy: FlowPolicy,
+    config: FlowConfig,
+    stats: TrafficStats,
+    mut port_forward_rx: mpsc::Receiver<PortForwardEvent>,
+    mut flow_table_rx: mpsc::Receiver<FlowTableRequest>,
 ) -> Result<()> {
-    let dataplane = Dataplane::new(wg_io, server_ip);
-    dataplane.run(from_wg, port_forward_rx).await
+    let mut workers = tokio::task::JoinSet::new();
+    let mut port_forward_txs = Vec::new();
+    let mut flow_table_txs = Vec::new();
+    let mut heartbeats = Vec::new();
+    let buffers = RelayBuffers::default();
+    let mut heartbeat_interval = tokio::time::interval(config.reap_interval());
+    for from_wg in from_wg {
+        let (port_forward_tx, port_forward_rx) = mpsc::channel(100);
+        let (flow_table_tx, flow_table_rx) = mpsc::channel(16);
+        let dataplane = Dataplane::new(
+            Arc::clone(&wg_io),
+            networks.clone(),
+            Arc::clone(&dns),
+            policy.clone(),
+            config.clone(),
+            stats.clone(),
+            buffers.clone(),
+        );
+        heartbeats.push(Arc::clone(&dataplane.heartbeat));
+        workers.spawn(dataplane.run(from_wg, port_forward_rx, flow_table_rx));
+        port_forward_txs.push(port_forward_tx);
+        flow_table_txs.push(flow_table_tx);
+    }
+    info!("Dataplane running {} worker(s)", port_forward_txs.len());
+
+    loop {
+        tokio::select! {
+            Some(result) = workers.join_next() => {
+                result.context("dataplane worker panicked")??;
+                anyhow::bail!("dataplane worker stopped");
+            }
+
+            Some(event) = port_forward_rx.recv() => {
+                match &event {
+                    PortForwardEvent::Added(rule) => {
+                        let worker = worker_for_peer(&rule.peer_pubkey, port_forward_txs.len());
+                        let _ = port_forward_txs[worker].send(event).await;
+                    }
+                    // Only the worker that started the listener has it to stop
+                    PortForwardEvent::Removed { .. } => {
+                        for tx in &port_forward_txs {
+                            let _ = tx.send(event.clone()).await;
+                        }
+                    }
+                }
+            }
+
+            Some(reply) = flow_table_rx.recv() => {
+                let mut flows = Vec::new();
+                for tx in &flow_table_txs {
+                    let (worker_reply, worker_flows) = oneshot::channel();
+                    if tx.send(worker_reply).await.is_ok() {
+                        flows.extend(worker_flows.await.unwrap_or_default());
+                    }
+                }
+                let _ = reply.send(flows);
+            }
+
+            // Health checks go by the worker longest without housekeeping
+            _ = heartbeat_interval.tick() => {
+                let oldest = heartbeats
+                    .iter()
+                    .map(|heartbeat| heartbeat.load(Ordering::Relaxed))
+                    .min()
+                    .unwrap_or(0);
+                if oldest > 0 {
+                    stats.metrics.dataplane_heartbeat.store(oldest, Ordering::Relaxed);
+                }
+            }
+
+            else => return Ok(()),
+        }
+    }
 }
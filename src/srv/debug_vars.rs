@@ -0,0 +1,65 @@
+//! Runtime counters for debugging a live server
+//!
+//! `GET /debug/vars` on the metrics listener returns a JSON document in the
+//! spirit of Go's expvar: the async runtime's worker and task counts, how
+//! many tasks each subsystem is running, the depth of the channels between
+//! subsystems, and the size of the dataplane's flow tables. Unlike
+//! `/metrics`, these are meant to be read by a person chasing a problem,
+//! not scraped.
+
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Arc;
+
+use axum::extract::State;
+use axum::Json;
+use serde_json::{json, Map, Value};
+
+use super::state::SharedState;
+use super::wg::WgIo;
+
+/// Handler for GET /debug/vars
+pub async fn vars_handler(
+    State((shared, _wg_io)): State<(Arc<SharedState>, Arc<WgIo>)>,
+) -> Json<Value> {
+    let metrics = &shared.metrics;
+    let load = |counter: &AtomicU64| counter.load(Ordering::Relaxed);
+
+    let runtime = tokio::runtime::Handle::current().metrics();
+    let workers: Vec<Value> = (0..runtime.num_workers())
+        .map(|worker| {
+            json!({
+                "busy_secs": runtime.worker_total_busy_duration(worker).as_secs_f64(),
+                "parks": runtime.worker_park_count(worker),
+            })
+        })
+        .collect();
+
+    let tasks: Map<String, Value> = metrics
+        .running_tasks()
+        .into_iter()
+        .map(|(task, running)| (task.label().to_string(), running.into()))
+        .collect();
+    let queues: Map<String, Value> = metrics
+        .queue_depths()
+        .into_iter()
+        .map(|(name, depth)| (name.to_string(), depth.into()))
+        .collect();
+
+    Json(json!({
+        "runtime": {
+            "workers": workers,
+            "alive_tasks": runtime.num_alive_tasks(),
+            "global_queue_depth": runtime.global_queue_depth(),
+        },
+        "tasks": tasks,
+        "queues": queues,
+        "flows": {
+            "tcp": load(&metrics.tcp_flows).saturating_sub(load(&metrics.inbound_tcp_flows)),
+            "inbound_tcp": load(&metrics.inbound_tcp_flows),
+            "udp": load(&metrics.udp_flows),
+            "smoltcp_sockets": load(&metrics.smoltcp_sockets),
+        },
+        "peers": shared.peers.read().iter().count(),
+        "event_subscribers": shared.events.subscriber_count(),
+    }))
+}
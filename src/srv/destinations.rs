@@ -0,0 +1,151 @@
+//! Per-destination traffic statistics
+//!
+//! Flows forwarded through the NAT are aggregated by peer and destination
+//! (protocol, address and port), counting flows opened and payload bytes in
+//! each direction, so operators can see what the network is used for.
+//! Destinations are labelled with the name a peer looked up to reach them
+//! when the server's DNS answered it. Statistics are kept in memory since
+//! startup, with the least recently used destinations forgotten once a peer
+//! has too many.
+
+use std::collections::HashMap;
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr};
+use std::time::Instant;
+
+use parking_lot::Mutex;
+
+use super::dns_wire::{self, TYPE_A, TYPE_AAAA};
+use super::flow::Protocol;
+use super::usage::Counters;
+
+/// Destinations tracked per peer
+const MAX_DESTINATIONS_PER_PEER: usize = 4096;
+/// Addresses remembered from DNS answers
+const MAX_NAMES: usize = 65536;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub struct Destination {
+    pub protocol: Protocol,
+    pub ip: IpAddr,
+    pub port: u16,
+}
+
+struct Entry {
+    counters: Counters,
+    last_seen: Instant,
+}
+
+/// A destination's totals with its name, if known
+pub struct DestinationSummary {
+    pub destination: Destination,
+    pub name: Option<String>,
+    pub counters: Counters,
+}
+
+#[derive(Default)]
+pub struct DestinationStats {
+    by_peer: Mutex<HashMap<[u8; 32], HashMap<Destination, Entry>>>,
+    names: Mutex<HashMap<IpAddr, (String, Instant)>>,
+}
+
+impl DestinationStats {
+    /// Add counts gathered by the dataplane
+    pub fn record(&self, counts: HashMap<([u8; 32], Destination), Counters>) {
+        if counts.is_empty() {
+            return;
+        }
+        let now = Instant::now();
+        let mut by_peer = self.by_peer.lock();
+        for ((peer, destination), counters) in counts {
+            let entries = by_peer.entry(peer).or_default();
+            if !entries.contains_key(&destination) && entries.len() >= MAX_DESTINATIONS_PER_PEER {
+                evict_oldest(entries, |entry| entry.last_seen);
+            }
+            let entry = entries.entry(destination).or_insert_with(|| Entry {
+                counters: Counters::default(),
+                last_seen: now,
+            });
+            entry.counters.add(&counters);
+            entry.last_seen = now;
+        }
+    }
+
+    /// Remember the addresses a DNS response resolved its question to
+    pub fn learn_names(&self, response: &[u8]) {
+        let (Some(question), Some(records)) = (
+            dns_wire::parse_question(response),
+            dns_wire::parse_records(response),
+        ) else {
+            return;
+        };
+        let addrs: Vec<IpAddr> = records
+            .answers
+            .iter()
+            .filter_map(|record| {
+                let rdata = &response[record.rdata..record.rdata + record.rdlen];
+                match record.rtype {
+                    TYPE_A => Some(IpAddr::V4(Ipv4Addr::from(<[u8; 4]>::try_from(rdata).ok()?))),
+                    TYPE_AAAA => Some(IpAddr::V6(Ipv6Addr::from(
+                        <[u8; 16]>::try_from(rdata).ok()?,
+                    ))),
+                    _ => None,
+                }
+            })
+            .collect();
+        if addrs.is_empty() {
+            return;
+        }
+        let now = Instant::now();
+        let mut names = self.names.lock();
+        for addr in addrs {
+            if !names.contains_key(&addr) && names.len() >= MAX_NAMES {
+                evict_oldest(&mut names, |(_, seen)| *seen);
+            }
+            names.insert(addr, (question.name.clone(), now));
+        }
+    }
+
+    /// The `limit` destinations of one peer, or all peers combined, with
+    /// the most bytes
+    pub fn top(&self, peer: Option<&[u8; 32]>, limit: usize) -> Vec<DestinationSummary> {
+        let mut totals: HashMap<Destination, Counters> = HashMap::new();
+        {
+            let by_peer = self.by_peer.lock();
+            let peers: Box<dyn Iterator<Item = &HashMap<Destination, Entry>>> = match peer {
+                Some(peer) => Box::new(by_peer.get(peer).into_iter()),
+                None => Box::new(by_peer.values()),
+            };
+            for entries in peers {
+                for (destination, entry) in entries {
+                    totals.entry(*destination).or_default().add(&entry.counters);
+                }
+            }
+        }
+
+        let mut totals: Vec<_> = totals.into_iter().collect();
+        totals.sort_by_key(|(_, counters)| std::cmp::Reverse(counters.total_bytes()));
+        totals.truncate(limit);
+        let names = self.names.lock();
+        totals
+            .into_iter()
+            .map(|(destination, counters)| DestinationSummary {
+                destination,
+                name: names.get(&destination.ip).map(|(name, _)| name.clone()),
+                counters,
+            })
+            .collect()
+    }
+}
+
+fn evict_oldest<K: Copy + Eq + std::hash::Hash, V>(
+    map: &mut HashMap<K, V>,
+    last_seen: impl Fn(&V) -> Instant,
+) {
+    if let Some(oldest) = map
+        .iter()
+        .min_by_key(|(_, value)| last_seen(value))
+        .map(|(key, _)| *key)
+    {
+        map.remove(&oldest);
+    }
+}
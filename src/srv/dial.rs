@@ -0,0 +1,128 @@
+//! Dialing outbound TCP connections
+//!
+//! Connections the server opens by host name, to upstream proxies and
+//! DNS-over-TLS resolvers, race the host's addresses with Happy Eyeballs
+//! (RFC 8305): IPv6 and IPv4 addresses are tried alternately, each a short
+//! delay after the last unless it failed sooner, and the first to connect
+//! wins. A host with a broken IPv6 route then costs 250ms rather than a
+//! connect timeout per address.
+//!
+//! Dials for peers' flows are bounded by `--egress-connect-timeout-secs` a
+//! try and retried `--egress-connect-retries` times with backoff, as a
+//! destination that just timed out often answers a moment later.
+
+use std::fmt;
+use std::future::Future;
+use std::io;
+use std::net::SocketAddr;
+use std::time::Duration;
+
+use futures::stream::{FuturesUnordered, StreamExt};
+use tokio::net::TcpStream;
+use tracing::debug;
+
+/// How long to wait on one address before also trying the next (RFC 8305
+/// recommends 250ms)
+const CONNECTION_ATTEMPT_DELAY: Duration = Duration::from_millis(250);
+
+/// Wait before the first retry, doubling for each one after
+const RETRY_BACKOFF: Duration = Duration::from_millis(200);
+
+/// Timeout and retries for dials on peers' behalf
+#[derive(Debug, Clone, Copy)]
+pub struct DialPolicy {
+    pub timeout: Duration,
+    pub retries: u32,
+}
+
+impl Default for DialPolicy {
+    fn default() -> Self {
+        Self {
+            timeout: Duration::from_secs(10),
+            retries: 0,
+        }
+    }
+}
+
+impl DialPolicy {
+    /// Run `dial` under the timeout, trying again on failure. Refusals by
+    /// policy are not retried.
+    pub async fn run<T, F, Fut>(&self, target: impl fmt::Display, mut dial: F) -> io::Result<T>
+    where
+        F: FnMut() -> Fut,
+        Fut: Future<Output = io::Result<T>>,
+    {
+        let mut backoff = RETRY_BACKOFF;
+        let mut attempt = 0;
+        loop {
+            let err = match tokio::time::timeout(self.timeout, dial()).await {
+                Ok(Ok(connection)) => return Ok(connection),
+                Ok(Err(e)) => e,
+                Err(_) => io::Error::new(
+                    io::ErrorKind::TimedOut,
+                    format!("connect to {} timed out", target),
+                ),
+            };
+            if attempt >= self.retries || err.kind() == io::ErrorKind::PermissionDenied {
+                return Err(err);
+            }
+            attempt += 1;
+            debug!(
+                "Dial to {} failed ({}), retrying in {:?}",
+                target, err, backoff
+            );
+            tokio::time::sleep(backoff).await;
+            backoff *= 2;
+        }
+    }
+}
+
+/// Connect to `host:port`, racing its addresses with Happy Eyeballs
+pub async fn connect_host(addr: &str) -> io::Result<TcpStream> {
+    let addrs: Vec<SocketAddr> = tokio::net::lookup_host(addr).await?.collect();
+    let mut remaining = interleave(addrs).into_iter();
+    let mut attempts = FuturesUnordered::new();
+    let mut last_err = None;
+    let mut start_next = true;
+    loop {
+        if start_next {
+            if let Some(addr) = remaining.next() {
+                attempts.push(TcpStream::connect(addr));
+            }
+            start_next = false;
+        }
+        if attempts.is_empty() {
+            return Err(last_err.unwrap_or_else(|| {
+                io::Error::new(
+                    io::ErrorKind::NotFound,
+                    format!("{} has no addresses", addr),
+                )
+            }));
+        }
+        let more = remaining.len() > 0;
+        tokio::select! {
+            Some(result) = attempts.next() => match result {
+                Ok(stream) => return Ok(stream),
+                Err(e) => {
+                    last_err = Some(e);
+                    start_next = true;
+                }
+            },
+            _ = tokio::time::sleep(CONNECTION_ATTEMPT_DELAY), if more => start_next = true,
+        }
+    }
+}
+
+/// Order addresses IPv6 first, alternating families (RFC 8305 section 4)
+fn interleave(addrs: Vec<SocketAddr>) -> Vec<SocketAddr> {
+    let (v6, v4): (Vec<_>, Vec<_>) = addrs.into_iter().partition(SocketAddr::is_ipv6);
+    let mut v6 = v6.into_iter();
+    let mut v4 = v4.into_iter();
+    let mut ordered = Vec::new();
+    loop {
+        match (v6.next(), v4.next()) {
+            (None, None) => return ordered,
+            (a, b) => ordered.extend(a.into_iter().chain(b)),
+        }
+    }
+}
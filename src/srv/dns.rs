@@ -0,0 +1,338 @@
+//! DNS service for wirecagesrv
+//!
+//! Answers queries sent to the server IP inside the VPN by forwarding them
+//! to upstream resolvers from the host network. Queries arrive over UDP or
+//! over TCP with RFC 1035 two-byte length framing. Answers are cached in
+//! memory according to their TTLs, and names on configured blocklists are
+//! answered locally, as are names of peers in the internal zone. Each peer
+//! is served by the resolver its DNS policy selects, chosen by public key or
+//! tag, subject to a per-peer query rate limit. For IPv6-only peers, AAAA
+//! queries for names with only A records get DNS64 answers (see
+//! [`nat64`](super::nat64)).
+
+use std::collections::HashMap;
+use std::sync::Arc;
+use std::time::Instant;
+
+use anyhow::{Context, Result};
+use parking_lot::RwLock;
+use tracing::debug;
+
+use super::dns_blocklist::Blocklist;
+use super::dns_cache::DnsCache;
+use super::dns_local::LocalZone;
+use super::dns_ratelimit::{Limit, RateLimiter};
+use super::dns_upstream::UpstreamPool;
+use super::dns_wire::{self, Question, HEADER_LEN};
+use super::metrics::DnsOutcome;
+use super::nat64;
+use super::state::SharedState;
+
+pub use super::dns_upstream::{frame, Transport};
+
+/// Port the DNS service listens on inside the VPN
+pub const DNS_PORT: u16 = 53;
+
+/// What a DNS policy overrides for its peers
+pub struct PeerPolicy {
+    pub name: String,
+    /// `None` means DNS is disabled for the peer
+    pub resolver: Option<Arc<Resolver>>,
+    pub rate_limit: Option<Limit>,
+}
+
+/// Per-peer DNS policies by public key and tag
+#[derive(Default)]
+pub struct Policies {
+    pub by_peer: HashMap<[u8; 32], Arc<PeerPolicy>>,
+    /// In file order, so the first policy naming one of a peer's tags wins
+    pub by_tag: Vec<(String, Arc<PeerPolicy>)>,
+    /// Policies in the file
+    pub count: usize,
+}
+
+/// How a peer's queries are answered
+pub struct PeerDns {
+    /// Name of the DNS policy selecting the peer, if one does
+    pub policy: Option<String>,
+    /// Each upstream and whether it is up; `None` if DNS is disabled for
+    /// the peer
+    pub upstreams: Option<Vec<(String, bool)>>,
+    pub blocklist: bool,
+    /// Query rate limit, if any
+    pub rate_limit: Option<Limit>,
+    /// Domain peers' names are served under
+    pub domain: String,
+}
+
+/// Routes each peer's queries to the resolver chosen by its DNS policy
+pub struct DnsService {
+    default: Arc<Resolver>,
+    policies: RwLock<Arc<Policies>>,
+    shared: Arc<SharedState>,
+    zone: LocalZone,
+    rate_limiter: RateLimiter,
+}
+
+impl DnsService {
+    pub fn new(
+        default: Arc<Resolver>,
+        policies: Policies,
+        shared: Arc<SharedState>,
+        zone: LocalZone,
+        rate_limiter: RateLimiter,
+    ) -> Self {
+        Self {
+            default,
+            policies: RwLock::new(Arc::new(policies)),
+            shared,
+            zone,
+            rate_limiter,
+        }
+    }
+
+    /// The upstreams of the default resolver
+    pub fn upstreams(&self) -> &UpstreamPool {
+        self.default.upstreams()
+    }
+
+    /// The server-wide query rate limit, which policies' bursts default to
+    pub fn default_rate_limit(&self) -> Option<Limit> {
+        self.rate_limiter.default_limit()
+    }
+
+    /// Replace the per-peer policies; queries already in flight finish
+    /// under the old ones
+    pub fn set_policies(&self, policies: Policies) {
+        *self.policies.write() = Arc::new(policies);
+    }
+
+    /// The policy for a peer: its own listing, else the first matching tag
+    fn policy_for(&self, peer_pubkey: &[u8; 32]) -> Option<Arc<PeerPolicy>> {
+        let policies = Arc::clone(&self.policies.read());
+        if let Some(policy) = policies.by_peer.get(peer_pubkey) {
+            return Some(Arc::clone(policy));
+        }
+        if policies.by_tag.is_empty() {
+            return None;
+        }
+        let tags = self.shared.peer_tags(peer_pubkey);
+        policies
+            .by_tag
+            .iter()
+            .find(|(tag, _)| tags.contains(tag))
+            .map(|(_, policy)| Arc::clone(policy))
+    }
+
+    /// How the peer's queries are answered, for the status page
+    pub fn describe(&self, peer_pubkey: &[u8; 32]) -> PeerDns {
+        let policy = self.policy_for(peer_pubkey);
+        let resolver = match &policy {
+            Some(policy) => policy.resolver.as_ref(),
+            None => Some(&self.default),
+        };
+        let rate_limit = policy
+            .as_ref()
+            .and_then(|policy| policy.rate_limit)
+            .or(self.rate_limiter.default_limit())
+            .filter(|limit| limit.rate > 0.0);
+        PeerDns {
+            policy: policy.as_ref().map(|policy| policy.name.clone()),
+            upstreams: resolver.map(|resolver| resolver.upstreams().status()),
+            blocklist: resolver.is_some_and(|resolver| resolver.blocklist.is_some()),
+            rate_limit,
+            domain: self.zone.domain().to_string(),
+        }
+    }
+
+    /// Resolve a query on behalf of a peer
+    pub async fn resolve(
+        &self,
+        peer_pubkey: &[u8; 32],
+        query: &[u8],
+        transport: Transport,
+    ) -> Result<Vec<u8>> {
+        let started = Instant::now();
+        let (outcome, response) = self.answer(peer_pubkey, query, transport).await;
+        self.shared
+            .metrics
+            .record_dns_query(outcome, started.elapsed());
+        response
+    }
+
+    async fn answer(
+        &self,
+        peer_pubkey: &[u8; 32],
+        query: &[u8],
+        transport: Transport,
+    ) -> (DnsOutcome, Result<Vec<u8>>) {
+        let policy = self.policy_for(peer_pubkey);
+        let rate_limit = policy.as_ref().and_then(|policy| policy.rate_limit);
+        if !self.rate_limiter.check(peer_pubkey, rate_limit) {
+            return (
+                DnsOutcome::RateLimited,
+                local_error(query, self.rate_limiter.response().rcode()),
+            );
+        }
+
+        let resolver = match policy.as_deref() {
+            Some(PeerPolicy {
+                resolver: Some(resolver),
+                ..
+            }) => resolver,
+            Some(PeerPolicy { resolver: None, .. }) => {
+                return (
+                    DnsOutcome::Refused,
+                    local_error(query, dns_wire::RCODE_REFUSED),
+                )
+            }
+            None => &self.default,
+        };
+
+        let question = dns_wire::parse_question(query);
+        if let Some(question) = &question {
+            if let Some(response) = self.zone.answer(query, question) {
+                return (DnsOutcome::Local, Ok(response));
+            }
+        }
+        match resolver.resolve(query, transport).await {
+            Ok(response) => match question {
+                Some(question)
+                    if self.shared.config.ipv6_only
+                        && nat64::wants_synthesis(&question, &response) =>
+                {
+                    let response = self
+                        .synthesize_aaaa(resolver, query, &question, transport)
+                        .await
+                        .unwrap_or(response);
+                    (DnsOutcome::Forwarded, Ok(response))
+                }
+                _ => (DnsOutcome::Forwarded, Ok(response)),
+            },
+            Err(e) => (DnsOutcome::Failed, Err(e)),
+        }
+    }
+
+    /// DNS64: look up the A records of a name without AAAA records and
+    /// answer with them in the NAT64 prefix, for IPv6-only peers
+    async fn synthesize_aaaa(
+        &self,
+        resolver: &Resolver,
+        query: &[u8],
+        question: &Question,
+        transport: Transport,
+    ) -> Option<Vec<u8>> {
+        let a_query = dns_wire::build_query(dns_wire::id(query), &question.name, dns_wire::TYPE_A);
+        match resolver.resolve(&a_query, transport).await {
+            Ok(a_response) => nat64::synthesize(query, question, &a_response),
+            Err(e) => {
+                debug!("DNS64 lookup of {} failed: {:#}", question.name, e);
+                None
+            }
+        }
+    }
+}
+
+/// Answer a query locally with an error rcode and no records
+fn local_error(query: &[u8], rcode: u8) -> Result<Vec<u8>> {
+    let question = dns_wire::parse_question(query).context("malformed DNS query")?;
+    Ok(dns_wire::build_response(query, &question, rcode, &[]))
+}
+
+/// Forwards client DNS queries to upstream resolvers
+pub struct Resolver {
+    upstreams: UpstreamPool,
+    cache: DnsCache,
+    blocklist: Option<Arc<Blocklist>>,
+}
+
+impl Resolver {
+    pub fn new(
+        upstreams: UpstreamPool,
+        cache_size: usize,
+        blocklist: Option<Arc<Blocklist>>,
+    ) -> Self {
+        Self {
+            upstreams,
+            cache: DnsCache::new(cache_size),
+            blocklist,
+        }
+    }
+
+    /// The upstreams this resolver forwards to
+    pub fn upstreams(&self) -> &UpstreamPool {
+        &self.upstreams
+    }
+
+    /// Resolve a single DNS query message, returning the raw response.
+    ///
+    /// Truncated UDP answers are passed through to UDP clients so they retry
+    /// over TCP; TCP clients get the full answer re-queried over TCP upstream.
+    pub async fn resolve(&self, query: &[u8], transport: Transport) -> Result<Vec<u8>> {
+        if query.len() < HEADER_LEN {
+            anyhow::bail!("DNS query too short");
+        }
+
+        let question = dns_wire::parse_question(query);
+        if let Some(question) = &question {
+            if let Some(blocklist) = &self.blocklist {
+                if blocklist.is_blocked(&question.name) {
+                    debug!("Blocked DNS query for {}", question.name);
+                    return Ok(blocklist.blocked_response(query, question));
+                }
+            }
+            if let Some(cached) = self.cache.get(question, dns_wire::id(query)) {
+                return Ok(fit_transport(query, cached, transport));
+            }
+        }
+
+        let response = self.upstreams.exchange(query, transport).await?;
+        if let Some(question) = &question {
+            self.cache.insert(question, &response);
+        }
+        Ok(fit_transport(query, response, transport))
+    }
+}
+
+/// Adapt an upstream answer to what the querier asked for: drop the EDNS0
+/// record we added on its behalf and truncate past its UDP limit
+fn fit_transport(query: &[u8], response: Vec<u8>, transport: Transport) -> Vec<u8> {
+    let response = if dns_wire::has_edns(query) {
+        response
+    } else {
+        dns_wire::strip_edns(&response)
+    };
+    if transport == Transport::Tcp || response.len() <= dns_wire::udp_payload_limit(query) {
+        return response;
+    }
+    match dns_wire::parse_question(&response) {
+        Some(question) => dns_wire::truncate(&response, question.end),
+        None => response,
+    }
+}
+
+/// Reassembles length-prefixed DNS messages from a TCP byte stream
+#[derive(Default)]
+pub struct TcpFramer {
+    buf: Vec<u8>,
+}
+
+impl TcpFramer {
+    pub fn push(&mut self, data: &[u8]) {
+        self.buf.extend_from_slice(data);
+    }
+
+    /// Pop the next complete message, if one has fully arrived
+    pub fn next_message(&mut self) -> Option<Vec<u8>> {
+        if self.buf.len() < 2 {
+            return None;
+        }
+        let len = u16::from_be_bytes([self.buf[0], self.buf[1]]) as usize;
+        if self.buf.len() < 2 + len {
+            return None;
+        }
+        let message = self.buf[2..2 + len].to_vec();
+        self.buf.drain(..2 + len);
+        Some(message)
+    }
+}
@@ -0,0 +1,168 @@
+//! Domain blocklists for the wirecagesrv DNS service
+//!
+//! Lists are loaded from files or http(s) URLs in either hosts format
+//! (`0.0.0.0 ads.example.com`) or plain one-domain-per-line format, and are
+//! refreshed periodically. Blocking a domain also blocks its subdomains.
+
+use std::collections::HashSet;
+use std::sync::Arc;
+use std::time::Duration;
+
+use anyhow::{Context, Result};
+use parking_lot::RwLock;
+use tracing::{info, warn};
+
+use super::dns_wire::{self, Answer, Question, RCODE_NOERROR, RCODE_NXDOMAIN, TYPE_A, TYPE_AAAA};
+
+const BLOCKED_TTL: u32 = 60;
+
+/// How blocked names are answered
+#[derive(Debug, Clone, Copy, PartialEq, Eq, clap::ValueEnum, serde::Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum BlockMode {
+    /// Answer NXDOMAIN
+    Nxdomain,
+    /// Answer 0.0.0.0 / :: for address queries
+    Null,
+}
+
+pub struct Blocklist {
+    sources: Vec<String>,
+    mode: BlockMode,
+    domains: RwLock<HashSet<String>>,
+}
+
+impl Blocklist {
+    /// Load every source once; fails if none of them could be loaded
+    pub async fn load(sources: Vec<String>, mode: BlockMode) -> Result<Arc<Self>> {
+        let blocklist = Arc::new(Self {
+            sources,
+            mode,
+            domains: RwLock::new(HashSet::new()),
+        });
+        blocklist.refresh().await?;
+        Ok(blocklist)
+    }
+
+    /// Reload all sources, keeping the previous list for any that fail
+    pub async fn refresh(&self) -> Result<()> {
+        let mut domains = HashSet::new();
+        let mut loaded = 0;
+
+        for source in &self.sources {
+            match fetch_source(source).await {
+                Ok(text) => {
+                    domains.extend(parse_list(&text));
+                    loaded += 1;
+                }
+                Err(e) => warn!("Failed to load DNS blocklist {}: {:#}", source, e),
+            }
+        }
+
+        if loaded == 0 {
+            anyhow::bail!("no DNS blocklist sources could be loaded");
+        }
+        if loaded < self.sources.len() {
+            // Merge with what we had so a flaky source doesn't unblock names
+            domains.extend(self.domains.read().iter().cloned());
+        }
+
+        info!("Loaded {} blocked domains from {} lists", domains.len(), loaded);
+        *self.domains.write() = domains;
+        Ok(())
+    }
+
+    /// Refresh the lists in the background every `interval`, until the
+    /// blocklist is dropped when a reload replaces it
+    pub fn spawn_refresh(self: &Arc<Self>, interval: Duration) {
+        let blocklist = Arc::downgrade(self);
+        tokio::spawn(async move {
+            let mut ticker = tokio::time::interval(interval);
+            ticker.tick().await;
+            loop {
+                ticker.tick().await;
+                let Some(blocklist) = blocklist.upgrade() else {
+                    return;
+                };
+                if let Err(e) = blocklist.refresh().await {
+                    warn!("DNS blocklist refresh failed: {:#}", e);
+                }
+            }
+        });
+    }
+
+    /// Whether the name or any of its parent domains is blocked
+    pub fn is_blocked(&self, name: &str) -> bool {
+        contains_domain(&self.domains.read(), name)
+    }
+
+    /// Answer for a blocked question
+    pub fn blocked_response(&self, query: &[u8], question: &Question) -> Vec<u8> {
+        match self.mode {
+            BlockMode::Nxdomain => dns_wire::build_response(query, question, RCODE_NXDOMAIN, &[]),
+            BlockMode::Null => {
+                let rdata = match question.qtype {
+                    TYPE_A => vec![0; 4],
+                    TYPE_AAAA => vec![0; 16],
+                    _ => return dns_wire::build_response(query, question, RCODE_NOERROR, &[]),
+                };
+                let answer = Answer {
+                    rtype: question.qtype,
+                    ttl: BLOCKED_TTL,
+                    rdata,
+                };
+                dns_wire::build_response(query, question, RCODE_NOERROR, &[answer])
+            }
+        }
+    }
+}
+
+/// Whether `name` or any of its parent domains is in `domains`
+pub fn contains_domain(domains: &HashSet<String>, name: &str) -> bool {
+    let mut candidate = name;
+    loop {
+        if domains.contains(candidate) {
+            return true;
+        }
+        match candidate.split_once('.') {
+            Some((_, parent)) => candidate = parent,
+            None => return false,
+        }
+    }
+}
+
+/// Read a list from a file or http(s) URL
+pub async fn fetch_source(source: &str) -> Result<String> {
+    if source.starts_with("http://") || source.starts_with("https://") {
+        let response = reqwest::get(source)
+            .await
+            .context("request failed")?
+            .error_for_status()
+            .context("bad response status")?;
+        return response.text().await.context("failed to read response body");
+    }
+
+    tokio::fs::read_to_string(source)
+        .await
+        .context("failed to read file")
+}
+
+/// Parse a hosts-format or plain domain list
+pub fn parse_list(text: &str) -> impl Iterator<Item = String> + '_ {
+    text.lines().filter_map(|line| {
+        let line = line.split('#').next().unwrap_or_default().trim();
+        let mut fields = line.split_whitespace();
+        let first = fields.next()?;
+        // Hosts format puts the address first
+        let domain = if first.parse::<std::net::IpAddr>().is_ok() {
+            fields.next()?
+        } else {
+            first
+        };
+        let domain = domain.trim_end_matches('.').to_ascii_lowercase();
+        if !domain.contains('.') || domain.parse::<std::net::IpAddr>().is_ok() {
+            return None;
+        }
+        Some(domain)
+    })
+}
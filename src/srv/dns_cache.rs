@@ -0,0 +1,130 @@
+//! In-memory DNS answer cache
+//!
+//! Entries are keyed by question and expire with the smallest record TTL
+//! (or the SOA minimum for negative answers). Cached answers are served with
+//! TTLs aged by the time spent in the cache.
+
+use std::collections::HashMap;
+use std::time::{Duration, Instant};
+
+use parking_lot::Mutex;
+
+use super::dns_wire::{self, Question, TtlField, RCODE_NOERROR, RCODE_NXDOMAIN};
+
+const MAX_TTL_SECS: u32 = 86_400;
+const MAX_NEGATIVE_TTL_SECS: u32 = 3_600;
+
+#[derive(Debug, Clone, PartialEq, Eq, Hash)]
+struct CacheKey {
+    name: String,
+    qtype: u16,
+    qclass: u16,
+}
+
+impl From<&Question> for CacheKey {
+    fn from(question: &Question) -> Self {
+        Self {
+            name: question.name.clone(),
+            qtype: question.qtype,
+            qclass: question.qclass,
+        }
+    }
+}
+
+struct CacheEntry {
+    response: Vec<u8>,
+    ttl_fields: Vec<TtlField>,
+    inserted: Instant,
+    expires: Instant,
+}
+
+pub struct DnsCache {
+    entries: Mutex<HashMap<CacheKey, CacheEntry>>,
+    max_entries: usize,
+}
+
+impl DnsCache {
+    pub fn new(max_entries: usize) -> Self {
+        Self {
+            entries: Mutex::new(HashMap::new()),
+            max_entries,
+        }
+    }
+
+    /// Look up a cached answer, rewritten for the querier's ID
+    pub fn get(&self, question: &Question, query_id: u16) -> Option<Vec<u8>> {
+        let key = CacheKey::from(question);
+        let now = Instant::now();
+        let mut entries = self.entries.lock();
+
+        let entry = entries.get(&key)?;
+        if entry.expires <= now {
+            entries.remove(&key);
+            return None;
+        }
+
+        let elapsed = now.duration_since(entry.inserted).as_secs() as u32;
+        let mut response = entry.response.clone();
+        dns_wire::set_id(&mut response, query_id);
+        dns_wire::write_ttls(&mut response, &entry.ttl_fields, elapsed);
+        Some(response)
+    }
+
+    /// Cache an upstream answer if it is cacheable
+    pub fn insert(&self, question: &Question, response: &[u8]) {
+        if self.max_entries == 0 || dns_wire::is_truncated(response) {
+            return;
+        }
+        let Some(ttl) = cache_ttl(response) else {
+            return;
+        };
+        if ttl == 0 {
+            return;
+        }
+        let Some(records) = dns_wire::parse_records(response) else {
+            return;
+        };
+
+        let now = Instant::now();
+        let entry = CacheEntry {
+            response: response.to_vec(),
+            ttl_fields: dns_wire::ttl_fields(&records),
+            inserted: now,
+            expires: now + Duration::from_secs(ttl as u64),
+        };
+
+        let mut entries = self.entries.lock();
+        if entries.len() >= self.max_entries {
+            entries.retain(|_, entry| entry.expires > now);
+        }
+        if entries.len() >= self.max_entries {
+            // Still full of live answers: evict whichever expires soonest
+            if let Some(victim) = entries
+                .iter()
+                .min_by_key(|(_, entry)| entry.expires)
+                .map(|(key, _)| key.clone())
+            {
+                entries.remove(&victim);
+            }
+        }
+        entries.insert(CacheKey::from(question), entry);
+    }
+}
+
+/// How long an answer may be cached, or `None` if it must not be
+fn cache_ttl(response: &[u8]) -> Option<u32> {
+    let records = dns_wire::parse_records(response)?;
+    let rcode = dns_wire::rcode(response);
+
+    if rcode == RCODE_NOERROR && !records.answers.is_empty() {
+        let ttl = records.answers.iter().map(|r| r.ttl.ttl).min()?;
+        return Some(ttl.min(MAX_TTL_SECS));
+    }
+
+    if rcode == RCODE_NXDOMAIN || rcode == RCODE_NOERROR {
+        let ttl = dns_wire::negative_ttl(response, &records)?;
+        return Some(ttl.min(MAX_NEGATIVE_TTL_SECS));
+    }
+
+    None
+}
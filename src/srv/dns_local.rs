@@ -0,0 +1,117 @@
+//! Internal DNS zone for peers
+//!
+//! Peers that register with a name are reachable as `<name>.<domain>`
+//! (`cage.internal` by default), at their IPv6 address too when they have
+//! one, and reverse lookups for addresses in the VPN's networks return
+//! those names. Queries under the domain or for reverse names in the
+//! networks are always answered locally and never forwarded upstream.
+
+use std::net::Ipv4Addr;
+use std::sync::Arc;
+
+use super::dns_wire::{
+    self, Answer, Question, RCODE_NOERROR, RCODE_NXDOMAIN, TYPE_A, TYPE_AAAA, TYPE_PTR,
+};
+use super::state::SharedState;
+
+const LOCAL_TTL: u32 = 60;
+
+pub struct LocalZone {
+    domain: String,
+    shared: Arc<SharedState>,
+}
+
+impl LocalZone {
+    pub fn new(domain: &str, shared: Arc<SharedState>) -> Self {
+        Self {
+            domain: domain.trim_matches('.').to_ascii_lowercase(),
+            shared,
+        }
+    }
+
+    /// The zone's domain, without dots at either end
+    pub fn domain(&self) -> &str {
+        &self.domain
+    }
+
+    /// Answer the question if it falls inside the zone
+    pub fn answer(&self, query: &[u8], question: &Question) -> Option<Vec<u8>> {
+        if let Some(ip) = parse_reverse_name(&question.name) {
+            return self.answer_reverse(query, question, ip);
+        }
+        if question.name == self.domain {
+            return Some(dns_wire::build_response(query, question, RCODE_NOERROR, &[]));
+        }
+        let label = question
+            .name
+            .strip_suffix(self.domain.as_str())?
+            .strip_suffix('.')?;
+
+        let assigned_ip = self
+            .shared
+            .peers
+            .read()
+            .get_by_name(label)
+            .map(|peer| peer.assigned_ip);
+        let Some(assigned_ip) = assigned_ip else {
+            return Some(dns_wire::build_response(query, question, RCODE_NXDOMAIN, &[]));
+        };
+
+        // AAAA records are the peer's address in the IPv6 prefix, if peers
+        // have one; other types get an empty answer
+        let config = &self.shared.config;
+        let rdata = match (question.qtype, config.ipv6_prefix) {
+            (TYPE_A, _) if !config.ipv6_only => Some(assigned_ip.octets().to_vec()),
+            (TYPE_AAAA, Some(prefix)) => Some(prefix.address_for(assigned_ip).octets().to_vec()),
+            _ => None,
+        };
+        let answers: Vec<Answer> = rdata
+            .into_iter()
+            .map(|rdata| Answer {
+                rtype: question.qtype,
+                ttl: LOCAL_TTL,
+                rdata,
+            })
+            .collect();
+        Some(dns_wire::build_response(query, question, RCODE_NOERROR, &answers))
+    }
+
+    fn answer_reverse(&self, query: &[u8], question: &Question, ip: Ipv4Addr) -> Option<Vec<u8>> {
+        self.shared.config.networks.containing(ip)?;
+
+        let name = self
+            .shared
+            .peers
+            .read()
+            .get_by_ip(&ip)
+            .and_then(|peer| peer.name.clone());
+        let Some(name) = name else {
+            return Some(dns_wire::build_response(query, question, RCODE_NXDOMAIN, &[]));
+        };
+
+        let answers = if question.qtype == TYPE_PTR {
+            vec![Answer {
+                rtype: TYPE_PTR,
+                ttl: LOCAL_TTL,
+                rdata: dns_wire::encode_name(&format!("{}.{}", name, self.domain)),
+            }]
+        } else {
+            Vec::new()
+        };
+        Some(dns_wire::build_response(query, question, RCODE_NOERROR, &answers))
+    }
+}
+
+/// Parse a full `d.c.b.a.in-addr.arpa` name into its address
+fn parse_reverse_name(name: &str) -> Option<Ipv4Addr> {
+    let octets = name.strip_suffix(".in-addr.arpa")?;
+    let mut parts = octets.split('.').rev();
+    let mut address = [0u8; 4];
+    for octet in &mut address {
+        *octet = parts.next()?.parse().ok()?;
+    }
+    if parts.next().is_some() {
+        return None;
+    }
+    Some(Ipv4Addr::from(address))
+}
@@ -0,0 +1,250 @@
+//! Per-peer DNS policy for wirecagesrv
+//!
+//! A TOML policy file assigns groups of peers (by public key or tag) their
+//! own upstreams, blocklists and query rate limit, or disables DNS for them
+//! entirely:
+//!
+//! ```toml
+//! [[policy]]
+//! name = "ci"
+//! peers = ["<base64 public key>"]
+//! upstreams = ["tls://one.one.one.one"]
+//! blocklists = ["/etc/wirecage/ci-blocklist.txt"]
+//!
+//! [[policy]]
+//! name = "offline"
+//! peers = ["<base64 public key>"]
+//! disabled = true
+//!
+//! [[policy]]
+//! name = "build-farm"
+//! tags = ["builders"]
+//! rate_limit = 200
+//! rate_burst = 500
+//! ```
+//!
+//! A peer listed by key gets that policy; otherwise it gets the first policy
+//! in the file naming one of its tags. Peers no policy selects use the
+//! server-wide DNS flags. Omitted fields in a policy inherit the server-wide
+//! value, and a `rate_limit` of 0 lifts the limit. The file is re-read on
+//! SIGHUP or `POST /v1/reload`.
+
+use std::sync::Arc;
+use std::time::Duration;
+
+use anyhow::{Context, Result};
+use base64::Engine;
+use serde::Deserialize;
+use tracing::info;
+
+use super::dns::{DnsService, PeerPolicy, Policies, Resolver};
+use super::dns_blocklist::{BlockMode, Blocklist};
+use super::dns_local::LocalZone;
+use super::dns_ratelimit::{Limit, RateLimiter};
+use super::dns_upstream::{QueryPolicy, Upstream, UpstreamPool};
+use super::state::SharedState;
+
+/// Resolver configuration, either server-wide or for one policy
+#[derive(Debug, Clone)]
+pub struct ResolverSettings {
+    pub upstreams: Vec<String>,
+    pub query_policy: QueryPolicy,
+    pub cache_size: usize,
+    pub blocklists: Vec<String>,
+    pub block_mode: BlockMode,
+    pub blocklist_refresh: Duration,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct PolicyFile {
+    #[serde(default)]
+    policy: Vec<PolicyEntry>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct PolicyEntry {
+    name: String,
+    #[serde(default)]
+    peers: Vec<String>,
+    #[serde(default)]
+    tags: Vec<String>,
+    #[serde(default)]
+    disabled: bool,
+    upstreams: Option<Vec<String>>,
+    blocklists: Option<Vec<String>>,
+    block_mode: Option<BlockMode>,
+    rate_limit: Option<f64>,
+    rate_burst: Option<u32>,
+}
+
+/// Build a resolver from its settings, loading any blocklists
+pub async fn build_resolver(settings: &ResolverSettings) -> Result<Arc<Resolver>> {
+    let mut upstreams = Vec::new();
+    for spec in &settings.upstreams {
+        upstreams.push(Upstream::parse(spec)?);
+    }
+    let pool = UpstreamPool::new(upstreams, settings.query_policy)?;
+
+    let blocklist = if settings.blocklists.is_empty() {
+        None
+    } else {
+        let blocklist = Blocklist::load(settings.blocklists.clone(), settings.block_mode)
+            .await
+            .context("failed to load DNS blocklists")?;
+        blocklist.spawn_refresh(settings.blocklist_refresh);
+        Some(blocklist)
+    };
+
+    Ok(Arc::new(Resolver::new(pool, settings.cache_size, blocklist)))
+}
+
+/// Build the DNS service from server-wide settings, an optional policy file,
+/// the internal peer zone and the per-peer rate limiter
+pub async fn build_service(
+    defaults: &ResolverSettings,
+    policy_path: Option<&str>,
+    shared: Arc<SharedState>,
+    zone: LocalZone,
+    rate_limiter: RateLimiter,
+) -> Result<Arc<DnsService>> {
+    let default = build_resolver(defaults).await?;
+    let policies = match policy_path {
+        Some(path) => load_policies(defaults, path, rate_limiter.default_limit()).await?,
+        None => Policies::default(),
+    };
+    Ok(Arc::new(DnsService::new(
+        default,
+        policies,
+        shared,
+        zone,
+        rate_limiter,
+    )))
+}
+
+/// Re-reads the policy file into a running DNS service
+pub struct PolicyReloader {
+    defaults: ResolverSettings,
+    path: String,
+    service: Arc<DnsService>,
+}
+
+impl PolicyReloader {
+    pub fn new(defaults: ResolverSettings, path: String, service: Arc<DnsService>) -> Self {
+        Self {
+            defaults,
+            path,
+            service,
+        }
+    }
+
+    /// Re-read the policy file, keeping the current policies if it is
+    /// invalid. Returns the number of policies.
+    pub async fn reload(&self) -> Result<usize> {
+        let policies = load_policies(
+            &self.defaults,
+            &self.path,
+            self.service.default_rate_limit(),
+        )
+        .await?;
+        let count = policies.count;
+        self.service.set_policies(policies);
+        info!("Reloaded {} DNS policies from {}", count, self.path);
+        Ok(count)
+    }
+}
+
+async fn load_policies(
+    defaults: &ResolverSettings,
+    path: &str,
+    default_limit: Option<Limit>,
+) -> Result<Policies> {
+    let contents = tokio::fs::read_to_string(path)
+        .await
+        .with_context(|| format!("failed to read DNS policy file {}", path))?;
+    let file: PolicyFile = toml::from_str(&contents)
+        .with_context(|| format!("failed to parse DNS policy file {}", path))?;
+
+    let mut policies = Policies::default();
+    for entry in file.policy {
+        if entry.peers.is_empty() && entry.tags.is_empty() {
+            anyhow::bail!("DNS policy `{}` lists no peers or tags", entry.name);
+        }
+        let rate_limit = match (entry.rate_limit, entry.rate_burst) {
+            (Some(rate), burst) => Some(Limit {
+                rate,
+                burst: burst
+                    .or(default_limit.map(|limit| limit.burst))
+                    .unwrap_or(rate.ceil() as u32),
+            }),
+            (None, Some(_)) => anyhow::bail!(
+                "DNS policy `{}` sets rate_burst without rate_limit",
+                entry.name
+            ),
+            (None, None) => None,
+        };
+        let resolver = if entry.disabled {
+            None
+        } else {
+            let mut settings = defaults.clone();
+            if let Some(upstreams) = entry.upstreams {
+                settings.upstreams = upstreams;
+            }
+            if let Some(blocklists) = entry.blocklists {
+                settings.blocklists = blocklists;
+            }
+            if let Some(block_mode) = entry.block_mode {
+                settings.block_mode = block_mode;
+            }
+            Some(
+                build_resolver(&settings)
+                    .await
+                    .with_context(|| format!("invalid DNS policy `{}`", entry.name))?,
+            )
+        };
+
+        let policy = Arc::new(PeerPolicy {
+            name: entry.name.clone(),
+            resolver,
+            rate_limit,
+        });
+        for peer in &entry.peers {
+            let pubkey = decode_public_key(peer)
+                .with_context(|| format!("invalid peer key in DNS policy `{}`", entry.name))?;
+            if policies
+                .by_peer
+                .insert(pubkey, Arc::clone(&policy))
+                .is_some()
+            {
+                anyhow::bail!("peer {} appears in more than one DNS policy", peer);
+            }
+        }
+        for tag in &entry.tags {
+            policies.by_tag.push((tag.clone(), Arc::clone(&policy)));
+        }
+        policies.count += 1;
+
+        info!(
+            "Loaded DNS policy `{}` for {} peers and {} tags{}",
+            entry.name,
+            entry.peers.len(),
+            entry.tags.len(),
+            if entry.disabled {
+                " (DNS disabled)"
+            } else {
+                ""
+            }
+        );
+    }
+    Ok(policies)
+}
+
+fn decode_public_key(key: &str) -> Result<[u8; 32]> {
+    let bytes = base64::engine::general_purpose::STANDARD
+        .decode(key.trim())
+        .context("not valid base64")?;
+    bytes
+        .try_into()
+        .map_err(|_| anyhow::anyhow!("public key must be 32 bytes"))
+}
@@ -0,0 +1,124 @@
+//! Per-peer DNS query rate limiting
+//!
+//! Each peer gets a token bucket refilled at a fixed rate. Queries over the
+//! limit are answered locally with REFUSED or SERVFAIL instead of being
+//! forwarded, so one peer cannot use the DNS service for amplification or
+//! exhaust upstream quota. DNS policies can give their peers a different
+//! limit than the server-wide one.
+
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::Instant;
+
+use base64::Engine;
+use parking_lot::Mutex;
+use tracing::{info, warn};
+
+use super::dns_wire::{RCODE_REFUSED, RCODE_SERVFAIL};
+
+/// How rate-limited queries are answered
+#[derive(Debug, Clone, Copy, PartialEq, Eq, clap::ValueEnum)]
+pub enum LimitResponse {
+    Refused,
+    Servfail,
+}
+
+impl LimitResponse {
+    pub fn rcode(self) -> u8 {
+        match self {
+            LimitResponse::Refused => RCODE_REFUSED,
+            LimitResponse::Servfail => RCODE_SERVFAIL,
+        }
+    }
+}
+
+/// A query rate and burst size
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct Limit {
+    /// Queries per second; zero or less means unlimited
+    pub rate: f64,
+    pub burst: u32,
+}
+
+struct Bucket {
+    tokens: f64,
+    updated: Instant,
+    /// Queries dropped since the peer went over its limit
+    dropped: u64,
+}
+
+pub struct RateLimiter {
+    default: Option<Limit>,
+    response: LimitResponse,
+    buckets: Mutex<HashMap<[u8; 32], Bucket>>,
+    limited_total: AtomicU64,
+}
+
+impl RateLimiter {
+    /// Limit peers to `default` unless their policy says otherwise;
+    /// without a default, only peers with a policy limit are limited
+    pub fn new(default: Option<Limit>, response: LimitResponse) -> Self {
+        Self {
+            default,
+            response,
+            buckets: Mutex::new(HashMap::new()),
+            limited_total: AtomicU64::new(0),
+        }
+    }
+
+    pub fn default_limit(&self) -> Option<Limit> {
+        self.default
+    }
+
+    pub fn response(&self) -> LimitResponse {
+        self.response
+    }
+
+    /// Take a token for one query from the peer, returning false if limited.
+    /// `limit` is the peer's policy limit, if it has one.
+    pub fn check(&self, peer_pubkey: &[u8; 32], limit: Option<Limit>) -> bool {
+        let Some(limit) = limit.or(self.default).filter(|limit| limit.rate > 0.0) else {
+            return true;
+        };
+        let burst = f64::from(limit.burst.max(1));
+        let now = Instant::now();
+        let mut buckets = self.buckets.lock();
+        let bucket = buckets.entry(*peer_pubkey).or_insert(Bucket {
+            tokens: burst,
+            updated: now,
+            dropped: 0,
+        });
+
+        let elapsed = now.duration_since(bucket.updated).as_secs_f64();
+        bucket.tokens = (bucket.tokens + elapsed * limit.rate).min(burst);
+        bucket.updated = now;
+
+        if bucket.tokens >= 1.0 {
+            bucket.tokens -= 1.0;
+            if bucket.dropped > 0 {
+                info!(
+                    "DNS rate limit lifted for peer {} after {} dropped queries",
+                    encode_key(peer_pubkey),
+                    bucket.dropped
+                );
+                bucket.dropped = 0;
+            }
+            return true;
+        }
+
+        let limited_total = self.limited_total.fetch_add(1, Ordering::Relaxed) + 1;
+        if bucket.dropped == 0 {
+            warn!(
+                "Peer {} exceeded the DNS rate limit ({} queries limited in total)",
+                encode_key(peer_pubkey),
+                limited_total
+            );
+        }
+        bucket.dropped += 1;
+        false
+    }
+}
+
+fn encode_key(key: &[u8; 32]) -> String {
+    base64::engine::general_purpose::STANDARD.encode(key)
+}
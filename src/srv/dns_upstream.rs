@@ -0,0 +1,427 @@
+//! Upstream resolvers for the wirecagesrv DNS forwarder
+//!
+//! Supported upstream forms:
+//! - `1.1.1.1:53` - plain DNS over UDP, upgraded to TCP on truncation
+//! - `https://cloudflare-dns.com/dns-query` - DNS over HTTPS (RFC 8484)
+//! - `tls://one.one.one.one:853` - DNS over TLS (RFC 7858)
+//!
+//! Several upstreams can be configured; each query goes to the healthiest,
+//! fastest one first and is retried against the others with backoff.
+
+use std::fmt;
+use std::io::IoSlice;
+use std::net::SocketAddr;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use anyhow::{Context, Result};
+use parking_lot::Mutex;
+use rustls::pki_types::ServerName;
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt};
+use tokio::net::{TcpStream, UdpSocket};
+use tokio_rustls::TlsConnector;
+use tracing::debug;
+
+use super::bufpool::{self, BufferPool};
+use super::dial;
+use super::dns_wire::{self, HEADER_LEN};
+
+const MAX_MESSAGE: usize = 65535;
+/// Most idle receive buffers kept for reuse
+const MAX_FREE_BUFFERS: usize = 64;
+const DOT_DEFAULT_PORT: u16 = 853;
+
+/// EDNS0 UDP payload size advertised upstream (DNS flag day 2020 default)
+pub const EDNS_UDP_SIZE: u16 = 1232;
+
+const INITIAL_BACKOFF: Duration = Duration::from_millis(50);
+const FAILURES_BEFORE_DOWN: u32 = 3;
+const DOWN_DURATION: Duration = Duration::from_secs(30);
+
+/// Transport the client used to reach the DNS service
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Transport {
+    Udp,
+    Tcp,
+}
+
+/// A configured upstream resolver
+pub enum Upstream {
+    Plain(SocketAddr),
+    Https {
+        url: String,
+        client: reqwest::Client,
+    },
+    Tls {
+        addr: String,
+        server_name: ServerName<'static>,
+        connector: TlsConnector,
+    },
+}
+
+impl fmt::Display for Upstream {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Upstream::Plain(addr) => write!(f, "{}", addr),
+            Upstream::Https { url, .. } => write!(f, "{}", url),
+            Upstream::Tls { addr, .. } => write!(f, "tls://{}", addr),
+        }
+    }
+}
+
+impl Upstream {
+    /// Parse an upstream specification from the command line
+    pub fn parse(spec: &str) -> Result<Self> {
+        if spec.starts_with("https://") {
+            let client = reqwest::Client::builder()
+                .build()
+                .context("failed to build DNS-over-HTTPS client")?;
+            return Ok(Upstream::Https {
+                url: spec.to_string(),
+                client,
+            });
+        }
+
+        if let Some(rest) = spec.strip_prefix("tls://") {
+            // IPv6 literals must be bracketed, e.g. tls://[2606:4700::1111]:853
+            let (host, port) = match rest.rsplit_once(':') {
+                Some((host, port)) if !host.is_empty() && !port.contains(']') => {
+                    let port = port
+                        .parse::<u16>()
+                        .with_context(|| format!("invalid port in DNS upstream `{}`", spec))?;
+                    (host, port)
+                }
+                _ => (rest, DOT_DEFAULT_PORT),
+            };
+            let addr = format!("{}:{}", host, port);
+            let host = host.trim_start_matches('[').trim_end_matches(']').to_string();
+            let server_name = ServerName::try_from(host)
+                .with_context(|| format!("invalid TLS server name in DNS upstream `{}`", spec))?;
+            return Ok(Upstream::Tls {
+                addr,
+                server_name,
+                connector: tls_connector()?,
+            });
+        }
+
+        let addr = spec
+            .parse::<SocketAddr>()
+            .with_context(|| format!("invalid DNS upstream `{}`", spec))?;
+        Ok(Upstream::Plain(addr))
+    }
+
+    /// Send a query to this upstream and return its response, receiving
+    /// UDP answers into a buffer from `buffers`
+    pub async fn exchange(
+        &self,
+        query: &[u8],
+        transport: Transport,
+        buffers: &Arc<BufferPool>,
+    ) -> Result<Vec<u8>> {
+        let response = match self {
+            Upstream::Plain(addr) => exchange_plain(*addr, query, transport, buffers).await?,
+            Upstream::Https { url, client } => exchange_https(client, url, query).await?,
+            Upstream::Tls {
+                addr,
+                server_name,
+                connector,
+            } => exchange_tls(addr, server_name, connector, query).await?,
+        };
+        check_response(query, &response)?;
+        Ok(response)
+    }
+}
+
+/// Timeout and retry policy applied to every forwarded query
+#[derive(Debug, Clone, Copy)]
+pub struct QueryPolicy {
+    pub timeout: Duration,
+    pub retries: u32,
+}
+
+#[derive(Default)]
+struct Health {
+    consecutive_failures: u32,
+    down_until: Option<Instant>,
+    srtt: Option<Duration>,
+}
+
+impl Health {
+    fn record_success(&mut self, rtt: Duration) {
+        self.consecutive_failures = 0;
+        self.down_until = None;
+        self.srtt = Some(match self.srtt {
+            Some(srtt) => (srtt * 7 + rtt) / 8,
+            None => rtt,
+        });
+    }
+
+    fn record_failure(&mut self) {
+        self.consecutive_failures += 1;
+        if self.consecutive_failures >= FAILURES_BEFORE_DOWN {
+            self.down_until = Some(Instant::now() + DOWN_DURATION);
+        }
+    }
+
+    fn is_down(&self, now: Instant) -> bool {
+        self.down_until.is_some_and(|until| until > now)
+    }
+}
+
+/// A set of upstreams queried in order of health and latency
+pub struct UpstreamPool {
+    upstreams: Vec<(Upstream, Mutex<Health>)>,
+    policy: QueryPolicy,
+    /// Buffers UDP answers are received into
+    buffers: Arc<BufferPool>,
+}
+
+impl UpstreamPool {
+    pub fn new(upstreams: Vec<Upstream>, policy: QueryPolicy) -> Result<Self> {
+        if upstreams.is_empty() {
+            anyhow::bail!("at least one DNS upstream is required");
+        }
+        Ok(Self {
+            upstreams: upstreams
+                .into_iter()
+                .map(|upstream| (upstream, Mutex::new(Health::default())))
+                .collect(),
+            policy,
+            buffers: BufferPool::new(MAX_MESSAGE, MAX_FREE_BUFFERS),
+        })
+    }
+
+    /// Upstream indices, healthy ones first, fastest first
+    fn ranked(&self) -> Vec<usize> {
+        let now = Instant::now();
+        let mut order: Vec<usize> = (0..self.upstreams.len()).collect();
+        order.sort_by_key(|&index| {
+            let health = self.upstreams[index].1.lock();
+            (health.is_down(now), health.srtt.unwrap_or(Duration::ZERO))
+        });
+        order
+    }
+
+    /// Forward a query, retrying across upstreams with exponential backoff
+    pub async fn exchange(&self, query: &[u8], transport: Transport) -> Result<Vec<u8>> {
+        let query = dns_wire::add_edns(query, EDNS_UDP_SIZE);
+        let order = self.ranked();
+        let mut backoff = INITIAL_BACKOFF;
+        let mut last_err = None;
+
+        for attempt in 0..=self.policy.retries {
+            let (upstream, health) = &self.upstreams[order[attempt as usize % order.len()]];
+            let started = Instant::now();
+
+            match tokio::time::timeout(
+                self.policy.timeout,
+                upstream.exchange(&query, transport, &self.buffers),
+            )
+            .await
+            {
+                Ok(Ok(response)) => {
+                    health.lock().record_success(started.elapsed());
+                    return Ok(response);
+                }
+                Ok(Err(e)) => {
+                    debug!("DNS upstream {} failed: {:#}", upstream, e);
+                    health.lock().record_failure();
+                    last_err = Some(e);
+                }
+                Err(_) => {
+                    debug!("DNS upstream {} timed out", upstream);
+                    health.lock().record_failure();
+                    last_err = Some(anyhow::anyhow!("DNS upstream {} timed out", upstream));
+                }
+            }
+
+            if attempt < self.policy.retries {
+                tokio::time::sleep(backoff).await;
+                backoff *= 2;
+            }
+        }
+
+        Err(last_err.unwrap_or_else(|| anyhow::anyhow!("no DNS upstream answered")))
+    }
+
+    /// Ask every upstream for the root name servers, updating its health
+    pub async fn probe(&self) {
+        let query = dns_wire::build_query(rand::random(), ".", dns_wire::TYPE_NS);
+        for (upstream, health) in &self.upstreams {
+            let started = Instant::now();
+            let exchange = upstream.exchange(&query, Transport::Udp, &self.buffers);
+            match tokio::time::timeout(self.policy.timeout, exchange).await {
+                Ok(Ok(_)) => health.lock().record_success(started.elapsed()),
+                Ok(Err(e)) => {
+                    debug!("DNS upstream {} failed its probe: {:#}", upstream, e);
+                    health.lock().record_failure();
+                }
+                Err(_) => {
+                    debug!("DNS upstream {} timed out on its probe", upstream);
+                    health.lock().record_failure();
+                }
+            }
+        }
+    }
+
+    /// Each upstream and whether it is considered up
+    pub fn status(&self) -> Vec<(String, bool)> {
+        let now = Instant::now();
+        self.upstreams
+            .iter()
+            .map(|(upstream, health)| (upstream.to_string(), !health.lock().is_down(now)))
+            .collect()
+    }
+}
+
+fn tls_connector() -> Result<TlsConnector> {
+    let roots = rustls::RootCertStore::from_iter(webpki_roots::TLS_SERVER_ROOTS.iter().cloned());
+    let config = rustls::ClientConfig::builder_with_provider(Arc::new(
+        rustls::crypto::aws_lc_rs::default_provider(),
+    ))
+    .with_safe_default_protocol_versions()
+    .context("failed to configure TLS for DNS upstream")?
+    .with_root_certificates(roots)
+    .with_no_client_auth();
+    Ok(TlsConnector::from(Arc::new(config)))
+}
+
+async fn exchange_plain(
+    addr: SocketAddr,
+    query: &[u8],
+    transport: Transport,
+    buffers: &Arc<BufferPool>,
+) -> Result<Vec<u8>> {
+    let response = match query_udp(addr, query, buffers).await {
+        Ok(response) => response,
+        Err(e) if transport == Transport::Tcp => {
+            debug!("UDP upstream failed, retrying over TCP: {:#}", e);
+            return query_tcp(addr, query).await;
+        }
+        Err(e) => return Err(e),
+    };
+
+    // UDP clients get the truncated answer and retry over TCP themselves
+    if transport == Transport::Tcp && dns_wire::is_truncated(&response) {
+        return query_tcp(addr, query).await;
+    }
+    Ok(response)
+}
+
+async fn query_udp(addr: SocketAddr, query: &[u8], buffers: &Arc<BufferPool>) -> Result<Vec<u8>> {
+    let bind_addr = if addr.is_ipv4() { "0.0.0.0:0" } else { "[::]:0" };
+    let socket = UdpSocket::bind(bind_addr)
+        .await
+        .context("failed to bind DNS upstream socket")?;
+    socket
+        .connect(addr)
+        .await
+        .context("failed to connect DNS upstream socket")?;
+    socket
+        .send(query)
+        .await
+        .context("failed to send DNS query upstream")?;
+
+    let mut buf = buffers.get();
+    let n = socket
+        .recv(buf.space())
+        .await
+        .context("failed to read DNS upstream response")?;
+    Ok(buf.space()[..n].to_vec())
+}
+
+async fn query_tcp(addr: SocketAddr, query: &[u8]) -> Result<Vec<u8>> {
+    let mut stream = TcpStream::connect(addr)
+        .await
+        .context("failed to connect to DNS upstream over TCP")?;
+    exchange_framed(&mut stream, query).await
+}
+
+async fn exchange_https(client: &reqwest::Client, url: &str, query: &[u8]) -> Result<Vec<u8>> {
+    let response = client
+        .post(url)
+        .header("content-type", "application/dns-message")
+        .header("accept", "application/dns-message")
+        .body(query.to_vec())
+        .send()
+        .await
+        .context("DNS-over-HTTPS request failed")?;
+
+    let status = response.status();
+    if !status.is_success() {
+        anyhow::bail!("DNS-over-HTTPS upstream returned {}", status);
+    }
+
+    let body = response
+        .bytes()
+        .await
+        .context("failed to read DNS-over-HTTPS response")?;
+    Ok(body.to_vec())
+}
+
+async fn exchange_tls(
+    addr: &str,
+    server_name: &ServerName<'static>,
+    connector: &TlsConnector,
+    query: &[u8],
+) -> Result<Vec<u8>> {
+    let stream = dial::connect_host(addr)
+        .await
+        .context("failed to connect to DNS-over-TLS upstream")?;
+    let mut stream = connector
+        .connect(server_name.clone(), stream)
+        .await
+        .context("DNS-over-TLS handshake failed")?;
+    exchange_framed(&mut stream, query).await
+}
+
+/// Send one query and read one answer over a stream transport
+async fn exchange_framed<S: AsyncRead + AsyncWrite + Unpin>(
+    stream: &mut S,
+    query: &[u8],
+) -> Result<Vec<u8>> {
+    let len = u16::try_from(query.len()).context("DNS message too large for TCP framing")?;
+    let len = len.to_be_bytes();
+    bufpool::write_all_vectored(stream, &mut [IoSlice::new(&len), IoSlice::new(query)])
+        .await
+        .context("failed to write DNS message")?;
+    read_framed(stream)
+        .await?
+        .context("DNS upstream closed the connection without answering")
+}
+
+fn check_response(query: &[u8], response: &[u8]) -> Result<()> {
+    if response.len() < HEADER_LEN {
+        anyhow::bail!("DNS upstream response too short");
+    }
+    if response[..2] != query[..2] {
+        anyhow::bail!("DNS upstream response ID mismatch");
+    }
+    Ok(())
+}
+
+/// Read one length-prefixed DNS message, or `None` on a clean EOF
+async fn read_framed<R: AsyncRead + Unpin>(reader: &mut R) -> Result<Option<Vec<u8>>> {
+    let mut len_buf = [0u8; 2];
+    match reader.read_exact(&mut len_buf).await {
+        Ok(_) => {}
+        Err(e) if e.kind() == std::io::ErrorKind::UnexpectedEof => return Ok(None),
+        Err(e) => return Err(e).context("failed to read DNS length prefix"),
+    }
+    let len = u16::from_be_bytes(len_buf) as usize;
+    let mut message = vec![0u8; len];
+    reader
+        .read_exact(&mut message)
+        .await
+        .context("failed to read DNS message")?;
+    Ok(Some(message))
+}
+
+/// Prefix a DNS message with its two-byte length for stream transports
+pub fn frame(message: &[u8]) -> Result<Vec<u8>> {
+    let len = u16::try_from(message.len()).context("DNS message too large for TCP framing")?;
+    let mut framed = Vec::with_capacity(message.len() + 2);
+    framed.extend_from_slice(&len.to_be_bytes());
+    framed.extend_from_slice(message);
+    Ok(framed)
+}
@@ -0,0 +1,341 @@
+//! Minimal DNS wire-format helpers for the wirecagesrv DNS service
+//!
+//! Only what the forwarder needs: reading the question, walking resource
+//! records to find TTLs, rewriting headers on cached answers, and building
+//! locally-generated answers.
+
+/// Size of the fixed DNS message header
+pub const HEADER_LEN: usize = 12;
+
+pub const TYPE_A: u16 = 1;
+pub const TYPE_NS: u16 = 2;
+pub const TYPE_SOA: u16 = 6;
+pub const TYPE_PTR: u16 = 12;
+pub const TYPE_AAAA: u16 = 28;
+pub const TYPE_OPT: u16 = 41;
+
+pub const RCODE_NOERROR: u8 = 0;
+pub const RCODE_SERVFAIL: u8 = 2;
+pub const RCODE_NXDOMAIN: u8 = 3;
+pub const RCODE_REFUSED: u8 = 5;
+
+const CLASS_IN: u16 = 1;
+
+const MAX_POINTER_JUMPS: usize = 32;
+
+/// The (single) question of a DNS query
+#[derive(Debug, Clone, PartialEq, Eq, Hash)]
+pub struct Question {
+    /// Lowercased name without the trailing dot
+    pub name: String,
+    pub qtype: u16,
+    pub qclass: u16,
+    /// Offset just past the question section
+    pub end: usize,
+}
+
+/// A resource record TTL and where it lives in the message
+#[derive(Debug, Clone, Copy)]
+pub struct TtlField {
+    pub offset: usize,
+    pub ttl: u32,
+}
+
+pub fn id(message: &[u8]) -> u16 {
+    u16::from_be_bytes([message[0], message[1]])
+}
+
+pub fn set_id(message: &mut [u8], id: u16) {
+    message[..2].copy_from_slice(&id.to_be_bytes());
+}
+
+pub fn rcode(message: &[u8]) -> u8 {
+    message[3] & 0x0f
+}
+
+/// Whether the TC (truncated) bit is set in a DNS message
+pub fn is_truncated(message: &[u8]) -> bool {
+    message.len() >= HEADER_LEN && message[2] & 0x02 != 0
+}
+
+fn count(message: &[u8], index: usize) -> u16 {
+    let offset = 4 + index * 2;
+    u16::from_be_bytes([message[offset], message[offset + 1]])
+}
+
+fn read_u16(message: &[u8], pos: usize) -> Option<u16> {
+    Some(u16::from_be_bytes([*message.get(pos)?, *message.get(pos + 1)?]))
+}
+
+fn read_u32(message: &[u8], pos: usize) -> Option<u32> {
+    let bytes = message.get(pos..pos + 4)?;
+    Some(u32::from_be_bytes([bytes[0], bytes[1], bytes[2], bytes[3]]))
+}
+
+/// Read a possibly-compressed name starting at `pos`.
+///
+/// Returns the dotted, lowercased name and the offset just past it in the
+/// original position (pointers are followed but not advanced past).
+pub fn read_name(message: &[u8], mut pos: usize) -> Option<(String, usize)> {
+    let mut labels: Vec<String> = Vec::new();
+    let mut end = None;
+    let mut jumps = 0;
+
+    loop {
+        let len = *message.get(pos)? as usize;
+        match len & 0xc0 {
+            0x00 if len == 0 => {
+                if end.is_none() {
+                    end = Some(pos + 1);
+                }
+                break;
+            }
+            0x00 => {
+                let label = message.get(pos + 1..pos + 1 + len)?;
+                labels.push(String::from_utf8_lossy(label).to_ascii_lowercase());
+                pos += 1 + len;
+            }
+            0xc0 => {
+                let target = (read_u16(message, pos)? & 0x3fff) as usize;
+                if end.is_none() {
+                    end = Some(pos + 2);
+                }
+                jumps += 1;
+                if jumps > MAX_POINTER_JUMPS {
+                    return None;
+                }
+                pos = target;
+            }
+            _ => return None,
+        }
+    }
+
+    Some((labels.join("."), end?))
+}
+
+fn skip_name(message: &[u8], pos: usize) -> Option<usize> {
+    read_name(message, pos).map(|(_, end)| end)
+}
+
+/// Parse the single question of a query or response
+pub fn parse_question(message: &[u8]) -> Option<Question> {
+    if message.len() < HEADER_LEN || count(message, 0) != 1 {
+        return None;
+    }
+    let (name, pos) = read_name(message, HEADER_LEN)?;
+    let qtype = read_u16(message, pos)?;
+    let qclass = read_u16(message, pos + 2)?;
+    Some(Question {
+        name,
+        qtype,
+        qclass,
+        end: pos + 4,
+    })
+}
+
+/// A parsed resource record header
+#[derive(Debug, Clone, Copy)]
+pub struct Record {
+    /// Offset of the record's owner name
+    pub start: usize,
+    pub rtype: u16,
+    pub class: u16,
+    pub ttl: TtlField,
+    pub rdata: usize,
+    pub rdlen: usize,
+}
+
+/// Sections of resource records following the question
+#[derive(Debug, Default)]
+pub struct Records {
+    pub answers: Vec<Record>,
+    pub authority: Vec<Record>,
+    pub additional: Vec<Record>,
+}
+
+impl Records {
+    pub fn all(&self) -> impl Iterator<Item = &Record> {
+        self.answers
+            .iter()
+            .chain(self.authority.iter())
+            .chain(self.additional.iter())
+    }
+}
+
+/// Walk every resource record in a message
+pub fn parse_records(message: &[u8]) -> Option<Records> {
+    if message.len() < HEADER_LEN {
+        return None;
+    }
+    let mut pos = HEADER_LEN;
+    for _ in 0..count(message, 0) {
+        pos = skip_name(message, pos)? + 4;
+    }
+
+    let mut records = Records::default();
+    for section in 0..3 {
+        for _ in 0..count(message, section + 1) {
+            let start = pos;
+            pos = skip_name(message, pos)?;
+            let rtype = read_u16(message, pos)?;
+            let class = read_u16(message, pos + 2)?;
+            let ttl = read_u32(message, pos + 4)?;
+            let rdlen = read_u16(message, pos + 8)? as usize;
+            let rdata = pos + 10;
+            if rdata + rdlen > message.len() {
+                return None;
+            }
+            let record = Record {
+                start,
+                rtype,
+                class,
+                ttl: TtlField { offset: pos + 4, ttl },
+                rdata,
+                rdlen,
+            };
+            match section {
+                0 => records.answers.push(record),
+                1 => records.authority.push(record),
+                _ => records.additional.push(record),
+            }
+            pos = rdata + rdlen;
+        }
+    }
+    Some(records)
+}
+
+/// TTL fields of every record except EDNS OPT pseudo-records
+pub fn ttl_fields(records: &Records) -> Vec<TtlField> {
+    records
+        .all()
+        .filter(|record| record.rtype != TYPE_OPT)
+        .map(|record| record.ttl)
+        .collect()
+}
+
+/// Negative-caching TTL from the authority SOA (RFC 2308)
+pub fn negative_ttl(message: &[u8], records: &Records) -> Option<u32> {
+    let soa = records.authority.iter().find(|r| r.rtype == TYPE_SOA)?;
+    // MNAME and RNAME precede five 32-bit fields; MINIMUM is the last
+    let pos = skip_name(message, soa.rdata)?;
+    let pos = skip_name(message, pos)?;
+    let minimum = read_u32(message, pos + 16)?;
+    Some(soa.ttl.ttl.min(minimum))
+}
+
+/// Rewrite every TTL field, e.g. to age a cached answer
+pub fn write_ttls(message: &mut [u8], fields: &[TtlField], elapsed_secs: u32) {
+    for field in fields {
+        let ttl = field.ttl.saturating_sub(elapsed_secs);
+        message[field.offset..field.offset + 4].copy_from_slice(&ttl.to_be_bytes());
+    }
+}
+
+fn find_opt(message: &[u8]) -> Option<Record> {
+    parse_records(message)?
+        .additional
+        .into_iter()
+        .find(|record| record.rtype == TYPE_OPT)
+}
+
+/// Whether the message carries an EDNS0 OPT pseudo-record
+pub fn has_edns(message: &[u8]) -> bool {
+    find_opt(message).is_some()
+}
+
+/// Largest UDP response the querier accepts (EDNS0 OPT or the classic 512)
+pub fn udp_payload_limit(query: &[u8]) -> usize {
+    find_opt(query).map_or(512, |opt| (opt.class as usize).max(512))
+}
+
+/// Append an EDNS0 OPT record advertising `udp_size` to a query without one
+pub fn add_edns(query: &[u8], udp_size: u16) -> Vec<u8> {
+    let mut extended = query.to_vec();
+    if query.len() < HEADER_LEN || has_edns(query) {
+        return extended;
+    }
+    // Root owner name, TYPE=OPT, CLASS=payload size, TTL=0, RDLEN=0
+    extended.push(0);
+    extended.extend_from_slice(&TYPE_OPT.to_be_bytes());
+    extended.extend_from_slice(&udp_size.to_be_bytes());
+    extended.extend_from_slice(&[0, 0, 0, 0, 0, 0]);
+    let arcount = count(query, 3).saturating_add(1);
+    extended[10..12].copy_from_slice(&arcount.to_be_bytes());
+    extended
+}
+
+/// Remove the EDNS0 OPT record, for clients that did not ask for EDNS
+pub fn strip_edns(response: &[u8]) -> Vec<u8> {
+    let Some(opt) = find_opt(response) else {
+        return response.to_vec();
+    };
+    let end = opt.rdata + opt.rdlen;
+    let mut stripped = Vec::with_capacity(response.len());
+    stripped.extend_from_slice(&response[..opt.start]);
+    stripped.extend_from_slice(&response[end..]);
+    let arcount = count(response, 3).saturating_sub(1);
+    stripped[10..12].copy_from_slice(&arcount.to_be_bytes());
+    stripped
+}
+
+/// Reduce a response to its header and question with the TC bit set, so the
+/// client retries over TCP
+pub fn truncate(response: &[u8], question_end: usize) -> Vec<u8> {
+    let mut truncated = response[..question_end].to_vec();
+    truncated[2] |= 0x02;
+    // Answer, authority and additional counts are now zero
+    truncated[6..12].fill(0);
+    truncated
+}
+
+/// Encode a dotted name as uncompressed wire-format labels
+pub fn encode_name(name: &str) -> Vec<u8> {
+    let mut encoded = Vec::with_capacity(name.len() + 2);
+    for label in name.split('.').filter(|label| !label.is_empty()) {
+        encoded.push(label.len() as u8);
+        encoded.extend_from_slice(label.as_bytes());
+    }
+    encoded.push(0);
+    encoded
+}
+
+/// Build a recursive query for `name`
+pub fn build_query(id: u16, name: &str, qtype: u16) -> Vec<u8> {
+    let mut query = vec![0u8; HEADER_LEN];
+    query[0..2].copy_from_slice(&id.to_be_bytes());
+    query[2] = 0x01; // RD
+    query[4..6].copy_from_slice(&1u16.to_be_bytes());
+    query.extend_from_slice(&encode_name(name));
+    query.extend_from_slice(&qtype.to_be_bytes());
+    query.extend_from_slice(&CLASS_IN.to_be_bytes());
+    query
+}
+
+/// A locally-generated answer record for the question's name
+#[derive(Debug, Clone)]
+pub struct Answer {
+    pub rtype: u16,
+    pub ttl: u32,
+    pub rdata: Vec<u8>,
+}
+
+/// Build a response to `query` with the given rcode and answers
+pub fn build_response(query: &[u8], question: &Question, rcode: u8, answers: &[Answer]) -> Vec<u8> {
+    let mut response = query[..question.end].to_vec();
+    // QR set, opcode and RD copied from the query; RA set
+    response[2] = 0x80 | (query[2] & 0x79);
+    response[3] = 0x80 | (rcode & 0x0f);
+    response[6..8].copy_from_slice(&(answers.len() as u16).to_be_bytes());
+    response[8..12].fill(0);
+
+    for answer in answers {
+        // Owner name is a pointer back to the question name
+        response.extend_from_slice(&[0xc0, HEADER_LEN as u8]);
+        response.extend_from_slice(&answer.rtype.to_be_bytes());
+        response.extend_from_slice(&CLASS_IN.to_be_bytes());
+        response.extend_from_slice(&answer.ttl.to_be_bytes());
+        response.extend_from_slice(&(answer.rdata.len() as u16).to_be_bytes());
+        response.extend_from_slice(&answer.rdata);
+    }
+    response
+}
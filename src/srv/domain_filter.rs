@@ -0,0 +1,116 @@
+//! Server-wide egress filtering by domain
+//!
+//! DNS blocklists only stop clients that resolve names through the server.
+//! `--egress-domain-blocklist` and `--egress-domain-allowlist` take the same
+//! files and URLs, and instead hold TCP flows to `--egress-domain-ports` (80
+//! and 443 by default) until the client's first bytes show the domain they
+//! are for: the server name in a TLS ClientHello, or the Host header of a
+//! plain HTTP request. A flow to a blocked domain or one of its subdomains
+//! is reset, and so, when an allowlist is set, is one to any domain not on
+//! it or naming none at all. The lists apply to every peer, on top of
+//! egress ACLs, and to the HTTP and SOCKS5 proxies. They are re-read on
+//! SIGHUP or `POST /v1/reload`.
+
+use std::collections::HashSet;
+use std::sync::Arc;
+
+use anyhow::{Context, Result};
+use parking_lot::RwLock;
+use tracing::info;
+
+use super::dns_blocklist::{contains_domain, fetch_source, parse_list};
+
+struct Lists {
+    blocked: HashSet<String>,
+    /// Unset if every domain not blocked is allowed
+    allowed: Option<HashSet<String>>,
+}
+
+/// The domain lists in force, replaced as a whole on reload
+pub struct DomainFilter {
+    blocklists: Vec<String>,
+    allowlists: Vec<String>,
+    ports: Vec<u16>,
+    lists: RwLock<Arc<Lists>>,
+}
+
+impl DomainFilter {
+    /// Load every list; fails if any of them can't be
+    pub async fn load(
+        blocklists: Vec<String>,
+        allowlists: Vec<String>,
+        ports: Vec<u16>,
+    ) -> Result<Self> {
+        let lists = read_lists(&blocklists, &allowlists).await?;
+        info!(
+            "Loaded {} blocked and {} allowed egress domains",
+            lists.blocked.len(),
+            lists.allowed.as_ref().map_or(0, HashSet::len)
+        );
+        Ok(Self {
+            blocklists,
+            allowlists,
+            ports,
+            lists: RwLock::new(Arc::new(lists)),
+        })
+    }
+
+    /// Re-read every list, keeping the current ones if any fails. Flows
+    /// already open are not re-checked. Returns the number of domains.
+    pub async fn reload(&self) -> Result<usize> {
+        let lists = read_lists(&self.blocklists, &self.allowlists).await?;
+        let count = lists.blocked.len() + lists.allowed.as_ref().map_or(0, HashSet::len);
+        *self.lists.write() = Arc::new(lists);
+        info!("Reloaded {} egress domains", count);
+        Ok(count)
+    }
+
+    /// Whether only listed domains may be reached
+    pub fn is_allowlist(&self) -> bool {
+        !self.allowlists.is_empty()
+    }
+
+    /// Ports whose TCP flows are checked
+    pub fn ports(&self) -> &[u16] {
+        &self.ports
+    }
+
+    /// Whether TCP flows to `port` are checked
+    pub fn covers(&self, port: u16) -> bool {
+        self.ports.contains(&port)
+    }
+
+    /// Whether a flow naming `name`, or no name, may go ahead
+    pub fn allows(&self, name: Option<&str>) -> bool {
+        let lists = Arc::clone(&self.lists.read());
+        match name {
+            Some(name) if contains_domain(&lists.blocked, name) => false,
+            Some(name) => lists
+                .allowed
+                .as_ref()
+                .is_none_or(|allowed| contains_domain(allowed, name)),
+            None => lists.allowed.is_none(),
+        }
+    }
+}
+
+async fn read_lists(blocklists: &[String], allowlists: &[String]) -> Result<Lists> {
+    let blocked = read_domains(blocklists).await?;
+    let allowed = if allowlists.is_empty() {
+        None
+    } else {
+        Some(read_domains(allowlists).await?)
+    };
+    Ok(Lists { blocked, allowed })
+}
+
+async fn read_domains(sources: &[String]) -> Result<HashSet<String>> {
+    let mut domains = HashSet::new();
+    for source in sources {
+        let text = fetch_source(source)
+            .await
+            .with_context(|| format!("failed to load egress domain list {}", source))?;
+        domains.extend(parse_list(&text));
+    }
+    Ok(domains)
+}
@@ -0,0 +1,947 @@
+//! Where outbound flows leave the server
+//!
+//! On a multi-homed host the address the default route picks may not be
+//! the one upstream firewalls let through. `--egress-ip` binds the sockets
+//! the dataplane opens on peers' behalf to a given local address, and
+//! `--egress-interface` ties them to a network device with SO_BINDTODEVICE,
+//! which needs CAP_NET_RAW. With neither, the kernel picks as usual.
+//! `--egress-proxy` instead dials TCP flows through an upstream proxy, and
+//! `--egress-wg-config` sends TCP and UDP flows through a WireGuard tunnel
+//! to another server (see `cascade`). DNS upstream queries are the server's
+//! own and are not affected.
+//!
+//! `--egress-routes` takes a TOML routing table sending destination ranges
+//! out of other paths, through a proxy, or dropping them:
+//!
+//! ```toml
+//! [[route]]
+//! cidrs = ["10.0.0.0/8", "172.16.0.0/12"]
+//! interface = "corp0"
+//!
+//! [[route]]
+//! cidrs = ["0.0.0.0/0"]
+//! action = "proxy"
+//! proxy = "socks5://proxy.corp.example:1080"
+//!
+//! [[route]]
+//! cidrs = ["198.51.100.0/24"]
+//! action = "wireguard"
+//!
+//! [[route]]
+//! cidrs = ["192.0.2.0/24"]
+//! action = "drop"
+//! ```
+//!
+//! The most specific route covering a destination decides, with ties going
+//! to the earlier route, and destinations no route covers leave the default
+//! way. `wireguard` routes need `--egress-wg-config`. A route's `interface`
+//! and `source_ip` replace the default path's rather than adding to it. The file is re-read on SIGHUP or
+//! `POST /v1/reload`; flows already open keep their path.
+//!
+//! With several ways out, the file can also name egress points and let a
+//! route spread its destinations over them:
+//!
+//! ```toml
+//! [[egress]]
+//! name = "fra"
+//! interface = "wan-fra"
+//!
+//! [[egress]]
+//! name = "ams"
+//! proxy = "socks5://ams.example:1080"
+//! probe = "9.9.9.9:443"
+//!
+//! [[route]]
+//! cidrs = ["0.0.0.0/0"]
+//! egress = ["fra", "ams"]
+//! select = "latency"
+//! ```
+//!
+//! Each point is probed every few seconds with a TCP connection through it
+//! (to `1.1.1.1:443` unless it sets `probe`), and is down after several
+//! failures in a row until a probe gets through again. `select = "latency"`
+//! picks the up point with the lowest smoothed connect time, while
+//! `select = "order"` takes the first up point in the route's list, so that
+//! routes for a region's ranges can list its nearest points first as a geo
+//! mapping. New TCP connections fail over to the next point if the dial
+//! fails, and when every point is down the route still tries them all.
+//!
+//! Routes and egress points are IPv4 only. Peers' IPv6 flows (see `ipv6`)
+//! take the default path when it is direct, keeping its interface, and are
+//! dropped when flows leave through a proxy or tunnel by default.
+
+use std::collections::HashMap;
+use std::ffi::OsString;
+use std::io;
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr, SocketAddr, SocketAddrV4, SocketAddrV6};
+use std::os::fd::{AsFd, AsRawFd, BorrowedFd, OwnedFd};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use anyhow::{Context, Result};
+use ipnet::Ipv4Net;
+use nix::sys::socket::{setsockopt, sockopt};
+use parking_lot::{Mutex, RwLock};
+use serde::Deserialize;
+use tokio::io::{AsyncRead, AsyncWrite, DuplexStream};
+use tokio::net::{TcpSocket, TcpStream, UdpSocket};
+use tracing::{debug, info, warn};
+
+use super::cascade::{Cascade, TunnelUdp};
+use super::dial::DialPolicy;
+use super::flow::Protocol;
+use super::icmp::EchoSocket;
+use super::ipv6::Ipv6Egress;
+use super::nat_ports::{NatPorts, PortMapping};
+use super::upstream_proxy::{IdleLimits, UpstreamProxy};
+
+/// How often egress points are probed
+const PROBE_INTERVAL: Duration = Duration::from_secs(10);
+const PROBE_TIMEOUT: Duration = Duration::from_secs(5);
+/// Where egress points are probed unless they set `probe`
+const DEFAULT_PROBE: SocketAddrV4 = SocketAddrV4::new(Ipv4Addr::new(1, 1, 1, 1), 443);
+const FAILURES_BEFORE_DOWN: u32 = 3;
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct RoutesFile {
+    #[serde(default)]
+    egress: Vec<PointEntry>,
+    #[serde(default)]
+    route: Vec<RouteEntry>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct PointEntry {
+    name: String,
+    interface: Option<String>,
+    source_ip: Option<Ipv4Addr>,
+    proxy: Option<String>,
+    #[serde(default)]
+    wireguard: bool,
+    probe: Option<SocketAddrV4>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct RouteEntry {
+    cidrs: Vec<String>,
+    #[serde(default)]
+    action: RouteAction,
+    interface: Option<String>,
+    source_ip: Option<Ipv4Addr>,
+    proxy: Option<String>,
+    #[serde(default)]
+    egress: Vec<String>,
+    #[serde(default)]
+    select: Select,
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Deserialize)]
+#[serde(rename_all = "lowercase")]
+enum RouteAction {
+    /// Dial the destination from this server
+    #[default]
+    Direct,
+    /// Dial TCP through an upstream proxy
+    Proxy,
+    /// Dial through the `--egress-wg-config` tunnel
+    #[serde(rename = "wireguard")]
+    WireGuard,
+    Drop,
+}
+
+/// How flows to a destination leave the server
+#[derive(Debug, Clone)]
+pub enum Via {
+    Direct(Arc<Path>),
+    Proxy(Arc<UpstreamProxy>),
+    WireGuard(Arc<Cascade>),
+    /// One of several egress points, picked per flow
+    Pool(Arc<Pool>),
+    Drop,
+}
+
+impl Via {
+    /// Whether flows of `protocol` can leave this way
+    fn carries(&self, protocol: Protocol) -> bool {
+        match self {
+            Via::Direct(_) | Via::WireGuard(_) => true,
+            Via::Proxy(_) => protocol == Protocol::Tcp,
+            Via::Pool(pool) => pool.points.iter().any(|point| point.via.carries(protocol)),
+            Via::Drop => false,
+        }
+    }
+
+    /// Open an ICMP echo socket to `remote` this way; only direct paths
+    /// carry ICMP
+    fn open_echo(&self, remote: Ipv4Addr) -> io::Result<EchoSocket> {
+        match self {
+            Via::Direct(path) => EchoSocket::open(
+                IpAddr::V4(*path.local_addr().ip()),
+                path.interface.as_deref(),
+                IpAddr::V4(remote),
+            ),
+            Via::Pool(pool) => pool.open_echo(remote),
+            Via::Proxy(_) | Via::WireGuard(_) | Via::Drop => Err(dropped()),
+        }
+    }
+
+    /// Dial `remote` this way. Pools are handled by `Pool::connect_tcp`, as
+    /// their points are never pools themselves.
+    async fn connect_tcp(&self, remote: SocketAddrV4) -> io::Result<Box<dyn Connection>> {
+        match self {
+            Via::Direct(path) => Ok(Box::new(path.connect_tcp(remote).await?)),
+            Via::Proxy(proxy) => Ok(Box::new(proxy.connect(remote).await?)),
+            Via::WireGuard(cascade) => Ok(Box::new(cascade.connect_tcp(remote).await?)),
+            Via::Pool(_) | Via::Drop => Err(dropped()),
+        }
+    }
+
+    async fn open_udp(
+        &self,
+        remote: SocketAddrV4,
+        mapping: Option<&Arc<PortMapping>>,
+    ) -> io::Result<Datagrams> {
+        match self {
+            Via::Direct(path) => {
+                let (socket, mapping) = path.bind_udp(mapping)?;
+                socket.connect(SocketAddr::V4(remote)).await?;
+                Ok(Datagrams::Socket { socket, mapping })
+            }
+            Via::WireGuard(cascade) => Ok(Datagrams::Tunnel(cascade.open_udp(remote)?)),
+            Via::Proxy(_) | Via::Pool(_) | Via::Drop => Err(dropped()),
+        }
+    }
+}
+
+/// How a route picks among its egress points
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Deserialize)]
+#[serde(rename_all = "lowercase")]
+enum Select {
+    /// The up point with the lowest connect time
+    #[default]
+    Latency,
+    /// The first up point in the route's list
+    Order,
+}
+
+/// A named way out whose health is probed
+#[derive(Debug)]
+pub struct EgressPoint {
+    name: String,
+    via: Via,
+    probe: SocketAddrV4,
+    health: Mutex<Health>,
+}
+
+#[derive(Debug, Default)]
+struct Health {
+    consecutive_failures: u32,
+    /// Smoothed connect time
+    srtt: Option<Duration>,
+}
+
+impl Health {
+    fn is_down(&self) -> bool {
+        self.consecutive_failures >= FAILURES_BEFORE_DOWN
+    }
+}
+
+impl EgressPoint {
+    fn record_success(&self, rtt: Duration) {
+        let mut health = self.health.lock();
+        if health.is_down() {
+            info!("Egress point {} is back up", self.name);
+        }
+        health.consecutive_failures = 0;
+        health.srtt = Some(match health.srtt {
+            Some(srtt) => (srtt * 7 + rtt) / 8,
+            None => rtt,
+        });
+    }
+
+    fn record_failure(&self) {
+        let mut health = self.health.lock();
+        health.consecutive_failures += 1;
+        if health.consecutive_failures == FAILURES_BEFORE_DOWN {
+            warn!("Egress point {} is down", self.name);
+        }
+    }
+
+    /// Open a connection to the probe address, recording how it went
+    async fn probe(&self) {
+        let started = Instant::now();
+        match tokio::time::timeout(PROBE_TIMEOUT, self.via.connect_tcp(self.probe)).await {
+            Ok(Ok(_)) => self.record_success(started.elapsed()),
+            Ok(Err(e)) => {
+                debug!("Egress point {} failed its probe: {}", self.name, e);
+                self.record_failure();
+            }
+            Err(_) => {
+                debug!("Egress point {} timed out on its probe", self.name);
+                self.record_failure();
+            }
+        }
+    }
+}
+
+/// The egress points a route spreads its destinations over
+#[derive(Debug)]
+pub struct Pool {
+    points: Vec<Arc<EgressPoint>>,
+    select: Select,
+}
+
+impl Pool {
+    /// Points able to carry `protocol`, up ones first, in selection order
+    fn candidates(&self, protocol: Protocol) -> Vec<Arc<EgressPoint>> {
+        let mut candidates: Vec<(usize, bool, Duration, &Arc<EgressPoint>)> = self
+            .points
+            .iter()
+            .enumerate()
+            .filter(|(_, point)| point.via.carries(protocol))
+            .map(|(i, point)| {
+                let health = point.health.lock();
+                // Unmeasured points sort first so they get measured
+                (
+                    i,
+                    health.is_down(),
+                    health.srtt.unwrap_or(Duration::ZERO),
+                    point,
+                )
+            })
+            .collect();
+        match self.select {
+            Select::Latency => candidates.sort_by_key(|&(i, down, srtt, _)| (down, srtt, i)),
+            Select::Order => candidates.sort_by_key(|&(i, down, _, _)| (down, i)),
+        }
+        candidates
+            .into_iter()
+            .map(|(_, _, _, point)| Arc::clone(point))
+            .collect()
+    }
+
+    /// Dial `remote` through the best point, failing over to the others
+    async fn connect_tcp(&self, remote: SocketAddrV4) -> io::Result<Box<dyn Connection>> {
+        let mut last_err = None;
+        for point in self.candidates(Protocol::Tcp) {
+            let started = Instant::now();
+            match point.via.connect_tcp(remote).await {
+                Ok(stream) => {
+                    point.record_success(started.elapsed());
+                    return Ok(stream);
+                }
+                Err(e) => {
+                    debug!("Dial to {} through {} failed: {}", remote, point.name, e);
+                    point.record_failure();
+                    last_err = Some(e);
+                }
+            }
+        }
+        Err(last_err.unwrap_or_else(dropped))
+    }
+
+    /// Open a UDP flow through the best point able to carry it
+    async fn open_udp(
+        &self,
+        remote: SocketAddrV4,
+        mapping: Option<&Arc<PortMapping>>,
+    ) -> io::Result<Datagrams> {
+        let mut last_err = None;
+        for point in self.candidates(Protocol::Udp) {
+            match point.via.open_udp(remote, mapping).await {
+                Ok(datagrams) => return Ok(datagrams),
+                Err(e) => last_err = Some(e),
+            }
+        }
+        Err(last_err.unwrap_or_else(dropped))
+    }
+
+    /// Open an echo socket through the best point with a direct path
+    fn open_echo(&self, remote: Ipv4Addr) -> io::Result<EchoSocket> {
+        let mut last_err = None;
+        for point in self.candidates(Protocol::Udp) {
+            match point.via.open_echo(remote) {
+                Ok(socket) => return Ok(socket),
+                Err(e) => last_err = Some(e),
+            }
+        }
+        Err(last_err.unwrap_or_else(dropped))
+    }
+}
+
+/// A destination range and how it leaves
+struct Route {
+    net: Ipv4Net,
+    via: Via,
+}
+
+/// The routing table in force, most specific first
+#[derive(Default)]
+struct RouteTable {
+    routes: Vec<Route>,
+    /// Routes in the file, which may each cover several ranges
+    count: usize,
+    points: Vec<Arc<EgressPoint>>,
+}
+
+impl RouteTable {
+    fn read(
+        path: &str,
+        cascade: Option<&Arc<Cascade>>,
+        ports: &Arc<NatPorts>,
+        proxy_idle: IdleLimits,
+    ) -> Result<Self> {
+        let contents = std::fs::read_to_string(path)
+            .with_context(|| format!("failed to read egress routes file {}", path))?;
+        let file: RoutesFile = toml::from_str(&contents)
+            .with_context(|| format!("failed to parse egress routes file {}", path))?;
+
+        let mut points = Vec::new();
+        let mut by_name = HashMap::new();
+        for entry in &file.egress {
+            let point = Arc::new(
+                parse_point(entry, cascade, ports, proxy_idle)
+                    .with_context(|| format!("egress point {}", entry.name))?,
+            );
+            if by_name
+                .insert(entry.name.clone(), Arc::clone(&point))
+                .is_some()
+            {
+                anyhow::bail!("egress point {} is defined twice", entry.name);
+            }
+            points.push(point);
+        }
+
+        let count = file.route.len();
+        let mut routes = Vec::new();
+        for (i, entry) in file.route.into_iter().enumerate() {
+            let via = parse_route(&entry, cascade, ports, proxy_idle, &by_name)
+                .with_context(|| format!("route {}", i + 1))?;
+            for cidr in &entry.cidrs {
+                let net = cidr
+                    .parse::<Ipv4Net>()
+                    .or_else(|_| cidr.parse::<Ipv4Addr>().map(Ipv4Net::from))
+                    .with_context(|| format!("route {}: invalid CIDR {}", i + 1, cidr))?;
+                routes.push(Route {
+                    net: net.trunc(),
+                    via: via.clone(),
+                });
+            }
+        }
+        // A stable sort keeps file order among equally specific routes
+        routes.sort_by_key(|route| std::cmp::Reverse(route.net.prefix_len()));
+        Ok(Self {
+            routes,
+            count,
+            points,
+        })
+    }
+}
+
+fn parse_point(
+    entry: &PointEntry,
+    cascade: Option<&Arc<Cascade>>,
+    ports: &Arc<NatPorts>,
+    proxy_idle: IdleLimits,
+) -> Result<EgressPoint> {
+    let has_path = entry.interface.is_some() || entry.source_ip.is_some();
+    let via = match (&entry.proxy, entry.wireguard) {
+        (Some(_), true) => anyhow::bail!("an egress point takes a proxy or wireguard, not both"),
+        (Some(proxy), false) => {
+            if has_path {
+                anyhow::bail!("a proxy egress point takes no interface or source_ip");
+            }
+            Via::Proxy(Arc::new(UpstreamProxy::parse(proxy, proxy_idle)?))
+        }
+        (None, true) => {
+            if has_path {
+                anyhow::bail!("a wireguard egress point takes no interface or source_ip");
+            }
+            let cascade = cascade.context("a wireguard egress point needs --egress-wg-config")?;
+            Via::WireGuard(Arc::clone(cascade))
+        }
+        (None, false) => {
+            let path = Path::new(entry.source_ip, entry.interface.clone(), Arc::clone(ports));
+            path.check()?;
+            Via::Direct(Arc::new(path))
+        }
+    };
+    Ok(EgressPoint {
+        name: entry.name.clone(),
+        via,
+        probe: entry.probe.unwrap_or(DEFAULT_PROBE),
+        health: Mutex::new(Health::default()),
+    })
+}
+
+fn parse_route(
+    entry: &RouteEntry,
+    cascade: Option<&Arc<Cascade>>,
+    ports: &Arc<NatPorts>,
+    proxy_idle: IdleLimits,
+    points: &HashMap<String, Arc<EgressPoint>>,
+) -> Result<Via> {
+    if entry.cidrs.is_empty() {
+        anyhow::bail!("no cidrs");
+    }
+    let has_path = entry.interface.is_some() || entry.source_ip.is_some();
+    if !entry.egress.is_empty() {
+        if entry.action != RouteAction::Direct || has_path || entry.proxy.is_some() {
+            anyhow::bail!(
+                "a route with egress points takes no action, interface, source_ip or proxy"
+            );
+        }
+        let points = entry
+            .egress
+            .iter()
+            .map(|name| {
+                points
+                    .get(name)
+                    .cloned()
+                    .with_context(|| format!("unknown egress point {}", name))
+            })
+            .collect::<Result<Vec<_>>>()?;
+        return Ok(Via::Pool(Arc::new(Pool {
+            points,
+            select: entry.select,
+        })));
+    }
+    match entry.action {
+        RouteAction::Direct => {
+            if entry.proxy.is_some() {
+                anyhow::bail!("a direct route takes no proxy");
+            }
+            let path = Path::new(entry.source_ip, entry.interface.clone(), Arc::clone(ports));
+            path.check()?;
+            Ok(Via::Direct(Arc::new(path)))
+        }
+        RouteAction::Proxy => {
+            if has_path {
+                anyhow::bail!("a proxy route takes no interface or source_ip");
+            }
+            let proxy = entry
+                .proxy
+                .as_deref()
+                .context("a proxy route needs a proxy")?;
+            Ok(Via::Proxy(Arc::new(UpstreamProxy::parse(
+                proxy, proxy_idle,
+            )?)))
+        }
+        RouteAction::WireGuard => {
+            if has_path || entry.proxy.is_some() {
+                anyhow::bail!("a wireguard route takes no interface, source_ip or proxy");
+            }
+            let cascade = cascade.context("a wireguard route needs --egress-wg-config")?;
+            Ok(Via::WireGuard(Arc::clone(cascade)))
+        }
+        RouteAction::Drop => {
+            if has_path || entry.proxy.is_some() {
+                anyhow::bail!("a drop route takes no interface, source_ip or proxy");
+            }
+            Ok(Via::Drop)
+        }
+    }
+}
+
+/// The default way out and the routing table, replaced as a whole on reload
+pub struct Egress {
+    default: Via,
+    cascade: Option<Arc<Cascade>>,
+    /// For the paths routes name
+    ports: Arc<NatPorts>,
+    dial: DialPolicy,
+    /// For the proxies routes name
+    proxy_idle: IdleLimits,
+    /// Where peers' IPv6 flows leave from
+    ipv6: Ipv6Egress,
+    file: Option<String>,
+    table: RwLock<Arc<RouteTable>>,
+}
+
+impl Egress {
+    /// Check the default path and load the routing table, if there is one.
+    /// With a cascade or proxy, flows no route covers go through it instead
+    /// of the path.
+    pub fn load(
+        default: Path,
+        proxy: Option<UpstreamProxy>,
+        cascade: Option<Arc<Cascade>>,
+        dial: DialPolicy,
+        proxy_idle: IdleLimits,
+        ipv6: Ipv6Egress,
+        routes_file: Option<&str>,
+    ) -> Result<Self> {
+        default.check()?;
+        let ports = Arc::clone(&default.ports);
+        let default = match (&cascade, proxy) {
+            (Some(cascade), _) => Via::WireGuard(Arc::clone(cascade)),
+            (None, Some(proxy)) => Via::Proxy(Arc::new(proxy)),
+            (None, None) => Via::Direct(Arc::new(default)),
+        };
+        let table = match routes_file {
+            Some(file) => {
+                let table = RouteTable::read(file, cascade.as_ref(), &ports, proxy_idle)?;
+                info!(
+                    "Loaded {} egress routes and {} egress points from {}",
+                    table.count,
+                    table.points.len(),
+                    file
+                );
+                table
+            }
+            None => RouteTable::default(),
+        };
+        Ok(Self {
+            default,
+            cascade,
+            ports,
+            dial,
+            proxy_idle,
+            ipv6,
+            file: routes_file.map(str::to_string),
+            table: RwLock::new(Arc::new(table)),
+        })
+    }
+
+    pub fn is_configured(&self) -> bool {
+        self.file.is_some()
+    }
+
+    /// Re-read the routing table, keeping the current one if it is invalid.
+    /// Returns the number of routes.
+    pub fn reload(&self) -> Result<usize> {
+        let Some(file) = &self.file else {
+            anyhow::bail!("no --egress-routes configured");
+        };
+        let table = RouteTable::read(file, self.cascade.as_ref(), &self.ports, self.proxy_idle)?;
+        let count = table.count;
+        let points = table.points.len();
+        *self.table.write() = Arc::new(table);
+        info!(
+            "Reloaded {} egress routes and {} egress points from {}",
+            count, points, file
+        );
+        Ok(count)
+    }
+
+    /// Probe every egress point in the routing table, forever. Points
+    /// replaced by a reload start over as unmeasured.
+    pub async fn run_probes(self: Arc<Self>) {
+        let mut interval = tokio::time::interval(PROBE_INTERVAL);
+        loop {
+            interval.tick().await;
+            let table = Arc::clone(&self.table.read());
+            let probes = table.points.iter().map(|point| point.probe());
+            futures::future::join_all(probes).await;
+        }
+    }
+
+    /// How flows to `ip` leave the server
+    pub fn route(&self, ip: Ipv4Addr) -> Via {
+        let table = Arc::clone(&self.table.read());
+        match table.routes.iter().find(|route| route.net.contains(&ip)) {
+            Some(route) => route.via.clone(),
+            None => self.default.clone(),
+        }
+    }
+
+    /// Whether a new flow to `ip` has a way out: not routed to `drop`, and
+    /// not UDP routed only to proxies, which carry just TCP. IPv6 flows
+    /// need a direct default path.
+    pub fn admits(&self, protocol: Protocol, ip: IpAddr) -> bool {
+        match ip {
+            IpAddr::V4(ip) => self.route(ip).carries(protocol),
+            IpAddr::V6(_) => self.ipv6_path().is_some(),
+        }
+    }
+
+    /// The path IPv6 flows leave by, if they have one
+    fn ipv6_path(&self) -> Option<&Path> {
+        match &self.default {
+            Via::Direct(path) => Some(path),
+            _ => None,
+        }
+    }
+
+    /// The address an IPv6 flow from `client` leaves from, if not one the
+    /// kernel picks
+    fn ipv6_source(&self, client: IpAddr) -> Option<Ipv6Addr> {
+        match (self.ipv6, client) {
+            (Ipv6Egress::Routed, IpAddr::V6(client)) => Some(client),
+            _ => None,
+        }
+    }
+
+    /// Open a TCP connection to `remote` by its route, under the dial
+    /// policy
+    pub async fn connect_tcp(&self, remote: SocketAddrV4) -> io::Result<Box<dyn Connection>> {
+        self.dial
+            .run(remote, move || async move {
+                match self.route(*remote.ip()) {
+                    Via::Pool(pool) => pool.connect_tcp(remote).await,
+                    via => via.connect_tcp(remote).await,
+                }
+            })
+            .await
+    }
+
+    /// Open a UDP flow to `remote` by its route. `mapping` is the port of
+    /// the client endpoint's other flows, under endpoint-independent mapping.
+    pub async fn open_udp(
+        &self,
+        remote: SocketAddrV4,
+        mapping: Option<&Arc<PortMapping>>,
+    ) -> io::Result<Datagrams> {
+        match self.route(*remote.ip()) {
+            Via::Pool(pool) => pool.open_udp(remote, mapping).await,
+            via => via.open_udp(remote, mapping).await,
+        }
+    }
+
+    /// Open a TCP connection to `remote` for a peer's flow from `client`:
+    /// by its route for IPv4, and on the direct path for IPv6
+    pub async fn connect_flow_tcp(
+        &self,
+        client: IpAddr,
+        remote: SocketAddr,
+    ) -> io::Result<Box<dyn Connection>> {
+        let remote = match remote {
+            SocketAddr::V4(remote) => return self.connect_tcp(remote).await,
+            SocketAddr::V6(remote) => remote,
+        };
+        let path = self.ipv6_path().ok_or_else(dropped)?;
+        let source = self.ipv6_source(client);
+        self.dial
+            .run(remote, move || async move {
+                let stream = path.connect_tcp6(remote, source).await?;
+                Ok(Box::new(stream) as Box<dyn Connection>)
+            })
+            .await
+    }
+
+    /// Open a UDP flow to `remote` for a peer's flow from `client`, as
+    /// `connect_flow_tcp` does
+    pub async fn open_flow_udp(
+        &self,
+        client: IpAddr,
+        remote: SocketAddr,
+        mapping: Option<&Arc<PortMapping>>,
+    ) -> io::Result<Datagrams> {
+        let remote = match remote {
+            SocketAddr::V4(remote) => return self.open_udp(remote, mapping).await,
+            SocketAddr::V6(remote) => remote,
+        };
+        let path = self.ipv6_path().ok_or_else(dropped)?;
+        let (socket, mapping) = path.bind_udp6(self.ipv6_source(client), mapping)?;
+        socket.connect(SocketAddr::V6(remote)).await?;
+        Ok(Datagrams::Socket { socket, mapping })
+    }
+
+    /// Open a socket for a peer's echo requests from `client` to `ip`, which
+    /// needs a direct path
+    pub fn open_echo(&self, client: IpAddr, ip: IpAddr) -> io::Result<EchoSocket> {
+        match ip {
+            IpAddr::V4(ip) => self.route(ip).open_echo(ip),
+            IpAddr::V6(_) => {
+                let path = self.ipv6_path().ok_or_else(dropped)?;
+                let source = self.ipv6_source(client).unwrap_or(Ipv6Addr::UNSPECIFIED);
+                EchoSocket::open(IpAddr::V6(source), path.interface.as_deref(), ip)
+            }
+        }
+    }
+}
+
+/// An outbound TCP connection, dialed directly or through a proxy or tunnel
+pub trait Connection: AsyncRead + AsyncWrite + Unpin + Send {
+    /// The server's socket, unless the connection is through a tunnel
+    fn socket(&self) -> Option<BorrowedFd<'_>>;
+}
+
+impl Connection for TcpStream {
+    fn socket(&self) -> Option<BorrowedFd<'_>> {
+        Some(self.as_fd())
+    }
+}
+
+impl Connection for DuplexStream {
+    fn socket(&self) -> Option<BorrowedFd<'_>> {
+        None
+    }
+}
+
+/// An outbound UDP flow: a connected socket, or a flow through a tunnel
+pub enum Datagrams {
+    Socket {
+        socket: UdpSocket,
+        /// The port the socket shares, under endpoint-independent mapping
+        mapping: Option<Arc<PortMapping>>,
+    },
+    Tunnel(TunnelUdp),
+}
+
+impl Datagrams {
+    pub async fn send(&self, data: &[u8]) -> io::Result<usize> {
+        match self {
+            Datagrams::Socket { socket, .. } => socket.send(data).await,
+            Datagrams::Tunnel(tunnel) => tunnel.send(data).await,
+        }
+    }
+
+    pub async fn recv(&self, buf: &mut [u8]) -> io::Result<usize> {
+        match self {
+            Datagrams::Socket { socket, .. } => socket.recv(buf).await,
+            Datagrams::Tunnel(tunnel) => tunnel.recv(buf).await,
+        }
+    }
+
+    pub fn mapping(&self) -> Option<&Arc<PortMapping>> {
+        match self {
+            Datagrams::Socket { mapping, .. } => mapping.as_ref(),
+            Datagrams::Tunnel(_) => None,
+        }
+    }
+
+    /// The server's socket, unless the flow is through a tunnel
+    pub fn socket(&self) -> Option<BorrowedFd<'_>> {
+        match self {
+            Datagrams::Socket { socket, .. } => Some(socket.as_fd()),
+            Datagrams::Tunnel(_) => None,
+        }
+    }
+}
+
+/// For a flow whose route changed after it was admitted
+fn dropped() -> io::Error {
+    io::Error::new(io::ErrorKind::PermissionDenied, "dropped by egress route")
+}
+
+/// A way out of the server: a source address, a device, or both
+#[derive(Debug, Clone)]
+pub struct Path {
+    source_ip: Option<Ipv4Addr>,
+    interface: Option<String>,
+    ports: Arc<NatPorts>,
+}
+
+impl Path {
+    pub fn new(
+        source_ip: Option<Ipv4Addr>,
+        interface: Option<String>,
+        ports: Arc<NatPorts>,
+    ) -> Self {
+        Self {
+            source_ip,
+            interface,
+            ports,
+        }
+    }
+
+    /// Fail early if the source address is not local or the interface
+    /// cannot be bound to
+    pub fn check(&self) -> Result<()> {
+        if self.source_ip.is_none() && self.interface.is_none() {
+            return Ok(());
+        }
+        let addr = self.local_addr();
+        let socket = std::net::UdpSocket::bind(addr)
+            .with_context(|| format!("egress IP {} is not a local address", addr.ip()))?;
+        if let Some(interface) = &self.interface {
+            setsockopt(&socket, sockopt::BindToDevice, &OsString::from(interface))
+                .with_context(|| format!("failed to bind to egress interface {}", interface))?;
+        }
+        Ok(())
+    }
+
+    /// Open a TCP connection to `remote` from the egress address
+    pub async fn connect_tcp(&self, remote: SocketAddrV4) -> io::Result<TcpStream> {
+        let socket = TcpSocket::new_v4()?;
+        if let Some(interface) = &self.interface {
+            socket.bind_device(Some(interface.as_bytes()))?;
+        }
+        let ip = IpAddr::V4(*self.local_addr().ip());
+        if !self.ports.bind_tcp(&socket, ip)? && self.source_ip.is_some() {
+            // Leave the port to connect(), so ports are only unique per
+            // destination rather than across every flow
+            bind_address_no_port(&socket)?;
+            socket.bind(SocketAddr::V4(self.local_addr()))?;
+        }
+        socket.connect(SocketAddr::V4(remote)).await
+    }
+
+    /// Open a TCP connection to an IPv6 `remote` from `source`, or from the
+    /// address the kernel picks
+    async fn connect_tcp6(
+        &self,
+        remote: SocketAddrV6,
+        source: Option<Ipv6Addr>,
+    ) -> io::Result<TcpStream> {
+        let socket = TcpSocket::new_v6()?;
+        if let Some(interface) = &self.interface {
+            socket.bind_device(Some(interface.as_bytes()))?;
+        }
+        let ip = IpAddr::V6(source.unwrap_or(Ipv6Addr::UNSPECIFIED));
+        if !self.ports.bind_tcp(&socket, ip)? && source.is_some() {
+            socket.bind(SocketAddr::new(ip, 0))?;
+        }
+        socket.connect(SocketAddr::V6(remote)).await
+    }
+
+    /// Bind a UDP socket on the egress address, sharing `mapping`'s port
+    /// under endpoint-independent mapping
+    pub fn bind_udp(
+        &self,
+        mapping: Option<&Arc<PortMapping>>,
+    ) -> io::Result<(UdpSocket, Option<Arc<PortMapping>>)> {
+        self.bind_udp_on(IpAddr::V4(*self.local_addr().ip()), mapping)
+    }
+
+    /// Bind a UDP socket for an IPv6 flow on `source`, or on any address
+    fn bind_udp6(
+        &self,
+        source: Option<Ipv6Addr>,
+        mapping: Option<&Arc<PortMapping>>,
+    ) -> io::Result<(UdpSocket, Option<Arc<PortMapping>>)> {
+        self.bind_udp_on(IpAddr::V6(source.unwrap_or(Ipv6Addr::UNSPECIFIED)), mapping)
+    }
+
+    fn bind_udp_on(
+        &self,
+        ip: IpAddr,
+        mapping: Option<&Arc<PortMapping>>,
+    ) -> io::Result<(UdpSocket, Option<Arc<PortMapping>>)> {
+        let bind_device = |socket: &OwnedFd| -> io::Result<()> {
+            if let Some(interface) = &self.interface {
+                setsockopt(socket, sockopt::BindToDevice, &OsString::from(interface))?;
+            }
+            Ok(())
+        };
+        let (socket, mapping) = self.ports.bind_udp(ip, mapping, bind_device)?;
+        Ok((UdpSocket::from_std(socket)?, mapping))
+    }
+
+    fn local_addr(&self) -> SocketAddrV4 {
+        SocketAddrV4::new(self.source_ip.unwrap_or(Ipv4Addr::UNSPECIFIED), 0)
+    }
+}
+
+/// Set IP_BIND_ADDRESS_NO_PORT, deferring the choice of source port until
+/// the socket connects
+fn bind_address_no_port(socket: &TcpSocket) -> io::Result<()> {
+    let enable: libc::c_int = 1;
+    let ret = unsafe {
+        libc::setsockopt(
+            socket.as_raw_fd(),
+            libc::IPPROTO_IP,
+            libc::IP_BIND_ADDRESS_NO_PORT,
+            &enable as *const libc::c_int as *const libc::c_void,
+            std::mem::size_of::<libc::c_int>() as libc::socklen_t,
+        )
+    };
+    if ret != 0 {
+        return Err(io::Error::last_os_error());
+    }
+    Ok(())
+}
@@ -0,0 +1,594 @@
+//! Enrollment tokens for self-service peer registration
+//!
+//! Operators mint tokens through the admin API that allow a limited number
+//! of registrations, optionally until an expiry time. Clients present one in
+//! place of the server's auth token on `/v1/register`. Peers enrolled with a
+//! token can keep re-registering with it, since the client registers on
+//! every run, without using up further registrations.
+//!
+//! A token can also require a TOTP code from an authenticator app the admin
+//! shares the secret with, as a second factor for enrolling new keys, and
+//! can tag the peers it enrolls so policies apply to them. A token given
+//! too many wrong codes in a row is locked, so its holder can't go on
+//! guessing codes.
+//!
+//! Tokens are handed to the new server on an upgrade and, in a cluster,
+//! exchanged between nodes along with the peers, so a client can redeem a
+//! token at any node. Each node keeps what it has done with a token apart
+//! from the others: the peers it enrolled, its last TOTP step and wrong
+//! codes. Registrations left, replay and lockout are decided across them
+//! all, so a token's uses are only exceeded, or a code reused, by clients
+//! racing through different nodes within a pull interval.
+
+use std::collections::hash_map::Entry;
+use std::collections::{HashMap, HashSet};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use base64::Engine;
+use rand::RngCore;
+use serde::{Deserialize, Serialize};
+use tracing::warn;
+
+use super::events::encode_key;
+use super::totp;
+use super::usage::unix_now;
+
+/// Wrong TOTP codes in a row after which a token stops enrolling new keys
+const MAX_TOTP_FAILURES: u32 = 5;
+
+/// How long revoked tokens are remembered, for nodes that were down to
+/// learn of the revocation
+const REVOKED_TTL: Duration = Duration::from_secs(7 * 86400);
+
+/// Why an enrollment token was not accepted
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum EnrollError {
+    Invalid,
+    Expired,
+    Exhausted,
+    /// The token needs a TOTP code and none, a wrong one, or a reused one was given
+    TotpRequired,
+    /// The token was given too many wrong TOTP codes
+    Locked,
+}
+
+impl EnrollError {
+    pub fn message(self) -> &'static str {
+        match self {
+            EnrollError::Invalid => "invalid token",
+            EnrollError::Expired => "enrollment token expired",
+            EnrollError::Exhausted => "enrollment token has no registrations left",
+            EnrollError::TotpRequired => "a valid TOTP code is required with this token",
+            EnrollError::Locked => "enrollment token locked after too many wrong TOTP codes",
+        }
+    }
+}
+
+struct EnrollmentToken {
+    id: String,
+    uses: u32,
+    expires_at: Option<SystemTime>,
+    totp_secret: Option<Vec<u8>>,
+    peer_ttl: Option<Duration>,
+    peer_tags: Vec<String>,
+    /// Unix time the token was revoked. Revoked tokens are kept for a
+    /// while, so other nodes learn of the revocation rather than bringing
+    /// the token back.
+    revoked_at: Option<u64>,
+    /// What each node has done with the token, by node name
+    nodes: HashMap<String, NodeUse>,
+}
+
+/// What one node has done with a token. Only that node changes it, so the
+/// copy with the most changes is the newest.
+#[derive(Default)]
+struct NodeUse {
+    changes: u64,
+    enrolled: HashSet<[u8; 32]>,
+    /// Time step of the last accepted TOTP code, so codes cannot be replayed
+    last_totp_step: Option<u64>,
+    /// Wrong TOTP codes given since the last right one
+    totp_failures: u32,
+}
+
+impl EnrollmentToken {
+    fn is_enrolled(&self, peer: &[u8; 32]) -> bool {
+        self.nodes.values().any(|node| node.enrolled.contains(peer))
+    }
+
+    fn enrolled_peers(&self) -> usize {
+        let enrolled: HashSet<_> = self
+            .nodes
+            .values()
+            .flat_map(|node| &node.enrolled)
+            .collect();
+        enrolled.len()
+    }
+
+    fn uses_left(&self) -> u32 {
+        let enrolled = u32::try_from(self.enrolled_peers()).unwrap_or(u32::MAX);
+        self.uses.saturating_sub(enrolled)
+    }
+
+    fn last_totp_step(&self) -> Option<u64> {
+        self.nodes
+            .values()
+            .filter_map(|node| node.last_totp_step)
+            .max()
+    }
+
+    fn totp_failures(&self) -> u32 {
+        self.nodes
+            .values()
+            .fold(0, |sum, node| sum.saturating_add(node.totp_failures))
+    }
+
+    /// `node`'s use of the token, counted as changed
+    fn change(&mut self, node: &str) -> &mut NodeUse {
+        let own = self.nodes.entry(node.to_string()).or_default();
+        own.changes += 1;
+        own
+    }
+}
+
+/// What a new token allows
+pub struct TokenOptions {
+    /// Number of peers the token may register
+    pub uses: u32,
+    /// When the token itself stops enrolling new peers
+    pub expires_at: Option<SystemTime>,
+    /// Require a TOTP code for each new peer
+    pub require_totp: bool,
+    /// Lifetime of peers the token registers, renewed when they register again
+    pub peer_ttl: Option<Duration>,
+    /// Tags given to peers the token registers
+    pub peer_tags: Vec<String>,
+}
+
+/// Token details shown by the admin API, without the secret
+#[derive(Debug, Clone, Serialize)]
+pub struct TokenSummary {
+    pub id: String,
+    pub uses_left: u32,
+    /// Unix timestamp after which the token stops enrolling new peers
+    pub expires_at: Option<u64>,
+    pub enrolled_peers: usize,
+    pub totp: bool,
+    /// Whether the token was given too many wrong TOTP codes to enroll more
+    /// keys
+    pub totp_locked: bool,
+    /// Seconds peers enrolled with the token live after registering
+    pub peer_ttl_secs: Option<u64>,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub peer_tags: Vec<String>,
+}
+
+/// A newly minted token, including secrets that are only shown once
+pub struct CreatedToken {
+    pub secret: String,
+    /// Authenticator app URI for tokens that require a TOTP code
+    pub totp_uri: Option<String>,
+    pub summary: TokenSummary,
+}
+
+pub struct EnrollmentRegistry {
+    /// This node's name in a cluster, which its own use of tokens is kept
+    /// under
+    node: String,
+    /// Token secret -> token
+    tokens: HashMap<String, EnrollmentToken>,
+}
+
+impl EnrollmentRegistry {
+    pub fn new(node: String) -> Self {
+        Self {
+            node,
+            tokens: HashMap::new(),
+        }
+    }
+
+    /// Mint a token with the given limits
+    pub fn create(&mut self, options: TokenOptions) -> CreatedToken {
+        let secret = random_string(32);
+        let token = EnrollmentToken {
+            id: random_string(6),
+            uses: options.uses,
+            expires_at: options.expires_at,
+            totp_secret: options.require_totp.then(totp::generate_secret),
+            peer_ttl: options.peer_ttl,
+            peer_tags: options.peer_tags,
+            revoked_at: None,
+            nodes: HashMap::new(),
+        };
+        let totp_uri = token
+            .totp_secret
+            .as_deref()
+            .map(|totp_secret| totp::otpauth_uri(totp_secret, &token.id));
+        let summary = summarize(&token);
+        self.tokens.insert(secret.clone(), token);
+        CreatedToken {
+            secret,
+            totp_uri,
+            summary,
+        }
+    }
+
+    pub fn list(&self) -> Vec<TokenSummary> {
+        let mut tokens: Vec<_> = self
+            .tokens
+            .values()
+            .filter(|token| token.revoked_at.is_none())
+            .map(summarize)
+            .collect();
+        tokens.sort_by(|a, b| a.id.cmp(&b.id));
+        tokens
+    }
+
+    /// Revoke a token by ID; peers it already enrolled stay registered
+    pub fn revoke(&mut self, id: &str) -> bool {
+        let token = self
+            .tokens
+            .values_mut()
+            .find(|token| token.id == id && token.revoked_at.is_none());
+        let Some(token) = token else {
+            return false;
+        };
+        token.revoked_at = Some(unix_now());
+        true
+    }
+
+    /// Use the token to register `peer`.
+    ///
+    /// Returns whether a registration was consumed; peers the token already
+    /// enrolled are accepted without consuming one or needing a TOTP code.
+    pub fn redeem(
+        &mut self,
+        secret: &str,
+        peer: &[u8; 32],
+        totp_code: Option<&str>,
+    ) -> Result<bool, EnrollError> {
+        let token = self
+            .tokens
+            .get_mut(secret)
+            .filter(|token| token.revoked_at.is_none())
+            .ok_or(EnrollError::Invalid)?;
+        if token.is_enrolled(peer) {
+            return Ok(false);
+        }
+        if token
+            .expires_at
+            .is_some_and(|expires_at| expires_at <= SystemTime::now())
+        {
+            return Err(EnrollError::Expired);
+        }
+        if token.uses_left() == 0 {
+            return Err(EnrollError::Exhausted);
+        }
+        if token.totp_secret.is_some() {
+            if token.totp_failures() >= MAX_TOTP_FAILURES {
+                return Err(EnrollError::Locked);
+            }
+            let last_step = token.last_totp_step();
+            let step = token
+                .totp_secret
+                .as_deref()
+                .zip(totp_code)
+                .and_then(|(totp_secret, code)| totp::verify(totp_secret, code))
+                .filter(|step| last_step.is_none_or(|last| *step > last));
+            let Some(step) = step else {
+                // Only codes given count, so clients that don't know the
+                // token needs one can't lock it by trying without
+                if totp_code.is_some() {
+                    token.change(&self.node).totp_failures += 1;
+                }
+                return Err(EnrollError::TotpRequired);
+            };
+            let own = token.change(&self.node);
+            own.totp_failures = 0;
+            own.last_totp_step = Some(step);
+        }
+        token.change(&self.node).enrolled.insert(*peer);
+        Ok(true)
+    }
+
+    /// ID of the token with this secret, for logging
+    pub fn id_of(&self, secret: &str) -> Option<&str> {
+        self.tokens.get(secret).map(|token| token.id.as_str())
+    }
+
+    /// Lifetime the token gives the peers it registers, if limited
+    pub fn peer_ttl(&self, secret: &str) -> Option<Duration> {
+        self.tokens.get(secret)?.peer_ttl
+    }
+
+    /// Tags the token gives the peers it registers
+    pub fn peer_tags(&self, secret: &str) -> Vec<String> {
+        self.tokens
+            .get(secret)
+            .map(|token| token.peer_tags.clone())
+            .unwrap_or_default()
+    }
+
+    /// Give back a registration consumed by a failed enrollment
+    pub fn refund(&mut self, secret: &str, peer: &[u8; 32]) {
+        let Some(token) = self.tokens.get_mut(secret) else {
+            return;
+        };
+        let enrolled_here = token
+            .nodes
+            .get(&self.node)
+            .is_some_and(|own| own.enrolled.contains(peer));
+        if enrolled_here {
+            token.change(&self.node).enrolled.remove(peer);
+        }
+    }
+
+    /// Every token, revoked ones included, as nodes exchange them and a
+    /// server hands them to its successor
+    pub fn export(&self) -> Vec<SharedToken> {
+        self.tokens
+            .iter()
+            .map(|(secret, token)| SharedToken::new(secret, token))
+            .collect()
+    }
+
+    /// Take in tokens from another node, or from the server this one took
+    /// over from: tokens not seen before are added, and revocations and
+    /// each node's newer use of the rest are applied
+    pub fn merge(&mut self, tokens: Vec<SharedToken>) {
+        for shared in tokens {
+            let id = shared.id.clone();
+            let Some((secret, theirs)) = shared.into_token() else {
+                warn!("Ignoring invalid shared enrollment token {}", id);
+                continue;
+            };
+            let token = match self.tokens.entry(secret) {
+                Entry::Vacant(entry) => {
+                    entry.insert(theirs);
+                    continue;
+                }
+                Entry::Occupied(entry) => entry.into_mut(),
+            };
+            token.revoked_at = match (token.revoked_at, theirs.revoked_at) {
+                (Some(ours), Some(theirs)) => Some(ours.min(theirs)),
+                (ours, theirs) => ours.or(theirs),
+            };
+            for (node, their_use) in theirs.nodes {
+                let own = node == self.node;
+                let our_use = token.nodes.entry(node).or_default();
+                if their_use.changes <= our_use.changes {
+                    continue;
+                }
+                if own {
+                    // What this node did before it restarted, kept along
+                    // with what it has done since
+                    our_use.enrolled.extend(their_use.enrolled);
+                    our_use.last_totp_step = our_use.last_totp_step.max(their_use.last_totp_step);
+                    our_use.totp_failures = our_use.totp_failures.max(their_use.totp_failures);
+                    our_use.changes = their_use.changes + 1;
+                } else {
+                    *our_use = their_use;
+                }
+            }
+        }
+        let forget_before = unix_now().saturating_sub(REVOKED_TTL.as_secs());
+        self.tokens.retain(|_, token| {
+            token
+                .revoked_at
+                .is_none_or(|revoked_at| revoked_at >= forget_before)
+        });
+    }
+}
+
+/// An enrollment token as nodes exchange it, secrets included
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SharedToken {
+    secret: String,
+    id: String,
+    uses: u32,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    expires_at: Option<u64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    totp_secret: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    peer_ttl_secs: Option<u64>,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    peer_tags: Vec<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    revoked_at: Option<u64>,
+    #[serde(default)]
+    nodes: HashMap<String, SharedUse>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct SharedUse {
+    changes: u64,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    enrolled: Vec<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    last_totp_step: Option<u64>,
+    #[serde(default)]
+    totp_failures: u32,
+}
+
+impl SharedToken {
+    fn new(secret: &str, token: &EnrollmentToken) -> Self {
+        let b64 = &base64::engine::general_purpose::STANDARD;
+        Self {
+            secret: secret.to_string(),
+            id: token.id.clone(),
+            uses: token.uses,
+            expires_at: token.expires_at.map(unix_secs),
+            totp_secret: token.totp_secret.as_ref().map(|secret| b64.encode(secret)),
+            peer_ttl_secs: token.peer_ttl.map(|ttl| ttl.as_secs()),
+            peer_tags: token.peer_tags.clone(),
+            revoked_at: token.revoked_at,
+            nodes: token
+                .nodes
+                .iter()
+                .map(|(node, node_use)| {
+                    let shared = SharedUse {
+                        changes: node_use.changes,
+                        enrolled: node_use.enrolled.iter().map(encode_key).collect(),
+                        last_totp_step: node_use.last_totp_step,
+                        totp_failures: node_use.totp_failures,
+                    };
+                    (node.clone(), shared)
+                })
+                .collect(),
+        }
+    }
+
+    /// The token and its secret, or `None` if any of it is invalid
+    fn into_token(self) -> Option<(String, EnrollmentToken)> {
+        let b64 = &base64::engine::general_purpose::STANDARD;
+        let expires_at = match self.expires_at {
+            Some(secs) => Some(UNIX_EPOCH.checked_add(Duration::from_secs(secs))?),
+            None => None,
+        };
+        let totp_secret = match self.totp_secret {
+            Some(secret) => Some(b64.decode(secret).ok()?),
+            None => None,
+        };
+        let mut nodes = HashMap::new();
+        for (node, shared) in self.nodes {
+            let enrolled = shared
+                .enrolled
+                .iter()
+                .map(|key| decode_key(key))
+                .collect::<Option<_>>()?;
+            let node_use = NodeUse {
+                changes: shared.changes,
+                enrolled,
+                last_totp_step: shared.last_totp_step,
+                totp_failures: shared.totp_failures,
+            };
+            nodes.insert(node, node_use);
+        }
+        let token = EnrollmentToken {
+            id: self.id,
+            uses: self.uses,
+            expires_at,
+            totp_secret,
+            peer_ttl: self.peer_ttl_secs.map(Duration::from_secs),
+            peer_tags: self.peer_tags,
+            revoked_at: self.revoked_at,
+            nodes,
+        };
+        Some((self.secret, token))
+    }
+}
+
+fn summarize(token: &EnrollmentToken) -> TokenSummary {
+    TokenSummary {
+        id: token.id.clone(),
+        uses_left: token.uses_left(),
+        expires_at: token.expires_at.map(unix_secs),
+        enrolled_peers: token.enrolled_peers(),
+        totp: token.totp_secret.is_some(),
+        totp_locked: token.totp_failures() >= MAX_TOTP_FAILURES,
+        peer_ttl_secs: token.peer_ttl.map(|ttl| ttl.as_secs()),
+        peer_tags: token.peer_tags.clone(),
+    }
+}
+
+fn unix_secs(time: SystemTime) -> u64 {
+    time.duration_since(UNIX_EPOCH).map_or(0, |d| d.as_secs())
+}
+
+fn decode_key(key: &str) -> Option<[u8; 32]> {
+    base64::engine::general_purpose::STANDARD
+        .decode(key)
+        .ok()
+        .and_then(|bytes| <[u8; 32]>::try_from(bytes).ok())
+}
+
+fn random_string(len: usize) -> String {
+    let mut bytes = vec![0u8; len];
+    rand::thread_rng().fill_bytes(&mut bytes);
+    base64::engine::general_purpose::URL_SAFE_NO_PAD.encode(bytes)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn wrong_totp_codes_lock_the_token() {
+        let mut registry = EnrollmentRegistry::new(String::new());
+        let created = registry.create(TokenOptions {
+            uses: 10,
+            expires_at: None,
+            require_totp: true,
+            peer_ttl: None,
+            peer_tags: Vec::new(),
+        });
+        let totp_secret = registry.tokens[&created.secret]
+            .totp_secret
+            .clone()
+            .unwrap();
+        let step = totp::current_step().unwrap();
+        let right = totp::code_at(&totp_secret, step + 1);
+        let wrong = (0..)
+            .map(|n| format!("{:06}", n))
+            .find(|code| totp::verify(&totp_secret, code).is_none())
+            .unwrap();
+
+        // Trying without a code doesn't count
+        for _ in 0..MAX_TOTP_FAILURES {
+            let result = registry.redeem(&created.secret, &[1; 32], None);
+            assert_eq!(result, Err(EnrollError::TotpRequired));
+        }
+        for _ in 0..MAX_TOTP_FAILURES {
+            let result = registry.redeem(&created.secret, &[1; 32], Some(&wrong));
+            assert_eq!(result, Err(EnrollError::TotpRequired));
+        }
+        let result = registry.redeem(&created.secret, &[1; 32], Some(&right));
+        assert_eq!(result, Err(EnrollError::Locked));
+        assert!(registry.list()[0].totp_locked);
+    }
+
+    #[test]
+    fn tokens_are_shared_between_nodes() {
+        let mut first = EnrollmentRegistry::new("vpn1".to_string());
+        let mut second = EnrollmentRegistry::new("vpn2".to_string());
+        let created = first.create(TokenOptions {
+            uses: 2,
+            expires_at: None,
+            require_totp: false,
+            peer_ttl: None,
+            peer_tags: vec!["ci".to_string()],
+        });
+        second.merge(first.export());
+        assert_eq!(second.peer_tags(&created.secret), ["ci"]);
+
+        // Each node enrolls a peer, and both learn of the other's
+        assert_eq!(first.redeem(&created.secret, &[1; 32], None), Ok(true));
+        assert_eq!(second.redeem(&created.secret, &[2; 32], None), Ok(true));
+        first.merge(second.export());
+        second.merge(first.export());
+        for registry in [&mut first, &mut second] {
+            assert_eq!(registry.list()[0].uses_left, 0);
+            assert_eq!(registry.redeem(&created.secret, &[1; 32], None), Ok(false));
+            assert_eq!(
+                registry.redeem(&created.secret, &[3; 32], None),
+                Err(EnrollError::Exhausted)
+            );
+        }
+
+        // A node that restarted gets back what it did before
+        let mut restarted = EnrollmentRegistry::new("vpn2".to_string());
+        restarted.merge(first.export());
+        restarted.refund(&created.secret, &[2; 32]);
+        first.merge(restarted.export());
+        assert_eq!(first.list()[0].uses_left, 1);
+
+        assert!(second.revoke(&created.summary.id));
+        first.merge(second.export());
+        assert!(first.list().is_empty());
+        assert_eq!(
+            first.redeem(&created.secret, &[4; 32], None),
+            Err(EnrollError::Invalid)
+        );
+    }
+}
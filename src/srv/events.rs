@@ -0,0 +1,99 @@
+//! Server events for external controllers
+//!
+//! State changes are published on a broadcast bus and streamed to admin API
+//! subscribers, so controllers can react without polling the peer list.
+
+use std::net::{Ipv4Addr, SocketAddr};
+
+use base64::Engine;
+use serde::Serialize;
+use tokio::sync::broadcast;
+
+use super::anomaly::AnomalyKind;
+
+/// Events buffered per subscriber before it starts missing some
+const EVENT_BUFFER: usize = 256;
+
+#[derive(Debug, Clone, Serialize)]
+#[serde(tag = "type", rename_all = "snake_case")]
+pub enum Event {
+    PeerAdded {
+        public_key: String,
+        assigned_ip: Ipv4Addr,
+        name: Option<String>,
+    },
+    PeerRemoved {
+        public_key: String,
+        assigned_ip: Ipv4Addr,
+    },
+    /// A peer was removed because its expiry passed; follows its
+    /// `PeerRemoved`
+    PeerExpired {
+        public_key: String,
+        assigned_ip: Ipv4Addr,
+    },
+    HandshakeCompleted {
+        public_key: String,
+        endpoint: SocketAddr,
+    },
+    EndpointChanged {
+        public_key: String,
+        previous: Option<SocketAddr>,
+        endpoint: SocketAddr,
+    },
+    /// A peer's egress looks unusual (see `anomaly`)
+    Anomaly {
+        public_key: String,
+        anomaly: AnomalyKind,
+        detail: String,
+    },
+}
+
+impl Event {
+    pub fn kind(&self) -> &'static str {
+        match self {
+            Event::PeerAdded { .. } => "peer_added",
+            Event::PeerRemoved { .. } => "peer_removed",
+            Event::PeerExpired { .. } => "peer_expired",
+            Event::HandshakeCompleted { .. } => "handshake_completed",
+            Event::EndpointChanged { .. } => "endpoint_changed",
+            Event::Anomaly { .. } => "anomaly",
+        }
+    }
+}
+
+pub struct EventBus {
+    tx: broadcast::Sender<Event>,
+}
+
+impl EventBus {
+    pub fn new() -> Self {
+        let (tx, _) = broadcast::channel(EVENT_BUFFER);
+        Self { tx }
+    }
+
+    /// Publish an event to current subscribers, if any
+    pub fn publish(&self, event: Event) {
+        let _ = self.tx.send(event);
+    }
+
+    pub fn subscribe(&self) -> broadcast::Receiver<Event> {
+        self.tx.subscribe()
+    }
+
+    /// Subscribers currently listening
+    pub fn subscriber_count(&self) -> usize {
+        self.tx.receiver_count()
+    }
+}
+
+impl Default for EventBus {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+/// Base64 form of a public key as it appears in events
+pub fn encode_key(key: &[u8; 32]) -> String {
+    base64::engine::general_purpose::STANDARD.encode(key)
+}
@@ -0,0 +1,453 @@
+//! Firewall rules for forwarded traffic
+//!
+//! `--firewall-rules` loads an ordered rule list that every new outbound
+//! flow from a peer is checked against, one rule per line:
+//!
+//! ```text
+//! policy accept
+//! log tcp from tag:contractors port 22
+//! reject tcp from tag:contractors port 22
+//! drop from peer:<base64 public key> to 169.254.0.0/16
+//! accept udp to domain:ntp.example.com port 123
+//! drop to 10.0.0.0/8
+//! ```
+//!
+//! A rule is a verdict, an optional protocol (`tcp` or `udp`), and any of
+//! `from` (`any`, `peer:<key>`, `name:<peer name>` or `tag:<tag>`), `to`
+//! (`any`, a CIDR or address, or `domain:<name>`) and `port` (a port, a
+//! `low-high` range, or a comma-separated list of either). As in nftables,
+//! the first `accept`, `drop` or `reject` to match decides, while `log`
+//! records the match and carries on; flows no rule decides get the
+//! `policy` (`accept` unless set). Pings leaving through the NAT are
+//! matched by rules naming neither a protocol nor a port. Domains are
+//! resolved when the rules are loaded. `drop` discards the flow's packets
+//! silently and `reject` answers with a TCP reset or ICMP port unreachable.
+//!
+//! Unless `--egress-safeguards=false`, built-in rules after the file's
+//! reject SMTP (TCP port 25), so a new server can't be used to send spam,
+//! and cloud metadata services (169.254.0.0/16, Alibaba's 100.100.100.200
+//! and AWS's fd00:ec2::254), which would hand peers the host's
+//! credentials. A rule
+//! in the file that matches first overrides them for the peers it names,
+//! such as `accept tcp from tag:mail port 25`.
+//!
+//! The file can be reloaded at runtime; the new rules apply to flows opened
+//! afterwards.
+
+use std::net::IpAddr;
+use std::ops::RangeInclusive;
+use std::path::PathBuf;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Arc;
+
+use anyhow::{Context, Result};
+use base64::Engine;
+use ipnet::IpNet;
+use parking_lot::RwLock;
+use serde::Serialize;
+use tracing::info;
+
+use super::events::encode_key;
+use super::flow::Protocol;
+use super::state::SharedState;
+
+/// Checked after the file's rules with `--egress-safeguards`
+const SAFEGUARD_RULES: &str = "\
+reject tcp port 25
+reject to 169.254.0.0/16
+reject to 100.100.100.200
+reject to fd00:ec2::254
+";
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Verdict {
+    Accept,
+    Drop,
+    Reject,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum RuleAction {
+    Verdict(Verdict),
+    Log,
+}
+
+#[derive(Debug)]
+enum Source {
+    Any,
+    Peer([u8; 32]),
+    Name(String),
+    Tag(String),
+}
+
+#[derive(Debug)]
+enum Destination {
+    Any,
+    Net(IpNet),
+    /// A domain and the addresses it resolved to at load time
+    Domain(String, Vec<IpAddr>),
+}
+
+#[derive(Debug)]
+struct Rule {
+    line: usize,
+    text: String,
+    action: RuleAction,
+    protocol: Option<Protocol>,
+    from: Source,
+    to: Destination,
+    ports: Vec<RangeInclusive<u16>>,
+    hits: AtomicU64,
+}
+
+/// A rule as reported by the admin API
+#[derive(Debug, Serialize)]
+pub struct RuleSummary {
+    /// 0 for the built-in safeguards
+    pub line: usize,
+    pub rule: String,
+    pub hits: u64,
+}
+
+#[derive(Debug)]
+struct Ruleset {
+    rules: Vec<Rule>,
+    policy: Verdict,
+}
+
+impl Ruleset {
+    fn empty() -> Self {
+        Self {
+            rules: Vec::new(),
+            policy: Verdict::Accept,
+        }
+    }
+}
+
+pub struct Firewall {
+    path: Option<PathBuf>,
+    safeguards: bool,
+    shared: Arc<SharedState>,
+    ruleset: RwLock<Arc<Ruleset>>,
+}
+
+impl Firewall {
+    /// Load rules from `path`, or accept everything without one but what
+    /// the safeguards reject
+    pub async fn load(
+        path: Option<PathBuf>,
+        safeguards: bool,
+        shared: Arc<SharedState>,
+    ) -> Result<Self> {
+        let mut ruleset = match &path {
+            Some(path) => read(path).await?,
+            None => Ruleset::empty(),
+        };
+        if safeguards {
+            ruleset.rules.extend(safeguard_rules());
+        }
+        Ok(Self {
+            path,
+            safeguards,
+            shared,
+            ruleset: RwLock::new(Arc::new(ruleset)),
+        })
+    }
+
+    pub fn is_configured(&self) -> bool {
+        self.path.is_some()
+    }
+
+    /// Re-read the rules file, keeping the current rules if it is invalid.
+    /// Returns the number of rules loaded.
+    pub async fn reload(&self) -> Result<usize> {
+        let Some(path) = &self.path else {
+            anyhow::bail!("no --firewall-rules file configured");
+        };
+        let mut ruleset = read(path).await?;
+        let count = ruleset.rules.len();
+        if self.safeguards {
+            ruleset.rules.extend(safeguard_rules());
+        }
+        *self.ruleset.write() = Arc::new(ruleset);
+        info!("Reloaded {} firewall rules from {}", count, path.display());
+        Ok(count)
+    }
+
+    /// Decide a new flow from `peer` to `ip:port`
+    pub fn check(&self, peer: &[u8; 32], protocol: Protocol, ip: IpAddr, port: u16) -> Verdict {
+        self.decide(peer, Some((protocol, port)), ip)
+    }
+
+    /// Decide a new ICMP echo session from `peer` to `ip`, which only rules
+    /// naming no protocol or port match
+    pub fn check_echo(&self, peer: &[u8; 32], ip: IpAddr) -> Verdict {
+        self.decide(peer, None, ip)
+    }
+
+    /// `transport` is the flow's protocol and port, if it has them
+    fn decide(&self, peer: &[u8; 32], transport: Option<(Protocol, u16)>, ip: IpAddr) -> Verdict {
+        let ruleset = Arc::clone(&self.ruleset.read());
+        // Looked up once, and only if a rule needs it
+        let mut labels = None;
+        for rule in &ruleset.rules {
+            let transport_matches = match transport {
+                Some((protocol, port)) => {
+                    rule.protocol.is_none_or(|p| p == protocol)
+                        && (rule.ports.is_empty()
+                            || rule.ports.iter().any(|range| range.contains(&port)))
+                }
+                None => rule.protocol.is_none() && rule.ports.is_empty(),
+            };
+            if !transport_matches || !rule.to.matches(ip) {
+                continue;
+            }
+            let from_matches = match &rule.from {
+                Source::Any => true,
+                Source::Peer(key) => key == peer,
+                Source::Name(name) => {
+                    let (peer_name, _) = labels.get_or_insert_with(|| self.labels(peer));
+                    peer_name.as_ref() == Some(name)
+                }
+                Source::Tag(tag) => {
+                    let (_, tags) = labels.get_or_insert_with(|| self.labels(peer));
+                    tags.contains(tag)
+                }
+            };
+            if !from_matches {
+                continue;
+            }
+
+            rule.hits.fetch_add(1, Ordering::Relaxed);
+            match rule.action {
+                RuleAction::Verdict(verdict) => return verdict,
+                RuleAction::Log => match transport {
+                    Some((protocol, port)) => info!(
+                        "Firewall rule {} matched {:?} {} -> {}:{}",
+                        rule.line,
+                        protocol,
+                        encode_key(peer),
+                        ip,
+                        port
+                    ),
+                    None => info!(
+                        "Firewall rule {} matched ICMP echo {} -> {}",
+                        rule.line,
+                        encode_key(peer),
+                        ip
+                    ),
+                },
+            }
+        }
+        ruleset.policy
+    }
+
+    /// A peer's name and tags
+    fn labels(&self, peer: &[u8; 32]) -> (Option<String>, Vec<String>) {
+        self.shared
+            .peers
+            .read()
+            .get_by_pubkey(peer)
+            .map(|info| (info.name.clone(), info.tags.clone()))
+            .unwrap_or_default()
+    }
+
+    /// Current rules with how many flows each has matched
+    pub fn rules(&self) -> Vec<RuleSummary> {
+        self.ruleset
+            .read()
+            .rules
+            .iter()
+            .map(|rule| RuleSummary {
+                line: rule.line,
+                rule: rule.text.clone(),
+                hits: rule.hits.load(Ordering::Relaxed),
+            })
+            .collect()
+    }
+
+    pub fn policy(&self) -> &'static str {
+        match self.ruleset.read().policy {
+            Verdict::Accept => "accept",
+            Verdict::Drop => "drop",
+            Verdict::Reject => "reject",
+        }
+    }
+}
+
+impl Destination {
+    fn matches(&self, ip: IpAddr) -> bool {
+        match self {
+            Destination::Any => true,
+            Destination::Net(net) => net.contains(&ip),
+            Destination::Domain(_, addrs) => addrs.contains(&ip),
+        }
+    }
+}
+
+fn safeguard_rules() -> Vec<Rule> {
+    let mut rules = parse(SAFEGUARD_RULES).expect("safeguard rules parse").rules;
+    for rule in &mut rules {
+        rule.line = 0;
+    }
+    rules
+}
+
+async fn read(path: &std::path::Path) -> Result<Ruleset> {
+    let contents = tokio::fs::read_to_string(path)
+        .await
+        .with_context(|| format!("failed to read firewall rules {}", path.display()))?;
+    let mut ruleset = parse(&contents)
+        .with_context(|| format!("failed to parse firewall rules {}", path.display()))?;
+    for rule in &mut ruleset.rules {
+        if let Destination::Domain(domain, addrs) = &mut rule.to {
+            *addrs = resolve(domain)
+                .await
+                .with_context(|| format!("line {}: failed to resolve {}", rule.line, domain))?;
+        }
+    }
+    Ok(ruleset)
+}
+
+async fn resolve(domain: &str) -> Result<Vec<IpAddr>> {
+    let addrs: Vec<IpAddr> = tokio::net::lookup_host((domain, 0))
+        .await?
+        .map(|addr| addr.ip())
+        .collect();
+    if addrs.is_empty() {
+        anyhow::bail!("no addresses");
+    }
+    Ok(addrs)
+}
+
+fn parse(contents: &str) -> Result<Ruleset> {
+    let mut ruleset = Ruleset::empty();
+    for (i, line) in contents.lines().enumerate() {
+        let text = line.split('#').next().unwrap_or_default().trim();
+        if text.is_empty() {
+            continue;
+        }
+        let line = i + 1;
+        let words: Vec<&str> = text.split_whitespace().collect();
+        if words[0] == "policy" {
+            ruleset.policy = match words[1..] {
+                ["accept"] => Verdict::Accept,
+                ["drop"] => Verdict::Drop,
+                ["reject"] => Verdict::Reject,
+                _ => anyhow::bail!("line {}: expected `policy accept|drop|reject`", line),
+            };
+            continue;
+        }
+        let rule = parse_rule(line, text, &words).with_context(|| format!("line {}", line))?;
+        ruleset.rules.push(rule);
+    }
+    Ok(ruleset)
+}
+
+fn parse_rule(line: usize, text: &str, words: &[&str]) -> Result<Rule> {
+    let action = match words[0] {
+        "accept" => RuleAction::Verdict(Verdict::Accept),
+        "drop" => RuleAction::Verdict(Verdict::Drop),
+        "reject" => RuleAction::Verdict(Verdict::Reject),
+        "log" => RuleAction::Log,
+        other => anyhow::bail!("unknown verdict `{}`", other),
+    };
+    let mut rest = &words[1..];
+    let protocol = match rest.first() {
+        Some(&"tcp") => Some(Protocol::Tcp),
+        Some(&"udp") => Some(Protocol::Udp),
+        _ => None,
+    };
+    if protocol.is_some() {
+        rest = &rest[1..];
+    }
+
+    let mut rule = Rule {
+        line,
+        text: text.to_string(),
+        action,
+        protocol,
+        from: Source::Any,
+        to: Destination::Any,
+        ports: Vec::new(),
+        hits: AtomicU64::new(0),
+    };
+    let (mut seen_from, mut seen_to, mut seen_port) = (false, false, false);
+    while let [keyword, value, tail @ ..] = rest {
+        let seen = match *keyword {
+            "from" => {
+                rule.from = parse_source(value)?;
+                &mut seen_from
+            }
+            "to" => {
+                rule.to = parse_destination(value)?;
+                &mut seen_to
+            }
+            "port" => {
+                rule.ports = value
+                    .split(',')
+                    .map(parse_port_range)
+                    .collect::<Result<_>>()?;
+                &mut seen_port
+            }
+            other => anyhow::bail!("unexpected `{}`", other),
+        };
+        if std::mem::replace(seen, true) {
+            anyhow::bail!("`{}` given more than once", keyword);
+        }
+        rest = tail;
+    }
+    if let Some(dangling) = rest.first() {
+        anyhow::bail!("`{}` needs a value", dangling);
+    }
+    Ok(rule)
+}
+
+fn parse_source(value: &str) -> Result<Source> {
+    if value == "any" {
+        return Ok(Source::Any);
+    }
+    match value.split_once(':') {
+        Some(("peer", key)) => {
+            let key = base64::engine::general_purpose::STANDARD
+                .decode(key)
+                .ok()
+                .and_then(|bytes| <[u8; 32]>::try_from(bytes).ok())
+                .with_context(|| format!("invalid peer public key {}", key))?;
+            Ok(Source::Peer(key))
+        }
+        Some(("name", name)) => Ok(Source::Name(name.to_string())),
+        Some(("tag", tag)) => Ok(Source::Tag(tag.to_string())),
+        _ => anyhow::bail!(
+            "invalid source `{}` (expected any, peer:<key>, name:<name> or tag:<tag>)",
+            value
+        ),
+    }
+}
+
+fn parse_destination(value: &str) -> Result<Destination> {
+    if value == "any" {
+        return Ok(Destination::Any);
+    }
+    if let Some(domain) = value.strip_prefix("domain:") {
+        return Ok(Destination::Domain(domain.to_string(), Vec::new()));
+    }
+    value
+        .parse::<IpNet>()
+        .or_else(|_| value.parse::<IpAddr>().map(IpNet::from))
+        .map(Destination::Net)
+        .with_context(|| format!("invalid destination `{}`", value))
+}
+
+fn parse_port_range(value: &str) -> Result<RangeInclusive<u16>> {
+    let (low, high) = value.split_once('-').unwrap_or((value, value));
+    let parse = |port: &str| {
+        port.parse::<u16>()
+            .with_context(|| format!("invalid port `{}`", value))
+    };
+    let (low, high) = (parse(low)?, parse(high)?);
+    if low > high {
+        anyhow::bail!("invalid port range `{}`", value);
+    }
+    Ok(low..=high)
+}
@@ -4,7 +4,12 @@
 //! - A WireGuard client (via smoltcp socket)
 //! - An internet destination (via tokio socket)
 
-use std::net::Ipv4Addr;
+use std::net::{IpAddr, Ipv4Addr};
+use std::time::Duration;
+
+/// Longest the dataplane waits between looking for timed-out flows
+const MAX_REAP_INTERVAL: Duration = Duration::from_secs(10);
+
 /// Protocol type
 #[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
 pub enum Protocol {
@@ -16,34 +21,85 @@ pub enum Protocol {
 #[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
 pub struct FlowKey {
     pub protocol: Protocol,
-    pub client_ip: Ipv4Addr,
+    pub client_ip: IpAddr,
     pub client_port: u16,
-    pub remote_ip: Ipv4Addr,
+    pub remote_ip: IpAddr,
     pub remote_port: u16,
 }
 
 /// Configuration for flow timeouts
 #[derive(Debug, Clone)]
 pub struct FlowConfig {
+    /// Idle time after which an established TCP flow is closed
     pub tcp_idle_timeout_secs: u64,
+    /// Idle time after which a TCP flow that one side has closed is closed
+    pub tcp_half_closed_timeout_secs: u64,
     pub udp_idle_timeout_secs: u64,
     pub max_tcp_flows: usize,
     pub max_udp_flows: usize,
+    /// Largest MSS peers' TCP connections may use, or `None` for what the
+    /// tunnel MTU allows; zero leaves the MSS alone
+    pub tcp_mss_clamp: Option<u16>,
 }
 
 impl Default for FlowConfig {
     fn default() -> Self {
         Self {
-            tcp_idle_timeout_secs: 300, // 5 minutes
-            udp_idle_timeout_secs: 60,  // 1 minute
+            tcp_idle_timeout_secs: 300,       // 5 minutes
+            tcp_half_closed_timeout_secs: 60, // 1 minute
+            udp_idle_timeout_secs: 60,        // 1 minute
             max_tcp_flows: 10000,
             max_udp_flows: 10000,
+            tcp_mss_clamp: None,
+        }
+    }
+}
+
+impl FlowConfig {
+    /// How often to look for timed-out flows: every 10 seconds, or twice
+    /// per shortest timeout if that is sooner
+    pub fn reap_interval(&self) -> Duration {
+        let shortest = self
+            .tcp_idle_timeout_secs
+            .min(self.tcp_half_closed_timeout_secs)
+            .min(self.udp_idle_timeout_secs);
+        (Duration::from_secs(shortest) / 2).clamp(Duration::from_secs(1), MAX_REAP_INTERVAL)
+    }
+}
+
+/// Why the reaper closed a flow
+#[derive(Debug, Clone, Copy)]
+pub enum Eviction {
+    TcpIdle,
+    /// A TCP flow one side had closed went quiet
+    TcpHalfClosed,
+    UdpIdle,
+}
+
+impl Eviction {
+    pub const ALL: [Eviction; 3] = [
+        Eviction::TcpIdle,
+        Eviction::TcpHalfClosed,
+        Eviction::UdpIdle,
+    ];
+
+    pub fn protocol(self) -> &'static str {
+        match self {
+            Eviction::TcpIdle | Eviction::TcpHalfClosed => "tcp",
+            Eviction::UdpIdle => "udp",
+        }
+    }
+
+    pub fn reason(self) -> &'static str {
+        match self {
+            Eviction::TcpIdle | Eviction::UdpIdle => "idle",
+            Eviction::TcpHalfClosed => "half_closed",
         }
     }
 }
 
 /// Port forwarding rule for server-side remote listening
-#[derive(Debug, Clone)]
+#[derive(Debug, Clone, PartialEq, Eq)]
 pub struct PortForwardRule {
     pub protocol: Protocol,
     pub public_port: u16,
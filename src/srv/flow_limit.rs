@@ -0,0 +1,191 @@
+//! Per-peer flow limits
+//!
+//! Each peer may hold at most `--peer-max-flows` outbound NAT flows open at
+//! once, and open new ones at `--peer-flow-rate` a second with bursts of
+//! `--peer-flow-burst`, so one peer running a port scanner cannot use up
+//! the server's file descriptors and memory. New flows over either limit
+//! are refused with a TCP reset or ICMP port unreachable, like flows the
+//! firewall rejects, and counted by reason. DNS to the server itself is not
+//! limited. Connections the HTTP and SOCKS5 proxies open for a peer, and
+//! flows it opens to other peers, count as its flows too; proxied
+//! connections are refused over the limits in the proxy's own way.
+
+use std::collections::HashMap;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use parking_lot::Mutex;
+use tracing::debug;
+
+use super::events::encode_key;
+use super::flow::FlowKey;
+use super::metrics::Metrics;
+
+/// How long a peer with no open flows keeps its bucket
+const IDLE_TIMEOUT: Duration = Duration::from_secs(300);
+
+#[derive(Debug, Clone, Copy)]
+pub struct FlowLimits {
+    /// Most flows a peer may have open; zero is no limit
+    pub max_open: usize,
+    /// New flows a second allowed per peer; zero or less is no limit
+    pub rate: f64,
+    pub burst: u32,
+}
+
+/// Why a new flow was refused
+#[derive(Debug, Clone, Copy)]
+pub enum FlowLimitReason {
+    /// The peer already has `--peer-max-flows` flows open
+    OpenFlows,
+    /// The peer is opening flows faster than `--peer-flow-rate`
+    Rate,
+}
+
+impl FlowLimitReason {
+    pub const ALL: [FlowLimitReason; 2] = [FlowLimitReason::OpenFlows, FlowLimitReason::Rate];
+
+    pub fn label(self) -> &'static str {
+        match self {
+            FlowLimitReason::OpenFlows => "open_flows",
+            FlowLimitReason::Rate => "rate",
+        }
+    }
+}
+
+struct PeerFlows {
+    open: usize,
+    tokens: f64,
+    updated: Instant,
+}
+
+/// Tracks each peer's open flows and flow rate; owned by the dataplane
+pub struct FlowLimiter {
+    limits: FlowLimits,
+    peers: HashMap<[u8; 32], PeerFlows>,
+    /// The peer each counted flow belongs to
+    owners: HashMap<FlowKey, [u8; 32]>,
+}
+
+impl FlowLimiter {
+    pub fn new(limits: FlowLimits) -> Self {
+        Self {
+            limits,
+            peers: HashMap::new(),
+            owners: HashMap::new(),
+        }
+    }
+
+    /// Whether the peer may open another flow, taking one from its rate if
+    /// so
+    pub fn admit(&mut self, peer_pubkey: &[u8; 32]) -> Result<(), FlowLimitReason> {
+        let burst = f64::from(self.limits.burst.max(1));
+        let now = Instant::now();
+        let peer = self.peers.entry(*peer_pubkey).or_insert(PeerFlows {
+            open: 0,
+            tokens: burst,
+            updated: now,
+        });
+        if self.limits.max_open > 0 && peer.open >= self.limits.max_open {
+            return Err(FlowLimitReason::OpenFlows);
+        }
+        if self.limits.rate > 0.0 {
+            let elapsed = now.duration_since(peer.updated).as_secs_f64();
+            peer.tokens = (peer.tokens + elapsed * self.limits.rate).min(burst);
+            peer.updated = now;
+            if peer.tokens < 1.0 {
+                return Err(FlowLimitReason::Rate);
+            }
+            peer.tokens -= 1.0;
+        }
+        Ok(())
+    }
+
+    /// Count a flow the peer has opened against its limit
+    pub fn opened(&mut self, peer_pubkey: &[u8; 32], flow_key: FlowKey) {
+        if self.owners.insert(flow_key, *peer_pubkey).is_some() {
+            return;
+        }
+        self.count_open(peer_pubkey);
+    }
+
+    /// Release a flow that has ended, if it was counted
+    pub fn closed(&mut self, flow_key: &FlowKey) {
+        let Some(peer_pubkey) = self.owners.remove(flow_key) else {
+            return;
+        };
+        self.release(&peer_pubkey);
+    }
+
+    fn count_open(&mut self, peer_pubkey: &[u8; 32]) {
+        let burst = f64::from(self.limits.burst.max(1));
+        self.peers
+            .entry(*peer_pubkey)
+            .or_insert(PeerFlows {
+                open: 0,
+                tokens: burst,
+                updated: Instant::now(),
+            })
+            .open += 1;
+    }
+
+    fn release(&mut self, peer_pubkey: &[u8; 32]) {
+        if let Some(peer) = self.peers.get_mut(peer_pubkey) {
+            peer.open = peer.open.saturating_sub(1);
+        }
+    }
+
+    /// Forget peers with no open flows that have been idle long enough for
+    /// their bucket to be full again
+    pub fn forget_idle(&mut self) {
+        self.peers
+            .retain(|_, peer| peer.open > 0 || peer.updated.elapsed() < IDLE_TIMEOUT);
+    }
+}
+
+/// The flow limiter as the proxies and peer-to-peer routing see it, for
+/// flows the NAT doesn't track itself
+#[derive(Clone)]
+pub struct ProxyFlows {
+    limiter: Arc<Mutex<FlowLimiter>>,
+    metrics: Arc<Metrics>,
+}
+
+impl ProxyFlows {
+    pub fn new(limiter: Arc<Mutex<FlowLimiter>>, metrics: Arc<Metrics>) -> Self {
+        Self { limiter, metrics }
+    }
+
+    /// Admit a new flow for the peer and count it as open until the permit
+    /// is dropped; `None` if the peer is over its limits
+    pub fn open(&self, peer_pubkey: &[u8; 32]) -> Option<FlowPermit> {
+        let mut limiter = self.limiter.lock();
+        if let Err(reason) = limiter.admit(peer_pubkey) {
+            debug!(
+                "Peer {} is over its flow limit ({}), refusing a proxied or peer-to-peer flow",
+                encode_key(peer_pubkey),
+                reason.label()
+            );
+            self.metrics.record_flow_limit(reason);
+            return None;
+        }
+        limiter.count_open(peer_pubkey);
+        Some(FlowPermit {
+            limiter: Arc::clone(&self.limiter),
+            peer_pubkey: *peer_pubkey,
+        })
+    }
+}
+
+/// A proxied or peer-to-peer flow, counted against its peer's limit until
+/// dropped
+pub struct FlowPermit {
+    limiter: Arc<Mutex<FlowLimiter>>,
+    peer_pubkey: [u8; 32],
+}
+
+impl Drop for FlowPermit {
+    fn drop(&mut self) {
+        self.limiter.lock().release(&self.peer_pubkey);
+    }
+}
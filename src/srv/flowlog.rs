@@ -0,0 +1,356 @@
+//! Per-flow records of forwarded traffic
+//!
+//! When an outbound NAT flow ends, or a new one is refused, a record of the
+//! peer, 5-tuple, bytes each way, duration and verdict is written as a JSON
+//! line to `--flow-log` and/or exported as IPFIX (RFC 7011) over UDP to
+//! `--ipfix-collector`. Records are handed to a background task so the
+//! dataplane never waits on the disk or the network; if it falls behind,
+//! records are dropped and counted.
+
+use std::io::Write;
+use std::net::{IpAddr, SocketAddr};
+use std::os::unix::fs::OpenOptionsExt;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::{Context, Result};
+use serde::Serialize;
+use tokio::net::UdpSocket;
+use tokio::sync::mpsc;
+use tracing::{error, warn};
+
+use super::events::encode_key;
+use super::flow::Protocol;
+
+/// Records queued before new ones are dropped
+const QUEUE_LEN: usize = 8192;
+
+/// How often buffered records are written out
+const FLUSH_INTERVAL: Duration = Duration::from_secs(1);
+
+/// Data records per IPFIX message, keeping messages under a typical MTU
+/// even when every record has IPv6 addresses
+const IPFIX_RECORDS_PER_MESSAGE: usize = 16;
+
+const IPFIX_VERSION: u16 = 10;
+const IPFIX_TEMPLATE_SET: u16 = 2;
+const IPFIX_TEMPLATE_ID: u16 = 256;
+const IPFIX_TEMPLATE_ID_V6: u16 = 257;
+
+/// Information elements of the data template for IPv4 flows, with their
+/// lengths
+const IPFIX_FIELDS: [(u16, u16); 10] = [
+    (8, 4),   // sourceIPv4Address
+    (7, 2),   // sourceTransportPort
+    (12, 4),  // destinationIPv4Address
+    (11, 2),  // destinationTransportPort
+    (4, 1),   // protocolIdentifier
+    (231, 8), // initiatorOctets
+    (232, 8), // responderOctets
+    (152, 8), // flowStartMilliseconds
+    (153, 8), // flowEndMilliseconds
+    (233, 1), // firewallEvent
+];
+
+/// The same for IPv6 flows
+const IPFIX_FIELDS_V6: [(u16, u16); 10] = [
+    (27, 16), // sourceIPv6Address
+    (7, 2),   // sourceTransportPort
+    (28, 16), // destinationIPv6Address
+    (11, 2),  // destinationTransportPort
+    (4, 1),   // protocolIdentifier
+    (231, 8), // initiatorOctets
+    (232, 8), // responderOctets
+    (152, 8), // flowStartMilliseconds
+    (153, 8), // flowEndMilliseconds
+    (233, 1), // firewallEvent
+];
+
+/// IPFIX firewallEvent values
+const FIREWALL_EVENT_DELETED: u8 = 2;
+const FIREWALL_EVENT_DENIED: u8 = 3;
+
+/// What happened to a flow
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum FlowVerdict {
+    /// Forwarded until it closed or expired
+    Accept,
+    /// Silently dropped by the firewall
+    Drop,
+    /// Refused by the firewall or access schedule
+    Reject,
+    /// Refused by the peer's egress ACL
+    Deny,
+}
+
+/// What a flow has carried since it opened
+#[derive(Debug, Clone, Copy)]
+pub struct FlowTotals {
+    pub opened: SystemTime,
+    pub up_bytes: u64,
+    pub down_bytes: u64,
+}
+
+impl FlowTotals {
+    pub fn new() -> Self {
+        Self {
+            opened: SystemTime::now(),
+            up_bytes: 0,
+            down_bytes: 0,
+        }
+    }
+}
+
+/// One flow, recorded when it ends or is refused
+#[derive(Debug, Clone)]
+pub struct FlowRecord {
+    pub peer: Option<[u8; 32]>,
+    pub protocol: Protocol,
+    pub src: (IpAddr, u16),
+    pub dst: (IpAddr, u16),
+    /// Bytes from the peer to the destination, and back
+    pub up_bytes: u64,
+    pub down_bytes: u64,
+    pub start: SystemTime,
+    pub end: SystemTime,
+    pub verdict: FlowVerdict,
+}
+
+#[derive(Serialize)]
+struct JsonRecord<'a> {
+    /// Unix time in milliseconds the flow started
+    start_ms: u64,
+    duration_ms: u64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    peer: Option<String>,
+    protocol: &'a str,
+    src: SocketAddr,
+    dst: SocketAddr,
+    up_bytes: u64,
+    down_bytes: u64,
+    verdict: FlowVerdict,
+}
+
+pub struct FlowLogSettings {
+    pub path: Option<String>,
+    pub ipfix_collector: Option<String>,
+}
+
+/// Hands flow records to the writer task
+pub struct FlowLog {
+    tx: mpsc::Sender<FlowRecord>,
+    dropped: AtomicU64,
+}
+
+impl FlowLog {
+    /// Open the configured outputs and start writing records to them
+    pub async fn start(settings: FlowLogSettings) -> Result<Self> {
+        let file = settings
+            .path
+            .as_deref()
+            .map(|path| {
+                std::fs::OpenOptions::new()
+                    .append(true)
+                    .create(true)
+                    .mode(0o600)
+                    .open(path)
+                    .with_context(|| format!("failed to open flow log {}", path))
+            })
+            .transpose()?;
+        let ipfix = match &settings.ipfix_collector {
+            Some(collector) => {
+                let socket = UdpSocket::bind("0.0.0.0:0")
+                    .await
+                    .context("failed to bind IPFIX socket")?;
+                socket
+                    .connect(collector)
+                    .await
+                    .with_context(|| format!("failed to resolve IPFIX collector {}", collector))?;
+                Some(IpfixExporter {
+                    socket,
+                    sequence: 0,
+                    domain: std::process::id(),
+                })
+            }
+            None => None,
+        };
+
+        let (tx, rx) = mpsc::channel(QUEUE_LEN);
+        tokio::spawn(write_records(rx, settings.path, file, ipfix));
+        Ok(Self {
+            tx,
+            dropped: AtomicU64::new(0),
+        })
+    }
+
+    pub fn record(&self, record: FlowRecord) {
+        if self.tx.try_send(record).is_err() {
+            // Only every thousandth drop is logged, as drops come in floods
+            if self.dropped.fetch_add(1, Ordering::Relaxed) % 1000 == 0 {
+                warn!("Flow log is falling behind; dropping records");
+            }
+        }
+    }
+}
+
+async fn write_records(
+    mut rx: mpsc::Receiver<FlowRecord>,
+    path: Option<String>,
+    mut file: Option<std::fs::File>,
+    mut ipfix: Option<IpfixExporter>,
+) {
+    let mut batch = Vec::new();
+    let mut flush = tokio::time::interval(FLUSH_INTERVAL);
+    loop {
+        tokio::select! {
+            record = rx.recv() => match record {
+                Some(record) => batch.push(record),
+                None => break,
+            },
+            _ = flush.tick() => {
+                if batch.is_empty() {
+                    continue;
+                }
+                if let Some(file) = &mut file {
+                    if let Err(e) = file.write_all(json_lines(&batch).as_bytes()) {
+                        error!(
+                            "Failed to write flow log {}: {}",
+                            path.as_deref().unwrap_or_default(),
+                            e
+                        );
+                    }
+                }
+                if let Some(ipfix) = &mut ipfix {
+                    ipfix.export(&batch).await;
+                }
+                batch.clear();
+            }
+        }
+    }
+}
+
+fn json_lines(records: &[FlowRecord]) -> String {
+    let mut out = String::new();
+    for record in records {
+        let json = JsonRecord {
+            start_ms: unix_millis(record.start),
+            duration_ms: record
+                .end
+                .duration_since(record.start)
+                .map_or(0, |d| d.as_millis() as u64),
+            peer: record.peer.as_ref().map(encode_key),
+            protocol: match record.protocol {
+                Protocol::Tcp => "tcp",
+                Protocol::Udp => "udp",
+            },
+            src: SocketAddr::from(record.src),
+            dst: SocketAddr::from(record.dst),
+            up_bytes: record.up_bytes,
+            down_bytes: record.down_bytes,
+            verdict: record.verdict,
+        };
+        out.push_str(&serde_json::to_string(&json).expect("flow records serialize"));
+        out.push('\n');
+    }
+    out
+}
+
+/// Sends records to an IPFIX collector, repeating the template in every
+/// message since UDP may lose any one of them
+struct IpfixExporter {
+    socket: UdpSocket,
+    /// Data records sent so far, as the IPFIX sequence number
+    sequence: u32,
+    domain: u32,
+}
+
+impl IpfixExporter {
+    async fn export(&mut self, records: &[FlowRecord]) {
+        for chunk in records.chunks(IPFIX_RECORDS_PER_MESSAGE) {
+            let message = self.message(chunk);
+            if let Err(e) = self.socket.send(&message).await {
+                warn!("Failed to send IPFIX message: {}", e);
+            }
+            self.sequence = self.sequence.wrapping_add(chunk.len() as u32);
+        }
+    }
+
+    fn message(&self, records: &[FlowRecord]) -> Vec<u8> {
+        let mut out = Vec::new();
+        out.extend_from_slice(&IPFIX_VERSION.to_be_bytes());
+        out.extend_from_slice(&[0, 0]); // Length, filled in below
+        let now = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map_or(0, |d| d.as_secs() as u32);
+        out.extend_from_slice(&now.to_be_bytes());
+        out.extend_from_slice(&self.sequence.to_be_bytes());
+        out.extend_from_slice(&self.domain.to_be_bytes());
+
+        // Template set, with both templates
+        let templates = [
+            (IPFIX_TEMPLATE_ID, &IPFIX_FIELDS),
+            (IPFIX_TEMPLATE_ID_V6, &IPFIX_FIELDS_V6),
+        ];
+        let template_len = 4 + 2 * (4 + 4 * IPFIX_FIELDS.len() as u16);
+        out.extend_from_slice(&IPFIX_TEMPLATE_SET.to_be_bytes());
+        out.extend_from_slice(&template_len.to_be_bytes());
+        for (id, fields) in templates {
+            out.extend_from_slice(&id.to_be_bytes());
+            out.extend_from_slice(&(fields.len() as u16).to_be_bytes());
+            for (element, length) in fields {
+                out.extend_from_slice(&element.to_be_bytes());
+                out.extend_from_slice(&length.to_be_bytes());
+            }
+        }
+
+        // A data set for each family with records
+        for (id, fields) in templates {
+            let family: Vec<&FlowRecord> = records
+                .iter()
+                .filter(|record| record.src.0.is_ipv6() == (id == IPFIX_TEMPLATE_ID_V6))
+                .collect();
+            if family.is_empty() {
+                continue;
+            }
+            let record_len: u16 = fields.iter().map(|(_, length)| length).sum();
+            let data_len = 4 + record_len * family.len() as u16;
+            out.extend_from_slice(&id.to_be_bytes());
+            out.extend_from_slice(&data_len.to_be_bytes());
+            for record in family {
+                write_ip(&mut out, record.src.0);
+                out.extend_from_slice(&record.src.1.to_be_bytes());
+                write_ip(&mut out, record.dst.0);
+                out.extend_from_slice(&record.dst.1.to_be_bytes());
+                out.push(match record.protocol {
+                    Protocol::Tcp => 6,
+                    Protocol::Udp => 17,
+                });
+                out.extend_from_slice(&record.up_bytes.to_be_bytes());
+                out.extend_from_slice(&record.down_bytes.to_be_bytes());
+                out.extend_from_slice(&unix_millis(record.start).to_be_bytes());
+                out.extend_from_slice(&unix_millis(record.end).to_be_bytes());
+                out.push(match record.verdict {
+                    FlowVerdict::Accept => FIREWALL_EVENT_DELETED,
+                    _ => FIREWALL_EVENT_DENIED,
+                });
+            }
+        }
+
+        let len = out.len() as u16;
+        out[2..4].copy_from_slice(&len.to_be_bytes());
+        out
+    }
+}
+
+fn write_ip(out: &mut Vec<u8>, ip: IpAddr) {
+    match ip {
+        IpAddr::V4(ip) => out.extend_from_slice(&ip.octets()),
+        IpAddr::V6(ip) => out.extend_from_slice(&ip.octets()),
+    }
+}
+
+fn unix_millis(time: SystemTime) -> u64 {
+    time.duration_since(UNIX_EPOCH)
+        .map_or(0, |d| d.as_millis() as u64)
+}
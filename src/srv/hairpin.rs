@@ -0,0 +1,343 @@
+//! Policy for traffic routed between peers
+//!
+//! With `--client-isolation=false`, packets a peer addresses to another
+//! peer are routed back out through the tunnel rather than the NAT. They
+//! are held to the same policy as flows leaving through the NAT: the first
+//! packet of a flow is checked against the sender's access schedule, the
+//! firewall, egress ACLs and the sender's flow limits, after which packets
+//! either way on the flow pass until it has been idle past the flow
+//! timeouts. TCP and UDP flows are told apart by their ports and pings by
+//! their identifier; other packets, such as ICMP errors, make one flow per
+//! protocol between two addresses, matched by the rules pings are.
+
+use std::collections::HashMap;
+use std::net::IpAddr;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use smoltcp::wire::IpProtocol;
+use tracing::debug;
+
+use super::acl::{Decision, EgressAcls};
+use super::firewall::{Firewall, Verdict};
+use super::flow::{FlowKey, Protocol};
+use super::flow_limit::{FlowPermit, ProxyFlows};
+use super::icmp;
+use super::schedule::AccessSchedules;
+
+/// A flow between two peers, as seen from the peer sending a packet on it
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub struct HairpinKey {
+    protocol: IpProtocol,
+    src_ip: IpAddr,
+    src_port: u16,
+    dst_ip: IpAddr,
+    dst_port: u16,
+}
+
+impl HairpinKey {
+    /// The flow of a packet with the given transport `payload`, or `None`
+    /// if it is too short to have its ports
+    pub fn of(
+        protocol: IpProtocol,
+        src_ip: IpAddr,
+        dst_ip: IpAddr,
+        payload: &[u8],
+    ) -> Option<Self> {
+        let (src_port, dst_port) = match protocol {
+            IpProtocol::Tcp | IpProtocol::Udp => {
+                let ports = payload.get(..4)?;
+                (
+                    u16::from_be_bytes([ports[0], ports[1]]),
+                    u16::from_be_bytes([ports[2], ports[3]]),
+                )
+            }
+            // Requests and replies carry the same identifier
+            IpProtocol::Icmp | IpProtocol::Icmpv6 if is_echo(payload) => {
+                let id = payload.get(4..6)?;
+                let id = u16::from_be_bytes([id[0], id[1]]);
+                (id, id)
+            }
+            _ => (0, 0),
+        };
+        Some(Self {
+            protocol,
+            src_ip,
+            src_port,
+            dst_ip,
+            dst_port,
+        })
+    }
+
+    /// The same flow seen from the other peer
+    pub fn reversed(&self) -> Self {
+        Self {
+            protocol: self.protocol,
+            src_ip: self.dst_ip,
+            src_port: self.dst_port,
+            dst_ip: self.src_ip,
+            dst_port: self.src_port,
+        }
+    }
+
+    /// The flow as the firewall and flow log see TCP and UDP flows
+    pub fn flow_key(&self) -> Option<FlowKey> {
+        let protocol = match self.protocol {
+            IpProtocol::Tcp => Protocol::Tcp,
+            IpProtocol::Udp => Protocol::Udp,
+            _ => return None,
+        };
+        Some(FlowKey {
+            protocol,
+            client_ip: self.src_ip,
+            client_port: self.src_port,
+            remote_ip: self.dst_ip,
+            remote_port: self.dst_port,
+        })
+    }
+}
+
+fn is_echo(payload: &[u8]) -> bool {
+    matches!(
+        payload.first(),
+        Some(
+            &(icmp::ECHO_REQUEST | icmp::ECHO_REPLY | icmp::ECHO_REQUEST_V6 | icmp::ECHO_REPLY_V6)
+        )
+    )
+}
+
+struct HairpinFlow {
+    /// The peer that opened the flow
+    peer: [u8; 32],
+    last_activity: Instant,
+    /// Counts the flow against its peer's limits until it ends
+    _permit: FlowPermit,
+}
+
+/// Peer-to-peer flows let through, and the policy new ones are checked
+/// against; owned by the dataplane
+pub struct HairpinFlows {
+    firewall: Arc<Firewall>,
+    acls: Arc<EgressAcls>,
+    schedules: Arc<AccessSchedules>,
+    limits: ProxyFlows,
+    flows: HashMap<HairpinKey, HairpinFlow>,
+}
+
+impl HairpinFlows {
+    pub fn new(
+        firewall: Arc<Firewall>,
+        acls: Arc<EgressAcls>,
+        schedules: Arc<AccessSchedules>,
+        limits: ProxyFlows,
+    ) -> Self {
+        Self {
+            firewall,
+            acls,
+            schedules,
+            limits,
+            flows: HashMap::new(),
+        }
+    }
+
+    /// Decide a packet `peer` sends another peer. Packets on a flow let
+    /// through before pass; the first of a new flow is checked as one
+    /// leaving through the NAT would be, and refused over the peer's flow
+    /// limits.
+    pub fn admit(&mut self, peer: &[u8; 32], key: HairpinKey) -> Verdict {
+        let now = Instant::now();
+        for known in [key, key.reversed()] {
+            if let Some(flow) = self.flows.get_mut(&known) {
+                flow.last_activity = now;
+                return Verdict::Accept;
+            }
+        }
+        let verdict = self.check(peer, &key);
+        if verdict != Verdict::Accept {
+            return verdict;
+        }
+        let Some(permit) = self.limits.open(peer) else {
+            return Verdict::Reject;
+        };
+        self.flows.insert(
+            key,
+            HairpinFlow {
+                peer: *peer,
+                last_activity: now,
+                _permit: permit,
+            },
+        );
+        Verdict::Accept
+    }
+
+    fn check(&self, peer: &[u8; 32], key: &HairpinKey) -> Verdict {
+        if !self.schedules.allows(peer) {
+            debug!(
+                "Access schedule refuses peer-to-peer {:?} flow {} -> {}",
+                key.protocol, key.src_ip, key.dst_ip
+            );
+            return Verdict::Reject;
+        }
+        let transport = key
+            .flow_key()
+            .map(|flow_key| (flow_key.protocol, key.dst_port));
+        let verdict = match transport {
+            Some((protocol, port)) => self.firewall.check(peer, protocol, key.dst_ip, port),
+            None => self.firewall.check_echo(peer, key.dst_ip),
+        };
+        if verdict != Verdict::Accept {
+            return verdict;
+        }
+        let allowed = match transport {
+            Some((protocol, port)) => match self.acls.check(peer, protocol, key.dst_ip, port) {
+                Decision::Allow => true,
+                Decision::Deny => false,
+                // Server names aren't read from traffic between peers
+                Decision::NeedsSni => self.acls.check_sni(peer, key.dst_ip, port, None),
+            },
+            None => self.acls.check_echo(peer, key.dst_ip),
+        };
+        if !allowed {
+            debug!(
+                "Egress ACL denies peer-to-peer {:?} flow {} -> {}",
+                key.protocol, key.src_ip, key.dst_ip
+            );
+            return Verdict::Drop;
+        }
+        Verdict::Accept
+    }
+
+    /// End flows idle past their timeout, and those of peers whose access
+    /// schedule closes their flows
+    pub fn expire(&mut self, tcp_timeout: Duration, udp_timeout: Duration) {
+        let now = Instant::now();
+        let schedules = &self.schedules;
+        self.flows.retain(|key, flow| {
+            let timeout = match key.protocol {
+                IpProtocol::Tcp => tcp_timeout,
+                _ => udp_timeout,
+            };
+            now.duration_since(flow.last_activity) < timeout && !schedules.terminates(&flow.peer)
+        });
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::Write;
+    use std::net::Ipv4Addr;
+    use std::time::{SystemTime, UNIX_EPOCH};
+
+    use base64::Engine;
+    use parking_lot::Mutex;
+
+    use crate::audit::AuditLog;
+    use crate::flow_limit::{FlowLimiter, FlowLimits};
+    use crate::metrics::Metrics;
+    use crate::network::{Network, Networks};
+    use crate::sessions::SessionHistory;
+    use crate::state::{ServerConfig, SharedState};
+
+    const PEER_A: [u8; 32] = [1; 32];
+    const PEER_B: [u8; 32] = [2; 32];
+    const IP_A: IpAddr = IpAddr::V4(Ipv4Addr::new(10, 200, 100, 2));
+    const IP_B: IpAddr = IpAddr::V4(Ipv4Addr::new(10, 200, 100, 3));
+
+    fn shared() -> Arc<SharedState> {
+        let server_ip = Ipv4Addr::new(10, 200, 100, 1);
+        let networks = Networks::new(vec![Network::new(server_ip, 24, None).unwrap()]).unwrap();
+        let config = ServerConfig {
+            subnet: server_ip,
+            subnet_mask: 24,
+            networks,
+            auth_token: String::new(),
+            ipv6_prefix: None,
+            ipv6_only: false,
+        };
+        SharedState::new(
+            config,
+            [0; 32],
+            None,
+            AuditLog::in_memory(),
+            SessionHistory::in_memory(Duration::from_secs(60)),
+            None,
+        )
+    }
+
+    fn flows(firewall: Firewall, schedules: AccessSchedules, max_open: usize) -> HairpinFlows {
+        let limits = FlowLimits {
+            max_open,
+            rate: 0.0,
+            burst: 0,
+        };
+        HairpinFlows::new(
+            Arc::new(firewall),
+            Arc::default(),
+            Arc::new(schedules),
+            ProxyFlows::new(
+                Arc::new(Mutex::new(FlowLimiter::new(limits))),
+                Arc::new(Metrics::default()),
+            ),
+        )
+    }
+
+    fn tcp(src_port: u16, dst_port: u16) -> HairpinKey {
+        let mut header = [0u8; 20];
+        header[..2].copy_from_slice(&src_port.to_be_bytes());
+        header[2..4].copy_from_slice(&dst_port.to_be_bytes());
+        HairpinKey::of(IpProtocol::Tcp, IP_A, IP_B, &header).unwrap()
+    }
+
+    #[tokio::test]
+    async fn firewall_rules_and_flow_limits_apply_between_peers() {
+        let mut rules = tempfile::NamedTempFile::new().unwrap();
+        writeln!(rules, "drop tcp to {} port 22", IP_B).unwrap();
+        let firewall = Firewall::load(Some(rules.path().to_path_buf()), false, shared())
+            .await
+            .unwrap();
+        let mut flows = flows(firewall, AccessSchedules::default(), 1);
+
+        assert_eq!(flows.admit(&PEER_A, tcp(40000, 22)), Verdict::Drop);
+        let web = tcp(40001, 80);
+        assert_eq!(flows.admit(&PEER_A, web), Verdict::Accept);
+        assert_eq!(flows.admit(&PEER_A, web), Verdict::Accept);
+        assert_eq!(flows.admit(&PEER_B, web.reversed()), Verdict::Accept);
+
+        // The peer's one flow is open
+        assert_eq!(flows.admit(&PEER_A, tcp(40002, 80)), Verdict::Reject);
+        flows.expire(Duration::ZERO, Duration::ZERO);
+        assert_eq!(flows.admit(&PEER_A, tcp(40002, 80)), Verdict::Accept);
+    }
+
+    #[tokio::test]
+    async fn closed_schedule_refuses_flows_between_peers() {
+        // A window a few minutes from now, in UTC
+        let now = SystemTime::now().duration_since(UNIX_EPOCH).unwrap();
+        let minute = (now.as_secs() / 60 % (24 * 60)) as u32;
+        let (start, end) = ((minute + 5) % (24 * 60), (minute + 6) % (24 * 60));
+        let mut file = tempfile::NamedTempFile::new().unwrap();
+        write!(
+            file,
+            "[[schedule]]\nname = \"later\"\npeers = [\"{}\"]\nhours = [\"{:02}:{:02}-{:02}:{:02}\"]\nutc_offset = \"+00:00\"\n",
+            base64::engine::general_purpose::STANDARD.encode(PEER_A),
+            start / 60,
+            start % 60,
+            end / 60,
+            end % 60,
+        )
+        .unwrap();
+        let shared = shared();
+        let schedules =
+            AccessSchedules::load(file.path().to_str().unwrap(), Arc::clone(&shared)).unwrap();
+        let firewall = Firewall::load(None, false, shared).await.unwrap();
+        let mut flows = flows(firewall, schedules, 0);
+
+        assert_eq!(flows.admit(&PEER_A, tcp(40000, 80)), Verdict::Reject);
+        // The other peer has no schedule
+        assert_eq!(
+            flows.admit(&PEER_B, tcp(40000, 80).reversed()),
+            Verdict::Accept
+        );
+    }
+}
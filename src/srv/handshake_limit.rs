@@ -0,0 +1,217 @@
+//! Handshake flood protection
+//!
+//! A handshake initiation is the one message anyone can make the server do
+//! real work for, so before one reaches the tunnels it has to:
+//! - carry a mac1 made for one of the server's public keys, so random
+//!   packets are dropped without any Curve25519 work
+//! - while the server is under load, that is receiving more than
+//!   `--handshake-load-threshold` initiations a second in total, carry a
+//!   mac2 from a cookie handed to its source address. Sources without one
+//!   get a cookie reply instead of a handshake response, which clients
+//!   answer by retrying; spoofed sources never see the cookie. With
+//!   `--handshake-under-load drop`, initiations are dropped outright while
+//!   under load instead.
+//! - fit within its source IP's rate, `--handshake-rate` a second with
+//!   bursts of `--handshake-burst`
+//!
+//! Dropped initiations are counted by reason in the metrics.
+
+use std::collections::HashMap;
+use std::net::{IpAddr, SocketAddr};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use parking_lot::Mutex;
+use tracing::{info, warn};
+
+use super::cookie::{self, CookieJar};
+use super::metrics::Metrics;
+
+/// Sources idle this long are forgotten; their bucket would be full again
+const SOURCE_IDLE: Duration = Duration::from_secs(60);
+
+/// What to do with initiations while the server is under load
+#[derive(Debug, Clone, Copy, PartialEq, Eq, clap::ValueEnum)]
+pub enum UnderLoad {
+    /// Answer initiations without a valid mac2 with a cookie reply
+    Cookie,
+    /// Drop every initiation until the load passes
+    Drop,
+}
+
+#[derive(Debug, Clone, Copy)]
+pub struct HandshakeSettings {
+    /// Initiations a second allowed per source IP; zero or less is no limit
+    pub rate: f64,
+    pub burst: u32,
+    /// Initiations a second server-wide above which the server is under
+    /// load; zero means never
+    pub load_threshold: u32,
+    pub under_load: UnderLoad,
+}
+
+/// Why an initiation was dropped
+#[derive(Debug, Clone, Copy)]
+pub enum HandshakeDrop {
+    /// Not made for any of the server's keys, or not an initiation at all
+    BadMac1,
+    /// Dropped while under load with `--handshake-under-load drop`
+    UnderLoad,
+    /// Over its source IP's rate
+    SourceRate,
+}
+
+impl HandshakeDrop {
+    pub const ALL: [HandshakeDrop; 3] = [
+        HandshakeDrop::BadMac1,
+        HandshakeDrop::UnderLoad,
+        HandshakeDrop::SourceRate,
+    ];
+
+    pub fn label(self) -> &'static str {
+        match self {
+            HandshakeDrop::BadMac1 => "bad_mac1",
+            HandshakeDrop::UnderLoad => "under_load",
+            HandshakeDrop::SourceRate => "source_rate",
+        }
+    }
+}
+
+/// What to do with an initiation
+pub enum Admission {
+    Accept,
+    Drop(HandshakeDrop),
+    /// Send this cookie reply to the source instead of answering
+    Cookie(Vec<u8>),
+}
+
+struct Bucket {
+    tokens: f64,
+    updated: Instant,
+}
+
+/// Initiations counted in the current and previous second
+struct LoadWindow {
+    started: Instant,
+    count: u32,
+    previous: u32,
+}
+
+pub struct HandshakeLimiter {
+    settings: HandshakeSettings,
+    cookies: CookieJar,
+    sources: Mutex<HashMap<IpAddr, Bucket>>,
+    load: Mutex<LoadWindow>,
+    metrics: Arc<Metrics>,
+}
+
+impl HandshakeLimiter {
+    pub fn new(settings: HandshakeSettings, metrics: Arc<Metrics>) -> Self {
+        Self {
+            settings,
+            cookies: CookieJar::default(),
+            sources: Mutex::new(HashMap::new()),
+            load: Mutex::new(LoadWindow {
+                started: Instant::now(),
+                count: 0,
+                previous: 0,
+            }),
+            metrics,
+        }
+    }
+
+    /// Decide what to do with an initiation from `src`, given the public
+    /// keys the server answers to
+    pub fn check(&self, msg: &[u8], src: SocketAddr, server_keys: &[[u8; 32]]) -> Admission {
+        let Some(server_key) = server_keys.iter().find(|key| cookie::mac1_valid(msg, key)) else {
+            return self.reject(HandshakeDrop::BadMac1);
+        };
+        if self.count_initiation() {
+            match self.settings.under_load {
+                UnderLoad::Drop => return self.reject(HandshakeDrop::UnderLoad),
+                UnderLoad::Cookie if !self.cookies.mac2_valid(msg, src) => {
+                    self.metrics.record_handshake_cookie();
+                    return Admission::Cookie(self.cookies.reply(msg, src, server_key));
+                }
+                UnderLoad::Cookie => {}
+            }
+        }
+        if !self.take_token(src.ip()) {
+            return self.reject(HandshakeDrop::SourceRate);
+        }
+        Admission::Accept
+    }
+
+    /// Whether initiations are arriving faster than the load threshold
+    pub fn is_under_load(&self) -> bool {
+        let threshold = self.settings.load_threshold;
+        let load = self.load.lock();
+        let recent = if load.started.elapsed() < Duration::from_secs(1) {
+            load.count.max(load.previous)
+        } else {
+            0
+        };
+        threshold > 0 && recent > threshold
+    }
+
+    fn reject(&self, reason: HandshakeDrop) -> Admission {
+        self.metrics.record_handshake_drop(reason);
+        Admission::Drop(reason)
+    }
+
+    /// Count one initiation towards the load, returning whether the server
+    /// is under load
+    fn count_initiation(&self) -> bool {
+        let threshold = self.settings.load_threshold;
+        let mut load = self.load.lock();
+        let elapsed = load.started.elapsed();
+        if elapsed >= Duration::from_secs(1) {
+            let was_under_load = threshold > 0 && load.count.max(load.previous) > threshold;
+            load.previous = if elapsed < Duration::from_secs(2) {
+                load.count
+            } else {
+                0
+            };
+            load.count = 0;
+            load.started = Instant::now();
+            let under_load = threshold > 0 && load.previous > threshold;
+            if under_load && !was_under_load {
+                warn!(
+                    "Under handshake load ({} initiations in the last second)",
+                    load.previous
+                );
+            } else if was_under_load && !under_load {
+                info!("Handshake load has passed");
+            }
+            self.sources
+                .lock()
+                .retain(|_, bucket| bucket.updated.elapsed() < SOURCE_IDLE);
+        }
+        load.count = load.count.saturating_add(1);
+        threshold > 0 && load.count.max(load.previous) > threshold
+    }
+
+    /// Take a token from the source's bucket, returning false if it is over
+    /// its rate
+    fn take_token(&self, ip: IpAddr) -> bool {
+        let rate = self.settings.rate;
+        if rate <= 0.0 {
+            return true;
+        }
+        let burst = f64::from(self.settings.burst.max(1));
+        let now = Instant::now();
+        let mut sources = self.sources.lock();
+        let bucket = sources.entry(ip).or_insert(Bucket {
+            tokens: burst,
+            updated: now,
+        });
+        let elapsed = now.duration_since(bucket.updated).as_secs_f64();
+        bucket.tokens = (bucket.tokens + elapsed * rate).min(burst);
+        bucket.updated = now;
+        if bucket.tokens < 1.0 {
+            return false;
+        }
+        bucket.tokens -= 1.0;
+        true
+    }
+}
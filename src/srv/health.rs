@@ -0,0 +1,203 @@
+//! Health endpoints for load balancers and orchestrators
+//!
+//! Served without authentication on the API listener and, when set, the
+//! metrics listener:
+//! - `GET /healthz` fails only when the server needs restarting: the
+//!   WireGuard receive loop or the dataplane has stopped, or the dataplane
+//!   has not run its housekeeping for a while
+//! - `GET /readyz` additionally fails while the WireGuard socket is not
+//!   bound, no DNS upstream is answering or the server is draining for
+//!   shutdown, so traffic can be steered away
+//!
+//! Both return 200 or 503 with a JSON body listing each check. DNS
+//! upstreams are probed in the background, so checks never wait on the
+//! network.
+
+use std::sync::atomic::Ordering;
+use std::sync::Arc;
+use std::time::Duration;
+
+use axum::extract::State;
+use axum::http::StatusCode;
+use axum::response::IntoResponse;
+use axum::routing::get;
+use axum::{Json, Router};
+use serde_json::{json, Map, Value};
+use tokio::task::JoinHandle;
+
+use super::dns::DnsService;
+use super::metrics::Metrics;
+use super::usage::unix_now;
+use super::wg::WgIo;
+
+/// How often DNS upstreams are probed
+const DNS_PROBE_INTERVAL: Duration = Duration::from_secs(15);
+
+/// How long the dataplane may go without housekeeping before it is
+/// considered stuck; it normally runs every 10 seconds
+const DATAPLANE_STALL_SECS: u64 = 60;
+
+/// What the health checks look at
+pub struct HealthChecks {
+    wg_io: Arc<WgIo>,
+    dns: Arc<DnsService>,
+    metrics: Arc<Metrics>,
+    wg_receive: JoinHandle<()>,
+    dataplane: JoinHandle<()>,
+}
+
+struct Check {
+    ok: bool,
+    detail: String,
+}
+
+impl HealthChecks {
+    /// Watch the given tasks and start probing DNS upstreams
+    pub fn spawn(
+        wg_io: Arc<WgIo>,
+        dns: Arc<DnsService>,
+        metrics: Arc<Metrics>,
+        wg_receive: JoinHandle<()>,
+        dataplane: JoinHandle<()>,
+    ) -> Arc<Self> {
+        let prober = Arc::clone(&dns);
+        tokio::spawn(async move {
+            let mut interval = tokio::time::interval(DNS_PROBE_INTERVAL);
+            loop {
+                interval.tick().await;
+                prober.upstreams().probe().await;
+            }
+        });
+        Arc::new(Self {
+            wg_io,
+            dns,
+            metrics,
+            wg_receive,
+            dataplane,
+        })
+    }
+
+    /// Whether every liveness check passes
+    pub fn is_live(&self) -> bool {
+        self.liveness().iter().all(|(_, check)| check.ok)
+    }
+
+    fn liveness(&self) -> Vec<(&'static str, Check)> {
+        let heartbeat = self.metrics.dataplane_heartbeat.load(Ordering::Relaxed);
+        let idle_secs = unix_now().saturating_sub(heartbeat);
+        let nat = if self.dataplane.is_finished() {
+            Check {
+                ok: false,
+                detail: "dataplane has stopped".to_string(),
+            }
+        } else if heartbeat > 0 && idle_secs > DATAPLANE_STALL_SECS {
+            Check {
+                ok: false,
+                detail: format!("dataplane has not run housekeeping for {}s", idle_secs),
+            }
+        } else {
+            Check {
+                ok: true,
+                detail: "running".to_string(),
+            }
+        };
+        let wireguard = Check {
+            ok: !self.wg_receive.is_finished(),
+            detail: if self.wg_receive.is_finished() {
+                "receive loop has stopped".to_string()
+            } else {
+                "receiving".to_string()
+            },
+        };
+        vec![("wireguard", wireguard), ("nat", nat)]
+    }
+
+    fn readiness(&self) -> Vec<(&'static str, Check)> {
+        let mut checks = self.liveness();
+        checks.push((
+            "wireguard_socket",
+            match self.wg_io.local_addrs().as_slice() {
+                [] => Check {
+                    ok: false,
+                    detail: "not bound".to_string(),
+                },
+                addrs => Check {
+                    ok: true,
+                    detail: format!(
+                        "bound to {}",
+                        addrs
+                            .iter()
+                            .map(|addr| addr.to_string())
+                            .collect::<Vec<_>>()
+                            .join(", ")
+                    ),
+                },
+            },
+        ));
+        let draining = self.wg_io.is_draining();
+        checks.push((
+            "draining",
+            Check {
+                ok: !draining,
+                detail: if draining {
+                    "shutting down".to_string()
+                } else {
+                    "accepting new flows".to_string()
+                },
+            },
+        ));
+        let upstreams = self.dns.upstreams().status();
+        let up = upstreams.iter().filter(|(_, up)| *up).count();
+        checks.push((
+            "dns_upstreams",
+            Check {
+                ok: up > 0,
+                detail: format!("{} of {} answering", up, upstreams.len()),
+            },
+        ));
+        checks
+    }
+}
+
+/// Create the router serving `/healthz` and `/readyz`
+pub fn create_router(checks: Arc<HealthChecks>) -> Router {
+    Router::new()
+        .route("/healthz", get(healthz_handler))
+        .route("/readyz", get(readyz_handler))
+        .with_state(checks)
+}
+
+/// Handler for GET /healthz
+async fn healthz_handler(State(checks): State<Arc<HealthChecks>>) -> impl IntoResponse {
+    report(checks.liveness())
+}
+
+/// Handler for GET /readyz
+async fn readyz_handler(State(checks): State<Arc<HealthChecks>>) -> impl IntoResponse {
+    report(checks.readiness())
+}
+
+fn report(checks: Vec<(&'static str, Check)>) -> (StatusCode, Json<Value>) {
+    let ok = checks.iter().all(|(_, check)| check.ok);
+    let checks: Map<String, Value> = checks
+        .into_iter()
+        .map(|(name, check)| {
+            (
+                name.to_string(),
+                json!({ "ok": check.ok, "detail": check.detail }),
+            )
+        })
+        .collect();
+    let status = if ok {
+        StatusCode::OK
+    } else {
+        StatusCode::SERVICE_UNAVAILABLE
+    };
+    (
+        status,
+        Json(json!({
+            "status": if ok { "ok" } else { "unavailable" },
+            "checks": checks,
+        })),
+    )
+}
@@ -0,0 +1,1045 @@
+//! Explicit HTTP proxy for peers
+//!
+//! With `--http-proxy-port`, the server IP inside the tunnel also answers as
+//! an HTTP proxy, for browsers and tools set up with one rather than relying
+//! on transparent NAT. `CONNECT host:port` opens a tunnel to the
+//! destination, and requests with an absolute `http://` URI are forwarded to
+//! the origin. Request heads are read until complete however the client's
+//! bytes are split, and are parsed with `httparse` rather than by hand.
+//!
+//! Forwarded requests keep both connections open where HTTP/1.1 allows:
+//! a client may send request after request on one connection, and a
+//! connection to an origin is kept after its response, for up to
+//! `--http-proxy-idle-connections` per peer and origin and
+//! `--http-proxy-idle-timeout-secs`, so the peer's next request to it
+//! skips the TCP handshake. Bodies are relayed by their `Content-Length` or
+//! chunked encoding; a response that ends only when the origin closes
+//! closes the client's connection too.
+//!
+//! Host names are resolved through the server's DNS service under the
+//! peer's DNS policy and blocklists, and each destination must pass the
+//! peer's access schedule, the firewall, the egress ACLs, the domain filter
+//! and the egress routes, as a NATed flow would. A request's host name
+//! stands in for the server name those match on. Each connection opened to
+//! a destination counts against the peer's flow limits, and a peer over
+//! them gets `429 Too Many Requests`.
+//!
+//! `--http-proxy-user` and `--http-proxy-token` make the proxy require a
+//! `Proxy-Authorization` header with Basic credentials or a Bearer token;
+//! with neither, any peer may use it. `--http-proxy-access-log` records
+//! every request (see `access_log`).
+
+use std::collections::HashMap;
+use std::fmt;
+use std::io;
+use std::net::{IpAddr, Ipv4Addr, SocketAddrV4};
+use std::pin::Pin;
+use std::sync::Arc;
+use std::task::{Context as TaskContext, Poll};
+use std::time::{Duration, Instant, SystemTime};
+
+use anyhow::{Context, Result};
+use base64::Engine;
+use futures::FutureExt;
+use parking_lot::Mutex;
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt, ReadBuf};
+use tracing::debug;
+
+use super::access_log::{AccessLog, AccessRecord};
+use super::acl::Decision;
+use super::api::constant_time_eq;
+use super::dataplane::FlowPolicy;
+use super::dns::{DnsService, Transport, DNS_PORT};
+use super::dns_wire;
+use super::egress::Connection;
+use super::firewall::Verdict;
+use super::flow::Protocol;
+use super::flow_limit::{FlowPermit, ProxyFlows};
+
+/// Longest request head accepted
+const MAX_HEAD: usize = 16 * 1024;
+const MAX_HEADERS: usize = 64;
+/// How long a client has to send its request head
+const HEAD_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// Headers that apply to one hop and are not passed on to the origin or
+/// the client
+const HOP_BY_HOP: &[&str] = &[
+    "connection",
+    "keep-alive",
+    "proxy-authorization",
+    "proxy-connection",
+    "te",
+    "trailer",
+];
+
+/// How many connections to each origin are kept open between a peer's
+/// requests, and for how long
+#[derive(Debug, Clone, Copy)]
+pub struct KeepAlive {
+    pub connections: usize,
+    pub timeout: Duration,
+}
+
+/// A connection to an origin, counted against its peer's flow limits
+type Origin = (Box<dyn Connection>, FlowPermit);
+
+/// Open connections to origins, by peer and origin, newest last
+type IdleOrigins = HashMap<([u8; 32], SocketAddrV4), Vec<(Origin, Instant)>>;
+
+/// The proxy's port and the credentials it accepts
+pub struct HttpProxy {
+    port: u16,
+    /// `user:password` pairs accepted as Basic credentials
+    users: Vec<String>,
+    tokens: Vec<String>,
+    access_log: Option<AccessLog>,
+    keep_alive: KeepAlive,
+    idle: Mutex<IdleOrigins>,
+}
+
+impl HttpProxy {
+    pub fn new(
+        port: u16,
+        users: Vec<String>,
+        tokens: Vec<String>,
+        access_log: Option<AccessLog>,
+        keep_alive: KeepAlive,
+    ) -> Result<Self> {
+        if port == DNS_PORT {
+            anyhow::bail!("port {} is the DNS service's", port);
+        }
+        if let Some(user) = users.iter().find(|user| !user.contains(':')) {
+            anyhow::bail!("proxy user {} is not user:password", user);
+        }
+        Ok(Self {
+            port,
+            users,
+            tokens: tokens.into_iter().filter(|t| !t.is_empty()).collect(),
+            access_log,
+            keep_alive,
+            idle: Mutex::new(HashMap::new()),
+        })
+    }
+
+    pub fn port(&self) -> u16 {
+        self.port
+    }
+
+    /// Serve one client connection from a peer, for as many requests as
+    /// the client sends on it
+    pub async fn serve<S: AsyncRead + AsyncWrite + Unpin>(&self, mut client: S, peer: Peer) {
+        let mut buf = Vec::new();
+        let mut served = false;
+        loop {
+            let start = SystemTime::now();
+            let head =
+                match tokio::time::timeout(HEAD_TIMEOUT, read_head(&mut client, &mut buf)).await {
+                    Ok(Ok(Some(head))) => head,
+                    Ok(Ok(None)) => return,
+                    Ok(Err(e)) => {
+                        debug!("Bad HTTP proxy request: {:#}", e);
+                        self.refuse(&mut client, &peer, None, Status::BadRequest, start)
+                            .await;
+                        return;
+                    }
+                    // A client done with a kept connection just leaves it
+                    Err(_) if served && buf.is_empty() => return,
+                    Err(_) => {
+                        self.refuse(&mut client, &peer, None, Status::RequestTimeout, start)
+                            .await;
+                        return;
+                    }
+                };
+            served = true;
+            if !self.authorized(&head) {
+                self.refuse(
+                    &mut client,
+                    &peer,
+                    Some(&head),
+                    Status::ProxyAuthRequired,
+                    start,
+                )
+                .await;
+                return;
+            }
+
+            buf.drain(..head.len);
+            let result = if head.method == "CONNECT" {
+                tunnel(&mut client, &head, &buf, &peer)
+                    .await
+                    .map(|relayed| (relayed, false))
+            } else {
+                self.forward(&mut client, &head, &mut buf, &peer).await
+            };
+            match result {
+                Ok((relayed, keep_open)) => {
+                    self.log(&peer, Some(&head), relayed, start);
+                    if !keep_open {
+                        return;
+                    }
+                }
+                Err(status) => {
+                    debug!("HTTP proxy {} {}: {}", head.method, head.target, status);
+                    self.refuse(&mut client, &peer, Some(&head), status, start)
+                        .await;
+                    return;
+                }
+            }
+        }
+    }
+
+    /// Answer a request the proxy will not carry out
+    async fn refuse<S: AsyncWrite + Unpin>(
+        &self,
+        client: &mut S,
+        peer: &Peer,
+        head: Option<&Head>,
+        status: Status,
+        start: SystemTime,
+    ) {
+        let _ = respond(client, status).await;
+        let relayed = Relayed {
+            status: Some(status.code()),
+            ..Relayed::default()
+        };
+        self.log(peer, head, relayed, start);
+    }
+
+    fn log(&self, peer: &Peer, head: Option<&Head>, relayed: Relayed, start: SystemTime) {
+        let Some(access_log) = &self.access_log else {
+            return;
+        };
+        access_log.record(AccessRecord {
+            peer: peer.pubkey,
+            client: peer.client,
+            method: head.map(|head| head.method.clone()),
+            host: head.and_then(Head::host).map(str::to_string),
+            status: relayed.status,
+            up_bytes: relayed.up_bytes,
+            down_bytes: relayed.down_bytes,
+            start,
+            end: SystemTime::now(),
+        });
+    }
+
+    /// Forward a plain HTTP request to its origin and relay the response,
+    /// on a connection kept from the peer's last request there if there is
+    /// one. Returns whether the client's connection can take another
+    /// request.
+    async fn forward<S: AsyncRead + AsyncWrite + Unpin>(
+        &self,
+        client: &mut S,
+        head: &Head,
+        buf: &mut Vec<u8>,
+        peer: &Peer,
+    ) -> Result<(Relayed, bool), Status> {
+        let (authority, path) = split_absolute_uri(&head.target).ok_or(Status::BadRequest)?;
+        let (host, port) = split_authority(authority, Some(80)).ok_or(Status::BadRequest)?;
+        let body = head.body().ok_or(Status::BadRequest)?;
+        let target = peer.resolve(&host).await.ok_or(Status::BadGateway)?;
+        let target = SocketAddrV4::new(target, port);
+        let server_name = host.parse::<Ipv4Addr>().is_err().then_some(host.as_str());
+        if !peer.allows(Protocol::Tcp, target, server_name) {
+            return Err(Status::Forbidden);
+        }
+        let request = origin_request(head, authority, &path);
+        if body != Body::Length(0) && head.has_token("expect", "100-continue") {
+            // Answered here, so the body isn't held up waiting on the origin
+            client
+                .write_all(b"HTTP/1.1 100 Continue\r\n\r\n")
+                .await
+                .map_err(|_| Status::BadGateway)?;
+        }
+
+        let mut kept = self.take_idle(&peer.pubkey, target);
+        let (mut origin, permit, (mut response, mut origin_buf, up_bytes)) = loop {
+            // The origin may have closed a kept connection just now; a
+            // request that can safely be sent twice goes again on a new one
+            let retry = kept.is_some() && body == Body::Length(0) && head.is_idempotent();
+            let (mut origin, permit) = match kept.take() {
+                Some(origin) => origin,
+                None => {
+                    let permit = peer.open_flow().ok_or(Status::TooManyRequests)?;
+                    let origin = peer
+                        .policy
+                        .egress
+                        .connect_tcp(target)
+                        .await
+                        .map_err(|_| Status::BadGateway)?;
+                    (origin, permit)
+                }
+            };
+            match exchange(&mut origin, request.as_bytes(), client, buf, body).await {
+                Ok(exchanged) => break (origin, permit, exchanged),
+                Err(e) if retry => debug!("Kept connection to {} failed: {:#}", target, e),
+                Err(e) => {
+                    debug!("HTTP proxy request to {} failed: {:#}", target, e);
+                    return Err(Status::BadGateway);
+                }
+            }
+        };
+
+        let mut relayed = Relayed {
+            status: None,
+            up_bytes,
+            down_bytes: 0,
+        };
+        // Informational responses go through ahead of the final one
+        while (100..200).contains(&response.status) && response.status != 101 {
+            relayed.down_bytes += response.len as u64;
+            if client.write_all(&origin_buf[..response.len]).await.is_err() {
+                return Ok((relayed, false));
+            }
+            origin_buf.drain(..response.len);
+            response = match read_response(&mut origin, &mut origin_buf).await {
+                Ok(Some(response)) => response,
+                _ => return Err(Status::BadGateway),
+            };
+        }
+        relayed.status = Some(response.status);
+        relayed.down_bytes += response.len as u64;
+        origin_buf.drain(..response.len);
+
+        let response_body = response.body(&head.method);
+        let keep_open = head.keep_alive() && response_body != Body::UntilClose;
+        let response_head = client_response(&response, keep_open, head.version);
+        if client.write_all(response_head.as_bytes()).await.is_err() {
+            return Ok((relayed, false));
+        }
+        match copy_body(&mut origin, &mut origin_buf, client, response_body).await {
+            Ok(copied) => relayed.down_bytes += copied,
+            Err(e) => {
+                debug!("HTTP proxy response from {} ended: {}", target, e);
+                return Ok((relayed, false));
+            }
+        }
+        if response_body != Body::UntilClose && response.keep_alive() && origin_buf.is_empty() {
+            self.keep_idle(&peer.pubkey, target, (origin, permit));
+        }
+        Ok((relayed, keep_open))
+    }
+
+    /// A connection to `target` kept open for `peer`, if the origin hasn't
+    /// closed it
+    fn take_idle(&self, peer: &[u8; 32], target: SocketAddrV4) -> Option<Origin> {
+        let mut idle = self.idle.lock();
+        let connections = idle.get_mut(&(*peer, target))?;
+        let timeout = self.keep_alive.timeout;
+        connections.retain(|(_, since)| since.elapsed() < timeout);
+        let mut kept = None;
+        while let Some(((mut origin, permit), _)) = connections.pop() {
+            // A kept connection has nothing to read unless the origin
+            // closed it
+            let mut byte = [0u8; 1];
+            if origin.read(&mut byte).now_or_never().is_none() {
+                kept = Some((origin, permit));
+                break;
+            }
+        }
+        if connections.is_empty() {
+            idle.remove(&(*peer, target));
+        }
+        kept
+    }
+
+    /// Keep a connection to `target` open for `peer`'s next request there
+    fn keep_idle(&self, peer: &[u8; 32], target: SocketAddrV4, origin: Origin) {
+        let mut idle = self.idle.lock();
+        let connections = idle.entry((*peer, target)).or_default();
+        if connections.len() < self.keep_alive.connections {
+            connections.push((origin, Instant::now()));
+        }
+    }
+
+    /// Close connections to origins that have been idle past the timeout
+    pub fn forget_idle(&self) {
+        let timeout = self.keep_alive.timeout;
+        self.idle.lock().retain(|_, connections| {
+            connections.retain(|(_, since)| since.elapsed() < timeout);
+            !connections.is_empty()
+        });
+    }
+
+    /// Whether the request carries accepted credentials, or none are needed
+    fn authorized(&self, head: &Head) -> bool {
+        if self.users.is_empty() && self.tokens.is_empty() {
+            return true;
+        }
+        let Some(value) = head.header("proxy-authorization") else {
+            return false;
+        };
+        let Some((scheme, credentials)) = value.trim().split_once(' ') else {
+            return false;
+        };
+        let credentials = credentials.trim();
+        let matches = |accepted: &[String], given: &[u8]| {
+            accepted
+                .iter()
+                .any(|candidate| constant_time_eq(candidate.as_bytes(), given))
+        };
+        if scheme.eq_ignore_ascii_case("basic") {
+            base64::engine::general_purpose::STANDARD
+                .decode(credentials)
+                .is_ok_and(|decoded| matches(&self.users, &decoded))
+        } else if scheme.eq_ignore_ascii_case("bearer") {
+            matches(&self.tokens, credentials.as_bytes())
+        } else {
+            false
+        }
+    }
+}
+
+/// Open a tunnel to the request's `host:port`
+async fn tunnel<S: AsyncRead + AsyncWrite + Unpin>(
+    client: &mut S,
+    head: &Head,
+    early_data: &[u8],
+    peer: &Peer,
+) -> Result<Relayed, Status> {
+    let (host, port) = split_authority(&head.target, None).ok_or(Status::BadRequest)?;
+    let target = peer.resolve(&host).await.ok_or(Status::BadGateway)?;
+    let target = SocketAddrV4::new(target, port);
+    let server_name = host.parse::<Ipv4Addr>().is_err().then_some(host.as_str());
+    if !peer.allows(Protocol::Tcp, target, server_name) {
+        return Err(Status::Forbidden);
+    }
+    let _permit = peer.open_flow().ok_or(Status::TooManyRequests)?;
+    let mut upstream = peer
+        .policy
+        .egress
+        .connect_tcp(target)
+        .await
+        .map(Metered::new)
+        .map_err(|_| Status::BadGateway)?;
+
+    let established = client
+        .write_all(b"HTTP/1.1 200 Connection Established\r\n\r\n")
+        .await;
+    if established.is_ok() && upstream.write_all(early_data).await.is_ok() {
+        if let Err(e) = tokio::io::copy_bidirectional(client, &mut upstream).await {
+            debug!("HTTP proxy tunnel to {} ended: {}", target, e);
+        }
+    }
+    Ok(upstream.relayed(Some(200)))
+}
+
+/// How the end of a message body is found
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Body {
+    Length(u64),
+    Chunked,
+    /// Everything until the connection closes
+    UntilClose,
+}
+
+/// The request head to send the origin: hop-by-hop headers dropped, and
+/// for HTTP/1.0 asking it to keep the connection open, as HTTP/1.1 does
+/// unless told otherwise
+fn origin_request(head: &Head, authority: &str, path: &str) -> String {
+    let mut request = format!("{} {} HTTP/1.{}\r\n", head.method, path, head.version);
+    let mut has_host = false;
+    for (name, value) in &head.headers {
+        let lower = name.to_ascii_lowercase();
+        // The proxy answers 100-continue itself
+        if HOP_BY_HOP.contains(&lower.as_str()) || lower == "expect" {
+            continue;
+        }
+        has_host |= lower == "host";
+        request.push_str(&format!("{}: {}\r\n", name, value));
+    }
+    if !has_host {
+        request.push_str(&format!("Host: {}\r\n", authority));
+    }
+    if head.version == 0 {
+        request.push_str("Connection: keep-alive\r\n");
+    }
+    request.push_str("\r\n");
+    request
+}
+
+/// The response head to send the client, saying whether its connection
+/// stays open
+fn client_response(response: &Response, keep_open: bool, client_version: u8) -> String {
+    let mut head = format!("HTTP/1.1 {} {}\r\n", response.status, response.reason);
+    for (name, value) in &response.headers {
+        if !HOP_BY_HOP.contains(&name.to_ascii_lowercase().as_str()) {
+            head.push_str(&format!("{}: {}\r\n", name, value));
+        }
+    }
+    if !keep_open {
+        head.push_str("Connection: close\r\n");
+    } else if client_version == 0 {
+        head.push_str("Connection: keep-alive\r\n");
+    }
+    head.push_str("\r\n");
+    head
+}
+
+/// Send a request head and the client's body after it to an origin, and
+/// read the head of the origin's response. Returns the response, what was
+/// read from the origin from its head on, and the bytes sent.
+async fn exchange<S: AsyncRead + Unpin>(
+    origin: &mut Box<dyn Connection>,
+    request: &[u8],
+    client: &mut S,
+    buf: &mut Vec<u8>,
+    body: Body,
+) -> Result<(Response, Vec<u8>, u64)> {
+    origin.write_all(request).await?;
+    let sent = copy_body(client, buf, origin, body).await?;
+    let mut origin_buf = Vec::new();
+    let response = read_response(origin, &mut origin_buf)
+        .await?
+        .context("origin closed the connection")?;
+    Ok((response, origin_buf, request.len() as u64 + sent))
+}
+
+/// Copy a message body from `buf` and then `from` to `to`, leaving
+/// anything read past it in `buf`. Returns the bytes copied, including
+/// chunk sizes and trailers.
+async fn copy_body<R, W>(from: &mut R, buf: &mut Vec<u8>, to: &mut W, body: Body) -> io::Result<u64>
+where
+    R: AsyncRead + Unpin + ?Sized,
+    W: AsyncWrite + Unpin + ?Sized,
+{
+    match body {
+        Body::Length(len) => copy_exact(from, buf, to, len).await.map(|()| len),
+        Body::Chunked => copy_chunked(from, buf, to).await,
+        Body::UntilClose => {
+            to.write_all(buf).await?;
+            let buffered = buf.len() as u64;
+            buf.clear();
+            Ok(buffered + tokio::io::copy(from, to).await?)
+        }
+    }
+}
+
+async fn copy_exact<R, W>(
+    from: &mut R,
+    buf: &mut Vec<u8>,
+    to: &mut W,
+    mut len: u64,
+) -> io::Result<()>
+where
+    R: AsyncRead + Unpin + ?Sized,
+    W: AsyncWrite + Unpin + ?Sized,
+{
+    loop {
+        let take = buf.len().min(usize::try_from(len).unwrap_or(usize::MAX));
+        to.write_all(&buf[..take]).await?;
+        buf.drain(..take);
+        len -= take as u64;
+        if len == 0 {
+            return Ok(());
+        }
+        fill(from, buf).await?;
+    }
+}
+
+async fn copy_chunked<R, W>(from: &mut R, buf: &mut Vec<u8>, to: &mut W) -> io::Result<u64>
+where
+    R: AsyncRead + Unpin + ?Sized,
+    W: AsyncWrite + Unpin + ?Sized,
+{
+    let invalid = || io::Error::new(io::ErrorKind::InvalidData, "invalid chunk size");
+    let mut copied = 0;
+    loop {
+        let line = read_line(from, buf).await?;
+        let size = std::str::from_utf8(&buf[..line - 2])
+            .ok()
+            .and_then(|line| line.split(';').next())
+            .and_then(|size| u64::from_str_radix(size.trim(), 16).ok())
+            .ok_or_else(invalid)?;
+        to.write_all(&buf[..line]).await?;
+        buf.drain(..line);
+        copied += line as u64;
+        if size == 0 {
+            break;
+        }
+        // The chunk and the CRLF after it
+        let len = size.checked_add(2).ok_or_else(invalid)?;
+        copy_exact(from, buf, to, len).await?;
+        copied += len;
+    }
+    // Trailers, up to a blank line
+    loop {
+        let line = read_line(from, buf).await?;
+        to.write_all(&buf[..line]).await?;
+        buf.drain(..line);
+        copied += line as u64;
+        if line == 2 {
+            return Ok(copied);
+        }
+    }
+}
+
+/// The length of the CRLF-terminated line at the start of `buf`, reading
+/// more from `from` until it is all there
+async fn read_line<R: AsyncRead + Unpin + ?Sized>(
+    from: &mut R,
+    buf: &mut Vec<u8>,
+) -> io::Result<usize> {
+    loop {
+        if let Some(end) = buf.windows(2).position(|pair| pair == b"\r\n") {
+            return Ok(end + 2);
+        }
+        if buf.len() >= MAX_HEAD {
+            return Err(io::Error::new(io::ErrorKind::InvalidData, "line too long"));
+        }
+        fill(from, buf).await?;
+    }
+}
+
+/// Read more from `from` onto the end of `buf`, failing if it has ended
+async fn fill<R: AsyncRead + Unpin + ?Sized>(from: &mut R, buf: &mut Vec<u8>) -> io::Result<()> {
+    let mut chunk = [0u8; 16 * 1024];
+    let n = from.read(&mut chunk).await?;
+    if n == 0 {
+        return Err(io::ErrorKind::UnexpectedEof.into());
+    }
+    buf.extend_from_slice(&chunk[..n]);
+    Ok(())
+}
+
+/// How a request went, for the access log
+#[derive(Debug, Default)]
+struct Relayed {
+    status: Option<u16>,
+    up_bytes: u64,
+    down_bytes: u64,
+}
+
+/// A connection to a destination, counting the bytes each way
+struct Metered<T> {
+    inner: T,
+    up_bytes: u64,
+    down_bytes: u64,
+}
+
+impl<T> Metered<T> {
+    fn new(inner: T) -> Self {
+        Self {
+            inner,
+            up_bytes: 0,
+            down_bytes: 0,
+        }
+    }
+
+    fn relayed(&self, status: Option<u16>) -> Relayed {
+        Relayed {
+            status,
+            up_bytes: self.up_bytes,
+            down_bytes: self.down_bytes,
+        }
+    }
+}
+
+impl<T: AsyncRead + Unpin> AsyncRead for Metered<T> {
+    fn poll_read(
+        self: Pin<&mut Self>,
+        cx: &mut TaskContext<'_>,
+        buf: &mut ReadBuf<'_>,
+    ) -> Poll<io::Result<()>> {
+        let this = self.get_mut();
+        let before = buf.filled().len();
+        let result = Pin::new(&mut this.inner).poll_read(cx, buf);
+        this.down_bytes += (buf.filled().len() - before) as u64;
+        result
+    }
+}
+
+impl<T: AsyncWrite + Unpin> AsyncWrite for Metered<T> {
+    fn poll_write(
+        self: Pin<&mut Self>,
+        cx: &mut TaskContext<'_>,
+        buf: &[u8],
+    ) -> Poll<io::Result<usize>> {
+        let this = self.get_mut();
+        let result = Pin::new(&mut this.inner).poll_write(cx, buf);
+        if let Poll::Ready(Ok(n)) = result {
+            this.up_bytes += n as u64;
+        }
+        result
+    }
+
+    fn poll_flush(self: Pin<&mut Self>, cx: &mut TaskContext<'_>) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.get_mut().inner).poll_flush(cx)
+    }
+
+    fn poll_shutdown(self: Pin<&mut Self>, cx: &mut TaskContext<'_>) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.get_mut().inner).poll_shutdown(cx)
+    }
+}
+
+/// The peer a client connection comes from, and what applies to it. Also
+/// used by the SOCKS5 service.
+pub struct Peer {
+    pub pubkey: [u8; 32],
+    /// The client's address in the tunnel
+    pub client: SocketAddrV4,
+    pub policy: FlowPolicy,
+    pub dns: Arc<DnsService>,
+    /// For counting the connections opened for the peer as its flows
+    pub flows: ProxyFlows,
+}
+
+impl Peer {
+    /// Resolve `host` through the peer's DNS policy
+    pub async fn resolve(&self, host: &str) -> Option<Ipv4Addr> {
+        if let Ok(ip) = host.parse::<Ipv4Addr>() {
+            return Some(ip);
+        }
+        let query = dns_wire::build_query(rand::random(), host, dns_wire::TYPE_A);
+        let response = self
+            .dns
+            .resolve(&self.pubkey, &query, Transport::Tcp)
+            .await
+            .ok()?;
+        let records = dns_wire::parse_records(&response)?;
+        records
+            .answers
+            .iter()
+            .find(|record| record.rtype == dns_wire::TYPE_A && record.rdlen == 4)
+            .map(|record| {
+                let rdata = &response[record.rdata..record.rdata + 4];
+                Ipv4Addr::new(rdata[0], rdata[1], rdata[2], rdata[3])
+            })
+            // Blocklists may answer with 0.0.0.0
+            .filter(|ip| !ip.is_unspecified())
+    }
+
+    /// Admit a new connection for the peer under its flow limits, counted
+    /// as one of its flows until the permit is dropped
+    pub fn open_flow(&self) -> Option<FlowPermit> {
+        self.flows.open(&self.pubkey)
+    }
+
+    /// Whether the peer may reach `target`, as for a new NATed flow.
+    /// `server_name` stands in for the server name of a TLS ClientHello or
+    /// HTTP request on TCP.
+    pub fn allows(
+        &self,
+        protocol: Protocol,
+        target: SocketAddrV4,
+        server_name: Option<&str>,
+    ) -> bool {
+        let (policy, peer) = (&self.policy, &self.pubkey);
+        let (ip, port) = (IpAddr::V4(*target.ip()), target.port());
+        if !policy.schedules.allows(peer)
+            || policy.firewall.check(peer, protocol, ip, port) != Verdict::Accept
+            || !policy.egress.admits(protocol, ip)
+        {
+            return false;
+        }
+        if let Some(domains) = &policy.domains {
+            if protocol == Protocol::Tcp && domains.covers(port) && !domains.allows(server_name) {
+                return false;
+            }
+        }
+        match policy.acls.check(peer, protocol, ip, port) {
+            Decision::Allow => true,
+            Decision::Deny => false,
+            Decision::NeedsSni => {
+                protocol == Protocol::Tcp && policy.acls.check_sni(peer, ip, port, server_name)
+            }
+        }
+    }
+}
+
+/// A parsed request head
+pub struct Head {
+    pub method: String,
+    pub target: String,
+    /// Minor HTTP version
+    pub version: u8,
+    pub headers: Vec<(String, String)>,
+    /// Bytes the head took up, including the blank line
+    pub len: usize,
+}
+
+impl Head {
+    /// `host:port` or `host` the request is for
+    fn host(&self) -> Option<&str> {
+        if self.method == "CONNECT" {
+            Some(&self.target)
+        } else {
+            split_absolute_uri(&self.target).map(|(authority, _)| authority)
+        }
+    }
+
+    pub fn header(&self, name: &str) -> Option<&str> {
+        header(&self.headers, name)
+    }
+
+    fn has_token(&self, name: &str, token: &str) -> bool {
+        has_token(&self.headers, name, token)
+    }
+
+    /// Whether the client wants its connection kept open after this
+    /// request
+    fn keep_alive(&self) -> bool {
+        let says = |token| {
+            self.has_token("connection", token) || self.has_token("proxy-connection", token)
+        };
+        if self.version == 0 {
+            says("keep-alive")
+        } else {
+            !says("close")
+        }
+    }
+
+    /// How the request's body ends; `None` if that can't be told, as with
+    /// a transfer coding other than chunked
+    fn body(&self) -> Option<Body> {
+        if let Some(codings) = self.header("transfer-encoding") {
+            return is_chunked(codings).then_some(Body::Chunked);
+        }
+        match self.header("content-length") {
+            Some(len) => len.trim().parse().ok().map(Body::Length),
+            None => Some(Body::Length(0)),
+        }
+    }
+
+    /// Whether sending the request twice does no more than sending it once
+    fn is_idempotent(&self) -> bool {
+        matches!(
+            self.method.as_str(),
+            "GET" | "HEAD" | "OPTIONS" | "TRACE" | "PUT" | "DELETE"
+        )
+    }
+}
+
+/// A parsed response head from an origin
+struct Response {
+    status: u16,
+    reason: String,
+    /// Minor HTTP version
+    version: u8,
+    headers: Vec<(String, String)>,
+    /// Bytes the head took up, including the blank line
+    len: usize,
+}
+
+impl Response {
+    /// Whether the origin will keep its connection open after this
+    /// response
+    fn keep_alive(&self) -> bool {
+        if self.version == 0 {
+            has_token(&self.headers, "connection", "keep-alive")
+        } else {
+            !has_token(&self.headers, "connection", "close")
+        }
+    }
+
+    /// How the response's body ends, as the answer to a `method` request
+    fn body(&self, method: &str) -> Body {
+        if self.status == 101 {
+            return Body::UntilClose;
+        }
+        if method == "HEAD" || self.status < 200 || self.status == 204 || self.status == 304 {
+            return Body::Length(0);
+        }
+        if let Some(codings) = header(&self.headers, "transfer-encoding") {
+            return if is_chunked(codings) {
+                Body::Chunked
+            } else {
+                Body::UntilClose
+            };
+        }
+        header(&self.headers, "content-length")
+            .and_then(|len| len.trim().parse().ok())
+            .map_or(Body::UntilClose, Body::Length)
+    }
+}
+
+fn header<'a>(headers: &'a [(String, String)], name: &str) -> Option<&'a str> {
+    headers
+        .iter()
+        .find(|(n, _)| n.eq_ignore_ascii_case(name))
+        .map(|(_, value)| value.as_str())
+}
+
+/// Whether the comma-separated values of a header include `token`
+fn has_token(headers: &[(String, String)], name: &str, token: &str) -> bool {
+    headers
+        .iter()
+        .filter(|(n, _)| n.eq_ignore_ascii_case(name))
+        .flat_map(|(_, value)| value.split(','))
+        .any(|value| value.trim().eq_ignore_ascii_case(token))
+}
+
+/// Whether the last of a message's transfer codings is chunked, which
+/// marks where its body ends
+fn is_chunked(codings: &str) -> bool {
+    codings
+        .rsplit(',')
+        .next()
+        .is_some_and(|coding| coding.trim().eq_ignore_ascii_case("chunked"))
+}
+
+/// Read from `client` into `buf` until it holds a whole request head.
+/// Returns `None` if the client closes before sending anything.
+pub async fn read_head<S: AsyncRead + Unpin>(
+    client: &mut S,
+    buf: &mut Vec<u8>,
+) -> Result<Option<Head>> {
+    let mut chunk = [0u8; 4096];
+    loop {
+        let mut headers = [httparse::EMPTY_HEADER; MAX_HEADERS];
+        let mut request = httparse::Request::new(&mut headers);
+        if let httparse::Status::Complete(len) = request.parse(buf.as_slice())? {
+            let headers = request
+                .headers
+                .iter()
+                .map(|header| {
+                    let value = std::str::from_utf8(header.value)
+                        .with_context(|| format!("header {} is not UTF-8", header.name))?;
+                    Ok((header.name.to_string(), value.to_string()))
+                })
+                .collect::<Result<_>>()?;
+            return Ok(Some(Head {
+                method: request.method.unwrap_or_default().to_string(),
+                target: request.path.unwrap_or_default().to_string(),
+                version: request.version.unwrap_or(1),
+                headers,
+                len,
+            }));
+        }
+        if buf.len() >= MAX_HEAD {
+            anyhow::bail!("request head over {} bytes", MAX_HEAD);
+        }
+        let n = client.read(&mut chunk).await?;
+        if n == 0 {
+            if buf.is_empty() {
+                return Ok(None);
+            }
+            anyhow::bail!("connection closed mid-request");
+        }
+        buf.extend_from_slice(&chunk[..n]);
+    }
+}
+
+/// Read from an origin into `buf` until it holds a whole response head.
+/// Returns `None` if the origin closes before sending anything.
+async fn read_response<R: AsyncRead + Unpin + ?Sized>(
+    origin: &mut R,
+    buf: &mut Vec<u8>,
+) -> Result<Option<Response>> {
+    let mut chunk = [0u8; 4096];
+    loop {
+        let mut headers = [httparse::EMPTY_HEADER; MAX_HEADERS];
+        let mut response = httparse::Response::new(&mut headers);
+        if let httparse::Status::Complete(len) = response.parse(buf.as_slice())? {
+            let headers = response
+                .headers
+                .iter()
+                .map(|header| {
+                    let value = std::str::from_utf8(header.value)
+                        .with_context(|| format!("header {} is not UTF-8", header.name))?;
+                    Ok((header.name.to_string(), value.to_string()))
+                })
+                .collect::<Result<_>>()?;
+            return Ok(Some(Response {
+                status: response.code.unwrap_or_default(),
+                reason: response.reason.unwrap_or_default().to_string(),
+                version: response.version.unwrap_or(1),
+                headers,
+                len,
+            }));
+        }
+        if buf.len() >= MAX_HEAD {
+            anyhow::bail!("response head over {} bytes", MAX_HEAD);
+        }
+        let n = origin.read(&mut chunk).await?;
+        if n == 0 {
+            if buf.is_empty() {
+                return Ok(None);
+            }
+            anyhow::bail!("connection closed mid-response");
+        }
+        buf.extend_from_slice(&chunk[..n]);
+    }
+}
+
+/// Split `host:port`, taking `default_port` if there is no port. IPv6
+/// literals are not supported.
+fn split_authority(authority: &str, default_port: Option<u16>) -> Option<(String, u16)> {
+    if authority.contains(['@', '[']) {
+        return None;
+    }
+    let (host, port) = match authority.rsplit_once(':') {
+        Some((host, port)) => (host, port.parse().ok()?),
+        None => (authority, default_port?),
+    };
+    (!host.is_empty() && port != 0).then(|| (host.to_string(), port))
+}
+
+/// Split an absolute `http://` URI into its authority and the path and
+/// query to request from the origin
+fn split_absolute_uri(uri: &str) -> Option<(&str, String)> {
+    let scheme_end = uri.find("://")?;
+    if !uri[..scheme_end].eq_ignore_ascii_case("http") {
+        return None;
+    }
+    let rest = &uri[scheme_end + 3..];
+    let path_start = rest.find(['/', '?']).unwrap_or(rest.len());
+    let (authority, path) = rest.split_at(path_start);
+    let path = match path {
+        "" => "/".to_string(),
+        path if path.starts_with('?') => format!("/{}", path),
+        path => path.to_string(),
+    };
+    Some((authority, path))
+}
+
+/// Error responses the proxy sends
+#[derive(Debug, Clone, Copy)]
+enum Status {
+    BadRequest,
+    Forbidden,
+    ProxyAuthRequired,
+    RequestTimeout,
+    TooManyRequests,
+    BadGateway,
+}
+
+impl Status {
+    fn code(self) -> u16 {
+        match self {
+            Status::BadRequest => 400,
+            Status::Forbidden => 403,
+            Status::ProxyAuthRequired => 407,
+            Status::RequestTimeout => 408,
+            Status::TooManyRequests => 429,
+            Status::BadGateway => 502,
+        }
+    }
+}
+
+impl fmt::Display for Status {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let reason = match self {
+            Status::BadRequest => "Bad Request",
+            Status::Forbidden => "Forbidden",
+            Status::ProxyAuthRequired => "Proxy Authentication Required",
+            Status::RequestTimeout => "Request Timeout",
+            Status::TooManyRequests => "Too Many Requests",
+            Status::BadGateway => "Bad Gateway",
+        };
+        write!(f, "{} {}", self.code(), reason)
+    }
+}
+
+async fn respond<S: AsyncWrite + Unpin>(client: &mut S, status: Status) -> std::io::Result<()> {
+    let mut response = format!(
+        "HTTP/1.1 {}\r\nContent-Length: 0\r\nConnection: close\r\n",
+        status
+    );
+    if let Status::ProxyAuthRequired = status {
+        response.push_str("Proxy-Authenticate: Basic realm=\"wirecage\"\r\n");
+    }
+    response.push_str("\r\n");
+    client.write_all(response.as_bytes()).await?;
+    client.shutdown().await
+}
@@ -0,0 +1,165 @@
+//! ICMP echo for peers
+//!
+//! The dataplane answers pings to the server IP itself. Echo requests to
+//! other destinations are sent on from the host, so `ping` works through
+//! the NAT: each peer's echo session, an identifier to one destination,
+//! gets a socket of its own. That is an unprivileged ping socket where
+//! `net.ipv4.ping_group_range` includes the server's group, and otherwise
+//! a raw ICMP socket, which needs CAP_NET_RAW. Replies go back to the peer
+//! with the identifier it used.
+//!
+//! A new session passes the peer's access schedule and flow rate, and the
+//! firewall rules and egress ACL rules naming no protocol or port, such as
+//! `drop to 10.0.0.0/8`. It leaves by the destination's egress route only
+//! when that is a direct path; proxies and WireGuard egress tunnels don't
+//! carry ICMP. `--icmp-echo-forwarding=false` answers only the server IP.
+//! Pings over IPv6 work the same with ICMPv6, whose checksum the kernel
+//! fills in on both kinds of socket.
+
+use std::ffi::OsString;
+use std::io;
+use std::net::{IpAddr, SocketAddr};
+use std::os::fd::{AsRawFd, OwnedFd};
+
+use nix::errno::Errno;
+use nix::sys::socket::{
+    bind, connect, setsockopt, socket, sockopt, AddressFamily, SockFlag, SockProtocol, SockType,
+    SockaddrStorage,
+};
+use tokio::net::UdpSocket;
+
+use super::dataplane::internet_checksum;
+
+pub const ECHO_REPLY: u8 = 0;
+pub const ECHO_REQUEST: u8 = 8;
+pub const ECHO_REQUEST_V6: u8 = 128;
+pub const ECHO_REPLY_V6: u8 = 129;
+/// Type, code, checksum, identifier and sequence number
+const ECHO_HEADER_LEN: usize = 8;
+
+/// An echo request or reply
+pub struct Echo<'a> {
+    pub ident: u16,
+    pub seq: u16,
+    pub data: &'a [u8],
+}
+
+impl<'a> Echo<'a> {
+    /// Parse an ICMP message as an echo of `kind`
+    pub fn parse(message: &'a [u8], kind: u8) -> Option<Self> {
+        let (header, data) = message.split_first_chunk::<ECHO_HEADER_LEN>()?;
+        if header[0] != kind || header[1] != 0 {
+            return None;
+        }
+        Some(Self {
+            ident: u16::from_be_bytes([header[4], header[5]]),
+            seq: u16::from_be_bytes([header[6], header[7]]),
+            data,
+        })
+    }
+
+    /// The ICMP message of an echo of `kind`, with its checksum
+    pub fn encode(&self, kind: u8) -> Vec<u8> {
+        let mut message = Vec::with_capacity(ECHO_HEADER_LEN + self.data.len());
+        message.extend_from_slice(&[kind, 0, 0, 0]);
+        message.extend_from_slice(&self.ident.to_be_bytes());
+        message.extend_from_slice(&self.seq.to_be_bytes());
+        message.extend_from_slice(self.data);
+        let checksum = internet_checksum(&[&message]);
+        message[2..4].copy_from_slice(&checksum.to_be_bytes());
+        message
+    }
+}
+
+/// A socket sending echo requests to one destination
+pub struct EchoSocket {
+    socket: UdpSocket,
+    /// Raw sockets see every echo reply from the destination, so replies
+    /// are matched on `ident`, and over IPv4 the IP header too
+    raw: bool,
+    v6: bool,
+    /// The identifier requests are sent with; ping sockets have the kernel
+    /// set their own
+    ident: u16,
+}
+
+impl EchoSocket {
+    /// Open a socket from `local`, and `interface` if set, to `remote`,
+    /// which must be of the same family
+    pub fn open(local: IpAddr, interface: Option<&str>, remote: IpAddr) -> io::Result<Self> {
+        let v6 = remote.is_ipv6();
+        let (family, protocol) = if v6 {
+            (AddressFamily::Inet6, SockProtocol::IcmpV6)
+        } else {
+            (AddressFamily::Inet, SockProtocol::Icmp)
+        };
+        let open = |kind| {
+            socket(
+                family,
+                kind,
+                SockFlag::SOCK_NONBLOCK | SockFlag::SOCK_CLOEXEC,
+                protocol,
+            )
+        };
+        let (fd, raw): (OwnedFd, bool) = match open(SockType::Datagram) {
+            Ok(fd) => (fd, false),
+            Err(Errno::EACCES | Errno::EPERM) => (open(SockType::Raw)?, true),
+            Err(e) => return Err(e.into()),
+        };
+        if let Some(interface) = interface {
+            setsockopt(&fd, sockopt::BindToDevice, &OsString::from(interface))?;
+        }
+        bind(
+            fd.as_raw_fd(),
+            &SockaddrStorage::from(SocketAddr::new(local, 0)),
+        )?;
+        connect(
+            fd.as_raw_fd(),
+            &SockaddrStorage::from(SocketAddr::new(remote, 0)),
+        )?;
+        let socket = UdpSocket::from_std(std::net::UdpSocket::from(fd))?;
+        Ok(Self {
+            socket,
+            raw,
+            v6,
+            ident: rand::random(),
+        })
+    }
+
+    pub async fn send(&self, seq: u16, data: &[u8]) -> io::Result<()> {
+        let echo = Echo {
+            ident: self.ident,
+            seq,
+            data,
+        };
+        let kind = if self.v6 {
+            ECHO_REQUEST_V6
+        } else {
+            ECHO_REQUEST
+        };
+        self.socket.send(&echo.encode(kind)).await?;
+        Ok(())
+    }
+
+    /// Wait for the next echo reply, returning its sequence number and
+    /// data
+    pub async fn recv(&self, buf: &mut [u8]) -> io::Result<(u16, Vec<u8>)> {
+        loop {
+            let n = self.socket.recv(buf).await?;
+            let message = if self.raw && !self.v6 {
+                let header_len = buf.first().map_or(0, |b| usize::from(b & 0x0f) * 4);
+                &buf[header_len.min(n)..n]
+            } else {
+                &buf[..n]
+            };
+            let kind = if self.v6 { ECHO_REPLY_V6 } else { ECHO_REPLY };
+            let Some(echo) = Echo::parse(message, kind) else {
+                continue;
+            };
+            if self.raw && echo.ident != self.ident {
+                continue;
+            }
+            return Ok((echo.seq, echo.data.to_vec()));
+        }
+    }
+}
@@ -0,0 +1,68 @@
+//! IPv6 for peers
+//!
+//! With `--ipv6-prefix`, such as `fd42:42:42::/64`, every peer gets an IPv6
+//! address beside its IPv4 one: the prefix with its IPv4 address in the low
+//! 32 bits, so 10.200.100.7 goes with `fd42:42:42::ac8:6407`. The two stay
+//! in step without a second pool, and the dataplane finds a peer from
+//! either. The server takes the address matching its own IP and answers DNS
+//! and pings there, and peers' configs route `::/0` into the tunnel.
+//!
+//! Peers' IPv6 flows leave the host directly. `--ipv6-egress nat`, the
+//! default, sends them from the host's own addresses as IPv4 flows are
+//! (NAT66), which suits a ULA prefix. `--ipv6-egress routed` sends them
+//! from each peer's own address, for a global prefix routed to the host;
+//! the kernel has to treat the prefix as local so sockets can bind to peers'
+//! addresses: `ip -6 route add local 2001:db8:42::/64 dev lo`. Egress
+//! routes, proxies and the WireGuard egress tunnel only carry IPv4, so with
+//! `--egress-proxy` or `--egress-wg-config` IPv6 flows are dropped rather
+//! than let out around them.
+
+use std::net::{Ipv4Addr, Ipv6Addr};
+
+use anyhow::Result;
+use ipnet::Ipv6Net;
+
+/// Where peers' IPv6 flows leave from
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, clap::ValueEnum)]
+pub enum Ipv6Egress {
+    /// The host's own address, translated like IPv4 flows
+    #[default]
+    Nat,
+    /// The peer's own address, for a prefix routed to the host
+    Routed,
+}
+
+/// The prefix peers' IPv6 addresses are made in
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Ipv6Prefix {
+    net: Ipv6Net,
+}
+
+impl Ipv6Prefix {
+    /// Make addresses in `net`, which must leave 32 bits for IPv4 addresses
+    pub fn new(net: Ipv6Net) -> Result<Self> {
+        if net.prefix_len() > 96 {
+            anyhow::bail!(
+                "IPv6 prefix {} is longer than /96, leaving no room for IPv4 addresses",
+                net
+            );
+        }
+        Ok(Self { net: net.trunc() })
+    }
+
+    pub fn prefix_len(&self) -> u8 {
+        self.net.prefix_len()
+    }
+
+    /// The IPv6 address going with the peer or server IPv4 address `ip`
+    pub fn address_for(&self, ip: Ipv4Addr) -> Ipv6Addr {
+        Ipv6Addr::from(u128::from(self.net.network()) | u128::from(u32::from(ip)))
+    }
+
+    /// The IPv4 address `ip` was made from, if it is one of the prefix's
+    /// addresses
+    pub fn ipv4_for(&self, ip: Ipv6Addr) -> Option<Ipv4Addr> {
+        let ipv4 = Ipv4Addr::from(u128::from(ip) as u32);
+        (self.address_for(ipv4) == ip).then_some(ipv4)
+    }
+}
@@ -0,0 +1,570 @@
+//! Kernel WireGuard mode
+//!
+//! With `--kernel-interface`, a server running with CAP_NET_ADMIN hands the
+//! WireGuard device and NAT to the kernel instead of running them in
+//! userspace: it creates a kernel WireGuard interface with the server key and
+//! address, masquerades the VPN subnet out of the outbound interface with
+//! iptables, and keeps the interface's peers in step with the registry, so
+//! the API, enrollment, expiry and bans work as before. DNS is served on the
+//! server IP by the same resolver and policies.
+//!
+//! The interface is configured with `ip`, `wg` and `iptables`, which must be
+//! installed. Firewall rules, egress ACLs, access schedules, bandwidth and
+//! flow limits, port forwards and packet captures belong to the userspace
+//! dataplane and do not apply in this mode. The egress safeguards are
+//! iptables rules here, and can't be overridden for some peers.
+
+use std::collections::HashMap;
+use std::io::Write;
+use std::net::{Ipv4Addr, SocketAddr};
+use std::process::{Command, Stdio};
+use std::sync::atomic::Ordering;
+use std::sync::Arc;
+use std::time::{Duration, UNIX_EPOCH};
+
+use anyhow::{Context, Result};
+use base64::Engine;
+use parking_lot::RwLock;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::{TcpListener, TcpStream, UdpSocket};
+use tracing::{debug, info, warn};
+
+use super::dns::{self, DnsService, Transport, DNS_PORT};
+use super::events::encode_key;
+use super::state::SharedState;
+use super::usage::unix_now;
+use super::wg::PeerStats;
+use super::wgconf;
+
+/// How often the interface's peers are reconciled with the registry
+const SYNC_INTERVAL: Duration = Duration::from_secs(2);
+
+/// How long a DNS-over-TCP client may stay idle between queries
+const DNS_TCP_IDLE_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Marks the iptables rules the server adds, so they can be told apart
+const RULE_COMMENT: &str = "wirecage";
+
+/// MSS for the 1420-byte MTU new WireGuard interfaces get
+const DEFAULT_MSS: u16 = 1380;
+
+/// How the kernel interface is set up
+pub struct KernelSettings {
+    pub interface: String,
+    pub listen_port: u16,
+    pub server_ip: Ipv4Addr,
+    pub subnet_mask: u8,
+    /// Interface traffic leaves by; the default route's if unset
+    pub outbound_interface: Option<String>,
+    pub client_isolation: bool,
+    /// Reject SMTP and cloud metadata traffic from peers
+    pub egress_safeguards: bool,
+    /// MSS that forwarded SYNs are lowered to; the interface MTU's if
+    /// unset, and none if zero
+    pub mss_clamp: Option<u16>,
+}
+
+/// A peer as the kernel last reported it
+struct KernelPeer {
+    preshared_key: Option<[u8; 32]>,
+    allowed_ip: Option<Ipv4Addr>,
+    stats: PeerStats,
+}
+
+/// A kernel WireGuard interface serving the registered peers
+pub struct KernelDevice {
+    settings: KernelSettings,
+    outbound: String,
+    peers: RwLock<HashMap<[u8; 32], KernelPeer>>,
+}
+
+impl KernelDevice {
+    /// Create the interface, or take over one left by a previous server, and
+    /// set up forwarding and NAT for the VPN subnet
+    pub fn create(settings: KernelSettings, private_key: &[u8; 32]) -> Result<Self> {
+        let interface = settings.interface.as_str();
+        if run("ip", &["link", "show", "dev", interface]).is_err() {
+            run(
+                "ip",
+                &["link", "add", "dev", interface, "type", "wireguard"],
+            )
+            .context("failed to create kernel WireGuard interface (needs CAP_NET_ADMIN)")?;
+        }
+        let port = settings.listen_port.to_string();
+        run_with_key(
+            &[
+                "set",
+                interface,
+                "listen-port",
+                &port,
+                "private-key",
+                "/dev/stdin",
+            ],
+            private_key,
+        )
+        .context("failed to configure kernel WireGuard interface")?;
+        let address = format!("{}/{}", settings.server_ip, settings.subnet_mask);
+        run("ip", &["address", "replace", &address, "dev", interface])?;
+        run("ip", &["link", "set", "up", "dev", interface])?;
+        std::fs::write("/proc/sys/net/ipv4/ip_forward", "1")
+            .context("failed to enable IPv4 forwarding")?;
+
+        let outbound = match &settings.outbound_interface {
+            Some(outbound) => outbound.clone(),
+            None => default_interface()?,
+        };
+        let device = Self {
+            settings,
+            outbound,
+            peers: RwLock::new(HashMap::new()),
+        };
+        for (table, chain, rule) in device.rules() {
+            ensure_rule(table, chain, &rule)?;
+        }
+        info!(
+            "Kernel WireGuard interface {} listening on port {}, NAT out of {}",
+            device.settings.interface, device.settings.listen_port, device.outbound
+        );
+        Ok(device)
+    }
+
+    /// The iptables rules the interface needs, as table, chain and rule
+    fn rules(&self) -> Vec<(&'static str, &'static str, Vec<String>)> {
+        let interface = self.settings.interface.as_str();
+        let subnet = format!("{}/{}", self.settings.server_ip, self.settings.subnet_mask);
+        let mss = self.settings.mss_clamp.unwrap_or(DEFAULT_MSS);
+        let mss_arg = mss.to_string();
+        let mut rules = Vec::new();
+        if mss != 0 {
+            // Both ways, as either end may advertise more than the tunnel
+            // carries
+            for direction in ["-i", "-o"] {
+                rules.push((
+                    "mangle",
+                    "FORWARD",
+                    vec![
+                        direction,
+                        interface,
+                        "-p",
+                        "tcp",
+                        "--tcp-flags",
+                        "SYN,RST",
+                        "SYN",
+                        "-j",
+                        "TCPMSS",
+                        "--set-mss",
+                        mss_arg.as_str(),
+                    ],
+                ));
+            }
+        }
+        if self.settings.client_isolation {
+            rules.push((
+                "filter",
+                "FORWARD",
+                vec!["-i", interface, "-o", interface, "-j", "DROP"],
+            ));
+        }
+        if self.settings.egress_safeguards {
+            rules.push((
+                "filter",
+                "FORWARD",
+                vec![
+                    "-i",
+                    interface,
+                    "-p",
+                    "tcp",
+                    "--dport",
+                    "25",
+                    "-j",
+                    "REJECT",
+                    "--reject-with",
+                    "tcp-reset",
+                ],
+            ));
+            for metadata in ["169.254.0.0/16", "100.100.100.200"] {
+                rules.push((
+                    "filter",
+                    "FORWARD",
+                    vec!["-i", interface, "-d", metadata, "-j", "REJECT"],
+                ));
+            }
+        }
+        rules.push(("filter", "FORWARD", vec!["-i", interface, "-j", "ACCEPT"]));
+        rules.push((
+            "filter",
+            "FORWARD",
+            vec![
+                "-o",
+                interface,
+                "-m",
+                "conntrack",
+                "--ctstate",
+                "RELATED,ESTABLISHED",
+                "-j",
+                "ACCEPT",
+            ],
+        ));
+        rules.push((
+            "nat",
+            "POSTROUTING",
+            vec![
+                "-s",
+                subnet.as_str(),
+                "-o",
+                self.outbound.as_str(),
+                "-j",
+                "MASQUERADE",
+            ],
+        ));
+        rules
+            .into_iter()
+            .map(|(table, chain, rule)| {
+                let mut rule: Vec<String> = rule.into_iter().map(str::to_string).collect();
+                rule.extend(
+                    ["-m", "comment", "--comment", RULE_COMMENT]
+                        .into_iter()
+                        .map(str::to_string),
+                );
+                (table, chain, rule)
+            })
+            .collect()
+    }
+
+    /// Remove the interface and the rules added for it
+    pub fn remove(&self) {
+        for (table, chain, rule) in self.rules() {
+            let mut args = vec!["-t", table, "-D", chain];
+            args.extend(rule.iter().map(String::as_str));
+            if let Err(e) = run("iptables", &args) {
+                debug!("Failed to remove iptables rule: {:#}", e);
+            }
+        }
+        match run("ip", &["link", "del", "dev", &self.settings.interface]) {
+            Ok(_) => info!("Removed interface {}", self.settings.interface),
+            Err(e) => warn!(
+                "Failed to remove interface {}: {:#}",
+                self.settings.interface, e
+            ),
+        }
+    }
+
+    /// Replace the interface's private key. The kernel holds one key, so
+    /// peers still using the old one must handshake again with the new one.
+    pub fn set_private_key(&self, private_key: &[u8; 32]) -> Result<()> {
+        run_with_key(
+            &["set", &self.settings.interface, "private-key", "/dev/stdin"],
+            private_key,
+        )
+        .context("failed to set kernel WireGuard private key")
+    }
+
+    /// Address the kernel receives WireGuard traffic on
+    pub fn listen_addr(&self) -> SocketAddr {
+        SocketAddr::from((Ipv4Addr::UNSPECIFIED, self.settings.listen_port))
+    }
+
+    /// A peer's counters as of the last sync
+    pub fn peer_stats(&self, peer_pubkey: &[u8; 32]) -> Option<PeerStats> {
+        self.peers
+            .read()
+            .get(peer_pubkey)
+            .map(|peer| peer.stats.clone())
+    }
+
+    /// Add, update and remove the interface's peers to match the registry,
+    /// and refresh their counters
+    fn sync_peers(&self, shared: &SharedState) -> Result<()> {
+        let dump = run("wg", &["show", &self.settings.interface, "dump"])?;
+        let mut current = parse_dump(&dump);
+        let desired: HashMap<[u8; 32], (Ipv4Addr, Option<[u8; 32]>)> = shared
+            .peers
+            .read()
+            .iter()
+            .map(|peer| (peer.public_key, (peer.assigned_ip, peer.preshared_key)))
+            .collect();
+
+        let interface = self.settings.interface.as_str();
+        for public_key in current.keys() {
+            if !desired.contains_key(public_key) {
+                let key = encode_key(public_key);
+                run("wg", &["set", interface, "peer", &key, "remove"])?;
+                info!("Removed peer {} from {}", key, interface);
+            }
+        }
+        for (public_key, (ip, preshared_key)) in &desired {
+            let unchanged = current.get(public_key).is_some_and(|peer| {
+                peer.allowed_ip == Some(*ip) && peer.preshared_key == *preshared_key
+            });
+            if unchanged {
+                continue;
+            }
+            let key = encode_key(public_key);
+            let allowed_ips = format!("{}/32", ip);
+            let mut args = vec![
+                "set",
+                interface,
+                "peer",
+                key.as_str(),
+                "allowed-ips",
+                allowed_ips.as_str(),
+            ];
+            match preshared_key {
+                Some(preshared_key) => {
+                    args.extend(["preshared-key", "/dev/stdin"]);
+                    run_with_key(&args, preshared_key)?;
+                }
+                None => {
+                    args.extend(["preshared-key", "/dev/null"]);
+                    run("wg", &args)?;
+                }
+            }
+            debug!("Synced peer {} to {}", key, interface);
+        }
+
+        // Roams are counted from endpoint changes between syncs
+        let mut peers = self.peers.write();
+        for (public_key, peer) in current.iter_mut() {
+            if let Some(previous) = peers.get(public_key) {
+                peer.stats.roams = previous.stats.roams;
+                if previous.stats.endpoint.is_some()
+                    && previous.stats.endpoint != peer.stats.endpoint
+                {
+                    peer.stats.roams += 1;
+                }
+            }
+        }
+        current.retain(|public_key, _| desired.contains_key(public_key));
+        *peers = current;
+        Ok(())
+    }
+}
+
+/// Keep the interface's peers in step with the registry until the server
+/// exits. Each pass counts as dataplane housekeeping for the health checks.
+pub async fn run_sync(device: Arc<KernelDevice>, shared: Arc<SharedState>) {
+    let mut interval = tokio::time::interval(SYNC_INTERVAL);
+    loop {
+        interval.tick().await;
+        let syncing = Arc::clone(&device);
+        let state = Arc::clone(&shared);
+        match tokio::task::spawn_blocking(move || syncing.sync_peers(&state)).await {
+            Ok(Ok(())) => {
+                shared
+                    .metrics
+                    .dataplane_heartbeat
+                    .store(unix_now(), Ordering::Relaxed);
+            }
+            Ok(Err(e)) => warn!("Failed to sync kernel WireGuard peers: {:#}", e),
+            Err(e) => warn!("Kernel WireGuard peer sync panicked: {}", e),
+        }
+    }
+}
+
+/// Answer DNS queries from peers on the server IP, over UDP and TCP
+pub async fn serve_dns(
+    server_ip: Ipv4Addr,
+    dns: Arc<DnsService>,
+    shared: Arc<SharedState>,
+) -> Result<()> {
+    let addr = SocketAddr::from((server_ip, DNS_PORT));
+    let udp = Arc::new(
+        UdpSocket::bind(addr)
+            .await
+            .with_context(|| format!("failed to bind DNS on {}", addr))?,
+    );
+    let tcp = TcpListener::bind(addr)
+        .await
+        .with_context(|| format!("failed to bind DNS on {}", addr))?;
+    info!("Serving DNS on {}", addr);
+
+    let mut buf = vec![0u8; 4096];
+    loop {
+        tokio::select! {
+            received = udp.recv_from(&mut buf) => {
+                let (n, client) = received.context("DNS receive failed")?;
+                let Some(peer_pubkey) = peer_for(&shared, client) else {
+                    continue;
+                };
+                let query = buf[..n].to_vec();
+                let (udp, dns) = (Arc::clone(&udp), Arc::clone(&dns));
+                tokio::spawn(async move {
+                    match dns.resolve(&peer_pubkey, &query, Transport::Udp).await {
+                        Ok(response) => {
+                            let _ = udp.send_to(&response, client).await;
+                        }
+                        Err(e) => debug!("DNS query from {} failed: {:#}", client, e),
+                    }
+                });
+            }
+            accepted = tcp.accept() => {
+                let (stream, client) = match accepted {
+                    Ok(accepted) => accepted,
+                    Err(e) => {
+                        warn!("DNS accept failed: {}", e);
+                        continue;
+                    }
+                };
+                let Some(peer_pubkey) = peer_for(&shared, client) else {
+                    continue;
+                };
+                let dns = Arc::clone(&dns);
+                tokio::spawn(async move {
+                    if let Err(e) = serve_dns_tcp(stream, peer_pubkey, &dns).await {
+                        debug!("DNS over TCP from {} failed: {:#}", client, e);
+                    }
+                });
+            }
+        }
+    }
+}
+
+/// Answer length-prefixed queries on a connection until the client closes
+/// it or goes idle
+async fn serve_dns_tcp(
+    mut stream: TcpStream,
+    peer_pubkey: [u8; 32],
+    dns: &DnsService,
+) -> Result<()> {
+    loop {
+        let mut len = [0u8; 2];
+        match tokio::time::timeout(DNS_TCP_IDLE_TIMEOUT, stream.read_exact(&mut len)).await {
+            Ok(Ok(_)) => {}
+            Ok(Err(e)) if e.kind() == std::io::ErrorKind::UnexpectedEof => return Ok(()),
+            Ok(Err(e)) => return Err(e).context("failed to read DNS length prefix"),
+            Err(_) => return Ok(()),
+        }
+        let mut query = vec![0u8; u16::from_be_bytes(len) as usize];
+        stream
+            .read_exact(&mut query)
+            .await
+            .context("failed to read DNS query")?;
+        let response = dns.resolve(&peer_pubkey, &query, Transport::Tcp).await?;
+        stream
+            .write_all(&dns::frame(&response)?)
+            .await
+            .context("failed to write DNS response")?;
+    }
+}
+
+/// The registered peer a DNS client address belongs to
+fn peer_for(shared: &SharedState, client: SocketAddr) -> Option<[u8; 32]> {
+    let SocketAddr::V4(client) = client else {
+        return None;
+    };
+    shared
+        .peers
+        .read()
+        .get_by_ip(client.ip())
+        .map(|peer| peer.public_key)
+}
+
+/// Parse the peer lines of `wg show <interface> dump`
+fn parse_dump(dump: &str) -> HashMap<[u8; 32], KernelPeer> {
+    // The first line describes the interface itself
+    dump.lines()
+        .skip(1)
+        .filter_map(|line| {
+            let fields: Vec<&str> = line.split('\t').collect();
+            let [public_key, preshared_key, endpoint, allowed_ips, handshake, rx, tx, _keepalive] =
+                fields[..]
+            else {
+                return None;
+            };
+            let last_handshake = match handshake.parse::<u64>().ok()? {
+                0 => None,
+                secs => Some(UNIX_EPOCH + Duration::from_secs(secs)),
+            };
+            let stats = PeerStats {
+                endpoint: endpoint.parse().ok(),
+                last_handshake,
+                // The kernel only reports handshakes, which an active peer
+                // repeats every two minutes
+                last_receive: last_handshake,
+                last_keepalive: None,
+                roams: 0,
+                rx_bytes: rx.parse().unwrap_or(0),
+                tx_bytes: tx.parse().unwrap_or(0),
+            };
+            let peer = KernelPeer {
+                preshared_key: wgconf::decode_key(preshared_key),
+                allowed_ip: allowed_ips
+                    .split(',')
+                    .next()
+                    .and_then(|net| net.strip_suffix("/32"))
+                    .and_then(|ip| ip.parse().ok()),
+                stats,
+            };
+            Some((wgconf::decode_key(public_key)?, peer))
+        })
+        .collect()
+}
+
+/// Add an iptables rule unless it is already there
+fn ensure_rule(table: &str, chain: &str, rule: &[String]) -> Result<()> {
+    let mut check = vec!["-t", table, "-C", chain];
+    check.extend(rule.iter().map(String::as_str));
+    if run("iptables", &check).is_ok() {
+        return Ok(());
+    }
+    let mut add = vec!["-t", table, "-A", chain];
+    add.extend(rule.iter().map(String::as_str));
+    run("iptables", &add).context("failed to add iptables rule")?;
+    Ok(())
+}
+
+/// The interface the default route leaves by
+fn default_interface() -> Result<String> {
+    let routes = run("ip", &["route", "show", "default"])?;
+    routes
+        .split_whitespace()
+        .skip_while(|&word| word != "dev")
+        .nth(1)
+        .map(str::to_string)
+        .context("could not determine the default interface; set --kernel-outbound-interface")
+}
+
+/// Run a command, returning its output or failing with its error message
+fn run(program: &str, args: &[&str]) -> Result<String> {
+    let output = Command::new(program)
+        .args(args)
+        .output()
+        .with_context(|| format!("failed to run {}", program))?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "{} {} failed: {}",
+            program,
+            args.join(" "),
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(String::from_utf8_lossy(&output.stdout).into_owned())
+}
+
+/// Run `wg` with a key passed on its standard input, so it never appears on
+/// a command line
+fn run_with_key(args: &[&str], key: &[u8; 32]) -> Result<()> {
+    let mut child = Command::new("wg")
+        .args(args)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::null())
+        .stderr(Stdio::piped())
+        .spawn()
+        .context("failed to run wg")?;
+    let encoded = base64::engine::general_purpose::STANDARD.encode(key);
+    child
+        .stdin
+        .take()
+        .context("failed to pass key to wg")?
+        .write_all(encoded.as_bytes())
+        .context("failed to pass key to wg")?;
+    let output = child.wait_with_output().context("failed to run wg")?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "wg {} failed: {}",
+            args.first().copied().unwrap_or_default(),
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(())
+}
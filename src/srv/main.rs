@@ -3,35 +3,133 @@
 //! Features:
 //! - Userspace WireGuard (no kernel module needed)
 //! - Userspace NAT via smoltcp (no iptables needed for NAT mode)
-//! - HTTPS API for dynamic peer registration with token auth
+//! - HTTPS API for dynamic peer registration with token or OIDC auth
 //! - Inbound TCP/UDP port forwarding managed through the API
+//! - Optional peer management API on a separate listener, with token auth
+//!   and TLS
 
+mod access_log;
+mod acl;
+mod admin;
+mod admin_auth;
+mod anomaly;
 mod api;
+mod audit;
+mod bandwidth;
+mod bufpool;
+mod cascade;
+#[cfg(test)]
+#[path = "../obfuscation.rs"]
+mod client_obfuscation;
+mod cluster;
+mod cookie;
+mod ctl;
+mod dashboard;
 mod dataplane;
+mod debug_vars;
+mod destinations;
+mod dial;
+mod dns;
+mod dns_blocklist;
+mod dns_cache;
+mod dns_local;
+mod dns_policy;
+mod dns_ratelimit;
+mod dns_upstream;
+mod dns_wire;
+mod domain_filter;
+mod egress;
+mod enroll;
+mod events;
+mod firewall;
 mod flow;
+mod flow_limit;
+mod flowlog;
+mod hairpin;
+mod handshake_limit;
+mod health;
+mod http_proxy;
+mod icmp;
+mod ipv6;
+mod kernel;
+mod metrics;
+mod mss;
+mod nat64;
+mod nat_ports;
+mod network;
+mod ntp;
+mod obfuscation;
+mod oidc;
+mod otel;
+mod pcap;
+mod port_forwards;
+mod port_mapping;
+mod proxy_protocol;
+mod qos;
+mod relay;
+mod reload;
+mod schedule;
+mod sessions;
+mod sni;
+mod socks;
+mod speedtest;
+mod ssh_auth;
 mod state;
+mod status_page;
+mod store;
+mod stun;
+mod systemd;
+mod tenant;
+mod totp;
+mod upgrade;
+mod upstream_proxy;
+mod usage;
+mod webhooks;
+mod websocket;
 mod wg;
+#[path = "../wg_mac.rs"]
+mod wg_mac;
+mod wg_socket;
+mod wg_stream;
+mod wgconf;
+mod wgimport;
 
 use std::net::Ipv4Addr;
+use std::os::fd::AsRawFd;
+use std::sync::atomic::Ordering;
 use std::sync::Arc;
+use std::time::Duration;
 
 use anyhow::{Context, Result};
 use base64::Engine;
-use clap::{ArgGroup, Parser};
+use clap::parser::ValueSource;
+use clap::{ArgGroup, ArgMatches, CommandFactory, FromArgMatches, Parser};
+use tokio::signal::unix::{signal, SignalKind};
 use tokio::sync::mpsc;
-use tracing::{error, info};
+use tracing::{error, info, warn, Instrument};
 use x25519_dalek::{PublicKey, StaticSecret};
 
+use proxy_protocol::ProxyProtocol;
 use state::{ServerConfig, SharedState};
 use wg::WgIo;
 
+/// How often peers past their expiry are looked for and removed
+const EXPIRY_CHECK_INTERVAL: Duration = Duration::from_secs(30);
+
+/// How often a draining server checks whether its flows have finished
+const DRAIN_POLL_INTERVAL: Duration = Duration::from_secs(1);
+
+/// How often peers' tunnel state is sampled for session history
+const SESSION_CHECK_INTERVAL: Duration = Duration::from_secs(10);
+
 #[derive(Parser, Debug, Clone)]
 #[command(name = "wirecagesrv")]
 #[command(about = "WireGuard VPN Server with userspace NAT and HTTPS API")]
 #[command(group(
     ArgGroup::new("private_key_source")
         .required(true)
-        .args(["private_key", "private_key_file"])
+        .multiple(true)
+        .args(["private_key", "private_key_file", "wg_config"])
 ))]
 struct Args {
     /// Server private key (base64-encoded 32-byte key)
@@ -39,17 +137,193 @@ struct Args {
     private_key: Option<String>,
 
     /// Path to server private key file (base64-encoded 32-byte key)
-    #[arg(long, env = "WG_PRIVATE_KEY_FILE")]
+    #[arg(long, env = "WG_PRIVATE_KEY_FILE", conflicts_with = "private_key")]
     private_key_file: Option<String>,
 
-    /// WireGuard listen address and port
-    #[arg(long, default_value = "0.0.0.0:51820")]
-    wg_listen: String,
+    /// Existing WireGuard or wg-quick server config to take the private key,
+    /// listen port, address and peers from
+    #[arg(long)]
+    wg_config: Option<String>,
+
+    /// WireGuard listen ports, or addresses and ports; peers are answered
+    /// from the one they send to (repeatable)
+    #[arg(long, default_value = "51820", value_delimiter = ',')]
+    wg_listen: Vec<String>,
+
+    /// Address bare `--wg-listen` ports bind to: 0.0.0.0 for IPv4 only, ::
+    /// for IPv6 and IPv4, or one interface's address
+    #[arg(long, default_value = "0.0.0.0")]
+    listen_addr: std::net::IpAddr,
+
+    /// Bind IPv6 WireGuard addresses for IPv6 only instead of dual-stack
+    #[arg(long)]
+    ipv6_only: bool,
+
+    /// WireGuard sockets to open on each listen address with SO_REUSEPORT,
+    /// each with its own receive loop
+    #[arg(long, default_value = "1")]
+    wg_sockets: usize,
+
+    /// Use UDP GRO and GSO on the WireGuard sockets where the kernel
+    /// supports them; pass `--udp-offload=false` to turn them off
+    #[arg(long, default_value_t = true, action = clap::ArgAction::Set)]
+    udp_offload: bool,
+
+    /// Also accept WireGuard over TCP on the first listen address and port,
+    /// length-prefixed or over WebSocket
+    #[arg(long, conflicts_with = "kernel_interface")]
+    wg_tcp: bool,
+
+    /// Load balancer addresses whose connections to the relay and the
+    /// WireGuard TCP listener open with a PROXY protocol v2 header
+    /// (repeatable)
+    #[arg(long, value_name = "CIDR", value_delimiter = ',')]
+    proxy_protocol_from: Vec<ipnet::IpNet>,
+
+    /// Serve peers from a kernel WireGuard interface with this name, with
+    /// kernel NAT, in place of the userspace device (needs CAP_NET_ADMIN)
+    #[arg(long, value_name = "NAME")]
+    kernel_interface: Option<String>,
+
+    /// Interface kernel NAT sends traffic out of (default: the one the
+    /// default route uses)
+    #[arg(long, value_name = "NAME", requires = "kernel_interface")]
+    kernel_outbound_interface: Option<String>,
+
+    /// Sustained handshake initiations per second allowed per source IP (0 disables the limit)
+    #[arg(long, default_value = "20")]
+    handshake_rate: f64,
+
+    /// Burst of handshake initiations a source IP may send above the sustained rate
+    #[arg(long, default_value = "5")]
+    handshake_burst: u32,
+
+    /// Handshake initiations per second from all sources above which the server is under load (0 never)
+    #[arg(long, default_value = "500")]
+    handshake_load_threshold: u32,
+
+    /// What to do with handshake initiations while under load
+    #[arg(long, value_enum, default_value = "cookie")]
+    handshake_under_load: handshake_limit::UnderLoad,
+
+    /// TOML file of AmneziaWG obfuscation parameters for all or given peers
+    #[arg(long, conflicts_with = "kernel_interface")]
+    obfuscation_file: Option<String>,
 
     /// API listen address and port
     #[arg(long, default_value = "0.0.0.0:8443")]
     api_listen: String,
 
+    /// Listen address for the peer management API (disabled unless set;
+    /// without admin tokens, bind it to loopback or a trusted network)
+    #[arg(long)]
+    admin_listen: Option<String>,
+
+    /// Bearer token with full access to the admin listener (repeatable)
+    #[arg(long, env = "WIRECAGE_ADMIN_TOKEN", value_delimiter = ',')]
+    admin_token: Vec<String>,
+
+    /// Bearer token with read-only access to the admin listener (repeatable)
+    #[arg(long, env = "WIRECAGE_ADMIN_READ_TOKEN", value_delimiter = ',')]
+    admin_read_token: Vec<String>,
+
+    /// TLS certificate file for the admin listener
+    #[arg(long, requires = "admin_tls_key")]
+    admin_tls_cert: Option<String>,
+
+    /// TLS private key file for the admin listener
+    #[arg(long, requires = "admin_tls_cert")]
+    admin_tls_key: Option<String>,
+
+    /// CA whose client certificates the admin listener requires (mTLS)
+    #[arg(long, requires = "admin_tls_cert")]
+    admin_client_ca: Option<String>,
+
+    /// Unix socket for the peer management API, used by `wirecagesrv peer`
+    #[arg(long)]
+    admin_socket: Option<String>,
+
+    /// Listen address for Prometheus metrics at /metrics (disabled unless set)
+    #[arg(long)]
+    metrics_listen: Option<String>,
+
+    /// UDP address to answer STUN binding requests on, e.g. 0.0.0.0:3478,
+    /// so clients can learn their public address (disabled unless set)
+    #[arg(long)]
+    stun_listen: Option<String>,
+
+    /// TCP address to relay WireGuard over WebSocket on, e.g. 0.0.0.0:443,
+    /// for clients whose networks block UDP; TLS with --tls-cert (disabled
+    /// unless set)
+    #[arg(long, conflicts_with = "kernel_interface")]
+    relay_listen: Option<String>,
+
+    /// Relay URL handed to clients, when it isn't the relay port on the
+    /// --wg-endpoint host, e.g. behind a reverse proxy
+    #[arg(long, requires = "relay_listen")]
+    relay_url: Option<String>,
+
+    /// File holding the log filter, in `RUST_LOG` syntax, re-read on reload
+    #[arg(long)]
+    log_filter_file: Option<String>,
+
+    /// Seconds open TCP flows are given to finish on SIGTERM before the
+    /// server exits
+    #[arg(long, default_value = "30")]
+    drain_secs: u64,
+
+    /// Unix socket on which a newly started server takes over this one's
+    /// sockets and peers, for upgrades without dropping tunnels
+    #[arg(long)]
+    upgrade_socket: Option<String>,
+
+    /// Also run a tenant, an independent server configured by the flags in
+    /// FILE, whose APIs are served under `/tenants/NAME` (repeatable)
+    #[arg(long, value_name = "NAME=FILE", conflicts_with = "upgrade_socket")]
+    tenant: Vec<String>,
+
+    /// OTLP/HTTP collector to push metrics and flow traces to, e.g.
+    /// `http://otel-collector:4318`
+    #[arg(long, env = "OTEL_EXPORTER_OTLP_ENDPOINT")]
+    otlp_endpoint: Option<String>,
+
+    /// Header sent with OTLP exports as `name=value` (repeatable)
+    #[arg(long, env = "OTEL_EXPORTER_OTLP_HEADERS", value_delimiter = ',')]
+    otlp_header: Vec<String>,
+
+    /// Service name reported to the OTLP collector
+    #[arg(long, env = "OTEL_SERVICE_NAME", default_value = "wirecagesrv")]
+    otlp_service_name: String,
+
+    /// How often metrics are pushed to the OTLP collector, in seconds
+    #[arg(long, default_value = "60")]
+    otlp_interval_secs: u64,
+
+    /// File to append a JSON line to for every finished or refused flow
+    #[arg(long)]
+    flow_log: Option<String>,
+
+    /// IPFIX collector (host:port) to export flow records to over UDP
+    #[arg(long)]
+    ipfix_collector: Option<String>,
+
+    /// Capture decrypted tunnel traffic to this pcap file from startup
+    #[arg(long)]
+    pcap: Option<String>,
+
+    /// Which packets `--pcap` keeps, as comma-separated `peer=<key>`,
+    /// `host=<ip>`, `port=<port>` and `protocol=tcp|udp` terms
+    #[arg(long, requires = "pcap")]
+    pcap_filter: Option<String>,
+
+    /// Size in MiB at which the `--pcap` file is rotated
+    #[arg(long, default_value = "100")]
+    pcap_rotate_mb: u64,
+
+    /// Rotated `--pcap` files to keep
+    #[arg(long, default_value = "5")]
+    pcap_keep: usize,
+
     /// Server IP address within the VPN subnet
     #[arg(long, default_value = "10.200.100.1")]
     server_ip: String,
@@ -58,6 +332,275 @@ struct Args {
     #[arg(long, default_value = "24")]
     subnet_mask: u8,
 
+    /// Network to give peers addresses in, as the server's address in it
+    /// and the prefix length, with `TAG=` first to keep it for peers with
+    /// that tag; repeat for several, the first being the main one. Replaces
+    /// `--server-ip` and `--subnet-mask`
+    #[arg(
+        long = "network",
+        value_name = "[TAG=]CIDR",
+        conflicts_with_all = ["server_ip", "subnet_mask"]
+    )]
+    networks: Vec<String>,
+
+    /// TOML file restricting the destinations, ports, protocols and TLS
+    /// server names given peers may reach
+    #[arg(long, conflicts_with = "kernel_interface")]
+    egress_acl_file: Option<String>,
+
+    /// Domain list file or http(s) URL, in hosts or domain-list format,
+    /// whose domains TCP flows may not name in their TLS SNI or HTTP Host
+    /// (repeatable)
+    #[arg(long, value_name = "SOURCE", conflicts_with = "kernel_interface")]
+    egress_domain_blocklist: Vec<String>,
+
+    /// Domain list whose domains are the only ones TCP flows may name
+    /// (repeatable)
+    #[arg(long, value_name = "SOURCE", conflicts_with = "kernel_interface")]
+    egress_domain_allowlist: Vec<String>,
+
+    /// TCP ports whose flows the egress domain lists apply to
+    #[arg(
+        long,
+        value_name = "PORT",
+        value_delimiter = ',',
+        default_value = "80,443"
+    )]
+    egress_domain_ports: Vec<u16>,
+
+    /// Local address outbound flows are sent from, on hosts with several
+    #[arg(long, value_name = "IP")]
+    egress_ip: Option<Ipv4Addr>,
+
+    /// Network device outbound flows are sent out of (needs CAP_NET_RAW)
+    #[arg(long, value_name = "NAME")]
+    egress_interface: Option<String>,
+
+    /// TOML routing table sending destination ranges out of other
+    /// interfaces or addresses, or dropping them
+    #[arg(long, value_name = "FILE")]
+    egress_routes: Option<String>,
+
+    /// Upstream proxy to dial outbound TCP flows through, as
+    /// `socks5://[user:password@]host:port` or `http://...`; UDP flows are
+    /// dropped unless a route sends them direct
+    #[arg(long, value_name = "URL")]
+    egress_proxy: Option<String>,
+
+    /// Connections to keep open to each upstream proxy ahead of need, so
+    /// new flows skip dialing the proxy
+    #[arg(long, default_value = "0")]
+    egress_proxy_idle_connections: usize,
+
+    /// Seconds an idle upstream proxy connection is kept before closing it
+    #[arg(long, default_value = "30")]
+    egress_proxy_idle_timeout_secs: u64,
+
+    /// wg-quick client config of an upstream WireGuard server to send
+    /// outbound flows through, as a peer of that server
+    #[arg(long, value_name = "FILE", conflicts_with = "egress_proxy")]
+    egress_wg_config: Option<String>,
+
+    /// Seconds to wait for each attempt to connect to a peer's TCP
+    /// destination
+    #[arg(long, default_value = "10")]
+    egress_connect_timeout_secs: u64,
+
+    /// Extra attempts, with backoff, to connect to a peer's TCP destination
+    /// after one fails or times out
+    #[arg(long, default_value = "0")]
+    egress_connect_retries: u32,
+
+    /// Source ports outbound flows are sent from, as `first-last` (default:
+    /// the kernel's choice)
+    #[arg(long, value_name = "RANGE")]
+    nat_port_range: Option<String>,
+
+    /// How source ports are taken from --nat-port-range
+    #[arg(long, value_enum, requires = "nat_port_range")]
+    nat_port_strategy: Option<nat_ports::PortStrategy>,
+
+    /// Whether a peer endpoint's UDP flows each get a source port or share
+    /// one whatever their destination
+    #[arg(long, value_enum, default_value = "per-flow")]
+    nat_udp_mapping: nat_ports::UdpMapping,
+
+    /// TOML file of public ports to forward to peers, reloadable
+    #[arg(long, value_name = "FILE", conflicts_with = "kernel_interface")]
+    port_forward_file: Option<String>,
+
+    /// Public ports peers may forward to themselves over NAT-PMP, as
+    /// `first-last` (default: port mapping is off)
+    #[arg(long, value_name = "RANGE", conflicts_with = "kernel_interface")]
+    port_mapping_ports: Option<String>,
+
+    /// Most port mappings a peer may hold at once
+    #[arg(long, default_value = "4", requires = "port_mapping_ports")]
+    port_mapping_max_per_peer: usize,
+
+    /// Longest a port mapping lasts before it must be renewed
+    #[arg(long, default_value = "7200", requires = "port_mapping_ports")]
+    port_mapping_max_lifetime_secs: u32,
+
+    /// Ordered firewall rules applied to all forwarded traffic, reloadable
+    /// through the admin API
+    #[arg(long, conflicts_with = "kernel_interface")]
+    firewall_rules: Option<String>,
+
+    /// Reject peers' SMTP and cloud metadata traffic unless a firewall rule
+    /// accepts it first; pass `--egress-safeguards=false` to allow both
+    #[arg(long, default_value_t = true, action = clap::ArgAction::Set)]
+    egress_safeguards: bool,
+
+    /// Drop traffic between peers; pass `--client-isolation=false` to let
+    /// peers reach each other's VPN addresses
+    #[arg(long, default_value_t = true, action = clap::ArgAction::Set)]
+    client_isolation: bool,
+
+    /// Copy peers' multicast and broadcast packets to the other peers in
+    /// their network, for discovery protocols; needs
+    /// `--client-isolation=false`
+    #[arg(long, conflicts_with = "kernel_interface")]
+    peer_multicast: bool,
+
+    /// Answer NTP requests on the server IP from the host's clock, so peers
+    /// without other egress can keep theirs in sync
+    #[arg(long)]
+    ntp: bool,
+
+    /// Port to answer bandwidth tests on at the server IP, over HTTP on TCP
+    /// and by echoing UDP
+    #[arg(long, value_name = "PORT")]
+    speedtest_port: Option<u16>,
+
+    /// Serve each peer a page describing its address, policy, DNS and
+    /// usage over HTTP on port 80 of the server IP
+    #[arg(long, conflicts_with = "kernel_interface")]
+    status_page: bool,
+
+    /// Send peers' pings to the internet on from the host; pass
+    /// `--icmp-echo-forwarding=false` to only answer pings to the server IP
+    #[arg(long, default_value_t = true, action = clap::ArgAction::Set)]
+    icmp_echo_forwarding: bool,
+
+    /// Give peers IPv6 addresses in this prefix, at most /96, beside their
+    /// IPv4 ones, and forward their IPv6 flows
+    #[arg(long, value_name = "PREFIX", conflicts_with = "kernel_interface")]
+    ipv6_prefix: Option<ipnet::Ipv6Net>,
+
+    /// Whether peers' IPv6 flows leave from the host's address or their own
+    #[arg(long, value_enum, default_value = "nat")]
+    ipv6_egress: ipv6::Ipv6Egress,
+
+    /// Give peers only their IPv6 address, answering DNS64 and translating
+    /// flows to 64:ff9b::/96 to IPv4 (NAT64)
+    #[arg(long, requires = "ipv6_prefix")]
+    ipv6_only_peers: bool,
+
+    /// TOML file of days and hours when given peers or tags may open flows
+    #[arg(long, conflicts_with = "kernel_interface")]
+    access_schedule_file: Option<String>,
+
+    /// Most each peer may send through the server, e.g. `10mbit`
+    #[arg(long, value_name = "RATE", conflicts_with = "kernel_interface")]
+    peer_upload_limit: Option<String>,
+
+    /// Most each peer may receive through the server, e.g. `50mbit`
+    #[arg(long, value_name = "RATE", conflicts_with = "kernel_interface")]
+    peer_download_limit: Option<String>,
+
+    /// TOML file of bandwidth limits for given peers or tags
+    #[arg(long, conflicts_with = "kernel_interface")]
+    bandwidth_limit_file: Option<String>,
+
+    /// TOML file of QoS classes sorting NAT flows by peer, port or domain
+    #[arg(long, conflicts_with = "kernel_interface")]
+    qos_file: Option<String>,
+
+    /// Rate of the uplink QoS classes share by weight, e.g. `90mbit`
+    #[arg(long, value_name = "RATE", conflicts_with = "kernel_interface")]
+    qos_uplink: Option<String>,
+
+    /// Rate of the downlink QoS classes share by weight, e.g. `450mbit`
+    #[arg(long, value_name = "RATE", conflicts_with = "kernel_interface")]
+    qos_downlink: Option<String>,
+
+    /// Most NAT flows each peer may have open at once (0 disables the limit)
+    #[arg(long, default_value = "1000")]
+    peer_max_flows: usize,
+
+    /// Sustained new NAT flows per second allowed per peer (0 disables the limit)
+    #[arg(long, default_value = "50")]
+    peer_flow_rate: f64,
+
+    /// Burst of new flows a peer may open above the sustained rate
+    #[arg(long, default_value = "200")]
+    peer_flow_burst: u32,
+
+    /// Seconds an established TCP flow may sit idle before it is closed
+    #[arg(long, default_value = "300")]
+    tcp_idle_timeout_secs: u64,
+
+    /// Seconds a TCP flow that one side has closed may sit idle before it is closed
+    #[arg(long, default_value = "60")]
+    tcp_half_closed_timeout_secs: u64,
+
+    /// Seconds a UDP flow may sit idle before it is closed
+    #[arg(long, default_value = "60")]
+    udp_idle_timeout_secs: u64,
+
+    /// Largest MSS peers' TCP connections may use (default: what the tunnel
+    /// MTU allows; 0 leaves the MSS alone)
+    #[arg(long, value_name = "BYTES")]
+    tcp_mss_clamp: Option<u16>,
+
+    /// NAT dataplane workers, each handling the flows of its share of the
+    /// peers (0 runs one per CPU)
+    #[arg(long, default_value = "1")]
+    dataplane_workers: usize,
+
+    /// JSON file where registered peers are saved and restored from on startup
+    #[arg(long)]
+    state_file: Option<String>,
+
+    /// Admin API URL of another server sharing this one's peers, such as
+    /// https://vpn2.example.com:9443 (repeatable)
+    #[arg(long, value_name = "URL")]
+    cluster_node: Vec<String>,
+
+    /// Admin token the other cluster nodes accept
+    #[arg(long, env = "WIRECAGE_CLUSTER_TOKEN")]
+    cluster_token: Option<String>,
+
+    /// This server's name in the cluster (default: the hostname)
+    #[arg(long)]
+    cluster_name: Option<String>,
+
+    /// Seconds between pulls of peers from the other cluster nodes
+    #[arg(long, default_value = "5", value_parser = clap::value_parser!(u64).range(1..))]
+    cluster_interval_secs: u64,
+
+    /// Append-only JSON-lines file recording administrative actions
+    #[arg(long)]
+    audit_log: Option<String>,
+
+    /// JSON-lines file recording peer sessions, read back on startup
+    #[arg(long)]
+    session_log: Option<String>,
+
+    /// Days of peer session history to keep
+    #[arg(long, default_value = "30")]
+    session_retention_days: u64,
+
+    /// JSON file where per-peer traffic usage is saved and restored from on
+    /// startup
+    #[arg(long)]
+    usage_file: Option<String>,
+
+    /// Days of per-peer traffic usage to keep
+    #[arg(long, default_value = "90")]
+    usage_retention_days: u64,
+
     /// Authentication token for the API (required)
     #[arg(long, env = "AUTH_TOKEN")]
     auth_token: String,
@@ -73,12 +616,175 @@ struct Args {
     /// TLS private key file for HTTPS API (optional)
     #[arg(long)]
     tls_key: Option<String>,
+
+    /// Upstream resolvers for the DNS service on the server IP
+    /// (host:port, https:// for DoH, or tls:// for DoT; repeatable)
+    #[arg(long, value_delimiter = ',', default_value = "1.1.1.1:53")]
+    dns_upstream: Vec<String>,
+
+    /// Per-attempt timeout for upstream DNS queries, in milliseconds
+    #[arg(long, default_value = "2000")]
+    dns_timeout_ms: u64,
+
+    /// Additional upstream attempts after a failed DNS query
+    #[arg(long, default_value = "2")]
+    dns_retries: u32,
+
+    /// DNS blocklist file or http(s) URL in hosts or domain-list format (repeatable)
+    #[arg(long)]
+    dns_blocklist: Vec<String>,
+
+    /// How to answer queries for blocked names
+    #[arg(long, value_enum, default_value = "nxdomain")]
+    dns_block_mode: dns_blocklist::BlockMode,
+
+    /// How often to reload DNS blocklists, in seconds
+    #[arg(long, default_value = "86400")]
+    dns_blocklist_refresh_secs: u64,
+
+    /// TOML file assigning per-peer DNS upstreams, blocklists, or disabling DNS
+    #[arg(long)]
+    dns_policy_file: Option<String>,
+
+    /// Maximum number of cached DNS answers (0 disables the cache)
+    #[arg(long, default_value = "10000")]
+    dns_cache_size: usize,
+
+    /// Sustained DNS queries per second allowed per peer (0 disables the limit)
+    #[arg(long, default_value = "100")]
+    dns_rate_limit: f64,
+
+    /// Burst of DNS queries a peer may send above the sustained rate
+    #[arg(long, default_value = "200")]
+    dns_rate_burst: u32,
+
+    /// Domain under which named peers are served by the DNS service
+    #[arg(long, default_value = "cage.internal")]
+    dns_domain: String,
+
+    /// How to answer DNS queries over the per-peer rate limit
+    #[arg(long, value_enum, default_value = "refused")]
+    dns_rate_limit_response: dns_ratelimit::LimitResponse,
+
+    /// Port to serve an explicit HTTP proxy on at the server IP, for peers
+    /// set up with one
+    #[arg(long, value_name = "PORT", conflicts_with = "kernel_interface")]
+    http_proxy_port: Option<u16>,
+
+    /// `user:password` the HTTP proxy accepts as Basic credentials
+    /// (repeatable)
+    #[arg(
+        long,
+        env = "WIRECAGE_HTTP_PROXY_USER",
+        value_delimiter = ',',
+        requires = "http_proxy_port"
+    )]
+    http_proxy_user: Vec<String>,
+
+    /// Bearer token the HTTP proxy accepts (repeatable)
+    #[arg(
+        long,
+        env = "WIRECAGE_HTTP_PROXY_TOKEN",
+        value_delimiter = ',',
+        requires = "http_proxy_port"
+    )]
+    http_proxy_token: Vec<String>,
+
+    /// File to record HTTP proxy requests in as JSON lines, or `-` for
+    /// stdout
+    #[arg(long, value_name = "FILE", requires = "http_proxy_port")]
+    http_proxy_access_log: Option<String>,
+
+    /// Connections to each origin the HTTP proxy keeps open between a
+    /// peer's requests there
+    #[arg(long, default_value = "4", requires = "http_proxy_port")]
+    http_proxy_idle_connections: usize,
+
+    /// Seconds the HTTP proxy keeps an idle connection to an origin open
+    #[arg(long, default_value = "30", requires = "http_proxy_port")]
+    http_proxy_idle_timeout_secs: u64,
+
+    /// Port to serve SOCKS5 on at the server IP, over TCP and for UDP
+    /// associations over UDP
+    #[arg(long, value_name = "PORT", conflicts_with = "kernel_interface")]
+    socks_port: Option<u16>,
+
+    /// `user:password` the SOCKS5 service requires one of (repeatable)
+    #[arg(
+        long,
+        env = "WIRECAGE_SOCKS_USER",
+        value_delimiter = ',',
+        requires = "socks_port"
+    )]
+    socks_user: Vec<String>,
+
+    /// OIDC issuer whose ID tokens may be used to register
+    #[arg(long, requires = "oidc_audience")]
+    oidc_issuer: Option<String>,
+
+    /// Audience (client ID) ID tokens must be issued for
+    #[arg(long)]
+    oidc_audience: Option<String>,
+
+    /// ID token claim used as the peer name
+    #[arg(long, default_value = "preferred_username")]
+    oidc_name_claim: String,
+
+    /// ID token claim listing groups, which become peer tags
+    #[arg(long, default_value = "groups")]
+    oidc_groups_claim: String,
+
+    /// Only allow members of these groups to enroll (repeatable)
+    #[arg(long, value_delimiter = ',')]
+    oidc_allowed_group: Vec<String>,
+
+    /// Remove OIDC-enrolled peers when their ID token expires
+    #[arg(long)]
+    oidc_expire_peers: bool,
+
+    /// authorized_keys-style file of SSH keys that may sign registrations
+    #[arg(long)]
+    ssh_authorized_keys: Option<String>,
+
+    /// URL to POST peer lifecycle events to (repeatable)
+    #[arg(long)]
+    webhook_url: Vec<String>,
+
+    /// Secret for HMAC-SHA256 signatures on webhook bodies
+    #[arg(long, env = "WIRECAGE_WEBHOOK_SECRET")]
+    webhook_secret: Option<String>,
+
+    /// Only send these webhook events: peer_added, peer_removed,
+    /// peer_expired, peer_connected, peer_idle (repeatable; default all)
+    #[arg(long)]
+    webhook_event: Vec<String>,
+
+    /// Seconds without a handshake before a peer_idle webhook (0 to disable)
+    #[arg(long, default_value = "300")]
+    webhook_idle_secs: u64,
+
+    /// Flag peers whose destinations, DNS rate or ports look unusual, as
+    /// `anomaly` events and webhooks
+    #[arg(long)]
+    anomaly_detection: bool,
+
+    /// Fewest distinct destinations in a minute that count as a spike
+    #[arg(long, default_value = "50")]
+    anomaly_min_destinations: usize,
+
+    /// DNS queries per minute, sustained for three minutes, that are flagged
+    #[arg(long, default_value = "600")]
+    anomaly_dns_per_minute: u64,
+
+    /// Hours a peer is watched before flows to ports it never used are flagged
+    #[arg(long, default_value = "24")]
+    anomaly_learning_hours: u64,
 }
 
 #[tokio::main]
 async fn main() -> Result<()> {
     // Initialize logging
-    tracing_subscriber::fmt()
+    let subscriber = tracing_subscriber::fmt()
         .with_env_filter(
             tracing_subscriber::EnvFilter::try_from_default_env().unwrap_or_else(|_| {
                 tracing_subscriber::EnvFilter::new("info")
@@ -86,22 +792,164 @@ async fn main() -> Result<()> {
             })
             .add_directive("netlink_packet_route::link::buffer_tool=error".parse().unwrap()),
         )
-        .init();
+        .with_filter_reloading();
+    let log_filter_handle = subscriber.reload_handle();
+    subscriber.init();
+
+    match std::env::args().nth(1).as_deref() {
+        Some("peer") => return ctl::run(ctl::PeerCli::parse_from(std::env::args().skip(1))).await,
+        Some("status") => {
+            return ctl::run_status(ctl::StatusCli::parse_from(std::env::args().skip(1))).await
+        }
+        Some("dumpconf") => {
+            return ctl::run_dumpconf(ctl::DumpconfCli::parse_from(std::env::args().skip(1)))
+                .await
+        }
+        Some("rotate-key") => {
+            return ctl::run_rotate_key(ctl::RotateKeyCli::parse_from(std::env::args().skip(1)))
+                .await
+        }
+        _ => {}
+    }
+
+    let matches = Args::command().get_matches();
+    let args = Args::from_arg_matches(&matches).unwrap_or_else(|e| e.exit());
+    let mut activated = systemd::ActivatedSockets::from_env();
+    let mut takeover = args
+        .upgrade_socket
+        .as_deref()
+        .map(upgrade::take_over)
+        .transpose()
+        .context("failed to take over from the running server")?
+        .flatten();
+    if let Some(takeover) = &mut takeover {
+        info!(
+            "Taking over {} socket(s) from the running server",
+            takeover.sockets.len()
+        );
+        activated.extend(takeover.sockets.drain(..));
+    }
+    let log_filter = args
+        .log_filter_file
+        .clone()
+        .map(|path| reload::LogFilter::load(path, log_filter_handle))
+        .transpose()
+        .context("failed to load log filter")?;
 
-    let args = Args::parse();
+    let mut tenants: Vec<tenant::Tenant> = Vec::new();
+    for spec in &args.tenant {
+        let name = tenant::name(spec)?;
+        if tenants.iter().any(|tenant| tenant.name == name) {
+            anyhow::bail!("tenant {} is given twice", name);
+        }
+        tenants.push(start_tenant(spec).await?);
+    }
 
-    let private_key_b64 = load_private_key_b64(&args).await?;
+    run_server(
+        args, matches, activated, takeover, log_filter, tenants, None,
+    )
+    .await
+}
 
-    let private_key_bytes = base64::engine::general_purpose::STANDARD
-        .decode(private_key_b64.trim())
-        .context("invalid private key encoding")?;
+/// Start the server for `--tenant NAME=FILE`, returning once its APIs are
+/// ready to be served
+async fn start_tenant(spec: &str) -> Result<tenant::Tenant> {
+    let name = tenant::name(spec)?.to_string();
+    let flags = tenant::load_flags(spec)?;
+    let matches = Args::command()
+        .try_get_matches_from(std::iter::once("wirecagesrv".to_string()).chain(flags))
+        .with_context(|| format!("invalid flags for tenant {}", name))?;
+    let args = Args::from_arg_matches(&matches)?;
+    let process_wide = tenant::PROCESS_WIDE
+        .iter()
+        .find(|id| matches.value_source(id) == Some(ValueSource::CommandLine));
+    if let Some(id) = process_wide {
+        anyhow::bail!(
+            "--{} is set for the whole process, not in tenant {}'s file",
+            id.replace('_', "-"),
+            name
+        );
+    }
 
-    if private_key_bytes.len() != 32 {
-        anyhow::bail!("private key must be 32 bytes");
+    info!("Starting tenant {}", name);
+    let (mount_tx, mount_rx) = tokio::sync::oneshot::channel();
+    let span = tracing::info_span!("tenant", name = %name);
+    let task_name = name.clone();
+    let task = tokio::spawn(
+        async move {
+            let activated = systemd::ActivatedSockets::default();
+            if let Err(e) = run_server(
+                args,
+                matches,
+                activated,
+                None,
+                None,
+                Vec::new(),
+                Some(mount_tx),
+            )
+            .await
+            {
+                error!("Tenant {} failed: {:#}", task_name, e);
+            }
+        }
+        .instrument(span),
+    );
+    match mount_rx.await {
+        Ok(routers) => Ok(tenant::Tenant {
+            name,
+            routers,
+            task,
+        }),
+        // The tenant's server has logged why it stopped
+        Err(_) => anyhow::bail!("tenant {} failed to start", name),
     }
+}
+
+/// Run one server: the process's own, or a tenant's when `mount` takes
+/// its APIs for the process's listeners
+async fn run_server(
+    args: Args,
+    matches: ArgMatches,
+    mut activated: systemd::ActivatedSockets,
+    mut takeover: Option<upgrade::Takeover>,
+    log_filter: Option<reload::LogFilter>,
+    tenants: Vec<tenant::Tenant>,
+    mount: Option<tokio::sync::oneshot::Sender<tenant::Routers>>,
+) -> Result<()> {
+    // Settings from --wg-config apply unless given explicitly
+    let explicit = |id: &str| {
+        matches
+            .value_source(id)
+            .is_some_and(|source| source != ValueSource::DefaultValue)
+    };
+
+    let wg_import = args
+        .wg_config
+        .as_deref()
+        .map(wgimport::WgConfigImport::load)
+        .transpose()
+        .context("failed to load WireGuard config")?;
+    let imported = wg_import.as_ref().map(|(_, conf)| conf);
+
+    let key_given = args.private_key.is_some() || args.private_key_file.is_some();
+    let server_private_key = match imported.and_then(|conf| conf.private_key) {
+        Some(private_key) if !key_given => private_key,
+        _ => {
+            let private_key_b64 = load_private_key_b64(&args).await?;
 
-    let mut server_private_key = [0u8; 32];
-    server_private_key.copy_from_slice(&private_key_bytes);
+            let private_key_bytes = base64::engine::general_purpose::STANDARD
+                .decode(private_key_b64.trim())
+                .context("invalid private key encoding")?;
+
+            if private_key_bytes.len() != 32 {
+                anyhow::bail!("private key must be 32 bytes");
+            }
+
+            let mut server_private_key = [0u8; 32];
+            server_private_key.copy_from_slice(&private_key_bytes);
+            server_private_key
+        }
+    };
 
     // Derive public key
     let secret = StaticSecret::from(server_private_key);
@@ -114,60 +962,997 @@ async fn main() -> Result<()> {
     );
 
     // Parse server IP
-    let server_ip: Ipv4Addr = args.server_ip.parse().context("invalid server IP")?;
+    let networks = if args.networks.is_empty() {
+        let (server_ip, subnet_mask) = match imported.and_then(|conf| conf.address) {
+            Some(address) if !explicit("server_ip") => address,
+            _ => (
+                args.server_ip.parse().context("invalid server IP")?,
+                args.subnet_mask,
+            ),
+        };
+        vec![network::Network::new(server_ip, subnet_mask, None)?]
+    } else {
+        args.networks
+            .iter()
+            .map(|spec| network::Network::parse(spec))
+            .collect::<Result<Vec<_>>>()?
+    };
+    let networks = network::Networks::new(networks)?;
+    let server_ip = networks.main().server_ip;
+    let subnet_mask = networks.main().prefix_len;
+    let wg_listen = match imported.and_then(|conf| conf.listen_port) {
+        Some(port) if !explicit("wg_listen") => vec![port.to_string()],
+        _ => args.wg_listen.clone(),
+    };
+    let wg_listen = wg_socket::resolve(&wg_listen, args.listen_addr)?;
+
+    let ipv6_prefix = args.ipv6_prefix.map(ipv6::Ipv6Prefix::new).transpose()?;
+    if let Some(prefix) = args.ipv6_prefix.filter(|_| args.ipv6_only_peers) {
+        if prefix.contains(&nat64::address_for(Ipv4Addr::UNSPECIFIED)) {
+            anyhow::bail!(
+                "--ipv6-prefix {} overlaps the NAT64 prefix 64:ff9b::/96",
+                prefix
+            );
+        }
+    }
 
     // Create shared state
     let config = ServerConfig {
-        server_public_key,
         subnet: server_ip,
-        subnet_mask: args.subnet_mask,
+        subnet_mask,
+        networks: networks.clone(),
         auth_token: args.auth_token.clone(),
+        ipv6_prefix,
+        ipv6_only: args.ipv6_only_peers,
+    };
+
+    let store = args.state_file.as_deref().map(store::PeerStore::new);
+    let audit = match &args.audit_log {
+        Some(path) => audit::AuditLog::open(path)?,
+        None => audit::AuditLog::in_memory(),
     };
+    let session_retention = Duration::from_secs(args.session_retention_days * 86400);
+    let sessions = match &args.session_log {
+        Some(path) => sessions::SessionHistory::open(path, session_retention)
+            .context("failed to load session history")?,
+        None => sessions::SessionHistory::in_memory(session_retention),
+    };
+    let ledger = if args.cluster_node.is_empty() {
+        None
+    } else {
+        let name = match &args.cluster_name {
+            Some(name) => name.clone(),
+            None => cluster::hostname()?,
+        };
+        Some(cluster::Ledger::new(name))
+    };
+    let shared_state = SharedState::new(config, server_public_key, store, audit, sessions, ledger);
+    match takeover.as_mut() {
+        Some(takeover) => {
+            let restored = shared_state.restore(
+                std::mem::take(&mut takeover.peers),
+                std::mem::take(&mut takeover.bans),
+            );
+            info!("Took over {} peers from the running server", restored);
+            shared_state
+                .enrollment
+                .write()
+                .merge(std::mem::take(&mut takeover.enrollment_tokens));
+        }
+        None => {
+            let restored = shared_state
+                .restore_peers()
+                .context("failed to restore peers")?;
+            if let Some(state_file) = &args.state_file {
+                info!("Restored {} peers from {}", restored, state_file);
+            }
+        }
+    }
+    let wg_import = wg_import.map(|(import, conf)| {
+        let result = import.apply(&shared_state, &conf);
+        info!(
+            "Imported {} peers from {} ({} skipped)",
+            result.applied,
+            args.wg_config.as_deref().unwrap_or_default(),
+            result.skipped
+        );
+        Arc::new(import)
+    });
 
-    let shared_state = SharedState::new(config);
+    if !args.webhook_url.is_empty() {
+        webhooks::spawn(
+            shared_state.events.subscribe(),
+            webhooks::WebhookSettings {
+                urls: args.webhook_url.clone(),
+                secret: args.webhook_secret.clone(),
+                events: args.webhook_event.clone(),
+                idle_after: (args.webhook_idle_secs > 0)
+                    .then(|| Duration::from_secs(args.webhook_idle_secs)),
+            },
+        )
+        .context("failed to start webhooks")?;
+        info!("Sending webhooks to {} URLs", args.webhook_url.len());
+    }
 
-    // Create WireGuard IO
-    let wg_io = Arc::new(
-        WgIo::new(&args.wg_listen, server_private_key, Arc::clone(&shared_state))
+    let dns_settings = dns_policy::ResolverSettings {
+        upstreams: args.dns_upstream.clone(),
+        query_policy: dns_upstream::QueryPolicy {
+            timeout: std::time::Duration::from_millis(args.dns_timeout_ms),
+            retries: args.dns_retries,
+        },
+        cache_size: args.dns_cache_size,
+        blocklists: args.dns_blocklist.clone(),
+        block_mode: args.dns_block_mode,
+        blocklist_refresh: std::time::Duration::from_secs(args.dns_blocklist_refresh_secs.max(1)),
+    };
+    info!("Forwarding DNS queries to {}", args.dns_upstream.join(", "));
+    let dns_rate_limiter = dns_ratelimit::RateLimiter::new(
+        (args.dns_rate_limit > 0.0).then_some(dns_ratelimit::Limit {
+            rate: args.dns_rate_limit,
+            burst: args.dns_rate_burst,
+        }),
+        args.dns_rate_limit_response,
+    );
+    let dns_zone = dns_local::LocalZone::new(&args.dns_domain, Arc::clone(&shared_state));
+    let dns_service = dns_policy::build_service(
+        &dns_settings,
+        args.dns_policy_file.as_deref(),
+        Arc::clone(&shared_state),
+        dns_zone,
+        dns_rate_limiter,
+    )
+    .await
+    .context("failed to configure DNS service")?;
+
+    let dns_policies = args.dns_policy_file.clone().map(|path| {
+        dns_policy::PolicyReloader::new(dns_settings.clone(), path, Arc::clone(&dns_service))
+    });
+
+    let egress_acls = match &args.egress_acl_file {
+        Some(path) => acl::EgressAcls::load(path, Arc::clone(&shared_state))
+            .context("failed to load egress ACLs")?,
+        None => acl::EgressAcls::default(),
+    };
+    let egress_acls = Arc::new(egress_acls);
+    let domain_filter =
+        if args.egress_domain_blocklist.is_empty() && args.egress_domain_allowlist.is_empty() {
+            None
+        } else {
+            let filter = domain_filter::DomainFilter::load(
+                args.egress_domain_blocklist.clone(),
+                args.egress_domain_allowlist.clone(),
+                args.egress_domain_ports.clone(),
+            )
             .await
-            .context("failed to create WireGuard IO")?,
+            .context("failed to load egress domain lists")?;
+            Some(Arc::new(filter))
+        };
+    let nat_port_range = args
+        .nat_port_range
+        .as_deref()
+        .map(nat_ports::parse_range)
+        .transpose()
+        .context("invalid --nat-port-range")?;
+    if let Some(range) = &nat_port_range {
+        info!(
+            "Sending outbound flows from ports {}-{}",
+            range.start(),
+            range.end()
+        );
+    }
+    let nat_ports = Arc::new(nat_ports::NatPorts::new(
+        nat_port_range,
+        args.nat_port_strategy.unwrap_or_default(),
+        args.nat_udp_mapping,
+    ));
+    if args.egress_connect_timeout_secs == 0 {
+        anyhow::bail!("--egress-connect-timeout-secs must be at least one second");
+    }
+    let egress_path = egress::Path::new(args.egress_ip, args.egress_interface.clone(), nat_ports);
+    let proxy_idle = upstream_proxy::IdleLimits {
+        connections: args.egress_proxy_idle_connections,
+        timeout: Duration::from_secs(args.egress_proxy_idle_timeout_secs),
+    };
+    let egress_proxy = args
+        .egress_proxy
+        .as_deref()
+        .map(|url| upstream_proxy::UpstreamProxy::parse(url, proxy_idle))
+        .transpose()
+        .context("invalid --egress-proxy")?;
+    if let Some(proxy) = &egress_proxy {
+        info!("Dialing outbound TCP flows through {}", proxy);
+    }
+    let cascade = match &args.egress_wg_config {
+        Some(path) => Some(
+            cascade::Cascade::start(path)
+                .await
+                .context("failed to start WireGuard egress")?,
+        ),
+        None => None,
+    };
+    let egress = egress::Egress::load(
+        egress_path,
+        egress_proxy,
+        cascade,
+        dial::DialPolicy {
+            timeout: Duration::from_secs(args.egress_connect_timeout_secs),
+            retries: args.egress_connect_retries,
+        },
+        proxy_idle,
+        args.ipv6_egress,
+        args.egress_routes.as_deref(),
+    )
+    .context("failed to configure egress")?;
+    let egress = Arc::new(egress);
+    if egress.is_configured() {
+        tokio::spawn(Arc::clone(&egress).run_probes());
+    }
+    if let Some(ip) = args.egress_ip {
+        info!("Sending outbound flows from {}", ip);
+    }
+    if let Some(interface) = &args.egress_interface {
+        info!("Sending outbound flows out of {}", interface);
+    }
+    let firewall_rules = args.firewall_rules.clone().map(Into::into);
+    let firewall = Arc::new(
+        firewall::Firewall::load(
+            firewall_rules,
+            args.egress_safeguards,
+            Arc::clone(&shared_state),
+        )
+        .await
+        .context("failed to load firewall rules")?,
+    );
+    let access_schedules = match &args.access_schedule_file {
+        Some(path) => schedule::AccessSchedules::load(path, Arc::clone(&shared_state))
+            .context("failed to load access schedules")?,
+        None => schedule::AccessSchedules::default(),
+    };
+    let parse_limit = |rate: &Option<String>| {
+        rate.as_deref()
+            .map(bandwidth::parse_rate)
+            .transpose()
+            .map(Option::flatten)
+    };
+    let bandwidth_limits = Arc::new(
+        bandwidth::BandwidthLimits::load(
+            bandwidth::Rates {
+                up: parse_limit(&args.peer_upload_limit).context("invalid --peer-upload-limit")?,
+                down: parse_limit(&args.peer_download_limit)
+                    .context("invalid --peer-download-limit")?,
+            },
+            args.bandwidth_limit_file.as_deref(),
+            Arc::clone(&shared_state),
+        )
+        .context("failed to load bandwidth limits")?,
+    );
+    let qos = Arc::new(
+        qos::Qos::load(
+            args.qos_file.as_deref(),
+            parse_limit(&args.qos_uplink).context("invalid --qos-uplink")?,
+            parse_limit(&args.qos_downlink).context("invalid --qos-downlink")?,
+            Arc::clone(&shared_state),
+        )
+        .context("failed to load QoS classes")?,
     );
+    let usage = Arc::new(
+        usage::UsageTracker::load(
+            args.usage_file.clone().map(Into::into),
+            Duration::from_secs(args.usage_retention_days * 86400),
+        )
+        .context("failed to load traffic usage")?,
+    );
+    usage.spawn_flush();
+    let otlp = args
+        .otlp_endpoint
+        .as_ref()
+        .map(|endpoint| {
+            otel::OtlpExporter::new(otel::OtlpSettings {
+                endpoint: endpoint.clone(),
+                headers: args.otlp_header.clone(),
+                service_name: args.otlp_service_name.clone(),
+                interval: Duration::from_secs(args.otlp_interval_secs.max(1)),
+            })
+        })
+        .transpose()
+        .context("failed to configure OTLP export")?;
+    let flow_log = if args.flow_log.is_some() || args.ipfix_collector.is_some() {
+        Some(Arc::new(
+            flowlog::FlowLog::start(flowlog::FlowLogSettings {
+                path: args.flow_log.clone(),
+                ipfix_collector: args.ipfix_collector.clone(),
+            })
+            .await?,
+        ))
+    } else {
+        None
+    };
+    let traffic_stats = dataplane::TrafficStats {
+        usage: Arc::clone(&usage),
+        destinations: Arc::new(destinations::DestinationStats::default()),
+        metrics: Arc::clone(&shared_state.metrics),
+        tracer: otlp.as_ref().map(|otlp| otlp.spawn_tracer()),
+        flow_log,
+        capture: Arc::new(pcap::PacketCapture::default()),
+        anomalies: args.anomaly_detection.then(|| {
+            anomaly::AnomalyDetector::spawn(
+                anomaly::AnomalySettings {
+                    min_destinations: args.anomaly_min_destinations,
+                    dns_per_minute: args.anomaly_dns_per_minute,
+                    learning_period: Duration::from_secs(args.anomaly_learning_hours * 3600),
+                },
+                Arc::clone(&shared_state),
+            )
+        }),
+    };
+    if let Some(path) = &args.pcap {
+        let filter = pcap::CaptureFilter::parse(args.pcap_filter.as_deref().unwrap_or_default())
+            .context("invalid --pcap-filter")?;
+        traffic_stats.capture.spawn_file(
+            path.clone(),
+            filter,
+            args.pcap_rotate_mb.max(1) * 1024 * 1024,
+            args.pcap_keep,
+        )?;
+    }
 
-    // Create channel for WG -> dataplane communication
-    let (wg_to_dataplane_tx, wg_to_dataplane_rx) = mpsc::channel(1000);
+    let oidc = match (&args.oidc_issuer, &args.oidc_audience) {
+        (Some(issuer), Some(audience)) => {
+            let settings = oidc::OidcSettings {
+                issuer: issuer.clone(),
+                audience: audience.clone(),
+                name_claim: args.oidc_name_claim.clone(),
+                groups_claim: args.oidc_groups_claim.clone(),
+                allowed_groups: args.oidc_allowed_group.clone(),
+                expire_peers: args.oidc_expire_peers,
+            };
+            let verifier = oidc::OidcVerifier::discover(settings)
+                .await
+                .context("failed to configure OIDC")?;
+            info!("Accepting ID tokens from {} for enrollment", issuer);
+            Some(Arc::new(verifier))
+        }
+        _ => None,
+    };
+
+    let ssh_authorizer = args
+        .ssh_authorized_keys
+        .as_deref()
+        .map(ssh_auth::SshAuthorizer::new)
+        .transpose()
+        .context("failed to load authorized SSH keys")?;
+
+    // Create WireGuard IO
+    let handshakes = handshake_limit::HandshakeSettings {
+        rate: args.handshake_rate,
+        burst: args.handshake_burst,
+        load_threshold: args.handshake_load_threshold,
+        under_load: args.handshake_under_load,
+    };
+    let obfuscation = Arc::new(
+        obfuscation::Obfuscation::load(args.obfuscation_file.as_deref(), Arc::clone(&shared_state))
+            .context("failed to load obfuscation profiles")?,
+    );
+    if !(1..=wg_socket::MAX_SOCKETS).contains(&args.wg_sockets) {
+        anyhow::bail!(
+            "--wg-sockets must be between 1 and {}",
+            wg_socket::MAX_SOCKETS
+        );
+    }
+    let kernel_device = match &args.kernel_interface {
+        Some(interface) => {
+            if wg_listen.len() > 1 {
+                anyhow::bail!("kernel WireGuard mode takes a single --wg-listen address");
+            }
+            if networks.iter().count() > 1 {
+                anyhow::bail!("kernel WireGuard mode takes a single --network");
+            }
+            let listen_port = wg_listen[0].port();
+            let settings = kernel::KernelSettings {
+                interface: interface.clone(),
+                listen_port,
+                server_ip,
+                subnet_mask,
+                outbound_interface: args.kernel_outbound_interface.clone(),
+                client_isolation: args.client_isolation,
+                egress_safeguards: args.egress_safeguards,
+                mss_clamp: args.tcp_mss_clamp,
+            };
+            let device = kernel::KernelDevice::create(settings, &server_private_key)?;
+            warn!("Kernel WireGuard mode: flow limits and captures do not apply");
+            Some(Arc::new(device))
+        }
+        None => None,
+    };
+    let wg_io = match &kernel_device {
+        Some(device) => WgIo::kernel(
+            Arc::clone(device),
+            server_private_key,
+            Arc::clone(&shared_state),
+            handshakes,
+        ),
+        None => {
+            let mut wg_sockets = Vec::new();
+            while wg_sockets.len() < args.wg_sockets * wg_listen.len() {
+                match activated.take_udp("wireguard")? {
+                    Some(socket) => wg_sockets.push(socket),
+                    None => break,
+                }
+            }
+            let wg_sockets =
+                wg_socket::open_all(&wg_listen, args.ipv6_only, wg_sockets, args.wg_sockets)?;
+            let wg_io = WgIo::from_std(
+                wg_sockets,
+                args.udp_offload,
+                server_private_key,
+                Arc::clone(&shared_state),
+                handshakes,
+                Arc::clone(&obfuscation),
+            );
+            wg_io.context("failed to create WireGuard IO")?
+        }
+    };
+    let wg_io = Arc::new(wg_io);
+
+    // Unnamed listeners from systemd are taken in this order. A tenant's
+    // API is served on the process's listener.
+    let api_listener = mount
+        .is_none()
+        .then(|| activated.tcp_listener("api", &args.api_listen))
+        .transpose()
+        .context("failed to bind API listener")?;
+    let admin_listener = args
+        .admin_listen
+        .as_deref()
+        .map(|addr| activated.tcp_listener("admin", addr))
+        .transpose()
+        .context("failed to bind admin API listener")?;
+    let metrics_listener = args
+        .metrics_listen
+        .as_deref()
+        .map(|addr| activated.tcp_listener("metrics", addr))
+        .transpose()
+        .context("failed to bind metrics listener")?;
+    let stun_socket = args
+        .stun_listen
+        .as_deref()
+        .map(|addr| activated.udp_socket("stun", addr))
+        .transpose()
+        .context("failed to bind STUN socket")?;
+    let relay_listener = args
+        .relay_listen
+        .as_deref()
+        .map(|addr| activated.tcp_listener("relay", addr))
+        .transpose()
+        .context("failed to bind relay listener")?;
+    let wg_tcp_listener = args
+        .wg_tcp
+        .then(|| match activated.take_tcp("wireguard-tcp")? {
+            Some(listener) => Ok(listener),
+            None => wg_socket::bind_tcp(wg_listen[0], args.ipv6_only),
+        })
+        .transpose()
+        .context("failed to bind WireGuard TCP listener")?;
+    activated.warn_unused();
+
+    // Everything a successor takes over on upgrade
+    let mut handoff_sockets: Vec<_> = wg_io
+        .socket_fds()
+        .into_iter()
+        .map(|fd| ("wireguard", fd))
+        .collect();
+    if let Some(listener) = &api_listener {
+        handoff_sockets.push(("api", listener.as_raw_fd()));
+    }
+    if let Some(listener) = &admin_listener {
+        handoff_sockets.push(("admin", listener.as_raw_fd()));
+    }
+    if let Some(listener) = &metrics_listener {
+        handoff_sockets.push(("metrics", listener.as_raw_fd()));
+    }
+    if let Some(socket) = &stun_socket {
+        handoff_sockets.push(("stun", socket.as_raw_fd()));
+    }
+    if let Some(listener) = &relay_listener {
+        handoff_sockets.push(("relay", listener.as_raw_fd()));
+    }
+    if let Some(listener) = &wg_tcp_listener {
+        handoff_sockets.push(("wireguard-tcp", listener.as_raw_fd()));
+    }
+
+    // Create queues for WG -> dataplane communication, one per worker
+    let dataplane_workers = match args.dataplane_workers {
+        0 => std::thread::available_parallelism().map_or(1, |n| n.get()),
+        workers => workers,
+    };
+    let (wg_to_dataplane_tx, wg_to_dataplane_rx) = dataplane::WorkerQueues::new(dataplane_workers);
 
     // Create channel for API -> dataplane port forward events
     let (port_forward_tx, port_forward_rx) = mpsc::channel(100);
+    // Admin API requests for the dataplane's flow table
+    let (flow_table_tx, flow_table_rx) = mpsc::channel(16);
+    for sender in wg_to_dataplane_tx.senders() {
+        shared_state.metrics.watch_queue("wg_to_dataplane", sender);
+    }
+    shared_state
+        .metrics
+        .watch_queue("port_forward_events", &port_forward_tx);
 
-    // Spawn WireGuard receive task
+    // Relay connections feed the dataplane alongside the sockets
+    let relay_to_dataplane = wg_to_dataplane_tx.clone();
+    let proxy_protocol = ProxyProtocol::new(args.proxy_protocol_from.clone());
+    let stream_proxy_protocol = proxy_protocol.clone();
+
+    // Spawn WireGuard receive task, or in kernel mode the task keeping the
+    // interface's peers in step with the registry
     let wg_io_recv = Arc::clone(&wg_io);
-    tokio::spawn(async move {
-        if let Err(e) = wg_io_recv.run_receive(wg_to_dataplane_tx).await {
-            error!("WireGuard receive task failed: {}", e);
+    let wg_receive_task = match &kernel_device {
+        Some(device) => tokio::spawn(kernel::run_sync(
+            Arc::clone(device),
+            Arc::clone(&shared_state),
+        )),
+        None => tokio::spawn(async move {
+            if let Err(e) = wg_io_recv
+                .run_receive(wg_to_dataplane_tx, wg_tcp_listener, stream_proxy_protocol)
+                .await
+            {
+                error!("WireGuard receive task failed: {}", e);
+            }
+        }),
+    };
+
+    let http_proxy = match args.http_proxy_port {
+        Some(port) => {
+            let access_log = args
+                .http_proxy_access_log
+                .as_deref()
+                .map(access_log::AccessLog::start)
+                .transpose()?;
+            let proxy = http_proxy::HttpProxy::new(
+                port,
+                args.http_proxy_user.clone(),
+                args.http_proxy_token.clone(),
+                access_log,
+                http_proxy::KeepAlive {
+                    connections: args.http_proxy_idle_connections,
+                    timeout: Duration::from_secs(args.http_proxy_idle_timeout_secs),
+                },
+            )
+            .context("invalid HTTP proxy settings")?;
+            info!("Serving an HTTP proxy on {}:{}", server_ip, port);
+            Some(Arc::new(proxy))
         }
-    });
+        None => None,
+    };
+
+    let socks = match args.socks_port {
+        Some(port) => {
+            if args.http_proxy_port == Some(port) {
+                anyhow::bail!("--socks-port {} is also the HTTP proxy's port", port);
+            }
+            let socks = socks::SocksServer::new(port, server_ip, args.socks_user.clone())
+                .context("invalid SOCKS5 settings")?;
+            info!("Serving SOCKS5 on {}:{}", server_ip, port);
+            Some(Arc::new(socks))
+        }
+        None => None,
+    };
+
+    if let Some(port) = args.speedtest_port {
+        let taken = [
+            Some(dns::DNS_PORT),
+            args.ntp.then_some(ntp::NTP_PORT),
+            args.port_mapping_ports
+                .as_ref()
+                .map(|_| port_mapping::NAT_PMP_PORT),
+            args.http_proxy_port,
+            args.socks_port,
+        ];
+        if taken.contains(&Some(port)) {
+            anyhow::bail!("--speedtest-port {} is taken by another service", port);
+        }
+        info!("Serving speed tests on {}:{}", server_ip, port);
+    }
+
+    let status_page = if args.status_page {
+        let port = status_page::STATUS_PORT;
+        if [args.http_proxy_port, args.socks_port, args.speedtest_port].contains(&Some(port)) {
+            anyhow::bail!("--status-page needs port {}, which is taken", port);
+        }
+        info!("Serving the status page on {}:{}", server_ip, port);
+        Some(Arc::new(status_page::StatusPage::new(
+            Arc::clone(&shared_state),
+            Arc::clone(&wg_io),
+            Arc::clone(&dns_service),
+            Arc::clone(&traffic_stats.usage),
+        )))
+    } else {
+        None
+    };
+
+    let port_mapping = match args.port_mapping_ports.as_deref() {
+        Some(range) => {
+            let ports = nat_ports::parse_range(range).context("invalid --port-mapping-ports")?;
+            info!(
+                "Letting peers map ports {}-{} over NAT-PMP on {}:{}",
+                ports.start(),
+                ports.end(),
+                server_ip,
+                port_mapping::NAT_PMP_PORT
+            );
+            let mapper = Arc::new(
+                port_mapping::PortMapper::new(
+                    ports,
+                    args.port_mapping_max_per_peer,
+                    args.port_mapping_max_lifetime_secs,
+                    &args.wg_endpoint,
+                    Arc::clone(&shared_state),
+                    port_forward_tx.clone(),
+                )
+                .await,
+            );
+            tokio::spawn(Arc::clone(&mapper).run_expiry());
+            Some(mapper)
+        }
+        None => None,
+    };
 
     // Spawn dataplane task
     let wg_io_dataplane = Arc::clone(&wg_io);
-    tokio::spawn(async move {
-        if let Err(e) =
-            dataplane::run_dataplane(wg_io_dataplane, wg_to_dataplane_rx, server_ip, port_forward_rx)
-                .await
-        {
-            error!("Dataplane task failed: {}", e);
+    let stats_dataplane = traffic_stats.clone();
+    let access_schedules = Arc::new(access_schedules);
+    if args.peer_multicast && args.client_isolation {
+        warn!("--peer-multicast copies nothing while client isolation is on");
+    }
+    let flow_policy = dataplane::FlowPolicy {
+        firewall: Arc::clone(&firewall),
+        acls: Arc::clone(&egress_acls),
+        schedules: Arc::clone(&access_schedules),
+        bandwidth: Arc::clone(&bandwidth_limits),
+        qos: Arc::clone(&qos),
+        client_isolation: args.client_isolation,
+        peer_multicast: args.peer_multicast,
+        flow_limits: flow_limit::FlowLimits {
+            max_open: args.peer_max_flows,
+            rate: args.peer_flow_rate,
+            burst: args.peer_flow_burst,
+        },
+        egress: Arc::clone(&egress),
+        http_proxy,
+        socks,
+        domains: domain_filter.clone(),
+        port_mapping,
+        icmp_echo_forwarding: args.icmp_echo_forwarding,
+        ipv6_prefix,
+        ipv6_only: args.ipv6_only_peers,
+        ntp: args.ntp,
+        speedtest_port: args.speedtest_port,
+        status_page,
+    };
+    if args.tcp_idle_timeout_secs == 0
+        || args.tcp_half_closed_timeout_secs == 0
+        || args.udp_idle_timeout_secs == 0
+    {
+        anyhow::bail!("NAT flow timeouts must be at least one second");
+    }
+    let flow_config = flow::FlowConfig {
+        tcp_idle_timeout_secs: args.tcp_idle_timeout_secs,
+        tcp_half_closed_timeout_secs: args.tcp_half_closed_timeout_secs,
+        udp_idle_timeout_secs: args.udp_idle_timeout_secs,
+        tcp_mss_clamp: args.tcp_mss_clamp,
+        ..flow::FlowConfig::default()
+    };
+    let dns_dataplane = Arc::clone(&dns_service);
+    // In kernel mode only DNS, NTP and speed tests are left to serve; the
+    // port forward and flow table channels are dropped, so those admin
+    // requests fail
+    let dataplane_task = match &kernel_device {
+        Some(_) => {
+            if args.ntp {
+                tokio::spawn(async move {
+                    let addr = std::net::SocketAddr::from((server_ip, ntp::NTP_PORT));
+                    if let Err(e) = ntp::serve(addr).await {
+                        error!("NTP task failed: {:#}", e);
+                    }
+                });
+            }
+            if let Some(port) = args.speedtest_port {
+                tokio::spawn(async move {
+                    let addr = std::net::SocketAddr::from((server_ip, port));
+                    if let Err(e) = speedtest::listen(addr).await {
+                        error!("Speed test task failed: {:#}", e);
+                    }
+                });
+            }
+            let shared_dns = Arc::clone(&shared_state);
+            tokio::spawn(async move {
+                if let Err(e) = kernel::serve_dns(server_ip, dns_dataplane, shared_dns).await {
+                    error!("DNS task failed: {:#}", e);
+                }
+            })
         }
-    });
+        None => tokio::spawn(async move {
+            if let Err(e) = dataplane::run_dataplane(
+                wg_io_dataplane,
+                wg_to_dataplane_rx,
+                networks,
+                dns_dataplane,
+                flow_policy,
+                flow_config,
+                stats_dataplane,
+                port_forward_rx,
+                flow_table_rx,
+            )
+            .await
+            {
+                error!("Dataplane task failed: {}", e);
+            }
+        }),
+    };
+    let health_checks = health::HealthChecks::spawn(
+        Arc::clone(&wg_io),
+        dns_service,
+        Arc::clone(&shared_state.metrics),
+        wg_receive_task,
+        dataplane_task,
+    );
+    if mount.is_none() {
+        systemd::spawn_watchdog(Arc::clone(&health_checks));
+    }
+
+    // Once the dataplane is running to take the forwards' listeners
+    let port_forward_file = match args.port_forward_file.clone() {
+        Some(path) => Some(
+            port_forwards::PortForwardFile::load(
+                path,
+                Arc::clone(&shared_state),
+                port_forward_tx.clone(),
+            )
+            .await
+            .context("failed to load port forwards")?,
+        ),
+        None => None,
+    };
+
+    let reloader = reload::Reloader::new(
+        Arc::clone(&shared_state),
+        port_forward_tx.clone(),
+        reload::ReloadSources {
+            wg_config: wg_import.clone(),
+            firewall: Arc::clone(&firewall),
+            acls: egress_acls,
+            domains: domain_filter,
+            egress,
+            schedules: access_schedules,
+            bandwidth: bandwidth_limits,
+            qos,
+            obfuscation: Arc::clone(&obfuscation),
+            dns_policies,
+            port_forwards: port_forward_file,
+            log_filter,
+        },
+    );
+    reloader.spawn_sighup()?;
+
+    let cluster = if args.cluster_node.is_empty() {
+        None
+    } else {
+        let cluster = cluster::Cluster::spawn(
+            Arc::clone(&shared_state),
+            port_forward_tx.clone(),
+            cluster::ClusterSettings {
+                nodes: args.cluster_node.clone(),
+                token: args.cluster_token.clone(),
+                interval: Duration::from_secs(args.cluster_interval_secs),
+            },
+        )
+        .context("failed to start clustering")?;
+        info!(
+            "Sharing peers with {} other cluster nodes",
+            args.cluster_node.len()
+        );
+        Some(cluster)
+    };
+
+    let admin_router = admin::create_router(
+        Arc::clone(&shared_state),
+        Arc::clone(&wg_io),
+        args.wg_endpoint.clone(),
+        port_forward_tx.clone(),
+        flow_table_tx,
+        wg_import,
+        firewall,
+        traffic_stats,
+        reloader,
+        // Keys from --private-key or --wg-config have nowhere to be saved
+        args.private_key
+            .is_none()
+            .then(|| args.private_key_file.clone())
+            .flatten(),
+    );
+    let admin_router = match cluster {
+        Some(cluster) => admin_router.merge(cluster::create_router(
+            Arc::clone(&shared_state),
+            Arc::clone(&wg_io),
+            cluster,
+        )),
+        None => admin_router,
+    };
+    let admin_router = admin_router.merge(dashboard::create_router());
+    let admin_router = tenant::mount(admin_router, &tenants, |routers| &routers.admin);
+
+    if let (Some(admin_listen), Some(listener)) = (args.admin_listen.clone(), admin_listener) {
+        let tokens = admin_auth::AdminTokens::new(
+            args.admin_token.clone(),
+            args.admin_read_token.clone(),
+        );
+        let mut tcp_router = admin_router.clone();
+        if tokens.is_empty() {
+            if args.admin_client_ca.is_none() {
+                warn!("Admin API on {} is unauthenticated", admin_listen);
+            }
+        } else {
+            tcp_router = tcp_router.layer(axum::middleware::from_fn_with_state(
+                Arc::new(tokens),
+                admin_auth::require_token,
+            ));
+        }
+
+        if let (Some(cert), Some(key)) = (&args.admin_tls_cert, &args.admin_tls_key) {
+            let tls_config =
+                admin_auth::tls_config(cert, key, args.admin_client_ca.as_deref()).await?;
+            let server = axum_server::from_tcp_rustls(listener, tls_config);
+            info!("Admin API listening on {} (HTTPS)", admin_listen);
+            tokio::spawn(async move {
+                if let Err(e) = server
+                    .serve(tcp_router.into_make_service_with_connect_info::<std::net::SocketAddr>())
+                    .await
+                {
+                    error!("Admin API server failed: {}", e);
+                }
+            });
+        } else {
+            let listener = tokio::net::TcpListener::from_std(listener)
+                .context("failed to use admin API listener")?;
+            info!("Admin API listening on {}", admin_listen);
+            tokio::spawn(async move {
+                let service =
+                    tcp_router.into_make_service_with_connect_info::<std::net::SocketAddr>();
+                if let Err(e) = axum::serve(listener, service).await {
+                    error!("Admin API server failed: {}", e);
+                }
+            });
+        }
+    }
+
+    if let Some(admin_socket) = args.admin_socket.clone() {
+        let listener = bind_owner_socket(&admin_socket).context("failed to bind admin socket")?;
+        info!("Admin API listening on unix socket {}", admin_socket);
+        let router = admin_router.clone();
+        tokio::spawn(async move {
+            if let Err(e) = axum::serve(listener, router).await {
+                error!("Admin socket server failed: {}", e);
+            }
+        });
+    }
+
+    if let Some(otlp) = &otlp {
+        otlp.spawn_metrics(Arc::clone(&shared_state), Arc::clone(&wg_io));
+        info!(
+            "Exporting metrics and traces to {}",
+            args.otlp_endpoint.as_deref().unwrap_or_default()
+        );
+    }
+
+    if let (Some(metrics_listen), Some(listener)) = (&args.metrics_listen, metrics_listener) {
+        let router = metrics::create_router(Arc::clone(&shared_state), Arc::clone(&wg_io))
+            .merge(health::create_router(Arc::clone(&health_checks)));
+        let listener = tokio::net::TcpListener::from_std(listener)
+            .context("failed to use metrics listener")?;
+        info!("Metrics listening on {}", metrics_listen);
+        tokio::spawn(async move {
+            if let Err(e) = axum::serve(listener, router).await {
+                error!("Metrics server failed: {}", e);
+            }
+        });
+    }
+
+    if let Some(socket) = stun_socket {
+        let socket =
+            tokio::net::UdpSocket::from_std(socket).context("failed to use STUN socket")?;
+        tokio::spawn(async move {
+            if let Err(e) = stun::serve(socket).await {
+                error!("STUN server failed: {:#}", e);
+            }
+        });
+    }
+
+    let relay_url = match relay_listener {
+        Some(listener) => {
+            let tls = match (&args.tls_cert, &args.tls_key) {
+                (Some(cert), Some(key)) => {
+                    let config = axum_server::tls_rustls::RustlsConfig::from_pem_file(cert, key)
+                        .await
+                        .context("failed to load relay TLS config")?;
+                    // The WebSocket handshake is HTTP/1.1 only
+                    let mut config = (*config.get_inner()).clone();
+                    config.alpn_protocols = vec![b"http/1.1".to_vec()];
+                    Some(tokio_rustls::TlsAcceptor::from(Arc::new(config)))
+                }
+                _ => {
+                    warn!("Relay running without TLS; terminate TLS in front of it");
+                    None
+                }
+            };
+            let url = relay::public_url(
+                args.relay_url.as_deref(),
+                &args.wg_endpoint,
+                args.relay_listen.as_deref().unwrap_or_default(),
+                tls.is_some(),
+            );
+            let listener = tokio::net::TcpListener::from_std(listener)
+                .context("failed to use relay listener")?;
+            let relay = Arc::new(relay::Relay::new(
+                tls,
+                proxy_protocol,
+                Arc::clone(&wg_io),
+                relay_to_dataplane,
+                Arc::clone(&shared_state.metrics),
+            ));
+            tokio::spawn(relay.serve(listener));
+            info!("Offering clients the relay at {}", url);
+            Some(url)
+        }
+        None => None,
+    };
+
+    tokio::spawn(run_expiry_reaper(
+        Arc::clone(&shared_state),
+        port_forward_tx.clone(),
+    ));
+    tokio::spawn(run_session_tracker(
+        Arc::clone(&shared_state),
+        Arc::clone(&wg_io),
+    ));
 
     // Create and run API server
     let router = api::create_router(
         Arc::clone(&shared_state),
         args.wg_endpoint.clone(),
+        relay_url,
         port_forward_tx,
-    );
+        oidc,
+        ssh_authorizer,
+        obfuscation,
+    )
+    .merge(health::create_router(health_checks));
+    let router = tenant::mount(router, &tenants, |routers| &routers.api);
+
+    let Some(api_listener) = api_listener else {
+        // A tenant serves until the process shuts down
+        if let Some(mount) = mount {
+            let _ = mount.send(tenant::Routers {
+                api: router,
+                admin: admin_router,
+            });
+        }
+        shutdown_signal().await;
+        drain(
+            &shared_state,
+            &wg_io,
+            &usage,
+            Duration::from_secs(args.drain_secs),
+        )
+        .await;
+        if let Some(device) = &kernel_device {
+            device.remove();
+        }
+        return Ok(());
+    };
 
     info!("API server listening on {}", args.api_listen);
 
-    if args.tls_cert.is_some() && args.tls_key.is_some() {
+    let api_server = if args.tls_cert.is_some() && args.tls_key.is_some() {
         // HTTPS mode
         let tls_config = axum_server::tls_rustls::RustlsConfig::from_pem_file(
             args.tls_cert.as_ref().unwrap(),
@@ -176,25 +1961,242 @@ async fn main() -> Result<()> {
         .await
         .context("failed to load TLS config")?;
 
-        let addr: std::net::SocketAddr = args.api_listen.parse().context("invalid API listen address")?;
-        axum_server::bind_rustls(addr, tls_config)
-            .serve(router.into_make_service())
-            .await
-            .context("API server failed")?;
+        let server = axum_server::from_tcp_rustls(api_listener, tls_config);
+        tokio::spawn(async move {
+            server
+                .serve(router.into_make_service_with_connect_info::<std::net::SocketAddr>())
+                .await
+        })
     } else {
         // HTTP mode (for development/testing)
         info!("Running API in HTTP mode (no TLS configured)");
-        let listener = tokio::net::TcpListener::bind(&args.api_listen)
+        let listener = tokio::net::TcpListener::from_std(api_listener)
+            .context("failed to use API listener")?;
+        tokio::spawn(async move {
+            axum::serve(
+                listener,
+                router.into_make_service_with_connect_info::<std::net::SocketAddr>(),
+            )
             .await
-            .context("failed to bind API listener")?;
-        axum::serve(listener, router)
-            .await
-            .context("API server failed")?;
+        })
+    };
+
+    systemd::notify("READY=1");
+    if let Some(takeover) = takeover {
+        if let Err(e) = takeover.finish() {
+            warn!("{:#}", e);
+        }
+    }
+    let upgrade_listener = args
+        .upgrade_socket
+        .as_deref()
+        .map(|path| {
+            let listener = bind_owner_socket(path).context("failed to bind upgrade socket")?;
+            info!("Waiting for upgrades on {}", path);
+            Ok::<_, anyhow::Error>(listener)
+        })
+        .transpose()?;
+    let successor = async {
+        match upgrade_listener {
+            Some(listener) => {
+                upgrade::wait_for_successor(
+                    listener,
+                    handoff_sockets,
+                    Arc::clone(&shared_state),
+                    Arc::clone(&usage),
+                )
+                .await
+            }
+            None => std::future::pending().await,
+        }
+    };
+
+    tokio::select! {
+        result = api_server => {
+            result.context("API server panicked")?.context("API server failed")?;
+        }
+        _ = successor => {
+            close_sessions(&shared_state, &wg_io);
+            info!("Handed over to the new server; exiting");
+        }
+        _ = shutdown_signal() => {
+            systemd::notify("STOPPING=1");
+            drain(
+                &shared_state,
+                &wg_io,
+                &usage,
+                Duration::from_secs(args.drain_secs),
+            )
+            .await;
+            // A successor takes over the interface as it is, so it is only
+            // removed on shutdown
+            if let Some(device) = &kernel_device {
+                device.remove();
+            }
+        }
+    }
+    // Tenants drain on the same signal
+    for tenant in tenants {
+        let _ = tenant.task.await;
     }
 
     Ok(())
 }
 
+/// Wait for SIGINT or SIGTERM
+async fn shutdown_signal() {
+    let mut terminate = match signal(SignalKind::terminate()) {
+        Ok(signal) => signal,
+        Err(e) => {
+            warn!("Failed to listen for SIGTERM: {}", e);
+            let _ = tokio::signal::ctrl_c().await;
+            return;
+        }
+    };
+    tokio::select! {
+        _ = tokio::signal::ctrl_c() => {}
+        _ = terminate.recv() => {}
+    }
+}
+
+/// Periodically remove peers whose expiry has passed
+async fn run_expiry_reaper(
+    shared: Arc<SharedState>,
+    port_forward_tx: mpsc::Sender<api::PortForwardEvent>,
+) {
+    let mut interval = tokio::time::interval(EXPIRY_CHECK_INTERVAL);
+    loop {
+        interval.tick().await;
+        for (peer, rules) in shared.remove_expired() {
+            info!(
+                "Removed expired peer {} with IP {}",
+                events::encode_key(&peer.public_key),
+                peer.assigned_ip
+            );
+            shared.audit.record(
+                audit::AuditEntry::new(audit::AuditAction::PeerExpire, &audit::Actor::system())
+                    .target(events::encode_key(&peer.public_key)),
+            );
+            for rule in rules {
+                let event = api::PortForwardEvent::Removed {
+                    protocol: rule.protocol,
+                    port: rule.public_port,
+                };
+                if port_forward_tx.send(event).await.is_err() {
+                    warn!("Dataplane is gone; stopping expiry reaper");
+                    return;
+                }
+            }
+        }
+    }
+}
+
+/// Periodically sample every peer's tunnel state into the session history
+async fn run_session_tracker(shared: Arc<SharedState>, wg_io: Arc<WgIo>) {
+    let mut interval = tokio::time::interval(SESSION_CHECK_INTERVAL);
+    loop {
+        interval.tick().await;
+        shared.sessions.observe(observe_sessions(&shared, &wg_io));
+    }
+}
+
+/// The current state of every peer, for session history
+fn observe_sessions(shared: &SharedState, wg_io: &WgIo) -> Vec<sessions::Observation> {
+    let peers: Vec<_> = shared
+        .peers
+        .read()
+        .iter()
+        .map(|peer| (peer.public_key, peer.name.clone()))
+        .collect();
+    peers
+        .into_iter()
+        .map(|(public_key, name)| {
+            let stats = wg_io.peer_stats(&public_key);
+            let stats = stats.as_ref();
+            sessions::Observation {
+                public_key,
+                name,
+                connected: stats.is_some_and(|stats| stats.is_connected()),
+                endpoint: stats.and_then(|stats| stats.endpoint),
+                roams: stats.map_or(0, |stats| stats.roams),
+                last_handshake: stats.and_then(|stats| stats.last_handshake),
+                last_receive: stats.and_then(|stats| stats.last_receive),
+                rx_bytes: stats.map_or(0, |stats| stats.rx_bytes),
+                tx_bytes: stats.map_or(0, |stats| stats.tx_bytes),
+            }
+        })
+        .collect()
+}
+
+/// Refuse new handshakes and flows, give open TCP flows up to `window` to
+/// finish, then save traffic usage and close open sessions
+async fn drain(shared: &SharedState, wg_io: &WgIo, usage: &usage::UsageTracker, window: Duration) {
+    wg_io.start_draining();
+    let metrics = &shared.metrics;
+    let started = usage::unix_now();
+    let deadline = tokio::time::Instant::now() + window;
+    info!(
+        "Draining for up to {}s before shutting down",
+        window.as_secs()
+    );
+    loop {
+        // Flow counts are refreshed, and traffic usage recorded, by the
+        // dataplane's housekeeping, so wait for a pass after draining began
+        let refreshed = metrics.dataplane_heartbeat.load(Ordering::Relaxed) > started;
+        let open = metrics.tcp_flows.load(Ordering::Relaxed);
+        if refreshed && open == 0 {
+            info!("All flows finished");
+            break;
+        }
+        if tokio::time::Instant::now() >= deadline {
+            if open > 0 {
+                warn!("Shutting down with {} TCP flows still open", open);
+            }
+            break;
+        }
+        tokio::time::sleep(DRAIN_POLL_INTERVAL).await;
+    }
+
+    if let Err(e) = usage.flush() {
+        warn!("Failed to save traffic usage: {:#}", e);
+    }
+    close_sessions(shared, wg_io);
+    info!("Shutting down");
+}
+
+/// Record every open session as ended, ahead of exiting
+fn close_sessions(shared: &SharedState, wg_io: &WgIo) {
+    let observations = observe_sessions(shared, wg_io)
+        .into_iter()
+        .map(|observation| sessions::Observation {
+            connected: false,
+            ..observation
+        })
+        .collect();
+    shared.sessions.observe(observations);
+}
+
+/// Bind an owner-only unix socket, replacing one left by a previous run
+fn bind_owner_socket(path: &str) -> Result<tokio::net::UnixListener> {
+    use std::os::unix::fs::{FileTypeExt, PermissionsExt};
+
+    if let Ok(metadata) = std::fs::symlink_metadata(path) {
+        if !metadata.file_type().is_socket() {
+            anyhow::bail!("{} exists and is not a socket", path);
+        }
+        std::fs::remove_file(path).context("failed to remove stale socket")?;
+    }
+    if let Some(parent) = std::path::Path::new(path).parent() {
+        std::fs::create_dir_all(parent).context("failed to create socket directory")?;
+    }
+
+    let listener =
+        tokio::net::UnixListener::bind(path).with_context(|| format!("failed to bind {}", path))?;
+    std::fs::set_permissions(path, std::fs::Permissions::from_mode(0o600))
+        .context("failed to restrict socket permissions")?;
+    Ok(listener)
+}
+
 async fn load_private_key_b64(args: &Args) -> Result<String> {
     if let Some(private_key) = &args.private_key {
         return Ok(private_key.clone());
@@ -203,9 +2205,88 @@ async fn load_private_key_b64(args: &Args) -> Result<String> {
     let private_key_file = args
         .private_key_file
         .as_ref()
-        .context("either --private-key or --private-key-file is required")?;
+        .context("either --private-key, --private-key-file or a --wg-config with a PrivateKey is required")?;
 
     tokio::fs::read_to_string(private_key_file)
         .await
         .context("failed to read server private key file")
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Policy files kernel mode can't enforce are refused rather than
+    /// silently ignored
+    #[test]
+    fn kernel_mode_refuses_policy_files() {
+        for flag in [
+            "--firewall-rules",
+            "--egress-acl-file",
+            "--access-schedule-file",
+            "--bandwidth-limit-file",
+            "--peer-upload-limit",
+            "--peer-download-limit",
+        ] {
+            let result = Args::try_parse_from([
+                "wirecagesrv",
+                "--private-key-file",
+                "/etc/wirecage/key",
+                "--auth-token",
+                "secret",
+                "--wg-endpoint",
+                "vpn.example.com:51820",
+                "--kernel-interface",
+                "wg0",
+                flag,
+                "x",
+            ]);
+            let err = result.expect_err(flag);
+            assert_eq!(
+                err.kind(),
+                clap::error::ErrorKind::ArgumentConflict,
+                "{}",
+                flag
+            );
+        }
+    }
+
+    #[test]
+    fn userspace_mode_takes_policy_files() {
+        let args = Args::try_parse_from([
+            "wirecagesrv",
+            "--private-key-file",
+            "/etc/wirecage/key",
+            "--auth-token",
+            "secret",
+            "--wg-endpoint",
+            "vpn.example.com:51820",
+            "--firewall-rules",
+            "/etc/wirecage/firewall.rules",
+            "--egress-acl-file",
+            "/etc/wirecage/acl.toml",
+        ])
+        .unwrap();
+        assert!(args.kernel_interface.is_none());
+    }
+
+    #[test]
+    fn cluster_interval_must_be_positive() {
+        let args = |interval: &str| {
+            Args::try_parse_from([
+                "wirecagesrv",
+                "--private-key-file",
+                "/etc/wirecage/key",
+                "--auth-token",
+                "secret",
+                "--wg-endpoint",
+                "vpn.example.com:51820",
+                "--cluster-interval-secs",
+                interval,
+            ])
+        };
+        let err = args("0").expect_err("a zero interval");
+        assert_eq!(err.kind(), clap::error::ErrorKind::ValueValidation);
+        assert_eq!(args("1").unwrap().cluster_interval_secs, 1);
+    }
+}
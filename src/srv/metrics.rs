@@ -0,0 +1,632 @@
+//! Prometheus metrics for wirecagesrv
+//!
+//! Served as `GET /metrics` on `--metrics-listen` in the Prometheus text
+//! format. Counters are kept as atomics where things happen; peer counts,
+//! transfer counters and socket drops are read when scraped. The same
+//! snapshot is pushed to OTLP collectors by `otel`.
+
+use std::fmt::Write as _;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Arc;
+use std::time::{Duration, UNIX_EPOCH};
+
+use axum::extract::State;
+use axum::http::header;
+use axum::response::IntoResponse;
+use axum::routing::get;
+use axum::Router;
+use parking_lot::Mutex;
+use tokio::sync::mpsc;
+
+use super::anomaly::AnomalyKind;
+use super::debug_vars;
+use super::events::encode_key;
+use super::flow::Eviction;
+use super::flow_limit::FlowLimitReason;
+use super::handshake_limit::HandshakeDrop;
+use super::state::SharedState;
+use super::wg::WgIo;
+
+/// Upper bounds of the DNS latency histogram buckets, in seconds
+const DNS_LATENCY_BUCKETS: [f64; 10] =
+    [0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0];
+
+/// How a DNS query from a peer was handled
+#[derive(Debug, Clone, Copy)]
+pub enum DnsOutcome {
+    /// Answered by an upstream resolver, the cache or the blocklist
+    Forwarded,
+    /// Answered from the local zone
+    Local,
+    RateLimited,
+    /// Refused by the peer's DNS policy
+    Refused,
+    /// Forwarding failed, so the query went unanswered
+    Failed,
+}
+
+impl DnsOutcome {
+    const ALL: [DnsOutcome; 5] = [
+        DnsOutcome::Forwarded,
+        DnsOutcome::Local,
+        DnsOutcome::RateLimited,
+        DnsOutcome::Refused,
+        DnsOutcome::Failed,
+    ];
+
+    fn label(self) -> &'static str {
+        match self {
+            DnsOutcome::Forwarded => "forwarded",
+            DnsOutcome::Local => "local",
+            DnsOutcome::RateLimited => "rate_limited",
+            DnsOutcome::Refused => "refused",
+            DnsOutcome::Failed => "failed",
+        }
+    }
+}
+
+#[derive(Default)]
+struct Histogram {
+    /// Observations at or below each bucket's bound, not cumulative
+    buckets: [AtomicU64; DNS_LATENCY_BUCKETS.len()],
+    count: AtomicU64,
+    sum_micros: AtomicU64,
+}
+
+impl Histogram {
+    fn observe(&self, duration: Duration) {
+        let secs = duration.as_secs_f64();
+        if let Some(bucket) = DNS_LATENCY_BUCKETS.iter().position(|bound| secs <= *bound) {
+            self.buckets[bucket].fetch_add(1, Ordering::Relaxed);
+        }
+        self.count.fetch_add(1, Ordering::Relaxed);
+        self.sum_micros
+            .fetch_add(duration.as_micros() as u64, Ordering::Relaxed);
+    }
+}
+
+/// Kinds of long-running task counted in `/debug/vars`
+#[derive(Debug, Clone, Copy)]
+pub enum Task {
+    /// Relays an outbound TCP flow to its destination
+    TcpRelay,
+    UdpRelay,
+    /// Sends a peer's pings to one destination and relays the replies
+    EchoRelay,
+    /// Relays an inbound port-forwarded TCP connection
+    InboundRelay,
+    /// Answers a DNS query or serves a DNS-over-TCP connection
+    Dns,
+    /// Serves a peer's HTTP proxy connection
+    HttpProxy,
+    /// Serves a peer's SOCKS5 connection and any UDP association it opens
+    Socks,
+    /// Serves a peer's bandwidth test connection
+    SpeedTest,
+    /// Serves a peer's status page request
+    StatusPage,
+    PortForwardListener,
+    /// Carries a peer's WireGuard messages over a relay connection
+    RelayConnection,
+    /// Carries a peer's WireGuard messages over a connection to the
+    /// WireGuard TCP listener
+    StreamConnection,
+}
+
+impl Task {
+    pub const ALL: [Task; 12] = [
+        Task::TcpRelay,
+        Task::UdpRelay,
+        Task::EchoRelay,
+        Task::InboundRelay,
+        Task::Dns,
+        Task::HttpProxy,
+        Task::Socks,
+        Task::SpeedTest,
+        Task::StatusPage,
+        Task::PortForwardListener,
+        Task::RelayConnection,
+        Task::StreamConnection,
+    ];
+
+    pub fn label(self) -> &'static str {
+        match self {
+            Task::TcpRelay => "tcp_relay",
+            Task::UdpRelay => "udp_relay",
+            Task::EchoRelay => "echo_relay",
+            Task::InboundRelay => "inbound_relay",
+            Task::Dns => "dns",
+            Task::HttpProxy => "http_proxy",
+            Task::Socks => "socks",
+            Task::SpeedTest => "speedtest",
+            Task::StatusPage => "status_page",
+            Task::PortForwardListener => "port_forward_listener",
+            Task::RelayConnection => "relay_connection",
+            Task::StreamConnection => "stream_connection",
+        }
+    }
+}
+
+/// Counts a task as running until dropped
+pub struct RunningTask {
+    metrics: Arc<Metrics>,
+    task: Task,
+}
+
+impl Drop for RunningTask {
+    fn drop(&mut self) {
+        self.metrics.tasks[self.task as usize].fetch_sub(1, Ordering::Relaxed);
+    }
+}
+
+/// Reports how many messages are waiting in a channel, or `None` once it
+/// has closed
+type QueueProbe = Box<dyn Fn() -> Option<usize> + Send + Sync>;
+
+/// Counters updated by the rest of the server
+#[derive(Default)]
+pub struct Metrics {
+    /// Handshakes completed with peers
+    pub handshakes: AtomicU64,
+    /// Open NAT flows, summed over dataplane workers as of each one's last
+    /// cleanup; TCP includes inbound port-forwarded connections
+    pub tcp_flows: AtomicU64,
+    pub udp_flows: AtomicU64,
+    pub inbound_tcp_flows: AtomicU64,
+    /// Sockets in the dataplane's userspace TCP stack
+    pub smoltcp_sockets: AtomicU64,
+    /// Unix time by which every dataplane worker had last cleaned up its
+    /// flows, for health checks
+    pub dataplane_heartbeat: AtomicU64,
+    /// Packets from peers dropped because a UDP flow's socket was backed up
+    pub udp_dropped: AtomicU64,
+    /// Outbound connections, binds and sends that failed
+    pub tcp_forward_errors: AtomicU64,
+    pub udp_forward_errors: AtomicU64,
+    flow_limit_refusals: [AtomicU64; FlowLimitReason::ALL.len()],
+    /// Flows closed by the dataplane for timing out
+    evictions: [AtomicU64; Eviction::ALL.len()],
+    dns_queries: [AtomicU64; DnsOutcome::ALL.len()],
+    dns_latency: Histogram,
+    anomalies: [AtomicU64; AnomalyKind::ALL.len()],
+    handshake_drops: [AtomicU64; HandshakeDrop::ALL.len()],
+    /// Cookie replies sent to initiations while under handshake load
+    handshake_cookies: AtomicU64,
+    tasks: [AtomicU64; Task::ALL.len()],
+    queues: Mutex<Vec<(&'static str, QueueProbe)>>,
+}
+
+impl Metrics {
+    /// Count a task of the given kind as running until the returned guard
+    /// is dropped
+    pub fn running(self: &Arc<Self>, task: Task) -> RunningTask {
+        self.tasks[task as usize].fetch_add(1, Ordering::Relaxed);
+        RunningTask {
+            metrics: Arc::clone(self),
+            task,
+        }
+    }
+
+    /// Tasks of each kind now running
+    pub fn running_tasks(&self) -> Vec<(Task, u64)> {
+        Task::ALL
+            .iter()
+            .map(|task| (*task, self.tasks[*task as usize].load(Ordering::Relaxed)))
+            .collect()
+    }
+
+    /// Report the depth of a channel under `name`. Only a weak handle is
+    /// kept, so watching a channel does not keep it open.
+    pub fn watch_queue<T: Send + 'static>(&self, name: &'static str, sender: &mpsc::Sender<T>) {
+        let sender = sender.downgrade();
+        self.queues.lock().push((
+            name,
+            Box::new(move || {
+                let sender = sender.upgrade()?;
+                Some(sender.max_capacity() - sender.capacity())
+            }),
+        ));
+    }
+
+    /// Messages waiting in each watched channel that is still open, summed
+    /// over channels watched under the same name
+    pub fn queue_depths(&self) -> Vec<(&'static str, usize)> {
+        let mut depths: Vec<(&'static str, usize)> = Vec::new();
+        for (name, probe) in self.queues.lock().iter() {
+            let Some(depth) = probe() else {
+                continue;
+            };
+            match depths.iter_mut().find(|(seen, _)| seen == name) {
+                Some((_, total)) => *total += depth,
+                None => depths.push((name, depth)),
+            }
+        }
+        depths
+    }
+
+    pub fn record_dns_query(&self, outcome: DnsOutcome, duration: Duration) {
+        self.dns_queries[outcome as usize].fetch_add(1, Ordering::Relaxed);
+        self.dns_latency.observe(duration);
+    }
+
+    pub fn record_anomaly(&self, kind: AnomalyKind) {
+        self.anomalies[kind as usize].fetch_add(1, Ordering::Relaxed);
+    }
+
+    pub fn record_eviction(&self, eviction: Eviction) {
+        self.evictions[eviction as usize].fetch_add(1, Ordering::Relaxed);
+    }
+
+    pub fn record_flow_limit(&self, reason: FlowLimitReason) {
+        self.flow_limit_refusals[reason as usize].fetch_add(1, Ordering::Relaxed);
+    }
+
+    pub fn record_handshake_drop(&self, reason: HandshakeDrop) {
+        self.handshake_drops[reason as usize].fetch_add(1, Ordering::Relaxed);
+    }
+
+    pub fn record_handshake_cookie(&self) {
+        self.handshake_cookies.fetch_add(1, Ordering::Relaxed);
+    }
+}
+
+/// Create the metrics router, which also serves `/debug/vars`
+pub fn create_router(shared: Arc<SharedState>, wg_io: Arc<WgIo>) -> Router {
+    Router::new()
+        .route("/metrics", get(metrics_handler))
+        .route("/debug/vars", get(debug_vars::vars_handler))
+        .with_state((shared, wg_io))
+}
+
+/// Handler for GET /metrics
+async fn metrics_handler(
+    State((shared, wg_io)): State<(Arc<SharedState>, Arc<WgIo>)>,
+) -> impl IntoResponse {
+    (
+        [(header::CONTENT_TYPE, "text/plain; version=0.0.4")],
+        render(&shared, &wg_io),
+    )
+}
+
+/// Whether a metric only goes up
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Kind {
+    Counter,
+    Gauge,
+}
+
+/// A metric and its current values, one per label set
+pub struct Family {
+    pub name: &'static str,
+    pub kind: Kind,
+    pub help: &'static str,
+    pub samples: Vec<Sample>,
+}
+
+pub struct Sample {
+    pub labels: Vec<(&'static str, String)>,
+    pub value: u64,
+}
+
+impl Family {
+    fn new(name: &'static str, kind: Kind, help: &'static str) -> Self {
+        Self {
+            name,
+            kind,
+            help,
+            samples: Vec::new(),
+        }
+    }
+
+    fn single(name: &'static str, kind: Kind, help: &'static str, value: u64) -> Self {
+        Self::new(name, kind, help).sample(Vec::new(), value)
+    }
+
+    fn sample(mut self, labels: Vec<(&'static str, String)>, value: u64) -> Self {
+        self.samples.push(Sample { labels, value });
+        self
+    }
+}
+
+/// DNS query latencies observed since startup
+pub struct LatencySnapshot {
+    pub bounds: &'static [f64],
+    /// Observations in each bucket, not cumulative, with the last past the
+    /// final bound
+    pub buckets: Vec<u64>,
+    pub count: u64,
+    pub sum_secs: f64,
+}
+
+pub const DNS_LATENCY_NAME: &str = "wirecage_dns_query_duration_seconds";
+pub const DNS_LATENCY_HELP: &str = "Time taken to answer DNS queries from peers";
+
+/// Every metric's current value
+pub struct Snapshot {
+    pub families: Vec<Family>,
+    pub dns_latency: LatencySnapshot,
+}
+
+/// Read the current value of every metric
+pub fn snapshot(shared: &SharedState, wg_io: &WgIo) -> Snapshot {
+    let metrics = &shared.metrics;
+    let load = |counter: &AtomicU64| counter.load(Ordering::Relaxed);
+
+    let peers: Vec<_> = shared
+        .peers
+        .read()
+        .iter()
+        .map(|peer| (peer.public_key, peer.name.clone()))
+        .collect();
+    let stats: Vec<_> = peers
+        .iter()
+        .map(|(public_key, name)| {
+            let labels = vec![
+                ("public_key", encode_key(public_key)),
+                ("name", name.clone().unwrap_or_default()),
+            ];
+            (labels, wg_io.peer_stats(public_key))
+        })
+        .collect();
+    let connected = stats
+        .iter()
+        .filter(|(_, stats)| stats.as_ref().is_some_and(|stats| stats.is_connected()))
+        .count();
+
+    let mut rx = Family::new(
+        "wirecage_peer_receive_bytes_total",
+        Kind::Counter,
+        "WireGuard bytes received from each peer",
+    );
+    let mut tx = Family::new(
+        "wirecage_peer_transmit_bytes_total",
+        Kind::Counter,
+        "WireGuard bytes sent to each peer",
+    );
+    let mut handshake = Family::new(
+        "wirecage_peer_last_handshake_seconds",
+        Kind::Gauge,
+        "Unix time of each peer's latest handshake",
+    );
+    for (labels, stats) in stats {
+        let stats = stats.as_ref();
+        rx = rx.sample(labels.clone(), stats.map_or(0, |stats| stats.rx_bytes));
+        tx = tx.sample(labels.clone(), stats.map_or(0, |stats| stats.tx_bytes));
+        let last_handshake = stats
+            .and_then(|stats| stats.last_handshake)
+            .and_then(|time| time.duration_since(UNIX_EPOCH).ok())
+            .map_or(0, |d| d.as_secs());
+        handshake = handshake.sample(labels, last_handshake);
+    }
+
+    let protocol = |name: &str| vec![("protocol", name.to_string())];
+    let mut families = vec![
+        Family::single(
+            "wirecage_peers",
+            Kind::Gauge,
+            "Registered peers",
+            peers.len() as u64,
+        ),
+        Family::single(
+            "wirecage_peers_connected",
+            Kind::Gauge,
+            "Peers heard from within the liveness timeout",
+            connected as u64,
+        ),
+        Family::single(
+            "wirecage_handshakes_total",
+            Kind::Counter,
+            "Handshakes completed with peers",
+            load(&metrics.handshakes),
+        ),
+        rx,
+        tx,
+        handshake,
+        Family::single(
+            "wirecage_handshake_cookies_sent_total",
+            Kind::Counter,
+            "Cookie replies sent to handshake initiations while under load",
+            load(&metrics.handshake_cookies),
+        ),
+        Family::single(
+            "wirecage_handshake_under_load",
+            Kind::Gauge,
+            "Whether handshake initiations are arriving faster than the load threshold",
+            wg_io.handshakes_under_load() as u64,
+        ),
+        Family::new("wirecage_nat_flows", Kind::Gauge, "Open NAT flows")
+            .sample(protocol("tcp"), load(&metrics.tcp_flows))
+            .sample(protocol("udp"), load(&metrics.udp_flows)),
+        Family::single(
+            "wirecage_nat_udp_dropped_packets_total",
+            Kind::Counter,
+            "UDP packets from peers dropped because their flow was backed up",
+            load(&metrics.udp_dropped),
+        ),
+        Family::new(
+            "wirecage_forward_errors_total",
+            Kind::Counter,
+            "Outbound connections and sends for NAT flows that failed",
+        )
+        .sample(protocol("tcp"), load(&metrics.tcp_forward_errors))
+        .sample(protocol("udp"), load(&metrics.udp_forward_errors)),
+    ];
+    let mut evictions = Family::new(
+        "wirecage_nat_flows_evicted_total",
+        Kind::Counter,
+        "NAT flows closed for being idle past their timeout",
+    );
+    for eviction in Eviction::ALL {
+        evictions = evictions.sample(
+            vec![
+                ("protocol", eviction.protocol().to_string()),
+                ("reason", eviction.reason().to_string()),
+            ],
+            load(&metrics.evictions[eviction as usize]),
+        );
+    }
+    families.push(evictions);
+    let mut flow_limits = Family::new(
+        "wirecage_peer_flows_refused_total",
+        Kind::Counter,
+        "New flows refused because their peer was over its flow limits, by reason",
+    );
+    for reason in FlowLimitReason::ALL {
+        flow_limits = flow_limits.sample(
+            vec![("reason", reason.label().to_string())],
+            load(&metrics.flow_limit_refusals[reason as usize]),
+        );
+    }
+    families.push(flow_limits);
+    if let Some(drops) = wg_io
+        .local_addr()
+        .and_then(|addr| socket_drops(addr.port()))
+    {
+        families.push(Family::single(
+            "wirecage_wg_socket_drops_total",
+            Kind::Counter,
+            "Packets the kernel dropped on the WireGuard socket",
+            drops,
+        ));
+    }
+    let mut dns_queries = Family::new(
+        "wirecage_dns_queries_total",
+        Kind::Counter,
+        "DNS queries from peers by how they were handled",
+    );
+    for outcome in DnsOutcome::ALL {
+        dns_queries = dns_queries.sample(
+            vec![("result", outcome.label().to_string())],
+            load(&metrics.dns_queries[outcome as usize]),
+        );
+    }
+    families.push(dns_queries);
+    let mut anomalies = Family::new(
+        "wirecage_anomalies_total",
+        Kind::Counter,
+        "Unusual peer behavior flagged by the anomaly detector",
+    );
+    for kind in AnomalyKind::ALL {
+        anomalies = anomalies.sample(
+            vec![("kind", kind.label().to_string())],
+            load(&metrics.anomalies[kind as usize]),
+        );
+    }
+    families.push(anomalies);
+    let mut handshake_drops = Family::new(
+        "wirecage_handshake_initiations_dropped_total",
+        Kind::Counter,
+        "Handshake initiations dropped before reaching a tunnel, by reason",
+    );
+    for reason in HandshakeDrop::ALL {
+        handshake_drops = handshake_drops.sample(
+            vec![("reason", reason.label().to_string())],
+            load(&metrics.handshake_drops[reason as usize]),
+        );
+    }
+    families.push(handshake_drops);
+
+    let latency = &metrics.dns_latency;
+    let count = load(&latency.count);
+    let mut buckets: Vec<u64> = latency.buckets.iter().map(load).collect();
+    buckets.push(count.saturating_sub(buckets.iter().sum()));
+    Snapshot {
+        families,
+        dns_latency: LatencySnapshot {
+            bounds: &DNS_LATENCY_BUCKETS,
+            buckets,
+            count,
+            sum_secs: load(&latency.sum_micros) as f64 / 1e6,
+        },
+    }
+}
+
+fn render(shared: &SharedState, wg_io: &WgIo) -> String {
+    let snapshot = snapshot(shared, wg_io);
+    let mut out = String::new();
+    for family in &snapshot.families {
+        let kind = match family.kind {
+            Kind::Counter => "counter",
+            Kind::Gauge => "gauge",
+        };
+        header(&mut out, family.name, kind, family.help);
+        for sample in &family.samples {
+            if sample.labels.is_empty() {
+                let _ = writeln!(out, "{} {}", family.name, sample.value);
+                continue;
+            }
+            let labels: Vec<String> = sample
+                .labels
+                .iter()
+                .map(|(key, value)| format!("{}=\"{}\"", key, escape(value)))
+                .collect();
+            let _ = writeln!(
+                out,
+                "{}{{{}}} {}",
+                family.name,
+                labels.join(","),
+                sample.value
+            );
+        }
+    }
+
+    let latency = &snapshot.dns_latency;
+    header(&mut out, DNS_LATENCY_NAME, "histogram", DNS_LATENCY_HELP);
+    let mut cumulative = 0;
+    for (bound, bucket) in latency.bounds.iter().zip(&latency.buckets) {
+        cumulative += *bucket;
+        let _ = writeln!(
+            out,
+            "{}_bucket{{le=\"{}\"}} {}",
+            DNS_LATENCY_NAME, bound, cumulative
+        );
+    }
+    let _ = writeln!(
+        out,
+        "{}_bucket{{le=\"+Inf\"}} {}",
+        DNS_LATENCY_NAME, latency.count
+    );
+    let _ = writeln!(out, "{}_sum {}", DNS_LATENCY_NAME, latency.sum_secs);
+    let _ = writeln!(out, "{}_count {}", DNS_LATENCY_NAME, latency.count);
+    out
+}
+
+fn header(out: &mut String, name: &str, kind: &str, help: &str) {
+    let _ = writeln!(out, "# HELP {} {}", name, help);
+    let _ = writeln!(out, "# TYPE {} {}", name, kind);
+}
+
+/// Escape a label value
+fn escape(value: &str) -> String {
+    value
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
+
+/// Drops the kernel counted on UDP sockets bound to `port`, from
+/// `/proc/net/udp` and `/proc/net/udp6`
+fn socket_drops(port: u16) -> Option<u64> {
+    let mut found = false;
+    let mut drops = 0;
+    for table in ["/proc/net/udp", "/proc/net/udp6"] {
+        let Ok(contents) = std::fs::read_to_string(table) else {
+            continue;
+        };
+        for line in contents.lines().skip(1) {
+            let fields: Vec<&str> = line.split_whitespace().collect();
+            let local_port = fields
+                .get(1)
+                .and_then(|addr| addr.rsplit_once(':'))
+                .and_then(|(_, port)| u16::from_str_radix(port, 16).ok());
+            if local_port != Some(port) {
+                continue;
+            }
+            if let Some(count) = fields.last().and_then(|count| count.parse::<u64>().ok()) {
+                found = true;
+                drops += count;
+            }
+        }
+    }
+    found.then_some(drops)
+}
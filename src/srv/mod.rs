@@ -1,5 +1,82 @@
+pub mod access_log;
+pub mod acl;
+pub mod admin;
+pub mod admin_auth;
+pub mod anomaly;
 pub mod api;
+pub mod audit;
+pub mod bandwidth;
+pub mod bufpool;
+pub mod cascade;
+pub mod cluster;
+pub mod cookie;
+pub mod ctl;
+pub mod dashboard;
 pub mod dataplane;
+pub mod debug_vars;
+pub mod destinations;
+pub mod dial;
+pub mod dns;
+pub mod dns_blocklist;
+pub mod dns_cache;
+pub mod dns_local;
+pub mod dns_policy;
+pub mod dns_ratelimit;
+pub mod dns_upstream;
+pub mod dns_wire;
+pub mod domain_filter;
+pub mod egress;
+pub mod enroll;
+pub mod events;
+pub mod firewall;
 pub mod flow;
+pub mod flow_limit;
+pub mod flowlog;
+pub mod hairpin;
+pub mod handshake_limit;
+pub mod health;
+pub mod http_proxy;
+pub mod icmp;
+pub mod ipv6;
+pub mod kernel;
+pub mod metrics;
+pub mod mss;
+pub mod nat64;
+pub mod nat_ports;
+pub mod network;
+pub mod ntp;
+pub mod obfuscation;
+pub mod oidc;
+pub mod otel;
+pub mod pcap;
+pub mod port_forwards;
+pub mod port_mapping;
+pub mod proxy_protocol;
+pub mod qos;
+pub mod relay;
+pub mod reload;
+pub mod schedule;
+pub mod sessions;
+pub mod sni;
+pub mod socks;
+pub mod speedtest;
+pub mod ssh_auth;
 pub mod state;
+pub mod status_page;
+pub mod store;
+pub mod stun;
+pub mod systemd;
+pub mod tenant;
+pub mod totp;
+pub mod upgrade;
+pub mod upstream_proxy;
+pub mod usage;
+pub mod webhooks;
+pub mod websocket;
 pub mod wg;
+#[path = "../wg_mac.rs"]
+pub mod wg_mac;
+pub mod wg_socket;
+pub mod wg_stream;
+pub mod wgconf;
+pub mod wgimport;
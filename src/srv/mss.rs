@@ -0,0 +1,87 @@
+//! TCP MSS clamping
+//!
+//! A peer whose WireGuard interface has a larger MTU than the server's
+//! tunnel, such as 1500 instead of 1420, advertises an MSS the tunnel cannot
+//! carry. Full-size segments relayed to it then need fragmenting once
+//! encrypted, and are lost wherever the path drops fragments or the ICMP
+//! that would lower the path MTU. Lowering the MSS option in SYNs as they
+//! pass keeps segments small enough from the start.
+
+/// IPv4 and TCP header bytes between an MTU and the MSS it allows
+pub const HEADERS: usize = 40;
+
+const TCP: u8 = 6;
+const SYN: u8 = 0x02;
+const OPTION_END: u8 = 0;
+const OPTION_NOP: u8 = 1;
+const OPTION_MSS: u8 = 2;
+
+/// Lower the MSS option of a TCP SYN or SYN-ACK to at most `max`, updating
+/// the checksum. `max` is for IPv4; IPv6's header is 20 bytes longer, so its
+/// segments are clamped 20 bytes lower. Returns whether the packet changed.
+pub fn clamp(packet: &mut [u8], max: u16) -> bool {
+    let (ip_header, max) = match packet.first().map(|byte| byte >> 4) {
+        Some(4) if packet.len() >= 20 && packet[9] == TCP => {
+            // Only the first fragment carries the TCP header
+            let fragment_offset = u16::from_be_bytes([packet[6], packet[7]]) & 0x1fff;
+            if fragment_offset != 0 {
+                return false;
+            }
+            (usize::from(packet[0] & 0x0f) * 4, max)
+        }
+        // Extension headers aren't followed
+        Some(6) if packet.len() >= 40 && packet[6] == TCP => (40, max.saturating_sub(20)),
+        _ => return false,
+    };
+    if packet.len() < ip_header + 20 {
+        return false;
+    }
+    let tcp = &mut packet[ip_header..];
+    if tcp[13] & SYN == 0 {
+        return false;
+    }
+    let tcp_header = usize::from(tcp[12] >> 4) * 4;
+    if tcp_header < 20 || tcp.len() < tcp_header {
+        return false;
+    }
+
+    let mut i = 20;
+    while i < tcp_header {
+        match tcp[i] {
+            OPTION_END => return false,
+            OPTION_NOP => i += 1,
+            kind => {
+                let Some(&len) = tcp.get(i + 1) else {
+                    return false;
+                };
+                let len = usize::from(len);
+                if len < 2 || i + len > tcp_header {
+                    return false;
+                }
+                if kind == OPTION_MSS && len == 4 {
+                    let mss = u16::from_be_bytes([tcp[i + 2], tcp[i + 3]]);
+                    if mss <= max {
+                        return false;
+                    }
+                    tcp[i + 2..i + 4].copy_from_slice(&max.to_be_bytes());
+                    let checksum = u16::from_be_bytes([tcp[16], tcp[17]]);
+                    let checksum = update_checksum(checksum, mss, max);
+                    tcp[16..18].copy_from_slice(&checksum.to_be_bytes());
+                    return true;
+                }
+                i += len;
+            }
+        }
+    }
+    false
+}
+
+/// Update a ones' complement checksum for a 16-bit word changing from
+/// `old` to `new` (RFC 1624, equation 3)
+fn update_checksum(checksum: u16, old: u16, new: u16) -> u16 {
+    let mut sum = u32::from(!checksum) + u32::from(!old) + u32::from(new);
+    while sum > 0xffff {
+        sum = (sum & 0xffff) + (sum >> 16);
+    }
+    !(sum as u16)
+}
@@ -0,0 +1,92 @@
+//! NAT64 and DNS64 for IPv6-only peers
+//!
+//! With `--ipv6-only-peers` peers are given just their address in the
+//! `--ipv6-prefix` (see [`ipv6`](super::ipv6)); the IPv4 address they are
+//! still allocated only names them inside the server. IPv4-only hosts stay
+//! reachable through the well-known prefix `64:ff9b::/96` (RFC 6052): the
+//! DNS service answers AAAA queries for names with only A records with
+//! those addresses in the prefix (DNS64, RFC 6147), and the dataplane sends
+//! flows to an address in the prefix on as IPv4 flows to the address in its
+//! low 32 bits. The firewall, egress ACLs and egress routes see that IPv4
+//! address, so rules written for IPv4 destinations hold through the prefix.
+
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr};
+
+use super::dns_wire::{self, Answer, Question, RCODE_NOERROR, TYPE_A, TYPE_AAAA};
+
+/// `64:ff9b::/96`, with the IPv4 address in the low 32 bits
+const WELL_KNOWN_PREFIX: u128 = 0x0064_ff9b << 96;
+const PREFIX_MASK: u128 = !(u32::MAX as u128);
+
+/// The IPv6 address IPv4-only `ip` is reached at
+pub fn address_for(ip: Ipv4Addr) -> Ipv6Addr {
+    Ipv6Addr::from(WELL_KNOWN_PREFIX | u128::from(u32::from(ip)))
+}
+
+/// The IPv4 address `ip` stands for, if it is in the prefix
+pub fn ipv4_for(ip: Ipv6Addr) -> Option<Ipv4Addr> {
+    let bits = u128::from(ip);
+    (bits & PREFIX_MASK == WELL_KNOWN_PREFIX).then(|| Ipv4Addr::from(bits as u32))
+}
+
+/// The address a flow to `ip` leaves for: the IPv4 address in the prefix
+/// for translated flows, otherwise `ip` itself
+pub fn translate(ip: IpAddr) -> IpAddr {
+    match ip {
+        IpAddr::V6(v6) => ipv4_for(v6).map_or(ip, IpAddr::V4),
+        IpAddr::V4(_) => ip,
+    }
+}
+
+/// Whether `response`, the upstream answer to an AAAA `question`, should
+/// be replaced by a synthesized one: the name exists but has no AAAA
+/// records
+pub fn wants_synthesis(question: &Question, response: &[u8]) -> bool {
+    if question.qtype != TYPE_AAAA
+        || dns_wire::rcode(response) != RCODE_NOERROR
+        || dns_wire::is_truncated(response)
+    {
+        return false;
+    }
+    dns_wire::parse_records(response).is_some_and(|records| {
+        !records
+            .answers
+            .iter()
+            .any(|record| record.rtype == TYPE_AAAA)
+    })
+}
+
+/// Answer the AAAA `query` with addresses in the prefix made from
+/// `a_response`, the answer to an A query for the same name. `None` if it
+/// has no A records. The records are all owned by the question's name, so
+/// CNAMEs on the way are flattened away.
+pub fn synthesize(query: &[u8], question: &Question, a_response: &[u8]) -> Option<Vec<u8>> {
+    if dns_wire::rcode(a_response) != RCODE_NOERROR {
+        return None;
+    }
+    let records = dns_wire::parse_records(a_response)?;
+    let answers: Vec<Answer> = records
+        .answers
+        .iter()
+        .filter(|record| record.rtype == TYPE_A && record.rdlen == 4)
+        .map(|record| {
+            let rdata: [u8; 4] = a_response[record.rdata..record.rdata + 4]
+                .try_into()
+                .expect("4 bytes");
+            Answer {
+                rtype: TYPE_AAAA,
+                ttl: record.ttl.ttl,
+                rdata: address_for(Ipv4Addr::from(rdata)).octets().to_vec(),
+            }
+        })
+        .collect();
+    if answers.is_empty() {
+        return None;
+    }
+    Some(dns_wire::build_response(
+        query,
+        question,
+        RCODE_NOERROR,
+        &answers,
+    ))
+}
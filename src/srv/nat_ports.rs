@@ -0,0 +1,258 @@
+//! Source ports for NATed flows
+//!
+//! By default the kernel picks the source port of each outbound socket.
+//! `--nat-port-range` confines direct TCP and UDP flows to a range instead,
+//! for upstream firewalls that only pass certain source ports, with ports
+//! taken at random or in sequence (`--nat-port-strategy`). Each TCP flow
+//! needs a port of its own, so the range bounds how many can be open at
+//! once.
+//!
+//! `--nat-udp-mapping endpoint-independent` gives all UDP flows from one
+//! peer address and port the same source port, whatever their destination
+//! (RFC 4787 endpoint-independent mapping), so protocols that learn their
+//! public address from one server and use it with another work behind the
+//! NAT. Each flow still gets its own socket: they share the port through
+//! SO_REUSEPORT and are each connected to their destination, which the
+//! kernel uses to tell their replies apart. Replies are only accepted from
+//! destinations a flow was opened to. Flows through proxies or a WireGuard
+//! egress tunnel are not affected.
+
+use std::collections::HashSet;
+use std::io;
+use std::net::{IpAddr, SocketAddr, UdpSocket};
+use std::ops::RangeInclusive;
+use std::os::fd::{AsRawFd, OwnedFd};
+use std::sync::Arc;
+
+use anyhow::{Context, Result};
+use nix::sys::socket::{
+    bind, setsockopt, socket, sockopt, AddressFamily, SockFlag, SockType, SockaddrStorage,
+};
+use parking_lot::Mutex;
+use rand::Rng;
+use tokio::net::TcpSocket;
+
+/// Most ports tried for one socket before giving up
+const MAX_BIND_ATTEMPTS: usize = 64;
+
+/// How ports are taken from the range
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, clap::ValueEnum)]
+pub enum PortStrategy {
+    #[default]
+    Random,
+    Sequential,
+}
+
+/// How UDP flows from one peer endpoint are mapped to source ports
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, clap::ValueEnum)]
+pub enum UdpMapping {
+    /// A port of its own for every flow
+    #[default]
+    PerFlow,
+    /// One port for every flow from the same peer address and port
+    EndpointIndependent,
+}
+
+/// Parse a `first-last` port range
+pub fn parse_range(range: &str) -> Result<RangeInclusive<u16>> {
+    let (first, last) = range
+        .split_once('-')
+        .with_context(|| format!("port range {} is not first-last", range))?;
+    let first: u16 = first
+        .trim()
+        .parse()
+        .with_context(|| format!("invalid port {}", first))?;
+    let last: u16 = last
+        .trim()
+        .parse()
+        .with_context(|| format!("invalid port {}", last))?;
+    if first == 0 || first > last {
+        anyhow::bail!("port range {} is empty or starts at 0", range);
+    }
+    Ok(first..=last)
+}
+
+/// The configured range and strategy, and the ports UDP mappings hold
+pub struct NatPorts {
+    range: Option<RangeInclusive<u16>>,
+    strategy: PortStrategy,
+    udp_mapping: UdpMapping,
+    /// Offset into the range of the next sequential port
+    next: Mutex<u32>,
+    /// Ports held by endpoint-independent mappings, which no new mapping
+    /// may share
+    mapped: Mutex<HashSet<u16>>,
+}
+
+impl NatPorts {
+    pub fn new(
+        range: Option<RangeInclusive<u16>>,
+        strategy: PortStrategy,
+        udp_mapping: UdpMapping,
+    ) -> Self {
+        Self {
+            range,
+            strategy,
+            udp_mapping,
+            next: Mutex::new(0),
+            mapped: Mutex::new(HashSet::new()),
+        }
+    }
+
+    /// Ports to try binding, in order, or `None` to leave it to the kernel
+    fn candidates(&self) -> Option<Vec<u16>> {
+        let range = self.range.as_ref()?;
+        let size = u32::from(range.end() - range.start()) + 1;
+        let attempts = (size as usize).min(MAX_BIND_ATTEMPTS);
+        let ports = match self.strategy {
+            PortStrategy::Random => {
+                let mut rng = rand::thread_rng();
+                (0..attempts)
+                    .map(|_| rng.gen_range(range.clone()))
+                    .collect()
+            }
+            PortStrategy::Sequential => {
+                let mut next = self.next.lock();
+                let first = *next;
+                *next = (first + attempts as u32) % size;
+                (0..attempts as u32)
+                    .map(|i| range.start() + ((first + i) % size) as u16)
+                    .collect()
+            }
+        };
+        Some(ports)
+    }
+
+    /// Bind a TCP socket to a port from the range, if there is one
+    pub fn bind_tcp(&self, socket: &TcpSocket, ip: IpAddr) -> io::Result<bool> {
+        let Some(ports) = self.candidates() else {
+            return Ok(false);
+        };
+        for port in ports {
+            match socket.bind(SocketAddr::new(ip, port)) {
+                Ok(()) => return Ok(true),
+                Err(e) if e.kind() == io::ErrorKind::AddrInUse => continue,
+                Err(e) => return Err(e),
+            }
+        }
+        Err(exhausted())
+    }
+
+    /// Bind a non-blocking UDP socket on `ip`, calling `setup` on it
+    /// first. Under endpoint-independent mapping the socket joins
+    /// `mapping`'s port if given and it can, or else takes a new port for a
+    /// new mapping, which is returned.
+    pub fn bind_udp(
+        self: &Arc<Self>,
+        ip: IpAddr,
+        mapping: Option<&Arc<PortMapping>>,
+        setup: impl Fn(&OwnedFd) -> io::Result<()>,
+    ) -> io::Result<(UdpSocket, Option<Arc<PortMapping>>)> {
+        let shared = self.endpoint_independent();
+        let new_socket = || -> io::Result<OwnedFd> {
+            let family = match ip {
+                IpAddr::V4(_) => AddressFamily::Inet,
+                IpAddr::V6(_) => AddressFamily::Inet6,
+            };
+            let fd = socket(
+                family,
+                SockType::Datagram,
+                SockFlag::SOCK_NONBLOCK | SockFlag::SOCK_CLOEXEC,
+                None,
+            )?;
+            if shared {
+                setsockopt(&fd, sockopt::ReusePort, &true)?;
+            }
+            setup(&fd)?;
+            Ok(fd)
+        };
+        let bind_port = |fd: &OwnedFd, port: u16| -> io::Result<()> {
+            let addr = SockaddrStorage::from(SocketAddr::new(ip, port));
+            Ok(bind(fd.as_raw_fd(), &addr)?)
+        };
+
+        if let (true, Some(mapping)) = (shared, mapping) {
+            let fd = new_socket()?;
+            if bind_port(&fd, mapping.port).is_ok() {
+                return Ok((UdpSocket::from(fd), Some(Arc::clone(mapping))));
+            }
+            // Something else has the port on this path; give this flow a
+            // mapping of its own
+        }
+
+        let fd = new_socket()?;
+        let Some(ports) = self.candidates() else {
+            bind_port(&fd, 0)?;
+            let socket = UdpSocket::from(fd);
+            let mapping = if shared {
+                Some(self.map(socket.local_addr()?.port())?)
+            } else {
+                None
+            };
+            return Ok((socket, mapping));
+        };
+        for port in ports {
+            // Claimed before binding, so no other mapping can join the port
+            let mapping = if shared {
+                match self.map(port) {
+                    Ok(mapping) => Some(mapping),
+                    Err(_) => continue,
+                }
+            } else {
+                None
+            };
+            match bind_port(&fd, port) {
+                Ok(()) => return Ok((UdpSocket::from(fd), mapping)),
+                Err(e) if e.kind() == io::ErrorKind::AddrInUse => continue,
+                Err(e) => return Err(e),
+            }
+        }
+        Err(exhausted())
+    }
+
+    /// Claim `port` for a new mapping
+    fn map(self: &Arc<Self>, port: u16) -> io::Result<Arc<PortMapping>> {
+        if !self.mapped.lock().insert(port) {
+            return Err(io::ErrorKind::AddrInUse.into());
+        }
+        Ok(Arc::new(PortMapping {
+            port,
+            ports: Arc::clone(self),
+        }))
+    }
+
+    pub fn endpoint_independent(&self) -> bool {
+        self.udp_mapping == UdpMapping::EndpointIndependent
+    }
+}
+
+fn exhausted() -> io::Error {
+    io::Error::new(
+        io::ErrorKind::AddrNotAvailable,
+        "no free port in the NAT port range",
+    )
+}
+
+/// A source port shared by a peer endpoint's UDP flows, released once the
+/// last socket using it is closed
+#[derive(Debug)]
+pub struct PortMapping {
+    port: u16,
+    ports: Arc<NatPorts>,
+}
+
+impl Drop for PortMapping {
+    fn drop(&mut self) {
+        self.ports.mapped.lock().remove(&self.port);
+    }
+}
+
+impl std::fmt::Debug for NatPorts {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("NatPorts")
+            .field("range", &self.range)
+            .field("strategy", &self.strategy)
+            .field("udp_mapping", &self.udp_mapping)
+            .finish()
+    }
+}
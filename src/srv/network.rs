@@ -0,0 +1,145 @@
+//! Client networks
+//!
+//! Peers' addresses come from one network by default, `--server-ip` with
+//! `--subnet-mask`. `--network`, given once for each, lists several
+//! instead, each as the server's own address in it with its prefix length
+//! (`10.200.100.1/24`), so deployments can grow past one prefix. Peers are
+//! given addresses from the first network with room. A network written
+//! `TAG=CIDR` (`ci=10.201.0.1/16`) is kept for peers with that tag, which
+//! are given addresses only from their tags' networks, so address ranges
+//! can be told apart by group in firewall rules and logs.
+//!
+//! The first network is the main one: the HTTP and SOCKS5 proxies, NAT-PMP
+//! and the server's IPv6 address are on its server address. DNS and pings
+//! are answered on every network's, and peers are pointed at the one in
+//! their own network.
+
+use std::net::Ipv4Addr;
+
+use anyhow::{Context, Result};
+
+/// One network peers are given addresses in
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Network {
+    /// The server's own address in the network
+    pub server_ip: Ipv4Addr,
+    pub prefix_len: u8,
+    /// Only peers with this tag are given addresses here
+    pub tag: Option<String>,
+}
+
+impl Network {
+    /// Parse `ADDRESS/LEN`, optionally prefixed by `TAG=`
+    pub fn parse(spec: &str) -> Result<Self> {
+        let (tag, cidr) = match spec.split_once('=') {
+            Some((tag, cidr)) if !tag.is_empty() => (Some(tag.to_string()), cidr),
+            Some(_) => anyhow::bail!("network `{}` has an empty tag", spec),
+            None => (None, spec),
+        };
+        let (address, prefix_len) = cidr
+            .split_once('/')
+            .with_context(|| format!("network `{}` is not ADDRESS/LEN", spec))?;
+        let server_ip: Ipv4Addr = address
+            .parse()
+            .with_context(|| format!("invalid address in network `{}`", spec))?;
+        let prefix_len: u8 = prefix_len
+            .parse()
+            .with_context(|| format!("invalid prefix length in network `{}`", spec))?;
+        Self::new(server_ip, prefix_len, tag)
+    }
+
+    pub fn new(server_ip: Ipv4Addr, prefix_len: u8, tag: Option<String>) -> Result<Self> {
+        // Peers start at the third address, so a /30 is the smallest useful
+        if !(1..=30).contains(&prefix_len) {
+            anyhow::bail!(
+                "network {}/{} must be between /1 and /30",
+                server_ip,
+                prefix_len
+            );
+        }
+        Ok(Self {
+            server_ip,
+            prefix_len,
+            tag,
+        })
+    }
+
+    /// The network's first address
+    pub fn base(&self) -> u32 {
+        u32::from(self.server_ip) & self.mask()
+    }
+
+    /// How many addresses the network spans
+    pub fn size(&self) -> u32 {
+        1 << (32 - self.prefix_len)
+    }
+
+    /// The network's last address, its directed broadcast
+    pub fn broadcast(&self) -> Ipv4Addr {
+        Ipv4Addr::from(self.base() + (self.size() - 1))
+    }
+
+    pub fn contains(&self, ip: Ipv4Addr) -> bool {
+        u32::from(ip) & self.mask() == self.base()
+    }
+
+    fn mask(&self) -> u32 {
+        u32::MAX << (32 - self.prefix_len)
+    }
+}
+
+/// Every client network, the main one first
+#[derive(Debug, Clone)]
+pub struct Networks {
+    networks: Vec<Network>,
+}
+
+impl Networks {
+    /// Check that there is at least one network and that none overlap
+    pub fn new(networks: Vec<Network>) -> Result<Self> {
+        if networks.is_empty() {
+            anyhow::bail!("no client networks");
+        }
+        for (i, network) in networks.iter().enumerate() {
+            let overlapping = networks[..i].iter().find(|other| {
+                let shorter = network.prefix_len.min(other.prefix_len);
+                let mask = u32::MAX << (32 - shorter);
+                u32::from(network.server_ip) & mask == u32::from(other.server_ip) & mask
+            });
+            if let Some(other) = overlapping {
+                anyhow::bail!(
+                    "network {}/{} overlaps {}/{}",
+                    network.server_ip,
+                    network.prefix_len,
+                    other.server_ip,
+                    other.prefix_len
+                );
+            }
+        }
+        Ok(Self { networks })
+    }
+
+    pub fn main(&self) -> &Network {
+        &self.networks[0]
+    }
+
+    pub fn iter(&self) -> impl Iterator<Item = &Network> {
+        self.networks.iter()
+    }
+
+    /// The network `ip` is in, if any
+    pub fn containing(&self, ip: Ipv4Addr) -> Option<&Network> {
+        self.networks.iter().find(|network| network.contains(ip))
+    }
+
+    /// Whether `ip` is one of the server's own addresses
+    pub fn is_server(&self, ip: Ipv4Addr) -> bool {
+        self.networks.iter().any(|network| network.server_ip == ip)
+    }
+
+    /// The server's address in the network of peer address `ip`, or the
+    /// main one
+    pub fn gateway_for(&self, ip: Ipv4Addr) -> Ipv4Addr {
+        self.containing(ip).unwrap_or(self.main()).server_ip
+    }
+}
@@ -0,0 +1,125 @@
+//! NTP service for peers
+//!
+//! With `--ntp` the server answers NTP (and SNTP) requests on its VPN
+//! addresses from the host's own clock, so cages with no other way out can
+//! still set their clocks; a skewed clock otherwise shows up as TLS
+//! certificates that are not yet, or no longer, valid. The host's clock
+//! should itself be kept in sync, by chrony or systemd-timesyncd for
+//! example: while the kernel reports it unsynchronized, answers say so
+//! (leap indicator 3, stratum 16) and clients ignore them rather than take
+//! a wrong time.
+
+use std::net::{IpAddr, SocketAddr};
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use anyhow::{Context, Result};
+use tokio::net::UdpSocket;
+use tracing::{debug, info};
+
+pub const NTP_PORT: u16 = 123;
+
+const PACKET_LEN: usize = 48;
+const MODE_CLIENT: u8 = 3;
+const MODE_SERVER: u8 = 4;
+const LEAP_UNSYNCHRONIZED: u8 = 3;
+/// Stratum answered with while the host's clock is in sync: the host is
+/// taken to follow a stratum 2 server, as public pools mostly are
+const STRATUM: u8 = 3;
+const STRATUM_UNSYNCHRONIZED: u8 = 16;
+/// Seconds from the NTP epoch, 1900, to the Unix epoch
+const NTP_EPOCH_OFFSET: u64 = 2_208_988_800;
+/// Polling interval suggested to clients, as a power of two seconds
+const POLL: u8 = 6;
+/// Clock precision, as a power of two seconds: about a microsecond
+const PRECISION: i8 = -20;
+
+/// What the kernel knows of the host clock's synchronization
+struct ClockStatus {
+    synchronized: bool,
+    /// Largest error the clock may have, in microseconds
+    max_error_us: u64,
+}
+
+fn clock_status() -> ClockStatus {
+    // SAFETY: `timex` is plain data, and `modes` of 0 only reads the state
+    let mut timex: libc::timex = unsafe { std::mem::zeroed() };
+    let state = unsafe { libc::ntp_adjtime(&mut timex) };
+    ClockStatus {
+        synchronized: state != -1 && state != libc::TIME_ERROR,
+        max_error_us: u64::try_from(timex.maxerror).unwrap_or(0),
+    }
+}
+
+/// Answer a client's NTP request to `server_ip` received at `received`, or
+/// `None` if it is not one
+pub fn respond(request: &[u8], received: SystemTime, server_ip: IpAddr) -> Option<Vec<u8>> {
+    if request.len() < PACKET_LEN || request[0] & 0x07 != MODE_CLIENT {
+        return None;
+    }
+    let version = (request[0] >> 3) & 0x07;
+    if !(1..=4).contains(&version) {
+        return None;
+    }
+    let clock = clock_status();
+    let (leap, stratum) = if clock.synchronized {
+        (0, STRATUM)
+    } else {
+        (LEAP_UNSYNCHRONIZED, STRATUM_UNSYNCHRONIZED)
+    };
+
+    let mut response = vec![0u8; PACKET_LEN];
+    response[0] = leap << 6 | version << 3 | MODE_SERVER;
+    response[1] = stratum;
+    response[2] = request[2].clamp(POLL, 17);
+    response[3] = PRECISION as u8;
+    // Root delay stays zero; root dispersion is the clock's error bound,
+    // in seconds as 16.16 fixed point
+    let dispersion = (clock.max_error_us << 16) / 1_000_000;
+    response[8..12].copy_from_slice(&u32::try_from(dispersion).unwrap_or(u32::MAX).to_be_bytes());
+    // The reference ID names the server's own IPv4 address; over IPv6 it
+    // is conventionally a hash, for which a fixed name will do
+    let reference_id = match server_ip {
+        IpAddr::V4(ip) => ip.octets(),
+        IpAddr::V6(_) => *b"LOCL",
+    };
+    response[12..16].copy_from_slice(&reference_id);
+    response[16..24].copy_from_slice(&timestamp(received));
+    // The origin timestamp echoes the client's transmit timestamp
+    response[24..32].copy_from_slice(&request[40..48]);
+    response[32..40].copy_from_slice(&timestamp(received));
+    response[40..48].copy_from_slice(&timestamp(SystemTime::now()));
+    Some(response)
+}
+
+/// `time` in NTP's 64-bit format: seconds since 1900 and a binary fraction
+fn timestamp(time: SystemTime) -> [u8; 8] {
+    let since_unix = time.duration_since(UNIX_EPOCH).unwrap_or_default();
+    let seconds = (since_unix.as_secs() + NTP_EPOCH_OFFSET) as u32;
+    let fraction = ((u64::from(since_unix.subsec_nanos()) << 32) / 1_000_000_000) as u32;
+    let mut bytes = [0u8; 8];
+    bytes[..4].copy_from_slice(&seconds.to_be_bytes());
+    bytes[4..].copy_from_slice(&fraction.to_be_bytes());
+    bytes
+}
+
+/// Answer NTP requests on a socket bound to `addr`, for kernel WireGuard
+/// mode where the dataplane does not see peers' packets
+pub async fn serve(addr: SocketAddr) -> Result<()> {
+    let socket = UdpSocket::bind(addr)
+        .await
+        .with_context(|| format!("failed to bind NTP on {}", addr))?;
+    info!("Serving NTP on {}", addr);
+    let mut buf = [0u8; 512];
+    loop {
+        let (n, client) = socket
+            .recv_from(&mut buf)
+            .await
+            .context("NTP receive failed")?;
+        let Some(response) = respond(&buf[..n], SystemTime::now(), addr.ip()) else {
+            continue;
+        };
+        if let Err(e) = socket.send_to(&response, client).await {
+            debug!("NTP reply to {} failed: {}", client, e);
+        }
+    }
+}
@@ -0,0 +1,643 @@
+//! Obfuscated handshakes, compatible with AmneziaWG
+//!
+//! Deep packet inspection spots WireGuard by its fixed message types and
+//! handshake sizes. `--obfuscation-file` takes AmneziaWG's parameters, for
+//! every peer or for given peers and tags:
+//!
+//! ```toml
+//! [default]
+//! jc = 4
+//! jmin = 40
+//! jmax = 70
+//! s1 = 15
+//! s2 = 45
+//! h1 = 1522531863
+//! h2 = 2028264385
+//! h3 = 1361329402
+//! h4 = 1970137604
+//!
+//! [[profile]]
+//! name = "office"
+//! tags = ["office"]
+//! ```
+//!
+//! `h1` to `h4` replace the message types of handshake initiations,
+//! responses, cookie replies and transport data; `s1` and `s2` are how many
+//! random bytes go in front of initiations and responses; and before each
+//! initiation a client sends `jc` junk datagrams of `jmin` to `jmax` random
+//! bytes, which the server ignores. Parameters left out are WireGuard's own,
+//! so a profile with none, like `office` above, is plain WireGuard, and so
+//! is every peer without a file or a `[default]`. A peer listed by key gets
+//! that profile; otherwise it gets the first naming one of its tags.
+//!
+//! A packet is read by whichever profile it fits, and only the peers given
+//! that profile are tried on it, so profiles must not share a header value
+//! unless they are alike on the wire. Replies and packets to a peer are
+//! written with its profile. The wirecage client is handed its profile when
+//! it registers, and generated wg-quick configs carry it for AmneziaWG
+//! clients. The file is re-read on SIGHUP or `POST /v1/reload`.
+
+use std::borrow::Cow;
+use std::collections::HashMap;
+use std::fmt;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use anyhow::{Context, Result};
+use base64::Engine;
+use parking_lot::{Mutex, RwLock};
+use rand::RngCore;
+use serde::Deserialize;
+use tracing::info;
+
+use super::cookie::INITIATION_LEN;
+use super::state::SharedState;
+use super::wg_mac::{mac1_matches, seal_mac1};
+
+/// Sizes of the other WireGuard messages, by type
+const RESPONSE_LEN: usize = 92;
+const COOKIE_REPLY_LEN: usize = 64;
+/// Header and authentication tag of a transport message with no payload
+const MIN_TRANSPORT_LEN: usize = 32;
+/// Largest datagram AmneziaWG keeps handshakes and junk under
+const MAX_DATAGRAM: u16 = 1280;
+const MAX_JUNK_COUNT: u8 = 128;
+/// How long a peer's resolved profile is used before its tags are checked
+/// again
+const RESOLVE_INTERVAL: Duration = Duration::from_secs(10);
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct ObfuscationFile {
+    default: Option<ParamsEntry>,
+    #[serde(default)]
+    profile: Vec<ProfileEntry>,
+}
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct ParamsEntry {
+    jc: Option<u8>,
+    jmin: Option<u16>,
+    jmax: Option<u16>,
+    s1: Option<u16>,
+    s2: Option<u16>,
+    h1: Option<u32>,
+    h2: Option<u32>,
+    h3: Option<u32>,
+    h4: Option<u32>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct ProfileEntry {
+    name: String,
+    #[serde(default)]
+    peers: Vec<String>,
+    #[serde(default)]
+    tags: Vec<String>,
+    jc: Option<u8>,
+    jmin: Option<u16>,
+    jmax: Option<u16>,
+    s1: Option<u16>,
+    s2: Option<u16>,
+    h1: Option<u32>,
+    h2: Option<u32>,
+    h3: Option<u32>,
+    h4: Option<u32>,
+}
+
+impl ProfileEntry {
+    fn params(&self) -> ParamsEntry {
+        ParamsEntry {
+            jc: self.jc,
+            jmin: self.jmin,
+            jmax: self.jmax,
+            s1: self.s1,
+            s2: self.s2,
+            h1: self.h1,
+            h2: self.h2,
+            h3: self.h3,
+            h4: self.h4,
+        }
+    }
+}
+
+/// One set of AmneziaWG parameters
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Params {
+    pub junk_count: u8,
+    pub junk_min: u16,
+    pub junk_max: u16,
+    pub initiation_padding: u16,
+    pub response_padding: u16,
+    /// Message types of initiations, responses, cookie replies and
+    /// transport data
+    pub headers: [u32; 4],
+}
+
+impl Default for Params {
+    /// Plain WireGuard
+    fn default() -> Self {
+        Self {
+            junk_count: 0,
+            junk_min: 0,
+            junk_max: 0,
+            initiation_padding: 0,
+            response_padding: 0,
+            headers: [1, 2, 3, 4],
+        }
+    }
+}
+
+impl Params {
+    fn parse(entry: &ParamsEntry) -> Result<Self> {
+        let plain = Params::default();
+        let params = Params {
+            junk_count: entry.jc.unwrap_or(plain.junk_count),
+            junk_min: entry.jmin.unwrap_or(plain.junk_min),
+            junk_max: entry.jmax.unwrap_or(plain.junk_max),
+            initiation_padding: entry.s1.unwrap_or(plain.initiation_padding),
+            response_padding: entry.s2.unwrap_or(plain.response_padding),
+            headers: [
+                entry.h1.unwrap_or(plain.headers[0]),
+                entry.h2.unwrap_or(plain.headers[1]),
+                entry.h3.unwrap_or(plain.headers[2]),
+                entry.h4.unwrap_or(plain.headers[3]),
+            ],
+        };
+        if params.junk_count > MAX_JUNK_COUNT {
+            anyhow::bail!("jc must be at most {}", MAX_JUNK_COUNT);
+        }
+        if params.junk_min > params.junk_max || params.junk_max > MAX_DATAGRAM {
+            anyhow::bail!(
+                "jmin must be at most jmax, and jmax at most {}",
+                MAX_DATAGRAM
+            );
+        }
+        if usize::from(params.initiation_padding) + INITIATION_LEN > usize::from(MAX_DATAGRAM)
+            || usize::from(params.response_padding) + RESPONSE_LEN > usize::from(MAX_DATAGRAM)
+        {
+            anyhow::bail!(
+                "s1 and s2 must keep handshakes within {} bytes",
+                MAX_DATAGRAM
+            );
+        }
+        // Otherwise a padded initiation could pass for a response
+        if usize::from(params.initiation_padding) + INITIATION_LEN
+            == usize::from(params.response_padding) + RESPONSE_LEN
+        {
+            anyhow::bail!("s1 + 56 must not equal s2");
+        }
+        let headers = params.headers;
+        if (1..4).any(|i| headers[..i].contains(&headers[i])) {
+            anyhow::bail!("h1 to h4 must all differ");
+        }
+        Ok(params)
+    }
+
+    pub fn is_plain(&self) -> bool {
+        *self == Params::default()
+    }
+
+    /// Whether packets in the two are read the same way; junk is the
+    /// client's alone
+    fn same_wire(&self, other: &Params) -> bool {
+        self.initiation_padding == other.initiation_padding
+            && self.response_padding == other.response_padding
+            && self.headers == other.headers
+    }
+
+    /// The header value of `kind`'s messages, by WireGuard message type,
+    /// and the padding in front of them
+    fn framing(&self, kind: u8) -> Option<(u32, usize)> {
+        let header = *self.headers.get(usize::from(kind).checked_sub(1)?)?;
+        let padding = match kind {
+            1 => self.initiation_padding,
+            2 => self.response_padding,
+            _ => 0,
+        };
+        Some((header, usize::from(padding)))
+    }
+
+    /// Why packets could be read by both, if they could
+    fn conflict(&self, other: &Params) -> Option<&'static str> {
+        let names = ["h1", "h2", "h3", "h4"];
+        (1..=4u8).find_map(|kind| {
+            (self.framing(kind)? == other.framing(kind)?).then_some(names[usize::from(kind) - 1])
+        })
+    }
+
+    /// Rewrite a WireGuard message to go out: its type replaced and, for
+    /// handshakes, random bytes put in front and its mac1 made again for
+    /// `receiver`'s public key, as AmneziaWG makes it over the new header
+    pub fn encode(&self, message: &mut Vec<u8>, receiver: Option<&[u8; 32]>) {
+        let Some(kind) = message.first().copied() else {
+            return;
+        };
+        let Some((header, padding)) = self.framing(kind) else {
+            return;
+        };
+        if (header == u32::from(kind) && padding == 0) || message.len() < 4 {
+            return;
+        }
+        message[..4].copy_from_slice(&header.to_le_bytes());
+        if let (true, Some(receiver)) = (is_handshake(kind), receiver) {
+            seal_mac1(message, receiver);
+        }
+        if padding > 0 {
+            let mut junk = vec![0u8; padding];
+            rand::thread_rng().fill_bytes(&mut junk);
+            message.splice(0..0, junk);
+        }
+    }
+
+    /// The WireGuard message type of a packet written with these
+    /// parameters, and the message as sent, without its padding
+    fn read<'a>(&self, packet: &'a [u8]) -> Option<(u8, &'a [u8])> {
+        (1..=4u8).find_map(|kind| {
+            let (header, padding) = self.framing(kind)?;
+            let message = packet.get(padding..)?;
+            let fits = match kind {
+                1 => message.len() == INITIATION_LEN,
+                2 => message.len() == RESPONSE_LEN,
+                3 => message.len() == COOKIE_REPLY_LEN,
+                _ => message.len() >= MIN_TRANSPORT_LEN,
+            };
+            (fits && message[..4] == header.to_le_bytes()).then_some((kind, message))
+        })
+    }
+}
+
+fn is_handshake(kind: u8) -> bool {
+    kind == 1 || kind == 2
+}
+
+/// A message read from a received packet
+pub struct Received<'a> {
+    /// WireGuard message type
+    pub kind: u8,
+    /// The message as sent, without any padding
+    pub message: &'a [u8],
+    /// The profile it was written with
+    pub params: Arc<Params>,
+}
+
+impl<'a> Received<'a> {
+    /// The message as WireGuard writes it. A handshake's mac1 is checked
+    /// against each of `receivers`, the server's public keys, and made
+    /// again over WireGuard's header for the one it was made for; `None` if
+    /// it was made for none of them.
+    pub fn to_wireguard(&self, receivers: &[[u8; 32]]) -> Option<Cow<'a, [u8]>> {
+        let (header, _) = self.params.framing(self.kind)?;
+        if header == u32::from(self.kind) {
+            return Some(Cow::Borrowed(self.message));
+        }
+        let mut message = self.message.to_vec();
+        message[..4].copy_from_slice(&u32::from(self.kind).to_le_bytes());
+        if is_handshake(self.kind) {
+            let receiver = receivers
+                .iter()
+                .find(|key| mac1_matches(self.message, key))?;
+            seal_mac1(&mut message, receiver);
+        }
+        Some(Cow::Owned(message))
+    }
+}
+
+impl fmt::Display for Params {
+    /// As handed to the wirecage client
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "jc={},jmin={},jmax={},s1={},s2={},h1={},h2={},h3={},h4={}",
+            self.junk_count,
+            self.junk_min,
+            self.junk_max,
+            self.initiation_padding,
+            self.response_padding,
+            self.headers[0],
+            self.headers[1],
+            self.headers[2],
+            self.headers[3]
+        )
+    }
+}
+
+struct ProfileSet {
+    default: Arc<Params>,
+    by_peer: HashMap<[u8; 32], Arc<Params>>,
+    /// In file order, so the first profile naming one of a peer's tags wins
+    by_tag: Vec<(String, Arc<Params>)>,
+    /// One of each way packets are written, to read them by
+    wires: Vec<Arc<Params>>,
+    profiles: usize,
+}
+
+impl Default for ProfileSet {
+    /// Every peer plain WireGuard
+    fn default() -> Self {
+        Self {
+            default: Arc::default(),
+            by_peer: HashMap::new(),
+            by_tag: Vec::new(),
+            wires: vec![Arc::default()],
+            profiles: 0,
+        }
+    }
+}
+
+impl ProfileSet {
+    fn read(path: &str) -> Result<Self> {
+        let contents = std::fs::read_to_string(path)
+            .with_context(|| format!("failed to read obfuscation file {}", path))?;
+        let file: ObfuscationFile = toml::from_str(&contents)
+            .with_context(|| format!("failed to parse obfuscation file {}", path))?;
+
+        let default = match &file.default {
+            Some(entry) => Params::parse(entry).context("invalid default obfuscation")?,
+            None => Params::default(),
+        };
+        let default = Arc::new(default);
+        let mut set = ProfileSet {
+            default: Arc::clone(&default),
+            by_peer: HashMap::new(),
+            by_tag: Vec::new(),
+            wires: Vec::new(),
+            profiles: file.profile.len(),
+        };
+        set.add_wire(&default, "default")?;
+        for entry in &file.profile {
+            let params = Params::parse(&entry.params())
+                .with_context(|| format!("invalid obfuscation profile `{}`", entry.name))?;
+            let params = Arc::new(params);
+            set.add_wire(&params, &entry.name)?;
+            for peer in &entry.peers {
+                let pubkey = decode_public_key(peer).with_context(|| {
+                    format!("invalid peer key in obfuscation profile `{}`", entry.name)
+                })?;
+                if set.by_peer.insert(pubkey, Arc::clone(&params)).is_some() {
+                    anyhow::bail!("peer {} appears in more than one obfuscation profile", peer);
+                }
+            }
+            for tag in &entry.tags {
+                set.by_tag.push((tag.clone(), Arc::clone(&params)));
+            }
+            info!(
+                "Loaded obfuscation profile `{}` for {} peers and {} tags",
+                entry.name,
+                entry.peers.len(),
+                entry.tags.len()
+            );
+        }
+        Ok(set)
+    }
+
+    /// Read packets written with `params`, unless another profile already
+    /// does or would confuse them
+    fn add_wire(&mut self, params: &Arc<Params>, name: &str) -> Result<()> {
+        for wire in &self.wires {
+            if wire.same_wire(params) {
+                return Ok(());
+            }
+            if let Some(header) = wire.conflict(params) {
+                anyhow::bail!(
+                    "obfuscation profile `{}` shares its {} with another profile",
+                    name,
+                    header
+                );
+            }
+        }
+        self.wires.push(Arc::clone(params));
+        Ok(())
+    }
+}
+
+/// The obfuscation profiles in force, replaced as a whole on reload
+#[derive(Default)]
+pub struct Obfuscation {
+    path: Option<String>,
+    shared: Option<Arc<SharedState>>,
+    set: RwLock<Arc<ProfileSet>>,
+    /// Each peer's profile, and when its tags were last looked at
+    resolved: Mutex<HashMap<[u8; 32], (Arc<Params>, Instant)>>,
+}
+
+impl Obfuscation {
+    /// Profiles from an optional TOML file; without one, every peer is
+    /// plain WireGuard
+    pub fn load(path: Option<&str>, shared: Arc<SharedState>) -> Result<Self> {
+        let set = match path {
+            Some(path) => ProfileSet::read(path)?,
+            None => ProfileSet::default(),
+        };
+        Ok(Self {
+            path: path.map(str::to_string),
+            shared: Some(shared),
+            set: RwLock::new(Arc::new(set)),
+            resolved: Mutex::new(HashMap::new()),
+        })
+    }
+
+    pub fn is_configured(&self) -> bool {
+        self.path.is_some()
+    }
+
+    /// Re-read the profile file, keeping the current profiles if it is
+    /// invalid. Returns the number of profiles.
+    pub fn reload(&self) -> Result<usize> {
+        let Some(path) = &self.path else {
+            anyhow::bail!("no --obfuscation-file configured");
+        };
+        let set = ProfileSet::read(path)?;
+        let count = set.profiles;
+        *self.set.write() = Arc::new(set);
+        self.resolved.lock().clear();
+        info!("Reloaded {} obfuscation profiles from {}", count, path);
+        Ok(count)
+    }
+
+    /// The profile a peer's packets are written with
+    pub fn params(&self, peer: &[u8; 32]) -> Arc<Params> {
+        let set = Arc::clone(&self.set.read());
+        if set.by_peer.is_empty() && set.by_tag.is_empty() {
+            return Arc::clone(&set.default);
+        }
+        let now = Instant::now();
+        let mut resolved = self.resolved.lock();
+        if let Some((params, at)) = resolved.get(peer) {
+            if now.duration_since(*at) < RESOLVE_INTERVAL {
+                return Arc::clone(params);
+            }
+        }
+        let params = set.by_peer.get(peer).cloned().or_else(|| {
+            let tags = self.shared.as_ref()?.peer_tags(peer);
+            set.by_tag
+                .iter()
+                .find(|(tag, _)| tags.contains(tag))
+                .map(|(_, params)| Arc::clone(params))
+        });
+        let params = params.unwrap_or_else(|| Arc::clone(&set.default));
+        resolved.retain(|_, (_, at)| now.duration_since(*at) < RESOLVE_INTERVAL);
+        resolved.insert(*peer, (Arc::clone(&params), now));
+        params
+    }
+
+    /// The message in a received packet, by the profile that reads it;
+    /// `None` for junk and anything else no profile reads
+    pub fn read<'a>(&self, packet: &'a [u8]) -> Option<Received<'a>> {
+        let set = Arc::clone(&self.set.read());
+        set.wires.iter().find_map(|params| {
+            let (kind, message) = params.read(packet)?;
+            Some(Received {
+                kind,
+                message,
+                params: Arc::clone(params),
+            })
+        })
+    }
+
+    /// Whether packets written with `params` may be from `peer`
+    pub fn accepts(&self, peer: &[u8; 32], params: &Params) -> bool {
+        self.params(peer).same_wire(params)
+    }
+
+    /// A peer's parameters to hand to its client, unless it is plain
+    /// WireGuard
+    pub fn for_client(&self, peer: &[u8; 32]) -> Option<Arc<Params>> {
+        Some(self.params(peer)).filter(|params| !params.is_plain())
+    }
+}
+
+fn decode_public_key(key: &str) -> Result<[u8; 32]> {
+    let bytes = base64::engine::general_purpose::STANDARD
+        .decode(key.trim())
+        .context("not valid base64")?;
+    bytes
+        .try_into()
+        .map_err(|_| anyhow::anyhow!("public key must be 32 bytes"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    use crate::client_obfuscation;
+    use crate::cookie::mac1_valid;
+    use crate::wgconf;
+
+    fn params() -> Arc<Params> {
+        let entry = ParamsEntry {
+            jc: Some(4),
+            jmin: Some(40),
+            jmax: Some(70),
+            s1: Some(15),
+            s2: Some(45),
+            h1: Some(1522531863),
+            h2: Some(2028264385),
+            h3: Some(1361329402),
+            h4: Some(1970137604),
+        };
+        Arc::new(Params::parse(&entry).unwrap())
+    }
+
+    /// A server giving every peer `params`
+    fn server(params: &Arc<Params>) -> Obfuscation {
+        let mut set = ProfileSet {
+            default: Arc::clone(params),
+            wires: Vec::new(),
+            ..Default::default()
+        };
+        set.add_wire(params, "default").unwrap();
+        Obfuscation {
+            set: RwLock::new(Arc::new(set)),
+            ..Default::default()
+        }
+    }
+
+    /// A WireGuard message of `kind` and `len` bytes, with a handshake's
+    /// mac1 made for `receiver`
+    fn message(kind: u8, len: usize, receiver: &[u8; 32]) -> Vec<u8> {
+        let mut message = vec![0u8; len];
+        rand::thread_rng().fill_bytes(&mut message);
+        message[..4].copy_from_slice(&[kind, 0, 0, 0]);
+        if is_handshake(kind) {
+            seal_mac1(&mut message, receiver);
+        }
+        message
+    }
+
+    #[test]
+    fn client_messages_read_back() {
+        let server_key = wgconf::generate_key();
+        let client_key = wgconf::generate_key();
+        let params = params();
+        let client = client_obfuscation::Obfuscation::new(
+            params.to_string().parse().unwrap(),
+            server_key.public_key,
+            client_key.public_key,
+        );
+        let server = server(&params);
+
+        let initiation = message(1, INITIATION_LEN, &server_key.public_key);
+        let packet = client.encode(&initiation);
+        assert_eq!(packet.len(), 15 + INITIATION_LEN);
+        let received = server.read(&packet).expect("an initiation");
+        assert_eq!(received.kind, 1);
+        assert_eq!(received.params, params);
+
+        // mac1 was made over the client's header and is made again over
+        // WireGuard's, for whichever of the server's keys it was made for
+        let other_key = wgconf::generate_key().public_key;
+        let restored = received
+            .to_wireguard(&[other_key, server_key.public_key])
+            .expect("mac1 made for one of the server's keys");
+        assert_eq!(restored[..], initiation[..]);
+        assert!(mac1_valid(&restored, &server_key.public_key));
+        assert!(received.to_wireguard(&[other_key]).is_none());
+
+        let transport = message(4, 80, &server_key.public_key);
+        let packet = client.encode(&transport);
+        let received = server.read(&packet).expect("transport data");
+        assert_eq!(received.kind, 4);
+        assert_eq!(received.to_wireguard(&[]).unwrap()[..], transport[..]);
+
+        for junk in client.junk() {
+            assert!(server.read(&junk).is_none());
+        }
+    }
+
+    #[test]
+    fn server_messages_read_back() {
+        let server_key = wgconf::generate_key();
+        let client_key = wgconf::generate_key();
+        let params = params();
+        let client = client_obfuscation::Obfuscation::new(
+            params.to_string().parse().unwrap(),
+            server_key.public_key,
+            client_key.public_key,
+        );
+
+        let response = message(2, RESPONSE_LEN, &client_key.public_key);
+        let mut packet = response.clone();
+        params.encode(&mut packet, Some(&client_key.public_key));
+        assert_eq!(packet.len(), 45 + RESPONSE_LEN);
+        let len = packet.len();
+        assert_eq!(client.decode(&mut packet, len), Some(RESPONSE_LEN));
+        assert_eq!(packet[..RESPONSE_LEN], response[..]);
+
+        // A response whose mac1 was made for someone else is dropped
+        let mut packet = response.clone();
+        params.encode(&mut packet, Some(&server_key.public_key));
+        let len = packet.len();
+        assert_eq!(client.decode(&mut packet, len), None);
+
+        let transport = message(4, 80, &client_key.public_key);
+        let mut packet = transport.clone();
+        params.encode(&mut packet, None);
+        assert_ne!(packet, transport);
+        let len = packet.len();
+        assert_eq!(client.decode(&mut packet, len), Some(transport.len()));
+        assert_eq!(packet, transport);
+    }
+}
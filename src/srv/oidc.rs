@@ -0,0 +1,385 @@
+//! OpenID Connect enrollment
+//!
+//! With `--oidc-issuer` set, clients can register with an ID token from the
+//! organisation's identity provider in place of the server or an enrollment
+//! token. Tokens are verified against the issuer's published signing keys,
+//! and their claims decide the peer's name and tags.
+
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+use anyhow::{Context, Result};
+use aws_lc_rs::signature::{self, RsaPublicKeyComponents, UnparsedPublicKey};
+use base64::Engine;
+use parking_lot::RwLock;
+use serde::Deserialize;
+use tracing::{debug, info};
+
+/// Allowed clock skew when checking `exp` and `nbf`
+const CLOCK_SKEW: Duration = Duration::from_secs(60);
+
+/// Minimum time between key refreshes triggered by unknown key IDs
+const JWKS_REFRESH_INTERVAL: Duration = Duration::from_secs(60);
+
+const HTTP_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// How ID tokens are checked and mapped onto peers
+pub struct OidcSettings {
+    pub issuer: String,
+    /// Expected `aud`, normally the OIDC client ID
+    pub audience: String,
+    /// Claim used as the peer name
+    pub name_claim: String,
+    /// Claim listing the user's groups, which become peer tags
+    pub groups_claim: String,
+    /// If non-empty, only members of one of these groups may enroll
+    pub allowed_groups: Vec<String>,
+    /// Remove peers when the ID token they enrolled with expires
+    pub expire_peers: bool,
+}
+
+/// The identity an ID token vouches for
+#[derive(Debug, Clone)]
+pub struct OidcIdentity {
+    pub subject: String,
+    /// Value of the configured name claim, if present
+    pub name: Option<String>,
+    pub groups: Vec<String>,
+    pub expires_at: SystemTime,
+}
+
+#[derive(Deserialize)]
+struct Discovery {
+    issuer: String,
+    jwks_uri: String,
+}
+
+#[derive(Deserialize)]
+struct JwkSet {
+    keys: Vec<Jwk>,
+}
+
+#[derive(Deserialize)]
+struct Jwk {
+    kty: String,
+    #[serde(default)]
+    kid: Option<String>,
+    #[serde(default, rename = "use")]
+    key_use: Option<String>,
+    #[serde(default)]
+    n: Option<String>,
+    #[serde(default)]
+    e: Option<String>,
+    #[serde(default)]
+    crv: Option<String>,
+    #[serde(default)]
+    x: Option<String>,
+    #[serde(default)]
+    y: Option<String>,
+}
+
+#[derive(Deserialize)]
+struct JwtHeader {
+    alg: String,
+    #[serde(default)]
+    kid: Option<String>,
+}
+
+enum VerifyingKey {
+    Rsa { n: Vec<u8>, e: Vec<u8> },
+    /// Uncompressed P-256 point
+    EcP256(Vec<u8>),
+}
+
+impl VerifyingKey {
+    fn verify(&self, alg: &str, message: &[u8], sig: &[u8]) -> bool {
+        match (self, alg) {
+            (VerifyingKey::Rsa { n, e }, "RS256" | "RS384" | "RS512") => {
+                let params = match alg {
+                    "RS256" => &signature::RSA_PKCS1_2048_8192_SHA256,
+                    "RS384" => &signature::RSA_PKCS1_2048_8192_SHA384,
+                    _ => &signature::RSA_PKCS1_2048_8192_SHA512,
+                };
+                RsaPublicKeyComponents {
+                    n: n.as_slice(),
+                    e: e.as_slice(),
+                }
+                .verify(params, message, sig)
+                .is_ok()
+            }
+            (VerifyingKey::EcP256(point), "ES256") => {
+                UnparsedPublicKey::new(&signature::ECDSA_P256_SHA256_FIXED, point)
+                    .verify(message, sig)
+                    .is_ok()
+            }
+            _ => false,
+        }
+    }
+}
+
+struct KeyCache {
+    keys: Vec<(Option<String>, VerifyingKey)>,
+    fetched_at: Instant,
+}
+
+pub struct OidcVerifier {
+    settings: OidcSettings,
+    /// Issuer exactly as the provider reports it, which `iss` must match
+    issuer: String,
+    jwks_uri: String,
+    client: reqwest::Client,
+    keys: RwLock<KeyCache>,
+}
+
+impl OidcVerifier {
+    /// Look up the issuer's signing keys through OIDC discovery
+    pub async fn discover(settings: OidcSettings) -> Result<Self> {
+        let client = reqwest::Client::builder().timeout(HTTP_TIMEOUT).build()?;
+        let url = format!(
+            "{}/.well-known/openid-configuration",
+            settings.issuer.trim_end_matches('/')
+        );
+        let discovery: Discovery = client
+            .get(&url)
+            .send()
+            .await
+            .and_then(|response| response.error_for_status())
+            .with_context(|| format!("failed to fetch {}", url))?
+            .json()
+            .await
+            .with_context(|| format!("invalid discovery document at {}", url))?;
+        if discovery.issuer.trim_end_matches('/') != settings.issuer.trim_end_matches('/') {
+            anyhow::bail!("{} describes issuer {}", url, discovery.issuer);
+        }
+
+        let keys = fetch_keys(&client, &discovery.jwks_uri).await?;
+        info!(
+            "Loaded {} OIDC signing keys from {}",
+            keys.len(),
+            discovery.jwks_uri
+        );
+        Ok(Self {
+            settings,
+            issuer: discovery.issuer,
+            jwks_uri: discovery.jwks_uri,
+            client,
+            keys: RwLock::new(KeyCache {
+                keys,
+                fetched_at: Instant::now(),
+            }),
+        })
+    }
+
+    pub fn settings(&self) -> &OidcSettings {
+        &self.settings
+    }
+
+    /// Check an ID token's signature and claims
+    pub async fn verify(&self, token: &str) -> Result<OidcIdentity> {
+        let (message, sig) = token.rsplit_once('.').context("not a JWT")?;
+        let (header, payload) = message.split_once('.').context("not a JWT")?;
+        let b64 = &base64::engine::general_purpose::URL_SAFE_NO_PAD;
+        let header: JwtHeader = serde_json::from_slice(&b64.decode(header)?)
+            .context("invalid JWT header")?;
+        let sig = b64.decode(sig).context("invalid JWT signature encoding")?;
+
+        let verified = match self.check_signature(&header, message.as_bytes(), &sig) {
+            Some(verified) => verified,
+            // The provider may have rotated keys since they were fetched
+            None if self.refresh_keys().await? => self
+                .check_signature(&header, message.as_bytes(), &sig)
+                .context("no signing key matches the token")?,
+            None => anyhow::bail!("no signing key matches the token"),
+        };
+        if !verified {
+            anyhow::bail!("bad signature");
+        }
+
+        let claims: serde_json::Value =
+            serde_json::from_slice(&b64.decode(payload)?).context("invalid JWT claims")?;
+        self.check_claims(&claims)
+    }
+
+    /// Verify with the keys matching the token's key ID, or None if there are none
+    fn check_signature(&self, header: &JwtHeader, message: &[u8], sig: &[u8]) -> Option<bool> {
+        let cache = self.keys.read();
+        let mut candidates = cache
+            .keys
+            .iter()
+            .filter(|(kid, _)| header.kid.is_none() || *kid == header.kid)
+            .peekable();
+        candidates.peek()?;
+        Some(candidates.any(|(_, key)| key.verify(&header.alg, message, sig)))
+    }
+
+    /// Refetch the signing keys, unless they were fetched very recently
+    async fn refresh_keys(&self) -> Result<bool> {
+        if self.keys.read().fetched_at.elapsed() < JWKS_REFRESH_INTERVAL {
+            return Ok(false);
+        }
+        let keys = fetch_keys(&self.client, &self.jwks_uri).await?;
+        debug!("Refreshed {} OIDC signing keys", keys.len());
+        *self.keys.write() = KeyCache {
+            keys,
+            fetched_at: Instant::now(),
+        };
+        Ok(true)
+    }
+
+    fn check_claims(&self, claims: &serde_json::Value) -> Result<OidcIdentity> {
+        let now = SystemTime::now();
+        if claims["iss"].as_str() != Some(self.issuer.as_str()) {
+            anyhow::bail!("unexpected issuer");
+        }
+        let audience = self.settings.audience.as_str();
+        let audience_ok = match &claims["aud"] {
+            serde_json::Value::String(aud) => aud == audience,
+            serde_json::Value::Array(auds) => auds.iter().any(|aud| aud.as_str() == Some(audience)),
+            _ => false,
+        };
+        if !audience_ok {
+            anyhow::bail!("token is not for audience {}", audience);
+        }
+        let exp = claims["exp"].as_u64().context("missing exp claim")?;
+        let expires_at = UNIX_EPOCH
+            .checked_add(Duration::from_secs(exp))
+            .context("exp claim out of range")?;
+        let expired = expires_at
+            .checked_add(CLOCK_SKEW)
+            .context("exp claim out of range")?
+            <= now;
+        if expired {
+            anyhow::bail!("token expired");
+        }
+        if let Some(nbf) = claims["nbf"].as_u64() {
+            let valid_from = UNIX_EPOCH
+                .checked_add(Duration::from_secs(nbf))
+                .context("nbf claim out of range")?;
+            if now
+                .checked_add(CLOCK_SKEW)
+                .map_or(true, |latest| valid_from > latest)
+            {
+                anyhow::bail!("token not yet valid");
+            }
+        }
+
+        let subject = claims["sub"].as_str().context("missing sub claim")?;
+        let groups: Vec<String> = match &claims[self.settings.groups_claim.as_str()] {
+            serde_json::Value::String(group) => vec![group.clone()],
+            serde_json::Value::Array(groups) => groups
+                .iter()
+                .filter_map(|group| group.as_str().map(str::to_string))
+                .collect(),
+            _ => Vec::new(),
+        };
+        if !self.settings.allowed_groups.is_empty()
+            && !groups.iter().any(|group| self.settings.allowed_groups.contains(group))
+        {
+            anyhow::bail!("{} is not in an allowed group", subject);
+        }
+
+        Ok(OidcIdentity {
+            subject: subject.to_string(),
+            name: claims[self.settings.name_claim.as_str()]
+                .as_str()
+                .map(str::to_string),
+            groups,
+            expires_at,
+        })
+    }
+}
+
+/// Whether a registration token looks like a JWT rather than a plain secret
+pub fn is_jwt(token: &str) -> bool {
+    token.split('.').count() == 3
+}
+
+async fn fetch_keys(
+    client: &reqwest::Client,
+    jwks_uri: &str,
+) -> Result<Vec<(Option<String>, VerifyingKey)>> {
+    let set: JwkSet = client
+        .get(jwks_uri)
+        .send()
+        .await
+        .and_then(|response| response.error_for_status())
+        .with_context(|| format!("failed to fetch {}", jwks_uri))?
+        .json()
+        .await
+        .with_context(|| format!("invalid JWKS at {}", jwks_uri))?;
+
+    let b64 = &base64::engine::general_purpose::URL_SAFE_NO_PAD;
+    let keys: Vec<_> = set
+        .keys
+        .into_iter()
+        .filter(|jwk| jwk.key_use.as_deref().is_none_or(|key_use| key_use == "sig"))
+        .filter_map(|jwk| {
+            let key = match (jwk.kty.as_str(), jwk.crv.as_deref()) {
+                ("RSA", _) => VerifyingKey::Rsa {
+                    n: b64.decode(jwk.n.as_ref()?).ok()?,
+                    e: b64.decode(jwk.e.as_ref()?).ok()?,
+                },
+                ("EC", Some("P-256")) => {
+                    let mut point = vec![0x04];
+                    point.extend(b64.decode(jwk.x.as_ref()?).ok()?);
+                    point.extend(b64.decode(jwk.y.as_ref()?).ok()?);
+                    VerifyingKey::EcP256(point)
+                }
+                _ => return None,
+            };
+            Some((jwk.kid, key))
+        })
+        .collect();
+    if keys.is_empty() {
+        anyhow::bail!("{} has no usable signing keys", jwks_uri);
+    }
+    Ok(keys)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn verifier() -> OidcVerifier {
+        OidcVerifier {
+            settings: OidcSettings {
+                issuer: "https://issuer.example".to_string(),
+                audience: "wirecage".to_string(),
+                name_claim: "name".to_string(),
+                groups_claim: "groups".to_string(),
+                allowed_groups: Vec::new(),
+                expire_peers: false,
+            },
+            issuer: "https://issuer.example".to_string(),
+            jwks_uri: "https://issuer.example/jwks".to_string(),
+            client: reqwest::Client::new(),
+            keys: RwLock::new(KeyCache {
+                keys: Vec::new(),
+                fetched_at: Instant::now(),
+            }),
+        }
+    }
+
+    fn claims(exp: u64, nbf: u64) -> serde_json::Value {
+        serde_json::json!({
+            "iss": "https://issuer.example",
+            "aud": "wirecage",
+            "sub": "alice",
+            "exp": exp,
+            "nbf": nbf,
+        })
+    }
+
+    #[test]
+    fn out_of_range_times_are_rejected() {
+        let verifier = verifier();
+        let now = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .unwrap()
+            .as_secs();
+        assert!(verifier.check_claims(&claims(now + 3600, now)).is_ok());
+        assert!(verifier.check_claims(&claims(u64::MAX, now)).is_err());
+        assert!(verifier
+            .check_claims(&claims(now + 3600, u64::MAX))
+            .is_err());
+    }
+}
@@ -0,0 +1,371 @@
+//! OpenTelemetry export for wirecagesrv
+//!
+//! With `--otlp-endpoint`, the same metrics served on `/metrics` are pushed
+//! to an OTLP/HTTP collector every export interval, and each forwarded NAT
+//! flow is traced: a `flow` span from when the flow opens until it closes,
+//! with `dial` and `relay` child spans for connecting to the destination
+//! and for relaying data. Payloads use the OTLP JSON encoding, which every
+//! collector accepts on `/v1/metrics` and `/v1/traces`.
+
+use std::sync::Arc;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::{Context, Result};
+use reqwest::header::{HeaderMap, HeaderName, HeaderValue};
+use serde_json::{json, Value};
+use tokio::sync::mpsc;
+use tracing::{debug, warn};
+
+use super::metrics::{self, Kind, DNS_LATENCY_HELP, DNS_LATENCY_NAME};
+use super::state::SharedState;
+use super::wg::WgIo;
+
+const HTTP_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Finished spans queued for export before new ones are dropped
+const SPAN_QUEUE_LEN: usize = 4096;
+
+/// Most spans sent in one request
+const MAX_SPAN_BATCH: usize = 512;
+
+/// How often queued spans are sent even if the batch is not full
+const SPAN_FLUSH_INTERVAL: Duration = Duration::from_secs(5);
+
+/// OTLP span kinds
+const SPAN_KIND_INTERNAL: u8 = 1;
+const SPAN_KIND_CLIENT: u8 = 3;
+
+/// OTLP status code for a failed span
+const STATUS_ERROR: u8 = 2;
+
+/// OTLP cumulative aggregation temporality
+const CUMULATIVE: u8 = 2;
+
+pub struct OtlpSettings {
+    /// Collector base URL, e.g. `http://otel-collector:4318`
+    pub endpoint: String,
+    /// Extra request headers as `name=value`, e.g. for authentication
+    pub headers: Vec<String>,
+    pub service_name: String,
+    /// How often metrics are pushed
+    pub interval: Duration,
+}
+
+/// Sends metrics and spans to an OTLP collector
+pub struct OtlpExporter {
+    client: reqwest::Client,
+    endpoint: String,
+    interval: Duration,
+    resource: Value,
+    started: SystemTime,
+}
+
+impl OtlpExporter {
+    pub fn new(settings: OtlpSettings) -> Result<Arc<Self>> {
+        let mut headers = HeaderMap::new();
+        for header in &settings.headers {
+            let (name, value) = header
+                .split_once('=')
+                .with_context(|| format!("OTLP header {} is not name=value", header))?;
+            headers.insert(
+                HeaderName::from_bytes(name.trim().as_bytes())
+                    .with_context(|| format!("invalid OTLP header name {}", name))?,
+                HeaderValue::from_str(value.trim())
+                    .with_context(|| format!("invalid value for OTLP header {}", name))?,
+            );
+        }
+        let client = reqwest::Client::builder()
+            .timeout(HTTP_TIMEOUT)
+            .default_headers(headers)
+            .build()?;
+        let resource = json!({
+            "attributes": attributes(&[
+                ("service.name", settings.service_name),
+                ("service.version", env!("CARGO_PKG_VERSION").to_string()),
+            ]),
+        });
+        Ok(Arc::new(Self {
+            client,
+            endpoint: settings.endpoint.trim_end_matches('/').to_string(),
+            interval: settings.interval,
+            resource,
+            started: SystemTime::now(),
+        }))
+    }
+
+    /// Start exporting spans, returning the tracer that records them
+    pub fn spawn_tracer(self: &Arc<Self>) -> Arc<Tracer> {
+        let (tx, rx) = mpsc::channel(SPAN_QUEUE_LEN);
+        tokio::spawn(Arc::clone(self).export_spans(rx));
+        Arc::new(Tracer { spans: tx })
+    }
+
+    /// Start pushing the server's metrics every export interval
+    pub fn spawn_metrics(self: &Arc<Self>, shared: Arc<SharedState>, wg_io: Arc<WgIo>) {
+        let exporter = Arc::clone(self);
+        tokio::spawn(async move {
+            let mut interval = tokio::time::interval(exporter.interval);
+            // The first tick completes at once, before anything has happened
+            interval.tick().await;
+            loop {
+                interval.tick().await;
+                let body = exporter.metrics_body(&shared, &wg_io);
+                exporter.post("metrics", body).await;
+            }
+        });
+    }
+
+    async fn export_spans(self: Arc<Self>, mut spans: mpsc::Receiver<SpanData>) {
+        let mut batch = Vec::new();
+        let mut flush = tokio::time::interval(SPAN_FLUSH_INTERVAL);
+        loop {
+            tokio::select! {
+                span = spans.recv() => {
+                    let Some(span) = span else {
+                        break;
+                    };
+                    batch.push(span);
+                    if batch.len() >= MAX_SPAN_BATCH {
+                        self.send_spans(std::mem::take(&mut batch)).await;
+                    }
+                }
+                _ = flush.tick() => {
+                    if !batch.is_empty() {
+                        self.send_spans(std::mem::take(&mut batch)).await;
+                    }
+                }
+            }
+        }
+        if !batch.is_empty() {
+            self.send_spans(batch).await;
+        }
+    }
+
+    async fn send_spans(&self, batch: Vec<SpanData>) {
+        let spans: Vec<Value> = batch.iter().map(SpanData::to_json).collect();
+        let body = json!({
+            "resourceSpans": [{
+                "resource": self.resource,
+                "scopeSpans": [{
+                    "scope": { "name": "wirecagesrv" },
+                    "spans": spans,
+                }],
+            }],
+        });
+        self.post("traces", body).await;
+    }
+
+    fn metrics_body(&self, shared: &SharedState, wg_io: &WgIo) -> Value {
+        let snapshot = metrics::snapshot(shared, wg_io);
+        let start = unix_nanos(self.started);
+        let now = unix_nanos(SystemTime::now());
+
+        let mut exported: Vec<Value> = snapshot
+            .families
+            .iter()
+            .map(|family| {
+                let points: Vec<Value> = family
+                    .samples
+                    .iter()
+                    .map(|sample| {
+                        json!({
+                            "attributes": attributes(&sample.labels),
+                            "startTimeUnixNano": start,
+                            "timeUnixNano": now,
+                            "asInt": sample.value.to_string(),
+                        })
+                    })
+                    .collect();
+                let mut metric = json!({
+                    "name": family.name,
+                    "description": family.help,
+                });
+                match family.kind {
+                    Kind::Counter => {
+                        metric["sum"] = json!({
+                            "dataPoints": points,
+                            "aggregationTemporality": CUMULATIVE,
+                            "isMonotonic": true,
+                        });
+                    }
+                    Kind::Gauge => metric["gauge"] = json!({ "dataPoints": points }),
+                }
+                metric
+            })
+            .collect();
+
+        let latency = &snapshot.dns_latency;
+        let buckets: Vec<String> = latency.buckets.iter().map(u64::to_string).collect();
+        exported.push(json!({
+            "name": DNS_LATENCY_NAME,
+            "description": DNS_LATENCY_HELP,
+            "unit": "s",
+            "histogram": {
+                "dataPoints": [{
+                    "startTimeUnixNano": start,
+                    "timeUnixNano": now,
+                    "count": latency.count.to_string(),
+                    "sum": latency.sum_secs,
+                    "bucketCounts": buckets,
+                    "explicitBounds": latency.bounds,
+                }],
+                "aggregationTemporality": CUMULATIVE,
+            },
+        }));
+
+        json!({
+            "resourceMetrics": [{
+                "resource": self.resource,
+                "scopeMetrics": [{
+                    "scope": { "name": "wirecagesrv" },
+                    "metrics": exported,
+                }],
+            }],
+        })
+    }
+
+    async fn post(&self, signal: &str, body: Value) {
+        let url = format!("{}/v1/{}", self.endpoint, signal);
+        match self.client.post(&url).json(&body).send().await {
+            Ok(response) if response.status().is_success() => {
+                debug!("Exported OTLP {} to {}", signal, url);
+            }
+            Ok(response) => {
+                warn!(
+                    "OTLP export of {} to {} failed: status {}",
+                    signal,
+                    url,
+                    response.status()
+                );
+            }
+            Err(e) => warn!("OTLP export of {} to {} failed: {}", signal, url, e),
+        }
+    }
+}
+
+/// A finished span
+struct SpanData {
+    trace_id: [u8; 16],
+    span_id: [u8; 8],
+    parent_span_id: Option<[u8; 8]>,
+    name: &'static str,
+    kind: u8,
+    start: SystemTime,
+    end: SystemTime,
+    attributes: Vec<(&'static str, String)>,
+    error: Option<String>,
+}
+
+impl SpanData {
+    fn to_json(&self) -> Value {
+        let mut span = json!({
+            "traceId": hex(&self.trace_id),
+            "spanId": hex(&self.span_id),
+            "name": self.name,
+            "kind": self.kind,
+            "startTimeUnixNano": unix_nanos(self.start),
+            "endTimeUnixNano": unix_nanos(self.end),
+            "attributes": attributes(&self.attributes),
+        });
+        if let Some(parent) = &self.parent_span_id {
+            span["parentSpanId"] = hex(parent).into();
+        }
+        if let Some(error) = &self.error {
+            span["status"] = json!({ "code": STATUS_ERROR, "message": error });
+        }
+        span
+    }
+}
+
+/// Records spans for export
+pub struct Tracer {
+    spans: mpsc::Sender<SpanData>,
+}
+
+impl Tracer {
+    /// Start the span of a flow described by `attributes`
+    pub fn start_flow(self: &Arc<Self>, attributes: Vec<(&'static str, String)>) -> FlowTrace {
+        FlowTrace {
+            tracer: Arc::clone(self),
+            trace_id: rand::random(),
+            span_id: rand::random(),
+            start: SystemTime::now(),
+            attributes,
+        }
+    }
+
+    fn record(&self, span: SpanData) {
+        if self.spans.try_send(span).is_err() {
+            debug!("OTLP span queue is full; dropping span");
+        }
+    }
+}
+
+/// The span of one forwarded flow, exported when it is finished
+pub struct FlowTrace {
+    tracer: Arc<Tracer>,
+    trace_id: [u8; 16],
+    span_id: [u8; 8],
+    start: SystemTime,
+    attributes: Vec<(&'static str, String)>,
+}
+
+impl FlowTrace {
+    /// Record a phase of the flow that ran from `start` until now
+    pub fn phase(&self, name: &'static str, start: SystemTime, error: Option<String>) {
+        self.tracer.record(SpanData {
+            trace_id: self.trace_id,
+            span_id: rand::random(),
+            parent_span_id: Some(self.span_id),
+            name,
+            kind: if name == "dial" {
+                SPAN_KIND_CLIENT
+            } else {
+                SPAN_KIND_INTERNAL
+            },
+            start,
+            end: SystemTime::now(),
+            attributes: Vec::new(),
+            error,
+        });
+    }
+
+    /// Record a phase that failed, ending the flow with its error
+    pub fn fail(self, name: &'static str, start: SystemTime, error: String) {
+        self.phase(name, start, Some(error.clone()));
+        self.finish(Some(error));
+    }
+
+    /// End the flow's span
+    pub fn finish(self, error: Option<String>) {
+        self.tracer.record(SpanData {
+            trace_id: self.trace_id,
+            span_id: self.span_id,
+            parent_span_id: None,
+            name: "flow",
+            kind: SPAN_KIND_INTERNAL,
+            start: self.start,
+            end: SystemTime::now(),
+            attributes: self.attributes,
+            error,
+        });
+    }
+}
+
+/// OTLP attribute list of string values
+fn attributes(pairs: &[(&str, String)]) -> Value {
+    pairs
+        .iter()
+        .map(|(key, value)| json!({ "key": key, "value": { "stringValue": value } }))
+        .collect()
+}
+
+fn unix_nanos(time: SystemTime) -> String {
+    time.duration_since(UNIX_EPOCH)
+        .map_or(0, |d| d.as_nanos())
+        .to_string()
+}
+
+fn hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{:02x}", b)).collect()
+}
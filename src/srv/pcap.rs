@@ -0,0 +1,330 @@
+//! Capture of the decrypted traffic inside the tunnel
+//!
+//! Every IP packet the dataplane receives from a peer, or sends to one, can
+//! be copied to any number of captures, each with its own filter on the
+//! peer, a host address, a port and the protocol. `--pcap` writes a capture
+//! to rotating files from startup, and `GET /v1/capture` on the admin API
+//! streams one for a limited time. Both produce pcap with the raw IP link
+//! type, carrying IPv4 and IPv6 alike, which Wireshark and tcpdump read
+//! directly.
+//!
+//! Packets are handed to each capture's writer without blocking the
+//! dataplane; a capture that falls behind misses packets.
+
+use std::fs::{self, File};
+use std::io::{BufWriter, Write};
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::{bail, Context, Result};
+use base64::Engine;
+use parking_lot::RwLock;
+use tokio::sync::mpsc;
+use tracing::{error, info};
+
+use super::flow::Protocol;
+
+/// Packets queued for a capture before new ones are dropped
+const CAPTURE_QUEUE_LEN: usize = 4096;
+
+/// Longest packet kept in a capture
+const SNAPLEN: u32 = 65535;
+
+/// pcap link type for packets that start with an IPv4 or IPv6 header
+const LINKTYPE_RAW: u32 = 101;
+
+/// How often a file capture is flushed to disk
+const FILE_FLUSH_INTERVAL: Duration = Duration::from_secs(1);
+
+/// A captured packet and when it was seen
+pub type CapturedPacket = (SystemTime, Vec<u8>);
+
+/// Which packets a capture keeps; unset fields match everything
+#[derive(Debug, Clone, Default)]
+pub struct CaptureFilter {
+    pub peer: Option<[u8; 32]>,
+    /// Source or destination address
+    pub host: Option<IpAddr>,
+    /// Source or destination TCP or UDP port
+    pub port: Option<u16>,
+    pub protocol: Option<Protocol>,
+}
+
+impl CaptureFilter {
+    /// Parse a filter like `peer=<key>,host=1.2.3.4,port=443,protocol=tcp`
+    pub fn parse(spec: &str) -> Result<Self> {
+        let mut filter = Self::default();
+        for term in spec
+            .split(',')
+            .map(str::trim)
+            .filter(|term| !term.is_empty())
+        {
+            let (key, value) = term
+                .split_once('=')
+                .with_context(|| format!("capture filter term {} is not key=value", term))?;
+            match key.trim() {
+                "peer" => filter.peer = Some(decode_public_key(value)?),
+                "host" => {
+                    filter.host = Some(
+                        value
+                            .trim()
+                            .parse()
+                            .with_context(|| format!("invalid capture host {}", value))?,
+                    );
+                }
+                "port" => {
+                    filter.port = Some(
+                        value
+                            .trim()
+                            .parse()
+                            .with_context(|| format!("invalid capture port {}", value))?,
+                    );
+                }
+                "protocol" => filter.protocol = Some(parse_protocol(value)?),
+                other => bail!("unknown capture filter key {}", other),
+            }
+        }
+        Ok(filter)
+    }
+
+    fn matches(&self, peer_pubkey: &[u8; 32], packet: &[u8]) -> bool {
+        if self.peer.is_some_and(|peer| peer != *peer_pubkey) {
+            return false;
+        }
+        if self.host.is_none() && self.port.is_none() && self.protocol.is_none() {
+            return true;
+        }
+        let Some((src, dst, next_header, header_len)) = addresses(packet) else {
+            return false;
+        };
+        if self.host.is_some_and(|host| host != src && host != dst) {
+            return false;
+        }
+        let protocol = match next_header {
+            6 => Some(Protocol::Tcp),
+            17 => Some(Protocol::Udp),
+            _ => None,
+        };
+        if self.protocol.is_some() && self.protocol != protocol {
+            return false;
+        }
+        if let Some(port) = self.port {
+            let Some(ports) = packet.get(header_len..header_len + 4) else {
+                return false;
+            };
+            if protocol.is_none()
+                || (u16::from_be_bytes([ports[0], ports[1]]) != port
+                    && u16::from_be_bytes([ports[2], ports[3]]) != port)
+            {
+                return false;
+            }
+        }
+        true
+    }
+}
+
+/// A packet's source and destination, protocol and header length. IPv6
+/// extension headers aren't followed, so their packets match no protocol.
+fn addresses(packet: &[u8]) -> Option<(IpAddr, IpAddr, u8, usize)> {
+    match packet.first()? >> 4 {
+        4 if packet.len() >= 20 => {
+            let src = Ipv4Addr::new(packet[12], packet[13], packet[14], packet[15]);
+            let dst = Ipv4Addr::new(packet[16], packet[17], packet[18], packet[19]);
+            let header_len = usize::from(packet[0] & 0x0f) * 4;
+            Some((src.into(), dst.into(), packet[9], header_len))
+        }
+        6 if packet.len() >= 40 => {
+            let src: [u8; 16] = packet[8..24].try_into().expect("16 bytes");
+            let dst: [u8; 16] = packet[24..40].try_into().expect("16 bytes");
+            Some((
+                Ipv6Addr::from(src).into(),
+                Ipv6Addr::from(dst).into(),
+                packet[6],
+                40,
+            ))
+        }
+        _ => None,
+    }
+}
+
+struct Capture {
+    filter: CaptureFilter,
+    tx: mpsc::Sender<CapturedPacket>,
+}
+
+/// The running captures, fed by the dataplane
+#[derive(Default)]
+pub struct PacketCapture {
+    captures: RwLock<Vec<Capture>>,
+}
+
+impl PacketCapture {
+    /// Copy a packet to or from a peer to the captures that want it
+    pub fn packet(&self, peer_pubkey: &[u8; 32], packet: &[u8]) {
+        let captures = self.captures.read();
+        if captures.is_empty() {
+            return;
+        }
+        let mut closed = false;
+        let now = SystemTime::now();
+        for capture in captures.iter() {
+            if !capture.filter.matches(peer_pubkey, packet) {
+                continue;
+            }
+            if let Err(mpsc::error::TrySendError::Closed(_)) =
+                capture.tx.try_send((now, packet.to_vec()))
+            {
+                closed = true;
+            }
+        }
+        drop(captures);
+        if closed {
+            self.captures
+                .write()
+                .retain(|capture| !capture.tx.is_closed());
+        }
+    }
+
+    /// Start a capture; it ends when the receiver is dropped
+    pub fn subscribe(&self, filter: CaptureFilter) -> mpsc::Receiver<CapturedPacket> {
+        let (tx, rx) = mpsc::channel(CAPTURE_QUEUE_LEN);
+        self.captures.write().push(Capture { filter, tx });
+        rx
+    }
+
+    /// Capture to `path` until the server exits, moving it to `path.1`,
+    /// `path.2`, ... each time it reaches `rotate_bytes` and keeping `keep`
+    /// old files
+    pub fn spawn_file(
+        &self,
+        path: String,
+        filter: CaptureFilter,
+        rotate_bytes: u64,
+        keep: usize,
+    ) -> Result<()> {
+        let writer = RotatingFile::create(path, rotate_bytes, keep)?;
+        let rx = self.subscribe(filter);
+        tokio::spawn(writer.run(rx));
+        Ok(())
+    }
+}
+
+/// The pcap global header
+pub fn file_header() -> Vec<u8> {
+    let mut header = Vec::with_capacity(24);
+    header.extend_from_slice(&0xa1b2_c3d4u32.to_le_bytes());
+    header.extend_from_slice(&2u16.to_le_bytes());
+    header.extend_from_slice(&4u16.to_le_bytes());
+    header.extend_from_slice(&0i32.to_le_bytes()); // thiszone
+    header.extend_from_slice(&0u32.to_le_bytes()); // sigfigs
+    header.extend_from_slice(&SNAPLEN.to_le_bytes());
+    header.extend_from_slice(&LINKTYPE_RAW.to_le_bytes());
+    header
+}
+
+/// A packet record: its header followed by the packet
+pub fn record((time, packet): &CapturedPacket) -> Vec<u8> {
+    let since_epoch = time.duration_since(UNIX_EPOCH).unwrap_or_default();
+    let captured = packet.len().min(SNAPLEN as usize);
+    let mut record = Vec::with_capacity(16 + captured);
+    record.extend_from_slice(&(since_epoch.as_secs() as u32).to_le_bytes());
+    record.extend_from_slice(&since_epoch.subsec_micros().to_le_bytes());
+    record.extend_from_slice(&(captured as u32).to_le_bytes());
+    record.extend_from_slice(&(packet.len() as u32).to_le_bytes());
+    record.extend_from_slice(&packet[..captured]);
+    record
+}
+
+struct RotatingFile {
+    path: String,
+    rotate_bytes: u64,
+    keep: usize,
+    file: BufWriter<File>,
+    written: u64,
+}
+
+impl RotatingFile {
+    fn create(path: String, rotate_bytes: u64, keep: usize) -> Result<Self> {
+        let file = Self::open(&path)?;
+        Ok(Self {
+            path,
+            rotate_bytes,
+            keep,
+            file,
+            written: 24,
+        })
+    }
+
+    fn open(path: &str) -> Result<BufWriter<File>> {
+        let mut file = BufWriter::new(
+            File::create(path).with_context(|| format!("failed to create capture {}", path))?,
+        );
+        file.write_all(&file_header())
+            .with_context(|| format!("failed to write capture {}", path))?;
+        Ok(file)
+    }
+
+    async fn run(mut self, mut rx: mpsc::Receiver<CapturedPacket>) {
+        info!("Capturing packets to {}", self.path);
+        let mut flush = tokio::time::interval(FILE_FLUSH_INTERVAL);
+        loop {
+            let result = tokio::select! {
+                packet = rx.recv() => match packet {
+                    Some(packet) => self.write(&packet),
+                    None => break,
+                },
+                _ = flush.tick() => self.file.flush().map_err(Into::into),
+            };
+            if let Err(e) = result {
+                error!("Stopping capture to {}: {:#}", self.path, e);
+                return;
+            }
+        }
+        let _ = self.file.flush();
+    }
+
+    fn write(&mut self, packet: &CapturedPacket) -> Result<()> {
+        if self.written >= self.rotate_bytes {
+            self.rotate()?;
+        }
+        let record = record(packet);
+        self.file.write_all(&record)?;
+        self.written += record.len() as u64;
+        Ok(())
+    }
+
+    fn rotate(&mut self) -> Result<()> {
+        self.file.flush()?;
+        if self.keep == 0 {
+            fs::remove_file(&self.path)?;
+        } else {
+            for n in (1..self.keep).rev() {
+                let from = format!("{}.{}", self.path, n);
+                if fs::metadata(&from).is_ok() {
+                    fs::rename(&from, format!("{}.{}", self.path, n + 1))?;
+                }
+            }
+            fs::rename(&self.path, format!("{}.1", self.path))?;
+        }
+        self.file = Self::open(&self.path)?;
+        self.written = 24;
+        Ok(())
+    }
+}
+
+fn parse_protocol(value: &str) -> Result<Protocol> {
+    match value.trim().to_ascii_lowercase().as_str() {
+        "tcp" => Ok(Protocol::Tcp),
+        "udp" => Ok(Protocol::Udp),
+        other => bail!("capture protocol must be tcp or udp, not {}", other),
+    }
+}
+
+fn decode_public_key(key: &str) -> Result<[u8; 32]> {
+    let bytes = base64::engine::general_purpose::STANDARD
+        .decode(key.trim())
+        .context("not valid base64")?;
+    bytes
+        .try_into()
+        .map_err(|_| anyhow::anyhow!("public key must be 32 bytes"))
+}
@@ -0,0 +1,236 @@
+//! Port forwards configured by the operator
+//!
+//! Clients can ask for their own port forwards through the registration
+//! API; `--port-forward-file` and the admin API let the operator publish
+//! services running on any peer instead. The file is TOML:
+//!
+//! ```toml
+//! [[forward]]
+//! peer = "web-1"
+//! public_port = 443
+//! target_port = 8443
+//!
+//! [[forward]]
+//! peer = "<base64 public key>"
+//! protocol = "udp"
+//! public_port = 51000
+//! ```
+//!
+//! `peer` is a peer's name or public key, `protocol` defaults to `tcp` and
+//! `target_port` to `public_port`. Each forward listens on the public port
+//! of the host and dials the peer's address through the tunnel, like a
+//! client-requested one, and is removed with its peer. The file is applied
+//! at startup and re-read on SIGHUP or `POST /v1/reload`: forwards no longer
+//! listed are removed, and forwards to peers that are not registered yet,
+//! or to ports already taken, are skipped until the next reload.
+
+use std::net::Ipv4Addr;
+use std::sync::Arc;
+
+use anyhow::{Context, Result};
+use base64::Engine;
+use parking_lot::Mutex;
+use serde::Deserialize;
+use tokio::sync::mpsc;
+use tracing::{error, info, warn};
+
+use super::api::PortForwardEvent;
+use super::flow::{PortForwardRule, Protocol};
+use super::state::SharedState;
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct ForwardFile {
+    #[serde(default)]
+    forward: Vec<ForwardEntry>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct ForwardEntry {
+    peer: String,
+    #[serde(default = "default_protocol")]
+    protocol: ForwardProtocol,
+    public_port: u16,
+    target_port: Option<u16>,
+}
+
+#[derive(Debug, Clone, Copy, Deserialize)]
+#[serde(rename_all = "lowercase")]
+enum ForwardProtocol {
+    Tcp,
+    Udp,
+}
+
+fn default_protocol() -> ForwardProtocol {
+    ForwardProtocol::Tcp
+}
+
+/// The forwards read from `--port-forward-file`, kept in step with it
+pub struct PortForwardFile {
+    path: String,
+    shared: Arc<SharedState>,
+    port_forward_tx: mpsc::Sender<PortForwardEvent>,
+    /// Forwards this file added
+    applied: Mutex<Vec<PortForwardRule>>,
+}
+
+impl PortForwardFile {
+    /// Read the file and add its forwards
+    pub async fn load(
+        path: String,
+        shared: Arc<SharedState>,
+        port_forward_tx: mpsc::Sender<PortForwardEvent>,
+    ) -> Result<Self> {
+        let file = Self {
+            path,
+            shared,
+            port_forward_tx,
+            applied: Mutex::new(Vec::new()),
+        };
+        file.reload().await?;
+        Ok(file)
+    }
+
+    /// Re-read the file, removing forwards it no longer lists and adding
+    /// new ones. Returns the number of forwards in place.
+    pub async fn reload(&self) -> Result<usize> {
+        let contents = tokio::fs::read_to_string(&self.path)
+            .await
+            .with_context(|| format!("failed to read port forward file {}", self.path))?;
+        let file: ForwardFile = toml::from_str(&contents)
+            .with_context(|| format!("failed to parse port forward file {}", self.path))?;
+
+        let mut wanted = Vec::new();
+        for entry in &file.forward {
+            let protocol = match entry.protocol {
+                ForwardProtocol::Tcp => Protocol::Tcp,
+                ForwardProtocol::Udp => Protocol::Udp,
+            };
+            let Some((peer_pubkey, peer_ip)) = self.find_peer(&entry.peer) else {
+                warn!(
+                    "Skipping port forward of {} port {}: no peer {}",
+                    label(protocol),
+                    entry.public_port,
+                    entry.peer
+                );
+                continue;
+            };
+            wanted.push(PortForwardRule {
+                protocol,
+                public_port: entry.public_port,
+                peer_pubkey,
+                peer_ip,
+                target_port: entry.target_port.unwrap_or(entry.public_port),
+            });
+        }
+
+        let previous = std::mem::take(&mut *self.applied.lock());
+        let mut applied = Vec::new();
+        for rule in previous {
+            let current = self
+                .shared
+                .port_forwards
+                .read()
+                .get(rule.protocol, rule.public_port)
+                .cloned();
+            // Removed with its peer, or replaced through the API, since
+            if current.as_ref() != Some(&rule) {
+                continue;
+            }
+            if wanted.contains(&rule) {
+                applied.push(rule);
+            } else {
+                remove(
+                    &self.shared,
+                    &self.port_forward_tx,
+                    rule.protocol,
+                    rule.public_port,
+                )
+                .await;
+            }
+        }
+        for rule in wanted {
+            if applied.contains(&rule) {
+                continue;
+            }
+            let (protocol, port) = (rule.protocol, rule.public_port);
+            match add(&self.shared, &self.port_forward_tx, rule.clone()).await {
+                Ok(()) => applied.push(rule),
+                Err(e) => warn!(
+                    "Skipping port forward of {} port {}: {}",
+                    label(protocol),
+                    port,
+                    e
+                ),
+            }
+        }
+
+        let count = applied.len();
+        *self.applied.lock() = applied;
+        info!("Applied {} port forwards from {}", count, self.path);
+        Ok(count)
+    }
+
+    /// A peer's key and address, by name or public key
+    fn find_peer(&self, peer: &str) -> Option<([u8; 32], Ipv4Addr)> {
+        let peers = self.shared.peers.read();
+        let info = match peers.get_by_name(peer) {
+            Some(info) => info,
+            None => {
+                let key: [u8; 32] = base64::engine::general_purpose::STANDARD
+                    .decode(peer.trim())
+                    .ok()?
+                    .try_into()
+                    .ok()?;
+                peers.get_by_pubkey(&key)?
+            }
+        };
+        Some((info.public_key, info.assigned_ip))
+    }
+}
+
+/// Register a forward and start its listener
+pub async fn add(
+    shared: &SharedState,
+    port_forward_tx: &mpsc::Sender<PortForwardEvent>,
+    rule: PortForwardRule,
+) -> Result<(), &'static str> {
+    shared.port_forwards.write().add(rule.clone())?;
+    info!(
+        "Created port forward: {} port {} -> {}:{}",
+        label(rule.protocol),
+        rule.public_port,
+        rule.peer_ip,
+        rule.target_port
+    );
+    if let Err(e) = port_forward_tx.send(PortForwardEvent::Added(rule)).await {
+        error!("Failed to notify dataplane of port forward: {}", e);
+    }
+    Ok(())
+}
+
+/// Unregister a forward and stop its listener
+pub async fn remove(
+    shared: &SharedState,
+    port_forward_tx: &mpsc::Sender<PortForwardEvent>,
+    protocol: Protocol,
+    port: u16,
+) -> Option<PortForwardRule> {
+    let removed = shared.port_forwards.write().remove(protocol, port)?;
+    info!("Removed port forward: {} port {}", label(protocol), port);
+    if let Err(e) = port_forward_tx
+        .send(PortForwardEvent::Removed { protocol, port })
+        .await
+    {
+        error!("Failed to notify dataplane of port forward removal: {}", e);
+    }
+    Some(removed)
+}
+
+fn label(protocol: Protocol) -> &'static str {
+    match protocol {
+        Protocol::Tcp => "tcp",
+        Protocol::Udp => "udp",
+    }
+}
@@ -0,0 +1,317 @@
+//! Port mappings requested by peers
+//!
+//! With `--port-mapping-ports`, the server IP inside the tunnel answers
+//! NAT-PMP (RFC 6886) on UDP port 5351, so applications on a peer can
+//! forward a public port to themselves for as long as they need it, the
+//! way they would through a home router: `natpmpc -g <server ip> -a 8080
+//! 8080 tcp 3600`, or any library that speaks the protocol. Each mapping
+//! is a [port forward](super::port_forwards) from a port in the range to
+//! the peer's address, and lasts for the lifetime asked for, capped at
+//! `--port-mapping-max-lifetime-secs`, unless renewed by asking again. A
+//! peer holds at most `--port-mapping-max-per-peer` mappings at once.
+//!
+//! The external address reported is the one `--wg-endpoint` resolves to at
+//! startup. Mappings are not kept across restarts; clients are expected to
+//! renew them before they run out, which recreates them.
+
+use std::collections::HashMap;
+use std::net::{IpAddr, Ipv4Addr};
+use std::ops::RangeInclusive;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use parking_lot::Mutex;
+use rand::Rng;
+use tokio::sync::mpsc;
+use tracing::{info, warn};
+
+use super::api::PortForwardEvent;
+use super::flow::{PortForwardRule, Protocol};
+use super::port_forwards;
+use super::state::SharedState;
+
+/// Port NAT-PMP requests are sent to
+pub const NAT_PMP_PORT: u16 = 5351;
+
+const VERSION: u8 = 0;
+const OP_EXTERNAL_ADDRESS: u8 = 0;
+const OP_MAP_UDP: u8 = 1;
+const OP_MAP_TCP: u8 = 2;
+/// Set in the opcode of responses
+const OP_RESPONSE: u8 = 0x80;
+
+const RESULT_SUCCESS: u16 = 0;
+const RESULT_UNSUPPORTED_VERSION: u16 = 1;
+const RESULT_REFUSED: u16 = 2;
+const RESULT_NETWORK_FAILURE: u16 = 3;
+const RESULT_OUT_OF_RESOURCES: u16 = 4;
+const RESULT_UNSUPPORTED_OPCODE: u16 = 5;
+
+/// Random ports tried when the one suggested can't be had
+const MAX_PORT_ATTEMPTS: usize = 64;
+/// How often mappings are checked for expiry
+const EXPIRY_CHECK_INTERVAL: Duration = Duration::from_secs(5);
+
+/// A mapping and when it runs out
+struct Lease {
+    rule: PortForwardRule,
+    expires: Instant,
+}
+
+/// The NAT-PMP responder and the mappings it has handed out
+pub struct PortMapper {
+    ports: RangeInclusive<u16>,
+    max_per_peer: usize,
+    max_lifetime: u32,
+    external_ip: Option<Ipv4Addr>,
+    shared: Arc<SharedState>,
+    port_forward_tx: mpsc::Sender<PortForwardEvent>,
+    /// Start of the epoch reported in responses
+    started: Instant,
+    /// Mappings by protocol and public port
+    leases: Mutex<HashMap<(Protocol, u16), Lease>>,
+}
+
+impl PortMapper {
+    /// Set up mappings from `ports`, resolving `wg_endpoint` for the
+    /// external address
+    pub async fn new(
+        ports: RangeInclusive<u16>,
+        max_per_peer: usize,
+        max_lifetime_secs: u32,
+        wg_endpoint: &str,
+        shared: Arc<SharedState>,
+        port_forward_tx: mpsc::Sender<PortForwardEvent>,
+    ) -> Self {
+        let external_ip = match tokio::net::lookup_host(wg_endpoint).await {
+            Ok(mut addrs) => addrs.find_map(|addr| match addr.ip() {
+                IpAddr::V4(ip) => Some(ip),
+                IpAddr::V6(_) => None,
+            }),
+            Err(e) => {
+                warn!("Failed to resolve {} for port mapping: {}", wg_endpoint, e);
+                None
+            }
+        };
+        if external_ip.is_none() {
+            warn!("No IPv4 external address to report to port mapping clients");
+        }
+        Self {
+            ports,
+            max_per_peer,
+            max_lifetime: max_lifetime_secs,
+            external_ip,
+            shared,
+            port_forward_tx,
+            started: Instant::now(),
+            leases: Mutex::new(HashMap::new()),
+        }
+    }
+
+    /// Answer a request from a peer, or return `None` to ignore it
+    pub async fn handle(&self, peer_pubkey: [u8; 32], request: &[u8]) -> Option<Vec<u8>> {
+        let &[version, opcode, ..] = request else {
+            return None;
+        };
+        if opcode & OP_RESPONSE != 0 {
+            return None;
+        }
+        if version != VERSION {
+            return Some(self.header(opcode, RESULT_UNSUPPORTED_VERSION));
+        }
+        let protocol = match opcode {
+            OP_EXTERNAL_ADDRESS => {
+                let (result, ip) = match self.external_ip {
+                    Some(ip) => (RESULT_SUCCESS, ip),
+                    None => (RESULT_NETWORK_FAILURE, Ipv4Addr::UNSPECIFIED),
+                };
+                let mut response = self.header(opcode, result);
+                response.extend_from_slice(&ip.octets());
+                return Some(response);
+            }
+            OP_MAP_UDP => Protocol::Udp,
+            OP_MAP_TCP => Protocol::Tcp,
+            _ => return Some(self.header(opcode, RESULT_UNSUPPORTED_OPCODE)),
+        };
+        let request: &[u8; 12] = request.get(..12)?.try_into().ok()?;
+        let internal_port = u16::from_be_bytes([request[4], request[5]]);
+        let suggested_port = u16::from_be_bytes([request[6], request[7]]);
+        let lifetime = u32::from_be_bytes([request[8], request[9], request[10], request[11]]);
+
+        let mapped = self
+            .map(
+                peer_pubkey,
+                protocol,
+                internal_port,
+                suggested_port,
+                lifetime,
+            )
+            .await;
+        let (result, public_port, lifetime) = match mapped {
+            Ok((public_port, lifetime)) => (RESULT_SUCCESS, public_port, lifetime),
+            Err(result) => (result, 0, 0),
+        };
+        let mut response = self.header(opcode, result);
+        response.extend_from_slice(&internal_port.to_be_bytes());
+        response.extend_from_slice(&public_port.to_be_bytes());
+        response.extend_from_slice(&lifetime.to_be_bytes());
+        Some(response)
+    }
+
+    /// Create, renew or delete a mapping, returning its public port and
+    /// lifetime or the result code to fail with
+    async fn map(
+        &self,
+        peer_pubkey: [u8; 32],
+        protocol: Protocol,
+        internal_port: u16,
+        suggested_port: u16,
+        lifetime: u32,
+    ) -> Result<(u16, u32), u16> {
+        let peer_ip = self
+            .shared
+            .peers
+            .read()
+            .get_by_pubkey(&peer_pubkey)
+            .map(|peer| peer.assigned_ip)
+            .ok_or(RESULT_REFUSED)?;
+
+        if lifetime == 0 {
+            // An internal port of 0 deletes all of the peer's mappings
+            let released: Vec<PortForwardRule> = {
+                let mut leases = self.leases.lock();
+                let mut released = Vec::new();
+                leases.retain(|_, lease| {
+                    let matches = lease.rule.peer_pubkey == peer_pubkey
+                        && lease.rule.protocol == protocol
+                        && (internal_port == 0 || lease.rule.target_port == internal_port);
+                    if matches {
+                        released.push(lease.rule.clone());
+                    }
+                    !matches
+                });
+                released
+            };
+            self.release(released).await;
+            return Ok((0, 0));
+        }
+        if internal_port == 0 {
+            return Err(RESULT_REFUSED);
+        }
+        let lifetime = lifetime.min(self.max_lifetime);
+        let expires = Instant::now() + Duration::from_secs(lifetime.into());
+
+        {
+            let mut leases = self.leases.lock();
+            self.drop_stale(&mut leases);
+            if let Some(lease) = leases.values_mut().find(|lease| {
+                lease.rule.peer_pubkey == peer_pubkey
+                    && lease.rule.protocol == protocol
+                    && lease.rule.target_port == internal_port
+            }) {
+                lease.expires = expires;
+                return Ok((lease.rule.public_port, lifetime));
+            }
+            let held = leases
+                .values()
+                .filter(|lease| lease.rule.peer_pubkey == peer_pubkey)
+                .count();
+            if held >= self.max_per_peer {
+                return Err(RESULT_OUT_OF_RESOURCES);
+            }
+        }
+
+        let mut candidates = Vec::with_capacity(MAX_PORT_ATTEMPTS + 1);
+        if self.ports.contains(&suggested_port) {
+            candidates.push(suggested_port);
+        }
+        candidates.extend(
+            (0..MAX_PORT_ATTEMPTS).map(|_| rand::thread_rng().gen_range(self.ports.clone())),
+        );
+        for public_port in candidates {
+            let rule = PortForwardRule {
+                protocol,
+                public_port,
+                peer_pubkey,
+                peer_ip,
+                target_port: internal_port,
+            };
+            if port_forwards::add(&self.shared, &self.port_forward_tx, rule.clone())
+                .await
+                .is_ok()
+            {
+                self.leases
+                    .lock()
+                    .insert((protocol, public_port), Lease { rule, expires });
+                return Ok((public_port, lifetime));
+            }
+        }
+        Err(RESULT_OUT_OF_RESOURCES)
+    }
+
+    /// Remove mappings as they run out
+    pub async fn run_expiry(self: Arc<Self>) {
+        let mut interval = tokio::time::interval(EXPIRY_CHECK_INTERVAL);
+        loop {
+            interval.tick().await;
+            let now = Instant::now();
+            let expired: Vec<PortForwardRule> = {
+                let mut leases = self.leases.lock();
+                self.drop_stale(&mut leases);
+                let mut expired = Vec::new();
+                leases.retain(|_, lease| {
+                    if lease.expires > now {
+                        return true;
+                    }
+                    expired.push(lease.rule.clone());
+                    false
+                });
+                expired
+            };
+            if !expired.is_empty() {
+                info!("{} port mappings expired", expired.len());
+            }
+            self.release(expired).await;
+        }
+    }
+
+    /// Forget mappings removed with their peer, or replaced, since
+    fn drop_stale(&self, leases: &mut HashMap<(Protocol, u16), Lease>) {
+        let registry = self.shared.port_forwards.read();
+        leases.retain(|&(protocol, port), lease| registry.get(protocol, port) == Some(&lease.rule));
+    }
+
+    /// Remove forwards that mappings held, unless something else has taken
+    /// their ports
+    async fn release(&self, rules: Vec<PortForwardRule>) {
+        for rule in rules {
+            let current = self
+                .shared
+                .port_forwards
+                .read()
+                .get(rule.protocol, rule.public_port)
+                .cloned();
+            if current.as_ref() == Some(&rule) {
+                port_forwards::remove(
+                    &self.shared,
+                    &self.port_forward_tx,
+                    rule.protocol,
+                    rule.public_port,
+                )
+                .await;
+            }
+        }
+    }
+
+    /// The version, opcode, result code and epoch every response starts
+    /// with
+    fn header(&self, opcode: u8, result: u16) -> Vec<u8> {
+        let epoch = self.started.elapsed().as_secs() as u32;
+        let mut response = Vec::with_capacity(16);
+        response.push(VERSION);
+        response.push(opcode | OP_RESPONSE);
+        response.extend_from_slice(&result.to_be_bytes());
+        response.extend_from_slice(&epoch.to_be_bytes());
+        response
+    }
+}
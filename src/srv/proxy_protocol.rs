@@ -0,0 +1,94 @@
+//! PROXY protocol v2 on the stream listeners
+//!
+//! Behind a TCP load balancer, connections to the relay and the WireGuard
+//! TCP listener all come from the balancer. With `--proxy-protocol-from`
+//! naming its addresses, connections from there must open with a PROXY
+//! protocol v2 header (HAProxy's binary format, `send-proxy-v2`; AWS NLB
+//! and most other balancers can send it too) carrying the client's own
+//! address, which is then the peer's endpoint for handshake rate limits,
+//! roaming history and logs. `LOCAL` headers, sent by balancers' health
+//! checks, keep the balancer's address. Connections from anywhere else are
+//! taken as direct and never parsed for a header, so clients can't forge
+//! their address.
+
+use std::io;
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr, SocketAddr};
+
+use ipnet::IpNet;
+use tokio::io::{AsyncRead, AsyncReadExt};
+
+/// Every v2 header starts with this
+const SIGNATURE: [u8; 12] = *b"\r\n\r\n\0\r\nQUIT\n";
+/// Signature, version and command, family and protocol, and length
+const HEADER_LEN: usize = 16;
+const VERSION_2: u8 = 0x20;
+const COMMAND_LOCAL: u8 = 0x00;
+const COMMAND_PROXY: u8 = 0x01;
+const FAMILY_INET: u8 = 0x10;
+const FAMILY_INET6: u8 = 0x20;
+
+/// Which connections carry a PROXY protocol header
+#[derive(Debug, Clone, Default)]
+pub struct ProxyProtocol {
+    trusted: Vec<IpNet>,
+}
+
+impl ProxyProtocol {
+    /// Expect headers on connections from `trusted` networks
+    pub fn new(trusted: Vec<IpNet>) -> Self {
+        Self { trusted }
+    }
+
+    /// The address of the client behind a connection from `peer`: the one
+    /// in its header if `peer` is trusted to send one, and otherwise `peer`
+    /// itself. Reads exactly the header, leaving whatever follows, such as
+    /// a TLS handshake, unread.
+    pub async fn client_addr<R: AsyncRead + Unpin>(
+        &self,
+        reader: &mut R,
+        peer: SocketAddr,
+    ) -> io::Result<SocketAddr> {
+        let ip = peer.ip().to_canonical();
+        if !self.trusted.iter().any(|net| net.contains(&ip)) {
+            return Ok(peer);
+        }
+
+        let mut header = [0u8; HEADER_LEN];
+        reader.read_exact(&mut header).await?;
+        if header[..12] != SIGNATURE || header[12] & 0xf0 != VERSION_2 {
+            return Err(invalid("no PROXY protocol v2 header"));
+        }
+        let len = usize::from(u16::from_be_bytes([header[14], header[15]]));
+        let mut addresses = vec![0u8; len];
+        reader.read_exact(&mut addresses).await?;
+
+        match header[12] & 0x0f {
+            COMMAND_LOCAL => return Ok(peer),
+            COMMAND_PROXY => {}
+            _ => return Err(invalid("unknown PROXY protocol command")),
+        }
+        // Source address, destination address, source port, destination
+        // port, then any TLVs, which are skipped
+        let source = match header[13] & 0xf0 {
+            FAMILY_INET => addresses.get(..12).map(|block| {
+                let ip = Ipv4Addr::new(block[0], block[1], block[2], block[3]);
+                (IpAddr::V4(ip), u16::from_be_bytes([block[8], block[9]]))
+            }),
+            FAMILY_INET6 => addresses.get(..36).map(|block| {
+                let ip: [u8; 16] = block[..16].try_into().expect("16 bytes");
+                (
+                    IpAddr::V6(Ipv6Addr::from(ip)),
+                    u16::from_be_bytes([block[32], block[33]]),
+                )
+            }),
+            // Unix sockets and unknown families say nothing useful
+            _ => return Ok(peer),
+        };
+        let (ip, port) = source.ok_or_else(|| invalid("PROXY protocol header too short"))?;
+        Ok(SocketAddr::new(ip, port))
+    }
+}
+
+fn invalid(message: &str) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, message.to_string())
+}
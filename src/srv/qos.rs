@@ -0,0 +1,452 @@
+//! Traffic classes and DSCP marking
+//!
+//! `--qos-file` sorts the NAT flows peers open into classes, so that
+//! interactive traffic isn't starved by bulk transfers on a saturated
+//! uplink:
+//!
+//! ```toml
+//! [[class]]
+//! name = "interactive"
+//! weight = 8
+//! dscp = "ef"
+//! ports = [22, 3389, 3478]
+//! domains = ["meet.example.com"]
+//!
+//! [[class]]
+//! name = "bulk"
+//! weight = 1
+//! dscp = "cs1"
+//! tags = ["backup"]
+//! ```
+//!
+//! A flow is in the first class whose every criterion it meets: the peer
+//! is one of `peers` (by public key) or has one of `tags`, the flow uses
+//! `protocol` (`tcp` or `udp`) to one of `ports`, and it is for one of
+//! `domains` or a subdomain, as named by a TCP flow's TLS ClientHello or
+//! HTTP Host header. A criterion a class leaves out matches every flow, and
+//! flows no class takes are in the `default` class, of weight 1 and
+//! unmarked. To learn the name, TCP flows to ports 80 and 443 (or to the
+//! class's `ports`) are held until their first bytes arrive, as for the
+//! egress domain lists.
+//!
+//! `dscp`, a number up to 63 or a name such as `ef`, `af41` or `cs1`, marks
+//! the packets the server sends for the flow's connection, so routers
+//! upstream can prioritize them too. A flow leaving through an egress proxy
+//! marks its connection to the proxy; one leaving through a WireGuard
+//! egress tunnel isn't marked.
+//!
+//! `--qos-uplink` and `--qos-downlink` let the server schedule the link
+//! rather than leave it to whatever queue overflows first: forwarded
+//! traffic to and from the internet is held to those rates, and classes
+//! with traffic waiting share them in proportion to their weights, with a
+//! class's unused share going to the others. Set them a little below the
+//! link's real capacity so the queue builds here. Without them, classes
+//! only mark.
+//!
+//! The file is re-read on SIGHUP or `POST /v1/reload`; open flows keep the
+//! class they started in.
+
+use std::collections::{HashMap, HashSet};
+use std::io;
+use std::os::fd::{AsRawFd, BorrowedFd};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use anyhow::{Context, Result};
+use base64::Engine;
+use nix::sys::socket::{
+    getsockname, setsockopt, sockopt, AddressFamily, SockaddrLike, SockaddrStorage,
+};
+use parking_lot::{Mutex, RwLock};
+use serde::Deserialize;
+use tracing::info;
+
+use super::bandwidth::Direction;
+use super::dns_blocklist::contains_domain;
+use super::flow::Protocol;
+use super::state::SharedState;
+
+/// Ports whose TCP flows are held for their server name when a class
+/// names domains but no ports
+const NAME_PORTS: [u16; 2] = [80, 443];
+/// How long a class that sent nothing keeps its share of a link
+const ACTIVE_WINDOW: Duration = Duration::from_millis(100);
+/// How long an idle class's pacing state is kept
+const IDLE_TIMEOUT: Duration = Duration::from_secs(60);
+/// Traffic a class may send at once, in seconds of its share
+const BURST_SECS: f64 = 0.02;
+const MIN_BURST_BYTES: f64 = 16.0 * 1024.0;
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct ClassFile {
+    #[serde(default)]
+    class: Vec<ClassEntry>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct ClassEntry {
+    name: String,
+    #[serde(default = "default_weight")]
+    weight: u32,
+    dscp: Option<Dscp>,
+    #[serde(default)]
+    peers: Vec<String>,
+    #[serde(default)]
+    tags: Vec<String>,
+    protocol: Option<String>,
+    #[serde(default)]
+    ports: Vec<u16>,
+    #[serde(default)]
+    domains: Vec<String>,
+}
+
+fn default_weight() -> u32 {
+    1
+}
+
+/// A DSCP given as a number or by name
+#[derive(Debug, Deserialize)]
+#[serde(untagged)]
+enum Dscp {
+    Value(u8),
+    Name(String),
+}
+
+/// The class a flow was put in
+#[derive(Debug)]
+pub struct FlowClass {
+    pub name: String,
+    pub weight: u32,
+    pub dscp: Option<u8>,
+}
+
+/// Which flows a class takes
+struct Class {
+    peers: HashSet<[u8; 32]>,
+    tags: Vec<String>,
+    protocol: Option<Protocol>,
+    ports: Vec<u16>,
+    domains: HashSet<String>,
+    flow_class: Arc<FlowClass>,
+}
+
+impl Class {
+    fn matches(
+        &self,
+        peer: &[u8; 32],
+        tags: &[String],
+        protocol: Protocol,
+        port: u16,
+        server_name: Option<&str>,
+    ) -> bool {
+        let peer_matches = (self.peers.is_empty() && self.tags.is_empty())
+            || self.peers.contains(peer)
+            || self.tags.iter().any(|tag| tags.contains(tag));
+        peer_matches
+            && self.protocol.is_none_or(|p| p == protocol)
+            && (self.ports.is_empty() || self.ports.contains(&port))
+            && (self.domains.is_empty()
+                || server_name.is_some_and(|name| contains_domain(&self.domains, name)))
+    }
+
+    /// Whether the class could take a flow, once its server name is known
+    fn needs_name(&self, protocol: Protocol, port: u16) -> bool {
+        let ports: &[u16] = if self.ports.is_empty() {
+            &NAME_PORTS
+        } else {
+            &self.ports
+        };
+        !self.domains.is_empty()
+            && protocol == Protocol::Tcp
+            && self.protocol.is_none_or(|p| p == Protocol::Tcp)
+            && ports.contains(&port)
+    }
+}
+
+struct ClassSet {
+    classes: Vec<Class>,
+    default: Arc<FlowClass>,
+}
+
+impl Default for ClassSet {
+    fn default() -> Self {
+        Self {
+            classes: Vec::new(),
+            default: Arc::new(FlowClass {
+                name: "default".to_string(),
+                weight: 1,
+                dscp: None,
+            }),
+        }
+    }
+}
+
+impl ClassSet {
+    fn read(path: &str) -> Result<Self> {
+        let contents = std::fs::read_to_string(path)
+            .with_context(|| format!("failed to read QoS file {}", path))?;
+        let file: ClassFile = toml::from_str(&contents)
+            .with_context(|| format!("failed to parse QoS file {}", path))?;
+
+        let mut set = ClassSet::default();
+        for entry in file.class {
+            let class = parse_class(&entry)
+                .with_context(|| format!("invalid QoS class `{}`", entry.name))?;
+            info!(
+                "Loaded QoS class `{}` with weight {}{}",
+                entry.name,
+                entry.weight,
+                class
+                    .flow_class
+                    .dscp
+                    .map_or(String::new(), |dscp| format!(" and DSCP {}", dscp))
+            );
+            set.classes.push(class);
+        }
+        Ok(set)
+    }
+}
+
+/// A link whose rate classes share by weight
+struct Link {
+    /// Bytes a second
+    rate: f64,
+    classes: Mutex<HashMap<String, Pacer>>,
+}
+
+/// A class's use of a link
+struct Pacer {
+    weight: u32,
+    /// Negative while the class is sending faster than its share
+    tokens: f64,
+    updated: Instant,
+    /// Until when the class counts as using the link
+    active_until: Instant,
+}
+
+impl Link {
+    fn new(rate: f64) -> Self {
+        Self {
+            rate,
+            classes: Mutex::new(HashMap::new()),
+        }
+    }
+
+    /// Account `bytes` a flow in `class` has sent, returning how long the
+    /// flow should wait before sending more
+    fn take(&self, class: &FlowClass, bytes: usize) -> Duration {
+        let now = Instant::now();
+        let mut classes = self.classes.lock();
+        classes.retain(|_, pacer| now.duration_since(pacer.active_until) < IDLE_TIMEOUT);
+        let others: u32 = classes
+            .iter()
+            .filter(|(name, pacer)| **name != class.name && pacer.active_until > now)
+            .map(|(_, pacer)| pacer.weight)
+            .sum();
+        let rate = self.rate * f64::from(class.weight) / f64::from(others + class.weight);
+        let burst = (rate * BURST_SECS).max(MIN_BURST_BYTES);
+
+        let pacer = classes.entry(class.name.clone()).or_insert(Pacer {
+            weight: class.weight,
+            tokens: burst,
+            updated: now,
+            active_until: now,
+        });
+        let elapsed = now.duration_since(pacer.updated).as_secs_f64();
+        pacer.weight = class.weight;
+        pacer.tokens = (pacer.tokens + elapsed * rate).min(burst) - bytes as f64;
+        pacer.updated = now;
+        let wait = if pacer.tokens < 0.0 {
+            Duration::from_secs_f64(-pacer.tokens / rate)
+        } else {
+            Duration::ZERO
+        };
+        pacer.active_until = now + wait + ACTIVE_WINDOW;
+        wait
+    }
+}
+
+/// The QoS classes in force, replaced as a whole on reload, and the links
+/// they share
+#[derive(Default)]
+pub struct Qos {
+    path: Option<String>,
+    shared: Option<Arc<SharedState>>,
+    set: RwLock<Arc<ClassSet>>,
+    uplink: Option<Link>,
+    downlink: Option<Link>,
+}
+
+impl Qos {
+    /// Load classes from an optional TOML file, sharing the links whose
+    /// rates are given in bytes a second
+    pub fn load(
+        path: Option<&str>,
+        uplink: Option<f64>,
+        downlink: Option<f64>,
+        shared: Arc<SharedState>,
+    ) -> Result<Self> {
+        let set = match path {
+            Some(path) => ClassSet::read(path)?,
+            None => ClassSet::default(),
+        };
+        Ok(Self {
+            path: path.map(str::to_string),
+            shared: Some(shared),
+            set: RwLock::new(Arc::new(set)),
+            uplink: uplink.map(Link::new),
+            downlink: downlink.map(Link::new),
+        })
+    }
+
+    pub fn is_configured(&self) -> bool {
+        self.path.is_some()
+    }
+
+    /// Re-read the class file, keeping the current classes if it is
+    /// invalid. Returns the number of classes.
+    pub fn reload(&self) -> Result<usize> {
+        let Some(path) = &self.path else {
+            anyhow::bail!("no --qos-file configured");
+        };
+        let set = ClassSet::read(path)?;
+        let count = set.classes.len();
+        *self.set.write() = Arc::new(set);
+        info!("Reloaded {} QoS classes from {}", count, path);
+        Ok(count)
+    }
+
+    /// Whether a flow to `port` should be held until its server name is
+    /// known, for a class that names domains
+    pub fn needs_name(&self, protocol: Protocol, port: u16) -> bool {
+        let set = Arc::clone(&self.set.read());
+        set.classes
+            .iter()
+            .any(|class| class.needs_name(protocol, port))
+    }
+
+    /// The class of a peer's flow
+    pub fn classify(
+        &self,
+        peer: &[u8; 32],
+        protocol: Protocol,
+        port: u16,
+        server_name: Option<&str>,
+    ) -> Arc<FlowClass> {
+        let set = Arc::clone(&self.set.read());
+        if set.classes.is_empty() {
+            return Arc::clone(&set.default);
+        }
+        let tags = match &self.shared {
+            Some(shared) => shared.peer_tags(peer),
+            None => Vec::new(),
+        };
+        set.classes
+            .iter()
+            .find(|class| class.matches(peer, &tags, protocol, port, server_name))
+            .map_or(&set.default, |class| &class.flow_class)
+            .clone()
+    }
+
+    /// Wait for the share of the link `bytes` just sent in `direction`
+    /// used up: `Up` to the internet, `Down` from it
+    pub async fn pace(&self, class: &FlowClass, direction: Direction, bytes: usize) {
+        let link = match direction {
+            Direction::Up => &self.uplink,
+            Direction::Down => &self.downlink,
+        };
+        let Some(link) = link else {
+            return;
+        };
+        let wait = link.take(class, bytes);
+        if !wait.is_zero() {
+            tokio::time::sleep(wait).await;
+        }
+    }
+}
+
+/// Set the DSCP of the packets `socket` sends
+pub fn mark(socket: BorrowedFd<'_>, dscp: u8) -> io::Result<()> {
+    let tos = libc::c_int::from(dscp) << 2;
+    let local: SockaddrStorage = getsockname(socket.as_raw_fd())?;
+    match local.family() {
+        Some(AddressFamily::Inet6) => setsockopt(&socket, sockopt::Ipv6TClass, &tos)?,
+        _ => setsockopt(&socket, sockopt::Ipv4Tos, &tos)?,
+    }
+    Ok(())
+}
+
+fn parse_class(entry: &ClassEntry) -> Result<Class> {
+    if entry.weight == 0 {
+        anyhow::bail!("weight must be at least 1");
+    }
+    let dscp = entry.dscp.as_ref().map(parse_dscp).transpose()?;
+    let protocol = match entry.protocol.as_deref().map(str::to_ascii_lowercase) {
+        None => None,
+        Some(protocol) if protocol == "tcp" => Some(Protocol::Tcp),
+        Some(protocol) if protocol == "udp" => Some(Protocol::Udp),
+        Some(protocol) => anyhow::bail!("protocol `{}` is not tcp or udp", protocol),
+    };
+    let peers = entry
+        .peers
+        .iter()
+        .map(|peer| decode_public_key(peer).with_context(|| format!("invalid peer key {}", peer)))
+        .collect::<Result<_>>()?;
+    let domains = entry
+        .domains
+        .iter()
+        .map(|domain| domain.trim().trim_matches('.').to_ascii_lowercase())
+        .collect();
+    Ok(Class {
+        peers,
+        tags: entry.tags.clone(),
+        protocol,
+        ports: entry.ports.clone(),
+        domains,
+        flow_class: Arc::new(FlowClass {
+            name: entry.name.clone(),
+            weight: entry.weight,
+            dscp,
+        }),
+    })
+}
+
+/// A DSCP from its number or name: `be`, `ef`, `va`, `cs0`-`cs7` or
+/// `af11`-`af43`
+fn parse_dscp(dscp: &Dscp) -> Result<u8> {
+    let name = match dscp {
+        Dscp::Value(value) if *value <= 63 => return Ok(*value),
+        Dscp::Value(value) => anyhow::bail!("DSCP {} is over 63", value),
+        Dscp::Name(name) => name.to_ascii_lowercase(),
+    };
+    let value = match name.as_str() {
+        "be" | "df" => Some(0),
+        "ef" => Some(46),
+        "va" => Some(44),
+        _ => {
+            if let Some(class) = name.strip_prefix("cs") {
+                class.parse::<u8>().ok().filter(|c| *c <= 7).map(|c| c * 8)
+            } else if let Some(class) = name.strip_prefix("af") {
+                let digits: Vec<u8> = class.bytes().map(|b| b.wrapping_sub(b'0')).collect();
+                match digits[..] {
+                    [class @ 1..=4, drop @ 1..=3] => Some(class * 8 + drop * 2),
+                    _ => None,
+                }
+            } else {
+                None
+            }
+        }
+    };
+    value.with_context(|| format!("unknown DSCP `{}`", name))
+}
+
+fn decode_public_key(key: &str) -> Result<[u8; 32]> {
+    let bytes = base64::engine::general_purpose::STANDARD
+        .decode(key.trim())
+        .context("not valid base64")?;
+    bytes
+        .try_into()
+        .map_err(|_| anyhow::anyhow!("public key must be 32 bytes"))
+}
@@ -0,0 +1,170 @@
+//! WireGuard relay over WebSocket
+//!
+//! Some networks block UDP outright. With `--relay-listen`, usually on port
+//! 443, the server also carries WireGuard over WebSocket, in TLS when
+//! `--tls-cert` and `--tls-key` are set, much as a DERP server relays
+//! Tailscale traffic: clients connect to `/v1/relay` and send each
+//! WireGuard message as one binary message. Registration tells clients the
+//! relay's URL, and the client switches to it by itself once handshakes
+//! over UDP go unanswered.
+//!
+//! Messages from a relay connection are handled as if they were datagrams
+//! from the connection's address, so a peer roams onto the relay and back
+//! like it roams between networks, and handshake limits, key rotation and
+//! the dataplane treat it the same. Without TLS the relay speaks plain
+//! WebSocket, for running behind a reverse proxy that terminates TLS.
+
+use std::net::SocketAddr;
+use std::sync::Arc;
+use std::time::Duration;
+
+use anyhow::{Context, Result};
+use bytes::BytesMut;
+use tokio::io::{AsyncRead, AsyncWrite};
+use tokio::net::{TcpListener, TcpStream};
+use tokio_rustls::TlsAcceptor;
+use tracing::{debug, info, warn};
+
+use super::dataplane::WorkerQueues;
+use super::metrics::{Metrics, Task};
+use super::proxy_protocol::ProxyProtocol;
+use super::websocket;
+use super::wg::WgIo;
+use super::wg_stream;
+
+/// Path clients open the WebSocket on
+pub const RELAY_PATH: &str = "/v1/relay";
+
+/// How long a client has to finish the TLS and WebSocket handshakes
+const HANDSHAKE_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// The URL clients are told to relay through: `relay_url` if set, and
+/// otherwise the relay's port on the `wg_endpoint` host
+pub fn public_url(
+    relay_url: Option<&str>,
+    wg_endpoint: &str,
+    relay_listen: &str,
+    tls: bool,
+) -> String {
+    if let Some(url) = relay_url {
+        return url.to_string();
+    }
+    let host = wg_endpoint
+        .rsplit_once(':')
+        .map_or(wg_endpoint, |(host, _)| host);
+    let port = relay_listen
+        .rsplit_once(':')
+        .map_or(relay_listen, |(_, port)| port);
+    let scheme = if tls { "wss" } else { "ws" };
+    format!("{}://{}:{}{}", scheme, host, port, RELAY_PATH)
+}
+
+/// The relay listener and what its connections feed
+pub struct Relay {
+    tls: Option<TlsAcceptor>,
+    proxy_protocol: ProxyProtocol,
+    wg: Arc<WgIo>,
+    to_dataplane: WorkerQueues,
+    metrics: Arc<Metrics>,
+}
+
+impl Relay {
+    pub fn new(
+        tls: Option<TlsAcceptor>,
+        proxy_protocol: ProxyProtocol,
+        wg: Arc<WgIo>,
+        to_dataplane: WorkerQueues,
+        metrics: Arc<Metrics>,
+    ) -> Self {
+        Self {
+            tls,
+            proxy_protocol,
+            wg,
+            to_dataplane,
+            metrics,
+        }
+    }
+
+    /// Accept relay connections on `listener`
+    pub async fn serve(self: Arc<Self>, listener: TcpListener) {
+        match listener.local_addr() {
+            Ok(addr) => info!(
+                "Relaying WireGuard over WebSocket on {} ({})",
+                addr,
+                if self.tls.is_some() { "TLS" } else { "no TLS" }
+            ),
+            Err(e) => warn!("Relay listener has no address: {}", e),
+        }
+        loop {
+            let (stream, peer) = match listener.accept().await {
+                Ok(accepted) => accepted,
+                Err(e) => {
+                    warn!("Failed to accept relay connection: {}", e);
+                    continue;
+                }
+            };
+            let _ = stream.set_nodelay(true);
+            let relay = Arc::clone(&self);
+            tokio::spawn(async move {
+                let _running = relay.metrics.running(Task::RelayConnection);
+                if let Err(e) = relay.serve_connection(stream, peer).await {
+                    debug!("Relay connection from {} ended: {:#}", peer, e);
+                }
+            });
+        }
+    }
+
+    /// Take the client's address from a PROXY protocol header if `peer`
+    /// sends one, and finish the TLS handshake
+    async fn serve_connection(&self, mut stream: TcpStream, peer: SocketAddr) -> Result<()> {
+        let addr = tokio::time::timeout(
+            HANDSHAKE_TIMEOUT,
+            self.proxy_protocol.client_addr(&mut stream, peer),
+        )
+        .await
+        .context("timed out waiting for the PROXY protocol header")?
+        .context("failed to read PROXY protocol header")?;
+        match &self.tls {
+            Some(tls) => {
+                let stream = tokio::time::timeout(HANDSHAKE_TIMEOUT, tls.accept(stream))
+                    .await
+                    .context("TLS handshake timed out")?
+                    .context("TLS handshake failed")?;
+                self.serve_websocket(stream, addr).await
+            }
+            None => self.serve_websocket(stream, addr).await,
+        }
+    }
+
+    /// Carry a connection's messages until either side closes it
+    async fn serve_websocket<S>(&self, stream: S, addr: SocketAddr) -> Result<()>
+    where
+        S: AsyncRead + AsyncWrite + Unpin,
+    {
+        let (mut reader, mut writer) = tokio::io::split(stream);
+        let mut buf = BytesMut::new();
+        let request = tokio::time::timeout(
+            HANDSHAKE_TIMEOUT,
+            websocket::read_request(&mut reader, &mut buf),
+        )
+        .await
+        .context("WebSocket handshake timed out")?
+        .context("failed to read WebSocket handshake")?;
+        if request.path != RELAY_PATH {
+            websocket::reject(&mut writer, "404 Not Found").await?;
+            anyhow::bail!("no relay at {}", request.path);
+        }
+        if !request.is_upgrade() {
+            websocket::reject(&mut writer, "426 Upgrade Required").await?;
+            anyhow::bail!("not a WebSocket handshake");
+        }
+        websocket::accept(&mut writer, &request).await?;
+        debug!("Relay connection from {}", addr);
+
+        let messages = websocket::Reader::new(reader, buf, wg_stream::MAX_MESSAGE_LEN);
+        let result =
+            wg_stream::carry_websocket(&self.wg, addr, messages, writer, &self.to_dataplane).await;
+        debug!("Relay connection from {} closed", addr);
+        result.context("relay connection failed")
+    }
+}
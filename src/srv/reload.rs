@@ -0,0 +1,240 @@
+//! Reloading configuration files without a restart
+//!
+//! On SIGHUP, or `POST /v1/reload` on the admin API, every file the server
+//! was started with is re-read and applied in place: the peers of
+//! `--wg-config`, `--firewall-rules`, `--egress-acl-file`, the egress
+//! domain lists, `--egress-routes`, `--access-schedule-file`,
+//! `--bandwidth-limit-file`, `--qos-file`, `--obfuscation-file`,
+//! `--dns-policy-file`, `--port-forward-file` and `--log-filter-file`.
+//! Each file is applied on its own, so one that fails to parse keeps its
+//! current settings without holding back the others. Tunnels and open flows
+//! are left alone; new settings apply to flows and queries from then on.
+
+use std::sync::Arc;
+
+use anyhow::{Context, Result};
+use serde::Serialize;
+use tokio::signal::unix::{signal, SignalKind};
+use tokio::sync::mpsc;
+use tracing::{error, info, warn};
+use tracing_subscriber::EnvFilter;
+
+use super::acl::EgressAcls;
+use super::api::PortForwardEvent;
+use super::audit::{Actor, AuditAction, AuditEntry};
+use super::bandwidth::BandwidthLimits;
+use super::dns_policy::PolicyReloader;
+use super::domain_filter::DomainFilter;
+use super::egress::Egress;
+use super::firewall::Firewall;
+use super::flow::PortForwardRule;
+use super::obfuscation::Obfuscation;
+use super::port_forwards::PortForwardFile;
+use super::qos::Qos;
+use super::schedule::AccessSchedules;
+use super::state::SharedState;
+use super::wgimport::WgConfigImport;
+
+/// Handle for swapping the log filter installed at startup
+pub type FilterHandle =
+    tracing_subscriber::reload::Handle<EnvFilter, tracing_subscriber::fmt::Formatter>;
+
+/// A log filter read from a file, in `RUST_LOG` syntax
+pub struct LogFilter {
+    path: String,
+    handle: FilterHandle,
+}
+
+impl LogFilter {
+    /// Read the filter from `path` and install it in place of `RUST_LOG`
+    pub fn load(path: String, handle: FilterHandle) -> Result<Self> {
+        let filter = Self { path, handle };
+        filter.apply()?;
+        Ok(filter)
+    }
+
+    /// Returns the filter now in force
+    fn apply(&self) -> Result<String> {
+        let directives = std::fs::read_to_string(&self.path)
+            .with_context(|| format!("failed to read log filter file {}", self.path))?;
+        let directives = directives.trim().to_string();
+        let filter = EnvFilter::try_new(&directives)
+            .with_context(|| format!("invalid log filter in {}", self.path))?;
+        self.handle
+            .reload(filter)
+            .context("failed to install log filter")?;
+        Ok(directives)
+    }
+}
+
+/// The reloadable parts of the server's configuration
+pub struct ReloadSources {
+    pub wg_config: Option<Arc<WgConfigImport>>,
+    pub firewall: Arc<Firewall>,
+    pub acls: Arc<EgressAcls>,
+    pub domains: Option<Arc<DomainFilter>>,
+    pub egress: Arc<Egress>,
+    pub schedules: Arc<AccessSchedules>,
+    pub bandwidth: Arc<BandwidthLimits>,
+    pub qos: Arc<Qos>,
+    pub obfuscation: Arc<Obfuscation>,
+    pub dns_policies: Option<PolicyReloader>,
+    pub port_forwards: Option<PortForwardFile>,
+    pub log_filter: Option<LogFilter>,
+}
+
+/// How reloading one file went
+#[derive(Debug, Serialize)]
+pub struct ReloadOutcome {
+    pub source: &'static str,
+    pub ok: bool,
+    pub detail: String,
+}
+
+pub struct Reloader {
+    shared: Arc<SharedState>,
+    port_forward_tx: mpsc::Sender<PortForwardEvent>,
+    sources: ReloadSources,
+    /// Keeps a SIGHUP and an API call from reloading at the same time
+    running: tokio::sync::Mutex<()>,
+}
+
+impl Reloader {
+    pub fn new(
+        shared: Arc<SharedState>,
+        port_forward_tx: mpsc::Sender<PortForwardEvent>,
+        sources: ReloadSources,
+    ) -> Arc<Self> {
+        Arc::new(Self {
+            shared,
+            port_forward_tx,
+            sources,
+            running: tokio::sync::Mutex::new(()),
+        })
+    }
+
+    /// Reload on every SIGHUP
+    pub fn spawn_sighup(self: &Arc<Self>) -> Result<()> {
+        let mut hangup = signal(SignalKind::hangup()).context("failed to listen for SIGHUP")?;
+        let reloader = Arc::clone(self);
+        tokio::spawn(async move {
+            while hangup.recv().await.is_some() {
+                info!("Received SIGHUP; reloading configuration");
+                reloader.reload(&Actor::system()).await;
+            }
+        });
+        Ok(())
+    }
+
+    /// Re-read every configured file, recording each in the audit log
+    pub async fn reload(&self, actor: &Actor) -> Vec<ReloadOutcome> {
+        let _running = self.running.lock().await;
+        let mut outcomes = Vec::new();
+
+        if let Some(wg_config) = &self.sources.wg_config {
+            let result = match wg_config.reload(&self.shared) {
+                Ok(result) => {
+                    self.remove_port_forwards(&result.removed_rules).await;
+                    Ok(format!(
+                        "{} applied, {} skipped, {} removed",
+                        result.applied, result.skipped, result.removed
+                    ))
+                }
+                Err(e) => Err(e),
+            };
+            outcomes.push(("wg-config", result));
+        }
+        if self.sources.firewall.is_configured() {
+            let result = self.sources.firewall.reload().await;
+            outcomes.push(("firewall", result.map(|n| format!("{} rules", n))));
+        }
+        if self.sources.acls.is_configured() {
+            let result = self.sources.acls.reload();
+            outcomes.push(("egress-acls", result.map(|n| format!("{} ACLs", n))));
+        }
+        if let Some(domains) = &self.sources.domains {
+            let result = domains.reload().await;
+            outcomes.push(("egress-domains", result.map(|n| format!("{} domains", n))));
+        }
+        if self.sources.egress.is_configured() {
+            let result = self.sources.egress.reload();
+            outcomes.push(("egress-routes", result.map(|n| format!("{} routes", n))));
+        }
+        if self.sources.schedules.is_configured() {
+            let result = self.sources.schedules.reload();
+            outcomes.push((
+                "access-schedules",
+                result.map(|n| format!("{} schedules", n)),
+            ));
+        }
+        if self.sources.bandwidth.is_configured() {
+            let result = self.sources.bandwidth.reload();
+            outcomes.push(("bandwidth-limits", result.map(|n| format!("{} limits", n))));
+        }
+        if self.sources.qos.is_configured() {
+            let result = self.sources.qos.reload();
+            outcomes.push(("qos", result.map(|n| format!("{} classes", n))));
+        }
+        if self.sources.obfuscation.is_configured() {
+            let result = self.sources.obfuscation.reload();
+            outcomes.push(("obfuscation", result.map(|n| format!("{} profiles", n))));
+        }
+        if let Some(dns_policies) = &self.sources.dns_policies {
+            let result = dns_policies.reload().await;
+            outcomes.push(("dns-policy", result.map(|n| format!("{} policies", n))));
+        }
+        if let Some(port_forwards) = &self.sources.port_forwards {
+            let result = port_forwards.reload().await;
+            outcomes.push(("port-forwards", result.map(|n| format!("{} forwards", n))));
+        }
+        if let Some(log_filter) = &self.sources.log_filter {
+            let result = log_filter.apply();
+            if let Ok(directives) = &result {
+                info!("Log filter is now {}", directives);
+            }
+            outcomes.push(("log-filter", result));
+        }
+
+        outcomes
+            .into_iter()
+            .map(|(source, result)| {
+                let entry = AuditEntry::new(AuditAction::ConfigReload, actor).target(source);
+                match result {
+                    Ok(detail) => {
+                        self.shared.audit.record(entry.detail(detail.clone()));
+                        ReloadOutcome {
+                            source,
+                            ok: true,
+                            detail,
+                        }
+                    }
+                    Err(e) => {
+                        let detail = format!("{:#}", e);
+                        warn!("Failed to reload {}: {}", source, detail);
+                        self.shared.audit.record(entry.failed(detail.clone()));
+                        ReloadOutcome {
+                            source,
+                            ok: false,
+                            detail,
+                        }
+                    }
+                }
+            })
+            .collect()
+    }
+
+    async fn remove_port_forwards(&self, rules: &[PortForwardRule]) {
+        for rule in rules {
+            if let Err(e) = self
+                .port_forward_tx
+                .send(PortForwardEvent::Removed {
+                    protocol: rule.protocol,
+                    port: rule.public_port,
+                })
+                .await
+            {
+                error!("Failed to notify dataplane of port forward removal: {}", e);
+            }
+        }
+    }
+}
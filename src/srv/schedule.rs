@@ -0,0 +1,345 @@
+//! Scheduled access windows for wirecagesrv
+//!
+//! A TOML file limits when groups of peers (by public key or tag) may open
+//! flows through the NAT:
+//!
+//! ```toml
+//! [[schedule]]
+//! name = "contractors"
+//! tags = ["contractors"]
+//! days = ["mon-fri"]
+//! hours = ["09:00-17:00"]
+//! terminate = true
+//!
+//! [[schedule]]
+//! name = "night-batch"
+//! peers = ["<base64 public key>"]
+//! hours = ["22:00-06:00"]
+//! utc_offset = "+01:00"
+//! ```
+//!
+//! A peer listed by key gets that schedule; otherwise it gets the first
+//! schedule in the file naming one of its tags. Peers no schedule selects
+//! have access at all times. `days` are `mon`..`sun` or ranges of them and
+//! default to every day; `hours` default to the whole day, and a window
+//! ending before it starts runs past midnight into the next day. Times are
+//! the server's local time unless `utc_offset` is given.
+//!
+//! Outside its windows a peer's new flows are refused, and with `terminate`
+//! its open flows are closed as well. DNS queries to the server itself are
+//! always answered. The file is re-read on SIGHUP or `POST /v1/reload`.
+
+use std::collections::HashMap;
+use std::ops::Range;
+use std::sync::Arc;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use anyhow::{Context, Result};
+use base64::Engine;
+use parking_lot::RwLock;
+use serde::Deserialize;
+use tracing::info;
+
+use super::state::SharedState;
+
+const MINUTES_PER_DAY: u32 = 24 * 60;
+const DAY_NAMES: [&str; 7] = ["sun", "mon", "tue", "wed", "thu", "fri", "sat"];
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct ScheduleFile {
+    #[serde(default)]
+    schedule: Vec<ScheduleEntry>,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct ScheduleEntry {
+    name: String,
+    #[serde(default)]
+    peers: Vec<String>,
+    #[serde(default)]
+    tags: Vec<String>,
+    #[serde(default)]
+    days: Vec<String>,
+    #[serde(default)]
+    hours: Vec<String>,
+    utc_offset: Option<String>,
+    #[serde(default)]
+    terminate: bool,
+}
+
+struct Schedule {
+    name: String,
+    /// Allowed days as a bitmask, bit 0 being Sunday
+    days: u8,
+    /// Minutes of the day; `start > end` wraps past midnight
+    hours: Vec<Range<u32>>,
+    /// Offset from UTC in minutes, or `None` for local time
+    utc_offset: Option<i32>,
+    terminate: bool,
+}
+
+impl Schedule {
+    fn allows(&self, now: SystemTime) -> bool {
+        let (weekday, minute) = self.wall_clock(now);
+        let yesterday = (weekday + 6) % 7;
+        let has_day = |day: u32| self.days & (1 << day) != 0;
+        self.hours.iter().any(|window| {
+            if window.start <= window.end {
+                has_day(weekday) && window.contains(&minute)
+            } else {
+                (has_day(weekday) && minute >= window.start)
+                    || (has_day(yesterday) && minute < window.end)
+            }
+        })
+    }
+
+    /// Day of the week (0 is Sunday) and minute of the day at `now`
+    fn wall_clock(&self, now: SystemTime) -> (u32, u32) {
+        let secs = now.duration_since(UNIX_EPOCH).map_or(0, |d| d.as_secs() as i64);
+        let offset_secs = match self.utc_offset {
+            Some(minutes) => i64::from(minutes) * 60,
+            None => local_utc_offset(secs),
+        };
+        let local = secs + offset_secs;
+        let days = local.div_euclid(86400);
+        let minute = local.rem_euclid(86400) / 60;
+        // The Unix epoch was a Thursday
+        ((days + 4).rem_euclid(7) as u32, minute as u32)
+    }
+}
+
+/// The local time zone's offset from UTC in seconds at `secs`
+fn local_utc_offset(secs: i64) -> i64 {
+    let time = secs as libc::time_t;
+    // SAFETY: localtime_r only writes to the tm we pass it
+    unsafe {
+        let mut tm: libc::tm = std::mem::zeroed();
+        if libc::localtime_r(&time, &mut tm).is_null() {
+            return 0;
+        }
+        tm.tm_gmtoff
+    }
+}
+
+/// Access schedules by peer public key and tag, as read from the file
+#[derive(Default)]
+struct ScheduleSet {
+    by_peer: HashMap<[u8; 32], Arc<Schedule>>,
+    /// In file order, so the first schedule naming one of a peer's tags wins
+    by_tag: Vec<(String, Arc<Schedule>)>,
+    /// For looking up peers' tags; only set when some schedule uses tags
+    shared: Option<Arc<SharedState>>,
+    count: usize,
+}
+
+impl ScheduleSet {
+    fn read(path: &str, shared: &Arc<SharedState>) -> Result<Self> {
+        let contents = std::fs::read_to_string(path)
+            .with_context(|| format!("failed to read access schedule file {}", path))?;
+        let file: ScheduleFile = toml::from_str(&contents)
+            .with_context(|| format!("failed to parse access schedule file {}", path))?;
+
+        let count = file.schedule.len();
+        let mut by_peer = HashMap::new();
+        let mut by_tag = Vec::new();
+        for entry in file.schedule {
+            if entry.peers.is_empty() && entry.tags.is_empty() {
+                anyhow::bail!("access schedule `{}` lists no peers or tags", entry.name);
+            }
+            let schedule = Arc::new(
+                parse_schedule(&entry)
+                    .with_context(|| format!("invalid access schedule `{}`", entry.name))?,
+            );
+            for peer in &entry.peers {
+                let pubkey = decode_public_key(peer).with_context(|| {
+                    format!("invalid peer key in access schedule `{}`", entry.name)
+                })?;
+                if by_peer.insert(pubkey, Arc::clone(&schedule)).is_some() {
+                    anyhow::bail!("peer {} appears in more than one access schedule", peer);
+                }
+            }
+            for tag in &entry.tags {
+                by_tag.push((tag.clone(), Arc::clone(&schedule)));
+            }
+            info!(
+                "Loaded access schedule `{}` for {} peers and {} tags",
+                schedule.name,
+                entry.peers.len(),
+                entry.tags.len()
+            );
+        }
+        let shared = (!by_tag.is_empty()).then(|| Arc::clone(shared));
+        Ok(Self {
+            by_peer,
+            by_tag,
+            shared,
+            count,
+        })
+    }
+
+    /// The schedule for a peer: its own listing, else the first matching tag
+    fn schedule_for(&self, peer: &[u8; 32]) -> Option<&Schedule> {
+        if let Some(schedule) = self.by_peer.get(peer) {
+            return Some(schedule);
+        }
+        let shared = self.shared.as_ref()?;
+        let tags = shared.peer_tags(peer);
+        self.by_tag
+            .iter()
+            .find(|(tag, _)| tags.contains(tag))
+            .map(|(_, schedule)| schedule.as_ref())
+    }
+}
+
+/// The access schedules in force, replaced as a whole on reload
+#[derive(Default)]
+pub struct AccessSchedules {
+    path: Option<String>,
+    shared: Option<Arc<SharedState>>,
+    set: RwLock<Arc<ScheduleSet>>,
+}
+
+impl AccessSchedules {
+    /// Load schedules from a TOML file
+    pub fn load(path: &str, shared: Arc<SharedState>) -> Result<Self> {
+        let set = ScheduleSet::read(path, &shared)?;
+        Ok(Self {
+            path: Some(path.to_string()),
+            shared: Some(shared),
+            set: RwLock::new(Arc::new(set)),
+        })
+    }
+
+    pub fn is_configured(&self) -> bool {
+        self.path.is_some()
+    }
+
+    /// Re-read the schedule file, keeping the current schedules if it is
+    /// invalid. Returns the number of schedules.
+    pub fn reload(&self) -> Result<usize> {
+        let (Some(path), Some(shared)) = (&self.path, &self.shared) else {
+            anyhow::bail!("no --access-schedule-file configured");
+        };
+        let set = ScheduleSet::read(path, shared)?;
+        let count = set.count;
+        *self.set.write() = Arc::new(set);
+        info!("Reloaded {} access schedules from {}", count, path);
+        Ok(count)
+    }
+
+    /// Whether the peer may open new flows now
+    pub fn allows(&self, peer: &[u8; 32]) -> bool {
+        let set = Arc::clone(&self.set.read());
+        set.schedule_for(peer)
+            .is_none_or(|schedule| schedule.allows(SystemTime::now()))
+    }
+
+    /// Whether the peer's open flows should be closed now
+    pub fn terminates(&self, peer: &[u8; 32]) -> bool {
+        let set = Arc::clone(&self.set.read());
+        set.schedule_for(peer)
+            .is_some_and(|schedule| schedule.terminate && !schedule.allows(SystemTime::now()))
+    }
+
+    /// Name of the schedule applied to a peer, for logging
+    pub fn name_for(&self, peer: &[u8; 32]) -> Option<String> {
+        let set = Arc::clone(&self.set.read());
+        set.schedule_for(peer).map(|schedule| schedule.name.clone())
+    }
+}
+
+fn parse_schedule(entry: &ScheduleEntry) -> Result<Schedule> {
+    let mut days = 0u8;
+    for spec in &entry.days {
+        let (first, last) = spec.split_once('-').unwrap_or((spec, spec));
+        let (first, last) = (parse_day(first)?, parse_day(last)?);
+        // Ranges may wrap, as in `sat-sun`
+        let mut day = first;
+        loop {
+            days |= 1 << day;
+            if day == last {
+                break;
+            }
+            day = (day + 1) % 7;
+        }
+    }
+    if entry.days.is_empty() {
+        days = 0x7f;
+    }
+
+    let hours = if entry.hours.is_empty() {
+        vec![0..MINUTES_PER_DAY]
+    } else {
+        entry
+            .hours
+            .iter()
+            .map(|window| {
+                let (start, end) = window
+                    .split_once('-')
+                    .with_context(|| format!("invalid hours `{}` (expected HH:MM-HH:MM)", window))?;
+                let (start, end) = (parse_time(start)?, parse_time(end)?);
+                if start == end || start == MINUTES_PER_DAY {
+                    anyhow::bail!("invalid hours `{}`", window);
+                }
+                Ok(start..end)
+            })
+            .collect::<Result<_>>()?
+    };
+
+    let utc_offset = entry.utc_offset.as_deref().map(parse_offset).transpose()?;
+    Ok(Schedule {
+        name: entry.name.clone(),
+        days,
+        hours,
+        utc_offset,
+        terminate: entry.terminate,
+    })
+}
+
+fn parse_day(name: &str) -> Result<u32> {
+    let name = name.trim().to_ascii_lowercase();
+    DAY_NAMES
+        .iter()
+        .position(|day| name.starts_with(day))
+        .map(|day| day as u32)
+        .with_context(|| format!("invalid day `{}`", name))
+}
+
+/// Parse `HH:MM` into minutes of the day, allowing `24:00` as an end
+fn parse_time(time: &str) -> Result<u32> {
+    let time = time.trim();
+    let parsed = time
+        .split_once(':')
+        .and_then(|(h, m)| Some((h.parse::<u32>().ok()?, m.parse::<u32>().ok()?)));
+    match parsed {
+        Some((hour, minute)) if minute < 60 && hour * 60 + minute <= MINUTES_PER_DAY => {
+            Ok(hour * 60 + minute)
+        }
+        _ => anyhow::bail!("invalid time `{}` (expected HH:MM)", time),
+    }
+}
+
+/// Parse `+HH:MM` or `-HH:MM` into minutes
+fn parse_offset(offset: &str) -> Result<i32> {
+    let (sign, rest) = match offset.trim().split_at_checked(1) {
+        Some(("+", rest)) => (1, rest),
+        Some(("-", rest)) => (-1, rest),
+        _ => anyhow::bail!("invalid utc_offset `{}` (expected +HH:MM or -HH:MM)", offset),
+    };
+    let minutes = parse_time(rest)
+        .ok()
+        .filter(|minutes| *minutes <= 14 * 60)
+        .with_context(|| format!("invalid utc_offset `{}`", offset))?;
+    Ok(sign * minutes as i32)
+}
+
+fn decode_public_key(key: &str) -> Result<[u8; 32]> {
+    let bytes = base64::engine::general_purpose::STANDARD
+        .decode(key.trim())
+        .context("not valid base64")?;
+    bytes
+        .try_into()
+        .map_err(|_| anyhow::anyhow!("public key must be 32 bytes"))
+}
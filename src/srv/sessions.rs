@@ -0,0 +1,330 @@
+//! Peer session history
+//!
+//! A session starts when a peer that was idle completes a handshake and
+//! sends traffic, and ends when it goes quiet for the liveness timeout or is
+//! removed. Each session is recorded with the endpoint the peer connected
+//! from, when it started and ended and the WireGuard bytes exchanged, for an
+//! account of who was connected when. With `--session-log` finished sessions
+//! are appended to a JSON-lines file and read back on startup. Sessions that
+//! ended longer ago than the retention period are dropped, rewriting the
+//! file.
+
+use std::collections::{HashMap, VecDeque};
+use std::io::Write;
+use std::net::SocketAddr;
+use std::os::unix::fs::OpenOptionsExt;
+use std::path::PathBuf;
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+use anyhow::{Context, Result};
+use parking_lot::Mutex;
+use serde::{Deserialize, Serialize};
+use tracing::{debug, error, info};
+
+use super::events::encode_key;
+
+/// Sessions returned by a query unless it asks for fewer
+const DEFAULT_QUERY_LIMIT: usize = 100;
+
+/// How often sessions past the retention period are dropped
+const PRUNE_INTERVAL: Duration = Duration::from_secs(3600);
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Session {
+    pub public_key: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub name: Option<String>,
+    /// Endpoint the peer connected from
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub endpoint: Option<SocketAddr>,
+    /// Endpoint changes during the session
+    #[serde(default)]
+    pub roams: u64,
+    /// Unix time of the handshake that started the session
+    pub started_at: u64,
+    /// Unix time of the peer's last packet; unset while connected
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub ended_at: Option<u64>,
+    /// WireGuard bytes received from and sent to the peer
+    pub rx_bytes: u64,
+    pub tx_bytes: u64,
+}
+
+/// A peer's tunnel state, sampled periodically
+pub struct Observation {
+    pub public_key: [u8; 32],
+    pub name: Option<String>,
+    pub connected: bool,
+    pub endpoint: Option<SocketAddr>,
+    pub roams: u64,
+    pub last_handshake: Option<SystemTime>,
+    pub last_receive: Option<SystemTime>,
+    pub rx_bytes: u64,
+    pub tx_bytes: u64,
+}
+
+/// Which sessions a query returns
+#[derive(Debug, Default, Deserialize)]
+pub struct SessionFilter {
+    /// Only sessions still open or ended at or after this Unix time
+    pub since: Option<u64>,
+    /// Only sessions started before this Unix time
+    pub until: Option<u64>,
+    /// Return at most this many of the newest matching sessions
+    pub limit: Option<usize>,
+}
+
+impl SessionFilter {
+    fn matches(&self, session: &Session) -> bool {
+        self.since
+            .is_none_or(|since| session.ended_at.is_none_or(|ended| ended >= since))
+            && self.until.is_none_or(|until| session.started_at < until)
+    }
+}
+
+struct TrackedPeer {
+    /// Counters when the peer was last sampled
+    rx_bytes: u64,
+    tx_bytes: u64,
+    open: Option<OpenSession>,
+}
+
+/// A session in progress with the counters it started from
+struct OpenSession {
+    session: Session,
+    rx_bytes: u64,
+    tx_bytes: u64,
+    roams: u64,
+}
+
+impl OpenSession {
+    fn update(&mut self, obs: &Observation) {
+        self.session.rx_bytes = obs.rx_bytes - self.rx_bytes;
+        self.session.tx_bytes = obs.tx_bytes - self.tx_bytes;
+        self.session.roams = obs.roams.saturating_sub(self.roams);
+    }
+}
+
+pub struct SessionHistory {
+    path: Option<PathBuf>,
+    retention: Duration,
+    /// Finished sessions, oldest first
+    finished: Mutex<VecDeque<Session>>,
+    peers: Mutex<HashMap<[u8; 32], TrackedPeer>>,
+    last_pruned: Mutex<Instant>,
+}
+
+impl SessionHistory {
+    /// Keep sessions in memory only
+    pub fn in_memory(retention: Duration) -> Self {
+        Self {
+            path: None,
+            retention,
+            finished: Mutex::new(VecDeque::new()),
+            peers: Mutex::new(HashMap::new()),
+            last_pruned: Mutex::new(Instant::now()),
+        }
+    }
+
+    /// Also append finished sessions to `path`, restoring those it holds
+    pub fn open(path: impl Into<PathBuf>, retention: Duration) -> Result<Self> {
+        let path = path.into();
+        let finished = match std::fs::read_to_string(&path) {
+            // A torn final line from a crash is skipped
+            Ok(contents) => contents
+                .lines()
+                .filter_map(|line| serde_json::from_str(line).ok())
+                .collect(),
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => VecDeque::new(),
+            Err(e) => {
+                return Err(e).with_context(|| format!("failed to read {}", path.display()))
+            }
+        };
+        let history = Self {
+            path: Some(path),
+            retention,
+            finished: Mutex::new(finished),
+            peers: Mutex::new(HashMap::new()),
+            last_pruned: Mutex::new(Instant::now()),
+        };
+        history.prune()?;
+        Ok(history)
+    }
+
+    /// Open and close sessions from the current state of every peer
+    pub fn observe(&self, observations: Vec<Observation>) {
+        let now = unix_secs(SystemTime::now());
+        let mut ended = Vec::new();
+        {
+            let mut peers = self.peers.lock();
+            let removed: Vec<[u8; 32]> = peers
+                .keys()
+                .filter(|key| !observations.iter().any(|obs| obs.public_key == **key))
+                .copied()
+                .collect();
+            for key in removed {
+                if let Some(open) = peers.remove(&key).and_then(|peer| peer.open) {
+                    let mut session = open.session;
+                    session.ended_at = Some(now);
+                    ended.push(session);
+                }
+            }
+
+            for obs in observations {
+                let peer = peers.entry(obs.public_key).or_insert(TrackedPeer {
+                    rx_bytes: 0,
+                    tx_bytes: 0,
+                    open: None,
+                });
+                // Counters restart when the tunnel is rebuilt for a new
+                // preshared key
+                if obs.rx_bytes < peer.rx_bytes || obs.tx_bytes < peer.tx_bytes {
+                    peer.rx_bytes = 0;
+                    peer.tx_bytes = 0;
+                    if let Some(open) = &mut peer.open {
+                        open.rx_bytes = 0;
+                        open.tx_bytes = 0;
+                    }
+                }
+                match (peer.open.is_some(), obs.connected) {
+                    (false, true) => {
+                        let session = Session {
+                            public_key: encode_key(&obs.public_key),
+                            name: obs.name.clone(),
+                            endpoint: obs.endpoint,
+                            roams: 0,
+                            started_at: obs.last_handshake.map_or(now, unix_secs),
+                            ended_at: None,
+                            rx_bytes: 0,
+                            tx_bytes: 0,
+                        };
+                        debug!("Session started for peer {}", session.public_key);
+                        peer.open = Some(OpenSession {
+                            session,
+                            rx_bytes: peer.rx_bytes,
+                            tx_bytes: peer.tx_bytes,
+                            roams: obs.roams,
+                        });
+                    }
+                    (true, false) => {
+                        let mut open = peer.open.take().expect("session is open");
+                        open.update(&obs);
+                        let mut session = open.session;
+                        session.ended_at = Some(obs.last_receive.map_or(now, unix_secs));
+                        ended.push(session);
+                    }
+                    _ => {}
+                }
+                peer.rx_bytes = obs.rx_bytes;
+                peer.tx_bytes = obs.tx_bytes;
+                if let Some(open) = &mut peer.open {
+                    open.update(&obs);
+                }
+            }
+        }
+
+        for session in ended {
+            self.finish(session);
+        }
+
+        let mut last_pruned = self.last_pruned.lock();
+        if last_pruned.elapsed() >= PRUNE_INTERVAL {
+            *last_pruned = Instant::now();
+            drop(last_pruned);
+            if let Err(e) = self.prune() {
+                error!("Failed to prune session log: {:#}", e);
+            }
+        }
+    }
+
+    fn finish(&self, session: Session) {
+        info!(
+            "Session ended for peer {} after {}s",
+            session.public_key,
+            session.ended_at.unwrap_or(session.started_at).saturating_sub(session.started_at)
+        );
+        if let Some(path) = &self.path {
+            let mut line = serde_json::to_string(&session).expect("sessions serialize");
+            line.push('\n');
+            let written = std::fs::OpenOptions::new()
+                .append(true)
+                .create(true)
+                .mode(0o600)
+                .open(path)
+                .and_then(|mut file| file.write_all(line.as_bytes()));
+            if let Err(e) = written {
+                error!("Failed to write session log {}: {}", path.display(), e);
+            }
+        }
+        self.finished.lock().push_back(session);
+    }
+
+    /// Matching sessions of one peer, or all peers, oldest first; open
+    /// sessions come last
+    pub fn query(&self, public_key: Option<&[u8; 32]>, filter: &SessionFilter) -> Vec<Session> {
+        let public_key = public_key.map(encode_key);
+        let wanted = |session: &Session| {
+            public_key.as_ref().is_none_or(|key| session.public_key == *key)
+                && filter.matches(session)
+        };
+        let mut sessions: Vec<Session> = self
+            .finished
+            .lock()
+            .iter()
+            .filter(|session| wanted(session))
+            .cloned()
+            .collect();
+        let mut open: Vec<Session> = self
+            .peers
+            .lock()
+            .values()
+            .filter_map(|peer| peer.open.as_ref().map(|open| &open.session))
+            .filter(|session| wanted(session))
+            .cloned()
+            .collect();
+        open.sort_by_key(|session| session.started_at);
+        sessions.extend(open);
+        let limit = filter.limit.unwrap_or(DEFAULT_QUERY_LIMIT);
+        let excess = sessions.len().saturating_sub(limit);
+        sessions.drain(..excess);
+        sessions
+    }
+
+    /// Drop sessions that ended before the retention period, rewriting the
+    /// log if any were
+    fn prune(&self) -> Result<()> {
+        let cutoff = unix_secs(SystemTime::now()).saturating_sub(self.retention.as_secs());
+        let mut finished = self.finished.lock();
+        let before = finished.len();
+        finished.retain(|session| session.ended_at.is_none_or(|ended| ended >= cutoff));
+        if finished.len() == before {
+            return Ok(());
+        }
+        debug!("Dropped {} expired sessions", before - finished.len());
+        let Some(path) = &self.path else {
+            return Ok(());
+        };
+
+        let tmp_path = path.with_extension("tmp");
+        let mut tmp = std::fs::OpenOptions::new()
+            .write(true)
+            .create(true)
+            .truncate(true)
+            .mode(0o600)
+            .open(&tmp_path)
+            .with_context(|| format!("failed to create {}", tmp_path.display()))?;
+        for session in finished.iter() {
+            let mut line = serde_json::to_string(session).expect("sessions serialize");
+            line.push('\n');
+            tmp.write_all(line.as_bytes())?;
+        }
+        tmp.sync_all()?;
+        std::fs::rename(&tmp_path, path)
+            .with_context(|| format!("failed to replace {}", path.display()))?;
+        Ok(())
+    }
+}
+
+fn unix_secs(time: SystemTime) -> u64 {
+    time.duration_since(UNIX_EPOCH).map_or(0, |d| d.as_secs())
+}
@@ -0,0 +1,136 @@
+//! Server name extraction from a connection's first bytes: the SNI of a
+//! TLS ClientHello, or the Host header of a plain HTTP request
+//!
+//! Only the first TLS record is inspected; a ClientHello split across
+//! records is treated as having no server name.
+
+use std::net::IpAddr;
+
+/// Result of looking for a server name in a connection's first bytes
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum ClientHello {
+    /// More bytes are needed to finish the first record or request head
+    Incomplete,
+    /// The bytes are neither a TLS ClientHello nor an HTTP request
+    Unrecognized,
+    /// A ClientHello or request head, with its server name if it sent one
+    Parsed(Option<String>),
+}
+
+const RECORD_HANDSHAKE: u8 = 0x16;
+const HANDSHAKE_CLIENT_HELLO: u8 = 0x01;
+const EXTENSION_SERVER_NAME: u16 = 0x0000;
+const NAME_TYPE_HOST_NAME: u8 = 0x00;
+const MAX_HTTP_HEADERS: usize = 64;
+
+/// Parse the start of a client's stream
+pub fn parse(data: &[u8]) -> ClientHello {
+    if data.is_empty() {
+        return ClientHello::Incomplete;
+    }
+    if data[0] != RECORD_HANDSHAKE {
+        return parse_http(data);
+    }
+    if data.len() < 5 {
+        return ClientHello::Incomplete;
+    }
+    let record_len = u16::from_be_bytes([data[3], data[4]]) as usize;
+    let Some(record) = data.get(5..5 + record_len) else {
+        return ClientHello::Incomplete;
+    };
+    if record.first() != Some(&HANDSHAKE_CLIENT_HELLO) {
+        return ClientHello::Unrecognized;
+    }
+    ClientHello::Parsed(server_name(record))
+}
+
+/// Find the Host header of an HTTP request head. Hosts given as IP
+/// addresses are not server names.
+fn parse_http(data: &[u8]) -> ClientHello {
+    let mut headers = [httparse::EMPTY_HEADER; MAX_HTTP_HEADERS];
+    let mut request = httparse::Request::new(&mut headers);
+    match request.parse(data) {
+        Ok(httparse::Status::Complete(_)) => {}
+        Ok(httparse::Status::Partial) => return ClientHello::Incomplete,
+        Err(_) => return ClientHello::Unrecognized,
+    }
+    let host = request
+        .headers
+        .iter()
+        .find(|header| header.name.eq_ignore_ascii_case("host"))
+        .and_then(|header| std::str::from_utf8(header.value).ok())
+        .map(|host| host.trim())
+        .filter(|host| !host.starts_with('['))
+        .map(|host| match host.rsplit_once(':') {
+            Some((name, port)) if port.bytes().all(|b| b.is_ascii_digit()) => name,
+            _ => host,
+        })
+        .filter(|host| host.parse::<IpAddr>().is_err())
+        .map(|host| host.trim_end_matches('.').to_ascii_lowercase())
+        .filter(|host| !host.is_empty());
+    ClientHello::Parsed(host)
+}
+
+/// Find the host name in a ClientHello handshake message
+fn server_name(handshake: &[u8]) -> Option<String> {
+    let mut r = Reader(handshake);
+    r.skip(4)?; // handshake type and length
+    r.skip(2 + 32)?; // client version and random
+    let session_id = r.u8()? as usize;
+    r.skip(session_id)?;
+    let cipher_suites = r.u16()? as usize;
+    r.skip(cipher_suites)?;
+    let compression = r.u8()? as usize;
+    r.skip(compression)?;
+
+    let extensions_len = r.u16()? as usize;
+    let mut extensions = Reader(r.take(extensions_len)?);
+    while !extensions.0.is_empty() {
+        let kind = extensions.u16()?;
+        let len = extensions.u16()? as usize;
+        let body = extensions.take(len)?;
+        if kind != EXTENSION_SERVER_NAME {
+            continue;
+        }
+
+        let mut list = Reader(body);
+        let list_len = list.u16()? as usize;
+        let mut names = Reader(list.take(list_len)?);
+        while !names.0.is_empty() {
+            let name_type = names.u8()?;
+            let len = names.u16()? as usize;
+            let name = names.take(len)?;
+            if name_type == NAME_TYPE_HOST_NAME {
+                let name = std::str::from_utf8(name).ok()?;
+                return Some(name.trim_end_matches('.').to_ascii_lowercase());
+            }
+        }
+        return None;
+    }
+    None
+}
+
+struct Reader<'a>(&'a [u8]);
+
+impl<'a> Reader<'a> {
+    fn take(&mut self, len: usize) -> Option<&'a [u8]> {
+        if self.0.len() < len {
+            return None;
+        }
+        let (head, rest) = self.0.split_at(len);
+        self.0 = rest;
+        Some(head)
+    }
+
+    fn skip(&mut self, len: usize) -> Option<()> {
+        self.take(len).map(|_| ())
+    }
+
+    fn u8(&mut self) -> Option<u8> {
+        self.take(1).map(|b| b[0])
+    }
+
+    fn u16(&mut self) -> Option<u16> {
+        self.take(2).map(|b| u16::from_be_bytes([b[0], b[1]]))
+    }
+}
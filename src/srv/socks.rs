@@ -0,0 +1,473 @@
+//! SOCKS5 service for peers
+//!
+//! With `--socks-port`, the server IP inside the tunnel also runs a SOCKS5
+//! server (RFC 1928), which many tools and language runtimes speak more
+//! readily than an HTTP proxy. CONNECT opens a TCP connection to the
+//! destination, and UDP ASSOCIATE relays datagrams sent to the same port of
+//! the server IP over UDP, for as long as the client keeps the connection
+//! that asked for it open. BIND and IPv6 destinations are not supported.
+//!
+//! As with the [HTTP proxy](super::http_proxy), names are resolved through
+//! the peer's DNS policy, and each destination must pass the peer's policy
+//! as a NATed flow would, with a CONNECT's domain name standing in for the
+//! TLS server name egress ACLs match on. `--socks-user` requires
+//! username/password authentication (RFC 1929).
+
+use std::collections::HashMap;
+use std::io;
+use std::net::{Ipv4Addr, SocketAddrV4};
+use std::sync::atomic::{AtomicU16, Ordering};
+use std::sync::Arc;
+use std::time::Duration;
+
+use anyhow::{Context, Result};
+use parking_lot::Mutex;
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt};
+use tokio::sync::mpsc;
+use tokio::task::JoinSet;
+use tracing::debug;
+
+use super::api::constant_time_eq;
+use super::dns::DNS_PORT;
+use super::egress::Datagrams;
+use super::flow::Protocol;
+use super::http_proxy::Peer;
+
+const VERSION: u8 = 5;
+const METHOD_NONE: u8 = 0x00;
+const METHOD_PASSWORD: u8 = 0x02;
+const METHOD_UNACCEPTABLE: u8 = 0xff;
+/// Version of the username/password subnegotiation (RFC 1929)
+const PASSWORD_VERSION: u8 = 1;
+
+const CMD_CONNECT: u8 = 1;
+const CMD_UDP_ASSOCIATE: u8 = 3;
+
+const ATYP_IPV4: u8 = 1;
+const ATYP_DOMAIN: u8 = 3;
+const ATYP_IPV6: u8 = 4;
+
+const REP_SUCCEEDED: u8 = 0x00;
+const REP_NOT_ALLOWED: u8 = 0x02;
+const REP_HOST_UNREACHABLE: u8 = 0x04;
+const REP_REFUSED: u8 = 0x05;
+const REP_COMMAND_NOT_SUPPORTED: u8 = 0x07;
+const REP_ADDRESS_NOT_SUPPORTED: u8 = 0x08;
+
+/// How long a client has to authenticate and send its request
+const HANDSHAKE_TIMEOUT: Duration = Duration::from_secs(30);
+/// Datagrams queued from a client before new ones are dropped
+const UDP_QUEUE: usize = 256;
+/// Most destinations one UDP association may send to
+const MAX_UDP_DESTINATIONS: usize = 256;
+const MAX_DATAGRAM: usize = 65535;
+
+/// Sends a datagram from the service's port to a client in the tunnel
+pub type SendToClient = Arc<dyn Fn(SocketAddrV4, Vec<u8>) + Send + Sync>;
+
+/// The service's port and credentials, and its open UDP associations
+pub struct SocksServer {
+    port: u16,
+    server_ip: Ipv4Addr,
+    /// `user:password` pairs accepted, if authentication is required
+    users: Vec<String>,
+    /// By the peer that opened it, its client IP and the port the client
+    /// said it would send from, or 0 if it did not say
+    associations: Mutex<HashMap<([u8; 32], Ipv4Addr, u16), Arc<Association>>>,
+}
+
+/// Where datagrams for one UDP association are queued, with the port
+/// they came from
+struct Association {
+    tx: mpsc::Sender<(u16, Vec<u8>)>,
+}
+
+/// A destination as a client gave it
+enum Address {
+    Ip(SocketAddrV4),
+    Domain(String, u16),
+    Ipv6,
+}
+
+impl SocksServer {
+    pub fn new(port: u16, server_ip: Ipv4Addr, users: Vec<String>) -> Result<Self> {
+        if port == DNS_PORT {
+            anyhow::bail!("port {} is the DNS service's", port);
+        }
+        if let Some(user) = users.iter().find(|user| !user.contains(':')) {
+            anyhow::bail!("SOCKS user {} is not user:password", user);
+        }
+        Ok(Self {
+            port,
+            server_ip,
+            users,
+            associations: Mutex::new(HashMap::new()),
+        })
+    }
+
+    pub fn port(&self) -> u16 {
+        self.port
+    }
+
+    /// Serve one TCP connection from a peer. Datagrams of a UDP association
+    /// it opens are sent back with `send_to_client`.
+    pub async fn serve<S: AsyncRead + AsyncWrite + Unpin>(
+        self: &Arc<Self>,
+        mut client: S,
+        peer: Peer,
+        send_to_client: SendToClient,
+    ) {
+        let handshake = async {
+            if !self.negotiate(&mut client).await? {
+                return Ok(None);
+            }
+            read_request(&mut client).await.map(Some)
+        };
+        let (command, address) = match tokio::time::timeout(HANDSHAKE_TIMEOUT, handshake).await {
+            Ok(Ok(Some(request))) => request,
+            Ok(Ok(None)) | Err(_) => return,
+            Ok(Err(e)) => {
+                debug!("Bad SOCKS5 handshake from {}: {:#}", peer.client, e);
+                return;
+            }
+        };
+        match command {
+            CMD_CONNECT => connect(&mut client, &peer, address).await,
+            CMD_UDP_ASSOCIATE => self.associate(client, peer, address, send_to_client).await,
+            _ => {
+                let _ = reply(&mut client, REP_COMMAND_NOT_SUPPORTED, unspecified()).await;
+            }
+        }
+    }
+
+    /// Pass a datagram a client sent to the service's port to its
+    /// association, if it has one. Only the peer that opened an
+    /// association can send on it, whatever address its datagrams claim.
+    pub fn deliver(
+        &self,
+        peer_pubkey: &[u8; 32],
+        client_ip: Ipv4Addr,
+        client_port: u16,
+        datagram: &[u8],
+    ) {
+        let association = {
+            let associations = self.associations.lock();
+            associations
+                .get(&(*peer_pubkey, client_ip, client_port))
+                .or_else(|| associations.get(&(*peer_pubkey, client_ip, 0)))
+                .cloned()
+        };
+        match association {
+            Some(association) => {
+                let _ = association.tx.try_send((client_port, datagram.to_vec()));
+            }
+            None => debug!(
+                "Dropping SOCKS5 datagram from {}:{} with no association",
+                client_ip, client_port
+            ),
+        }
+    }
+
+    /// Agree on an authentication method and authenticate. Returns whether
+    /// the client may go on to its request.
+    async fn negotiate<S: AsyncRead + AsyncWrite + Unpin>(&self, client: &mut S) -> Result<bool> {
+        let mut greeting = [0u8; 2];
+        client.read_exact(&mut greeting).await?;
+        if greeting[0] != VERSION {
+            anyhow::bail!("not a SOCKS5 client");
+        }
+        let mut methods = vec![0u8; usize::from(greeting[1])];
+        client.read_exact(&mut methods).await?;
+        let method = if self.users.is_empty() {
+            METHOD_NONE
+        } else {
+            METHOD_PASSWORD
+        };
+        if !methods.contains(&method) {
+            client.write_all(&[VERSION, METHOD_UNACCEPTABLE]).await?;
+            return Ok(false);
+        }
+        client.write_all(&[VERSION, method]).await?;
+        if method == METHOD_NONE {
+            return Ok(true);
+        }
+
+        let mut header = [0u8; 2];
+        client.read_exact(&mut header).await?;
+        if header[0] != PASSWORD_VERSION {
+            anyhow::bail!("unknown authentication version {}", header[0]);
+        }
+        let mut given = vec![0u8; usize::from(header[1])];
+        client.read_exact(&mut given).await?;
+        let mut password = vec![0u8; usize::from(client.read_u8().await?)];
+        client.read_exact(&mut password).await?;
+        given.push(b':');
+        given.extend_from_slice(&password);
+        let accepted = self
+            .users
+            .iter()
+            .any(|user| constant_time_eq(user.as_bytes(), &given));
+        let status = if accepted { 0x00 } else { 0x01 };
+        client.write_all(&[PASSWORD_VERSION, status]).await?;
+        if !accepted {
+            debug!("SOCKS5 authentication failed");
+        }
+        Ok(accepted)
+    }
+
+    /// Relay the client's datagrams until it closes the connection
+    async fn associate<S: AsyncRead + AsyncWrite + Unpin>(
+        self: &Arc<Self>,
+        mut client: S,
+        peer: Peer,
+        address: Address,
+        send_to_client: SendToClient,
+    ) {
+        // The client may say which port it will send from, or leave it 0
+        let port = match address {
+            Address::Ip(addr) => addr.port(),
+            _ => 0,
+        };
+        let key = (peer.pubkey, *peer.client.ip(), port);
+        let (tx, rx) = mpsc::channel(UDP_QUEUE);
+        let association = Arc::new(Association { tx });
+        self.associations
+            .lock()
+            .insert(key, Arc::clone(&association));
+
+        let bound = SocketAddrV4::new(self.server_ip, self.port);
+        if reply(&mut client, REP_SUCCEEDED, bound).await.is_ok() {
+            let control = async {
+                let mut byte = [0u8; 1];
+                while let Ok(1..) = client.read(&mut byte).await {}
+            };
+            tokio::select! {
+                _ = relay_udp(&peer, rx, send_to_client) => {}
+                _ = control => {}
+            }
+        }
+
+        let mut associations = self.associations.lock();
+        if associations
+            .get(&key)
+            .is_some_and(|current| Arc::ptr_eq(current, &association))
+        {
+            associations.remove(&key);
+        }
+    }
+}
+
+/// Read the client's request: its command and destination
+async fn read_request<S: AsyncRead + AsyncWrite + Unpin>(client: &mut S) -> Result<(u8, Address)> {
+    let mut header = [0u8; 4];
+    client.read_exact(&mut header).await?;
+    if header[0] != VERSION {
+        anyhow::bail!("request is not SOCKS5");
+    }
+    let address = match header[3] {
+        ATYP_IPV4 => {
+            let mut addr = [0u8; 6];
+            client.read_exact(&mut addr).await?;
+            Address::Ip(SocketAddrV4::new(
+                Ipv4Addr::new(addr[0], addr[1], addr[2], addr[3]),
+                u16::from_be_bytes([addr[4], addr[5]]),
+            ))
+        }
+        ATYP_DOMAIN => {
+            let len = usize::from(client.read_u8().await?);
+            let mut name = vec![0u8; len + 2];
+            client.read_exact(&mut name).await?;
+            let port = u16::from_be_bytes([name[len], name[len + 1]]);
+            name.truncate(len);
+            let name = String::from_utf8(name).context("domain name is not UTF-8")?;
+            Address::Domain(name, port)
+        }
+        ATYP_IPV6 => {
+            let mut addr = [0u8; 18];
+            client.read_exact(&mut addr).await?;
+            Address::Ipv6
+        }
+        atyp => {
+            reply(client, REP_ADDRESS_NOT_SUPPORTED, unspecified()).await?;
+            anyhow::bail!("unknown address type {}", atyp);
+        }
+    };
+    Ok((header[1], address))
+}
+
+/// Resolve a destination for the peer, returning it with the domain name
+/// it was given by, or the reply code to refuse it with
+async fn resolve(peer: &Peer, address: Address) -> Result<(SocketAddrV4, Option<String>), u8> {
+    match address {
+        Address::Ip(addr) => Ok((addr, None)),
+        Address::Domain(name, port) => match peer.resolve(&name).await {
+            Some(ip) => {
+                let name = name.parse::<Ipv4Addr>().is_err().then_some(name);
+                Ok((SocketAddrV4::new(ip, port), name))
+            }
+            None => Err(REP_HOST_UNREACHABLE),
+        },
+        Address::Ipv6 => Err(REP_ADDRESS_NOT_SUPPORTED),
+    }
+}
+
+/// Open a TCP connection to the destination and relay it
+async fn connect<S: AsyncRead + AsyncWrite + Unpin>(client: &mut S, peer: &Peer, address: Address) {
+    let (target, name) = match resolve(peer, address).await {
+        Ok(resolved) => resolved,
+        Err(rep) => {
+            let _ = reply(client, rep, unspecified()).await;
+            return;
+        }
+    };
+    if !peer.allows(Protocol::Tcp, target, name.as_deref()) {
+        debug!("Policy refuses SOCKS5 CONNECT to {}", target);
+        let _ = reply(client, REP_NOT_ALLOWED, unspecified()).await;
+        return;
+    }
+    let Some(_permit) = peer.open_flow() else {
+        let _ = reply(client, REP_NOT_ALLOWED, unspecified()).await;
+        return;
+    };
+    let mut upstream = match peer.policy.egress.connect_tcp(target).await {
+        Ok(upstream) => upstream,
+        Err(e) => {
+            debug!("SOCKS5 CONNECT to {} failed: {}", target, e);
+            let rep = match e.kind() {
+                io::ErrorKind::ConnectionRefused => REP_REFUSED,
+                io::ErrorKind::PermissionDenied => REP_NOT_ALLOWED,
+                _ => REP_HOST_UNREACHABLE,
+            };
+            let _ = reply(client, rep, unspecified()).await;
+            return;
+        }
+    };
+    if reply(client, REP_SUCCEEDED, unspecified()).await.is_err() {
+        return;
+    }
+    if let Err(e) = tokio::io::copy_bidirectional(client, &mut upstream).await {
+        debug!("SOCKS5 connection to {} ended: {}", target, e);
+    }
+}
+
+/// Send the client's datagrams on to their destinations, opening a flow to
+/// each, and the destinations' datagrams back
+async fn relay_udp(
+    peer: &Peer,
+    mut from_client: mpsc::Receiver<(u16, Vec<u8>)>,
+    send_to_client: SendToClient,
+) {
+    // Replies go to the port the client last sent from
+    let client_port = Arc::new(AtomicU16::new(peer.client.port()));
+    let mut destinations: HashMap<SocketAddrV4, Arc<Datagrams>> = HashMap::new();
+    // Receivers are aborted along with the association
+    let mut receivers = JoinSet::new();
+    while let Some((port, datagram)) = from_client.recv().await {
+        client_port.store(port, Ordering::Relaxed);
+        let Some((address, data)) = parse_datagram(&datagram) else {
+            continue;
+        };
+        let Ok((target, _)) = resolve(peer, address).await else {
+            continue;
+        };
+        let socket = match destinations.get(&target) {
+            Some(socket) => Arc::clone(socket),
+            None => {
+                if destinations.len() >= MAX_UDP_DESTINATIONS
+                    || !peer.allows(Protocol::Udp, target, None)
+                {
+                    debug!("Dropping SOCKS5 datagram to {}", target);
+                    continue;
+                }
+                let socket = match peer.policy.egress.open_udp(target, None).await {
+                    Ok(socket) => Arc::new(socket),
+                    Err(e) => {
+                        debug!("SOCKS5 UDP to {} failed: {}", target, e);
+                        continue;
+                    }
+                };
+                receivers.spawn(receive_udp(
+                    Arc::clone(&socket),
+                    target,
+                    *peer.client.ip(),
+                    Arc::clone(&client_port),
+                    Arc::clone(&send_to_client),
+                ));
+                destinations.insert(target, Arc::clone(&socket));
+                socket
+            }
+        };
+        if let Err(e) = socket.send(data).await {
+            debug!("SOCKS5 UDP send to {} failed: {}", target, e);
+        }
+    }
+}
+
+/// Pass a destination's datagrams back to the client, with the SOCKS5 UDP
+/// header naming where they came from
+async fn receive_udp(
+    socket: Arc<Datagrams>,
+    from: SocketAddrV4,
+    client_ip: Ipv4Addr,
+    client_port: Arc<AtomicU16>,
+    send_to_client: SendToClient,
+) {
+    let mut buf = vec![0u8; MAX_DATAGRAM];
+    loop {
+        let n = match socket.recv(&mut buf).await {
+            Ok(n) => n,
+            Err(e) => {
+                debug!("SOCKS5 UDP receive from {} failed: {}", from, e);
+                return;
+            }
+        };
+        let mut datagram = Vec::with_capacity(10 + n);
+        datagram.extend_from_slice(&[0, 0, 0, ATYP_IPV4]);
+        datagram.extend_from_slice(&from.ip().octets());
+        datagram.extend_from_slice(&from.port().to_be_bytes());
+        datagram.extend_from_slice(&buf[..n]);
+        let client = SocketAddrV4::new(client_ip, client_port.load(Ordering::Relaxed));
+        send_to_client(client, datagram);
+    }
+}
+
+/// Split a client's datagram into its destination and data. Fragments are
+/// not supported and are dropped.
+fn parse_datagram(datagram: &[u8]) -> Option<(Address, &[u8])> {
+    let (header, rest) = datagram.split_first_chunk::<4>()?;
+    let [0, 0, 0, atyp] = *header else {
+        return None;
+    };
+    let (address, len) = match atyp {
+        ATYP_IPV4 => {
+            let addr = rest.get(..6)?;
+            let ip = Ipv4Addr::new(addr[0], addr[1], addr[2], addr[3]);
+            let port = u16::from_be_bytes([addr[4], addr[5]]);
+            (Address::Ip(SocketAddrV4::new(ip, port)), 6)
+        }
+        ATYP_DOMAIN => {
+            let len = usize::from(*rest.first()?);
+            let addr = rest.get(1..len + 3)?;
+            let name = std::str::from_utf8(&addr[..len]).ok()?.to_string();
+            let port = u16::from_be_bytes([addr[len], addr[len + 1]]);
+            (Address::Domain(name, port), len + 3)
+        }
+        _ => return None,
+    };
+    Some((address, &rest[len..]))
+}
+
+fn unspecified() -> SocketAddrV4 {
+    SocketAddrV4::new(Ipv4Addr::UNSPECIFIED, 0)
+}
+
+async fn reply<S: AsyncWrite + Unpin>(
+    client: &mut S,
+    rep: u8,
+    bound: SocketAddrV4,
+) -> io::Result<()> {
+    let mut reply = vec![VERSION, rep, 0x00, ATYP_IPV4];
+    reply.extend_from_slice(&bound.ip().octets());
+    reply.extend_from_slice(&bound.port().to_be_bytes());
+    client.write_all(&reply).await
+}
@@ -0,0 +1,233 @@
+//! Bandwidth tests for peers
+//!
+//! With `--speedtest-port` the server answers throughput tests on that port
+//! of its VPN addresses, measuring the tunnel end to end without a host out
+//! on the internet in the way. Over TCP it speaks plain HTTP, so `curl` is
+//! a client: `GET /download?bytes=N` sends N bytes, 100 MB by default, and
+//! a `POST` or `PUT` to `/upload` takes a body of any length, sized or
+//! chunked, and answers with how fast it arrived as JSON. Over UDP each
+//! datagram is sent straight back, so a client sending at a given rate can
+//! count what returns for loss. `wirecage speedtest` runs all three from
+//! inside a cage.
+//!
+//! Tests stay inside the tunnel: they open no NATed flows, and firewall
+//! rules and egress ACLs do not apply to them.
+
+use std::net::SocketAddr;
+use std::time::{Duration, Instant};
+
+use anyhow::{Context, Result};
+use tokio::io::{
+    AsyncBufRead, AsyncBufReadExt, AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt, BufReader,
+};
+use tokio::net::{TcpListener, UdpSocket};
+use tracing::{debug, warn};
+
+use super::http_proxy::{self, Head};
+
+/// Bytes a download sends when the request doesn't say
+const DEFAULT_DOWNLOAD_BYTES: u64 = 100_000_000;
+/// How long a client has to send its request head
+const HEAD_TIMEOUT: Duration = Duration::from_secs(30);
+const WRITE_CHUNK: usize = 64 * 1024;
+/// Longest chunk size or trailer line accepted in a chunked upload
+const MAX_LINE: u64 = 1024;
+
+/// Serve one test connection from a peer
+pub async fn serve<S: AsyncRead + AsyncWrite + Unpin>(mut client: S) {
+    if let Err(e) = serve_request(&mut client).await {
+        debug!("Speed test connection failed: {:#}", e);
+    }
+}
+
+async fn serve_request<S: AsyncRead + AsyncWrite + Unpin>(client: &mut S) -> Result<()> {
+    let mut buf = Vec::new();
+    let head = tokio::time::timeout(HEAD_TIMEOUT, http_proxy::read_head(client, &mut buf))
+        .await
+        .context("timed out waiting for the request")??;
+    let Some(head) = head else {
+        return Ok(());
+    };
+    let (path, query) = head
+        .target
+        .split_once('?')
+        .unwrap_or((head.target.as_str(), ""));
+    match (head.method.as_str(), path) {
+        ("GET", "/download") => match download_len(query) {
+            Some(len) => download(client, len).await,
+            None => respond(client, "400 Bad Request", r#"{"error":"invalid bytes"}"#).await,
+        },
+        ("POST" | "PUT", "/upload") => upload(client, &head, &buf[head.len..]).await,
+        _ => respond(client, "404 Not Found", r#"{"error":"not found"}"#).await,
+    }
+}
+
+/// The `bytes` a download asks for, or the default
+fn download_len(query: &str) -> Option<u64> {
+    match query
+        .split('&')
+        .find_map(|pair| pair.strip_prefix("bytes="))
+    {
+        Some(bytes) => bytes.parse().ok(),
+        None => Some(DEFAULT_DOWNLOAD_BYTES),
+    }
+}
+
+async fn download<S: AsyncWrite + Unpin>(client: &mut S, len: u64) -> Result<()> {
+    let head = format!(
+        "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\n\
+         Content-Length: {}\r\nCache-Control: no-store\r\nConnection: close\r\n\r\n",
+        len
+    );
+    client.write_all(head.as_bytes()).await?;
+    let chunk = vec![0u8; WRITE_CHUNK];
+    let mut left = len;
+    while left > 0 {
+        let n = left.min(WRITE_CHUNK as u64) as usize;
+        client.write_all(&chunk[..n]).await?;
+        left -= n as u64;
+    }
+    client.shutdown().await?;
+    Ok(())
+}
+
+/// Read the request's body, dropping it as it arrives, and answer with how
+/// long it took
+async fn upload<S: AsyncRead + AsyncWrite + Unpin>(
+    client: &mut S,
+    head: &Head,
+    early_data: &[u8],
+) -> Result<()> {
+    // curl waits a second for this before sending a large body
+    if head
+        .header("expect")
+        .is_some_and(|expect| expect.eq_ignore_ascii_case("100-continue"))
+    {
+        client.write_all(b"HTTP/1.1 100 Continue\r\n\r\n").await?;
+    }
+    let chunked = head
+        .header("transfer-encoding")
+        .is_some_and(|encoding| encoding.to_ascii_lowercase().contains("chunked"));
+    let start = Instant::now();
+    let bytes = {
+        let mut body = BufReader::new(early_data.chain(&mut *client));
+        if chunked {
+            discard_chunked(&mut body).await?
+        } else {
+            let len = match head.header("content-length") {
+                Some(len) => len.trim().parse().context("invalid Content-Length")?,
+                None => 0,
+            };
+            discard(&mut body, len).await?
+        }
+    };
+    let seconds = start.elapsed().as_secs_f64();
+    let bits_per_second = if seconds > 0.0 {
+        bytes as f64 * 8.0 / seconds
+    } else {
+        0.0
+    };
+    let result = serde_json::json!({
+        "bytes": bytes,
+        "seconds": seconds,
+        "bits_per_second": bits_per_second,
+    });
+    respond(client, "200 OK", &result.to_string()).await
+}
+
+/// Read and drop `len` bytes of body
+async fn discard<R: AsyncBufRead + Unpin>(body: &mut R, len: u64) -> Result<u64> {
+    let read = tokio::io::copy_buf(&mut (&mut *body).take(len), &mut tokio::io::sink()).await?;
+    if read < len {
+        anyhow::bail!("connection closed mid-body");
+    }
+    Ok(read)
+}
+
+/// Read and drop a chunked body, returning the bytes its chunks held
+async fn discard_chunked<R: AsyncBufRead + Unpin>(body: &mut R) -> Result<u64> {
+    let mut total = 0;
+    let mut line = String::new();
+    loop {
+        read_line(body, &mut line).await?;
+        let size = line.split(';').next().unwrap_or_default().trim();
+        let size = u64::from_str_radix(size, 16)
+            .with_context(|| format!("invalid chunk size {:?}", size))?;
+        if size == 0 {
+            break;
+        }
+        total += discard(body, size).await?;
+        // The line break ending the chunk
+        read_line(body, &mut line).await?;
+    }
+    // Trailers, up to the blank line
+    loop {
+        read_line(body, &mut line).await?;
+        if line.trim().is_empty() {
+            return Ok(total);
+        }
+    }
+}
+
+async fn read_line<R: AsyncBufRead + Unpin>(body: &mut R, line: &mut String) -> Result<()> {
+    line.clear();
+    let n = (&mut *body).take(MAX_LINE).read_line(line).await?;
+    if n == 0 {
+        anyhow::bail!("connection closed mid-body");
+    }
+    if !line.ends_with('\n') {
+        anyhow::bail!("chunked body line over {} bytes", MAX_LINE);
+    }
+    Ok(())
+}
+
+async fn respond<S: AsyncWrite + Unpin>(client: &mut S, status: &str, body: &str) -> Result<()> {
+    let response = format!(
+        "HTTP/1.1 {}\r\nContent-Type: application/json\r\nContent-Length: {}\r\n\
+         Connection: close\r\n\r\n{}",
+        status,
+        body.len(),
+        body
+    );
+    client.write_all(response.as_bytes()).await?;
+    client.shutdown().await?;
+    Ok(())
+}
+
+/// Serve tests on sockets bound to `addr`, for kernel WireGuard mode where
+/// the dataplane does not see peers' packets
+pub async fn listen(addr: SocketAddr) -> Result<()> {
+    let listener = TcpListener::bind(addr)
+        .await
+        .with_context(|| format!("failed to bind speed tests on TCP {}", addr))?;
+    let socket = UdpSocket::bind(addr)
+        .await
+        .with_context(|| format!("failed to bind speed tests on UDP {}", addr))?;
+    tokio::try_join!(accept(listener), echo(socket))?;
+    Ok(())
+}
+
+async fn accept(listener: TcpListener) -> Result<()> {
+    loop {
+        match listener.accept().await {
+            Ok((stream, _)) => {
+                tokio::spawn(serve(stream));
+            }
+            Err(e) => warn!("Failed to accept speed test connection: {}", e),
+        }
+    }
+}
+
+/// Send each datagram back where it came from
+async fn echo(socket: UdpSocket) -> Result<()> {
+    let mut buf = vec![0u8; 65536];
+    loop {
+        let (n, client) = socket
+            .recv_from(&mut buf)
+            .await
+            .context("speed test receive failed")?;
+        if let Err(e) = socket.send_to(&buf[..n], client).await {
+            debug!("Speed test echo to {} failed: {}", client, e);
+        }
+    }
+}
@@ -0,0 +1,251 @@
+//! SSH-key-authorized enrollment
+//!
+//! Clients may register by signing their WireGuard public key with an SSH
+//! key (`ssh-keygen -Y sign`, usually through the agent) listed in an
+//! authorized_keys-style file. The key's comment becomes the peer name, so
+//! teams that already distribute SSH keys need no new secrets.
+//!
+//! The signed message is `wirecage-enroll <wireguard key> <unix time>` in
+//! the `wirecage-enroll` namespace; signatures are accepted for a few
+//! minutes either side of the stated time.
+
+use std::path::PathBuf;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::{Context, Result};
+use aws_lc_rs::digest;
+use aws_lc_rs::signature::{self, RsaPublicKeyComponents, UnparsedPublicKey};
+use base64::Engine;
+
+pub const NAMESPACE: &str = "wirecage-enroll";
+
+/// How far a signature's timestamp may be from the server's clock
+const MAX_SIGNATURE_AGE: Duration = Duration::from_secs(300);
+
+const SSHSIG_MAGIC: &[u8] = b"SSHSIG";
+
+/// Message a client signs to enroll `client_public_key` at `timestamp`
+pub fn enrollment_message(client_public_key: &str, timestamp: u64) -> String {
+    format!("{} {} {}", NAMESPACE, client_public_key, timestamp)
+}
+
+/// An authorized SSH key
+#[derive(Debug, Clone)]
+pub struct SshIdentity {
+    /// The key's authorized_keys comment, if any
+    pub comment: Option<String>,
+    /// OpenSSH-style `SHA256:` fingerprint
+    pub fingerprint: String,
+}
+
+struct AuthorizedKey {
+    blob: Vec<u8>,
+    comment: Option<String>,
+}
+
+pub struct SshAuthorizer {
+    path: PathBuf,
+}
+
+impl SshAuthorizer {
+    /// Use the authorized keys in `path`, which is re-read on every
+    /// registration so edits apply without a restart
+    pub fn new(path: impl Into<PathBuf>) -> Result<Self> {
+        let authorizer = Self { path: path.into() };
+        let keys = authorizer.load()?;
+        tracing::info!(
+            "Loaded {} authorized SSH keys from {}",
+            keys.len(),
+            authorizer.path.display()
+        );
+        Ok(authorizer)
+    }
+
+    fn load(&self) -> Result<Vec<AuthorizedKey>> {
+        let contents = std::fs::read_to_string(&self.path)
+            .with_context(|| format!("failed to read {}", self.path.display()))?;
+        Ok(contents.lines().filter_map(parse_authorized_key).collect())
+    }
+
+    /// Check an armored SSH signature over the enrollment message
+    pub fn authorize(
+        &self,
+        client_public_key: &str,
+        timestamp: u64,
+        armored_signature: &str,
+    ) -> Result<SshIdentity> {
+        let now = SystemTime::now().duration_since(UNIX_EPOCH)?.as_secs();
+        if now.abs_diff(timestamp) > MAX_SIGNATURE_AGE.as_secs() {
+            anyhow::bail!("signature timestamp is too far from the server's clock");
+        }
+
+        let message = enrollment_message(client_public_key, timestamp);
+        let signer = verify_sshsig(armored_signature, message.as_bytes())?;
+        let key = self
+            .load()?
+            .into_iter()
+            .find(|key| key.blob == signer)
+            .context("signing key is not authorized")?;
+        Ok(SshIdentity {
+            comment: key.comment,
+            fingerprint: fingerprint(&key.blob),
+        })
+    }
+}
+
+/// Parse `[options] keytype base64 [comment]`, skipping blanks and comments
+fn parse_authorized_key(line: &str) -> Option<AuthorizedKey> {
+    let line = line.trim();
+    if line.is_empty() || line.starts_with('#') {
+        return None;
+    }
+    let fields: Vec<&str> = line.split_whitespace().collect();
+    // Options come first when present; the key type is the first field that names one
+    let type_index = fields.iter().position(|field| is_key_type(field))?;
+    let blob = base64::engine::general_purpose::STANDARD
+        .decode(fields.get(type_index + 1)?)
+        .ok()?;
+    let comment = fields[type_index + 2..].join(" ");
+    Some(AuthorizedKey {
+        blob,
+        comment: (!comment.is_empty()).then_some(comment),
+    })
+}
+
+fn is_key_type(field: &str) -> bool {
+    matches!(field, "ssh-ed25519" | "ssh-rsa" | "ecdsa-sha2-nistp256")
+}
+
+fn fingerprint(blob: &[u8]) -> String {
+    let hash = digest::digest(&digest::SHA256, blob);
+    format!(
+        "SHA256:{}",
+        base64::engine::general_purpose::STANDARD_NO_PAD.encode(hash.as_ref())
+    )
+}
+
+/// Verify an OpenSSH SSHSIG signature in our namespace, returning the
+/// public key blob that made it
+fn verify_sshsig(armored: &str, message: &[u8]) -> Result<Vec<u8>> {
+    let body: String = armored
+        .lines()
+        .map(str::trim)
+        .filter(|line| !line.starts_with("-----"))
+        .collect();
+    let blob = base64::engine::general_purpose::STANDARD
+        .decode(body)
+        .context("invalid signature encoding")?;
+    let fields = blob.strip_prefix(SSHSIG_MAGIC).context("not an SSH signature")?;
+
+    let mut reader = Reader(fields);
+    if reader.u32() != Some(1) {
+        anyhow::bail!("unsupported SSH signature version");
+    }
+    let malformed = || anyhow::anyhow!("malformed SSH signature");
+    let public_key = reader.string().ok_or_else(malformed)?;
+    let namespace = reader.string().ok_or_else(malformed)?;
+    let reserved = reader.string().ok_or_else(malformed)?;
+    let hash_algorithm = reader.string().ok_or_else(malformed)?;
+    let signature = reader.string().ok_or_else(malformed)?;
+    if namespace != NAMESPACE.as_bytes() {
+        anyhow::bail!("signature is for another namespace");
+    }
+
+    let hash = match hash_algorithm {
+        b"sha256" => digest::digest(&digest::SHA256, message),
+        b"sha512" => digest::digest(&digest::SHA512, message),
+        _ => anyhow::bail!("unsupported signature hash"),
+    };
+    let mut signed = SSHSIG_MAGIC.to_vec();
+    for field in [namespace, reserved, hash_algorithm, hash.as_ref()] {
+        put_string(&mut signed, field);
+    }
+
+    if !verify_signature(public_key, signature, &signed) {
+        anyhow::bail!("bad SSH signature");
+    }
+    Ok(public_key.to_vec())
+}
+
+fn verify_signature(public_key: &[u8], signature: &[u8], signed: &[u8]) -> bool {
+    let mut key = Reader(public_key);
+    let mut sig = Reader(signature);
+    let (Some(key_type), Some(sig_type), Some(sig_bytes)) = (key.string(), sig.string(), sig.string())
+    else {
+        return false;
+    };
+
+    match (key_type, sig_type) {
+        (b"ssh-ed25519", b"ssh-ed25519") => key.string().is_some_and(|point| {
+            UnparsedPublicKey::new(&signature::ED25519, point)
+                .verify(signed, sig_bytes)
+                .is_ok()
+        }),
+        (b"ssh-rsa", b"rsa-sha2-256" | b"rsa-sha2-512") => {
+            let (Some(e), Some(n)) = (key.mpint(), key.mpint()) else {
+                return false;
+            };
+            let params = if sig_type == b"rsa-sha2-256" {
+                &signature::RSA_PKCS1_2048_8192_SHA256
+            } else {
+                &signature::RSA_PKCS1_2048_8192_SHA512
+            };
+            RsaPublicKeyComponents { n, e }
+                .verify(params, signed, sig_bytes)
+                .is_ok()
+        }
+        (b"ecdsa-sha2-nistp256", b"ecdsa-sha2-nistp256") => {
+            let (Some(b"nistp256"), Some(point)) = (key.string(), key.string()) else {
+                return false;
+            };
+            // The signature is a pair of mpints; the verifier wants r || s
+            let mut rs = Reader(sig_bytes);
+            let (Some(r), Some(s)) = (rs.mpint(), rs.mpint()) else {
+                return false;
+            };
+            if r.len() > 32 || s.len() > 32 {
+                return false;
+            }
+            let mut fixed = [0u8; 64];
+            fixed[32 - r.len()..32].copy_from_slice(r);
+            fixed[64 - s.len()..].copy_from_slice(s);
+            UnparsedPublicKey::new(&signature::ECDSA_P256_SHA256_FIXED, point)
+                .verify(signed, &fixed)
+                .is_ok()
+        }
+        _ => false,
+    }
+}
+
+fn put_string(out: &mut Vec<u8>, data: &[u8]) {
+    out.extend_from_slice(&(data.len() as u32).to_be_bytes());
+    out.extend_from_slice(data);
+}
+
+/// Reader for the SSH wire encoding (RFC 4251)
+struct Reader<'a>(&'a [u8]);
+
+impl<'a> Reader<'a> {
+    fn u32(&mut self) -> Option<u32> {
+        let (bytes, rest) = self.0.split_first_chunk::<4>()?;
+        self.0 = rest;
+        Some(u32::from_be_bytes(*bytes))
+    }
+
+    fn string(&mut self) -> Option<&'a [u8]> {
+        let len = self.u32()? as usize;
+        if self.0.len() < len {
+            return None;
+        }
+        let (data, rest) = self.0.split_at(len);
+        self.0 = rest;
+        Some(data)
+    }
+
+    /// Unsigned mpint magnitude without its leading zero bytes
+    fn mpint(&mut self) -> Option<&'a [u8]> {
+        let data = self.string()?;
+        let start = data.iter().position(|&b| b != 0).unwrap_or(data.len());
+        Some(&data[start..])
+    }
+}
@@ -4,17 +4,34 @@ use std::collections::HashMap;
 use std::collections::HashSet;
 use std::net::Ipv4Addr;
 use std::sync::Arc;
+use std::time::SystemTime;
 use parking_lot::RwLock;
+use tracing::{error, warn};
 
+use super::audit::AuditLog;
+use super::cluster::Ledger;
+use super::enroll::EnrollmentRegistry;
+use super::events::{self, Event, EventBus};
 use super::flow::{PortForwardRule, Protocol};
+use super::ipv6::Ipv6Prefix;
+use super::metrics::Metrics;
+use super::network::{Network, Networks};
+use super::sessions::SessionHistory;
+use super::store::{self, PeerStore};
 
 /// Configuration for the server
 #[derive(Clone)]
 pub struct ServerConfig {
-    pub server_public_key: [u8; 32],
+    /// The server's address and prefix length in the main network
     pub subnet: Ipv4Addr,
     pub subnet_mask: u8,
+    /// Every network peers are given addresses in, the main one first
+    pub networks: Networks,
     pub auth_token: String,
+    /// Prefix peers' IPv6 addresses are made in, if they have them
+    pub ipv6_prefix: Option<Ipv6Prefix>,
+    /// Peers are given only their IPv6 address and reach IPv4 through NAT64
+    pub ipv6_only: bool,
 }
 
 /// A registered peer
@@ -22,53 +39,109 @@ pub struct ServerConfig {
 pub struct PeerInfo {
     pub public_key: [u8; 32],
     pub assigned_ip: Ipv4Addr,
+    /// DNS label the peer registered under, if any
+    pub name: Option<String>,
+    /// Labels policies can refer to, set through the admin API, by the
+    /// enrollment token, or from OIDC groups
+    pub tags: Vec<String>,
+    /// When the peer is removed automatically, if ever
+    pub expires_at: Option<SystemTime>,
+    /// Extra symmetric key mixed into the handshake
+    pub preshared_key: Option<[u8; 32]>,
 }
 
-/// IP address pool for dynamic allocation
+/// Optional attributes when adding a peer
+#[derive(Debug, Clone, Default)]
+pub struct PeerOptions {
+    pub name: Option<String>,
+    /// Fixed address; allocated from the network if omitted
+    pub address: Option<Ipv4Addr>,
+    pub preshared_key: Option<[u8; 32]>,
+    /// Replaces the peer's tags when given
+    pub tags: Option<Vec<String>>,
+}
+
+/// IP address pool for dynamic allocation across the client networks
 pub struct IpPool {
-    subnet: Ipv4Addr,
-    mask: u8,
+    networks: Networks,
     allocated: HashSet<Ipv4Addr>,
-    next_offset: u32,
+    /// Where allocation resumes in each network
+    next_offsets: Vec<u32>,
 }
 
 impl IpPool {
-    pub fn new(subnet: Ipv4Addr, mask: u8) -> Self {
-        Self {
-            subnet,
-            mask,
+    pub fn new(networks: Networks) -> Self {
+        let mut pool = Self {
+            // Start at .2 (server is .1)
+            next_offsets: networks.iter().map(|_| 2).collect(),
+            networks,
             allocated: HashSet::new(),
-            next_offset: 2, // Start at .2 (server is .1)
+        };
+        // The server's own addresses, which peers must never get
+        let server_ips: Vec<Ipv4Addr> = pool.networks.iter().map(|n| n.server_ip).collect();
+        for ip in server_ips {
+            pool.reserve(ip);
         }
+        pool
     }
 
-    /// Allocate the next available IP
-    pub fn allocate(&mut self) -> Option<Ipv4Addr> {
-        let max_hosts = 1u32 << (32 - self.mask);
-        let base = u32::from(self.subnet) & !(max_hosts - 1);
-        
-        // Try sequential allocation first
-        for _ in 0..max_hosts {
-            let ip = Ipv4Addr::from(base + self.next_offset);
-            self.next_offset = (self.next_offset + 1) % max_hosts;
-            if self.next_offset < 2 {
-                self.next_offset = 2; // Skip .0 and .1
+    /// Allocate the next available IP for a peer with `tags`: from the
+    /// networks kept for its tags if there are any, otherwise from the
+    /// untagged ones, in order
+    pub fn allocate(&mut self, tags: &[String]) -> Option<Ipv4Addr> {
+        let kept = |network: &Network| network.tag.as_ref().is_some_and(|tag| tags.contains(tag));
+        let has_own = self.networks.iter().any(kept);
+        for (i, network) in self.networks.iter().enumerate() {
+            let eligible = if has_own {
+                kept(network)
+            } else {
+                network.tag.is_none()
+            };
+            if !eligible {
+                continue;
             }
-            
-            if !self.allocated.contains(&ip) {
-                self.allocated.insert(ip);
-                return Some(ip);
+            let max_hosts = network.size();
+            let base = network.base();
+            let next_offset = &mut self.next_offsets[i];
+            for _ in 0..max_hosts {
+                let ip = Ipv4Addr::from(base + *next_offset);
+                *next_offset = (*next_offset + 1) % max_hosts;
+                if *next_offset < 2 {
+                    *next_offset = 2; // Skip .0 and .1
+                }
+
+                if self.allocated.insert(ip) {
+                    return Some(ip);
+                }
             }
         }
         None
     }
 
+    /// Mark a specific address as allocated, e.g. when restoring a peer.
+    ///
+    /// Returns false if the address is outside the pool or already in use.
+    pub fn reserve(&mut self, ip: Ipv4Addr) -> bool {
+        let Some(network) = self.networks.containing(ip) else {
+            return false;
+        };
+        if u32::from(ip) - network.base() < 2 {
+            return false;
+        }
+        self.allocated.insert(ip)
+    }
+
+    /// Return an address to the pool
+    pub fn release(&mut self, ip: Ipv4Addr) {
+        self.allocated.remove(&ip);
+    }
 }
 
 /// Peer registry - maps public keys to peer info
 pub struct PeerRegistry {
     by_pubkey: HashMap<[u8; 32], PeerInfo>,
     by_ip: HashMap<Ipv4Addr, [u8; 32]>,
+    by_name: HashMap<String, [u8; 32]>,
 }
 
 impl PeerRegistry {
@@ -76,6 +149,7 @@ impl PeerRegistry {
         Self {
             by_pubkey: HashMap::new(),
             by_ip: HashMap::new(),
+            by_name: HashMap::new(),
         }
     }
 
@@ -83,13 +157,90 @@ impl PeerRegistry {
         let pubkey = info.public_key;
         let ip = info.assigned_ip;
         self.by_ip.insert(ip, pubkey);
+        if let Some(name) = &info.name {
+            self.by_name.insert(name.clone(), pubkey);
+        }
         self.by_pubkey.insert(pubkey, info);
     }
 
+    pub fn remove(&mut self, pubkey: &[u8; 32]) -> Option<PeerInfo> {
+        let info = self.by_pubkey.remove(pubkey)?;
+        self.by_ip.remove(&info.assigned_ip);
+        if let Some(name) = &info.name {
+            self.by_name.remove(name);
+        }
+        Some(info)
+    }
+
+    /// Whether `name` is free for the given peer to use
+    pub fn name_available(&self, name: &str, pubkey: &[u8; 32]) -> bool {
+        self.by_name.get(name).is_none_or(|owner| owner == pubkey)
+    }
+
+    /// Give an existing peer a new name
+    pub fn rename(&mut self, pubkey: &[u8; 32], name: String) -> Result<(), &'static str> {
+        if !self.name_available(&name, pubkey) {
+            return Err("name already in use");
+        }
+        let info = self.by_pubkey.get_mut(pubkey).ok_or("unknown peer")?;
+        if let Some(old) = info.name.replace(name.clone()) {
+            self.by_name.remove(&old);
+        }
+        self.by_name.insert(name, *pubkey);
+        Ok(())
+    }
+
+    /// Replace a peer's tags and expiry, returning false for unknown peers
+    pub fn set_attributes(
+        &mut self,
+        pubkey: &[u8; 32],
+        tags: Vec<String>,
+        expires_at: Option<SystemTime>,
+    ) -> bool {
+        let Some(info) = self.by_pubkey.get_mut(pubkey) else {
+            return false;
+        };
+        info.tags = tags;
+        info.expires_at = expires_at;
+        true
+    }
+
+    /// Replace a peer's tags, returning false for unknown peers
+    pub fn set_tags(&mut self, pubkey: &[u8; 32], tags: Vec<String>) -> bool {
+        let Some(info) = self.by_pubkey.get_mut(pubkey) else {
+            return false;
+        };
+        info.tags = tags;
+        true
+    }
+
+    /// Set or clear a peer's expiry, returning false for unknown peers
+    pub fn set_expiry(&mut self, pubkey: &[u8; 32], expires_at: Option<SystemTime>) -> bool {
+        let Some(info) = self.by_pubkey.get_mut(pubkey) else {
+            return false;
+        };
+        info.expires_at = expires_at;
+        true
+    }
+
+    pub fn set_preshared_key(&mut self, pubkey: &[u8; 32], preshared_key: Option<[u8; 32]>) {
+        if let Some(info) = self.by_pubkey.get_mut(pubkey) {
+            info.preshared_key = preshared_key;
+        }
+    }
+
     pub fn get_by_pubkey(&self, pubkey: &[u8; 32]) -> Option<&PeerInfo> {
         self.by_pubkey.get(pubkey)
     }
 
+    pub fn get_by_ip(&self, ip: &Ipv4Addr) -> Option<&PeerInfo> {
+        self.by_pubkey.get(self.by_ip.get(ip)?)
+    }
+
+    pub fn get_by_name(&self, name: &str) -> Option<&PeerInfo> {
+        self.by_pubkey.get(self.by_name.get(name)?)
+    }
+
     pub fn iter(&self) -> impl Iterator<Item = &PeerInfo> {
         self.by_pubkey.values()
     }
@@ -156,6 +307,44 @@ impl PortForwardRegistry {
         }
     }
 
+    pub fn get(&self, protocol: Protocol, port: u16) -> Option<&PortForwardRule> {
+        match protocol {
+            Protocol::Tcp => self.tcp_rules.get(&port),
+            Protocol::Udp => self.udp_rules.get(&port),
+        }
+    }
+
+    /// Every rule, by protocol and public port
+    pub fn rules(&self) -> Vec<PortForwardRule> {
+        let mut rules: Vec<PortForwardRule> = self
+            .tcp_rules
+            .values()
+            .chain(self.udp_rules.values())
+            .cloned()
+            .collect();
+        rules.sort_by_key(|rule| (rule.protocol == Protocol::Udp, rule.public_port));
+        rules
+    }
+
+    /// All rules forwarding to a peer
+    pub fn rules_for_peer(&self, pubkey: &[u8; 32]) -> Vec<PortForwardRule> {
+        self.tcp_rules
+            .values()
+            .chain(self.udp_rules.values())
+            .filter(|rule| rule.peer_pubkey == *pubkey)
+            .cloned()
+            .collect()
+    }
+
+    /// Remove every rule forwarding to a peer
+    pub fn remove_peer(&mut self, pubkey: &[u8; 32]) -> Vec<PortForwardRule> {
+        let rules = self.rules_for_peer(pubkey);
+        for rule in &rules {
+            self.remove(rule.protocol, rule.public_port);
+        }
+        self.by_peer.remove(pubkey);
+        rules
+    }
 }
 
 impl Default for PortForwardRegistry {
@@ -164,22 +353,610 @@ impl Default for PortForwardRegistry {
     }
 }
 
+/// Why a peer could not be added
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum AddPeerError {
+    NameInUse,
+    NoAddressAvailable,
+    /// The requested address is outside the network or already assigned
+    AddressUnavailable,
+    /// The peer is already registered with a different address
+    AddressMismatch,
+    /// The public key is on the ban list
+    Banned,
+}
+
+impl AddPeerError {
+    pub fn message(self) -> &'static str {
+        match self {
+            AddPeerError::NameInUse => "name already in use",
+            AddPeerError::NoAddressAvailable => "no IPs available",
+            AddPeerError::AddressUnavailable => "address outside the network or already in use",
+            AddPeerError::AddressMismatch => "peer is already registered with a different address",
+            AddPeerError::Banned => "public key is banned",
+        }
+    }
+}
+
+/// A public key that may not be registered
+#[derive(Debug, Clone)]
+pub struct BannedKey {
+    pub public_key: [u8; 32],
+    pub reason: Option<String>,
+    pub banned_at: SystemTime,
+}
+
+/// What `replace_peers` changed
+#[derive(Default)]
+pub struct ReplacePeersResult {
+    pub added: Vec<PeerInfo>,
+    pub updated: Vec<PeerInfo>,
+    pub removed: Vec<PeerInfo>,
+    pub unchanged: usize,
+    /// Port forwards dropped because their peer was removed or readdressed
+    pub removed_rules: Vec<PortForwardRule>,
+}
+
 /// Shared server state
 pub struct SharedState {
     pub config: ServerConfig,
+    /// Public key clients should use, which changes on key rotation
+    server_public_key: RwLock<[u8; 32]>,
     pub ip_pool: RwLock<IpPool>,
     pub peers: RwLock<PeerRegistry>,
     pub port_forwards: RwLock<PortForwardRegistry>,
+    pub events: EventBus,
+    pub enrollment: RwLock<EnrollmentRegistry>,
+    pub audit: AuditLog,
+    pub sessions: SessionHistory,
+    pub metrics: Arc<Metrics>,
+    /// Keys refused registration, by public key
+    pub bans: RwLock<HashMap<[u8; 32], BannedKey>>,
+    store: Option<PeerStore>,
+    /// Changes shared with the other nodes, when clustered
+    pub cluster: Option<Ledger>,
 }
 
 impl SharedState {
-    pub fn new(config: ServerConfig) -> Arc<Self> {
-        let ip_pool = IpPool::new(config.subnet, config.subnet_mask);
+    pub fn new(
+        config: ServerConfig,
+        server_public_key: [u8; 32],
+        store: Option<PeerStore>,
+        audit: AuditLog,
+        sessions: SessionHistory,
+        cluster: Option<Ledger>,
+    ) -> Arc<Self> {
+        let ip_pool = IpPool::new(config.networks.clone());
+        let node = cluster
+            .as_ref()
+            .map(|ledger| ledger.node().to_string())
+            .unwrap_or_default();
         Arc::new(Self {
             config,
+            server_public_key: RwLock::new(server_public_key),
             ip_pool: RwLock::new(ip_pool),
             peers: RwLock::new(PeerRegistry::new()),
             port_forwards: RwLock::new(PortForwardRegistry::new()),
+            events: EventBus::new(),
+            enrollment: RwLock::new(EnrollmentRegistry::new(node)),
+            audit,
+            sessions,
+            metrics: Arc::new(Metrics::default()),
+            bans: RwLock::new(HashMap::new()),
+            store,
+            cluster,
         })
     }
+
+    pub fn server_public_key(&self) -> [u8; 32] {
+        *self.server_public_key.read()
+    }
+
+    pub fn set_server_public_key(&self, public_key: [u8; 32]) {
+        *self.server_public_key.write() = public_key;
+    }
+
+    /// Load peers recorded by a previous run, returning how many were restored
+    pub fn restore_peers(&self) -> anyhow::Result<usize> {
+        let Some(store) = &self.store else {
+            return Ok(0);
+        };
+        let (stored_peers, stored_bans) = store.load()?;
+        Ok(self.restore(stored_peers, stored_bans))
+    }
+
+    /// Register peers and bans carried over from a previous run, skipping
+    /// peers that are banned or clash with one already registered
+    pub fn restore(&self, stored_peers: Vec<PeerInfo>, stored_bans: Vec<BannedKey>) -> usize {
+        self.bans
+            .write()
+            .extend(stored_bans.into_iter().map(|ban| (ban.public_key, ban)));
+
+        let mut restored = 0;
+        let mut peers = self.peers.write();
+        let mut pool = self.ip_pool.write();
+        for info in stored_peers {
+            if self.is_banned(&info.public_key) {
+                warn!(
+                    "Not restoring banned peer {}",
+                    events::encode_key(&info.public_key)
+                );
+                continue;
+            }
+            if !pool.reserve(info.assigned_ip) {
+                warn!(
+                    "Not restoring peer with address {} outside the pool or already in use",
+                    info.assigned_ip
+                );
+                continue;
+            }
+            if let Some(name) = &info.name {
+                if !peers.name_available(name, &info.public_key) {
+                    warn!("Not restoring duplicate peer name {}", name);
+                    pool.release(info.assigned_ip);
+                    continue;
+                }
+            }
+            peers.add(info);
+            restored += 1;
+        }
+        restored
+    }
+
+    /// The registered peers and bans in the store's format
+    pub fn export_peers(&self) -> anyhow::Result<Vec<u8>> {
+        store::encode(self.peers.read().iter(), self.bans.read().values())
+    }
+
+    /// Write the peer registry to the store, if one is configured, and
+    /// record its changes for the cluster
+    fn persist(&self) {
+        if let Some(ledger) = &self.cluster {
+            ledger.observe(self.peers.read().iter(), self.bans.read().values());
+        }
+        if let Some(store) = &self.store {
+            if let Err(e) = store.save(self.peers.read().iter(), self.bans.read().values()) {
+                error!("Failed to persist peers: {:#}", e);
+            }
+        }
+    }
+
+    /// Register a peer, or update the name and preshared key of one that is
+    /// already registered.
+    ///
+    /// New peers get the requested address if given, otherwise the next
+    /// free address in the network.
+    pub fn add_peer(
+        &self,
+        public_key: [u8; 32],
+        options: PeerOptions,
+    ) -> Result<PeerInfo, AddPeerError> {
+        let PeerOptions {
+            name,
+            address,
+            preshared_key,
+            tags,
+        } = options;
+        if self.is_banned(&public_key) {
+            return Err(AddPeerError::Banned);
+        }
+        let info = {
+            let mut peers = self.peers.write();
+
+            if let Some(existing) = peers.get_by_pubkey(&public_key).cloned() {
+                if address.is_some_and(|address| address != existing.assigned_ip) {
+                    return Err(AddPeerError::AddressMismatch);
+                }
+                let mut changed = false;
+                if let Some(name) = name {
+                    if existing.name.as_deref() != Some(name.as_str()) {
+                        peers
+                            .rename(&public_key, name)
+                            .map_err(|_| AddPeerError::NameInUse)?;
+                        changed = true;
+                    }
+                }
+                if preshared_key.is_some() && preshared_key != existing.preshared_key {
+                    peers.set_preshared_key(&public_key, preshared_key);
+                    changed = true;
+                }
+                if let Some(tags) = tags.filter(|tags| *tags != existing.tags) {
+                    peers.set_tags(&public_key, tags);
+                    changed = true;
+                }
+                let updated = peers.get_by_pubkey(&public_key).cloned().expect("peer exists");
+                drop(peers);
+                if changed {
+                    self.persist();
+                }
+                return Ok(updated);
+            }
+
+            if let Some(name) = &name {
+                if !peers.name_available(name, &public_key) {
+                    return Err(AddPeerError::NameInUse);
+                }
+            }
+
+            let mut pool = self.ip_pool.write();
+            let assigned_ip = match address {
+                Some(address) if pool.reserve(address) => address,
+                Some(_) => return Err(AddPeerError::AddressUnavailable),
+                None => pool
+                    .allocate(tags.as_deref().unwrap_or_default())
+                    .ok_or(AddPeerError::NoAddressAvailable)?,
+            };
+            drop(pool);
+            let info = PeerInfo {
+                public_key,
+                assigned_ip,
+                name,
+                tags: tags.unwrap_or_default(),
+                expires_at: None,
+                preshared_key,
+            };
+            peers.add(info.clone());
+            info
+        };
+
+        self.persist();
+        self.events.publish(Event::PeerAdded {
+            public_key: events::encode_key(&public_key),
+            assigned_ip: info.assigned_ip,
+            name: info.name.clone(),
+        });
+        Ok(info)
+    }
+
+    /// Set a registered peer's tags and expiry
+    pub fn set_peer_attributes(
+        &self,
+        public_key: &[u8; 32],
+        tags: Vec<String>,
+        expires_at: Option<SystemTime>,
+    ) -> bool {
+        if !self.peers.write().set_attributes(public_key, tags, expires_at) {
+            return false;
+        }
+        self.persist();
+        true
+    }
+
+    /// Replace a registered peer's tags
+    pub fn set_peer_tags(&self, public_key: &[u8; 32], tags: Vec<String>) -> bool {
+        if !self.peers.write().set_tags(public_key, tags) {
+            return false;
+        }
+        self.persist();
+        true
+    }
+
+    /// Tags of a registered peer; none for unknown peers
+    pub fn peer_tags(&self, public_key: &[u8; 32]) -> Vec<String> {
+        self.peers
+            .read()
+            .get_by_pubkey(public_key)
+            .map(|peer| peer.tags.clone())
+            .unwrap_or_default()
+    }
+
+    /// Set or clear when a peer expires, keeping its tags
+    pub fn set_peer_expiry(&self, public_key: &[u8; 32], expires_at: Option<SystemTime>) -> bool {
+        if !self.peers.write().set_expiry(public_key, expires_at) {
+            return false;
+        }
+        self.persist();
+        true
+    }
+
+    pub fn is_banned(&self, public_key: &[u8; 32]) -> bool {
+        self.bans.read().contains_key(public_key)
+    }
+
+    /// Ban a key, removing its peer and port forwards if it is registered
+    pub fn ban_key(
+        &self,
+        public_key: [u8; 32],
+        reason: Option<String>,
+    ) -> Option<(PeerInfo, Vec<PortForwardRule>)> {
+        self.bans.write().insert(
+            public_key,
+            BannedKey {
+                public_key,
+                reason,
+                banned_at: SystemTime::now(),
+            },
+        );
+        let removed = self.remove_peer(&public_key);
+        if removed.is_none() {
+            self.persist();
+        }
+        removed
+    }
+
+    /// Lift a ban, returning false if the key was not banned
+    pub fn unban_key(&self, public_key: &[u8; 32]) -> bool {
+        if self.bans.write().remove(public_key).is_none() {
+            return false;
+        }
+        self.persist();
+        true
+    }
+
+    /// Remove every peer whose expiry has passed
+    pub fn remove_expired(&self) -> Vec<(PeerInfo, Vec<PortForwardRule>)> {
+        let now = SystemTime::now();
+        let expired: Vec<[u8; 32]> = self
+            .peers
+            .read()
+            .iter()
+            .filter(|peer| peer.expires_at.is_some_and(|expires_at| expires_at <= now))
+            .map(|peer| peer.public_key)
+            .collect();
+        let removed: Vec<_> = expired
+            .iter()
+            .filter_map(|public_key| self.remove_peer(public_key))
+            .collect();
+        for (peer, _) in &removed {
+            self.events.publish(Event::PeerExpired {
+                public_key: events::encode_key(&peer.public_key),
+                assigned_ip: peer.assigned_ip,
+            });
+        }
+        removed
+    }
+
+    /// Make the registry exactly `desired`, all at once.
+    ///
+    /// Peers not listed are removed, new ones added and the rest updated to
+    /// the given name, address and preshared key. Peers that keep their
+    /// address without asking for one keep it; tags and expiry are kept. On
+    /// error nothing changes and the offending peer is returned.
+    pub fn replace_peers(
+        &self,
+        desired: Vec<([u8; 32], PeerOptions)>,
+    ) -> Result<ReplacePeersResult, ([u8; 32], AddPeerError)> {
+        if let Some((public_key, _)) = desired.iter().find(|(key, _)| self.is_banned(key)) {
+            return Err((*public_key, AddPeerError::Banned));
+        }
+        let mut peers = self.peers.write();
+        let mut new_pool = IpPool::new(self.config.networks.clone());
+
+        // Fixed addresses first, then current addresses, then allocation,
+        // so a peer keeping its address never collides with a fixed one
+        let mut addresses: HashMap<[u8; 32], Ipv4Addr> = HashMap::new();
+        for (public_key, options) in &desired {
+            if let Some(address) = options.address {
+                if !new_pool.reserve(address) {
+                    return Err((*public_key, AddPeerError::AddressUnavailable));
+                }
+                addresses.insert(*public_key, address);
+            }
+        }
+        for (public_key, _) in &desired {
+            if addresses.contains_key(public_key) {
+                continue;
+            }
+            if let Some(existing) = peers.get_by_pubkey(public_key) {
+                if new_pool.reserve(existing.assigned_ip) {
+                    addresses.insert(*public_key, existing.assigned_ip);
+                }
+            }
+        }
+        for (public_key, options) in &desired {
+            if !addresses.contains_key(public_key) {
+                let tags = options.tags.as_deref().or_else(|| {
+                    peers
+                        .get_by_pubkey(public_key)
+                        .map(|peer| peer.tags.as_slice())
+                });
+                let address = new_pool
+                    .allocate(tags.unwrap_or_default())
+                    .ok_or((*public_key, AddPeerError::NoAddressAvailable))?;
+                addresses.insert(*public_key, address);
+            }
+        }
+
+        let mut new_peers = PeerRegistry::new();
+        let mut result = ReplacePeersResult::default();
+        for (public_key, options) in desired {
+            if let Some(name) = &options.name {
+                if !new_peers.name_available(name, &public_key) {
+                    return Err((public_key, AddPeerError::NameInUse));
+                }
+            }
+            let existing = peers.get_by_pubkey(&public_key);
+            let info = PeerInfo {
+                public_key,
+                assigned_ip: addresses[&public_key],
+                name: options.name,
+                tags: options
+                    .tags
+                    .or_else(|| existing.map(|peer| peer.tags.clone()))
+                    .unwrap_or_default(),
+                expires_at: existing.and_then(|peer| peer.expires_at),
+                preshared_key: options.preshared_key,
+            };
+            match existing {
+                None => result.added.push(info.clone()),
+                Some(existing)
+                    if existing.assigned_ip != info.assigned_ip
+                        || existing.name != info.name
+                        || existing.tags != info.tags
+                        || existing.preshared_key != info.preshared_key =>
+                {
+                    result.updated.push(info.clone())
+                }
+                Some(_) => result.unchanged += 1,
+            }
+            new_peers.add(info);
+        }
+        result.removed = peers
+            .iter()
+            .filter(|peer| new_peers.get_by_pubkey(&peer.public_key).is_none())
+            .cloned()
+            .collect();
+
+        {
+            let mut port_forwards = self.port_forwards.write();
+            for peer in &result.removed {
+                result.removed_rules.extend(port_forwards.remove_peer(&peer.public_key));
+            }
+            for peer in &result.updated {
+                let readdressed = peers
+                    .get_by_pubkey(&peer.public_key)
+                    .is_some_and(|old| old.assigned_ip != peer.assigned_ip);
+                if readdressed {
+                    result.removed_rules.extend(port_forwards.remove_peer(&peer.public_key));
+                }
+            }
+        }
+        *peers = new_peers;
+        *self.ip_pool.write() = new_pool;
+        drop(peers);
+
+        self.persist();
+        for peer in &result.removed {
+            self.events.publish(Event::PeerRemoved {
+                public_key: events::encode_key(&peer.public_key),
+                assigned_ip: peer.assigned_ip,
+            });
+        }
+        for peer in &result.added {
+            self.events.publish(Event::PeerAdded {
+                public_key: events::encode_key(&peer.public_key),
+                assigned_ip: peer.assigned_ip,
+                name: peer.name.clone(),
+            });
+        }
+        Ok(result)
+    }
+
+    /// Remove a peer, releasing its address and port forwards
+    pub fn remove_peer(&self, public_key: &[u8; 32]) -> Option<(PeerInfo, Vec<PortForwardRule>)> {
+        let info = self.peers.write().remove(public_key)?;
+        self.ip_pool.write().release(info.assigned_ip);
+        let rules = self.port_forwards.write().remove_peer(public_key);
+        self.persist();
+        self.events.publish(Event::PeerRemoved {
+            public_key: events::encode_key(public_key),
+            assigned_ip: info.assigned_ip,
+        });
+        Some((info, rules))
+    }
+
+    /// Bring the registry and bans in step with the cluster's ledger.
+    ///
+    /// Changes made here since the ledger last looked are recorded first,
+    /// so none are lost, then peers and bans become what it holds. Where
+    /// peers clash over an address or name, the one changed first keeps it;
+    /// a peer this node registered gets another address or loses its name,
+    /// and other nodes' are left out until theirs sort it out. Returns the
+    /// port forwards dropped with removed or readdressed peers.
+    pub fn sync_cluster(&self) -> Vec<PortForwardRule> {
+        let Some(ledger) = &self.cluster else {
+            return Vec::new();
+        };
+        let mut peers = self.peers.write();
+        let mut pool = self.ip_pool.write();
+        let mut bans = self.bans.write();
+        ledger.observe(peers.iter(), bans.values());
+        let (live_peers, live_bans) = ledger.live();
+
+        let mut new_pool = IpPool::new(self.config.networks.clone());
+        let mut new_peers = PeerRegistry::new();
+        let mut displaced = Vec::new();
+        let mut excluded = Vec::new();
+        for (info, local) in live_peers {
+            let name_free = info
+                .name
+                .as_ref()
+                .is_none_or(|name| new_peers.name_available(name, &info.public_key));
+            if name_free && new_pool.reserve(info.assigned_ip) {
+                new_peers.add(info);
+            } else if local {
+                displaced.push(info);
+            } else {
+                excluded.push(info.public_key);
+            }
+        }
+        for mut info in displaced {
+            let key = events::encode_key(&info.public_key);
+            if let Some(name) = &info.name {
+                if !new_peers.name_available(name, &info.public_key) {
+                    warn!(
+                        "Peer {} lost its name {} to a peer on another node",
+                        key, name
+                    );
+                    info.name = None;
+                }
+            }
+            if !new_pool.reserve(info.assigned_ip) {
+                let Some(address) = new_pool.allocate(&info.tags) else {
+                    warn!(
+                        "No address left for peer {}, which clashed with another",
+                        key
+                    );
+                    excluded.push(info.public_key);
+                    continue;
+                };
+                warn!(
+                    "Peer {} moved from {} to {}, which a peer on another node took",
+                    key, info.assigned_ip, address
+                );
+                info.assigned_ip = address;
+            }
+            new_peers.add(info);
+        }
+        ledger.set_excluded(excluded.into_iter());
+
+        let removed: Vec<PeerInfo> = peers
+            .iter()
+            .filter(|peer| new_peers.get_by_pubkey(&peer.public_key).is_none())
+            .cloned()
+            .collect();
+        let added: Vec<PeerInfo> = new_peers
+            .iter()
+            .filter(|peer| peers.get_by_pubkey(&peer.public_key).is_none())
+            .cloned()
+            .collect();
+        let mut removed_rules = Vec::new();
+        {
+            let mut port_forwards = self.port_forwards.write();
+            for peer in peers.iter() {
+                let kept = new_peers
+                    .get_by_pubkey(&peer.public_key)
+                    .is_some_and(|new| new.assigned_ip == peer.assigned_ip);
+                if !kept {
+                    removed_rules.extend(port_forwards.remove_peer(&peer.public_key));
+                }
+            }
+        }
+        *peers = new_peers;
+        *pool = new_pool;
+        *bans = live_bans
+            .into_iter()
+            .map(|ban| (ban.public_key, ban))
+            .collect();
+        drop(bans);
+        drop(pool);
+        drop(peers);
+
+        // Records readdressed peers as changed here
+        self.persist();
+        for peer in &removed {
+            self.events.publish(Event::PeerRemoved {
+                public_key: events::encode_key(&peer.public_key),
+                assigned_ip: peer.assigned_ip,
+            });
+        }
+        for peer in &added {
+            self.events.publish(Event::PeerAdded {
+                public_key: events::encode_key(&peer.public_key),
+                assigned_ip: peer.assigned_ip,
+                name: peer.name.clone(),
+            });
+        }
+        removed_rules
+    }
 }
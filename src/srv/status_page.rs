@@ -0,0 +1,497 @@
+//! Status page for peers
+//!
+//! With `--status-page` the server answers plain HTTP on port 80 of its VPN
+//! addresses, so `http://10.0.0.1` describes the peer asking: its addresses
+//! and tunnel, the policy it is under, how its DNS queries are answered,
+//! and its traffic beside its limits. Users inside a cage can see why
+//! something doesn't work without asking an admin. Browsers get HTML and
+//! other clients, like `curl`, plain text.
+//!
+//! Like the server's other services it is exempt from firewall rules and
+//! egress ACLs, so it stays reachable when those are what gets in the way.
+//! It shows a peer only its own details, and the names of the policies
+//! applied to it.
+
+use std::fmt::Write as _;
+use std::net::IpAddr;
+use std::sync::Arc;
+use std::time::{Duration, UNIX_EPOCH};
+
+use anyhow::{Context, Result};
+use tokio::io::{AsyncRead, AsyncWrite, AsyncWriteExt};
+use tracing::debug;
+
+use super::ctl::{format_ago, format_bytes, format_in};
+use super::dataplane::FlowPolicy;
+use super::dns::{DnsService, DNS_PORT};
+use super::events::encode_key;
+use super::flow::Protocol;
+use super::http_proxy::{self, Head};
+use super::ntp::NTP_PORT;
+use super::port_mapping::NAT_PMP_PORT;
+use super::state::SharedState;
+use super::usage::{unix_now, Counters, UsageTracker, HOUR_SECS};
+use super::wg::WgIo;
+
+/// Port the status page is served on inside the VPN
+pub const STATUS_PORT: u16 = 80;
+
+/// How long a client has to send its request head
+const HEAD_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// A titled list of facts about the peer
+struct Section {
+    title: &'static str,
+    rows: Vec<(&'static str, String)>,
+}
+
+pub struct StatusPage {
+    shared: Arc<SharedState>,
+    wg_io: Arc<WgIo>,
+    dns: Arc<DnsService>,
+    usage: Arc<UsageTracker>,
+}
+
+impl StatusPage {
+    pub fn new(
+        shared: Arc<SharedState>,
+        wg_io: Arc<WgIo>,
+        dns: Arc<DnsService>,
+        usage: Arc<UsageTracker>,
+    ) -> Self {
+        Self {
+            shared,
+            wg_io,
+            dns,
+            usage,
+        }
+    }
+
+    /// Serve one connection from a peer
+    pub async fn serve<S: AsyncRead + AsyncWrite + Unpin>(
+        &self,
+        mut client: S,
+        peer: [u8; 32],
+        policy: &FlowPolicy,
+    ) {
+        if let Err(e) = self.serve_request(&mut client, &peer, policy).await {
+            debug!("Status page connection failed: {:#}", e);
+        }
+    }
+
+    async fn serve_request<S: AsyncRead + AsyncWrite + Unpin>(
+        &self,
+        client: &mut S,
+        peer: &[u8; 32],
+        policy: &FlowPolicy,
+    ) -> Result<()> {
+        let mut buf = Vec::new();
+        let head = tokio::time::timeout(HEAD_TIMEOUT, http_proxy::read_head(client, &mut buf))
+            .await
+            .context("timed out waiting for the request")??;
+        let Some(head) = head else {
+            return Ok(());
+        };
+        let path = head
+            .target
+            .split_once('?')
+            .map_or(head.target.as_str(), |(path, _)| path);
+        let (status, content_type, body) = match (head.method.as_str(), path) {
+            ("GET" | "HEAD", "/") => {
+                let sections = self.report(peer, policy);
+                if wants_html(&head) {
+                    ("200 OK", "text/html; charset=utf-8", render_html(&sections))
+                } else {
+                    (
+                        "200 OK",
+                        "text/plain; charset=utf-8",
+                        render_text(&sections),
+                    )
+                }
+            }
+            ("GET" | "HEAD", _) => (
+                "404 Not Found",
+                "text/plain; charset=utf-8",
+                "not found\n".to_string(),
+            ),
+            _ => (
+                "405 Method Not Allowed",
+                "text/plain; charset=utf-8",
+                "method not allowed\n".to_string(),
+            ),
+        };
+        let mut response = format!(
+            "HTTP/1.1 {}\r\nContent-Type: {}\r\nContent-Length: {}\r\n\
+             Cache-Control: no-store\r\nConnection: close\r\n\r\n",
+            status,
+            content_type,
+            body.len()
+        );
+        if head.method != "HEAD" {
+            response.push_str(&body);
+        }
+        client.write_all(response.as_bytes()).await?;
+        client.shutdown().await?;
+        Ok(())
+    }
+
+    /// Everything the page says about `peer`
+    fn report(&self, peer: &[u8; 32], policy: &FlowPolicy) -> Vec<Section> {
+        let config = &self.shared.config;
+        let Some(info) = self.shared.peers.read().get_by_pubkey(peer).cloned() else {
+            return vec![Section {
+                title: "Peer",
+                rows: vec![
+                    ("Public key", encode_key(peer)),
+                    ("Status", "no longer registered".to_string()),
+                ],
+            }];
+        };
+        let network = config.networks.containing(info.assigned_ip);
+        let gateway = config.networks.gateway_for(info.assigned_ip);
+        let none = || "none".to_string();
+
+        let mut rows = vec![
+            ("Name", info.name.clone().unwrap_or_else(none)),
+            ("Public key", encode_key(peer)),
+            (
+                "Address",
+                format!(
+                    "{}/{}",
+                    info.assigned_ip,
+                    network.map_or(config.subnet_mask, |network| network.prefix_len)
+                ),
+            ),
+        ];
+        if let Some(prefix) = config.ipv6_prefix {
+            rows.push((
+                "IPv6 address",
+                format!(
+                    "{}/{}",
+                    prefix.address_for(info.assigned_ip),
+                    prefix.prefix_len()
+                ),
+            ));
+        }
+        if let Some(tag) = network.and_then(|network| network.tag.clone()) {
+            rows.push(("Network", tag));
+        }
+        rows.push((
+            "Tags",
+            if info.tags.is_empty() {
+                none()
+            } else {
+                info.tags.join(", ")
+            },
+        ));
+        let expires = info
+            .expires_at
+            .and_then(|at| at.duration_since(UNIX_EPOCH).ok())
+            .map(|at| format_in(at.as_secs()));
+        rows.push(("Expires", expires.unwrap_or_else(|| "never".to_string())));
+        let peer_section = Section {
+            title: "Peer",
+            rows,
+        };
+
+        let stats = self.wg_io.peer_stats(peer);
+        let stats = stats.as_ref();
+        let handshake = stats
+            .and_then(|stats| stats.last_handshake)
+            .and_then(|at| at.duration_since(UNIX_EPOCH).ok())
+            .map(|at| format_ago(at.as_secs()));
+        let tunnel = Section {
+            title: "Tunnel",
+            rows: vec![
+                (
+                    "Server public key",
+                    encode_key(&self.shared.server_public_key()),
+                ),
+                (
+                    "Your endpoint",
+                    stats
+                        .and_then(|stats| stats.endpoint)
+                        .map_or_else(none, |endpoint| endpoint.to_string()),
+                ),
+                ("Latest handshake", handshake.unwrap_or_else(none)),
+                (
+                    "Preshared key",
+                    yes_no(info.preshared_key.is_some()).to_string(),
+                ),
+                (
+                    "Received from you",
+                    format_bytes(stats.map_or(0, |stats| stats.rx_bytes)),
+                ),
+                (
+                    "Sent to you",
+                    format_bytes(stats.map_or(0, |stats| stats.tx_bytes)),
+                ),
+            ],
+        };
+
+        let mut services = vec![format!("DNS on {}", DNS_PORT)];
+        if policy.ntp {
+            services.push(format!("NTP on {}", NTP_PORT));
+        }
+        if let Some(port) = policy.speedtest_port {
+            services.push(format!("speed tests on {}", port));
+        }
+        if let Some(proxy) = &policy.http_proxy {
+            services.push(format!("HTTP proxy on {}", proxy.port()));
+        }
+        if let Some(socks) = &policy.socks {
+            services.push(format!("SOCKS5 on {}", socks.port()));
+        }
+        if policy.port_mapping.is_some() {
+            services.push(format!("NAT-PMP on {}", NAT_PMP_PORT));
+        }
+        let forwards: Vec<_> = self
+            .shared
+            .port_forwards
+            .read()
+            .rules_for_peer(peer)
+            .iter()
+            .map(|rule| {
+                let protocol = match rule.protocol {
+                    Protocol::Tcp => "tcp",
+                    Protocol::Udp => "udp",
+                };
+                format!("{} {} to {}", protocol, rule.public_port, rule.target_port)
+            })
+            .collect();
+        let mut rows = vec![
+            ("Server address", gateway.to_string()),
+            ("Services", services.join(", ")),
+            (
+                "Other peers reachable",
+                yes_no(!policy.client_isolation).to_string(),
+            ),
+        ];
+        if policy.ipv6_only {
+            rows.push(("IPv4", "through NAT64 only, at 64:ff9b::/96".to_string()));
+        }
+        rows.push((
+            "Port forwards",
+            if forwards.is_empty() {
+                none()
+            } else {
+                forwards.join(", ")
+            },
+        ));
+        let network_section = Section {
+            title: "Network",
+            rows,
+        };
+
+        let schedule = policy.schedules.name_for(peer).map(|name| {
+            let now = if policy.schedules.allows(peer) {
+                "open now"
+            } else {
+                "closed now"
+            };
+            format!("{} ({})", name, now)
+        });
+        let domains = policy.domains.as_ref().map(|domains| {
+            let ports: Vec<_> = domains.ports().iter().map(u16::to_string).collect();
+            let kind = if domains.is_allowlist() {
+                "allowlist"
+            } else {
+                "blocklist"
+            };
+            format!("{} on TCP ports {}", kind, ports.join(", "))
+        });
+        let firewall = policy
+            .firewall
+            .is_configured()
+            .then(|| format!("on, unmatched flows {}", policy.firewall.policy()));
+        let policy_section = Section {
+            title: "Policy",
+            rows: vec![
+                ("Firewall", firewall.unwrap_or_else(none)),
+                (
+                    "Egress ACL",
+                    policy.acls.name_for(peer).unwrap_or_else(none),
+                ),
+                ("Access schedule", schedule.unwrap_or_else(none)),
+                ("Egress domains", domains.unwrap_or_else(none)),
+            ],
+        };
+
+        let dns = self.dns.describe(peer);
+        let upstreams = dns.upstreams.map(|upstreams| {
+            upstreams
+                .iter()
+                .map(|(upstream, up)| format!("{} ({})", upstream, if *up { "up" } else { "down" }))
+                .collect::<Vec<_>>()
+                .join(", ")
+        });
+        let dns_server = match config.ipv6_prefix {
+            Some(prefix) if config.ipv6_only => IpAddr::V6(prefix.address_for(config.subnet)),
+            _ => IpAddr::V4(gateway),
+        };
+        let dns_section = Section {
+            title: "DNS",
+            rows: vec![
+                ("Server", dns_server.to_string()),
+                (
+                    "Policy",
+                    dns.policy.unwrap_or_else(|| "server-wide".to_string()),
+                ),
+                (
+                    "Upstreams",
+                    upstreams.unwrap_or_else(|| "DNS is disabled for you".to_string()),
+                ),
+                ("Blocklist", yes_no(dns.blocklist).to_string()),
+                (
+                    "Query limit",
+                    dns.rate_limit.map_or_else(none, |limit| {
+                        format!("{} a second, bursts of {}", limit.rate, limit.burst)
+                    }),
+                ),
+                ("Peer names", format!("NAME.{}", dns.domain)),
+            ],
+        };
+
+        let now = unix_now();
+        let usage = |secs: u64| {
+            let (total, _) = self
+                .usage
+                .peer_usage(peer, now.saturating_sub(secs), now, HOUR_SECS);
+            format_usage(&total)
+        };
+        let rates = policy.bandwidth.resolve(peer);
+        let limits = policy.flow_limits;
+        let usage_section = Section {
+            title: "Usage",
+            rows: vec![
+                ("Last day", usage(24 * HOUR_SECS)),
+                ("Last 30 days", usage(30 * 24 * HOUR_SECS)),
+                ("Upload limit", rates.up.map_or_else(none, format_rate)),
+                ("Download limit", rates.down.map_or_else(none, format_rate)),
+                (
+                    "Open flow limit",
+                    if limits.max_open == 0 {
+                        none()
+                    } else {
+                        limits.max_open.to_string()
+                    },
+                ),
+                (
+                    "New flow limit",
+                    if limits.rate <= 0.0 {
+                        none()
+                    } else {
+                        format!("{} a second, bursts of {}", limits.rate, limits.burst)
+                    },
+                ),
+            ],
+        };
+
+        vec![
+            peer_section,
+            tunnel,
+            network_section,
+            policy_section,
+            dns_section,
+            usage_section,
+        ]
+    }
+}
+
+/// Whether the client is a browser
+fn wants_html(head: &Head) -> bool {
+    head.header("accept")
+        .is_some_and(|accept| accept.contains("text/html"))
+}
+
+fn yes_no(value: bool) -> &'static str {
+    if value {
+        "yes"
+    } else {
+        "no"
+    }
+}
+
+fn format_usage(counters: &Counters) -> String {
+    format!(
+        "{} down, {} up, {} flows",
+        format_bytes(counters.down_bytes),
+        format_bytes(counters.up_bytes),
+        counters.flows
+    )
+}
+
+/// Format bytes a second as bits a second
+fn format_rate(bytes_per_second: f64) -> String {
+    let bits = bytes_per_second * 8.0;
+    if bits >= 1e9 {
+        format!("{:.1} Gbit/s", bits / 1e9)
+    } else if bits >= 1e6 {
+        format!("{:.1} Mbit/s", bits / 1e6)
+    } else {
+        format!("{:.0} kbit/s", bits / 1e3)
+    }
+}
+
+fn render_text(sections: &[Section]) -> String {
+    let width = sections
+        .iter()
+        .flat_map(|section| section.rows.iter())
+        .map(|(label, _)| label.len())
+        .max()
+        .unwrap_or(0);
+    let mut text = String::new();
+    for section in sections {
+        let _ = writeln!(text, "{}", section.title);
+        for (label, value) in &section.rows {
+            let _ = writeln!(text, "  {:width$}  {}", label, value, width = width);
+        }
+        text.push('\n');
+    }
+    text
+}
+
+fn render_html(sections: &[Section]) -> String {
+    let mut html = String::from(
+        "<!doctype html>\n<html lang=\"en\">\n<head>\n<meta charset=\"utf-8\">\n\
+         <meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">\n\
+         <title>wirecage status</title>\n<style>\n\
+         body { margin: 1rem auto; max-width: 48rem; padding: 0 1rem; \
+         font: 15px/1.4 system-ui, sans-serif; color: #1d232a; }\n\
+         h2 { margin: 1.5rem 0 0.5rem; font-size: 1.05rem; }\n\
+         table { width: 100%; border-collapse: collapse; }\n\
+         th, td { padding: 0.3rem 0.5rem; border-bottom: 1px solid #dde2e7; \
+         text-align: left; vertical-align: top; }\n\
+         th { width: 12rem; font-weight: 500; color: #6b7580; }\n\
+         td { word-break: break-all; }\n\
+         </style>\n</head>\n<body>\n<h1>wirecage status</h1>\n",
+    );
+    for section in sections {
+        let _ = writeln!(html, "<h2>{}</h2>\n<table>", escape(section.title));
+        for (label, value) in &section.rows {
+            let _ = writeln!(
+                html,
+                "<tr><th>{}</th><td>{}</td></tr>",
+                escape(label),
+                escape(value)
+            );
+        }
+        html.push_str("</table>\n");
+    }
+    html.push_str("</body>\n</html>\n");
+    html
+}
+
+fn escape(text: &str) -> String {
+    let mut escaped = String::with_capacity(text.len());
+    for c in text.chars() {
+        match c {
+            '&' => escaped.push_str("&amp;"),
+            '<' => escaped.push_str("&lt;"),
+            '>' => escaped.push_str("&gt;"),
+            '"' => escaped.push_str("&quot;"),
+            _ => escaped.push(c),
+        }
+    }
+    escaped
+}
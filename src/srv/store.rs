@@ -0,0 +1,209 @@
+//! On-disk peer store for wirecagesrv
+//!
+//! Registered peers are written to a JSON file whenever they change and
+//! replayed into the registry on startup, so restarts keep peer addresses
+//! and names stable. Banned public keys are kept alongside them.
+
+use std::io::Write;
+use std::net::Ipv4Addr;
+use std::os::unix::fs::OpenOptionsExt;
+use std::path::PathBuf;
+use std::time::{Duration, UNIX_EPOCH};
+
+use anyhow::{Context, Result};
+use base64::Engine;
+use serde::{Deserialize, Serialize};
+
+use super::state::{BannedKey, PeerInfo};
+
+const STORE_VERSION: u32 = 1;
+
+/// A peer as stored, and as nodes of a cluster exchange it
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct StoredPeer {
+    public_key: String,
+    assigned_ip: Ipv4Addr,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    name: Option<String>,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    tags: Vec<String>,
+    /// Unix timestamp at which the peer expires
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    expires_at: Option<u64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    preshared_key: Option<String>,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct StoredBan {
+    public_key: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    reason: Option<String>,
+    /// Unix timestamp at which the key was banned
+    banned_at: u64,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+struct StoreFile {
+    version: u32,
+    #[serde(default)]
+    peers: Vec<StoredPeer>,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    banned: Vec<StoredBan>,
+}
+
+fn decode_key(key: &str) -> Option<[u8; 32]> {
+    base64::engine::general_purpose::STANDARD
+        .decode(key)
+        .ok()
+        .and_then(|bytes| <[u8; 32]>::try_from(bytes).ok())
+}
+
+pub struct PeerStore {
+    path: PathBuf,
+}
+
+impl PeerStore {
+    pub fn new(path: impl Into<PathBuf>) -> Self {
+        Self { path: path.into() }
+    }
+
+    /// Read stored peers and bans; a missing file means neither yet
+    pub fn load(&self) -> Result<(Vec<PeerInfo>, Vec<BannedKey>)> {
+        let contents = match std::fs::read_to_string(&self.path) {
+            Ok(contents) => contents,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => {
+                return Ok((Vec::new(), Vec::new()))
+            }
+            Err(e) => {
+                return Err(e).with_context(|| format!("failed to read {}", self.path.display()))
+            }
+        };
+        decode(&contents, &self.path.display().to_string())
+    }
+
+    /// Atomically replace the store with the given peers and bans
+    pub fn save<'a>(
+        &self,
+        peers: impl Iterator<Item = &'a PeerInfo>,
+        bans: impl Iterator<Item = &'a BannedKey>,
+    ) -> Result<()> {
+        let contents = encode(peers, bans)?;
+
+        if let Some(parent) = self.path.parent() {
+            std::fs::create_dir_all(parent)
+                .with_context(|| format!("failed to create {}", parent.display()))?;
+        }
+        let tmp_path = self.path.with_extension("tmp");
+        let mut tmp = std::fs::OpenOptions::new()
+            .write(true)
+            .create(true)
+            .truncate(true)
+            .mode(0o600)
+            .open(&tmp_path)
+            .with_context(|| format!("failed to create {}", tmp_path.display()))?;
+        tmp.write_all(&contents)?;
+        tmp.sync_all()?;
+        std::fs::rename(&tmp_path, &self.path)
+            .with_context(|| format!("failed to replace {}", self.path.display()))?;
+        Ok(())
+    }
+}
+
+/// Parse peers and bans in the store's format; `origin` names where they
+/// came from in errors
+pub fn decode(contents: &str, origin: &str) -> Result<(Vec<PeerInfo>, Vec<BannedKey>)> {
+    let file: StoreFile =
+        serde_json::from_str(contents).with_context(|| format!("failed to parse {}", origin))?;
+    if file.version != STORE_VERSION {
+        anyhow::bail!("{} has unsupported version {}", origin, file.version);
+    }
+
+    let peers = file
+        .peers
+        .into_iter()
+        .map(peer_info)
+        .collect::<Result<Vec<_>>>()?;
+    let bans = file
+        .banned
+        .into_iter()
+        .map(banned_key)
+        .collect::<Result<Vec<_>>>()?;
+    Ok((peers, bans))
+}
+
+/// Serialize peers and bans in the store's format
+pub fn encode<'a>(
+    peers: impl Iterator<Item = &'a PeerInfo>,
+    bans: impl Iterator<Item = &'a BannedKey>,
+) -> Result<Vec<u8>> {
+    let mut peers: Vec<StoredPeer> = peers.map(stored_peer).collect();
+    peers.sort_by_key(|peer| peer.assigned_ip);
+    let mut banned: Vec<StoredBan> = bans.map(stored_ban).collect();
+    banned.sort_by_key(|ban| ban.banned_at);
+    let file = StoreFile {
+        version: STORE_VERSION,
+        peers,
+        banned,
+    };
+    Ok(serde_json::to_vec_pretty(&file)?)
+}
+
+pub fn stored_peer(peer: &PeerInfo) -> StoredPeer {
+    StoredPeer {
+        public_key: base64::engine::general_purpose::STANDARD.encode(peer.public_key),
+        assigned_ip: peer.assigned_ip,
+        name: peer.name.clone(),
+        tags: peer.tags.clone(),
+        expires_at: peer
+            .expires_at
+            .and_then(|t| t.duration_since(UNIX_EPOCH).ok())
+            .map(|d| d.as_secs()),
+        preshared_key: peer
+            .preshared_key
+            .map(|key| base64::engine::general_purpose::STANDARD.encode(key)),
+    }
+}
+
+pub fn peer_info(peer: StoredPeer) -> Result<PeerInfo> {
+    let public_key = decode_key(&peer.public_key)
+        .with_context(|| format!("invalid stored public key {}", peer.public_key))?;
+    let preshared_key = match &peer.preshared_key {
+        Some(key) => Some(
+            decode_key(key)
+                .with_context(|| format!("invalid stored preshared key for {}", peer.public_key))?,
+        ),
+        None => None,
+    };
+    Ok(PeerInfo {
+        public_key,
+        assigned_ip: peer.assigned_ip,
+        name: peer.name,
+        tags: peer.tags,
+        expires_at: peer
+            .expires_at
+            .map(|secs| UNIX_EPOCH + Duration::from_secs(secs)),
+        preshared_key,
+    })
+}
+
+pub fn stored_ban(ban: &BannedKey) -> StoredBan {
+    StoredBan {
+        public_key: base64::engine::general_purpose::STANDARD.encode(ban.public_key),
+        reason: ban.reason.clone(),
+        banned_at: ban
+            .banned_at
+            .duration_since(UNIX_EPOCH)
+            .map_or(0, |d| d.as_secs()),
+    }
+}
+
+pub fn banned_key(ban: StoredBan) -> Result<BannedKey> {
+    let public_key = decode_key(&ban.public_key)
+        .with_context(|| format!("invalid stored banned key {}", ban.public_key))?;
+    Ok(BannedKey {
+        public_key,
+        reason: ban.reason,
+        banned_at: UNIX_EPOCH + Duration::from_secs(ban.banned_at),
+    })
+}
@@ -0,0 +1,98 @@
+//! STUN binding service
+//!
+//! With `--stun-listen`, the server answers STUN binding requests (RFC
+//! 8489) on a UDP port of its own with the address and port each request
+//! came from. From behind a NAT, a client such as `stunclient` or
+//! `stun-client` learns its public, server-reflexive address, and comparing
+//! the mappings it gets from several local ports, or against the endpoint
+//! the server sees for the peer's tunnel, shows how the NAT treats it: the
+//! usual first step when a peer behind carrier-grade NAT can't keep its
+//! tunnel up. Clients predating RFC 5389 get the classic MAPPED-ADDRESS.
+//! The service keeps no state and answers nothing but binding requests.
+
+use std::net::{IpAddr, SocketAddr};
+
+use anyhow::{Context, Result};
+use tokio::net::UdpSocket;
+use tracing::{debug, info};
+
+const BINDING_REQUEST: u16 = 0x0001;
+const BINDING_RESPONSE: u16 = 0x0101;
+const MAGIC_COOKIE: u32 = 0x2112_a442;
+const HEADER_LEN: usize = 20;
+
+const ATTR_MAPPED_ADDRESS: u16 = 0x0001;
+const ATTR_XOR_MAPPED_ADDRESS: u16 = 0x0020;
+
+const FAMILY_IPV4: u8 = 0x01;
+const FAMILY_IPV6: u8 = 0x02;
+
+/// Answer binding requests on `socket` until it fails
+pub async fn serve(socket: UdpSocket) -> Result<()> {
+    info!(
+        "Answering STUN binding requests on {}",
+        socket.local_addr().context("STUN socket has no address")?
+    );
+    let mut buf = [0u8; 1500];
+    loop {
+        let (n, from) = socket
+            .recv_from(&mut buf)
+            .await
+            .context("failed to receive STUN request")?;
+        let Some(response) = respond(&buf[..n], from) else {
+            continue;
+        };
+        if let Err(e) = socket.send_to(&response, from).await {
+            debug!("Failed to answer STUN request from {}: {}", from, e);
+        }
+    }
+}
+
+/// The response to a binding request from `from`, or `None` for anything
+/// else
+fn respond(request: &[u8], from: SocketAddr) -> Option<Vec<u8>> {
+    let header: &[u8; HEADER_LEN] = request.get(..HEADER_LEN)?.try_into().ok()?;
+    let kind = u16::from_be_bytes([header[0], header[1]]);
+    let length = usize::from(u16::from_be_bytes([header[2], header[3]]));
+    if kind != BINDING_REQUEST || length % 4 != 0 || HEADER_LEN + length != request.len() {
+        return None;
+    }
+    let classic = u32::from_be_bytes([header[4], header[5], header[6], header[7]]) != MAGIC_COOKIE;
+    // The cookie and transaction ID, or the whole 16-byte classic
+    // transaction ID, are echoed back
+    let transaction = &header[4..];
+
+    // Report IPv4 clients of a dual-stack socket as such
+    let ip = match from.ip() {
+        IpAddr::V6(ip) => ip.to_ipv4_mapped().map_or(IpAddr::V6(ip), IpAddr::V4),
+        ip => ip,
+    };
+    let (family, mut address) = match ip {
+        IpAddr::V4(ip) => (FAMILY_IPV4, ip.octets().to_vec()),
+        IpAddr::V6(ip) => (FAMILY_IPV6, ip.octets().to_vec()),
+    };
+    let mut port = from.port();
+    let attribute = if classic {
+        ATTR_MAPPED_ADDRESS
+    } else {
+        // XOR-MAPPED-ADDRESS hides the address from middleboxes that
+        // rewrite anything that looks like one
+        port ^= (MAGIC_COOKIE >> 16) as u16;
+        for (byte, mask) in address.iter_mut().zip(transaction) {
+            *byte ^= mask;
+        }
+        ATTR_XOR_MAPPED_ADDRESS
+    };
+
+    let value_len = 4 + address.len();
+    let mut response = Vec::with_capacity(HEADER_LEN + 4 + value_len);
+    response.extend_from_slice(&BINDING_RESPONSE.to_be_bytes());
+    response.extend_from_slice(&((4 + value_len) as u16).to_be_bytes());
+    response.extend_from_slice(transaction);
+    response.extend_from_slice(&attribute.to_be_bytes());
+    response.extend_from_slice(&(value_len as u16).to_be_bytes());
+    response.extend_from_slice(&[0, family]);
+    response.extend_from_slice(&port.to_be_bytes());
+    response.extend_from_slice(&address);
+    Some(response)
+}
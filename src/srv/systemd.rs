@@ -0,0 +1,230 @@
+//! systemd socket activation and readiness notification
+//!
+//! When started by a `.socket` unit, systemd passes already-bound sockets
+//! from fd 3 on and says how many in `LISTEN_FDS`. The WireGuard UDP socket,
+//! the API listener and the admin listener are taken from there instead of
+//! being bound, by the `FileDescriptorName=` of their socket unit
+//! (`wireguard`, `api` or `admin`) or, for unnamed sockets, in that order by
+//! type, followed by the metrics listener (`metrics`), the STUN socket
+//! (`stun`), the relay listener (`relay`) and the WireGuard TCP listener
+//! (`wireguard-tcp`). Anything not passed in is bound from the command line
+//! as usual. Sockets handed over by a previous server during an upgrade are
+//! picked up the same way.
+//!
+//! Under `Type=notify`, `READY=1` is sent once every listener is up and
+//! `STOPPING=1` on shutdown. With `WatchdogSec=`, `WATCHDOG=1` is sent at
+//! half the interval for as long as the liveness checks pass, so systemd
+//! restarts a server whose dataplane has stopped.
+
+use std::net::{TcpListener, UdpSocket};
+use std::os::fd::{FromRawFd, IntoRawFd, OwnedFd, RawFd};
+use std::os::linux::net::SocketAddrExt;
+use std::os::unix::net::{SocketAddr, UnixDatagram};
+use std::sync::Arc;
+use std::time::Duration;
+
+use anyhow::{Context, Result};
+use tracing::{debug, info, warn};
+
+use super::health::HealthChecks;
+
+/// First fd systemd passes sockets on
+const LISTEN_FDS_START: RawFd = 3;
+
+/// Sockets passed in by systemd or a previous server that have not been
+/// claimed yet
+#[derive(Default)]
+pub struct ActivatedSockets {
+    sockets: Vec<(Option<String>, RawFd)>,
+}
+
+impl ActivatedSockets {
+    /// Pick up the sockets passed to this process, if any, and clear the
+    /// environment so they are not handed on to children
+    pub fn from_env() -> Self {
+        let pid = std::env::var("LISTEN_PID").ok();
+        let count = std::env::var("LISTEN_FDS").ok();
+        let names = std::env::var("LISTEN_FDNAMES").ok();
+        std::env::remove_var("LISTEN_PID");
+        std::env::remove_var("LISTEN_FDS");
+        std::env::remove_var("LISTEN_FDNAMES");
+
+        if pid.and_then(|pid| pid.parse::<u32>().ok()) != Some(std::process::id()) {
+            return Self::default();
+        }
+        let Some(count) = count.and_then(|count| count.parse::<RawFd>().ok()) else {
+            return Self::default();
+        };
+        let names: Vec<&str> = names
+            .as_deref()
+            .map_or(Vec::new(), |names| names.split(':').collect());
+        let sockets = (0..count)
+            .map(|n| {
+                let fd = LISTEN_FDS_START + n;
+                // Keep the sockets from leaking into anything we spawn
+                unsafe { libc::fcntl(fd, libc::F_SETFD, libc::FD_CLOEXEC) };
+                // systemd names sockets without a FileDescriptorName= after
+                // their unit, which is no use for matching
+                let name = names
+                    .get(n as usize)
+                    .filter(|name| !name.is_empty() && !name.ends_with(".socket"))
+                    .map(|name| name.to_string());
+                (name, fd)
+            })
+            .collect::<Vec<_>>();
+        if !sockets.is_empty() {
+            info!("Received {} socket(s) from systemd", sockets.len());
+        }
+        Self { sockets }
+    }
+
+    /// Add sockets handed over by a previous server
+    pub fn extend(&mut self, sockets: impl IntoIterator<Item = (String, OwnedFd)>) {
+        self.sockets.extend(
+            sockets
+                .into_iter()
+                .map(|(name, fd)| (Some(name), fd.into_raw_fd())),
+        );
+    }
+
+    /// Take the UDP socket named `name`, or else the first unnamed one
+    pub fn take_udp(&mut self, name: &str) -> Result<Option<UdpSocket>> {
+        let Some(fd) = self.take(name, libc::SOCK_DGRAM) else {
+            return Ok(None);
+        };
+        let socket = unsafe { UdpSocket::from_raw_fd(fd) };
+        socket
+            .set_nonblocking(true)
+            .context("failed to set activated socket non-blocking")?;
+        Ok(Some(socket))
+    }
+
+    /// Take the TCP listener named `name`, or else the first unnamed one
+    pub fn take_tcp(&mut self, name: &str) -> Result<Option<TcpListener>> {
+        let Some(fd) = self.take(name, libc::SOCK_STREAM) else {
+            return Ok(None);
+        };
+        let listener = unsafe { TcpListener::from_raw_fd(fd) };
+        listener
+            .set_nonblocking(true)
+            .context("failed to set activated socket non-blocking")?;
+        Ok(Some(listener))
+    }
+
+    /// Take the TCP listener named `name`, or else bind a new one to `addr`
+    pub fn tcp_listener(&mut self, name: &str, addr: &str) -> Result<TcpListener> {
+        if let Some(listener) = self.take_tcp(name)? {
+            return Ok(listener);
+        }
+        let listener =
+            TcpListener::bind(addr).with_context(|| format!("failed to bind {}", addr))?;
+        listener
+            .set_nonblocking(true)
+            .context("failed to set listener non-blocking")?;
+        Ok(listener)
+    }
+
+    /// Take the UDP socket named `name`, or else bind a new one to `addr`
+    pub fn udp_socket(&mut self, name: &str, addr: &str) -> Result<UdpSocket> {
+        if let Some(socket) = self.take_udp(name)? {
+            return Ok(socket);
+        }
+        let socket = UdpSocket::bind(addr).with_context(|| format!("failed to bind {}", addr))?;
+        socket
+            .set_nonblocking(true)
+            .context("failed to set socket non-blocking")?;
+        Ok(socket)
+    }
+
+    /// Warn about sockets passed in that nothing used
+    pub fn warn_unused(&self) {
+        for (name, fd) in &self.sockets {
+            warn!(
+                "Ignoring passed-in socket {} on fd {}",
+                name.as_deref().unwrap_or("(unnamed)"),
+                fd
+            );
+        }
+    }
+
+    fn take(&mut self, name: &str, kind: libc::c_int) -> Option<RawFd> {
+        let index = self
+            .sockets
+            .iter()
+            .position(|(n, _)| n.as_deref() == Some(name))
+            .or_else(|| {
+                self.sockets
+                    .iter()
+                    .position(|(n, fd)| n.is_none() && socket_type(*fd) == Some(kind))
+            })?;
+        let (_, fd) = self.sockets.remove(index);
+        debug!("Using passed-in socket on fd {} for {}", fd, name);
+        Some(fd)
+    }
+}
+
+fn socket_type(fd: RawFd) -> Option<libc::c_int> {
+    let mut kind: libc::c_int = 0;
+    let mut len = std::mem::size_of::<libc::c_int>() as libc::socklen_t;
+    let ret = unsafe {
+        libc::getsockopt(
+            fd,
+            libc::SOL_SOCKET,
+            libc::SO_TYPE,
+            &mut kind as *mut libc::c_int as *mut libc::c_void,
+            &mut len,
+        )
+    };
+    (ret == 0).then_some(kind)
+}
+
+/// Send a state change like `READY=1` to systemd; does nothing when not
+/// run under a notify service
+pub fn notify(state: &str) {
+    let Ok(path) = std::env::var("NOTIFY_SOCKET") else {
+        return;
+    };
+    if let Err(e) = send_notify(&path, state) {
+        warn!("Failed to notify systemd of {}: {:#}", state, e);
+    }
+}
+
+fn send_notify(path: &str, state: &str) -> Result<()> {
+    let socket = UnixDatagram::unbound().context("failed to create notify socket")?;
+    let addr = match path.strip_prefix('@') {
+        Some(name) => SocketAddr::from_abstract_name(name.as_bytes()),
+        None => SocketAddr::from_pathname(path),
+    }
+    .with_context(|| format!("invalid NOTIFY_SOCKET {}", path))?;
+    socket
+        .send_to_addr(state.as_bytes(), &addr)
+        .with_context(|| format!("failed to send to {}", path))?;
+    Ok(())
+}
+
+/// Ping the systemd watchdog while the server is live, if one is set
+pub fn spawn_watchdog(checks: Arc<HealthChecks>) {
+    let Some(interval) = watchdog_interval() else {
+        return;
+    };
+    info!("Pinging systemd watchdog every {:?}", interval / 2);
+    tokio::spawn(async move {
+        let mut ticker = tokio::time::interval(interval / 2);
+        loop {
+            ticker.tick().await;
+            if checks.is_live() {
+                notify("WATCHDOG=1");
+            }
+        }
+    });
+}
+
+fn watchdog_interval() -> Option<Duration> {
+    let usec: u64 = std::env::var("WATCHDOG_USEC").ok()?.parse().ok()?;
+    if let Ok(pid) = std::env::var("WATCHDOG_PID") {
+        if pid.parse::<u32>().ok() != Some(std::process::id()) {
+            return None;
+        }
+    }
+    (usec > 0).then(|| Duration::from_micros(usec))
+}
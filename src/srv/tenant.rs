@@ -0,0 +1,102 @@
+//! Tenants
+//!
+//! `--tenant NAME=FILE` runs another, independent server in the same
+//! process. FILE holds its flags, one per line as `--flag value`, with `#`
+//! comments, so each tenant has its own key, WireGuard port, networks, DNS,
+//! policy, state and peers, and none sees another's. The process's API and
+//! admin API listeners serve each tenant's APIs under `/tenants/NAME`:
+//! clients register with `https://vpn.example.com/tenants/NAME` as their
+//! server URL, and `wirecagesrv peer --tenant NAME` manages its peers.
+//! Those listeners, their credentials and upgrades belong to the process,
+//! so a tenant's file can't set them; metrics, relay and STUN listeners
+//! are each tenant's own, and a tenant's `--tls-cert` is its relay's.
+
+use anyhow::{Context, Result};
+use axum::Router;
+use tokio::task::JoinHandle;
+
+/// Path tenants' APIs are served under, followed by the tenant's name
+pub const PATH_PREFIX: &str = "/tenants";
+
+/// Flags set once for the whole process, which a tenant's file can't set
+pub const PROCESS_WIDE: &[&str] = &[
+    "api_listen",
+    "admin_listen",
+    "admin_token",
+    "admin_read_token",
+    "admin_tls_cert",
+    "admin_tls_key",
+    "admin_client_ca",
+    "admin_socket",
+    "log_filter_file",
+    "upgrade_socket",
+    "tenant",
+];
+
+/// A tenant's APIs, for the process's listeners to serve
+pub struct Routers {
+    pub api: Router,
+    pub admin: Router,
+}
+
+/// A running tenant
+pub struct Tenant {
+    pub name: String,
+    pub routers: Routers,
+    /// The tenant's server, which returns once it has shut down
+    pub task: JoinHandle<()>,
+}
+
+/// The name in `NAME=FILE`
+pub fn name(spec: &str) -> Result<&str> {
+    let (name, _) = spec
+        .split_once('=')
+        .with_context(|| format!("tenant `{}` is not NAME=FILE", spec))?;
+    let valid = |c: char| c.is_ascii_alphanumeric() || c == '-' || c == '_';
+    if name.is_empty() || !name.chars().all(valid) {
+        anyhow::bail!(
+            "tenant name `{}` must be letters, digits, `-` and `_`",
+            name
+        );
+    }
+    Ok(name)
+}
+
+/// Read the flags of tenant `NAME=FILE` from FILE
+pub fn load_flags(spec: &str) -> Result<Vec<String>> {
+    let (_, path) = spec
+        .split_once('=')
+        .with_context(|| format!("tenant `{}` is not NAME=FILE", spec))?;
+    let contents = std::fs::read_to_string(path)
+        .with_context(|| format!("failed to read tenant file {}", path))?;
+    Ok(parse_flags(&contents))
+}
+
+/// Each line is a flag, then its value if it takes one
+fn parse_flags(contents: &str) -> Vec<String> {
+    contents
+        .lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty() && !line.starts_with('#'))
+        .flat_map(|line| match line.split_once(char::is_whitespace) {
+            Some((flag, value)) => vec![flag.to_string(), value.trim().to_string()],
+            None => vec![line.to_string()],
+        })
+        .collect()
+}
+
+/// `path` as the tenant it is under sees it, without the tenant's prefix
+pub fn route_path(path: &str) -> &str {
+    path.strip_prefix(PATH_PREFIX)
+        .and_then(|rest| rest.strip_prefix('/'))
+        .and_then(|rest| rest.find('/').map(|i| &rest[i..]))
+        .unwrap_or(path)
+}
+
+/// Serve the routes `pick` takes from each tenant under its path
+pub fn mount(router: Router, tenants: &[Tenant], pick: fn(&Routers) -> &Router) -> Router {
+    tenants.iter().fold(router, |router, tenant| {
+        let path = format!("{}/{}", PATH_PREFIX, tenant.name);
+        router.nest(&path, pick(&tenant.routers).clone())
+    })
+}
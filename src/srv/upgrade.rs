@@ -0,0 +1,221 @@
+//! Upgrading the server in place
+//!
+//! With `--upgrade-socket`, the server listens on a unix socket for its
+//! successor. A new binary started with the same flags connects to it and is
+//! handed the bound WireGuard socket and TCP listeners, together with every
+//! registered peer, ban and enrollment token, so it serves on the same addresses without
+//! rebinding them. Once the successor reports that it is up, the old server
+//! closes its sessions and exits. Tunnel session keys are not carried over,
+//! so peers notice no more than one handshake retry.
+//!
+//! If the successor fails before coming up, the old server carries on.
+
+use std::io::{IoSlice, IoSliceMut, Read, Write};
+use std::os::fd::{AsRawFd, FromRawFd, OwnedFd, RawFd};
+use std::os::unix::net::UnixStream;
+use std::sync::Arc;
+use std::time::Duration;
+
+use anyhow::{Context, Result};
+use nix::sys::socket::{recvmsg, sendmsg, ControlMessage, ControlMessageOwned, MsgFlags};
+use serde::{Deserialize, Serialize};
+use tokio::net::UnixListener;
+use tracing::{info, warn};
+
+use super::enroll::SharedToken;
+use super::state::{BannedKey, PeerInfo, SharedState};
+use super::store;
+use super::usage::UsageTracker;
+
+const HANDOFF_VERSION: u32 = 1;
+
+/// Most sockets handed over at once
+const MAX_SOCKETS: usize = 16;
+
+/// How long a successor has to come up before the old server carries on
+const SUCCESSOR_TIMEOUT: Duration = Duration::from_secs(60);
+
+/// Sent by the successor once it is serving
+const UP: u8 = 1;
+
+/// Sent ahead of the sockets, which travel with its length prefix
+#[derive(Serialize, Deserialize)]
+struct Handoff {
+    version: u32,
+    /// Names of the sockets passed alongside, in order
+    sockets: Vec<String>,
+    /// Registered peers and bans, in the peer store's format
+    peers: String,
+    #[serde(default)]
+    enrollment_tokens: Vec<SharedToken>,
+}
+
+/// What a successor receives from the server it replaces
+pub struct Takeover {
+    pub sockets: Vec<(String, OwnedFd)>,
+    pub peers: Vec<PeerInfo>,
+    pub bans: Vec<BannedKey>,
+    pub enrollment_tokens: Vec<SharedToken>,
+    predecessor: UnixStream,
+}
+
+impl Takeover {
+    /// Tell the old server this one is serving, so it exits
+    pub fn finish(mut self) -> Result<()> {
+        self.predecessor
+            .write_all(&[UP])
+            .context("failed to tell the previous server to exit")
+    }
+}
+
+/// Take over from the server listening on `path`, if one is
+pub fn take_over(path: &str) -> Result<Option<Takeover>> {
+    let mut stream = match UnixStream::connect(path) {
+        Ok(stream) => stream,
+        Err(e)
+            if matches!(
+                e.kind(),
+                std::io::ErrorKind::NotFound | std::io::ErrorKind::ConnectionRefused
+            ) =>
+        {
+            return Ok(None)
+        }
+        Err(e) => return Err(e).with_context(|| format!("failed to connect to {}", path)),
+    };
+
+    let mut len = [0u8; 4];
+    let (received, fds) = {
+        let mut iov = [IoSliceMut::new(&mut len)];
+        let mut cmsg = nix::cmsg_space!([RawFd; MAX_SOCKETS]);
+        let msg = recvmsg::<()>(
+            stream.as_raw_fd(),
+            &mut iov,
+            Some(&mut cmsg),
+            MsgFlags::MSG_CMSG_CLOEXEC,
+        )
+        .context("failed to receive sockets")?;
+        let mut fds = Vec::new();
+        for cmsg in msg.cmsgs().context("failed to receive sockets")? {
+            if let ControlMessageOwned::ScmRights(received) = cmsg {
+                fds.extend(
+                    received
+                        .into_iter()
+                        .map(|fd| unsafe { OwnedFd::from_raw_fd(fd) }),
+                );
+            }
+        }
+        (msg.bytes, fds)
+    };
+    if received == 0 {
+        anyhow::bail!("the running server closed the upgrade socket");
+    }
+    stream
+        .read_exact(&mut len[received..])
+        .context("failed to read handoff")?;
+    let mut header = vec![0u8; u32::from_be_bytes(len) as usize];
+    stream
+        .read_exact(&mut header)
+        .context("failed to read handoff")?;
+    let handoff: Handoff = serde_json::from_slice(&header).context("invalid handoff")?;
+    if handoff.version != HANDOFF_VERSION {
+        anyhow::bail!("unsupported handoff version {}", handoff.version);
+    }
+    if handoff.sockets.len() != fds.len() {
+        anyhow::bail!(
+            "expected {} sockets but received {}",
+            handoff.sockets.len(),
+            fds.len()
+        );
+    }
+    let (peers, bans) = store::decode(&handoff.peers, "handed-over peers")?;
+
+    Ok(Some(Takeover {
+        sockets: handoff.sockets.into_iter().zip(fds).collect(),
+        peers,
+        bans,
+        enrollment_tokens: handoff.enrollment_tokens,
+        predecessor: stream,
+    }))
+}
+
+/// Hand `sockets`, the peer registry and traffic usage to the first
+/// successor to connect to `listener`, returning once one is serving
+pub async fn wait_for_successor(
+    listener: UnixListener,
+    sockets: Vec<(&'static str, RawFd)>,
+    shared: Arc<SharedState>,
+    usage: Arc<UsageTracker>,
+) {
+    loop {
+        let stream = match listener.accept().await {
+            Ok((stream, _)) => stream,
+            Err(e) => {
+                warn!("Failed to accept on upgrade socket: {}", e);
+                continue;
+            }
+        };
+        info!("Handing over to a new server");
+        let sockets = sockets.clone();
+        let shared = Arc::clone(&shared);
+        let usage = Arc::clone(&usage);
+        let result = tokio::task::spawn_blocking(move || {
+            let stream = stream
+                .into_std()
+                .context("failed to use upgrade connection")?;
+            stream
+                .set_nonblocking(false)
+                .context("failed to use upgrade connection")?;
+            hand_over(stream, &sockets, &shared, &usage)
+        })
+        .await;
+        match result {
+            Ok(Ok(())) => return,
+            Ok(Err(e)) => warn!("Upgrade failed, carrying on: {:#}", e),
+            Err(e) => warn!("Upgrade failed, carrying on: {}", e),
+        }
+    }
+}
+
+fn hand_over(
+    mut stream: UnixStream,
+    sockets: &[(&'static str, RawFd)],
+    shared: &SharedState,
+    usage: &UsageTracker,
+) -> Result<()> {
+    // The successor loads traffic usage from disk as it starts
+    usage.flush().context("failed to save traffic usage")?;
+    let peers = String::from_utf8(shared.export_peers()?).context("invalid peer export")?;
+    let handoff = Handoff {
+        version: HANDOFF_VERSION,
+        sockets: sockets.iter().map(|(name, _)| name.to_string()).collect(),
+        peers,
+        enrollment_tokens: shared.enrollment.read().export(),
+    };
+    let header = serde_json::to_vec(&handoff)?;
+    let len = (header.len() as u32).to_be_bytes();
+    let fds: Vec<RawFd> = sockets.iter().map(|(_, fd)| *fd).collect();
+    let sent = sendmsg::<()>(
+        stream.as_raw_fd(),
+        &[IoSlice::new(&len)],
+        &[ControlMessage::ScmRights(&fds)],
+        MsgFlags::empty(),
+        None,
+    )
+    .context("failed to send sockets")?;
+    stream
+        .write_all(&len[sent..])
+        .and_then(|_| stream.write_all(&header))
+        .context("failed to send handoff")?;
+
+    stream
+        .set_read_timeout(Some(SUCCESSOR_TIMEOUT))
+        .context("failed to set upgrade timeout")?;
+    let mut up = [0u8; 1];
+    stream
+        .read_exact(&mut up)
+        .context("new server exited or did not come up")?;
+    if up[0] != UP {
+        anyhow::bail!("unexpected reply {} from new server", up[0]);
+    }
+    Ok(())
+}
@@ -0,0 +1,338 @@
+//! Dialing through an upstream SOCKS5 or HTTP proxy
+//!
+//! Where the server itself may only reach the internet through a corporate
+//! proxy, peers' TCP flows can be dialed through it: `socks5://` proxies get
+//! a SOCKS5 CONNECT and `http://` proxies an HTTP CONNECT, either with
+//! optional `user:password@` credentials. Destinations are always passed as
+//! IP addresses, since peers have already resolved them. Neither kind
+//! carries UDP here, so UDP flows routed to a proxy are dropped.
+//!
+//! Each flow's CONNECT turns its proxy connection into a tunnel, so
+//! connections cannot be reused once a flow is done. Instead, with
+//! `--egress-proxy-idle-connections`, a few connections to each proxy are
+//! kept open ahead of need, SOCKS5 ones already past authentication, and a
+//! new flow sends its CONNECT on one of them rather than waiting for a TCP
+//! handshake with the proxy first. Each use dials a replacement in the
+//! background. Idle connections are closed after
+//! `--egress-proxy-idle-timeout-secs`, before the proxy gives up on them,
+//! and proxy connections have TCP keep-alive on.
+
+use std::fmt;
+use std::io;
+use std::net::SocketAddrV4;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use anyhow::{Context, Result};
+use base64::Engine;
+use nix::sys::socket::{setsockopt, sockopt};
+use parking_lot::Mutex;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+use tracing::debug;
+
+use super::dial;
+
+/// Longest HTTP CONNECT response header accepted
+const MAX_HTTP_RESPONSE: usize = 8192;
+
+/// How long opening an idle connection may take
+const IDLE_DIAL_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// How many connections to keep open to a proxy ahead of need, and for how
+/// long
+#[derive(Debug, Clone, Copy)]
+pub struct IdleLimits {
+    pub connections: usize,
+    pub timeout: Duration,
+}
+
+impl Default for IdleLimits {
+    fn default() -> Self {
+        Self {
+            connections: 0,
+            timeout: Duration::from_secs(30),
+        }
+    }
+}
+
+/// Connections ready for a CONNECT, newest last
+#[derive(Default)]
+struct IdlePool {
+    connections: Vec<(TcpStream, Instant)>,
+    /// Connections being opened to refill the pool
+    opening: usize,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Kind {
+    Socks5,
+    Http,
+}
+
+/// A proxy outbound TCP flows can be dialed through
+#[derive(Clone)]
+pub struct UpstreamProxy {
+    kind: Kind,
+    /// `host:port`, resolved on each dial
+    addr: String,
+    credentials: Option<(String, String)>,
+    limits: IdleLimits,
+    idle: Arc<Mutex<IdlePool>>,
+}
+
+impl fmt::Debug for UpstreamProxy {
+    // Leaves out the credentials
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", self)
+    }
+}
+
+impl fmt::Display for UpstreamProxy {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let scheme = match self.kind {
+            Kind::Socks5 => "socks5",
+            Kind::Http => "http",
+        };
+        write!(f, "{}://{}", scheme, self.addr)
+    }
+}
+
+impl UpstreamProxy {
+    /// Parse `socks5://[user:password@]host:port` or
+    /// `http://[user:password@]host:port`, keeping idle connections to it
+    /// within `limits`
+    pub fn parse(url: &str, limits: IdleLimits) -> Result<Self> {
+        let (scheme, rest) = url
+            .split_once("://")
+            .with_context(|| format!("proxy {} has no scheme", url))?;
+        let kind = match scheme {
+            "socks5" | "socks5h" => Kind::Socks5,
+            "http" => Kind::Http,
+            _ => anyhow::bail!("unsupported proxy scheme {} (use socks5 or http)", scheme),
+        };
+        let rest = rest.trim_end_matches('/');
+        let (credentials, addr) = match rest.rsplit_once('@') {
+            Some((userinfo, addr)) => {
+                let (user, password) = userinfo.split_once(':').unwrap_or((userinfo, ""));
+                (Some((user.to_string(), password.to_string())), addr)
+            }
+            None => (None, rest),
+        };
+        let port = addr
+            .rsplit_once(':')
+            .and_then(|(_, port)| port.parse::<u16>().ok())
+            .with_context(|| format!("proxy address {} has no port", addr))?;
+        if port == 0 {
+            anyhow::bail!("proxy address {} has no port", addr);
+        }
+        if kind == Kind::Socks5 {
+            if let Some((user, password)) = &credentials {
+                if user.len() > 255 || password.len() > 255 {
+                    anyhow::bail!("SOCKS5 user name and password must be under 256 bytes");
+                }
+            }
+        }
+        Ok(Self {
+            kind,
+            addr: addr.to_string(),
+            credentials,
+            limits,
+            idle: Arc::default(),
+        })
+    }
+
+    /// Open a TCP connection to `target` through the proxy, on an idle
+    /// connection if there is one
+    pub async fn connect(&self, target: SocketAddrV4) -> io::Result<TcpStream> {
+        let idle = self.take_idle();
+        self.refill();
+        if let Some(mut stream) = idle {
+            match self.request(&mut stream, target).await {
+                Ok(()) => return Ok(stream),
+                // The proxy may have dropped it just now; try a new one
+                Err(e) if e.downcast_ref::<io::Error>().is_some() => {
+                    debug!("Idle connection to proxy {} failed: {:#}", self, e);
+                }
+                Err(e) => return Err(self.error(e)),
+            }
+        }
+        let mut stream = self.open().await.map_err(|e| self.error(e))?;
+        self.request(&mut stream, target)
+            .await
+            .map_err(|e| self.error(e))?;
+        Ok(stream)
+    }
+
+    fn error(&self, e: anyhow::Error) -> io::Error {
+        io::Error::other(format!("proxy {}: {:#}", self, e))
+    }
+
+    /// Open a connection to the proxy, ready for a CONNECT
+    async fn open(&self) -> Result<TcpStream> {
+        let mut stream = dial::connect_host(&self.addr).await?;
+        stream.set_nodelay(true)?;
+        setsockopt(&stream, sockopt::KeepAlive, &true)?;
+        if self.kind == Kind::Socks5 {
+            self.socks5_authenticate(&mut stream).await?;
+        }
+        Ok(stream)
+    }
+
+    /// Ask the proxy for a tunnel to `target`
+    async fn request(&self, stream: &mut TcpStream, target: SocketAddrV4) -> Result<()> {
+        match self.kind {
+            Kind::Socks5 => self.socks5_connect(stream, target).await,
+            Kind::Http => self.http_connect(stream, target).await,
+        }
+    }
+
+    /// The newest idle connection still open, closing those past the idle
+    /// timeout
+    fn take_idle(&self) -> Option<TcpStream> {
+        let mut idle = self.idle.lock();
+        let timeout = self.limits.timeout;
+        idle.connections
+            .retain(|(_, since)| since.elapsed() < timeout);
+        while let Some((stream, _)) = idle.connections.pop() {
+            // A connection waiting for a request has nothing to read unless
+            // the proxy closed it
+            let mut byte = [0u8; 1];
+            if matches!(stream.try_read(&mut byte), Err(e) if e.kind() == io::ErrorKind::WouldBlock)
+            {
+                return Some(stream);
+            }
+        }
+        None
+    }
+
+    /// Open connections in the background until the pool is full
+    fn refill(&self) {
+        let wanted = {
+            let mut idle = self.idle.lock();
+            let wanted = self
+                .limits
+                .connections
+                .saturating_sub(idle.connections.len() + idle.opening);
+            idle.opening += wanted;
+            wanted
+        };
+        for _ in 0..wanted {
+            let proxy = self.clone();
+            tokio::spawn(async move {
+                let result = tokio::time::timeout(IDLE_DIAL_TIMEOUT, proxy.open()).await;
+                let mut idle = proxy.idle.lock();
+                idle.opening -= 1;
+                match result {
+                    Ok(Ok(stream)) => idle.connections.push((stream, Instant::now())),
+                    Ok(Err(e)) => {
+                        debug!("Failed to open idle connection to proxy {}: {:#}", proxy, e)
+                    }
+                    Err(_) => debug!("Opening idle connection to proxy {} timed out", proxy),
+                }
+            });
+        }
+    }
+
+    /// Negotiate the authentication method, and log in if there are
+    /// credentials
+    async fn socks5_authenticate(&self, stream: &mut TcpStream) -> Result<()> {
+        let method = if self.credentials.is_some() {
+            0x02
+        } else {
+            0x00
+        };
+        stream.write_all(&[0x05, 0x01, method]).await?;
+        let mut reply = [0u8; 2];
+        stream.read_exact(&mut reply).await?;
+        if reply[0] != 0x05 {
+            anyhow::bail!("not a SOCKS5 proxy");
+        }
+        if reply[1] != method {
+            anyhow::bail!("proxy refused authentication method {}", method);
+        }
+        if let Some((user, password)) = &self.credentials {
+            let mut auth = vec![0x01, user.len() as u8];
+            auth.extend_from_slice(user.as_bytes());
+            auth.push(password.len() as u8);
+            auth.extend_from_slice(password.as_bytes());
+            stream.write_all(&auth).await?;
+            stream.read_exact(&mut reply).await?;
+            if reply[1] != 0x00 {
+                anyhow::bail!("authentication failed");
+            }
+        }
+        Ok(())
+    }
+
+    async fn socks5_connect(&self, stream: &mut TcpStream, target: SocketAddrV4) -> Result<()> {
+        let mut request = vec![0x05, 0x01, 0x00, 0x01];
+        request.extend_from_slice(&target.ip().octets());
+        request.extend_from_slice(&target.port().to_be_bytes());
+        stream.write_all(&request).await?;
+        let mut header = [0u8; 4];
+        stream.read_exact(&mut header).await?;
+        if header[1] != 0x00 {
+            anyhow::bail!("CONNECT to {} failed: {}", target, socks5_error(header[1]));
+        }
+        // Skip the address the proxy bound
+        let bound_len = match header[3] {
+            0x01 => 4,
+            0x04 => 16,
+            0x03 => stream.read_u8().await? as usize,
+            atyp => anyhow::bail!("unknown address type {} in reply", atyp),
+        };
+        let mut bound = vec![0u8; bound_len + 2];
+        stream.read_exact(&mut bound).await?;
+        Ok(())
+    }
+
+    async fn http_connect(&self, stream: &mut TcpStream, target: SocketAddrV4) -> Result<()> {
+        let mut request = format!("CONNECT {0} HTTP/1.1\r\nHost: {0}\r\n", target);
+        if let Some((user, password)) = &self.credentials {
+            let token =
+                base64::engine::general_purpose::STANDARD.encode(format!("{}:{}", user, password));
+            request.push_str(&format!("Proxy-Authorization: Basic {}\r\n", token));
+        }
+        request.push_str("\r\n");
+        stream.write_all(request.as_bytes()).await?;
+
+        // Read the header a byte at a time so nothing from the tunnel that
+        // follows it is consumed
+        let mut response = Vec::new();
+        while !response.ends_with(b"\r\n\r\n") {
+            if response.len() >= MAX_HTTP_RESPONSE {
+                anyhow::bail!("CONNECT response too long");
+            }
+            response.push(stream.read_u8().await?);
+        }
+        let status_line = response
+            .split(|&b| b == b'\r')
+            .next()
+            .map(String::from_utf8_lossy)
+            .unwrap_or_default();
+        let status = status_line
+            .split_whitespace()
+            .nth(1)
+            .and_then(|code| code.parse::<u16>().ok())
+            .with_context(|| format!("invalid CONNECT response {:?}", status_line))?;
+        if !(200..300).contains(&status) {
+            anyhow::bail!("CONNECT to {} failed: {}", target, status_line.trim());
+        }
+        Ok(())
+    }
+}
+
+fn socks5_error(code: u8) -> &'static str {
+    match code {
+        0x01 => "general failure",
+        0x02 => "not allowed by ruleset",
+        0x03 => "network unreachable",
+        0x04 => "host unreachable",
+        0x05 => "connection refused",
+        0x06 => "TTL expired",
+        0x07 => "command not supported",
+        0x08 => "address type not supported",
+        _ => "unknown error",
+    }
+}
@@ -0,0 +1,291 @@
+//! Per-peer traffic accounting
+//!
+//! Bytes each peer sends (`up`) and receives (`down`) through the server and
+//! the flows it opens are counted in hourly buckets. With `--usage-file`
+//! the buckets are written to disk every minute and read back on startup,
+//! so usage survives restarts, unlike the WireGuard transfer counters.
+//! Buckets older than the retention period are dropped.
+
+use std::collections::{BTreeMap, HashMap};
+use std::io::Write;
+use std::ops::Range;
+use std::os::unix::fs::OpenOptionsExt;
+use std::path::PathBuf;
+use std::sync::Arc;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::{Context, Result};
+use base64::Engine;
+use parking_lot::Mutex;
+use serde::{Deserialize, Serialize};
+use tracing::{debug, warn};
+
+use super::bandwidth::Direction;
+
+const USAGE_VERSION: u32 = 1;
+pub const HOUR_SECS: u64 = 3600;
+const FLUSH_INTERVAL: Duration = Duration::from_secs(60);
+
+/// Traffic totals over some period
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Counters {
+    pub up_bytes: u64,
+    pub down_bytes: u64,
+    pub flows: u64,
+}
+
+impl Counters {
+    pub fn add(&mut self, other: &Counters) {
+        self.up_bytes += other.up_bytes;
+        self.down_bytes += other.down_bytes;
+        self.flows += other.flows;
+    }
+
+    pub fn total_bytes(&self) -> u64 {
+        self.up_bytes + self.down_bytes
+    }
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+struct StoredBucket {
+    /// Unix time the hour starts at
+    start: u64,
+    #[serde(flatten)]
+    counters: Counters,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+struct UsageFile {
+    version: u32,
+    #[serde(default)]
+    peers: BTreeMap<String, Vec<StoredBucket>>,
+}
+
+pub struct UsageTracker {
+    path: Option<PathBuf>,
+    retention: Duration,
+    /// Hourly buckets by peer, keyed by the Unix time each hour starts
+    history: Mutex<HashMap<[u8; 32], BTreeMap<u64, Counters>>>,
+}
+
+impl UsageTracker {
+    /// Track usage, restoring it from `path` if given
+    pub fn load(path: Option<PathBuf>, retention: Duration) -> Result<Self> {
+        let mut history = HashMap::new();
+        if let Some(path) = &path {
+            match std::fs::read_to_string(path) {
+                Ok(contents) => {
+                    let file: UsageFile = serde_json::from_str(&contents)
+                        .with_context(|| format!("failed to parse {}", path.display()))?;
+                    if file.version != USAGE_VERSION {
+                        anyhow::bail!(
+                            "{} has unsupported version {}",
+                            path.display(),
+                            file.version
+                        );
+                    }
+                    for (key, buckets) in file.peers {
+                        let public_key = base64::engine::general_purpose::STANDARD
+                            .decode(&key)
+                            .ok()
+                            .and_then(|bytes| <[u8; 32]>::try_from(bytes).ok())
+                            .with_context(|| format!("invalid public key {} in usage", key))?;
+                        history.insert(
+                            public_key,
+                            buckets
+                                .into_iter()
+                                .map(|bucket| (bucket.start, bucket.counters))
+                                .collect(),
+                        );
+                    }
+                }
+                Err(e) if e.kind() == std::io::ErrorKind::NotFound => {}
+                Err(e) => {
+                    return Err(e).with_context(|| format!("failed to read {}", path.display()))
+                }
+            }
+        }
+        let tracker = Self {
+            path,
+            retention,
+            history: Mutex::new(history),
+        };
+        tracker.prune();
+        Ok(tracker)
+    }
+
+    /// Add counts gathered since the last call to the current hour
+    pub fn record(&self, counts: HashMap<[u8; 32], Counters>) {
+        if counts.is_empty() {
+            return;
+        }
+        let hour = hour_start(unix_now());
+        let mut history = self.history.lock();
+        for (peer, counters) in counts {
+            history
+                .entry(peer)
+                .or_default()
+                .entry(hour)
+                .or_default()
+                .add(&counters);
+        }
+    }
+
+    /// Usage of one peer between two Unix times, in buckets of
+    /// `bucket_secs` (a multiple of an hour), and its total
+    pub fn peer_usage(
+        &self,
+        peer: &[u8; 32],
+        since: u64,
+        until: u64,
+        bucket_secs: u64,
+    ) -> (Counters, Vec<(u64, Counters)>) {
+        let history = self.history.lock();
+        let mut total = Counters::default();
+        let mut buckets: BTreeMap<u64, Counters> = BTreeMap::new();
+        if let (Some(hours), Some(window)) = (history.get(peer), window(since, until)) {
+            for (start, counters) in hours.range(window) {
+                total.add(counters);
+                buckets
+                    .entry(start - start % bucket_secs)
+                    .or_default()
+                    .add(counters);
+            }
+        }
+        (total, buckets.into_iter().collect())
+    }
+
+    /// Totals of every peer with traffic between two Unix times
+    pub fn totals(&self, since: u64, until: u64) -> Vec<([u8; 32], Counters)> {
+        let Some(window) = window(since, until) else {
+            return Vec::new();
+        };
+        self.history
+            .lock()
+            .iter()
+            .filter_map(|(peer, hours)| {
+                let mut total = Counters::default();
+                for counters in hours.range(window.clone()).map(|(_, c)| c) {
+                    total.add(counters);
+                }
+                (total != Counters::default()).then_some((*peer, total))
+            })
+            .collect()
+    }
+
+    /// Drop buckets older than the retention period
+    fn prune(&self) {
+        let cutoff = unix_now().saturating_sub(self.retention.as_secs());
+        let mut history = self.history.lock();
+        for hours in history.values_mut() {
+            *hours = hours.split_off(&hour_start(cutoff));
+        }
+        history.retain(|_, hours| !hours.is_empty());
+    }
+
+    /// Atomically replace the usage file with the current buckets
+    fn save(&self) -> Result<()> {
+        let Some(path) = &self.path else {
+            return Ok(());
+        };
+        let peers = self
+            .history
+            .lock()
+            .iter()
+            .map(|(peer, hours)| {
+                let key = base64::engine::general_purpose::STANDARD.encode(peer);
+                let buckets = hours
+                    .iter()
+                    .map(|(start, counters)| StoredBucket {
+                        start: *start,
+                        counters: *counters,
+                    })
+                    .collect();
+                (key, buckets)
+            })
+            .collect();
+        let contents = serde_json::to_vec(&UsageFile {
+            version: USAGE_VERSION,
+            peers,
+        })?;
+
+        let tmp_path = path.with_extension("tmp");
+        let mut tmp = std::fs::OpenOptions::new()
+            .write(true)
+            .create(true)
+            .truncate(true)
+            .mode(0o600)
+            .open(&tmp_path)
+            .with_context(|| format!("failed to create {}", tmp_path.display()))?;
+        tmp.write_all(&contents)?;
+        tmp.sync_all()?;
+        std::fs::rename(&tmp_path, path)
+            .with_context(|| format!("failed to replace {}", path.display()))?;
+        Ok(())
+    }
+
+    /// Prune and save the buckets now, as on shutdown
+    pub fn flush(&self) -> Result<()> {
+        self.prune();
+        self.save()
+    }
+
+    /// Prune and save the buckets every minute
+    pub fn spawn_flush(self: &Arc<Self>) {
+        let tracker = Arc::clone(self);
+        tokio::spawn(async move {
+            let mut interval = tokio::time::interval(FLUSH_INTERVAL);
+            interval.tick().await;
+            loop {
+                interval.tick().await;
+                tracker.prune();
+                let tracker = Arc::clone(&tracker);
+                match tokio::task::spawn_blocking(move || tracker.save()).await {
+                    Ok(Ok(())) => debug!("Saved traffic usage"),
+                    Ok(Err(e)) => warn!("Failed to save traffic usage: {:#}", e),
+                    Err(e) => warn!("Traffic usage save task failed: {}", e),
+                }
+            }
+        });
+    }
+}
+
+/// Counts gathered by the dataplane between calls to
+/// [`UsageTracker::record`]
+#[derive(Default)]
+pub struct PendingUsage(Mutex<HashMap<[u8; 32], Counters>>);
+
+impl PendingUsage {
+    pub fn add_bytes(&self, peer: &[u8; 32], direction: Direction, bytes: usize) {
+        let mut pending = self.0.lock();
+        let counters = pending.entry(*peer).or_default();
+        match direction {
+            Direction::Up => counters.up_bytes += bytes as u64,
+            Direction::Down => counters.down_bytes += bytes as u64,
+        }
+    }
+
+    pub fn add_flow(&self, peer: &[u8; 32]) {
+        self.0.lock().entry(*peer).or_default().flows += 1;
+    }
+
+    pub fn take(&self) -> HashMap<[u8; 32], Counters> {
+        std::mem::take(&mut *self.0.lock())
+    }
+}
+
+pub fn unix_now() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map_or(0, |d| d.as_secs())
+}
+
+fn hour_start(secs: u64) -> u64 {
+    secs - secs % HOUR_SECS
+}
+
+/// Start times of the hourly buckets overlapping `since..until`
+fn window(since: u64, until: u64) -> Option<Range<u64>> {
+    let start = hour_start(since);
+    (start < until).then_some(start..until)
+}
@@ -0,0 +1,248 @@
+//! Webhooks on peer lifecycle events
+//!
+//! Each configured URL receives a JSON `POST` when a peer is added,
+//! removed or expires, completes its first handshake (`peer_connected`), or has gone
+//! without a handshake for the idle threshold (`peer_idle`; its next
+//! handshake counts as connecting again), and when the anomaly detector
+//! flags a peer (`anomaly`). Deliveries to one URL are made in
+//! order and retried with backoff on network errors and 5xx or 429
+//! responses.
+//!
+//! With a secret configured, the body is signed with HMAC-SHA256 and the
+//! hex digest sent as `X-Wirecage-Signature: sha256=<hex>`. Every delivery
+//! carries a unique `X-Wirecage-Delivery` ID that stays the same across
+//! retries, so receivers can drop duplicates.
+
+use std::collections::HashMap;
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+use anyhow::Result;
+use aws_lc_rs::hmac;
+use rand::RngCore;
+use tokio::sync::{broadcast, mpsc};
+use tracing::{debug, warn};
+
+use super::events::Event;
+
+pub const EVENT_TYPES: &[&str] = &[
+    "peer_added",
+    "peer_removed",
+    "peer_expired",
+    "peer_connected",
+    "peer_idle",
+    "anomaly",
+];
+
+/// Deliveries queued per URL before new ones are dropped
+const QUEUE_LEN: usize = 1024;
+
+const MAX_ATTEMPTS: u32 = 5;
+const INITIAL_BACKOFF: Duration = Duration::from_secs(1);
+const HTTP_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// How often connected peers are checked for idleness
+const IDLE_CHECK_INTERVAL: Duration = Duration::from_secs(10);
+
+pub struct WebhookSettings {
+    pub urls: Vec<String>,
+    /// Key for signing request bodies
+    pub secret: Option<String>,
+    /// Event types to send; all of them if empty
+    pub events: Vec<String>,
+    /// Send `peer_idle` after this long without a handshake
+    pub idle_after: Option<Duration>,
+}
+
+/// Start delivering events from `events` to the configured URLs
+pub fn spawn(events: broadcast::Receiver<Event>, settings: WebhookSettings) -> Result<()> {
+    if let Some(unknown) = settings
+        .events
+        .iter()
+        .find(|event| !EVENT_TYPES.contains(&event.as_str()))
+    {
+        anyhow::bail!(
+            "unknown webhook event {} (expected one of {})",
+            unknown,
+            EVENT_TYPES.join(", ")
+        );
+    }
+
+    let client = reqwest::Client::builder().timeout(HTTP_TIMEOUT).build()?;
+    let key = settings
+        .secret
+        .as_ref()
+        .map(|secret| hmac::Key::new(hmac::HMAC_SHA256, secret.as_bytes()));
+    let queues = settings
+        .urls
+        .into_iter()
+        .map(|url| {
+            let (tx, rx) = mpsc::channel(QUEUE_LEN);
+            tokio::spawn(deliver(client.clone(), url, key.clone(), rx));
+            tx
+        })
+        .collect();
+
+    let watcher = Watcher {
+        wanted: settings.events,
+        idle_after: settings.idle_after,
+        connected: HashMap::new(),
+        queues,
+    };
+    tokio::spawn(watcher.run(events));
+    Ok(())
+}
+
+struct Watcher {
+    wanted: Vec<String>,
+    idle_after: Option<Duration>,
+    /// Last handshake of peers that have connected and not gone idle since
+    connected: HashMap<String, Instant>,
+    queues: Vec<mpsc::Sender<String>>,
+}
+
+impl Watcher {
+    async fn run(mut self, mut events: broadcast::Receiver<Event>) {
+        let mut idle_check = tokio::time::interval(IDLE_CHECK_INTERVAL);
+        loop {
+            tokio::select! {
+                received = events.recv() => match received {
+                    Ok(event) => self.handle(event),
+                    Err(broadcast::error::RecvError::Lagged(missed)) => {
+                        warn!("Webhooks fell behind and missed {} events", missed);
+                    }
+                    Err(broadcast::error::RecvError::Closed) => return,
+                },
+                _ = idle_check.tick(), if self.idle_after.is_some() => self.check_idle(),
+            }
+        }
+    }
+
+    fn handle(&mut self, event: Event) {
+        match &event {
+            Event::PeerAdded { .. } | Event::PeerExpired { .. } | Event::Anomaly { .. } => {}
+            Event::PeerRemoved { public_key, .. } => {
+                self.connected.remove(public_key);
+            }
+            Event::HandshakeCompleted {
+                public_key,
+                endpoint,
+            } => {
+                if self
+                    .connected
+                    .insert(public_key.clone(), Instant::now())
+                    .is_none()
+                {
+                    self.send(serde_json::json!({
+                        "type": "peer_connected",
+                        "public_key": public_key,
+                        "endpoint": endpoint,
+                    }));
+                }
+                return;
+            }
+            Event::EndpointChanged { .. } => return,
+        }
+        self.send(serde_json::to_value(&event).expect("events serialize"));
+    }
+
+    fn check_idle(&mut self) {
+        let Some(idle_after) = self.idle_after else {
+            return;
+        };
+        let idle: Vec<(String, Instant)> = self
+            .connected
+            .iter()
+            .filter(|(_, last_handshake)| last_handshake.elapsed() >= idle_after)
+            .map(|(public_key, last_handshake)| (public_key.clone(), *last_handshake))
+            .collect();
+        for (public_key, last_handshake) in idle {
+            self.connected.remove(&public_key);
+            self.send(serde_json::json!({
+                "type": "peer_idle",
+                "public_key": public_key,
+                "idle_secs": last_handshake.elapsed().as_secs(),
+            }));
+        }
+    }
+
+    fn send(&self, mut payload: serde_json::Value) {
+        let kind = payload["type"].as_str().unwrap_or_default().to_string();
+        if !self.wanted.is_empty() && !self.wanted.contains(&kind) {
+            return;
+        }
+        payload["time"] = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map_or(0, |d| d.as_secs())
+            .into();
+        let body = payload.to_string();
+        for queue in &self.queues {
+            if queue.try_send(body.clone()).is_err() {
+                warn!("Webhook queue is full; dropping {} event", kind);
+            }
+        }
+    }
+}
+
+/// Deliver queued bodies to one URL in order
+async fn deliver(
+    client: reqwest::Client,
+    url: String,
+    key: Option<hmac::Key>,
+    mut queue: mpsc::Receiver<String>,
+) {
+    while let Some(body) = queue.recv().await {
+        let delivery_id = delivery_id();
+        let signature = key
+            .as_ref()
+            .map(|key| format!("sha256={}", hex(hmac::sign(key, body.as_bytes()).as_ref())));
+
+        let mut backoff = INITIAL_BACKOFF;
+        for attempt in 1..=MAX_ATTEMPTS {
+            let mut request = client
+                .post(&url)
+                .header(reqwest::header::CONTENT_TYPE, "application/json")
+                .header("X-Wirecage-Delivery", &delivery_id)
+                .body(body.clone());
+            if let Some(signature) = &signature {
+                request = request.header("X-Wirecage-Signature", signature);
+            }
+
+            let (error, retryable) = match request.send().await {
+                Ok(response) if response.status().is_success() => {
+                    debug!("Delivered webhook {} to {}", delivery_id, url);
+                    break;
+                }
+                Ok(response) => {
+                    let status = response.status();
+                    let retryable = status.is_server_error()
+                        || status == reqwest::StatusCode::TOO_MANY_REQUESTS;
+                    (format!("status {}", status), retryable)
+                }
+                Err(e) => (e.to_string(), true),
+            };
+            if !retryable || attempt == MAX_ATTEMPTS {
+                warn!(
+                    "Giving up on webhook {} to {} after {} attempts: {}",
+                    delivery_id, url, attempt, error
+                );
+                break;
+            }
+            debug!(
+                "Webhook {} to {} failed ({}); retrying in {:?}",
+                delivery_id, url, error, backoff
+            );
+            tokio::time::sleep(backoff).await;
+            backoff *= 2;
+        }
+    }
+}
+
+fn delivery_id() -> String {
+    let mut bytes = [0u8; 8];
+    rand::thread_rng().fill_bytes(&mut bytes);
+    hex(&bytes)
+}
+
+fn hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{:02x}", b)).collect()
+}
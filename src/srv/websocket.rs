@@ -0,0 +1,271 @@
+//! Server side of the WebSocket protocol (RFC 6455)
+//!
+//! Only as much of it as carrying binary messages needs: the opening
+//! handshake and framing. Messages are read whole, text and pong frames are
+//! skipped, and pings are handed to the caller to answer.
+
+use std::io;
+
+use aws_lc_rs::digest;
+use base64::Engine;
+use bytes::{Buf, BytesMut};
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt};
+
+/// Appended to the client's key to make the accept value
+const ACCEPT_GUID: &str = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11";
+/// Longest opening handshake read
+const MAX_REQUEST_LEN: usize = 8192;
+const MAX_HEADERS: usize = 32;
+
+const OP_CONTINUATION: u8 = 0x0;
+const OP_TEXT: u8 = 0x1;
+pub const OP_BINARY: u8 = 0x2;
+const OP_CLOSE: u8 = 0x8;
+const OP_PING: u8 = 0x9;
+pub const OP_PONG: u8 = 0xa;
+
+/// The parts of a client's opening handshake the server looks at
+pub struct Request {
+    /// Path, without any query
+    pub path: String,
+    /// The client's key, if the request asks for a WebSocket
+    key: Option<String>,
+}
+
+impl Request {
+    pub fn is_upgrade(&self) -> bool {
+        self.key.is_some()
+    }
+}
+
+/// A message from the client
+pub enum Message {
+    Binary(Vec<u8>),
+    /// A ping, to be answered with a pong carrying the same data
+    Ping(Vec<u8>),
+}
+
+/// Read an opening handshake, parsing whatever `buf` already holds first
+/// and leaving anything sent after the request in it
+pub async fn read_request<R: AsyncRead + Unpin>(
+    reader: &mut R,
+    buf: &mut BytesMut,
+) -> io::Result<Request> {
+    loop {
+        let parsed = {
+            let mut headers = [httparse::EMPTY_HEADER; MAX_HEADERS];
+            let mut request = httparse::Request::new(&mut headers);
+            match request.parse(buf) {
+                Ok(httparse::Status::Complete(len)) => {
+                    let header = |name: &str| {
+                        request
+                            .headers
+                            .iter()
+                            .find(|header| header.name.eq_ignore_ascii_case(name))
+                            .and_then(|header| std::str::from_utf8(header.value).ok())
+                    };
+                    let upgrade = request.method == Some("GET")
+                        && header("upgrade")
+                            .is_some_and(|value| value.eq_ignore_ascii_case("websocket"))
+                        && header("sec-websocket-version") == Some("13");
+                    let key = header("sec-websocket-key")
+                        .filter(|_| upgrade)
+                        .map(|key| key.trim().to_string());
+                    let path = request.path.unwrap_or("/");
+                    let path = path.split_once('?').map_or(path, |(path, _)| path);
+                    Some((len, path.to_string(), key))
+                }
+                Ok(httparse::Status::Partial) => None,
+                Err(e) => return Err(invalid(&format!("malformed request: {}", e))),
+            }
+        };
+        if let Some((len, path, key)) = parsed {
+            buf.advance(len);
+            return Ok(Request { path, key });
+        }
+        if buf.len() >= MAX_REQUEST_LEN {
+            return Err(invalid("request too long"));
+        }
+        if reader.read_buf(buf).await? == 0 {
+            return Err(io::ErrorKind::UnexpectedEof.into());
+        }
+    }
+}
+
+/// Complete the handshake of a request for a WebSocket
+pub async fn accept<W: AsyncWrite + Unpin>(writer: &mut W, request: &Request) -> io::Result<()> {
+    let key = request
+        .key
+        .as_deref()
+        .ok_or_else(|| invalid("not a WebSocket request"))?;
+    let hash = digest::digest(
+        &digest::SHA1_FOR_LEGACY_USE_ONLY,
+        format!("{}{}", key, ACCEPT_GUID).as_bytes(),
+    );
+    let response = format!(
+        "HTTP/1.1 101 Switching Protocols\r\n\
+         Upgrade: websocket\r\n\
+         Connection: Upgrade\r\n\
+         Sec-WebSocket-Accept: {}\r\n\r\n",
+        base64::engine::general_purpose::STANDARD.encode(hash.as_ref())
+    );
+    writer.write_all(response.as_bytes()).await?;
+    writer.flush().await
+}
+
+/// Turn a request away with an HTTP status such as `404 Not Found`
+pub async fn reject<W: AsyncWrite + Unpin>(writer: &mut W, status: &str) -> io::Result<()> {
+    let response = format!(
+        "HTTP/1.1 {}\r\nSec-WebSocket-Version: 13\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+        status
+    );
+    writer.write_all(response.as_bytes()).await?;
+    writer.flush().await
+}
+
+/// Write a frame holding a whole message; frames from the server are not
+/// masked
+pub async fn write_frame<W: AsyncWrite + Unpin>(
+    writer: &mut W,
+    opcode: u8,
+    payload: &[u8],
+) -> io::Result<()> {
+    let mut frame = Vec::with_capacity(payload.len() + 10);
+    frame.push(0x80 | opcode);
+    match payload.len() {
+        len @ 0..=125 => frame.push(len as u8),
+        len @ 126..=0xffff => {
+            frame.push(126);
+            frame.extend_from_slice(&(len as u16).to_be_bytes());
+        }
+        len => {
+            frame.push(127);
+            frame.extend_from_slice(&(len as u64).to_be_bytes());
+        }
+    }
+    frame.extend_from_slice(payload);
+    writer.write_all(&frame).await?;
+    writer.flush().await
+}
+
+/// Messages read from a client
+pub struct Reader<R> {
+    inner: R,
+    buf: BytesMut,
+    max_len: usize,
+    /// Opcode and payload so far of a message split across frames
+    partial: Option<(u8, Vec<u8>)>,
+}
+
+impl<R: AsyncRead + Unpin> Reader<R> {
+    /// Read messages of up to `max_len` bytes, starting with any frames
+    /// already in `buf`
+    pub fn new(inner: R, buf: BytesMut, max_len: usize) -> Self {
+        Self {
+            inner,
+            buf,
+            max_len,
+            partial: None,
+        }
+    }
+
+    /// The next binary message or ping, or `None` once the client closes
+    /// the connection. Cancel-safe: a frame read in part is kept for the
+    /// next call.
+    pub async fn next(&mut self) -> io::Result<Option<Message>> {
+        loop {
+            let Some((fin, opcode, payload)) = self.frame().await? else {
+                return Ok(None);
+            };
+            let (opcode, message) = match opcode {
+                OP_CLOSE => return Ok(None),
+                OP_PING => return Ok(Some(Message::Ping(payload))),
+                OP_PONG => continue,
+                OP_TEXT | OP_BINARY if self.partial.is_none() => {
+                    if !fin {
+                        self.partial = Some((opcode, payload));
+                        continue;
+                    }
+                    (opcode, payload)
+                }
+                OP_CONTINUATION => {
+                    let (_, message) = self
+                        .partial
+                        .as_mut()
+                        .ok_or_else(|| invalid("continuation outside a message"))?;
+                    if message.len() + payload.len() > self.max_len {
+                        return Err(invalid("message too long"));
+                    }
+                    message.extend_from_slice(&payload);
+                    if !fin {
+                        continue;
+                    }
+                    self.partial.take().expect("partial message")
+                }
+                _ => return Err(invalid("unexpected frame")),
+            };
+            if opcode == OP_BINARY {
+                return Ok(Some(Message::Binary(message)));
+            }
+        }
+    }
+
+    /// Read a frame, returning whether it ends its message, its opcode and
+    /// its unmasked payload
+    async fn frame(&mut self) -> io::Result<Option<(bool, u8, Vec<u8>)>> {
+        loop {
+            if let Some(frame) = self.parse()? {
+                return Ok(Some(frame));
+            }
+            if self.inner.read_buf(&mut self.buf).await? == 0 {
+                if self.buf.is_empty() {
+                    return Ok(None);
+                }
+                return Err(io::ErrorKind::UnexpectedEof.into());
+            }
+        }
+    }
+
+    fn parse(&mut self) -> io::Result<Option<(bool, u8, Vec<u8>)>> {
+        let Some(&[first, second]) = self.buf.get(..2) else {
+            return Ok(None);
+        };
+        if second & 0x80 == 0 {
+            return Err(invalid("unmasked frame from client"));
+        }
+        let (len, offset) = match second & 0x7f {
+            126 => match self.buf.get(2..4) {
+                Some(len) => (u64::from(u16::from_be_bytes([len[0], len[1]])), 4),
+                None => return Ok(None),
+            },
+            127 => match self.buf.get(2..10) {
+                Some(len) => (u64::from_be_bytes(len.try_into().expect("8 bytes")), 10),
+                None => return Ok(None),
+            },
+            len => (u64::from(len), 2),
+        };
+        if len > self.max_len as u64 {
+            return Err(invalid("frame too long"));
+        }
+        let len = len as usize;
+        let Some(mask) = self.buf.get(offset..offset + 4) else {
+            return Ok(None);
+        };
+        let mask: [u8; 4] = mask.try_into().expect("4 bytes");
+        let start = offset + 4;
+        if self.buf.len() < start + len {
+            self.buf.reserve(start + len - self.buf.len());
+            return Ok(None);
+        }
+        self.buf.advance(start);
+        let mut payload = self.buf.split_to(len).to_vec();
+        for (i, byte) in payload.iter_mut().enumerate() {
+            *byte ^= mask[i % 4];
+        }
+        Ok(Some((first & 0x80 != 0, first & 0x0f, payload)))
+    }
+}
+
+fn invalid(message: &str) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, message.to_string())
+}
@@ -1,50 +1,194 @@
 //! WireGuard IO layer for wirecagesrv
 //!
 //! Handles:
-//! - UDP socket for WireGuard protocol
+//! - UDP sockets for WireGuard protocol, on one or more listen addresses;
+//!   a peer is answered from the address it last sent to
+//! - Connections carrying WireGuard messages over a stream, from the TCP
+//!   listener or the relay, whose peers are answered over the same
+//!   connection
 //! - Encryption/decryption via gotatun
+//! - AmneziaWG-style obfuscation of the messages (see `obfuscation`)
 //! - Dynamic peer management
+//!
+//! In kernel mode the kernel does all of this, and peer counters and key
+//! rotation are passed through to its interface.
 
-use std::collections::HashMap;
-use std::net::SocketAddr;
+use std::collections::{HashMap, VecDeque};
+use std::net::{Ipv4Addr, SocketAddr};
+use std::os::fd::{AsRawFd, RawFd};
+use std::sync::atomic::{AtomicBool, AtomicU64, AtomicUsize, Ordering};
 use std::sync::Arc;
+use std::time::{Duration, SystemTime};
 use anyhow::{Context, Result};
 use base64::Engine;
 use gotatun::noise::{Tunn, TunnResult};
 use gotatun::packet::Packet;
 use parking_lot::RwLock;
-use tokio::net::UdpSocket;
+use tokio::net::{TcpListener, UdpSocket};
 use tokio::sync::mpsc;
-use tracing::{debug, info, warn};
+use tracing::{debug, error, info, warn};
 use zerocopy::IntoBytes;
 
+use super::dataplane::WorkerQueues;
+use super::events::{self, Event};
+use super::handshake_limit::{Admission, HandshakeLimiter, HandshakeSettings};
+use super::kernel::KernelDevice;
+use super::metrics::Task;
+use super::network::Network;
+use super::obfuscation::Obfuscation;
+use super::proxy_protocol::ProxyProtocol;
 use super::state::SharedState;
+use super::wg_socket;
+use super::wg_stream;
+use super::wgconf;
 
 const MAX_PACKET: usize = 65536;
 
+/// WireGuard message type of a handshake initiation
+const HANDSHAKE_INITIATION: u8 = 1;
+
+/// WireGuard message type of transport data; keepalives are empty ones
+const TRANSPORT_DATA: u8 = 4;
+
+/// How long after its last packet a peer still counts as connected. Session
+/// keys expire after this long without a handshake, so a quieter peer would
+/// have to handshake again anyway.
+pub const LIVENESS_TIMEOUT: Duration = Duration::from_secs(180);
+
+/// Endpoints remembered per peer for its roaming history
+const ENDPOINT_HISTORY_LEN: usize = 32;
+
 /// A WireGuard peer with tunnel state
 pub struct WgPeer {
     pub tunnel: parking_lot::Mutex<Tunn>,
+    /// Tunnel under the server key being retired, kept for the grace period
+    /// after a key rotation
+    pub retiring_tunnel: parking_lot::Mutex<Option<Tunn>>,
+    /// Whether the peer has used the current server key since the last
+    /// rotation; until it has, packets to it go through the retiring tunnel
+    pub migrated: AtomicBool,
+    pub preshared_key: Option<[u8; 32]>,
     pub endpoint: RwLock<Option<SocketAddr>>,
+    /// Index of the listen address the endpoint last sent to, which
+    /// packets to the peer go out from
+    pub listener: AtomicUsize,
+    /// Endpoints the peer has used, oldest first, with when it moved to each
+    pub endpoint_history: parking_lot::Mutex<VecDeque<(SocketAddr, SystemTime)>>,
+    /// Endpoint changes since the server started, including ones that have
+    /// fallen out of the history
+    pub roams: AtomicU64,
+    pub last_handshake: RwLock<Option<SystemTime>>,
+    /// Last authenticated packet of any kind from the peer
+    pub last_receive: RwLock<Option<SystemTime>>,
+    /// Last keepalive from the peer, if it sends them
+    pub last_keepalive: RwLock<Option<SystemTime>>,
+    /// WireGuard bytes received from and sent to the peer
+    pub rx_bytes: AtomicU64,
+    pub tx_bytes: AtomicU64,
 }
 
 impl WgPeer {
-    pub fn new(server_private_key: [u8; 32], peer_public_key: [u8; 32]) -> Self {
-        let tunnel = Tunn::new(
-            server_private_key.into(),
-            peer_public_key.into(),
-            None,
-            None,
-            0,
-            None,
-        );
+    pub fn new(
+        server_private_key: [u8; 32],
+        retiring_key: Option<[u8; 32]>,
+        peer_public_key: [u8; 32],
+        preshared_key: Option<[u8; 32]>,
+    ) -> Self {
         Self {
-            tunnel: parking_lot::Mutex::new(tunnel),
+            tunnel: parking_lot::Mutex::new(new_tunnel(
+                server_private_key,
+                peer_public_key,
+                preshared_key,
+            )),
+            retiring_tunnel: parking_lot::Mutex::new(
+                retiring_key.map(|key| new_tunnel(key, peer_public_key, preshared_key)),
+            ),
+            migrated: AtomicBool::new(retiring_key.is_none()),
+            preshared_key,
             endpoint: RwLock::new(None),
+            listener: AtomicUsize::new(0),
+            endpoint_history: parking_lot::Mutex::new(VecDeque::new()),
+            roams: AtomicU64::new(0),
+            last_handshake: RwLock::new(None),
+            last_receive: RwLock::new(None),
+            last_keepalive: RwLock::new(None),
+            rx_bytes: AtomicU64::new(0),
+            tx_bytes: AtomicU64::new(0),
         }
     }
 }
 
+fn new_tunnel(
+    server_private_key: [u8; 32],
+    peer_public_key: [u8; 32],
+    preshared_key: Option<[u8; 32]>,
+) -> Tunn {
+    Tunn::new(
+        server_private_key.into(),
+        peer_public_key.into(),
+        preshared_key,
+        None,
+        0,
+        None,
+    )
+}
+
+/// What a tunnel made of an incoming packet: a reply for the peer and/or a
+/// decrypted packet for the dataplane
+type Opened = (Option<Vec<u8>>, Option<Vec<u8>>);
+
+fn open_packet(tunnel: &mut Tunn, packet_data: &[u8]) -> Option<Opened> {
+    let packet = Packet::from_bytes(bytes::BytesMut::from(packet_data));
+    let wg_packet = packet.try_into_wg().ok()?;
+    match tunnel.handle_incoming_packet(wg_packet) {
+        TunnResult::Done => Some((None, None)),
+        TunnResult::WriteToNetwork(response) => {
+            let response_packet: Packet = response.into();
+            Some((Some(response_packet.as_bytes().to_vec()), None))
+        }
+        TunnResult::WriteToTunnel(decrypted) => Some((None, Some(decrypted.as_bytes().to_vec()))),
+        TunnResult::Err(_) => None,
+    }
+}
+
+/// The server's WireGuard private keys
+struct ServerKeys {
+    current: [u8; 32],
+    current_public: [u8; 32],
+    /// Private and public key replaced by a rotation, still answered until
+    /// the given time
+    retiring: Option<([u8; 32], [u8; 32], SystemTime)>,
+}
+
+/// Point-in-time counters for a peer, as shown by `wirecagesrv status`
+#[derive(Debug, Clone)]
+pub struct PeerStats {
+    pub endpoint: Option<SocketAddr>,
+    pub last_handshake: Option<SystemTime>,
+    pub last_receive: Option<SystemTime>,
+    pub last_keepalive: Option<SystemTime>,
+    pub roams: u64,
+    pub rx_bytes: u64,
+    pub tx_bytes: u64,
+}
+
+impl PeerStats {
+    /// Whether the peer has sent anything within the liveness timeout
+    pub fn is_connected(&self) -> bool {
+        is_recent(self.last_receive)
+    }
+
+    /// Whether the peer is keeping its session alive with keepalives
+    pub fn sends_keepalives(&self) -> bool {
+        is_recent(self.last_keepalive)
+    }
+}
+
+fn is_recent(time: Option<SystemTime>) -> bool {
+    time.and_then(|time| time.elapsed().ok())
+        .is_some_and(|elapsed| elapsed < LIVENESS_TIMEOUT)
+}
+
 /// Packet from WireGuard to dataplane (decrypted)
 #[derive(Debug)]
 pub struct WgToDataplane {
@@ -54,94 +198,395 @@ pub struct WgToDataplane {
 
 /// WireGuard IO handler
 pub struct WgIo {
-    socket: Arc<UdpSocket>,
-    server_private_key: [u8; 32],
+    /// Sockets by listen address, each group sharing its address; replies
+    /// go out of the first socket of the address a peer sends to
+    listeners: Vec<Vec<Arc<UdpSocket>>>,
+    /// Whether receives may return GRO-coalesced datagrams
+    gro: bool,
+    /// Whether runs of packets to a peer go out in one GSO send; cleared if
+    /// the network device turns out not to support it
+    gso: AtomicBool,
+    keys: RwLock<ServerKeys>,
     peers: Arc<RwLock<HashMap<[u8; 32], Arc<WgPeer>>>>,
     shared_state: Arc<SharedState>,
+    /// Set on shutdown: peers without a session are refused handshakes and
+    /// the dataplane refuses new flows
+    draining: AtomicBool,
+    handshakes: HandshakeLimiter,
+    /// Kernel interface serving peers in place of the sockets, if any
+    kernel: Option<Arc<KernelDevice>>,
+    /// Queues of the stream connections attached, by the address they come
+    /// from; messages to these endpoints go to the queue, not the sockets
+    streams: RwLock<HashMap<SocketAddr, mpsc::Sender<Vec<u8>>>>,
+    obfuscation: Arc<Obfuscation>,
 }
 
 impl WgIo {
-    pub async fn new(
-        listen_addr: &str,
+    /// Serve on already-bound sockets, grouped by listen address, such as
+    /// those opened by `wg_socket::open_all`
+    pub fn from_std(
+        listeners: Vec<Vec<std::net::UdpSocket>>,
+        udp_offload: bool,
         server_private_key: [u8; 32],
         shared_state: Arc<SharedState>,
+        handshakes: HandshakeSettings,
+        obfuscation: Arc<Obfuscation>,
     ) -> Result<Self> {
-        let socket = UdpSocket::bind(listen_addr)
-            .await
-            .context("failed to bind WireGuard UDP socket")?;
-
-        info!("WireGuard listening on {}", socket.local_addr()?);
+        let listeners = listeners
+            .into_iter()
+            .map(|sockets| {
+                let sockets = sockets
+                    .into_iter()
+                    .map(|socket| UdpSocket::from_std(socket).map(Arc::new))
+                    .collect::<std::io::Result<Vec<_>>>()?;
+                if sockets.is_empty() {
+                    return Err(std::io::ErrorKind::NotFound.into());
+                }
+                Ok(sockets)
+            })
+            .collect::<std::io::Result<Vec<_>>>()
+            .context("failed to use WireGuard UDP socket")?;
+        let first = listeners
+            .first()
+            .map(|sockets| &sockets[0])
+            .context("no WireGuard UDP socket")?;
+        let all = || listeners.iter().flatten();
+        let gro = udp_offload && all().all(|socket| wg_socket::enable_gro(socket));
+        let gso = udp_offload && wg_socket::supports_gso(first);
+        for sockets in &listeners {
+            info!(
+                "WireGuard listening on {} ({} socket{}, GRO {}, GSO {})",
+                sockets[0].local_addr()?,
+                sockets.len(),
+                if sockets.len() == 1 { "" } else { "s" },
+                if gro { "on" } else { "off" },
+                if gso { "on" } else { "off" }
+            );
+        }
 
+        let handshakes = HandshakeLimiter::new(handshakes, Arc::clone(&shared_state.metrics));
         Ok(Self {
-            socket: Arc::new(socket),
-            server_private_key,
+            listeners,
+            gro,
+            gso: AtomicBool::new(gso),
+            keys: RwLock::new(ServerKeys {
+                current: server_private_key,
+                current_public: wgconf::public_key(&server_private_key),
+                retiring: None,
+            }),
             peers: Arc::new(RwLock::new(HashMap::new())),
             shared_state,
+            draining: AtomicBool::new(false),
+            handshakes,
+            kernel: None,
+            streams: RwLock::new(HashMap::new()),
+            obfuscation,
         })
     }
 
-    /// Run the receive loop - decrypts incoming WG packets and sends to dataplane
+    /// Leave WireGuard to a kernel interface, with no sockets of its own
+    pub fn kernel(
+        device: Arc<KernelDevice>,
+        server_private_key: [u8; 32],
+        shared_state: Arc<SharedState>,
+        handshakes: HandshakeSettings,
+    ) -> Self {
+        let handshakes = HandshakeLimiter::new(handshakes, Arc::clone(&shared_state.metrics));
+        Self {
+            listeners: Vec::new(),
+            gro: false,
+            gso: AtomicBool::new(false),
+            keys: RwLock::new(ServerKeys {
+                current: server_private_key,
+                current_public: wgconf::public_key(&server_private_key),
+                retiring: None,
+            }),
+            peers: Arc::new(RwLock::new(HashMap::new())),
+            shared_state,
+            draining: AtomicBool::new(false),
+            handshakes,
+            kernel: Some(device),
+            streams: RwLock::new(HashMap::new()),
+            obfuscation: Arc::default(),
+        }
+    }
+
+    /// How peers' messages are obfuscated
+    pub fn obfuscation(&self) -> &Arc<Obfuscation> {
+        &self.obfuscation
+    }
+
+    /// The socket replies and outgoing packets for the `listener`th listen
+    /// address are sent from
+    fn socket(&self, listener: usize) -> &UdpSocket {
+        let sockets = self.listeners.get(listener).unwrap_or(&self.listeners[0]);
+        &sockets[0]
+    }
+
+    /// Send a message to an endpoint, through its stream connection if it
+    /// has one and otherwise from the `listener`th listen address. A full
+    /// queue drops the message, as a full socket buffer would.
+    async fn send_to(&self, data: &[u8], addr: SocketAddr, listener: usize) -> Result<()> {
+        let stream = self.streams.read().get(&addr).cloned();
+        match stream {
+            Some(stream) => {
+                if stream.try_send(data.to_vec()).is_err() {
+                    debug!("Dropped a message to {}: stream queue full", addr);
+                }
+            }
+            None => {
+                self.socket(listener).send_to(data, addr).await?;
+            }
+        }
+        Ok(())
+    }
+
+    /// Take WireGuard messages from a stream connection from `addr`,
+    /// returning the queue of messages to send back over it
+    pub fn attach_stream(&self, addr: SocketAddr, queue_len: usize) -> mpsc::Receiver<Vec<u8>> {
+        let (tx, rx) = mpsc::channel(queue_len);
+        self.streams.write().insert(addr, tx);
+        rx
+    }
+
+    /// Forget a stream connection once it has closed
+    pub fn detach_stream(&self, addr: SocketAddr) {
+        self.streams.write().remove(&addr);
+    }
+
+    /// Handle a WireGuard message read from an attached stream connection
+    pub async fn receive_from_stream(
+        &self,
+        packet_data: &[u8],
+        addr: SocketAddr,
+        to_dataplane: &WorkerQueues,
+    ) -> Result<()> {
+        // Replies go over the connection, whatever the listener
+        self.handle_incoming(packet_data, addr, 0, to_dataplane)
+            .await
+    }
+
+    /// Run a receive loop on each socket - decrypts incoming WG packets and
+    /// sends to dataplane - and accept connections on the TCP listener, if
+    /// any, returning when any of them fails
     pub async fn run_receive(
         self: Arc<Self>,
-        to_dataplane: mpsc::Sender<WgToDataplane>,
+        to_dataplane: WorkerQueues,
+        stream_listener: Option<std::net::TcpListener>,
+        proxy_protocol: ProxyProtocol,
+    ) -> Result<()> {
+        let mut receivers = tokio::task::JoinSet::new();
+        for (listener, sockets) in self.listeners.iter().enumerate() {
+            for socket in sockets {
+                let receiver = Arc::clone(&self).receive_on(
+                    listener,
+                    Arc::clone(socket),
+                    to_dataplane.clone(),
+                );
+                receivers.spawn(receiver);
+            }
+        }
+        if let Some(listener) = stream_listener {
+            let listener =
+                TcpListener::from_std(listener).context("failed to use WireGuard TCP listener")?;
+            let accept = Arc::clone(&self).accept_streams(
+                listener,
+                Arc::new(proxy_protocol),
+                to_dataplane.clone(),
+            );
+            receivers.spawn(accept);
+        }
+        match receivers.join_next().await {
+            Some(Ok(result)) => result,
+            Some(Err(e)) => Err(e).context("WireGuard receive task panicked"),
+            None => Ok(()),
+        }
+    }
+
+    async fn receive_on(
+        self: Arc<Self>,
+        listener: usize,
+        socket: Arc<UdpSocket>,
+        to_dataplane: WorkerQueues,
     ) -> Result<()> {
-        let mut buf = vec![0u8; MAX_PACKET];
+        // Coalesced receives can hold up to 64KB of datagrams
+        let buf_len = if self.gro {
+            u16::MAX as usize
+        } else {
+            MAX_PACKET
+        };
+        let mut buf = vec![0u8; buf_len];
 
         loop {
-            let (len, addr) = self.socket.recv_from(&mut buf).await?;
-            let packet_data = &buf[..len];
+            let (len, segment_size, addr) = wg_socket::recv(&socket, &mut buf, self.gro).await?;
+            let segment_size = segment_size.unwrap_or(len).max(1);
 
-            if let Err(e) = self.handle_incoming(packet_data, addr, &to_dataplane).await {
-                debug!("Error handling incoming packet from {}: {}", addr, e);
+            for packet_data in buf[..len].chunks(segment_size) {
+                let handled = self
+                    .handle_incoming(packet_data, addr, listener, &to_dataplane)
+                    .await;
+                if let Err(e) = handled {
+                    debug!("Error handling incoming packet from {}: {}", addr, e);
+                }
             }
         }
     }
 
+    /// Accept connections carrying WireGuard over TCP, each served like
+    /// another socket
+    async fn accept_streams(
+        self: Arc<Self>,
+        listener: TcpListener,
+        proxy_protocol: Arc<ProxyProtocol>,
+        to_dataplane: WorkerQueues,
+    ) -> Result<()> {
+        info!("WireGuard also listening on TCP {}", listener.local_addr()?);
+        loop {
+            let (stream, peer) = match listener.accept().await {
+                Ok(accepted) => accepted,
+                Err(e) => {
+                    warn!("Failed to accept WireGuard TCP connection: {}", e);
+                    continue;
+                }
+            };
+            let _ = stream.set_nodelay(true);
+            let wg = Arc::clone(&self);
+            let proxy_protocol = Arc::clone(&proxy_protocol);
+            let to_dataplane = to_dataplane.clone();
+            tokio::spawn(async move {
+                let _running = wg.shared_state.metrics.running(Task::StreamConnection);
+                let served =
+                    wg_stream::serve(&wg, stream, peer, &proxy_protocol, &to_dataplane).await;
+                if let Err(e) = served {
+                    debug!("WireGuard TCP connection from {} ended: {:#}", peer, e);
+                }
+            });
+        }
+    }
+
     async fn handle_incoming(
         &self,
-        packet_data: &[u8],
+        received: &[u8],
         addr: SocketAddr,
-        to_dataplane: &mpsc::Sender<WgToDataplane>,
+        listener: usize,
+        to_dataplane: &WorkerQueues,
     ) -> Result<()> {
         // Check registered peers from shared state and ensure WgPeer exists
         self.sync_peers_from_state();
 
+        // Junk and packets in no profile's format are dropped here
+        let Some(message) = self.obfuscation.read(received) else {
+            return Ok(());
+        };
+        let params = Arc::clone(&message.params);
+
         let peer_keys: Vec<([u8; 32], Arc<WgPeer>)> = {
             let peers = self.peers.read();
             peers.iter().map(|(k, v)| (*k, Arc::clone(v))).collect()
         };
 
-        for (pubkey, peer) in peer_keys {
-            let packet = Packet::from_bytes(bytes::BytesMut::from(packet_data));
-            let wg_packet = match packet.try_into_wg() {
-                Ok(p) => p,
-                Err(_) => return Ok(()),
-            };
+        let server_keys: Vec<[u8; 32]> = if message.kind == TRANSPORT_DATA {
+            Vec::new()
+        } else {
+            let keys = self.keys.read();
+            std::iter::once(keys.current_public)
+                .chain(keys.retiring.map(|(_, public, _)| public))
+                .collect()
+        };
 
-            // Process packet under lock, extract result data before any await
-            let result = {
-                let mut tunnel = peer.tunnel.lock();
-                match tunnel.handle_incoming_packet(wg_packet) {
-                    TunnResult::Done => {
-                        *peer.endpoint.write() = Some(addr);
-                        Some((None, None)) // Done, no response needed
-                    }
-                    TunnResult::WriteToNetwork(response) => {
-                        *peer.endpoint.write() = Some(addr);
-                        let response_packet: Packet = response.into();
-                        Some((Some(response_packet.as_bytes().to_vec()), None))
-                    }
-                    TunnResult::WriteToTunnel(decrypted) => {
-                        *peer.endpoint.write() = Some(addr);
-                        Some((None, Some(decrypted.as_bytes().to_vec())))
-                    }
-                    TunnResult::Err(_) => None, // Try next peer
+        if message.kind == HANDSHAKE_INITIATION {
+            // As sent, since AmneziaWG makes the macs over its own header
+            match self.handshakes.check(message.message, addr, &server_keys) {
+                Admission::Accept => {}
+                Admission::Drop(reason) => {
+                    debug!(
+                        "Dropped handshake initiation from {} ({})",
+                        addr,
+                        reason.label()
+                    );
+                    return Ok(());
                 }
-            };
+                Admission::Cookie(mut reply) => {
+                    params.encode(&mut reply, None);
+                    self.send_to(&reply, addr, listener).await?;
+                    return Ok(());
+                }
+            }
+        }
+
+        let Some(packet_data) = message.to_wireguard(&server_keys) else {
+            debug!("Dropped a handshake message with a bad mac1 from {}", addr);
+            return Ok(());
+        };
+        let packet_data: &[u8] = &packet_data;
+        let packet = Packet::from_bytes(bytes::BytesMut::from(packet_data));
+        if packet.try_into_wg().is_err() {
+            return Ok(());
+        }
+
+        for (pubkey, peer) in peer_keys {
+            if !self.obfuscation.accepts(&pubkey, &params) {
+                continue;
+            }
+            // Process packet under lock, extract result data before any await.
+            // Peers that have not moved to a rotated key yet are answered
+            // with the retiring one.
+            let mut result = open_packet(&mut peer.tunnel.lock(), packet_data);
+            if result.is_some() {
+                if !peer.migrated.swap(true, Ordering::Relaxed) {
+                    debug!(
+                        "Peer {} moved to the current server key",
+                        events::encode_key(&pubkey)
+                    );
+                }
+            } else if let Some(tunnel) = peer.retiring_tunnel.lock().as_mut() {
+                result = open_packet(tunnel, packet_data);
+            }
+            if result.is_some() {
+                peer.listener.store(listener, Ordering::Relaxed);
+                self.note_endpoint(&pubkey, &peer, addr);
+            }
+            let was_connected = is_recent(*peer.last_receive.read());
+            if result.is_some() {
+                let now = SystemTime::now();
+                peer.rx_bytes.fetch_add(received.len() as u64, Ordering::Relaxed);
+                *peer.last_receive.write() = Some(now);
+                let empty = match &result {
+                    Some((None, None)) => true,
+                    Some((None, Some(decrypted))) => decrypted.is_empty(),
+                    _ => false,
+                };
+                if empty && packet_data.first() == Some(&TRANSPORT_DATA) {
+                    *peer.last_keepalive.write() = Some(now);
+                }
+            }
 
             match result {
-                Some((Some(response_bytes), None)) => {
-                    self.socket.send_to(&response_bytes, addr).await?;
+                Some((Some(mut response_bytes), None)) => {
+                    if self.is_draining()
+                        && !was_connected
+                        && packet_data.first() == Some(&HANDSHAKE_INITIATION)
+                    {
+                        debug!(
+                            "Refusing handshake from peer {} while draining",
+                            events::encode_key(&pubkey)
+                        );
+                        return Ok(());
+                    }
+                    params.encode(&mut response_bytes, Some(&pubkey));
+                    self.send_to(&response_bytes, addr, listener).await?;
+                    peer.tx_bytes.fetch_add(response_bytes.len() as u64, Ordering::Relaxed);
+                    if packet_data.first() == Some(&HANDSHAKE_INITIATION) {
+                        *peer.last_handshake.write() = Some(SystemTime::now());
+                        self.shared_state
+                            .metrics
+                            .handshakes
+                            .fetch_add(1, Ordering::Relaxed);
+                        self.shared_state.events.publish(Event::HandshakeCompleted {
+                            public_key: events::encode_key(&pubkey),
+                            endpoint: addr,
+                        });
+                    }
                     return Ok(());
                 }
                 Some((None, Some(decrypted_bytes))) => {
@@ -149,7 +594,7 @@ impl WgIo {
                         peer_pubkey: pubkey,
                         ip_packet: decrypted_bytes,
                     };
-                    if to_dataplane.send(msg).await.is_err() {
+                    if to_dataplane.for_peer(&pubkey).send(msg).await.is_err() {
                         warn!("Dataplane channel closed");
                     }
                     return Ok(());
@@ -166,14 +611,56 @@ impl WgIo {
         Ok(())
     }
 
+    /// Record where a peer's packets come from, announcing roams
+    fn note_endpoint(&self, pubkey: &[u8; 32], peer: &WgPeer, addr: SocketAddr) {
+        let previous = peer.endpoint.write().replace(addr);
+        if previous != Some(addr) {
+            let mut history = peer.endpoint_history.lock();
+            if history.len() == ENDPOINT_HISTORY_LEN {
+                history.pop_front();
+            }
+            history.push_back((addr, SystemTime::now()));
+            drop(history);
+            if previous.is_some() {
+                peer.roams.fetch_add(1, Ordering::Relaxed);
+            }
+            self.shared_state.events.publish(Event::EndpointChanged {
+                public_key: events::encode_key(pubkey),
+                previous,
+                endpoint: addr,
+            });
+        }
+    }
+
     /// Sync peers from shared state registry
     fn sync_peers_from_state(&self) {
+        self.drop_expired_key();
+        let keys = self.keys.read();
+        let retiring_key = keys.retiring.map(|(key, _, _)| key);
         let state_peers = self.shared_state.peers.read();
         let mut wg_peers = self.peers.write();
 
+        // Peers whose preshared key changed are dropped too and rebuilt
+        // below, which starts a fresh handshake with the new key
+        wg_peers.retain(|pubkey, peer| match state_peers.get_by_pubkey(pubkey) {
+            Some(info) => info.preshared_key == peer.preshared_key,
+            None => {
+                info!(
+                    "Dropped removed peer: {}",
+                    base64::engine::general_purpose::STANDARD.encode(pubkey)
+                );
+                false
+            }
+        });
+
         for peer_info in state_peers.iter() {
             if !wg_peers.contains_key(&peer_info.public_key) {
-                let peer = Arc::new(WgPeer::new(self.server_private_key, peer_info.public_key));
+                let peer = Arc::new(WgPeer::new(
+                    keys.current,
+                    retiring_key,
+                    peer_info.public_key,
+                    peer_info.preshared_key,
+                ));
                 wg_peers.insert(peer_info.public_key, peer);
                 info!(
                     "Synced new peer: {}",
@@ -183,30 +670,269 @@ impl WgIo {
         }
     }
 
+    pub fn server_private_key(&self) -> [u8; 32] {
+        self.keys.read().current
+    }
+
+    /// The public key being retired after a rotation and when it stops
+    /// being answered
+    pub fn retiring_key(&self) -> Option<([u8; 32], SystemTime)> {
+        self.keys
+            .read()
+            .retiring
+            .map(|(_, public, until)| (public, until))
+    }
+
+    /// Switch to a new private key, answering handshakes made with the
+    /// current one as well until `retire_at`. A key still being retired
+    /// from an earlier rotation is dropped along with its sessions.
+    pub fn rotate_key(&self, private_key: [u8; 32], retire_at: SystemTime) -> SystemTime {
+        if let Some(kernel) = &self.kernel {
+            return self.rotate_kernel_key(kernel, private_key);
+        }
+        let mut keys = self.keys.write();
+        let public_key = wgconf::public_key(&private_key);
+        let previous = std::mem::replace(&mut keys.current, private_key);
+        let previous_public = std::mem::replace(&mut keys.current_public, public_key);
+        keys.retiring = Some((previous, previous_public, retire_at));
+        for (pubkey, peer) in self.peers.read().iter() {
+            let mut tunnel = peer.tunnel.lock();
+            let fresh = new_tunnel(private_key, *pubkey, peer.preshared_key);
+            *peer.retiring_tunnel.lock() = Some(std::mem::replace(&mut *tunnel, fresh));
+            peer.migrated.store(false, Ordering::Relaxed);
+        }
+        drop(keys);
+        self.shared_state.set_server_public_key(public_key);
+        retire_at
+    }
+
+    /// Switch the kernel interface to a new key at once; it holds only one,
+    /// so there is no grace period for the old key
+    fn rotate_kernel_key(&self, kernel: &KernelDevice, private_key: [u8; 32]) -> SystemTime {
+        if let Err(e) = kernel.set_private_key(&private_key) {
+            error!("{:#}", e);
+            return SystemTime::now();
+        }
+        warn!("Kernel WireGuard has no grace period; peers must switch to the new key now");
+        let public_key = wgconf::public_key(&private_key);
+        let mut keys = self.keys.write();
+        keys.current = private_key;
+        keys.current_public = public_key;
+        keys.retiring = None;
+        drop(keys);
+        self.shared_state.set_server_public_key(public_key);
+        SystemTime::now()
+    }
+
+    /// Stop answering the retiring key once its grace period is over
+    fn drop_expired_key(&self) {
+        let expired = |keys: &ServerKeys| {
+            keys.retiring
+                .is_some_and(|(_, _, until)| until <= SystemTime::now())
+        };
+        if !expired(&self.keys.read()) {
+            return;
+        }
+        let mut keys = self.keys.write();
+        if !expired(&keys) {
+            return;
+        }
+        keys.retiring = None;
+        for peer in self.peers.read().values() {
+            *peer.retiring_tunnel.lock() = None;
+            peer.migrated.store(true, Ordering::Relaxed);
+        }
+        info!("Retired the previous server key");
+    }
+
+    /// Address the WireGuard sockets are bound to, the first one given if
+    /// there are several
+    pub fn local_addr(&self) -> Option<SocketAddr> {
+        self.local_addrs().into_iter().next()
+    }
+
+    /// Every listen address, in the order given
+    pub fn local_addrs(&self) -> Vec<SocketAddr> {
+        if let Some(kernel) = &self.kernel {
+            return vec![kernel.listen_addr()];
+        }
+        self.listeners
+            .iter()
+            .filter_map(|sockets| sockets[0].local_addr().ok())
+            .collect()
+    }
+
+    /// The WireGuard sockets' file descriptors, for handing to a successor
+    pub fn socket_fds(&self) -> Vec<RawFd> {
+        self.listeners
+            .iter()
+            .flatten()
+            .map(|socket| socket.as_raw_fd())
+            .collect()
+    }
+
+    /// Stop taking on new peers and flows ahead of shutdown
+    pub fn start_draining(&self) {
+        self.draining.store(true, Ordering::Relaxed);
+    }
+
+    pub fn is_draining(&self) -> bool {
+        self.draining.load(Ordering::Relaxed)
+    }
+
+    /// Whether handshake initiations are arriving faster than the load
+    /// threshold
+    pub fn handshakes_under_load(&self) -> bool {
+        self.handshakes.is_under_load()
+    }
+
+    /// Endpoint, handshake and transfer counters for a peer
+    pub fn peer_stats(&self, peer_pubkey: &[u8; 32]) -> Option<PeerStats> {
+        if let Some(kernel) = &self.kernel {
+            return kernel.peer_stats(peer_pubkey);
+        }
+        let peers = self.peers.read();
+        let peer = peers.get(peer_pubkey)?;
+        Some(PeerStats {
+            endpoint: *peer.endpoint.read(),
+            last_handshake: *peer.last_handshake.read(),
+            last_receive: *peer.last_receive.read(),
+            last_keepalive: *peer.last_keepalive.read(),
+            roams: peer.roams.load(Ordering::Relaxed),
+            rx_bytes: peer.rx_bytes.load(Ordering::Relaxed),
+            tx_bytes: peer.tx_bytes.load(Ordering::Relaxed),
+        })
+    }
+
+    /// Endpoints a peer has roamed through, oldest first, with the time it
+    /// was first seen at each
+    pub fn endpoint_history(&self, peer_pubkey: &[u8; 32]) -> Option<Vec<(SocketAddr, SystemTime)>> {
+        if let Some(kernel) = &self.kernel {
+            // The kernel only reports the current endpoint
+            let stats = kernel.peer_stats(peer_pubkey)?;
+            let seen = stats.last_handshake.unwrap_or_else(SystemTime::now);
+            let current = stats.endpoint.map(|endpoint| (endpoint, seen));
+            return Some(current.into_iter().collect());
+        }
+        let peers = self.peers.read();
+        let peer = peers.get(peer_pubkey)?;
+        let history = peer.endpoint_history.lock().iter().copied().collect();
+        Some(history)
+    }
+
+    /// The registered peer assigned `ip`
+    pub fn peer_for_ip(&self, ip: &Ipv4Addr) -> Option<[u8; 32]> {
+        self.shared_state
+            .peers
+            .read()
+            .get_by_ip(ip)
+            .map(|peer| peer.public_key)
+    }
+
+    /// Registered peers with addresses in `network` and an endpoint to
+    /// send to
+    pub fn peers_in(&self, network: &Network) -> Vec<[u8; 32]> {
+        let members: Vec<[u8; 32]> = self
+            .shared_state
+            .peers
+            .read()
+            .iter()
+            .filter(|peer| network.contains(peer.assigned_ip))
+            .map(|peer| peer.public_key)
+            .collect();
+        let peers = self.peers.read();
+        members
+            .into_iter()
+            .filter(|key| {
+                peers
+                    .get(key)
+                    .is_some_and(|peer| peer.endpoint.read().is_some())
+            })
+            .collect()
+    }
+
     /// Send an encrypted packet to a peer
     pub async fn send_to_peer(&self, peer_pubkey: &[u8; 32], ip_packet: &[u8]) -> Result<()> {
+        self.send_batch_to_peer(peer_pubkey, &[ip_packet]).await
+    }
+
+    /// Encrypt and send packets to a peer, in as few GSO sends as the
+    /// kernel allows
+    pub async fn send_batch_to_peer(
+        &self,
+        peer_pubkey: &[u8; 32],
+        ip_packets: &[&[u8]],
+    ) -> Result<()> {
+        let params = self.obfuscation.params(peer_pubkey);
         // Get peer and extract what we need before any await
-        let (endpoint, encrypted_packet) = {
+        let (peer, endpoint, encrypted) = {
             let peers = self.peers.read();
-            let peer = peers.get(peer_pubkey).context("peer not found")?;
+            let peer = Arc::clone(peers.get(peer_pubkey).context("peer not found")?);
 
             let endpoint = peer.endpoint.read().context("peer has no endpoint")?;
 
-            let packet = Packet::from_bytes(bytes::BytesMut::from(ip_packet));
-            let mut tunnel = peer.tunnel.lock();
-
-            let encrypted = if let Some(wg_packet) = tunnel.handle_outgoing_packet(packet) {
-                let out_packet: Packet = wg_packet.into();
-                Some(out_packet.as_bytes().to_vec())
-            } else {
-                None
+            let mut current = peer.tunnel.lock();
+            let mut retiring = peer.retiring_tunnel.lock();
+            let tunnel = match retiring.as_mut() {
+                Some(retiring) if !peer.migrated.load(Ordering::Relaxed) => retiring,
+                _ => &mut *current,
             };
 
-            (endpoint, encrypted)
+            let mut encrypted = Vec::with_capacity(ip_packets.len());
+            for ip_packet in ip_packets {
+                let packet = Packet::from_bytes(bytes::BytesMut::from(*ip_packet));
+                if let Some(wg_packet) = tunnel.handle_outgoing_packet(packet) {
+                    let out_packet: Packet = wg_packet.into();
+                    let mut data = out_packet.as_bytes().to_vec();
+                    params.encode(&mut data, Some(peer_pubkey));
+                    encrypted.push(data);
+                }
+            }
+
+            drop(retiring);
+            drop(current);
+            (peer, endpoint, encrypted)
         };
 
-        if let Some(data) = encrypted_packet {
-            self.socket.send_to(&data, endpoint).await?;
+        let stream = self.streams.read().get(&endpoint).cloned();
+        if let Some(stream) = stream {
+            for data in encrypted {
+                let len = data.len();
+                if stream.try_send(data).is_err() {
+                    debug!("Dropped a message to {}: stream queue full", endpoint);
+                    continue;
+                }
+                peer.tx_bytes.fetch_add(len as u64, Ordering::Relaxed);
+            }
+            return Ok(());
+        }
+
+        let socket = self.socket(peer.listener.load(Ordering::Relaxed));
+        for run in wg_socket::gso_runs(&encrypted) {
+            let packets = &encrypted[run];
+            if packets.len() > 1 && self.gso.load(Ordering::Relaxed) {
+                let segment_size = packets[0].len() as u16;
+                match wg_socket::send_segments(socket, &packets.concat(), segment_size, endpoint)
+                    .await
+                {
+                    Ok(()) => {
+                        let sent: usize = packets.iter().map(Vec::len).sum();
+                        peer.tx_bytes.fetch_add(sent as u64, Ordering::Relaxed);
+                        continue;
+                    }
+                    // The device cannot checksum segments for us
+                    Err(e) if e.raw_os_error() == Some(libc::EIO) => {
+                        warn!("Turning off UDP GSO, the network device does not support it");
+                        self.gso.store(false, Ordering::Relaxed);
+                    }
+                    Err(e) => return Err(e.into()),
+                }
+            }
+            for data in packets {
+                socket.send_to(data, endpoint).await?;
+                peer.tx_bytes
+                    .fetch_add(data.len() as u64, Ordering::Relaxed);
+            }
         }
 
         Ok(())
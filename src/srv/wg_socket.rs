@@ -0,0 +1,281 @@
+//! WireGuard UDP sockets and kernel offloads
+//!
+//! One socket and one receive loop top out well below what the dataplane
+//! can forward, so the server can:
+//! - open `--wg-sockets` sockets on the same address with `SO_REUSEPORT`,
+//!   each with its own receive task; the kernel spreads peers across them
+//!   by source address
+//! - turn on UDP GRO, so one `recvmsg` returns a run of datagrams from the
+//!   same sender coalesced into one buffer
+//! - send runs of encrypted packets to a peer with UDP GSO, as one
+//!   `sendmsg` the kernel splits into datagrams
+//!
+//! Offloads are on unless `--udp-offload=false`, and left off on kernels
+//! without them. Each `--wg-listen` address gets its own sockets; bare
+//! ports bind to `--listen-addr`, and IPv6 ones are dual-stack unless
+//! `--ipv6-only`, whatever the host's default. Sockets
+//! passed in by systemd or a previous server are used as they are, in place
+//! of the listen addresses; more are only opened next to them if they were
+//! bound with `SO_REUSEPORT`.
+
+use std::io::{self, IoSlice, IoSliceMut};
+use std::net::{IpAddr, SocketAddr, TcpListener, ToSocketAddrs, UdpSocket};
+use std::ops::Range;
+use std::os::fd::{AsRawFd, OwnedFd};
+
+use anyhow::{Context, Result};
+use nix::sys::socket::{
+    bind, getsockopt, listen, recvmsg, sendmsg, setsockopt, socket, sockopt, AddressFamily,
+    Backlog, ControlMessage, ControlMessageOwned, MsgFlags, SockFlag, SockType, SockaddrLike,
+    SockaddrStorage,
+};
+use tokio::io::Interest;
+use tracing::{debug, warn};
+
+/// Most sockets served on at once
+pub const MAX_SOCKETS: usize = 8;
+
+/// Most segments the kernel accepts in one GSO send
+const GSO_MAX_SEGMENTS: usize = 64;
+
+/// Most bytes sent in one GSO send, leaving room for the UDP and IP headers
+const GSO_MAX_BYTES: usize = 65000;
+
+/// Where each `--wg-listen` entry binds: its own address and port, or for a
+/// bare port, that port on `listen_ip`
+pub fn resolve(entries: &[String], listen_ip: IpAddr) -> Result<Vec<SocketAddr>> {
+    entries
+        .iter()
+        .map(|entry| {
+            if let Ok(port) = entry.parse::<u16>() {
+                return Ok(SocketAddr::new(listen_ip, port));
+            }
+            entry
+                .to_socket_addrs()
+                .with_context(|| format!("invalid WireGuard listen address {}", entry))?
+                .next()
+                .with_context(|| format!("{} did not resolve to an address", entry))
+        })
+        .collect()
+}
+
+/// The WireGuard sockets to serve on, grouped by address: those passed in,
+/// each address's topped up to `count`, or else `count` newly bound to each
+/// of `listen_addrs`
+pub fn open_all(
+    listen_addrs: &[SocketAddr],
+    ipv6_only: bool,
+    passed: Vec<UdpSocket>,
+    count: usize,
+) -> Result<Vec<Vec<UdpSocket>>> {
+    if passed.is_empty() {
+        return listen_addrs
+            .iter()
+            .map(|addr| bind_all(*addr, ipv6_only, count))
+            .collect();
+    }
+    let mut groups: Vec<(Option<SocketAddr>, Vec<UdpSocket>)> = Vec::new();
+    for socket in passed {
+        let addr = socket.local_addr().ok();
+        match groups.iter_mut().find(|(group, _)| *group == addr) {
+            Some((_, sockets)) => sockets.push(socket),
+            None => groups.push((addr, vec![socket])),
+        }
+    }
+    groups
+        .into_iter()
+        .map(|(_, sockets)| top_up(sockets, count))
+        .collect()
+}
+
+/// `count` sockets newly bound to `addr`, sharing it with `SO_REUSEPORT`
+/// if there are several
+fn bind_all(addr: SocketAddr, ipv6_only: bool, count: usize) -> Result<Vec<UdpSocket>> {
+    (0..count)
+        .map(|_| {
+            let fd = bind_socket(addr, SockType::Datagram, count > 1, ipv6_only)
+                .context("failed to bind WireGuard UDP socket")?;
+            Ok(UdpSocket::from(fd))
+        })
+        .collect()
+}
+
+/// Sockets passed in, topped up to `count` with `SO_REUSEPORT` sockets on
+/// the same address
+fn top_up(mut sockets: Vec<UdpSocket>, count: usize) -> Result<Vec<UdpSocket>> {
+    let addr = sockets[0]
+        .local_addr()
+        .context("failed to read WireGuard socket address")?;
+    // Match however the socket passed in was bound
+    let ipv6_only = addr.is_ipv6() && getsockopt(&sockets[0], sockopt::Ipv6V6Only).unwrap_or(false);
+    while sockets.len() < count {
+        match bind_socket(addr, SockType::Datagram, true, ipv6_only) {
+            Ok(fd) => sockets.push(UdpSocket::from(fd)),
+            Err(e) => {
+                warn!(
+                    "Serving WireGuard on {} passed-in socket(s) only; bind them with \
+                     SO_REUSEPORT (ReusePort=yes) to open more: {:#}",
+                    sockets.len(),
+                    e
+                );
+                break;
+            }
+        }
+    }
+    Ok(sockets)
+}
+
+/// Bind the WireGuard TCP listener to `addr`
+pub fn bind_tcp(addr: SocketAddr, ipv6_only: bool) -> Result<TcpListener> {
+    let fd = bind_socket(addr, SockType::Stream, false, ipv6_only)?;
+    listen(&fd, Backlog::MAXCONN).with_context(|| format!("failed to listen on {}", addr))?;
+    Ok(TcpListener::from(fd))
+}
+
+/// A non-blocking socket bound to `addr`. IPv6 sockets are made IPv6-only
+/// or dual-stack as asked rather than left to the `bindv6only` sysctl.
+fn bind_socket(
+    addr: SocketAddr,
+    kind: SockType,
+    reuseport: bool,
+    ipv6_only: bool,
+) -> Result<OwnedFd> {
+    let family = match addr {
+        SocketAddr::V4(_) => AddressFamily::Inet,
+        SocketAddr::V6(_) => AddressFamily::Inet6,
+    };
+    let fd = socket(
+        family,
+        kind,
+        SockFlag::SOCK_NONBLOCK | SockFlag::SOCK_CLOEXEC,
+        None,
+    )
+    .context("failed to create socket")?;
+    if kind == SockType::Stream {
+        setsockopt(&fd, sockopt::ReuseAddr, &true).context("failed to set SO_REUSEADDR")?;
+    }
+    if reuseport {
+        setsockopt(&fd, sockopt::ReusePort, &true).context("failed to set SO_REUSEPORT")?;
+    }
+    if addr.is_ipv6() {
+        setsockopt(&fd, sockopt::Ipv6V6Only, &ipv6_only).context("failed to set IPV6_V6ONLY")?;
+    }
+    bind(fd.as_raw_fd(), &SockaddrStorage::from(addr))
+        .with_context(|| format!("failed to bind {}", addr))?;
+    Ok(fd)
+}
+
+/// Turn on UDP GRO, returning whether the kernel supports it
+pub fn enable_gro(socket: &tokio::net::UdpSocket) -> bool {
+    match setsockopt(socket, sockopt::UdpGroSegment, &true) {
+        Ok(()) => true,
+        Err(e) => {
+            debug!("UDP GRO unavailable: {}", e);
+            false
+        }
+    }
+}
+
+/// Whether the kernel can send with UDP GSO on this socket
+pub fn supports_gso(socket: &tokio::net::UdpSocket) -> bool {
+    match getsockopt(socket, sockopt::UdpGsoSegment) {
+        Ok(_) => true,
+        Err(e) => {
+            debug!("UDP GSO unavailable: {}", e);
+            false
+        }
+    }
+}
+
+/// Receive into `buf` a datagram or, with GRO on, a run of datagrams from
+/// one sender. Returns the length, the size of each datagram in a
+/// coalesced run (the last may be shorter), and the sender.
+pub async fn recv(
+    socket: &tokio::net::UdpSocket,
+    buf: &mut [u8],
+    gro: bool,
+) -> io::Result<(usize, Option<usize>, SocketAddr)> {
+    if !gro {
+        let (len, addr) = socket.recv_from(buf).await?;
+        return Ok((len, None, addr));
+    }
+    socket
+        .async_io(Interest::READABLE, || {
+            let mut iov = [IoSliceMut::new(&mut *buf)];
+            let mut cmsg = nix::cmsg_space!(libc::c_int);
+            let msg = recvmsg::<SockaddrStorage>(
+                socket.as_raw_fd(),
+                &mut iov,
+                Some(&mut cmsg),
+                MsgFlags::empty(),
+            )?;
+            let mut segment_size = None;
+            for cmsg in msg.cmsgs()? {
+                if let ControlMessageOwned::UdpGroSegments(size) = cmsg {
+                    segment_size = Some(size as usize);
+                }
+            }
+            let addr = msg.address.as_ref().and_then(to_std).ok_or_else(|| {
+                io::Error::new(io::ErrorKind::InvalidData, "datagram without a sender")
+            })?;
+            Ok((msg.bytes, segment_size, addr))
+        })
+        .await
+}
+
+/// Send `buf` to `addr` as datagrams of `segment_size` bytes, the last
+/// possibly shorter, in one GSO send
+pub async fn send_segments(
+    socket: &tokio::net::UdpSocket,
+    buf: &[u8],
+    segment_size: u16,
+    addr: SocketAddr,
+) -> io::Result<()> {
+    let addr = SockaddrStorage::from(addr);
+    socket
+        .async_io(Interest::WRITABLE, || {
+            sendmsg(
+                socket.as_raw_fd(),
+                &[IoSlice::new(buf)],
+                &[ControlMessage::UdpGsoSegments(&segment_size)],
+                MsgFlags::empty(),
+                Some(&addr),
+            )?;
+            Ok(())
+        })
+        .await
+}
+
+/// Split packets into runs that can each go out in one GSO send: all the
+/// same size except a shorter last one, within the kernel's limits
+pub fn gso_runs(packets: &[Vec<u8>]) -> Vec<Range<usize>> {
+    let mut runs = Vec::new();
+    let mut start = 0;
+    while start < packets.len() {
+        let size = packets[start].len();
+        let mut total = size;
+        let mut end = start + 1;
+        while end < packets.len()
+            && end - start < GSO_MAX_SEGMENTS
+            && packets[end].len() <= size
+            && total + packets[end].len() <= GSO_MAX_BYTES
+        {
+            total += packets[end].len();
+            end += 1;
+            if packets[end - 1].len() < size {
+                break;
+            }
+        }
+        runs.push(start..end);
+        start = end;
+    }
+    runs
+}
+
+fn to_std(addr: &SockaddrStorage) -> Option<SocketAddr> {
+    if let Some(addr) = addr.as_sockaddr_in() {
+        return Some(SocketAddr::V4((*addr).into()));
+    }
+    addr.as_sockaddr_in6()
+        .map(|addr| SocketAddr::V6((*addr).into()))
+}
@@ -0,0 +1,192 @@
+//! WireGuard over TCP
+//!
+//! With `--wg-tcp` the server listens on TCP at the WireGuard address and
+//! port as well, for networks that let TCP out but not UDP. A connection
+//! carries WireGuard messages either each prefixed with its length as a
+//! 16-bit big-endian number, the framing of Mullvad's `udp2tcp`, or as
+//! binary WebSocket messages, one each, like the [relay](super::relay);
+//! connections opening with an HTTP request get the WebSocket. Either way
+//! the listener is one more way into [`WgIo`] beside its UDP sockets:
+//! messages are handled like datagrams from the connection's address, and
+//! the peer is answered over the connection for as long as it stays there.
+
+use std::io;
+use std::net::SocketAddr;
+use std::time::Duration;
+
+use anyhow::{Context, Result};
+use bytes::{Buf, BytesMut};
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt};
+use tokio::net::TcpStream;
+use tokio::sync::mpsc;
+use tracing::debug;
+
+use super::dataplane::WorkerQueues;
+use super::proxy_protocol::ProxyProtocol;
+use super::websocket::{self, Message};
+use super::wg::WgIo;
+
+/// How long a new connection has to show which framing it uses
+const HANDSHAKE_TIMEOUT: Duration = Duration::from_secs(10);
+/// Longest WebSocket message accepted; length-prefixed ones can't exceed
+/// 64KB either
+pub const MAX_MESSAGE_LEN: usize = 65536;
+/// Messages queued for a connection before more are dropped
+const SEND_QUEUE_LEN: usize = 256;
+/// Pings queued to answer before more are ignored
+const PONG_QUEUE_LEN: usize = 4;
+
+/// Serve a connection from `peer` accepted on the WireGuard TCP listener
+pub async fn serve(
+    wg: &WgIo,
+    mut stream: TcpStream,
+    peer: SocketAddr,
+    proxy_protocol: &ProxyProtocol,
+    to_dataplane: &WorkerQueues,
+) -> Result<()> {
+    let addr = tokio::time::timeout(
+        HANDSHAKE_TIMEOUT,
+        proxy_protocol.client_addr(&mut stream, peer),
+    )
+    .await
+    .context("timed out waiting for the PROXY protocol header")?
+    .context("failed to read PROXY protocol header")?;
+    let (mut reader, mut writer) = stream.into_split();
+    let mut buf = BytesMut::new();
+    tokio::time::timeout(HANDSHAKE_TIMEOUT, async {
+        while buf.len() < 4 {
+            if reader.read_buf(&mut buf).await? == 0 {
+                return Err(io::Error::from(io::ErrorKind::UnexpectedEof));
+            }
+        }
+        Ok(())
+    })
+    .await
+    .context("timed out waiting for the first message")??;
+
+    if !buf.starts_with(b"GET ") {
+        return carry_framed(wg, addr, reader, buf, writer, to_dataplane)
+            .await
+            .context("WireGuard TCP connection failed");
+    }
+    let request = tokio::time::timeout(
+        HANDSHAKE_TIMEOUT,
+        websocket::read_request(&mut reader, &mut buf),
+    )
+    .await
+    .context("WebSocket handshake timed out")?
+    .context("failed to read WebSocket handshake")?;
+    if !request.is_upgrade() {
+        websocket::reject(&mut writer, "426 Upgrade Required").await?;
+        anyhow::bail!("not a WebSocket handshake");
+    }
+    websocket::accept(&mut writer, &request).await?;
+    let messages = websocket::Reader::new(reader, buf, MAX_MESSAGE_LEN);
+    carry_websocket(wg, addr, messages, writer, to_dataplane)
+        .await
+        .context("WireGuard WebSocket connection failed")
+}
+
+/// Carry WireGuard messages over an open WebSocket from `addr` until
+/// either side closes it
+pub async fn carry_websocket<R, W>(
+    wg: &WgIo,
+    addr: SocketAddr,
+    mut messages: websocket::Reader<R>,
+    mut writer: W,
+    to_dataplane: &WorkerQueues,
+) -> io::Result<()>
+where
+    R: AsyncRead + Unpin,
+    W: AsyncWrite + Unpin,
+{
+    let mut outgoing = wg.attach_stream(addr, SEND_QUEUE_LEN);
+    let (pong_tx, mut pong_rx) = mpsc::channel(PONG_QUEUE_LEN);
+    let send = async {
+        loop {
+            let (opcode, payload) = tokio::select! {
+                Some(message) = outgoing.recv() => (websocket::OP_BINARY, message),
+                Some(ping) = pong_rx.recv() => (websocket::OP_PONG, ping),
+                else => return Ok::<_, io::Error>(()),
+            };
+            websocket::write_frame(&mut writer, opcode, &payload).await?;
+        }
+    };
+    let receive = async {
+        while let Some(message) = messages.next().await? {
+            match message {
+                Message::Binary(packet) => deliver(wg, &packet, addr, to_dataplane).await,
+                Message::Ping(data) => {
+                    let _ = pong_tx.try_send(data);
+                }
+            }
+        }
+        Ok::<_, io::Error>(())
+    };
+    let result = tokio::select! {
+        result = send => result,
+        result = receive => result,
+    };
+    wg.detach_stream(addr);
+    result
+}
+
+/// Carry length-prefixed WireGuard messages over a connection from `addr`,
+/// starting with any already read into `buf`, until either side closes it
+async fn carry_framed<R, W>(
+    wg: &WgIo,
+    addr: SocketAddr,
+    mut reader: R,
+    mut buf: BytesMut,
+    mut writer: W,
+    to_dataplane: &WorkerQueues,
+) -> io::Result<()>
+where
+    R: AsyncRead + Unpin,
+    W: AsyncWrite + Unpin,
+{
+    let mut outgoing = wg.attach_stream(addr, SEND_QUEUE_LEN);
+    let send = async {
+        while let Some(message) = outgoing.recv().await {
+            let Ok(len) = u16::try_from(message.len()) else {
+                continue;
+            };
+            let mut frame = Vec::with_capacity(2 + message.len());
+            frame.extend_from_slice(&len.to_be_bytes());
+            frame.extend_from_slice(&message);
+            writer.write_all(&frame).await?;
+            writer.flush().await?;
+        }
+        Ok::<_, io::Error>(())
+    };
+    let receive = async {
+        loop {
+            let complete = match buf.get(..2) {
+                Some(len) => buf.len() >= 2 + usize::from(u16::from_be_bytes([len[0], len[1]])),
+                None => false,
+            };
+            if !complete {
+                if reader.read_buf(&mut buf).await? == 0 {
+                    return Ok::<_, io::Error>(());
+                }
+                continue;
+            }
+            let len = usize::from(buf.get_u16());
+            let packet = buf.split_to(len);
+            deliver(wg, &packet, addr, to_dataplane).await;
+        }
+    };
+    let result = tokio::select! {
+        result = send => result,
+        result = receive => result,
+    };
+    wg.detach_stream(addr);
+    result
+}
+
+/// Hand a message read from a connection to WireGuard
+async fn deliver(wg: &WgIo, packet: &[u8], addr: SocketAddr, to_dataplane: &WorkerQueues) {
+    if let Err(e) = wg.receive_from_stream(packet, addr, to_dataplane).await {
+        debug!("Error handling packet from {} over TCP: {}", addr, e);
+    }
+}
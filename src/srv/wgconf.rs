@@ -0,0 +1,321 @@
+//! WireGuard configuration files
+//!
+//! Renders wg-quick configs that let standard WireGuard clients (wg-quick,
+//! the mobile apps) join using a keypair the server generated for them, and
+//! the server's own state in `wg showconf` format for moving to or comparing
+//! with kernel WireGuard. Existing server configs in the same format can be
+//! read back in. Peers given obfuscation parameters get them in AmneziaWG's
+//! format.
+
+use std::fmt::Write;
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr, SocketAddr};
+
+use anyhow::{Context, Result};
+use base64::Engine;
+use rand::RngCore;
+use x25519_dalek::{PublicKey, StaticSecret};
+
+use super::obfuscation::Params;
+
+/// Keepalive suggested to clients, since they are usually behind NAT
+const PERSISTENT_KEEPALIVE_SECS: u32 = 25;
+
+/// A freshly generated client keypair
+pub struct GeneratedKey {
+    pub private_key: [u8; 32],
+    pub public_key: [u8; 32],
+}
+
+pub fn generate_key() -> GeneratedKey {
+    let secret = StaticSecret::random_from_rng(rand::thread_rng());
+    let public = PublicKey::from(&secret);
+    GeneratedKey {
+        private_key: secret.to_bytes(),
+        public_key: *public.as_bytes(),
+    }
+}
+
+/// The public key belonging to a private key
+pub fn public_key(private_key: &[u8; 32]) -> [u8; 32] {
+    *PublicKey::from(&StaticSecret::from(*private_key)).as_bytes()
+}
+
+/// A random preshared key for a peer
+pub fn generate_preshared_key() -> [u8; 32] {
+    let mut key = [0u8; 32];
+    rand::thread_rng().fill_bytes(&mut key);
+    key
+}
+
+/// Everything needed to write a client's wg-quick config
+pub struct ClientConf<'a> {
+    pub private_key: &'a [u8; 32],
+    pub address: Ipv4Addr,
+    pub prefix_len: u8,
+    /// IPv6 address and prefix length, if the server gives peers one
+    pub address6: Option<(Ipv6Addr, u8)>,
+    /// Give the peer only its IPv6 address and route only IPv6
+    pub ipv6_only: bool,
+    pub dns: IpAddr,
+    pub server_public_key: &'a [u8; 32],
+    pub server_endpoint: &'a str,
+    pub preshared_key: Option<&'a [u8; 32]>,
+    /// AmneziaWG parameters, for peers that are not plain WireGuard
+    pub obfuscation: Option<&'a Params>,
+}
+
+impl ClientConf<'_> {
+    /// Render as a wg-quick `.conf` routing all IPv4 traffic, and all IPv6
+    /// traffic when the peer has an IPv6 address, through the server; an
+    /// IPv6-only peer gets no IPv4 address or route
+    pub fn render(&self) -> String {
+        let b64 = &base64::engine::general_purpose::STANDARD;
+        let mut conf = String::new();
+        let _ = writeln!(conf, "[Interface]");
+        let _ = writeln!(conf, "PrivateKey = {}", b64.encode(self.private_key));
+        match self.address6 {
+            Some((address6, prefix_len6)) if self.ipv6_only => {
+                let _ = writeln!(conf, "Address = {}/{}", address6, prefix_len6);
+            }
+            Some((address6, prefix_len6)) => {
+                let _ = writeln!(
+                    conf,
+                    "Address = {}/{}, {}/{}",
+                    self.address, self.prefix_len, address6, prefix_len6
+                );
+            }
+            None => {
+                let _ = writeln!(conf, "Address = {}/{}", self.address, self.prefix_len);
+            }
+        }
+        let _ = writeln!(conf, "DNS = {}", self.dns);
+        if let Some(params) = self.obfuscation {
+            let _ = writeln!(conf, "Jc = {}", params.junk_count);
+            let _ = writeln!(conf, "Jmin = {}", params.junk_min);
+            let _ = writeln!(conf, "Jmax = {}", params.junk_max);
+            let _ = writeln!(conf, "S1 = {}", params.initiation_padding);
+            let _ = writeln!(conf, "S2 = {}", params.response_padding);
+            for (i, header) in params.headers.iter().enumerate() {
+                let _ = writeln!(conf, "H{} = {}", i + 1, header);
+            }
+        }
+        let _ = writeln!(conf);
+        let _ = writeln!(conf, "[Peer]");
+        let _ = writeln!(conf, "PublicKey = {}", b64.encode(self.server_public_key));
+        if let Some(preshared_key) = self.preshared_key {
+            let _ = writeln!(conf, "PresharedKey = {}", b64.encode(preshared_key));
+        }
+        let _ = writeln!(conf, "Endpoint = {}", self.server_endpoint);
+        let allowed_ips = match self.address6 {
+            Some(_) if self.ipv6_only => "::/0",
+            Some(_) => "0.0.0.0/0, ::/0",
+            None => "0.0.0.0/0",
+        };
+        let _ = writeln!(conf, "AllowedIPs = {}", allowed_ips);
+        let _ = writeln!(conf, "PersistentKeepalive = {}", PERSISTENT_KEEPALIVE_SECS);
+        conf
+    }
+}
+
+/// A peer as listed in the server's configuration
+pub struct ServerConfPeer<'a> {
+    pub public_key: &'a [u8; 32],
+    pub preshared_key: Option<&'a [u8; 32]>,
+    pub address: Ipv4Addr,
+    /// The peer's IPv6 address, if it has one
+    pub address6: Option<Ipv6Addr>,
+    pub endpoint: Option<SocketAddr>,
+}
+
+/// Render the server's interface and peers as `wg showconf` does, so the
+/// output can be loaded with `wg setconf`. The private key is left out if
+/// not given.
+pub fn render_showconf(
+    listen_port: u16,
+    private_key: Option<&[u8; 32]>,
+    peers: &[ServerConfPeer],
+) -> String {
+    let b64 = &base64::engine::general_purpose::STANDARD;
+    let mut conf = String::new();
+    let _ = writeln!(conf, "[Interface]");
+    let _ = writeln!(conf, "ListenPort = {}", listen_port);
+    if let Some(private_key) = private_key {
+        let _ = writeln!(conf, "PrivateKey = {}", b64.encode(private_key));
+    }
+    for peer in peers {
+        let _ = writeln!(conf);
+        let _ = writeln!(conf, "[Peer]");
+        let _ = writeln!(conf, "PublicKey = {}", b64.encode(peer.public_key));
+        if let Some(preshared_key) = peer.preshared_key {
+            let _ = writeln!(conf, "PresharedKey = {}", b64.encode(preshared_key));
+        }
+        match peer.address6 {
+            Some(address6) => {
+                let _ = writeln!(conf, "AllowedIPs = {}/32, {}/128", peer.address, address6);
+            }
+            None => {
+                let _ = writeln!(conf, "AllowedIPs = {}/32", peer.address);
+            }
+        }
+        if let Some(endpoint) = peer.endpoint {
+            let _ = writeln!(conf, "Endpoint = {}", endpoint);
+        }
+    }
+    conf
+}
+
+/// Settings read from a server's WireGuard or wg-quick config file
+#[derive(Debug, Default)]
+pub struct ParsedConf {
+    pub private_key: Option<[u8; 32]>,
+    pub listen_port: Option<u16>,
+    /// wg-quick `Address` of the interface, with its prefix length
+    pub address: Option<(Ipv4Addr, u8)>,
+    pub peers: Vec<ParsedPeer>,
+}
+
+#[derive(Debug)]
+pub struct ParsedPeer {
+    pub public_key: [u8; 32],
+    pub preshared_key: Option<[u8; 32]>,
+    /// The peer's single-address entry in `AllowedIPs`
+    pub address: Option<Ipv4Addr>,
+    /// `host:port` to reach the peer at, as in a client's config
+    pub endpoint: Option<String>,
+    pub persistent_keepalive: Option<u16>,
+}
+
+/// Parse an `[Interface]`/`[Peer]` config as read by `wg setconf` or wg-quick.
+///
+/// Settings with no equivalent here (routed subnets, hooks) are skipped
+/// with a warning.
+pub fn parse_conf(text: &str) -> Result<ParsedConf> {
+    enum Section {
+        None,
+        Interface,
+        Peer,
+    }
+
+    let mut conf = ParsedConf::default();
+    let mut section = Section::None;
+    let mut peer: Option<ParsedPeer> = None;
+
+    for (index, line) in text.lines().enumerate() {
+        let line_no = index + 1;
+        let line = line.split('#').next().unwrap_or("").trim();
+        if line.is_empty() {
+            continue;
+        }
+        if line.starts_with('[') {
+            conf.peers.extend(peer.take());
+            section = match line.to_ascii_lowercase().as_str() {
+                "[interface]" => Section::Interface,
+                "[peer]" => Section::Peer,
+                _ => anyhow::bail!("line {}: unknown section {}", line_no, line),
+            };
+            continue;
+        }
+
+        let (key, value) = line
+            .split_once('=')
+            .with_context(|| format!("line {}: expected `Key = Value`", line_no))?;
+        let key = key.trim().to_ascii_lowercase();
+        let value = value.trim();
+        match (&section, key.as_str()) {
+            (Section::Interface, "privatekey") => {
+                conf.private_key = Some(decode_key(value).with_context(|| {
+                    format!("line {}: invalid PrivateKey", line_no)
+                })?);
+            }
+            (Section::Interface, "listenport") => {
+                conf.listen_port = Some(
+                    value
+                        .parse::<u16>()
+                        .with_context(|| format!("line {}: invalid ListenPort", line_no))?,
+                );
+            }
+            (Section::Interface, "address") => {
+                for entry in value.split(',').map(str::trim) {
+                    if let Some(address) = parse_ipv4_net(entry) {
+                        conf.address.get_or_insert(address);
+                    }
+                }
+            }
+            (Section::Peer, "publickey") => {
+                let public_key = decode_key(value)
+                    .with_context(|| format!("line {}: invalid PublicKey", line_no))?;
+                conf.peers.extend(peer.take());
+                peer = Some(ParsedPeer {
+                    public_key,
+                    preshared_key: None,
+                    address: None,
+                    endpoint: None,
+                    persistent_keepalive: None,
+                });
+            }
+            (Section::Peer, "presharedkey" | "allowedips" | "endpoint" | "persistentkeepalive")
+                if peer.is_none() =>
+            {
+                anyhow::bail!("line {}: PublicKey must come first in a [Peer]", line_no);
+            }
+            (Section::Peer, "presharedkey") => {
+                let preshared_key = decode_key(value)
+                    .with_context(|| format!("line {}: invalid PresharedKey", line_no))?;
+                if let Some(peer) = &mut peer {
+                    peer.preshared_key = Some(preshared_key);
+                }
+            }
+            (Section::Peer, "endpoint") => {
+                if let Some(peer) = &mut peer {
+                    peer.endpoint = Some(value.to_string());
+                }
+            }
+            (Section::Peer, "persistentkeepalive") => {
+                let keepalive = match value {
+                    "off" => 0,
+                    _ => value.parse::<u16>().with_context(|| {
+                        format!("line {}: invalid PersistentKeepalive", line_no)
+                    })?,
+                };
+                if let Some(peer) = &mut peer {
+                    peer.persistent_keepalive = (keepalive > 0).then_some(keepalive);
+                }
+            }
+            (Section::Peer, "allowedips") => {
+                for entry in value.split(',').map(str::trim).filter(|e| !e.is_empty()) {
+                    let Some(peer) = &mut peer else { break };
+                    match parse_ipv4_net(entry) {
+                        Some((address, 32)) if peer.address.is_none() => {
+                            peer.address = Some(address);
+                        }
+                        _ => tracing::warn!(
+                            "line {}: ignoring AllowedIPs entry {}; only one address per peer is supported",
+                            line_no,
+                            entry
+                        ),
+                    }
+                }
+            }
+            (Section::None, _) => {
+                anyhow::bail!("line {}: setting outside of a section", line_no);
+            }
+            _ => tracing::warn!("line {}: ignoring unsupported setting {}", line_no, key),
+        }
+    }
+    conf.peers.extend(peer);
+    Ok(conf)
+}
+
+pub fn decode_key(value: &str) -> Option<[u8; 32]> {
+    let bytes = base64::engine::general_purpose::STANDARD.decode(value).ok()?;
+    bytes.try_into().ok()
+}
+
+/// Parse `a.b.c.d[/len]`; a bare address is a /32
+fn parse_ipv4_net(entry: &str) -> Option<(Ipv4Addr, u8)> {
+    let (address, prefix_len) = match entry.split_once('/') {
+        Some((address, prefix_len)) => (address, prefix_len.parse().ok()?),
+        None => (entry, 32),
+    };
+    (prefix_len <= 32).then_some((address.parse().ok()?, prefix_len))
+}
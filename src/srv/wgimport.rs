@@ -0,0 +1,130 @@
+//! Importing peers from an existing WireGuard server config
+//!
+//! `--wg-config` loads the interface settings and peer list of a `wg` or
+//! wg-quick config at startup, so existing servers can move over without
+//! re-provisioning clients. The file can be reloaded through the admin API;
+//! peers it no longer lists are removed, while peers that registered through
+//! the API are left alone.
+
+use std::collections::HashSet;
+use std::path::PathBuf;
+
+use anyhow::{Context, Result};
+use parking_lot::Mutex;
+use tracing::{info, warn};
+
+use super::events::encode_key;
+use super::flow::PortForwardRule;
+use super::state::{PeerOptions, SharedState};
+use super::wgconf::{self, ParsedConf};
+
+/// What applying the config changed
+#[derive(Default)]
+pub struct ImportResult {
+    /// Peers added or updated from the file
+    pub applied: usize,
+    /// Peers in the file that could not be added
+    pub skipped: usize,
+    /// Peers removed because the file no longer lists them
+    pub removed: usize,
+    /// Port forwards of removed peers
+    pub removed_rules: Vec<PortForwardRule>,
+}
+
+pub struct WgConfigImport {
+    path: PathBuf,
+    /// Interface settings at startup, which a reload cannot change
+    private_key: Option<[u8; 32]>,
+    listen_port: Option<u16>,
+    /// Peers that came from the file
+    imported: Mutex<HashSet<[u8; 32]>>,
+}
+
+impl WgConfigImport {
+    /// Read and parse the config, returning it for startup settings
+    pub fn load(path: impl Into<PathBuf>) -> Result<(Self, ParsedConf)> {
+        let path = path.into();
+        let conf = read(&path)?;
+        let import = Self {
+            path,
+            private_key: conf.private_key,
+            listen_port: conf.listen_port,
+            imported: Mutex::new(HashSet::new()),
+        };
+        Ok((import, conf))
+    }
+
+    /// Add or update the config's peers, removing earlier imports it dropped
+    pub fn apply(&self, shared: &SharedState, conf: &ParsedConf) -> ImportResult {
+        let mut result = ImportResult::default();
+        let mut imported = self.imported.lock();
+        let mut listed = HashSet::new();
+
+        for peer in &conf.peers {
+            let Some(address) = peer.address else {
+                warn!(
+                    "Skipping imported peer {} with no single-address AllowedIPs entry",
+                    encode_key(&peer.public_key)
+                );
+                result.skipped += 1;
+                continue;
+            };
+            let options = PeerOptions {
+                name: None,
+                address: Some(address),
+                preshared_key: peer.preshared_key,
+                tags: None,
+            };
+            match shared.add_peer(peer.public_key, options) {
+                Ok(_) => {
+                    listed.insert(peer.public_key);
+                    result.applied += 1;
+                }
+                Err(e) => {
+                    warn!(
+                        "Skipping imported peer {} at {}: {}",
+                        encode_key(&peer.public_key),
+                        address,
+                        e.message()
+                    );
+                    result.skipped += 1;
+                }
+            }
+        }
+
+        for public_key in imported.difference(&listed) {
+            if let Some((_, rules)) = shared.remove_peer(public_key) {
+                result.removed += 1;
+                result.removed_rules.extend(rules);
+            }
+        }
+        *imported = listed;
+        result
+    }
+
+    /// Re-read the file and apply its peers
+    pub fn reload(&self, shared: &SharedState) -> Result<ImportResult> {
+        let conf = read(&self.path)?;
+        if conf.private_key != self.private_key || conf.listen_port != self.listen_port {
+            warn!(
+                "{} changed interface settings; restart wirecagesrv to apply them",
+                self.path.display()
+            );
+        }
+        let result = self.apply(shared, &conf);
+        info!(
+            "Reloaded {}: {} peers applied, {} skipped, {} removed",
+            self.path.display(),
+            result.applied,
+            result.skipped,
+            result.removed
+        );
+        Ok(result)
+    }
+}
+
+fn read(path: &std::path::Path) -> Result<ParsedConf> {
+    let text = std::fs::read_to_string(path)
+        .with_context(|| format!("failed to read {}", path.display()))?;
+    wgconf::parse_conf(&text).with_context(|| format!("failed to parse {}", path.display()))
+}
@@ -0,0 +1,111 @@
+//! WireGuard's handshake MACs, shared by the client and the server
+//!
+//! Every handshake initiation and response ends in a mac1 keyed with its
+//! receiver's public key, then a mac2 keyed with a cookie. Rewriting a
+//! message's header, as obfuscation does, means making its mac1 again.
+//! BLAKE2s comes from the same crate gotatun makes and checks the MACs with.
+
+use blake2::digest::consts::U16;
+use blake2::digest::{Digest, Mac};
+use blake2::{Blake2s256, Blake2sMac};
+
+/// mac1 and mac2, which end every handshake message
+const MACS_LEN: usize = 32;
+
+const LABEL_MAC1: &[u8] = b"mac1----";
+
+/// Whether a handshake initiation or response's mac1 was made for
+/// `public_key`, its receiver's
+pub fn mac1_matches(msg: &[u8], public_key: &[u8; 32]) -> bool {
+    let Some(offset) = msg.len().checked_sub(MACS_LEN) else {
+        return false;
+    };
+    let mac1 = make_mac1(&msg[..offset], public_key);
+    constant_time_eq(&mac1, &msg[offset..offset + 16])
+}
+
+/// Make a handshake initiation or response's mac1 again for `public_key`,
+/// as after its header is rewritten. Leaves mac2 as it was.
+pub fn seal_mac1(msg: &mut [u8], public_key: &[u8; 32]) {
+    let Some(offset) = msg.len().checked_sub(MACS_LEN) else {
+        return;
+    };
+    let mac1 = make_mac1(&msg[..offset], public_key);
+    msg[offset..offset + 16].copy_from_slice(&mac1);
+}
+
+fn make_mac1(covered: &[u8], public_key: &[u8; 32]) -> [u8; 16] {
+    mac(&hash(LABEL_MAC1, public_key), &[covered])
+}
+
+/// BLAKE2s-256 of `label` followed by `key`, which WireGuard derives its
+/// mac1 and cookie keys with
+pub fn hash(label: &[u8], key: &[u8; 32]) -> [u8; 32] {
+    Blake2s256::new()
+        .chain_update(label)
+        .chain_update(key)
+        .finalize()
+        .into()
+}
+
+/// WireGuard's MAC: BLAKE2s keyed with `key`, cut to 16 bytes, of the
+/// concatenated `input`
+pub fn mac(key: &[u8], input: &[&[u8]]) -> [u8; 16] {
+    let mut mac =
+        Blake2sMac::<U16>::new_from_slice(key).expect("BLAKE2s takes keys up to 32 bytes");
+    for part in input {
+        Mac::update(&mut mac, part);
+    }
+    mac.finalize().into_bytes().into()
+}
+
+fn constant_time_eq(a: &[u8], b: &[u8]) -> bool {
+    a.len() == b.len() && a.iter().zip(b).fold(0u8, |acc, (x, y)| acc | (x ^ y)) == 0
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn blake2s_known_answers() {
+        // Checked against Python's hashlib.blake2s
+        assert_eq!(
+            hash(LABEL_MAC1, &[0; 32]),
+            hex("d84d593e94aac535d9107d24b9e4576f12a1d0c96b630c2961edee4259e3e3c5")[..]
+        );
+        let key: Vec<u8> = (0..32).collect();
+        assert_eq!(
+            mac(&key, &[b"a", b"bc"]),
+            hex("61ba5f165c194692e09d12520cc4c74a")[..]
+        );
+        let input: Vec<u8> = (0..64).collect();
+        assert_eq!(
+            mac(&key[..16], &[&input]),
+            hex("dd55c51c98f8ab96ed272882941f0b6a")[..]
+        );
+    }
+
+    #[test]
+    fn mac1_follows_the_header() {
+        let public_key = [7; 32];
+        let mut msg = vec![0x5a; 148];
+        msg[..4].copy_from_slice(&[1, 0, 0, 0]);
+        assert!(!mac1_matches(&msg, &public_key));
+        seal_mac1(&mut msg, &public_key);
+        assert!(mac1_matches(&msg, &public_key));
+        assert!(!mac1_matches(&msg, &[8; 32]));
+
+        msg[..4].copy_from_slice(&0x5a5a5a5au32.to_le_bytes());
+        assert!(!mac1_matches(&msg, &public_key));
+        seal_mac1(&mut msg, &public_key);
+        assert!(mac1_matches(&msg, &public_key));
+    }
+
+    fn hex(s: &str) -> Vec<u8> {
+        (0..s.len())
+            .step_by(2)
+            .map(|i| u8::from_str_radix(&s[i..i + 2], 16).unwrap())
+            .collect()
+    }
+}
@@ -2,22 +2,47 @@ use anyhow::{Context, Result};
 use base64::Engine;
 use gotatun::noise::Tunn;
 use std::net::SocketAddr;
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
 use std::sync::Arc;
+use std::time::{Duration, Instant};
 use tokio::net::{lookup_host, UdpSocket};
-use tokio::sync::Mutex;
-use tracing::debug;
+use tokio::sync::{mpsc, Mutex};
+use tracing::{debug, info, warn};
+use x25519_dalek::{PublicKey, StaticSecret};
+
+use crate::args::RelayMode;
+use crate::obfuscation::{Obfuscation, Params};
+use crate::relay::RelayConnection;
+
+/// WireGuard message types the transport watches for
+const HANDSHAKE_INITIATION: u8 = 1;
+const HANDSHAKE_RESPONSE: u8 = 2;
+
+/// How long a handshake over UDP may go unanswered before switching to the
+/// relay; long enough for two retries
+const RELAY_FALLBACK_AFTER: Duration = Duration::from_secs(12);
+/// How long a handshake may go unanswered before trying the endpoint's next
+/// address, when its name has several, as a cluster's may
+const FAILOVER_AFTER: Duration = Duration::from_secs(12);
+/// Wait after a failed relay connection before trying again
+const RELAY_RETRY_AFTER: Duration = Duration::from_secs(5);
+/// Messages queued to and from the relay
+const RELAY_QUEUE_LEN: usize = 256;
 
 pub struct WireGuardTunnel {
     tunnel: Arc<Mutex<Box<Tunn>>>,
-    socket: Arc<UdpSocket>,
-    endpoint: SocketAddr,
+    transport: Arc<Transport>,
 }
 
 impl WireGuardTunnel {
     pub async fn new_simple(
         private_key: &str,
         public_key: &str,
+        preshared_key: Option<&str>,
         endpoint: &str,
+        relay_url: Option<&str>,
+        relay_mode: RelayMode,
+        obfuscation: Option<&str>,
     ) -> Result<Self> {
         // Decode keys
         let private_key_bytes = base64::engine::general_purpose::STANDARD
@@ -41,10 +66,29 @@ impl WireGuardTunnel {
         let mut pub_key = [0u8; 32];
         pub_key.copy_from_slice(&public_key_bytes);
 
-        let endpoint = resolve_endpoint(endpoint).await?;
+        let preshared_key = match preshared_key {
+            Some(key) => {
+                let bytes = base64::engine::general_purpose::STANDARD
+                    .decode(key.trim())
+                    .context("invalid preshared key")?;
+                Some(<[u8; 32]>::try_from(bytes).map_err(|_| anyhow::anyhow!("preshared key must be 32 bytes"))?)
+            }
+            None => None,
+        };
+
+        let obfuscation = match obfuscation {
+            Some(params) => {
+                let params: Params = params.parse().context("invalid obfuscation parameters")?;
+                let own_public_key = PublicKey::from(&StaticSecret::from(priv_key));
+                Some(Obfuscation::new(params, pub_key, own_public_key.to_bytes()))
+            }
+            None => None,
+        };
+
+        let endpoints = resolve_endpoint(endpoint).await?;
 
         // Create tunnel
-        let tunnel = Tunn::new(priv_key.into(), pub_key.into(), None, None, 0, None);
+        let tunnel = Tunn::new(priv_key.into(), pub_key.into(), preshared_key, None, 0, None);
 
         // Create UDP socket
         let socket = UdpSocket::bind("0.0.0.0:0")
@@ -54,37 +98,239 @@ impl WireGuardTunnel {
         let local_addr = socket.local_addr()?;
         debug!(
             "WireGuard tunnel created, local: {}, endpoint: {}",
-            local_addr, endpoint
+            local_addr, endpoints[0]
         );
 
+        let relay_url = match relay_mode {
+            RelayMode::Never => None,
+            _ => relay_url.map(str::to_string),
+        };
+        let (relayed_tx, relayed_rx) = mpsc::channel(RELAY_QUEUE_LEN);
+
         Ok(Self {
             tunnel: Arc::new(Mutex::new(Box::new(tunnel))),
-            socket: Arc::new(socket),
-            endpoint,
+            transport: Arc::new(Transport {
+                socket,
+                endpoints,
+                current: AtomicUsize::new(0),
+                failovers: AtomicUsize::new(0),
+                relay_url,
+                relay_mode,
+                relay: std::sync::Mutex::new(None),
+                relayed_tx,
+                relayed_rx: Mutex::new(relayed_rx),
+                unanswered_since: std::sync::Mutex::new(None),
+                connecting: AtomicBool::new(false),
+                obfuscation,
+            }),
         })
     }
 
-    pub fn clone_socket(&self) -> Arc<UdpSocket> {
-        Arc::clone(&self.socket)
+    pub fn clone_transport(&self) -> Arc<Transport> {
+        Arc::clone(&self.transport)
     }
 
     pub fn clone_tunnel(&self) -> Arc<Mutex<Box<Tunn>>> {
         Arc::clone(&self.tunnel)
     }
+}
+
+/// Where the tunnel's WireGuard messages travel: over UDP to the endpoint,
+/// or through the server's relay once handshakes over UDP go unanswered
+pub struct Transport {
+    socket: UdpSocket,
+    /// Every address the endpoint resolved to
+    endpoints: Vec<SocketAddr>,
+    /// Index of the address in use
+    current: AtomicUsize,
+    /// Addresses moved on from since the last handshake response
+    failovers: AtomicUsize,
+    /// The relay to fall back to, unless the server has none or it is
+    /// turned off
+    relay_url: Option<String>,
+    relay_mode: RelayMode,
+    /// Queue of messages to the relay, while connected to it
+    relay: std::sync::Mutex<Option<mpsc::Sender<Vec<u8>>>>,
+    /// Messages received from the relay
+    relayed_tx: mpsc::Sender<Vec<u8>>,
+    relayed_rx: Mutex<mpsc::Receiver<Vec<u8>>>,
+    /// When the oldest handshake initiation still without a response was
+    /// sent
+    unanswered_since: std::sync::Mutex<Option<Instant>>,
+    /// Whether a relay connection is being made or in use
+    connecting: AtomicBool,
+    /// How messages are disguised, if the server obfuscates this peer
+    obfuscation: Option<Obfuscation>,
+}
+
+impl Transport {
+    pub fn local_addr(&self) -> std::io::Result<SocketAddr> {
+        self.socket.local_addr()
+    }
+
+    /// Send a WireGuard message to the server
+    pub async fn send(&self, data: &[u8]) -> std::io::Result<()> {
+        let initiation = data.first() == Some(&HANDSHAKE_INITIATION);
+        if initiation {
+            self.unanswered_since
+                .lock()
+                .unwrap()
+                .get_or_insert_with(Instant::now);
+        }
+        let encoded;
+        let data = match &self.obfuscation {
+            Some(obfuscation) => {
+                encoded = obfuscation.encode(data);
+                &encoded[..]
+            }
+            None => data,
+        };
+        let relay = self.relay.lock().unwrap().clone();
+        match relay {
+            Some(relay) => {
+                if relay.try_send(data.to_vec()).is_err() {
+                    debug!("Relay queue full or closed, dropping {} bytes", data.len());
+                }
+            }
+            None => {
+                let endpoint = self.endpoints[self.current.load(Ordering::Relaxed)];
+                if let Some(obfuscation) = self.obfuscation.as_ref().filter(|_| initiation) {
+                    for junk in obfuscation.junk() {
+                        self.socket.send_to(&junk, endpoint).await?;
+                    }
+                }
+                self.socket.send_to(data, endpoint).await?;
+            }
+        }
+        Ok(())
+    }
 
-    pub fn endpoint(&self) -> SocketAddr {
-        self.endpoint
+    /// Wait for the next WireGuard message from the server, over UDP or the
+    /// relay, returning its length. Obfuscated messages are turned back
+    /// into WireGuard's, and packets that aren't one are skipped.
+    pub async fn recv(&self, buf: &mut [u8]) -> std::io::Result<usize> {
+        let mut relayed = self.relayed_rx.lock().await;
+        loop {
+            let n = tokio::select! {
+                received = self.socket.recv_from(buf) => received?.0,
+                Some(message) = relayed.recv() => {
+                    let n = message.len().min(buf.len());
+                    buf[..n].copy_from_slice(&message[..n]);
+                    n
+                }
+            };
+            let n = match &self.obfuscation {
+                Some(obfuscation) => match obfuscation.decode(buf, n) {
+                    Some(n) => n,
+                    None => {
+                        debug!("Dropped {} bytes that are no obfuscated message", n);
+                        continue;
+                    }
+                },
+                None => n,
+            };
+            if n > 0 && buf[0] == HANDSHAKE_RESPONSE {
+                *self.unanswered_since.lock().unwrap() = None;
+                self.failovers.store(0, Ordering::Relaxed);
+            }
+            return Ok(n);
+        }
+    }
+
+    /// Move to the endpoint's next address, or to the relay once every
+    /// address has been tried, if handshakes over UDP have gone unanswered
+    /// for long enough; to the relay at once with `--relay always`. Called
+    /// on every timer tick.
+    pub fn check_fallback(self: &Arc<Self>) {
+        if self.check_failover() {
+            return;
+        }
+        let Some(url) = self.relay_url.clone() else {
+            return;
+        };
+        let due = self.relay_mode == RelayMode::Always
+            || self
+                .unanswered_since
+                .lock()
+                .unwrap()
+                .is_some_and(|since| since.elapsed() >= RELAY_FALLBACK_AFTER);
+        if !due || self.connecting.swap(true, Ordering::Relaxed) {
+            return;
+        }
+
+        let transport = Arc::clone(self);
+        tokio::spawn(async move {
+            match RelayConnection::connect(&url).await {
+                Ok(connection) => {
+                    match transport.relay_mode {
+                        RelayMode::Always => info!("Relaying WireGuard through {}", url),
+                        _ => info!("No handshake over UDP, relaying WireGuard through {}", url),
+                    }
+                    let (tx, rx) = mpsc::channel(RELAY_QUEUE_LEN);
+                    *transport.relay.lock().unwrap() = Some(tx);
+                    *transport.unanswered_since.lock().unwrap() = None;
+                    let result = connection.run(rx, transport.relayed_tx.clone()).await;
+                    *transport.relay.lock().unwrap() = None;
+                    match result {
+                        Ok(()) => info!("Relay connection closed, back to UDP"),
+                        Err(e) => warn!("Relay connection lost, back to UDP: {:#}", e),
+                    }
+                }
+                Err(e) => {
+                    warn!("Failed to connect to relay: {:#}", e);
+                    tokio::time::sleep(RELAY_RETRY_AFTER).await;
+                }
+            }
+            transport.connecting.store(false, Ordering::Relaxed);
+        });
+    }
+
+    /// Move to the endpoint's next address once handshakes to this one
+    /// have gone unanswered for long enough, returning whether addresses
+    /// are still being tried rather than the relay
+    fn check_failover(&self) -> bool {
+        if self.endpoints.len() < 2
+            || self.relay_mode == RelayMode::Always
+            || self.relay.lock().unwrap().is_some()
+        {
+            return false;
+        }
+        // With a relay to fall back to, each address is tried once first;
+        // without one, they are tried in turn until one answers
+        let tried = self.failovers.load(Ordering::Relaxed);
+        if self.relay_url.is_some() && tried + 1 >= self.endpoints.len() {
+            return false;
+        }
+        let mut unanswered_since = self.unanswered_since.lock().unwrap();
+        if unanswered_since.is_some_and(|since| since.elapsed() >= FAILOVER_AFTER) {
+            let next = (self.current.load(Ordering::Relaxed) + 1) % self.endpoints.len();
+            info!(
+                "No handshake from {}, trying {}",
+                self.endpoints[self.current.load(Ordering::Relaxed)],
+                self.endpoints[next]
+            );
+            self.current.store(next, Ordering::Relaxed);
+            self.failovers.store(tried + 1, Ordering::Relaxed);
+            *unanswered_since = None;
+        }
+        true
     }
 }
 
-async fn resolve_endpoint(endpoint: &str) -> Result<SocketAddr> {
+/// Every address of the endpoint of the first one's family, which is the
+/// one used first
+async fn resolve_endpoint(endpoint: &str) -> Result<Vec<SocketAddr>> {
     if let Ok(addr) = endpoint.parse::<SocketAddr>() {
-        return Ok(addr);
+        return Ok(vec![addr]);
     }
 
-    lookup_host(endpoint)
+    let mut addrs = lookup_host(endpoint)
         .await
-        .with_context(|| format!("failed to resolve endpoint `{}`", endpoint))?
+        .with_context(|| format!("failed to resolve endpoint `{}`", endpoint))?;
+    let first = addrs
         .next()
-        .with_context(|| format!("endpoint `{}` resolved to no addresses", endpoint))
+        .with_context(|| format!("endpoint `{}` resolved to no addresses", endpoint))?;
+    Ok(std::iter::once(first)
+        .chain(addrs.filter(|addr| addr.is_ipv4() == first.is_ipv4()))
+        .collect())
 }